@@ -0,0 +1,190 @@
+// C side of the Go bindings: unnarize.h takes plain function pointers and
+// a void* of user data, so each callback is a trampoline into an exported
+// Go function, with a cgo.Handle as the user data.
+//
+// The interpreter runs spawned coroutines and stepped runs on stacks of its
+// own. Go takes a callback on such a stack only on a thread it did not
+// create, so every call that can run script code goes to a thread of the
+// bridge's, one per interpreter, while the Go caller waits.
+
+#include <pthread.h>
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include "unnarize.h"
+#include "_cgo_export.h"
+
+typedef enum {
+    CALL_NEW,
+    CALL_FREE,
+    CALL_RUN,
+    CALL_START,
+    CALL_STEP
+} CallKind;
+
+typedef struct BridgeWorker {
+    pthread_t thread;
+    pthread_mutex_t lock;
+    pthread_cond_t wake;        // A call is waiting, or the worker is to quit
+    pthread_cond_t finished;    // The call is done
+    bool pending;
+    bool quit;
+    // The call and its results
+    CallKind kind;
+    UnnInterp* interp;
+    const char* source;
+    int64_t maxInstructions;
+    UnnValue* result;
+    bool ok;
+    UnnStepStatus status;
+} BridgeWorker;
+
+static void perform(BridgeWorker* w) {
+    switch (w->kind) {
+        case CALL_NEW:
+            w->interp = unnNew();
+            break;
+        case CALL_FREE:
+            unnFree(w->interp);
+            break;
+        case CALL_RUN:
+            w->ok = unnRun(w->interp, w->source, w->result);
+            break;
+        case CALL_START:
+            w->ok = unnStart(w->interp, w->source);
+            break;
+        case CALL_STEP:
+            w->status = unnStep(w->interp, w->maxInstructions, w->result);
+            break;
+    }
+}
+
+static void* workerMain(void* arg) {
+    BridgeWorker* w = arg;
+    pthread_mutex_lock(&w->lock);
+    for (;;) {
+        while (!w->pending && !w->quit) pthread_cond_wait(&w->wake, &w->lock);
+        if (w->quit) break;
+        pthread_mutex_unlock(&w->lock);
+        perform(w);
+        pthread_mutex_lock(&w->lock);
+        w->pending = false;
+        pthread_cond_broadcast(&w->finished);
+    }
+    pthread_mutex_unlock(&w->lock);
+    return NULL;
+}
+
+// Run the call set up in 'w' on its thread and wait for it. A Go callback
+// that calls back into the interpreter is on that thread already.
+static void submit(BridgeWorker* w) {
+    if (pthread_equal(pthread_self(), w->thread)) {
+        perform(w);
+        return;
+    }
+    pthread_mutex_lock(&w->lock);
+    w->pending = true;
+    pthread_cond_signal(&w->wake);
+    while (w->pending) pthread_cond_wait(&w->finished, &w->lock);
+    pthread_mutex_unlock(&w->lock);
+}
+
+BridgeWorker* bridgeNewWorker(void) {
+    BridgeWorker* w = calloc(1, sizeof(BridgeWorker));
+    if (!w) return NULL;
+    pthread_mutex_init(&w->lock, NULL);
+    pthread_cond_init(&w->wake, NULL);
+    pthread_cond_init(&w->finished, NULL);
+    if (pthread_create(&w->thread, NULL, workerMain, w) != 0) {
+        pthread_mutex_destroy(&w->lock);
+        pthread_cond_destroy(&w->wake);
+        pthread_cond_destroy(&w->finished);
+        free(w);
+        return NULL;
+    }
+    return w;
+}
+
+void bridgeFreeWorker(BridgeWorker* w) {
+    pthread_mutex_lock(&w->lock);
+    w->quit = true;
+    pthread_cond_signal(&w->wake);
+    pthread_mutex_unlock(&w->lock);
+    pthread_join(w->thread, NULL);
+    pthread_mutex_destroy(&w->lock);
+    pthread_cond_destroy(&w->wake);
+    pthread_cond_destroy(&w->finished);
+    free(w);
+}
+
+UnnInterp* bridgeNew(BridgeWorker* w) {
+    w->kind = CALL_NEW;
+    submit(w);
+    return w->interp;
+}
+
+void bridgeFree(BridgeWorker* w, UnnInterp* interp) {
+    w->kind = CALL_FREE;
+    w->interp = interp;
+    submit(w);
+}
+
+bool bridgeRun(BridgeWorker* w, UnnInterp* interp, const char* source, UnnValue* result) {
+    w->kind = CALL_RUN;
+    w->interp = interp;
+    w->source = source;
+    w->result = result;
+    submit(w);
+    return w->ok;
+}
+
+// A stepped run stays on the thread that started it, as unnStep requires
+bool bridgeStart(BridgeWorker* w, UnnInterp* interp, const char* source) {
+    w->kind = CALL_START;
+    w->interp = interp;
+    w->source = source;
+    submit(w);
+    return w->ok;
+}
+
+UnnStepStatus bridgeStep(BridgeWorker* w, UnnInterp* interp, int64_t maxInstructions, UnnValue* result) {
+    w->kind = CALL_STEP;
+    w->interp = interp;
+    w->maxInstructions = maxInstructions;
+    w->result = result;
+    submit(w);
+    return w->status;
+}
+
+static UnnValue callTrampoline(UnnInterp* interp, const UnnValue* args, int argCount, void* userData) {
+    return goUnnCall(interp, (UnnValue*)args, argCount, (uintptr_t)userData);
+}
+
+static void writeTrampoline(const char* data, size_t length, void* userData) {
+    goUnnWrite((char*)data, length, (uintptr_t)userData);
+}
+
+void bridgeRegisterFn(UnnInterp* interp, const char* name, uintptr_t handle) {
+    unnRegisterFn(interp, name, callTrampoline, (void*)handle);
+}
+
+// An empty module, replacing any of that name, for bridgeRegisterModuleFn
+// to fill: each function has a handle of its own
+void bridgeNewModule(UnnInterp* interp, const char* name) {
+    static const UnnModuleFn none[] = {{NULL, NULL}};
+    unnRegisterModule(interp, name, none, NULL);
+}
+
+void bridgeRegisterModuleFn(UnnInterp* interp, const char* module, const char* name, uintptr_t handle) {
+    unnRegisterModuleFn(interp, module, name, callTrampoline, (void*)handle);
+}
+
+void bridgeSetOutput(UnnInterp* interp, uintptr_t handle) {
+    if (handle == 0) unnSetOutput(interp, NULL, NULL);
+    else unnSetOutput(interp, writeTrampoline, (void*)handle);
+}
+
+// unnThrow formats its message; cgo can't call a variadic function
+UnnValue bridgeThrow(UnnInterp* interp, const char* message) {
+    return unnThrow(interp, "%s", message);
+}
@@ -0,0 +1,3 @@
+module github.com/gtkrshnaaa/unnarize/bindings/go
+
+go 1.21
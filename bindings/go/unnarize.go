@@ -0,0 +1,340 @@
+// Package unnarize runs Unnarize scripts inside a Go program, through the
+// C embedding API in core/include/unnarize.h.
+//
+// Build the library first, from the repository root:
+//
+//	make lib
+//
+// Each Interp runs its scripts on a thread of its own, so a Go function
+// may be called from anywhere in a script, spawned coroutines included.
+// An Interp has no locking of its own: calls on one must not overlap. Any
+// goroutine may use one, given a sync.Mutex around a shared Interp or one
+// Interp per goroutine.
+package unnarize
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../../core/include
+#cgo LDFLAGS: ${SRCDIR}/../../bin/libunnarize.a -lm -ldl -lpthread
+#include <stdint.h>
+#include <stdlib.h>
+#include "unnarize.h"
+
+typedef struct BridgeWorker BridgeWorker;
+
+BridgeWorker* bridgeNewWorker(void);
+void bridgeFreeWorker(BridgeWorker* w);
+UnnInterp* bridgeNew(BridgeWorker* w);
+void bridgeFree(BridgeWorker* w, UnnInterp* interp);
+bool bridgeRun(BridgeWorker* w, UnnInterp* interp, const char* source, UnnValue* result);
+bool bridgeStart(BridgeWorker* w, UnnInterp* interp, const char* source);
+UnnStepStatus bridgeStep(BridgeWorker* w, UnnInterp* interp, int64_t maxInstructions, UnnValue* result);
+void bridgeRegisterFn(UnnInterp* interp, const char* name, uintptr_t handle);
+void bridgeNewModule(UnnInterp* interp, const char* name);
+void bridgeRegisterModuleFn(UnnInterp* interp, const char* module, const char* name, uintptr_t handle);
+void bridgeSetOutput(UnnInterp* interp, uintptr_t handle);
+UnnValue bridgeThrow(UnnInterp* interp, const char* message);
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime/cgo"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// Interp is one interpreter with every built-in library loaded. Globals
+// persist across Run calls until Close.
+type Interp struct {
+	c       *C.UnnInterp
+	worker  *C.BridgeWorker // The thread scripts run on
+	handles []cgo.Handle
+	output  cgo.Handle // Of the *output scripts print to, or 0 for stdout
+	result  Value      // Of the last stepped run to finish
+	// The error the output writer gave during that run, if any
+	resultErr error
+	// The text of the last string a Func returned, which the interpreter
+	// copies only after the callback is back
+	returned *C.char
+}
+
+// Func is a Go function callable from scripts. A non-nil error is thrown
+// to the script as a catchable Error with its message. So is a TypeObject
+// result, such as an array argument handed back, since only the object's
+// type name reached Go.
+type Func func(args []Value) (Value, error)
+
+type registeredFn struct {
+	interp *Interp
+	fn     Func
+}
+
+// output is the writer SetOutput was given, with the first error it
+// returned; nothing more is written to it after one
+type output struct {
+	w   io.Writer
+	err error
+}
+
+// SetHashSeed fixes the seed of the string hash for every interpreter in
+// the process, so a map's keys come out in the same order on every run.
+// It fails once an interpreter has been created, as the seed is then in use.
+func SetHashSeed(seed uint32) error {
+	if !C.unnSetHashSeed(C.uint32_t(seed)) {
+		return errors.New("unnarize: the hash seed is already in use")
+	}
+	return nil
+}
+
+// New returns an interpreter, or an error when out of memory
+func New() (*Interp, error) {
+	worker := C.bridgeNewWorker()
+	if worker == nil {
+		return nil, errors.New("unnarize: can't start the interpreter's thread")
+	}
+	c := C.bridgeNew(worker)
+	if c == nil {
+		C.bridgeFreeWorker(worker)
+		return nil, errors.New("unnarize: out of memory")
+	}
+	return &Interp{c: c, worker: worker}, nil
+}
+
+// Close frees the interpreter. It must not be used after.
+func (i *Interp) Close() {
+	if i.c == nil {
+		return
+	}
+	C.bridgeFree(i.worker, i.c)
+	C.bridgeFreeWorker(i.worker)
+	i.c = nil
+	i.worker = nil
+	for _, h := range i.handles {
+		h.Delete()
+	}
+	i.handles = nil
+	if i.output != 0 {
+		i.output.Delete()
+		i.output = 0
+	}
+	freeText(i.returned)
+	i.returned = nil
+}
+
+func (i *Interp) lastError() error {
+	return errors.New(C.GoString(C.unnLastError(i.c)))
+}
+
+// Run compiles and runs source. The result is the value of a top-level
+// 'return', or nil. The error is a syntax or compile error, a throw
+// nothing caught, or else the first error the SetOutput writer returned.
+func (i *Interp) Run(source string) (Value, error) {
+	text := C.CString(source)
+	defer freeText(text)
+	var result C.UnnValue
+	if !C.bridgeRun(i.worker, i.c, text, &result) {
+		i.writeError()
+		return NilValue(), i.lastError()
+	}
+	v := fromC(result)
+	C.unnFreeValue(&result)
+	return v, i.writeError()
+}
+
+// Start compiles source as Run does but runs none of it: Step runs it a
+// slice at a time, for a host with an event loop of its own. The error is
+// a syntax or compile error, or another stepped run still unfinished.
+func (i *Interp) Start(source string) error {
+	text := C.CString(source)
+	defer freeText(text)
+	if !C.bridgeStart(i.worker, i.c, text) {
+		return i.lastError()
+	}
+	return nil
+}
+
+// Step runs at most maxInstructions bytecode instructions of the run Start
+// began and returns, keeping the run where it stopped for the next Step.
+// done is true once the run has finished, with its value in Result. The
+// error is what Run would report, or that there was no run to step. While
+// a run is paused Run and Start fail; globals can be read and set.
+func (i *Interp) Step(maxInstructions int) (done bool, err error) {
+	var result C.UnnValue
+	switch C.bridgeStep(i.worker, i.c, C.int64_t(maxInstructions), &result) {
+	case C.UNN_STEP_PAUSED:
+		return false, nil
+	case C.UNN_STEP_DONE:
+		i.result = fromC(result)
+		C.unnFreeValue(&result)
+		i.resultErr = i.writeError()
+		return true, nil
+	}
+	i.writeError()
+	return true, i.lastError()
+}
+
+// Result is the value of the last stepped run to finish: that of its
+// top-level 'return', or nil. The error is the first one the SetOutput
+// writer returned during that run.
+func (i *Interp) Result() (Value, error) {
+	return i.result, i.resultErr
+}
+
+// writeError takes the error the output writer returned since the last
+// call, so the next run starts without one
+func (i *Interp) writeError() error {
+	if i.output == 0 {
+		return nil
+	}
+	out := i.output.Value().(*output)
+	err := out.err
+	out.err = nil
+	if err != nil {
+		return fmt.Errorf("unnarize: writing output: %w", err)
+	}
+	return nil
+}
+
+// SetGlobal defines the global name as v, replacing any it had. The error
+// is for a TypeObject v, which only names the type of the script's object
+// and so can't be passed back; the global is left alone.
+func (i *Interp) SetGlobal(name string, v Value) error {
+	if v.typ == TypeObject {
+		return errObject(v)
+	}
+	cName := C.CString(name)
+	defer freeText(cName)
+	value, text := toC(v)
+	defer freeText(text)
+	C.unnSetGlobal(i.c, cName, value)
+	return nil
+}
+
+// GetGlobal is the value of the global name; ok is false when there is none
+func (i *Interp) GetGlobal(name string) (v Value, ok bool) {
+	cName := C.CString(name)
+	defer freeText(cName)
+	var out C.UnnValue
+	if !C.unnGetGlobal(i.c, cName, &out) {
+		return NilValue(), false
+	}
+	v = fromC(out)
+	C.unnFreeValue(&out)
+	return v, true
+}
+
+// RegisterFn makes fn a global function of scripts under name
+func (i *Interp) RegisterFn(name string, fn Func) {
+	h := cgo.NewHandle(&registeredFn{interp: i, fn: fn})
+	i.handles = append(i.handles, h)
+	cName := C.CString(name)
+	defer freeText(cName)
+	C.bridgeRegisterFn(i.c, cName, C.uintptr_t(h))
+}
+
+// RegisterModule makes fns a module of scripts under name, called as
+// name.fn(...) like the built-in libraries, replacing any module or global
+// it had
+func (i *Interp) RegisterModule(name string, fns map[string]Func) {
+	cName := C.CString(name)
+	defer freeText(cName)
+	C.bridgeNewModule(i.c, cName)
+	fnNames := make([]string, 0, len(fns))
+	for fnName := range fns {
+		fnNames = append(fnNames, fnName)
+	}
+	sort.Strings(fnNames)
+	for _, fnName := range fnNames {
+		h := cgo.NewHandle(&registeredFn{interp: i, fn: fns[fnName]})
+		i.handles = append(i.handles, h)
+		cFn := C.CString(fnName)
+		C.bridgeRegisterModuleFn(i.c, cName, cFn, C.uintptr_t(h))
+		freeText(cFn)
+	}
+}
+
+// SetMaxStack limits how deep calls nest in later runs, 1024 frames until
+// set. Going deeper raises a catchable "Stack overflow.". The error is for
+// a depth outside 1..1000000, which keeps the old one.
+func (i *Interp) SetMaxStack(frames int) error {
+	if frames < 1 || frames > 1000000 || !C.unnSetMaxStack(i.c, C.int(frames)) {
+		return fmt.Errorf("unnarize: stack depth %d is outside 1..1000000", frames)
+	}
+	return nil
+}
+
+// SetMaxHeap limits the heap of later runs to bytes, or lifts the limit
+// for 0. Going past it ends the run with an error no try/catch intercepts.
+func (i *Interp) SetMaxHeap(bytes uint64) {
+	C.unnSetMaxHeap(i.c, C.size_t(bytes))
+}
+
+// SetTimeout limits how long each later run may take, rounded up to the
+// millisecond, or lifts the limit for 0. Running past it ends the run as
+// SetMaxHeap's limit does.
+func (i *Interp) SetTimeout(d time.Duration) {
+	ms := d.Milliseconds()
+	if d > 0 && d%time.Millisecond != 0 {
+		ms++
+	}
+	C.unnSetTimeout(i.c, C.int64_t(ms))
+}
+
+// SetEval allows or forbids eval() in scripts; it is allowed until
+// forbidden. While it is, eval() throws a catchable Error.
+func (i *Interp) SetEval(enabled bool) {
+	C.unnSetEval(i.c, C.bool(enabled))
+}
+
+// SetOutput sends what scripts print to w, or to stdout again for nil.
+// The interpreter buffers it: w gets it in pieces, when the buffer fills,
+// when a script calls flush() and before Run returns. Once w returns an
+// error it gets nothing more until the run ends, and Run, or Result for a
+// stepped run, reports that error.
+func (i *Interp) SetOutput(w io.Writer) {
+	old := i.output
+	i.output = 0
+	if w != nil {
+		i.output = cgo.NewHandle(&output{w: w})
+	}
+	C.bridgeSetOutput(i.c, C.uintptr_t(i.output))
+	if old != 0 {
+		old.Delete()
+	}
+}
+
+//export goUnnCall
+func goUnnCall(interp *C.UnnInterp, args *C.UnnValue, argCount C.int, handle C.uintptr_t) C.UnnValue {
+	entry := cgo.Handle(handle).Value().(*registeredFn)
+	goArgs := make([]Value, int(argCount))
+	if argCount > 0 {
+		for k, arg := range unsafe.Slice(args, int(argCount)) {
+			goArgs[k] = fromC(arg)
+		}
+	}
+	result, err := entry.fn(goArgs)
+	if err == nil && result.typ == TypeObject {
+		err = errObject(result)
+	}
+	if err != nil {
+		message := C.CString(err.Error())
+		defer freeText(message)
+		return C.bridgeThrow(interp, message)
+	}
+	value, text := toC(result)
+	// The one before was copied when its callback returned
+	freeText(entry.interp.returned)
+	entry.interp.returned = text
+	return value
+}
+
+//export goUnnWrite
+func goUnnWrite(data *C.char, length C.size_t, handle C.uintptr_t) {
+	out := cgo.Handle(handle).Value().(*output)
+	if out.err == nil {
+		_, out.err = out.w.Write(C.GoBytes(unsafe.Pointer(data), C.int(length)))
+	}
+}
@@ -0,0 +1,482 @@
+package unnarize
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The hash seed can only be fixed before the first interpreter
+func TestMain(m *testing.M) {
+	if err := SetHashSeed(7); err != nil {
+		fmt.Fprintln(os.Stderr, "SetHashSeed() before New:", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func newInterp(t *testing.T) *Interp {
+	t.Helper()
+	interp, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(interp.Close)
+	return interp
+}
+
+// A Go function registered with RegisterFn, called from a script
+func ExampleInterp_RegisterFn() {
+	interp, err := New()
+	if err != nil {
+		panic(err)
+	}
+	defer interp.Close()
+
+	stock := map[string]int64{"apples": 3, "pears": 5}
+	interp.RegisterFn("lookup", func(args []Value) (Value, error) {
+		if len(args) != 1 {
+			return NilValue(), errors.New("lookup() expects a name")
+		}
+		name, ok := args[0].AsString()
+		if !ok {
+			return NilValue(), errors.New("lookup() expects a name")
+		}
+		return IntValue(stock[name]), nil
+	})
+
+	result, err := interp.Run(`return lookup("apples") + lookup("pears");`)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result.AsInt())
+
+	result, _ = interp.Run(`
+		try {
+			lookup(42);
+		} catch (e) {
+			return e.message;
+		}`)
+	message, _ := result.AsString()
+	fmt.Println(message)
+	// Output:
+	// 8
+	// lookup() expects a name
+}
+
+// A module of Go functions, called from a script as name.fn(...)
+func ExampleInterp_RegisterModule() {
+	interp, err := New()
+	if err != nil {
+		panic(err)
+	}
+	defer interp.Close()
+
+	var stock = map[string]int64{"apples": 3}
+	interp.RegisterModule("stock", map[string]Func{
+		"count": func(args []Value) (Value, error) {
+			name, _ := args[0].AsString()
+			return IntValue(stock[name]), nil
+		},
+		"add": func(args []Value) (Value, error) {
+			name, _ := args[0].AsString()
+			stock[name] += args[1].AsInt()
+			return NilValue(), nil
+		},
+	})
+
+	result, err := interp.Run(`
+		stock.add("apples", 2);
+		stock.add("pears", 4);
+		return stock.count("apples") + stock.count("pears");`)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(result.AsInt())
+
+	result, _ = interp.Run(`
+		try {
+			stock.remove("apples");
+		} catch (e) {
+			return e.message;
+		}`)
+	message, _ := result.AsString()
+	fmt.Println(message)
+	// Output:
+	// 9
+	// Undefined property 'remove' in module 'stock'.
+}
+
+func TestRunResults(t *testing.T) {
+	interp := newInterp(t)
+	tests := []struct {
+		source   string
+		typeName string
+		check    func(Value) bool
+	}{
+		{`return nil;`, "nil", func(v Value) bool { return v.Type() == TypeNil && !v.AsBool() }},
+		{`var x = 1;`, "nil", func(v Value) bool { return v.Type() == TypeNil }},
+		{`return 6 * 7;`, "int", func(v Value) bool { return v.AsInt() == 42 && v.AsNumber() == 42 && v.IsNumber() }},
+		{`return 7 / 2.0;`, "double", func(v Value) bool { return v.AsNumber() == 3.5 && v.AsInt() == 3 }},
+		{`return 1 < 2;`, "bool", func(v Value) bool { return v.AsBool() }},
+		{`return "naïve" + "!";`, "string", func(v Value) bool { s, ok := v.AsString(); return ok && s == "naïve!" }},
+		{`return [1, 2];`, "array", func(v Value) bool { return v.Type() == TypeObject && !v.IsNumber() && v.AsBool() }},
+		{`return {"a": 1};`, "map", func(v Value) bool { _, ok := v.AsString(); return !ok }},
+	}
+	for _, tt := range tests {
+		v, err := interp.Run(tt.source)
+		if err != nil {
+			t.Errorf("Run(%q) error = %v", tt.source, err)
+			continue
+		}
+		if v.TypeName() != tt.typeName || !tt.check(v) {
+			t.Errorf("Run(%q) = %+v (%s), want a %s", tt.source, v, v.TypeName(), tt.typeName)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	interp := newInterp(t)
+	for _, source := range []string{`var = 1;`, `throw Error("boom");`, `return missing;`} {
+		if _, err := interp.Run(source); err == nil {
+			t.Errorf("Run(%q) succeeded", source)
+		}
+	}
+	if _, err := interp.Run(`throw Error("boom");`); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Run() error = %v, want one naming the message", err)
+	}
+	// A failed run leaves the interpreter usable
+	if v, err := interp.Run(`return 1;`); err != nil || v.AsInt() != 1 {
+		t.Errorf("Run() after an error = %v, %v", v, err)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	interp := newInterp(t)
+	interp.SetGlobal("limit", IntValue(10))
+	interp.SetGlobal("ratio", NumberValue(0.5))
+	interp.SetGlobal("name", StringValue("host"))
+	interp.SetGlobal("verbose", BoolValue(true))
+	v, err := interp.Run(`return name + " " + (limit * ratio) + " " + verbose;`)
+	if s, _ := v.AsString(); err != nil || s != "host 5 true" {
+		t.Errorf("Run() = %q, %v", s, err)
+	}
+
+	if _, err := interp.Run(`var total = limit + 5; var label = "n=" + total;`); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := interp.GetGlobal("total"); !ok || v.AsInt() != 15 {
+		t.Errorf("GetGlobal(total) = %+v, %v", v, ok)
+	}
+	if v, ok := interp.GetGlobal("label"); !ok || v.TypeName() != "string" {
+		t.Errorf("GetGlobal(label) = %+v, %v", v, ok)
+	}
+	if _, ok := interp.GetGlobal("nowhere"); ok {
+		t.Error("GetGlobal(nowhere) found a global")
+	}
+
+	// Script ints are 64-bit: a wide one keeps every digit both ways
+	interp.SetGlobal("id", IntValue(1<<53+1))
+	if v, ok := interp.GetGlobal("id"); !ok || v.AsInt() != 1<<53+1 {
+		t.Errorf("GetGlobal(id) = %+v, %v", v, ok)
+	}
+	if v, err := interp.Run(`return id + 1;`); err != nil || v.AsInt() != 1<<53+2 {
+		t.Errorf("Run() with a wide int = %+v, %v", v, err)
+	}
+
+	// An object came over as its type name only, so it can't go back
+	list, err := interp.Run(`return [1, 2];`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := interp.SetGlobal("limit", list); err == nil || !strings.Contains(err.Error(), "array") {
+		t.Errorf("SetGlobal() of an array = %v, want an error naming it", err)
+	}
+	if v, ok := interp.GetGlobal("limit"); !ok || v.AsInt() != 10 {
+		t.Errorf("GetGlobal(limit) after the refused SetGlobal = %+v, %v", v, ok)
+	}
+}
+
+func TestRegisterFn(t *testing.T) {
+	interp := newInterp(t)
+	var seen []Value
+	interp.RegisterFn("record", func(args []Value) (Value, error) {
+		seen = append(seen, args...)
+		return IntValue(int64(len(args))), nil
+	})
+	interp.RegisterFn("greet", func(args []Value) (Value, error) {
+		name, _ := args[0].AsString()
+		return StringValue("hello " + name), nil
+	})
+	v, err := interp.Run(`
+		var n = record(1, 2.5, "three", nil, [4]) + record();
+		var parts = [];
+		for (var i = 0; i < 100; i++) {
+			push(parts, greet("#" + i));
+		}
+		return n + " " + parts[99];`)
+	if s, _ := v.AsString(); err != nil || s != "5 hello #99" {
+		t.Fatalf("Run() = %q, %v", s, err)
+	}
+	interp.RegisterFn("huge", func(args []Value) (Value, error) {
+		return IntValue(math.MinInt64), nil
+	})
+	v, err = interp.Run(`return huge();`)
+	if err != nil || v.AsInt() != math.MinInt64 {
+		t.Errorf("Run() of a Func returning a wide int = %+v, %v", v, err)
+	}
+	interp.RegisterFn("same", func(args []Value) (Value, error) {
+		return args[0], nil
+	})
+	v, err = interp.Run(`
+		var message = "";
+		try { same([1]); } catch (e) { message = e.message; }
+		return same(7) + " " + message;`)
+	if s, _ := v.AsString(); err != nil || s != "7 unnarize: can't pass an object (array) back to a script" {
+		t.Errorf("Run() of a Func returning its array argument = %q, %v", s, err)
+	}
+	want := []string{"int", "double", "string", "nil", "array"}
+	if len(seen) != len(want) {
+		t.Fatalf("callback saw %d arguments, want %d", len(seen), len(want))
+	}
+	for k, name := range want {
+		if seen[k].TypeName() != name {
+			t.Errorf("argument %d is a %s, want a %s", k, seen[k].TypeName(), name)
+		}
+	}
+}
+
+func TestRegisterModule(t *testing.T) {
+	interp := newInterp(t)
+	interp.RegisterModule("host", map[string]Func{
+		"name": func(args []Value) (Value, error) { return StringValue("first"), nil },
+	})
+	// Registering it again replaces the whole module
+	interp.RegisterModule("host", map[string]Func{
+		"version": func(args []Value) (Value, error) { return IntValue(2), nil },
+		"fail":    func(args []Value) (Value, error) { return NilValue(), errors.New("host refused") },
+	})
+	v, err := interp.Run(`
+		var name = "gone";
+		try { name = host.name(); } catch (e) {}
+		var failed = "";
+		try { host.fail(); } catch (e) { failed = e.message; }
+		return name + " " + host.version() + " " + failed + " " + typeof(host);`)
+	if s, _ := v.AsString(); err != nil || s != "gone 2 host refused module" {
+		t.Errorf("Run() = %q, %v", s, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	interp := newInterp(t)
+	if err := interp.SetMaxStack(0); err == nil {
+		t.Error("SetMaxStack(0) succeeded")
+	}
+	if err := interp.SetMaxStack(50); err != nil {
+		t.Fatal(err)
+	}
+	v, err := interp.Run(`
+		function down(n) { return 1 + down(n + 1); }
+		try { down(0); } catch (e) { return e.message; }`)
+	if s, _ := v.AsString(); err != nil || !strings.Contains(s, "Stack overflow") {
+		t.Errorf("Run() past SetMaxStack = %q, %v, want a caught stack overflow", s, err)
+	}
+
+	interp.SetTimeout(50 * time.Millisecond)
+	_, err = interp.Run(`try { while (true) {} } catch (e) { return "caught"; }`)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() past SetTimeout error = %v, want a timeout", err)
+	}
+	interp.SetTimeout(0)
+
+	interp.SetMaxHeap(2 * 1024 * 1024)
+	_, err = interp.Run(`
+		var hog = [];
+		try { while (true) { push(hog, "x" + length(hog) * 1000); } } catch (e) { return "caught"; }`)
+	if err == nil || !strings.Contains(err.Error(), "Heap limit") {
+		t.Errorf("Run() past SetMaxHeap error = %v, want the heap limit", err)
+	}
+	interp.SetMaxHeap(0)
+
+	// Lifting the limits leaves the interpreter usable
+	if v, err := interp.Run(`hog = nil; return 1;`); err != nil || v.AsInt() != 1 {
+		t.Errorf("Run() after the limits = %+v, %v", v, err)
+	}
+}
+
+func TestSetEval(t *testing.T) {
+	interp := newInterp(t)
+	if v, err := interp.Run(`return eval("6 * 7");`); err != nil || v.AsInt() != 42 {
+		t.Errorf("eval() = %+v, %v", v, err)
+	}
+	interp.SetEval(false)
+	v, err := interp.Run(`try { eval("1"); } catch (e) { return e.message; }`)
+	if s, _ := v.AsString(); err != nil || !strings.Contains(s, "eval() is disabled") {
+		t.Errorf("eval() while disabled = %q, %v", s, err)
+	}
+	interp.SetEval(true)
+	if v, err := interp.Run(`return eval("1 + 1");`); err != nil || v.AsInt() != 2 {
+		t.Errorf("eval() enabled again = %+v, %v", v, err)
+	}
+}
+
+func TestSetHashSeed(t *testing.T) {
+	newInterp(t)
+	if err := SetHashSeed(8); err == nil {
+		t.Error("SetHashSeed() succeeded after New")
+	}
+}
+
+func TestSetOutput(t *testing.T) {
+	interp := newInterp(t)
+	var out strings.Builder
+	interp.SetOutput(&out)
+	if _, err := interp.Run(`print("one"); print(1 + 1);`); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "one\n2\n" {
+		t.Errorf("output = %q", out.String())
+	}
+	interp.SetOutput(nil)
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("disk full")
+}
+
+// A writer's error comes back from Run, once, and stops the writes to it
+func TestSetOutputError(t *testing.T) {
+	interp := newInterp(t)
+	w := &failingWriter{}
+	interp.SetOutput(w)
+	_, err := interp.Run(`print("one"); flush(); print("two"); flush();`)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Run() error = %v, want the writer's", err)
+	}
+	if w.writes != 1 {
+		t.Errorf("writer called %d times after failing, want 1", w.writes)
+	}
+	if _, err := interp.Run(`return 1;`); err != nil {
+		t.Errorf("next Run() error = %v", err)
+	}
+	interp.SetOutput(nil)
+}
+
+// A spawned coroutine runs on a stack the interpreter made, which a Go
+// callback must survive
+func TestRegisterFnInCoroutine(t *testing.T) {
+	interp := newInterp(t)
+	interp.RegisterFn("double", func(args []Value) (Value, error) {
+		return IntValue(args[0].AsInt() * 2), nil
+	})
+	v, err := interp.Run(`
+		var results = channel();
+		function worker(n) {
+			send(results, double(n));
+		}
+		for (var n = 1; n <= 3; n++) {
+			spawn worker(n);
+		}
+		return recv(results) + recv(results) + recv(results);`)
+	if err != nil || v.AsInt() != 12 {
+		t.Errorf("Run() = %+v, %v", v, err)
+	}
+}
+
+// A Go function that runs a script of its own on the same interpreter
+func TestRegisterFnNested(t *testing.T) {
+	interp := newInterp(t)
+	interp.RegisterFn("inner", func(args []Value) (Value, error) {
+		return interp.Run(`return 40;`)
+	})
+	v, err := interp.Run(`return inner() + 2;`)
+	if err != nil || v.AsInt() != 42 {
+		t.Errorf("Run() = %+v, %v", v, err)
+	}
+}
+
+func TestStep(t *testing.T) {
+	interp := newInterp(t)
+	calls := 0
+	interp.RegisterFn("tick", func(args []Value) (Value, error) {
+		calls++
+		return IntValue(int64(calls)), nil
+	})
+	source := `
+		var total = 0;
+		for (var i = 1; i <= 1000; i++) {
+			total += i;
+			if (i % 100 == 0) {
+				tick();
+			}
+		}
+		return "total " + total;`
+	if err := interp.Start(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := interp.Start(source); err == nil {
+		t.Error("Start() succeeded while a run was paused")
+	}
+	steps := 0
+	for {
+		done, err := interp.Step(500)
+		if err != nil {
+			t.Fatalf("Step() error = %v", err)
+		}
+		steps++
+		if done {
+			break
+		}
+		// Globals can be read between steps
+		if _, ok := interp.GetGlobal("total"); !ok {
+			t.Fatal("GetGlobal(total) found nothing while paused")
+		}
+	}
+	if steps < 2 {
+		t.Errorf("the run took %d Step, want it paused at least once", steps)
+	}
+	result, err := interp.Result()
+	if s, _ := result.AsString(); s != "total 500500" || calls != 10 || err != nil {
+		t.Errorf("Result() = %q, %v after %d calls", s, err, calls)
+	}
+
+	// The stepped run's result matches Run's
+	v, err := interp.Run(source)
+	if s, _ := v.AsString(); err != nil || s != "total 500500" {
+		t.Errorf("Run() = %q, %v", s, err)
+	}
+	if done, err := interp.Step(10); !done || err == nil {
+		t.Errorf("Step() with no run = %v, %v, want an error", done, err)
+	}
+}
+
+func TestStepErrors(t *testing.T) {
+	interp := newInterp(t)
+	if err := interp.Start(`var = ;`); err == nil {
+		t.Error("Start() compiled a syntax error")
+	}
+	if err := interp.Start(`
+		var n = 0;
+		while (n < 50) {
+			n++;
+		}
+		throw Error("stopped at " + n);`); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for done := false; !done; {
+		done, err = interp.Step(20)
+	}
+	if err == nil || !strings.Contains(err.Error(), "stopped at 50") {
+		t.Errorf("Step() error = %v, want the thrown message", err)
+	}
+}
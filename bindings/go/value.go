@@ -0,0 +1,160 @@
+package unnarize
+
+/*
+#include <stdlib.h>
+#include "unnarize.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Type is what kind of value a Value holds, as UnnType in unnarize.h
+type Type int
+
+const (
+	TypeNil Type = iota
+	TypeBool
+	TypeInt
+	TypeDouble
+	TypeString
+	TypeObject // Array, map, function, struct instance...: only its type name is visible
+)
+
+// Value is a value passed between Go and a script. It is a copy: changing
+// it changes nothing in the interpreter. The zero Value is nil.
+type Value struct {
+	typ     Type
+	boolean bool
+	integer int64
+	number  float64
+	text    string // TypeString: the text, TypeObject: its type name
+}
+
+// NilValue is the script's nil, as is the zero Value
+func NilValue() Value { return Value{} }
+
+// BoolValue is true or false
+func BoolValue(b bool) Value { return Value{typ: TypeBool, boolean: b} }
+
+// IntValue is an int; scripts have the full int64 range
+func IntValue(n int64) Value { return Value{typ: TypeInt, integer: n} }
+
+// NumberValue is a double, even for a whole number such as 2.0
+func NumberValue(d float64) Value { return Value{typ: TypeDouble, number: d} }
+
+// StringValue is a string; it reaches a script as C text, so a NUL byte ends it
+func StringValue(s string) Value { return Value{typ: TypeString, text: s} }
+
+// Type is what kind of value v holds
+func (v Value) Type() Type { return v.typ }
+
+// IsNumber reports whether v is an int or a double
+func (v Value) IsNumber() bool { return v.typ == TypeInt || v.typ == TypeDouble }
+
+// AsNumber is an int or double as a float64, else 0
+func (v Value) AsNumber() float64 {
+	switch v.typ {
+	case TypeInt:
+		return float64(v.integer)
+	case TypeDouble:
+		return v.number
+	}
+	return 0
+}
+
+// AsInt is an int, or a double truncated, else 0
+func (v Value) AsInt() int64 {
+	switch v.typ {
+	case TypeInt:
+		return v.integer
+	case TypeDouble:
+		return int64(v.number)
+	}
+	return 0
+}
+
+// AsBool is v's truthiness: only nil and false are false
+func (v Value) AsBool() bool {
+	switch v.typ {
+	case TypeNil:
+		return false
+	case TypeBool:
+		return v.boolean
+	}
+	return true
+}
+
+// AsString is the text of a string; ok is false for any other type
+func (v Value) AsString() (s string, ok bool) {
+	if v.typ != TypeString {
+		return "", false
+	}
+	return v.text, true
+}
+
+// TypeName is the name typeof() uses for v
+func (v Value) TypeName() string {
+	switch v.typ {
+	case TypeBool:
+		return "bool"
+	case TypeInt:
+		return "int"
+	case TypeDouble:
+		return "double"
+	case TypeString:
+		return "string"
+	case TypeObject:
+		return v.text
+	}
+	return "nil"
+}
+
+// A Value from the C side; its strings are copied, not released
+func fromC(v C.UnnValue) Value {
+	switch v._type {
+	case C.UNN_BOOL:
+		return BoolValue(bool(C.unnAsBool(v)))
+	case C.UNN_INT:
+		return IntValue(int64(C.unnAsInt(v)))
+	case C.UNN_DOUBLE:
+		return NumberValue(float64(C.unnAsNumber(v)))
+	case C.UNN_STRING:
+		return StringValue(C.GoString(C.unnAsString(v)))
+	case C.UNN_OBJECT:
+		return Value{typ: TypeObject, text: C.GoString(C.unnTypeName(v))}
+	}
+	return NilValue()
+}
+
+// v for the C side. A string's text is a C copy, returned for the caller
+// to free once the interpreter has copied it in turn. Callers turn away an
+// object, which can't be made from Go (see errObject).
+func toC(v Value) (C.UnnValue, *C.char) {
+	switch v.typ {
+	case TypeBool:
+		return C.unnBool(C.bool(v.boolean)), nil
+	case TypeInt:
+		return C.unnInt(C.int64_t(v.integer)), nil
+	case TypeDouble:
+		return C.unnDouble(C.double(v.number)), nil
+	case TypeString:
+		text := C.CString(v.text)
+		return C.unnString(text), text
+	}
+	return C.unnNil(), nil
+}
+
+// The error for passing the object v to a script: a Value holds only its
+// type name
+func errObject(v Value) error {
+	return fmt.Errorf("unnarize: can't pass an object (%s) back to a script", v.TypeName())
+}
+
+func freeText(text *C.char) {
+	if text != nil {
+		C.free(unsafe.Pointer(text))
+	}
+}
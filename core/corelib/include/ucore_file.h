@@ -0,0 +1,9 @@
+#ifndef UCORE_FILE_H
+#define UCORE_FILE_H
+
+#include "vm.h"
+
+// Register the ucoreFile native library into the VM
+void registerUCoreFile(VM* vm);
+
+#endif // UCORE_FILE_H
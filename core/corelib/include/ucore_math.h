@@ -0,0 +1,9 @@
+#ifndef UCORE_MATH_H
+#define UCORE_MATH_H
+
+#include "vm.h"
+
+// Register the ucoreMath native library into the VM
+void registerUCoreMath(VM* vm);
+
+#endif // UCORE_MATH_H
@@ -0,0 +1,9 @@
+#ifndef UCORE_RANDOM_H
+#define UCORE_RANDOM_H
+
+#include "vm.h"
+
+// Register the ucoreRandom native library into the VM
+void registerUCoreRandom(VM* vm);
+
+#endif // UCORE_RANDOM_H
@@ -0,0 +1,12 @@
+#ifndef UCORE_REGEX_H
+#define UCORE_REGEX_H
+
+#include "vm.h"
+
+// Register the ucoreRegex native library and its regex_* globals
+void registerUCoreRegex(VM* vm);
+
+// Free the VM's compiled patterns (freeVM)
+void freeRegexCache(VM* vm);
+
+#endif // UCORE_REGEX_H
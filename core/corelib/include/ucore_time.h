@@ -0,0 +1,9 @@
+#ifndef UCORE_TIME_H
+#define UCORE_TIME_H
+
+#include "vm.h"
+
+// Register the ucoreTime native library into the VM
+void registerUCoreTime(VM* vm);
+
+#endif // UCORE_TIME_H
@@ -0,0 +1,156 @@
+#include "ucore_file.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+
+// Text files, read and written whole. Paths are relative to the script's
+// directory, like every other path a script hands to the runtime. Failures
+// throw a catchable Error naming the path as the script wrote it.
+
+static bool checkArgs(VM* vm, const char* name, Value* args, int argCount, int expected) {
+    if (argCount != expected) {
+        nativeError(vm, "ucoreFile.%s expects %d argument%s but got %d.",
+                    name, expected, expected == 1 ? "" : "s", argCount);
+        return false;
+    }
+    if (!IS_STRING(args[0])) {
+        nativeError(vm, "ucoreFile.%s expects a string path but got %s.", name, valueTypeName(args[0]));
+        return false;
+    }
+    if (expected == 2 && !IS_STRING(args[1])) {
+        nativeError(vm, "ucoreFile.%s expects string content but got %s.", name, valueTypeName(args[1]));
+        return false;
+    }
+    return true;
+}
+
+// Read the whole file into a malloc'd buffer; NULL after throwing
+static char* slurp(VM* vm, const char* name, Value pathArg, size_t* outLength) {
+    char* path = resolvePath(vm, AS_CSTRING(pathArg));
+    FILE* f = fopen(path, "rb");
+    free(path);
+    if (!f) {
+        nativeError(vm, "ucoreFile.%s could not open '%s': %s.", name, AS_CSTRING(pathArg), strerror(errno));
+        return NULL;
+    }
+
+    size_t capacity = 4096;
+    size_t length = 0;
+    char* buf = malloc(capacity);
+    size_t n;
+    while (buf && (n = fread(buf + length, 1, capacity - length, f)) > 0) {
+        length += n;
+        if (length == capacity) {
+            capacity *= 2;
+            char* grown = realloc(buf, capacity);
+            if (!grown) { free(buf); buf = NULL; }
+            else buf = grown;
+        }
+    }
+    bool failed = !buf || ferror(f);
+    int err = errno;
+    fclose(f);
+
+    if (failed) {
+        const char* reason = buf ? strerror(err) : "out of memory";
+        free(buf);
+        nativeError(vm, "ucoreFile.%s could not read '%s': %s.", name, AS_CSTRING(pathArg), reason);
+        return NULL;
+    }
+    *outLength = length;
+    return buf;
+}
+
+// Write (mode "wb") or append (mode "ab") the content argument
+static Value spill(VM* vm, const char* name, Value* args, const char* mode) {
+    char* path = resolvePath(vm, AS_CSTRING(args[0]));
+    FILE* f = fopen(path, mode);
+    free(path);
+    if (!f) {
+        return nativeError(vm, "ucoreFile.%s could not open '%s': %s.", name, AS_CSTRING(args[0]), strerror(errno));
+    }
+
+    ObjString* content = AS_STRING(args[1]);
+    size_t written = fwrite(content->chars, 1, content->length, f);
+    int err = errno;
+    // fclose flushes, so a full disk can surface here rather than in fwrite
+    if (fclose(f) != 0 && written == (size_t)content->length) {
+        written = 0;
+        err = errno;
+    }
+    if (written != (size_t)content->length) {
+        return nativeError(vm, "ucoreFile.%s could not write '%s': %s.", name, AS_CSTRING(args[0]), strerror(err));
+    }
+    return NIL_VAL;
+}
+
+// ucoreFile.readFile(path): the whole file as a string
+static Value file_readFile(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "readFile", args, argCount, 1)) return NIL_VAL;
+    size_t length;
+    char* buf = slurp(vm, "readFile", args[0], &length);
+    if (!buf) return NIL_VAL;
+    ObjString* s = internString(vm, buf, (int)length);
+    free(buf);
+    return OBJ_VAL(s);
+}
+
+// ucoreFile.readLines(path): an array of lines without their "\n" or
+// "\r\n"; a final newline does not add an empty line
+static Value file_readLines(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "readLines", args, argCount, 1)) return NIL_VAL;
+    size_t length;
+    char* buf = slurp(vm, "readLines", args[0], &length);
+    if (!buf) return NIL_VAL;
+
+    Array* lines = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(lines); // Root the array
+    size_t start = 0;
+    while (start < length) {
+        char* nl = memchr(buf + start, '\n', length - start);
+        size_t end = nl ? (size_t)(nl - buf) : length;
+        size_t lineEnd = end;
+        if (lineEnd > start && buf[lineEnd - 1] == '\r') lineEnd--;
+        arrayPush(vm, lines, OBJ_VAL(internString(vm, buf + start, (int)(lineEnd - start))));
+        start = end + 1;
+    }
+    vm->stackTop--;
+    free(buf);
+    return OBJ_VAL(lines);
+}
+
+// ucoreFile.writeFile(path, content): create or overwrite
+static Value file_writeFile(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "writeFile", args, argCount, 2)) return NIL_VAL;
+    return spill(vm, "writeFile", args, "wb");
+}
+
+// ucoreFile.appendFile(path, content): add to the end, creating the file
+static Value file_appendFile(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "appendFile", args, argCount, 2)) return NIL_VAL;
+    return spill(vm, "appendFile", args, "ab");
+}
+
+// ucoreFile.remove(path): delete a file
+static Value file_remove(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "remove", args, argCount, 1)) return NIL_VAL;
+    char* path = resolvePath(vm, AS_CSTRING(args[0]));
+    int rc = remove(path);
+    free(path);
+    if (rc != 0) {
+        return nativeError(vm, "ucoreFile.remove could not remove '%s': %s.", AS_CSTRING(args[0]), strerror(errno));
+    }
+    return NIL_VAL;
+}
+
+void registerUCoreFile(VM* vm) {
+    Module* mod = defineNativeModule(vm, "ucoreFile");
+    defineModuleAlias(vm, mod, "file");
+
+    defineNative(vm, mod->env, "readFile", file_readFile, 1);
+    defineNative(vm, mod->env, "readLines", file_readLines, 1);
+    defineNative(vm, mod->env, "writeFile", file_writeFile, 2);
+    defineNative(vm, mod->env, "appendFile", file_appendFile, 2);
+    defineNative(vm, mod->env, "remove", file_remove, 1);
+}
@@ -48,7 +48,7 @@ static void parseQueryString(VM* vm, Map* queryMap, const char* queryStr) {
             urlDecode(val, eq + 1);
             
             ObjString* valStr = internString(vm, val, (int)strlen(val));
-            mapSetStr(queryMap, key, (int)strlen(key), OBJ_VAL(valStr));
+            mapSetStr(vm, queryMap, key, (int)strlen(key), OBJ_VAL(valStr));
         }
         token = strtok(NULL, "&");
     }
@@ -82,7 +82,7 @@ static void parseHeaders(VM* vm, Map* headerMap, const char* request) {
             for (int i = 0; i < keyLen; i++) key[i] = tolower(key[i]);
             
             ObjString* valStr = internString(vm, valStart, valLen);
-            mapSetStr(headerMap, key, keyLen, OBJ_VAL(valStr));
+            mapSetStr(vm, headerMap, key, keyLen, OBJ_VAL(valStr));
         }
         
         line = end + 1;
@@ -178,17 +178,13 @@ static void json_serialize_val(Value v, char** buf, int* len, int* cap) {
                 Map* m = (Map*)o;
                 json_append(buf, len, cap, "{");
                 bool first = true;
-                for (int i = 0; i < TABLE_SIZE; i++) {
-                    MapEntry* e = m->buckets[i];
-                    while (e) {
-                         if (!first) json_append(buf, len, cap, ",");
-                         first = false;
-                         json_append(buf, len, cap, "\"");
-                         json_append(buf, len, cap, e->key); // Assume keys are strings
-                         json_append(buf, len, cap, "\":");
-                         json_serialize_val(e->value, buf, len, cap);
-                         e = e->next;
-                    }
+                for (MapEntry* e = mapFirstEntry(m); e; e = mapNextEntry(m, e)) {
+                     if (!first) json_append(buf, len, cap, ",");
+                     first = false;
+                     json_append(buf, len, cap, "\"");
+                     json_append(buf, len, cap, e->key); // Assume keys are strings
+                     json_append(buf, len, cap, "\":");
+                     json_serialize_val(e->value, buf, len, cap);
                 }
                 json_append(buf, len, cap, "}");
             } else {
@@ -230,14 +226,14 @@ static Value http_perform(VM* vm, const char* method, const char* url, const cha
     int port;
     
     if (!parseUrl(url, host, path, &port)) {
-        printf("Invalid URL or HTTPS not supported.\n");
+        writeOutputf(vm, "Invalid URL or HTTPS not supported.\n");
         return NIL_VAL; 
     }
     
     // DNS Resolve
     struct hostent* he = gethostbyname(host);
     if (!he) {
-        printf("Could not resolve host: %s\n", host);
+        writeOutputf(vm, "Could not resolve host: %s\n", host);
         return NIL_VAL; // null
     }
     
@@ -316,7 +312,7 @@ static Value http_perform(VM* vm, const char* method, const char* url, const cha
 
 static Value uhttp_get(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) {
-        printf("Error: ucoreHttp.get(url) expects url string.\n");
+        writeOutputf(vm, "Error: ucoreHttp.get(url) expects url string.\n");
         return NIL_VAL;
     }
     return http_perform(vm, "GET", AS_CSTRING(args[0]), NULL);
@@ -324,7 +320,7 @@ static Value uhttp_get(VM* vm, Value* args, int argCount) {
 
 static Value uhttp_post(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
-        printf("Error: ucoreHttp.post(url, body) expects url and body strings.\n");
+        writeOutputf(vm, "Error: ucoreHttp.post(url, body) expects url and body strings.\n");
         return NIL_VAL;
     }
     return http_perform(vm, "POST", AS_CSTRING(args[0]), AS_CSTRING(args[1]));
@@ -332,7 +328,7 @@ static Value uhttp_post(VM* vm, Value* args, int argCount) {
 
 static Value uhttp_put(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
-        printf("Error: ucoreHttp.put(url, body) expects url and body strings.\n");
+        writeOutputf(vm, "Error: ucoreHttp.put(url, body) expects url and body strings.\n");
         return NIL_VAL;
     }
     return http_perform(vm, "PUT", AS_CSTRING(args[0]), AS_CSTRING(args[1]));
@@ -340,7 +336,7 @@ static Value uhttp_put(VM* vm, Value* args, int argCount) {
 
 static Value uhttp_delete(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) {
-        printf("Error: ucoreHttp.delete(url) expects url string.\n");
+        writeOutputf(vm, "Error: ucoreHttp.delete(url) expects url string.\n");
         return NIL_VAL;
     }
     return http_perform(vm, "DELETE", AS_CSTRING(args[0]), NULL);
@@ -348,7 +344,7 @@ static Value uhttp_delete(VM* vm, Value* args, int argCount) {
 
 static Value uhttp_patch(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
-        printf("Error: ucoreHttp.patch(url, body) expects url and body strings.\n");
+        writeOutputf(vm, "Error: ucoreHttp.patch(url, body) expects url and body strings.\n");
         return NIL_VAL;
     }
     return http_perform(vm, "PATCH", AS_CSTRING(args[0]), AS_CSTRING(args[1]));
@@ -386,7 +382,7 @@ static StaticMount* g_static = NULL;
 static Value uhttp_use(VM* vm, Value* args, int argCount) {
     (void)vm;
     if (argCount != 1 || !IS_STRING(args[0])) {
-        printf("Error: ucoreHttp.use(handlerName) expects string.\n");
+        writeOutputf(vm, "Error: ucoreHttp.use(handlerName) expects string.\n");
         return BOOL_VAL(false);
     }
     
@@ -402,7 +398,7 @@ static Value uhttp_use(VM* vm, Value* args, int argCount) {
 static Value uhttp_static(VM* vm, Value* args, int argCount) {
     (void)vm;
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
-        printf("Error: ucoreHttp.static(urlPrefix, dirPath) expects 2 strings.\n");
+        writeOutputf(vm, "Error: ucoreHttp.static(urlPrefix, dirPath) expects 2 strings.\n");
         return BOOL_VAL(false);
     }
     
@@ -492,7 +488,7 @@ static bool matchRoute(const char* pattern, const char* path, VM* vm, Map* param
                 name[nameLen] = '\0';
                 
                 ObjString* valStr = internString(vm, valStart, valLen);
-                mapSetStr(paramsMap, name, nameLen, OBJ_VAL(valStr));
+                mapSetStr(vm, paramsMap, name, nameLen, OBJ_VAL(valStr));
             }
         } else {
             if (*p != *u) return false;
@@ -508,7 +504,7 @@ static bool matchRoute(const char* pattern, const char* path, VM* vm, Map* param
 static Value uhttp_route(VM* vm, Value* args, int argCount) {
     (void)vm;
     if (argCount != 3 || !IS_STRING(args[0]) || !IS_STRING(args[1]) || !IS_STRING(args[2])) {
-        printf("Error: ucoreHttp.route(method, path, handlerName) expects 3 strings.\n");
+        writeOutputf(vm, "Error: ucoreHttp.route(method, path, handlerName) expects 3 strings.\n");
         return BOOL_VAL(false);
     }
     
@@ -524,7 +520,7 @@ static Value uhttp_route(VM* vm, Value* args, int argCount) {
 
 static Value uhttp_listen(VM* vm, Value* args, int argCount) {
     if (argCount < 1 || !IS_INT(args[0])) {
-        printf("Error: ucoreHttp.listen(port, [handlerName]) expects int port.\n");
+        writeOutputf(vm, "Error: ucoreHttp.listen(port, [handlerName]) expects int port.\n");
         return BOOL_VAL(false);
     }
     
@@ -536,7 +532,7 @@ static Value uhttp_listen(VM* vm, Value* args, int argCount) {
         mainHandlerName = AS_CSTRING(args[1]);
         mainHandler = findFunctionByName(vm, mainHandlerName);
         if (!mainHandler) {
-             printf("Error: Handler function '%s' not found.\n", mainHandlerName);
+             writeOutputf(vm, "Error: Handler function '%s' not found.\n", mainHandlerName);
              return BOOL_VAL(false);
         }
     }
@@ -573,10 +569,10 @@ static Value uhttp_listen(VM* vm, Value* args, int argCount) {
         return BOOL_VAL(false);
     }
     
-    printf("Server listening on port %d...\n", port);
-    if (mainHandlerName) printf("Using main handler: %s\n", mainHandlerName);
-    else printf("Using router.\n");
-    fflush(stdout);
+    writeOutputf(vm, "Server listening on port %d...\n", port);
+    if (mainHandlerName) writeOutputf(vm, "Using main handler: %s\n", mainHandlerName);
+    else writeOutputf(vm, "Using router.\n");
+    flushOutput(vm);
     
     while (1) {
         if ((new_socket = accept(server_fd, (struct sockaddr *)&address, (socklen_t*)&addrlen)) < 0) {
@@ -654,27 +650,27 @@ static Value uhttp_listen(VM* vm, Value* args, int argCount) {
         // Build Request Map (Standard)
         Map* reqMap = newMap(vm);
         Value vMethod = OBJ_VAL(internString(vm, method, (int)strlen(method)));
-        mapSetStr(reqMap, "method", 6, vMethod);
+        mapSetStr(vm, reqMap, "method", 6, vMethod);
         
         Value vPath = OBJ_VAL(internString(vm, cleanPath, (int)strlen(cleanPath)));
-        mapSetStr(reqMap, "path", 4, vPath);
+        mapSetStr(vm, reqMap, "path", 4, vPath);
         
         // req.query - parsed query string
         Map* queryMap = newMap(vm);
         parseQueryString(vm, queryMap, queryStr);
-        mapSetStr(reqMap, "query", 5, OBJ_VAL(queryMap));
+        mapSetStr(vm, reqMap, "query", 5, OBJ_VAL(queryMap));
         
         // req.headers - parsed headers
         Map* headerMap = newMap(vm);
         parseHeaders(vm, headerMap, buffer);
-        mapSetStr(reqMap, "headers", 7, OBJ_VAL(headerMap));
+        mapSetStr(vm, reqMap, "headers", 7, OBJ_VAL(headerMap));
         
         // req.params - already populated by route matching
-        mapSetStr(reqMap, "params", 6, OBJ_VAL(paramsMap));
+        mapSetStr(vm, reqMap, "params", 6, OBJ_VAL(paramsMap));
 
         // req.body
         Value vBody = OBJ_VAL(internString(vm, body, (int)strlen(body)));
-        mapSetStr(reqMap, "body", 4, vBody);
+        mapSetStr(vm, reqMap, "body", 4, vBody);
         
         Value vReq = OBJ_VAL(reqMap);
         
@@ -758,22 +754,8 @@ static Value uhttp_listen(VM* vm, Value* args, int argCount) {
 
 
 void registerUCoreHttp(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreHttp", 9);
-    char* modName = modNameObj->chars; 
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName); 
-    mod->obj.isMarked = true; 
-    mod->obj.isPermanent = true; // PERMANENT ROOT
-    
-    // CRITICAL: Use ALLOCATE_OBJ for Environment to enable GC tracking
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL; // Globals
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true; // PERMANENT ROOT
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreHttp");
+    defineModuleAlias(vm, mod, "http");
     
     defineNative(vm, mod->env, "get", uhttp_get, 1);
     defineNative(vm, mod->env, "post", uhttp_post, 2);
@@ -785,7 +767,4 @@ void registerUCoreHttp(VM* vm) {
     defineNative(vm, mod->env, "route", uhttp_route, 3);
     defineNative(vm, mod->env, "use", uhttp_use, 1);
     defineNative(vm, mod->env, "static", uhttp_static, 2);
-    
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreHttp", vMod);
 }
@@ -3,6 +3,8 @@
 #include <stdlib.h>
 #include <string.h>
 #include <ctype.h>
+#include <errno.h>
+#include <math.h>
 #include <unistd.h>
 
 // ============================================================================
@@ -29,17 +31,31 @@ static ObjString* copyString(VM* vm, const char* chars, int length) {
 // JSON Parser
 // ============================================================================
 
+// Arrays and objects nested deeper than this are rejected, both ways,
+// instead of running the C stack out
+#define JSON_MAX_DEPTH 512
+
 typedef struct {
     const char* start;
     const char* current;
     VM* vm;
+    int depth;
     char errorMsg[256];
     bool hasError;
 } JsonParser;
 
 static void jsonError(JsonParser* parser, const char* msg) {
     if (parser->hasError) return;
-    snprintf(parser->errorMsg, sizeof(parser->errorMsg), "%s (at char %ld)", msg, (long)(parser->current - parser->start));
+    int line = 1, column = 1;
+    for (const char* p = parser->start; p < parser->current; p++) {
+        if (*p == '\n') {
+            line++;
+            column = 1;
+        } else {
+            column++;
+        }
+    }
+    snprintf(parser->errorMsg, sizeof(parser->errorMsg), "%s at line %d, column %d", msg, line, column);
     parser->hasError = true;
 }
 
@@ -67,6 +83,44 @@ static bool match(JsonParser* parser, char expected) {
 // Forward declarations of parsing functions
 static Value parseValue(JsonParser* parser);
 
+// Four hex digits of a \u escape, or -1
+static int parseHex4(const char* p) {
+    int code = 0;
+    for (int i = 0; i < 4; i++) {
+        char c = p[i];
+        code <<= 4;
+        if (c >= '0' && c <= '9') code |= c - '0';
+        else if (c >= 'a' && c <= 'f') code |= c - 'a' + 10;
+        else if (c >= 'A' && c <= 'F') code |= c - 'A' + 10;
+        else return -1;
+    }
+    return code;
+}
+
+// UTF-8 bytes of a code point; returns how many were written
+static int encodeUtf8(uint32_t code, char* out) {
+    if (code < 0x80) {
+        out[0] = (char)code;
+        return 1;
+    }
+    if (code < 0x800) {
+        out[0] = (char)(0xC0 | (code >> 6));
+        out[1] = (char)(0x80 | (code & 0x3F));
+        return 2;
+    }
+    if (code < 0x10000) {
+        out[0] = (char)(0xE0 | (code >> 12));
+        out[1] = (char)(0x80 | ((code >> 6) & 0x3F));
+        out[2] = (char)(0x80 | (code & 0x3F));
+        return 3;
+    }
+    out[0] = (char)(0xF0 | (code >> 18));
+    out[1] = (char)(0x80 | ((code >> 12) & 0x3F));
+    out[2] = (char)(0x80 | ((code >> 6) & 0x3F));
+    out[3] = (char)(0x80 | (code & 0x3F));
+    return 4;
+}
+
 static Value parseString(JsonParser* parser) {
     if (*parser->current != '"') {
         jsonError(parser, "Expected '\"'");
@@ -74,14 +128,18 @@ static Value parseString(JsonParser* parser) {
     }
     parser->current++; // skip opening quote
 
-    // Simple implementation: find closing quote, handle escapes manually if needed
-    // rigorous implementation would allocate a buffer.
-    // For now, we will scan to end, handle simple escapes, copy to new buffer.
-    
-    // First pass: calc length
+    // First pass: find the closing quote. Escapes never decode to more
+    // bytes than they take up, so the raw length bounds the buffer.
     const char* strStart = parser->current;
-    int len = 0;
-    while (*parser->current != '"' && *parser->current != '\0') {
+    while (*parser->current != '"') {
+        if (*parser->current == '\0') {
+            jsonError(parser, "Unterminated string");
+            return NIL_VAL;
+        }
+        if ((unsigned char)*parser->current < 0x20) {
+            jsonError(parser, "Control character in string");
+            return NIL_VAL;
+        }
         if (*parser->current == '\\') {
             parser->current++;
             if (*parser->current == '\0') {
@@ -90,50 +148,70 @@ static Value parseString(JsonParser* parser) {
             }
         }
         parser->current++;
-        len++;
-    }
-
-    if (*parser->current != '"') {
-        jsonError(parser, "Unterminated string");
-        return NIL_VAL;
     }
+    const char* strEnd = parser->current;
 
     // Allocate buffer
-    char* buffer = (char*)malloc(len + 1);
+    char* buffer = (char*)malloc(strEnd - strStart + 1);
     if (!buffer) {
         jsonError(parser, "Out of memory");
         return NIL_VAL;
     }
 
-    // copy
+    // Second pass: copy, decoding escapes
     const char* scan = strStart;
     char* dest = buffer;
-    while (scan < parser->current) {
-        if (*scan == '\\') {
-            scan++;
-            switch (*scan) {
-                case '"': *dest++ = '"'; break;
-                case '\\': *dest++ = '\\'; break;
-                case '/': *dest++ = '/'; break;
-                case 'b': *dest++ = '\b'; break;
-                case 'f': *dest++ = '\f'; break;
-                case 'n': *dest++ = '\n'; break;
-                case 'r': *dest++ = '\r'; break;
-                case 't': *dest++ = '\t'; break;
-                case 'u': 
-                    // skipping unicode for now... simply consume uXXXX
-                    scan += 4; 
-                    *dest++ = '?'; // placeholder
-                    break;
-                default: *dest++ = *scan; break;
+    while (scan < strEnd) {
+        if (*scan != '\\') {
+            *dest++ = *scan++;
+            continue;
+        }
+        parser->current = scan; // Errors point at the escape
+        scan++;
+        switch (*scan) {
+            case '"': *dest++ = '"'; break;
+            case '\\': *dest++ = '\\'; break;
+            case '/': *dest++ = '/'; break;
+            case 'b': *dest++ = '\b'; break;
+            case 'f': *dest++ = '\f'; break;
+            case 'n': *dest++ = '\n'; break;
+            case 'r': *dest++ = '\r'; break;
+            case 't': *dest++ = '\t'; break;
+            case 'u': {
+                int code = strEnd - scan > 4 ? parseHex4(scan + 1) : -1;
+                if (code < 0) {
+                    jsonError(parser, "Invalid \\u escape");
+                    free(buffer);
+                    return NIL_VAL;
+                }
+                scan += 4;
+                // Characters past U+FFFF come as a surrogate pair
+                if (code >= 0xD800 && code <= 0xDBFF) {
+                    int low = strEnd - scan > 6 && scan[1] == '\\' && scan[2] == 'u' ? parseHex4(scan + 3) : -1;
+                    if (low < 0xDC00 || low > 0xDFFF) {
+                        jsonError(parser, "Unpaired surrogate in \\u escape");
+                        free(buffer);
+                        return NIL_VAL;
+                    }
+                    code = 0x10000 + ((code - 0xD800) << 10) + (low - 0xDC00);
+                    scan += 6;
+                } else if (code >= 0xDC00 && code <= 0xDFFF) {
+                    jsonError(parser, "Unpaired surrogate in \\u escape");
+                    free(buffer);
+                    return NIL_VAL;
+                }
+                dest += encodeUtf8((uint32_t)code, dest);
+                break;
             }
-        } else {
-            *dest++ = *scan;
+            default:
+                jsonError(parser, "Invalid escape in string");
+                free(buffer);
+                return NIL_VAL;
         }
         scan++;
     }
     *dest = '\0';
-    parser->current++; // skip closing quote
+    parser->current = strEnd + 1; // skip closing quote
 
     ObjString* os = copyString(parser->vm, buffer, (int)(dest - buffer));
     free(buffer);
@@ -142,24 +220,44 @@ static Value parseString(JsonParser* parser) {
 
 static Value parseNumber(JsonParser* parser) {
     const char* start = parser->current;
+    bool isInt = true;
     if (*parser->current == '-') parser->current++;
+    if (!isdigit((unsigned char)*parser->current)) {
+        jsonError(parser, "Expected digit in number");
+        return NIL_VAL;
+    }
+    // No leading zeros: "0" alone, or a non-zero digit first
+    if (*parser->current == '0' && isdigit((unsigned char)parser->current[1])) {
+        jsonError(parser, "Leading zero in number");
+        return NIL_VAL;
+    }
     while (isdigit((unsigned char)*parser->current)) parser->current++;
-    
+
     // fraction
     if (*parser->current == '.') {
+        isInt = false;
         parser->current++;
+        if (!isdigit((unsigned char)*parser->current)) {
+            jsonError(parser, "Expected digit after '.'");
+            return NIL_VAL;
+        }
         while (isdigit((unsigned char)*parser->current)) parser->current++;
     }
 
     // exponent
     if (*parser->current == 'e' || *parser->current == 'E') {
+        isInt = false;
         parser->current++;
         if (*parser->current == '+' || *parser->current == '-') parser->current++;
+        if (!isdigit((unsigned char)*parser->current)) {
+            jsonError(parser, "Expected digit in exponent");
+            return NIL_VAL;
+        }
         while (isdigit((unsigned char)*parser->current)) parser->current++;
     }
 
     size_t len = parser->current - start;
-    
+
     // OPTIMIZATION: Use stack buffer for small numbers (most common case)
     char stackBuf[64];
     char* tmp = stackBuf;
@@ -170,51 +268,48 @@ static Value parseNumber(JsonParser* parser) {
     }
     memcpy(tmp, start, len);
     tmp[len] = '\0';
-    
-    // OPTIMIZATION: Check for float during scan instead of second loop
-    bool isInt = true;
-    for (const char* p = start; p < parser->current; p++) {
-        if (*p == '.' || *p == 'e' || *p == 'E') {
-            isInt = false; 
-            break;
-        }
-    }
 
+    // Integers too large for int64 fall back to the nearest double
     Value val;
-    if (isInt) {
-        long long v = strtoll(tmp, NULL, 10);
-        val = INT_VAL((int)v);
+    errno = 0;
+    long long n = isInt ? strtoll(tmp, NULL, 10) : 0;
+    if (isInt && errno != ERANGE) {
+        val = intValue(parser->vm, (int64_t)n);
     } else {
-        double v = strtod(tmp, NULL);
-        val = FLOAT_VAL(v);
+        val = FLOAT_VAL(strtod(tmp, NULL));
     }
     if (heapAlloc) free(tmp);
     return val;
 }
 
 static Value parseArray(JsonParser* parser) {
+    if (++parser->depth > JSON_MAX_DEPTH) {
+        jsonError(parser, "Nesting too deep");
+        return NIL_VAL;
+    }
     parser->current++; // skip '['
     Array* arr = newArray(parser->vm);
-    
+
     // GC Protection: While we fill this array, if GC triggers, 'arr' must be reachable.
     // In unnarize, 'newArray' puts it on heap, but it's not rooted yet unless passed to push() or something deeply?
     // Actually, 'newArray' links it into vm->objects.
     // If GC runs, it will sweep 'arr' unless it's marked.
     // We should push 'arr' to stack temporarily using `push(vm, val)`.
-    
+
     push(parser->vm, OBJ_VAL(arr)); // PROTECT
 
     skipWhitespace(parser);
     if (*parser->current == ']') {
         parser->current++;
         pop(parser->vm); // UNPROTECT
+        parser->depth--;
         return OBJ_VAL(arr);
     }
 
     while (true) {
         Value val = parseValue(parser);
         if (parser->hasError) break;
-        
+
         push(parser->vm, val); // Protect item
         arrayPush(parser->vm, arr, val);
         pop(parser->vm);       // Unprotect item
@@ -226,25 +321,31 @@ static Value parseArray(JsonParser* parser) {
         }
 
         if (!match(parser, ',')) {
-            jsonError(parser, "Expected ',' in array");
+            jsonError(parser, "Expected ',' or ']' in array");
             break;
         }
     }
 
     pop(parser->vm); // UNPROTECT arr
+    parser->depth--;
     return OBJ_VAL(arr);
 }
 
 static Value parseObject(JsonParser* parser) {
+    if (++parser->depth > JSON_MAX_DEPTH) {
+        jsonError(parser, "Nesting too deep");
+        return NIL_VAL;
+    }
     parser->current++; // skip '{'
     Map* map = newMap(parser->vm);
-    
+
     push(parser->vm, OBJ_VAL(map)); // PROTECT
 
     skipWhitespace(parser);
     if (*parser->current == '}') {
         parser->current++;
         pop(parser->vm); // UNPROTECT
+        parser->depth--;
         return OBJ_VAL(map);
     }
 
@@ -257,7 +358,7 @@ static Value parseObject(JsonParser* parser) {
 
         Value keyVal = parseString(parser);
         if (parser->hasError) break;
-        
+
         // key must be string
         ObjString* keyStr = AS_STRING(keyVal);
         push(parser->vm, keyVal); // Protect Key
@@ -276,7 +377,7 @@ static Value parseObject(JsonParser* parser) {
         }
 
         push(parser->vm, val); // Protect Val
-        mapSetStr(map, keyStr->chars, keyStr->length, val);
+        mapSetStr(parser->vm, map, keyStr->chars, keyStr->length, val);
         pop(parser->vm); // pop val
         pop(parser->vm); // pop key
 
@@ -287,12 +388,13 @@ static Value parseObject(JsonParser* parser) {
         }
 
         if (!match(parser, ',')) {
-            jsonError(parser, "Expected ',' in object");
+            jsonError(parser, "Expected ',' or '}' in object");
             break;
         }
     }
 
     pop(parser->vm); // UNPROTECT map
+    parser->depth--;
     return OBJ_VAL(map);
 }
 
@@ -305,7 +407,7 @@ static Value parseValue(JsonParser* parser) {
     if (c == '[') return parseArray(parser);
     if (c == '{') return parseObject(parser);
     if (isdigit((unsigned char)c) || c == '-') return parseNumber(parser);
-    
+
     if (strncmp(parser->current, "true", 4) == 0) {
         parser->current += 4;
         return BOOL_VAL(true);
@@ -319,43 +421,58 @@ static Value parseValue(JsonParser* parser) {
         return NIL_VAL;
     }
 
-    jsonError(parser, "Unexpected character");
+    jsonError(parser, c == '\0' ? "Unexpected end of input" : "Unexpected character");
     return NIL_VAL;
 }
 
+// Parse a whole JSON document. On failure returns false with the reason
+// in parser->errorMsg.
+static bool decodeJson(VM* vm, const char* text, JsonParser* parser, Value* result) {
+    parser->vm = vm;
+    parser->start = text;
+    parser->current = text;
+    parser->depth = 0;
+    parser->hasError = false;
+    parser->errorMsg[0] = '\0';
+
+    *result = parseValue(parser);
+    if (!parser->hasError) {
+        skipWhitespace(parser);
+        if (*parser->current != '\0') jsonError(parser, "Extra data after JSON value");
+    }
+    return !parser->hasError;
+}
+
 static Value jsonParse(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) {
-        return OBJ_VAL(copyString(vm, "Error: parse() expects a JSON string", 36)); 
+        return OBJ_VAL(copyString(vm, "Error: parse() expects a JSON string", 36));
         // Or return NIL and print error? Standard pattern is probably to error out or return nil
         // Let's print runtime error for now?
         // Actually, returning a result object or throwing would be better.
         // For simplicity, let's just return NIL if bad args.
     }
 
-    ObjString* jsonStr = AS_STRING(args[0]);
     JsonParser parser;
-    parser.vm = vm;
-    parser.start = jsonStr->chars;
-    parser.current = jsonStr->chars;
-    parser.hasError = false;
-    parser.errorMsg[0] = '\0';
-
-    Value result = parseValue(&parser);
-    
-    if (parser.hasError) {
+    Value result;
+    if (!decodeJson(vm, AS_CSTRING(args[0]), &parser, &result)) {
         // Return error as string? Or just print?
         // Let's just print to stderr and return NIL
-        printf("JSON Parse Error: %s\n", parser.errorMsg);
+        writeOutputf(vm, "JSON Parse Error: %s\n", parser.errorMsg);
         return NIL_VAL;
     }
-    
-    // Check if we consumed everything? 
-    skipWhitespace(&parser);
-    if (*parser.current != '\0') {
-         printf("JSON Parse Error: Extra data at end of JSON\n");
-         return NIL_VAL;
-    }
+    return result;
+}
 
+// json.decode(text): like ucoreJson.parse, but malformed input throws
+static Value jsonDecode(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_STRING(args[0])) {
+        return nativeError(vm, "json.decode() expects a JSON string.");
+    }
+    JsonParser parser;
+    Value result;
+    if (!decodeJson(vm, AS_CSTRING(args[0]), &parser, &result)) {
+        return nativeError(vm, "JSON parse error: %s.", parser.errorMsg);
+    }
     return result;
 }
 
@@ -368,9 +485,22 @@ typedef struct {
     size_t capacity;
     size_t length;
     VM* vm;
+    Obj* path[JSON_MAX_DEPTH]; // Arrays and maps being written, outermost first
+    int depth;
+    char errorMsg[128];
+    bool hasError;
 } JsonHeader;
 
-
+static void initHeader(JsonHeader* header, VM* vm, size_t capacity) {
+    header->vm = vm;
+    header->capacity = capacity;
+    header->length = 0;
+    header->buffer = (char*)malloc(header->capacity);
+    header->buffer[0] = '\0';
+    header->depth = 0;
+    header->errorMsg[0] = '\0';
+    header->hasError = false;
+}
 
 static void jsonAppend(JsonHeader* header, const char* str, size_t len) {
     if (header->length + len >= header->capacity) {
@@ -384,38 +514,122 @@ static void jsonAppend(JsonHeader* header, const char* str, size_t len) {
     header->buffer[header->length] = '\0';
 }
 
+static void stringifyError(JsonHeader* header, const char* msg) {
+    if (header->hasError) return;
+    snprintf(header->errorMsg, sizeof(header->errorMsg), "%s", msg);
+    header->hasError = true;
+}
+
+// Quoted string with '"', '\' and control characters escaped. Other bytes,
+// UTF-8 included, are copied as they are, in runs between escapes.
+static void stringifyString(JsonHeader* header, const char* chars, int length) {
+    jsonAppend(header, "\"", 1);
+    int run = 0;
+    for (int i = 0; i < length; i++) {
+        unsigned char c = (unsigned char)chars[i];
+        if (c >= 0x20 && c != '"' && c != '\\') continue;
+        jsonAppend(header, chars + run, i - run);
+        run = i + 1;
+        char esc[8];
+        switch (c) {
+            case '"':  jsonAppend(header, "\\\"", 2); break;
+            case '\\': jsonAppend(header, "\\\\", 2); break;
+            case '\b': jsonAppend(header, "\\b", 2); break;
+            case '\f': jsonAppend(header, "\\f", 2); break;
+            case '\n': jsonAppend(header, "\\n", 2); break;
+            case '\r': jsonAppend(header, "\\r", 2); break;
+            case '\t': jsonAppend(header, "\\t", 2); break;
+            default:
+                snprintf(esc, sizeof(esc), "\\u%04x", c);
+                jsonAppend(header, esc, 6);
+                break;
+        }
+    }
+    jsonAppend(header, chars + run, length - run);
+    jsonAppend(header, "\"", 1);
+}
+
+// Shortest form that parses back to the same double, always with a '.'
+// or exponent so it decodes as a double again
+static void stringifyDouble(JsonHeader* header, double d) {
+    if (isnan(d) || isinf(d)) {
+        stringifyError(header, "cannot encode NaN or infinity");
+        return;
+    }
+    char buf[40];
+    int len = 0;
+    for (int precision = 15; precision <= 17; precision++) {
+        len = snprintf(buf, sizeof(buf), "%.*g", precision, d);
+        if (strtod(buf, NULL) == d) break;
+    }
+    if (!strpbrk(buf, ".e")) len += snprintf(buf + len, sizeof(buf) - len, ".0");
+    jsonAppend(header, buf, len);
+}
+
 static void stringifyValue(JsonHeader* header, Value val);
 
+// Enter an array or map; fails on one already being written
+static bool enterContainer(JsonHeader* header, Obj* obj) {
+    for (int i = 0; i < header->depth; i++) {
+        if (header->path[i] == obj) {
+            stringifyError(header, "cyclic reference");
+            return false;
+        }
+    }
+    if (header->depth == JSON_MAX_DEPTH) {
+        stringifyError(header, "nesting too deep");
+        return false;
+    }
+    header->path[header->depth++] = obj;
+    return true;
+}
+
 static void stringifyArray(JsonHeader* header, Array* arr) {
+    if (!enterContainer(header, (Obj*)arr)) return;
     jsonAppend(header, "[", 1);
-    for (int i = 0; i < arr->count; i++) {
+    for (int i = 0; i < arr->count && !header->hasError; i++) {
         stringifyValue(header, arr->items[i]);
         if (i < arr->count - 1) jsonAppend(header, ",", 1);
     }
     jsonAppend(header, "]", 1);
+    header->depth--;
 }
 
 static void stringifyMap(JsonHeader* header, Map* map) {
+    if (!enterContainer(header, (Obj*)map)) return;
     jsonAppend(header, "{", 1);
     bool first = true;
-    for (int i = 0; i < TABLE_SIZE; i++) {
-        MapEntry* e = map->buckets[i];
-        while (e) {
-            if (!first) jsonAppend(header, ",", 1);
-            first = false;
-            
-            // Key
-            jsonAppend(header, "\"", 1);
-            jsonAppend(header, e->key, strlen(e->key)); // key is char*
-            jsonAppend(header, "\":", 2);
-            
-            // Value
-            stringifyValue(header, e->value);
-            
-            e = e->next;
+    for (MapEntry* e = mapFirstEntry(map); e && !header->hasError; e = mapNextEntry(map, e)) {
+        if (!first) jsonAppend(header, ",", 1);
+        first = false;
+
+        // Key: JSON keys are strings, so integer keys are written as text
+        if (e->isIntKey) {
+            char buf[32];
+            int len = snprintf(buf, sizeof(buf), "%lld", (long long)e->intKey);
+            stringifyString(header, buf, len);
+        } else {
+            stringifyString(header, e->key, e->keyLength);
         }
+        jsonAppend(header, ":", 1);
+
+        // Value
+        stringifyValue(header, e->value);
     }
     jsonAppend(header, "}", 1);
+    header->depth--;
+}
+
+// A set is written as an array of its elements
+static void stringifySet(JsonHeader* header, Map* set) {
+    if (!enterContainer(header, (Obj*)set)) return;
+    jsonAppend(header, "[", 1);
+    for (MapEntry* e = set->first; e && !header->hasError; e = e->after) {
+        stringifyValue(header, e->value);
+        if (e->after) jsonAppend(header, ",", 1);
+    }
+    jsonAppend(header, "]", 1);
+    header->depth--;
 }
 
 static void stringifyValue(JsonHeader* header, Value val) {
@@ -426,66 +640,52 @@ static void stringifyValue(JsonHeader* header, Value val) {
         else jsonAppend(header, "false", 5);
     } else if (IS_INT(val)) {
         char buf[32];
-        int len = snprintf(buf, sizeof(buf), "%d", AS_INT(val));
+        int len = snprintf(buf, sizeof(buf), "%lld", (long long)AS_INT(val));
         jsonAppend(header, buf, len);
     } else if (IS_FLOAT(val)) {
-        char buf[32];
-        int len = snprintf(buf, sizeof(buf), "%.14g", AS_FLOAT(val));
-        jsonAppend(header, buf, len);
+        stringifyDouble(header, AS_FLOAT(val));
     } else if (IS_STRING(val)) {
         ObjString* s = AS_STRING(val);
-        // OPTIMIZATION: Pre-calculate escaped length and batch write
-        int escapeCount = 0;
-        for (int i = 0; i < s->length; i++) {
-            char c = s->chars[i];
-            if (c == '"' || c == '\\' || c == '\n' || c == '\r' || c == '\t') escapeCount++;
-        }
-        
-        // Reserve space: quotes(2) + length + escapes
-        size_t needed = 2 + s->length + escapeCount;
-        if (header->length + needed >= header->capacity) {
-            while (header->length + needed >= header->capacity) header->capacity *= 2;
-            header->buffer = (char*)realloc(header->buffer, header->capacity);
-        }
-        
-        char* dest = header->buffer + header->length;
-        *dest++ = '"';
-        for (int i = 0; i < s->length; i++) {
-            char c = s->chars[i];
-            if (c == '"') { *dest++ = '\\'; *dest++ = '"'; }
-            else if (c == '\\') { *dest++ = '\\'; *dest++ = '\\'; }
-            else if (c == '\n') { *dest++ = '\\'; *dest++ = 'n'; }
-            else if (c == '\r') { *dest++ = '\\'; *dest++ = 'r'; }
-            else if (c == '\t') { *dest++ = '\\'; *dest++ = 't'; }
-            else { *dest++ = c; }
-        }
-        *dest++ = '"';
-        header->length = dest - header->buffer;
-        header->buffer[header->length] = '\0';
+        stringifyString(header, s->chars, s->length);
     } else if (IS_ARRAY(val)) {
         stringifyArray(header, (Array*)AS_OBJ(val));
     } else if (IS_MAP(val)) {
         stringifyMap(header, (Map*)AS_OBJ(val));
+    } else if (IS_SET(val)) {
+        stringifySet(header, (Map*)AS_OBJ(val));
+    } else {
+        char msg[64];
+        snprintf(msg, sizeof(msg), "cannot encode %s", valueTypeName(val));
+        stringifyError(header, msg);
+    }
+}
+
+// JSON text of a value as a new string, or a thrown error naming 'caller'
+static Value encodeJson(VM* vm, Value val, const char* caller) {
+    JsonHeader* header = malloc(sizeof(JsonHeader));
+    initHeader(header, vm, 1024); // OPTIMIZATION: Larger initial buffer
+    stringifyValue(header, val);
+
+    Value result;
+    if (header->hasError) {
+        result = nativeError(vm, "%s: %s.", caller, header->errorMsg);
     } else {
-        jsonAppend(header, "\"UnsupportedType\"", 17);
+        result = OBJ_VAL(copyString(vm, header->buffer, (int)header->length));
     }
+    free(header->buffer);
+    free(header);
+    return result;
 }
 
 static Value jsonStringify(VM* vm, Value* args, int argCount) {
     if (argCount < 1) return NIL_VAL;
-    
-    JsonHeader header;
-    header.vm = vm;
-    header.capacity = 1024; // OPTIMIZATION: Larger initial buffer
-    header.length = 0;
-    header.buffer = (char*)malloc(header.capacity);
-    header.buffer[0] = '\0';
-    
-    stringifyValue(&header, args[0]);
-    
-    ObjString* res = copyString(vm, header.buffer, (int)header.length);
-    free(header.buffer);
-    return OBJ_VAL(res);
+    return encodeJson(vm, args[0], "stringify()");
+}
+
+// json.encode(value): JSON text for nil, bools, numbers, strings, arrays and maps
+static Value jsonEncode(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "json.encode() takes 1 argument, got %d.", argCount);
+    return encodeJson(vm, args[0], "json.encode()");
 }
 
 // ============================================================================
@@ -496,10 +696,11 @@ static Value jsonRead(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) {
          return OBJ_VAL(copyString(vm, "Error: read(path) expects a file path string", 44));
     }
-    char* path = AS_CSTRING(args[0]);
+    char* path = resolvePath(vm, AS_CSTRING(args[0]));
     
     FILE* file = fopen(path, "rb");
     if (!file) {
+        free(path);
         return NIL_VAL; // File not found or err
     }
 
@@ -510,6 +711,7 @@ static Value jsonRead(VM* vm, Value* args, int argCount) {
     char* buffer = malloc(fileSize + 1);
     if (!buffer) {
         fclose(file);
+        free(path);
         return NIL_VAL;
     }
     
@@ -522,24 +724,18 @@ static Value jsonRead(VM* vm, Value* args, int argCount) {
     free(buffer);
     
     push(vm, OBJ_VAL(jsonStr));
-    
-    // Reuse parser logic manually
     JsonParser parser;
-    parser.vm = vm;
-    parser.start = jsonStr->chars;
-    parser.current = jsonStr->chars;
-    parser.hasError = false;
-    parser.errorMsg[0] = '\0';
-
-    Value result = parseValue(&parser);
-    
+    Value result;
+    bool ok = decodeJson(vm, jsonStr->chars, &parser, &result);
     pop(vm); // jsonStr
 
-    if (parser.hasError) {
-        printf("JSON Read Error: %s in %s\n", parser.errorMsg, path);
+    if (!ok) {
+        writeOutputf(vm, "JSON Read Error: %s in %s\n", parser.errorMsg, AS_CSTRING(args[0]));
+        free(path);
         return NIL_VAL;
     }
     
+    free(path);
     return result;
 }
 
@@ -548,31 +744,22 @@ static Value jsonWrite(VM* vm, Value* args, int argCount) {
         return BOOL_VAL(false);
     }
     
-    char* path = resolvePath(vm, AS_CSTRING(args[0]));
-    Value data = args[1];
-    
-    // Stringify
-    JsonHeader header;
-    header.vm = vm;
-    header.capacity = 128;
-    header.length = 0;
-    header.buffer = (char*)malloc(header.capacity);
-    header.buffer[0] = '\0';
-    
-    stringifyValue(&header, data);
+    Value text = encodeJson(vm, args[1], "write()");
+    if (vm->throwPending) return text;
+    push(vm, text);
     
+    char* path = resolvePath(vm, AS_CSTRING(args[0]));
     FILE* file = fopen(path, "w");
+    free(path);
     if (!file) {
-        free(header.buffer);
-        free(path);
+        pop(vm);
         return BOOL_VAL(false);
     }
     
     // OPTIMIZATION: Use fwrite for better performance than fprintf
-    fwrite(header.buffer, 1, header.length, file);
+    fwrite(AS_CSTRING(text), 1, AS_STRING(text)->length, file);
     fclose(file);
-    free(header.buffer);
-    free(path);
+    pop(vm);
     
     return BOOL_VAL(true);
 }
@@ -595,30 +782,16 @@ static Value jsonRemove(VM* vm, Value* args, int argCount) {
 // ============================================================================
 
 void registerUCoreJson(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreJson", 9);
-    char* modName = modNameObj->chars;
-    
-    // Create Module manually
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName);
-    mod->source = NULL;
-    mod->obj.isMarked = true; 
-    mod->obj.isPermanent = true; // PERMANENT ROOT
-    
-    // CRITICAL: Use ALLOCATE_OBJ for Environment to enable GC tracking
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true; // PERMANENT ROOT
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreJson");
+    defineModuleAlias(vm, mod, "json");
     
     // Protect module during native registration
     push(vm, OBJ_VAL(mod));
     
     defineNative(vm, mod->env, "parse", jsonParse, 1);
     defineNative(vm, mod->env, "stringify", jsonStringify, 1);
+    defineNative(vm, mod->env, "encode", jsonEncode, 1);
+    defineNative(vm, mod->env, "decode", jsonDecode, 1);
     
     defineNative(vm, mod->env, "read", jsonRead, 1);
     defineNative(vm, mod->env, "write", jsonWrite, 2);
@@ -626,7 +799,7 @@ void registerUCoreJson(VM* vm) {
     
     pop(vm); // unprotect
     
-    // Define global 'ucoreJson'
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreJson", vMod);
+    // Deprecated flat spellings of json.encode and json.decode
+    defineNative(vm, vm->globalEnv, "json_encode", jsonEncode, 1);
+    defineNative(vm, vm->globalEnv, "json_decode", jsonDecode, 1);
 }
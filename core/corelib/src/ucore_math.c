@@ -0,0 +1,108 @@
+#include "ucore_math.h"
+#include <math.h>
+
+#define UMATH_PI 3.14159265358979323846
+#define UMATH_E  2.71828182845904523536
+
+// Every function takes numbers (int or double) and raises a catchable
+// Error on a wrong argument count or type. Results outside a function's
+// domain follow IEEE 754: sqrt(-1) is NaN, log(0) is -inf.
+
+// Validate argCount and that each argument is numeric; false after raising
+static bool checkArgs(VM* vm, const char* name, Value* args, int argCount, int expected) {
+    if (argCount != expected) {
+        nativeError(vm, "ucoreMath.%s expects %d argument%s but got %d.",
+                    name, expected, expected == 1 ? "" : "s", argCount);
+        return false;
+    }
+    for (int i = 0; i < argCount; i++) {
+        if (!IS_NUMERIC(args[i])) {
+            nativeError(vm, "ucoreMath.%s expects a number but got %s.", name, valueTypeName(args[i]));
+            return false;
+        }
+    }
+    return true;
+}
+
+// Doubles cover every NaN bit pattern, and some of them are the tags of
+// boxed values, so NaN results are stored as the one canonical NaN
+static Value numberResult(double d) {
+    return isnan(d) ? FLOAT_VAL(NAN) : FLOAT_VAL(d);
+}
+
+// ucoreMath.<name>(x) for a C function double -> double
+#define UNARY_MATH(name, fn) \
+    static Value umath_##name(VM* vm, Value* args, int argCount) { \
+        if (!checkArgs(vm, #name, args, argCount, 1)) return NIL_VAL; \
+        return numberResult(fn(AS_NUMERIC(args[0]))); \
+    }
+
+UNARY_MATH(sqrt, sqrt)
+UNARY_MATH(sin, sin)
+UNARY_MATH(cos, cos)
+UNARY_MATH(tan, tan)
+UNARY_MATH(log, log)
+UNARY_MATH(exp, exp)
+
+// ucoreMath.pow(base, exponent)
+static Value umath_pow(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "pow", args, argCount, 2)) return NIL_VAL;
+    return numberResult(pow(AS_NUMERIC(args[0]), AS_NUMERIC(args[1])));
+}
+
+// floor/ceil give an int when the result fits one, so they can index arrays
+static Value roundedResult(VM* vm, double d) {
+    if (d >= -0x1p63 && d < 0x1p63) return intValue(vm, (int64_t)d);
+    return numberResult(d);
+}
+
+// ucoreMath.floor(x)
+static Value umath_floor(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "floor", args, argCount, 1)) return NIL_VAL;
+    if (IS_INT(args[0])) return args[0];
+    return roundedResult(vm, floor(AS_FLOAT(args[0])));
+}
+
+// ucoreMath.ceil(x)
+static Value umath_ceil(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "ceil", args, argCount, 1)) return NIL_VAL;
+    if (IS_INT(args[0])) return args[0];
+    return roundedResult(vm, ceil(AS_FLOAT(args[0])));
+}
+
+// ucoreMath.abs(x): keeps the argument's type
+static Value umath_abs(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "abs", args, argCount, 1)) return NIL_VAL;
+    if (IS_INT(args[0])) {
+        int64_t n = AS_INT(args[0]);
+        if (n == INT64_MIN) return nativeError(vm, "Integer overflow in abs(%lld).", (long long)n);
+        return intValue(vm, n < 0 ? -n : n);
+    }
+    return numberResult(fabs(AS_FLOAT(args[0])));
+}
+
+// ucoreMath.isNaN(x)
+static Value umath_isNaN(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "isNaN", args, argCount, 1)) return NIL_VAL;
+    return BOOL_VAL(IS_FLOAT(args[0]) && isnan(AS_FLOAT(args[0])));
+}
+
+void registerUCoreMath(VM* vm) {
+    Module* mod = defineNativeModule(vm, "ucoreMath");
+    defineModuleAlias(vm, mod, "math");
+
+    defineNative(vm, mod->env, "sqrt", umath_sqrt, 1);
+    defineNative(vm, mod->env, "pow", umath_pow, 2);
+    defineNative(vm, mod->env, "sin", umath_sin, 1);
+    defineNative(vm, mod->env, "cos", umath_cos, 1);
+    defineNative(vm, mod->env, "tan", umath_tan, 1);
+    defineNative(vm, mod->env, "floor", umath_floor, 1);
+    defineNative(vm, mod->env, "ceil", umath_ceil, 1);
+    defineNative(vm, mod->env, "abs", umath_abs, 1);
+    defineNative(vm, mod->env, "log", umath_log, 1);
+    defineNative(vm, mod->env, "exp", umath_exp, 1);
+    defineNative(vm, mod->env, "isNaN", umath_isNaN, 1);
+
+    defineNativeValue(vm, mod->env, "PI", FLOAT_VAL(UMATH_PI));
+    defineNativeValue(vm, mod->env, "E", FLOAT_VAL(UMATH_E));
+}
@@ -0,0 +1,90 @@
+#include "ucore_random.h"
+#include <time.h>
+
+// Pseudo-random numbers from xoshiro256**, not fit for cryptography. The
+// generator uses nothing but 64-bit integer arithmetic, so a given seed
+// produces the same sequence on every platform. Each VM starts seeded
+// from the clock; seed(x) makes a run reproducible.
+
+static uint64_t rotl(uint64_t x, int k) {
+    return (x << k) | (x >> (64 - k));
+}
+
+// splitmix64 spreads one seed over the four state words, so similar
+// seeds still give unrelated sequences and the state is never all zero
+static void seedState(VM* vm, uint64_t seed) {
+    for (int i = 0; i < 4; i++) {
+        uint64_t z = (seed += 0x9E3779B97F4A7C15ULL);
+        z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9ULL;
+        z = (z ^ (z >> 27)) * 0x94D049BB133111EBULL;
+        vm->rngState[i] = z ^ (z >> 31);
+    }
+}
+
+static uint64_t nextRandom(VM* vm) {
+    uint64_t* s = vm->rngState;
+    uint64_t result = rotl(s[1] * 5, 7) * 9;
+    uint64_t t = s[1] << 17;
+    s[2] ^= s[0];
+    s[3] ^= s[1];
+    s[1] ^= s[2];
+    s[0] ^= s[3];
+    s[2] ^= t;
+    s[3] = rotl(s[3], 45);
+    return result;
+}
+
+// rand(): a double in [0, 1) from the top 53 bits
+static Value urandom_rand(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (!checkArgCount(vm, "rand", argCount, 0)) return NIL_VAL;
+    return FLOAT_VAL((double)(nextRandom(vm) >> 11) * 0x1.0p-53);
+}
+
+// randInt(n): an int in [0, n). Draws below 2^64 mod n are rejected so
+// every result is equally likely.
+static Value urandom_randInt(VM* vm, Value* args, int argCount) {
+    if (!checkArgCount(vm, "randInt", argCount, 1)) return NIL_VAL;
+    if (!IS_INT(args[0])) {
+        return nativeError(vm, "randInt expects an int but got %s.", valueTypeName(args[0]));
+    }
+    int64_t n = AS_INT(args[0]);
+    if (n <= 0) {
+        return nativeError(vm, "randInt expects a positive bound but got %lld.", (long long)n);
+    }
+    uint64_t bound = (uint64_t)n;
+    uint64_t threshold = -bound % bound;
+    uint64_t r;
+    do {
+        r = nextRandom(vm);
+    } while (r < threshold);
+    return intValue(vm, (int64_t)(r % bound));
+}
+
+// seed(x): restart the sequence; the same x always gives the same numbers
+static Value urandom_seed(VM* vm, Value* args, int argCount) {
+    if (!checkArgCount(vm, "seed", argCount, 1)) return NIL_VAL;
+    if (!IS_INT(args[0])) {
+        return nativeError(vm, "seed expects an int but got %s.", valueTypeName(args[0]));
+    }
+    seedState(vm, (uint64_t)AS_INT(args[0]));
+    return NIL_VAL;
+}
+
+void registerUCoreRandom(VM* vm) {
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    seedState(vm, (uint64_t)ts.tv_sec * 1000000000ULL + (uint64_t)ts.tv_nsec);
+
+    Module* mod = defineNativeModule(vm, "ucoreRandom");
+    defineModuleAlias(vm, mod, "random");
+
+    defineNative(vm, mod->env, "rand", urandom_rand, 0);
+    defineNative(vm, mod->env, "randInt", urandom_randInt, 1);
+    defineNative(vm, mod->env, "seed", urandom_seed, 1);
+
+    // Deprecated flat spellings of random.rand and the rest
+    defineNative(vm, vm->globalEnv, "rand", urandom_rand, 0);
+    defineNative(vm, vm->globalEnv, "rand_int", urandom_randInt, 1);
+    defineNative(vm, vm->globalEnv, "seed", urandom_seed, 1);
+}
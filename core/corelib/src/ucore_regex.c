@@ -0,0 +1,341 @@
+#include <stdlib.h>
+#include <string.h>
+#include <regex.h>
+#include "ucore_regex.h"
+
+// Regular expressions on the POSIX engine, in extended syntax, plus \d and
+// \D for digits. Each VM keeps its compiled patterns by source string, so
+// a pattern used in a loop is only compiled once. When REGEX_CACHE_MAX
+// patterns are cached, the one unused the longest makes room.
+//
+// A match is returned as the matched text, or, when the pattern has
+// groups, as [match, group1, group2, ...] with nil for a group that took
+// no part in the match.
+
+#define REGEX_CACHE_MAX 64
+
+typedef struct {
+    char* source;       // The pattern as written
+    regex_t compiled;
+    unsigned long lastUse;
+} CachedRegex;
+
+typedef struct RegexCache RegexCache;
+
+struct RegexCache {
+    CachedRegex entries[REGEX_CACHE_MAX];
+    int count;
+    unsigned long uses;
+    long hits;          // Lookups served from the cache
+    long misses;        // Patterns compiled
+};
+
+void freeRegexCache(VM* vm) {
+    RegexCache* cache = vm->regexCache;
+    if (!cache) return;
+    for (int i = 0; i < cache->count; i++) {
+        regfree(&cache->entries[i].compiled);
+        free(cache->entries[i].source);
+    }
+    free(cache);
+    vm->regexCache = NULL;
+}
+
+// Validate argCount and that each argument is a string; false after raising
+static bool checkArgs(VM* vm, const char* name, Value* args, int argCount, int expected) {
+    if (!checkArgCount(vm, name, argCount, expected)) return false;
+    for (int i = 0; i < argCount; i++) {
+        if (!IS_STRING(args[i])) {
+            nativeError(vm, "%s expects a string but got %s.", name, valueTypeName(args[i]));
+            return false;
+        }
+    }
+    return true;
+}
+
+// POSIX has no \d: spell it (and \D) as a bracket expression. Outside
+// brackets only; everything else is passed through.
+static char* translatePattern(const char* source) {
+    size_t length = strlen(source);
+    char* out = malloc(length * 4 + 1);
+    size_t n = 0;
+    bool inBracket = false;
+    for (size_t i = 0; i < length; i++) {
+        char ch = source[i];
+        if (!inBracket && ch == '\\' && (source[i + 1] == 'd' || source[i + 1] == 'D')) {
+            const char* digits = source[i + 1] == 'd' ? "[0-9]" : "[^0-9]";
+            memcpy(out + n, digits, strlen(digits));
+            n += strlen(digits);
+            i++;
+            continue;
+        }
+        if (!inBracket && ch == '\\' && source[i + 1]) {
+            out[n++] = ch;
+            out[n++] = source[++i];
+            continue;
+        }
+        if (!inBracket && ch == '[') {
+            inBracket = true;
+            out[n++] = ch;
+            // A ']' right after '[' or '[^' is a member, not the end
+            if (source[i + 1] == '^') out[n++] = source[++i];
+            if (source[i + 1] == ']') out[n++] = source[++i];
+            continue;
+        }
+        if (inBracket && ch == ']') inBracket = false;
+        out[n++] = ch;
+    }
+    out[n] = '\0';
+    return out;
+}
+
+// The compiled form of 'pattern', from the cache or compiled now. NULL
+// with an error pending when it does not compile.
+static regex_t* compilePattern(VM* vm, const char* name, ObjString* pattern) {
+    RegexCache* cache = vm->regexCache;
+    if (!cache) {
+        cache = calloc(1, sizeof(RegexCache));
+        vm->regexCache = cache;
+    }
+    cache->uses++;
+    for (int i = 0; i < cache->count; i++) {
+        CachedRegex* entry = &cache->entries[i];
+        if (strcmp(entry->source, pattern->chars) == 0) {
+            entry->lastUse = cache->uses;
+            cache->hits++;
+            return &entry->compiled;
+        }
+    }
+
+    regex_t compiled;
+    char* translated = translatePattern(pattern->chars);
+    int status = regcomp(&compiled, translated, REG_EXTENDED);
+    free(translated);
+    if (status != 0) {
+        char reason[128];
+        regerror(status, &compiled, reason, sizeof(reason));
+        nativeError(vm, "%s(): invalid pattern \"%s\": %s.", name, pattern->chars, reason);
+        return NULL;
+    }
+    cache->misses++;
+
+    CachedRegex* slot;
+    if (cache->count < REGEX_CACHE_MAX) {
+        slot = &cache->entries[cache->count++];
+    } else {
+        slot = &cache->entries[0];
+        for (int i = 1; i < cache->count; i++) {
+            if (cache->entries[i].lastUse < slot->lastUse) slot = &cache->entries[i];
+        }
+        regfree(&slot->compiled);
+        free(slot->source);
+    }
+    slot->source = strdup(pattern->chars);
+    slot->compiled = compiled;
+    slot->lastUse = cache->uses;
+    return &slot->compiled;
+}
+
+// Append 'value' to 'array', keeping it reachable while the array grows
+static void pushRooted(VM* vm, Array* array, Value value) {
+    vm->stack[vm->stackTop++] = value;
+    arrayPush(vm, array, value);
+    vm->stackTop--;
+}
+
+// The text of a match of 'regex' in 'subject'; see the top of the file
+static Value matchValue(VM* vm, regex_t* regex, const char* subject, regmatch_t* groups) {
+    if (regex->re_nsub == 0) {
+        return OBJ_VAL(internString(vm, subject + groups[0].rm_so, (int)(groups[0].rm_eo - groups[0].rm_so)));
+    }
+    Array* parts = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(parts);
+    for (size_t i = 0; i <= regex->re_nsub; i++) {
+        if (groups[i].rm_so < 0) {
+            pushRooted(vm, parts, NIL_VAL);
+        } else {
+            pushRooted(vm, parts, OBJ_VAL(internString(vm, subject + groups[i].rm_so,
+                                                       (int)(groups[i].rm_eo - groups[i].rm_so))));
+        }
+    }
+    vm->stackTop--;
+    return OBJ_VAL(parts);
+}
+
+// Where a scan of 'subject' for successive matches has got to
+typedef struct {
+    ObjString* subject;
+    size_t offset;      // Search from here
+    regoff_t lastEnd;   // End of the previous match, -1 before the first
+} Scan;
+
+// The next match of the scan, with offsets in 'groups' from the start of
+// the subject; '^' only matches there. The search resumes past each match,
+// or one UTF-8 character on after an empty one. An empty match right where
+// the previous match ended is skipped.
+static bool nextMatch(regex_t* regex, Scan* scan, regmatch_t* groups) {
+    while (scan->offset <= (size_t)scan->subject->length) {
+        int flags = scan->offset > 0 ? REG_NOTBOL : 0;
+        if (regexec(regex, scan->subject->chars + scan->offset, regex->re_nsub + 1, groups, flags) != 0) {
+            return false;
+        }
+        for (size_t i = 0; i <= regex->re_nsub; i++) {
+            if (groups[i].rm_so < 0) continue;
+            groups[i].rm_so += (regoff_t)scan->offset;
+            groups[i].rm_eo += (regoff_t)scan->offset;
+        }
+        bool empty = groups[0].rm_so == groups[0].rm_eo;
+        scan->offset = (size_t)groups[0].rm_eo;
+        if (empty) {
+            const unsigned char* chars = (const unsigned char*)scan->subject->chars;
+            scan->offset++;
+            while (scan->offset < (size_t)scan->subject->length && (chars[scan->offset] & 0xC0) == 0x80) scan->offset++;
+        }
+        if (empty && groups[0].rm_so == scan->lastEnd) continue;
+        scan->lastEnd = groups[0].rm_eo;
+        return true;
+    }
+    return false;
+}
+
+// regex.match(pattern, s): whether the pattern matches anywhere in s
+static Value regex_matchNative(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "regex.match", args, argCount, 2)) return NIL_VAL;
+    regex_t* regex = compilePattern(vm, "regex.match", AS_STRING(args[0]));
+    if (!regex) return NIL_VAL;
+    return BOOL_VAL(regexec(regex, AS_CSTRING(args[1]), 0, NULL, 0) == 0);
+}
+
+// regex.find(pattern, s): the first match, or nil
+static Value regex_findNative(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "regex.find", args, argCount, 2)) return NIL_VAL;
+    regex_t* regex = compilePattern(vm, "regex.find", AS_STRING(args[0]));
+    if (!regex) return NIL_VAL;
+    Scan scan = {AS_STRING(args[1]), 0, -1};
+    regmatch_t* groups = malloc(sizeof(regmatch_t) * (regex->re_nsub + 1));
+    Value result = nextMatch(regex, &scan, groups) ? matchValue(vm, regex, scan.subject->chars, groups) : NIL_VAL;
+    free(groups);
+    return result;
+}
+
+// regex.findAll(pattern, s): every non-overlapping match, in order
+static Value regex_findAllNative(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "regex.findAll", args, argCount, 2)) return NIL_VAL;
+    regex_t* regex = compilePattern(vm, "regex.findAll", AS_STRING(args[0]));
+    if (!regex) return NIL_VAL;
+    Scan scan = {AS_STRING(args[1]), 0, -1};
+    regmatch_t* groups = malloc(sizeof(regmatch_t) * (regex->re_nsub + 1));
+
+    Array* matches = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(matches);
+    while (nextMatch(regex, &scan, groups)) {
+        pushRooted(vm, matches, matchValue(vm, regex, scan.subject->chars, groups));
+    }
+    vm->stackTop--;
+    free(groups);
+    return OBJ_VAL(matches);
+}
+
+typedef struct {
+    char* chars;
+    size_t length;
+    size_t capacity;
+} Buffer;
+
+static void append(Buffer* buffer, const char* chars, size_t length) {
+    if (buffer->length + length + 1 > buffer->capacity) {
+        while (buffer->length + length + 1 > buffer->capacity) buffer->capacity *= 2;
+        buffer->chars = realloc(buffer->chars, buffer->capacity);
+    }
+    memcpy(buffer->chars + buffer->length, chars, length);
+    buffer->length += length;
+}
+
+// Append 'repl' for one match: $0..$9 and ${n} are groups (empty when the
+// group did not take part or does not exist), $$ is a '$'
+static void appendReplacement(Buffer* out, const char* repl, const char* subject,
+                              regmatch_t* groups, size_t groupCount) {
+    for (const char* p = repl; *p; p++) {
+        if (*p != '$') {
+            append(out, p, 1);
+            continue;
+        }
+        size_t group;
+        if (p[1] == '$') {
+            append(out, "$", 1);
+            p++;
+            continue;
+        } else if (p[1] >= '0' && p[1] <= '9') {
+            group = (size_t)(p[1] - '0');
+            p++;
+        } else if (p[1] == '{' && p[2] >= '0' && p[2] <= '9' && strchr(p + 2, '}')) {
+            char* end;
+            group = strtoul(p + 2, &end, 10);
+            if (*end != '}') {
+                append(out, p, 1);
+                continue;
+            }
+            p = end;
+        } else {
+            append(out, p, 1);
+            continue;
+        }
+        if (group < groupCount && groups[group].rm_so >= 0) {
+            append(out, subject + groups[group].rm_so, (size_t)(groups[group].rm_eo - groups[group].rm_so));
+        }
+    }
+}
+
+// regex.replace(pattern, s, repl): s with every match replaced by repl
+static Value regex_replaceNative(VM* vm, Value* args, int argCount) {
+    if (!checkArgs(vm, "regex.replace", args, argCount, 3)) return NIL_VAL;
+    regex_t* regex = compilePattern(vm, "regex.replace", AS_STRING(args[0]));
+    if (!regex) return NIL_VAL;
+    ObjString* subject = AS_STRING(args[1]);
+    const char* repl = AS_CSTRING(args[2]);
+    Scan scan = {subject, 0, -1};
+    regmatch_t* groups = malloc(sizeof(regmatch_t) * (regex->re_nsub + 1));
+
+    Buffer out = {malloc(subject->length + 16), 0, (size_t)subject->length + 16};
+    size_t copied = 0;      // Subject bytes already in 'out'
+    while (nextMatch(regex, &scan, groups)) {
+        append(&out, subject->chars + copied, (size_t)groups[0].rm_so - copied);
+        appendReplacement(&out, repl, subject->chars, groups, regex->re_nsub + 1);
+        copied = (size_t)groups[0].rm_eo;
+    }
+    append(&out, subject->chars + copied, (size_t)subject->length - copied);
+    free(groups);
+
+    Value result = OBJ_VAL(internString(vm, out.chars, (int)out.length));
+    free(out.chars);
+    return result;
+}
+
+// ucoreRegex.cacheStats(): {"size", "hits", "misses"} of the pattern cache
+static Value regex_cacheStats(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (argCount != 0) return nativeError(vm, "ucoreRegex.cacheStats() takes no arguments, got %d.", argCount);
+    RegexCache* cache = vm->regexCache;
+    Map* stats = newMap(vm);
+    mapSetStr(vm, stats, "size", 4, INT_VAL(cache ? cache->count : 0));
+    mapSetStr(vm, stats, "hits", 4, INT_VAL(cache ? cache->hits : 0));
+    mapSetStr(vm, stats, "misses", 6, INT_VAL(cache ? cache->misses : 0));
+    return OBJ_VAL(stats);
+}
+
+void registerUCoreRegex(VM* vm) {
+    Module* mod = defineNativeModule(vm, "ucoreRegex");
+    defineModuleAlias(vm, mod, "regex");
+
+    defineNative(vm, mod->env, "match", regex_matchNative, 2);
+    defineNative(vm, mod->env, "find", regex_findNative, 2);
+    defineNative(vm, mod->env, "findAll", regex_findAllNative, 2);
+    defineNative(vm, mod->env, "replace", regex_replaceNative, 3);
+    defineNative(vm, mod->env, "cacheStats", regex_cacheStats, 0);
+
+    // Deprecated flat spellings of regex.match and the rest
+    defineNative(vm, vm->globalEnv, "regex_match", regex_matchNative, 2);
+    defineNative(vm, vm->globalEnv, "regex_find", regex_findNative, 2);
+    defineNative(vm, vm->globalEnv, "regex_find_all", regex_findAllNative, 2);
+    defineNative(vm, vm->globalEnv, "regex_replace", regex_replaceNative, 3);
+}
@@ -447,26 +447,26 @@ static ScraperSelector* parseSelector(const char* identifier) {
 // (Previous code block was malformed)
 
 // Function to recursively print DOM (Depth-First)
-static void printNode(ScraperNode* node, int depth) {
-    for (int i = 0; i < depth; i++) printf("  ");
+static void printNode(VM* vm, ScraperNode* node, int depth) {
+    for (int i = 0; i < depth; i++) writeOutputf(vm, "  ");
     
     if (node->type == NODE_DOCUMENT) {
-        printf("#document\n");
+        writeOutputf(vm, "#document\n");
     } else if (node->type == NODE_ELEMENT) {
-        printf("<%s", node->tagName);
+        writeOutputf(vm, "<%s", node->tagName);
         for (int i=0; i<node->attrCount; i++) {
-            printf(" %s=\"%s\"", node->attrKeys[i], node->attrValues[i]);
+            writeOutputf(vm, " %s=\"%s\"", node->attrKeys[i], node->attrValues[i]);
         }
-        printf(">\n");
+        writeOutputf(vm, ">\n");
     } else if (node->type == NODE_TEXT) {
         // Trim whitespace for display
         char* txt = node->textContent;
         while(isspace(*txt)) txt++;
-        if (strlen(txt) > 0) printf("#text: \"%s\"\n", txt);
+        if (strlen(txt) > 0) writeOutputf(vm, "#text: \"%s\"\n", txt);
     }
     
     for (int i = 0; i < node->childCount; i++) {
-        printNode(node->children[i], depth + 1);
+        printNode(vm, node->children[i], depth + 1);
     }
 }
 
@@ -661,11 +661,12 @@ static void selectNodesV(ScraperNode* root, ScraperSelector* sel, ScraperNode***
 // Helper: Convert ScraperNode to Unnarize Value (Map)
 static Value nodeToValue(VM* vm, ScraperNode* node) {
     Map* map = newMap(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(map); // Root it while strings are made
     
     // Tag Name
     if (node->tagName) {
         Value vTag = OBJ_VAL(internString(vm, node->tagName, strlen(node->tagName)));
-        mapSetStr(map, "tagName", 7, vTag);
+        mapSetStr(vm, map, "tagName", 7, vTag);
     }
     
     // Text Content (Recursive!)
@@ -677,20 +678,21 @@ static Value nodeToValue(VM* vm, ScraperNode* node) {
     
     if (tLen > 0) {
          Value vText = OBJ_VAL(internString(vm, tBuf, tLen));
-         mapSetStr(map, "text", 4, vText);
+         mapSetStr(vm, map, "text", 4, vText);
     }
     free(tBuf);
     
     // Attributes
     if (node->attrCount > 0) {
         Map* attrs = newMap(vm);
+        mapSetStr(vm, map, "attributes", 10, OBJ_VAL(attrs));
         for (int i=0; i<node->attrCount; i++) {
             Value vVal = OBJ_VAL(internString(vm, node->attrValues[i], strlen(node->attrValues[i])));
-            mapSetStr(attrs, node->attrKeys[i], strlen(node->attrKeys[i]), vVal);
+            mapSetStr(vm, attrs, node->attrKeys[i], strlen(node->attrKeys[i]), vVal);
         }
-        mapSetStr(map, "attributes", 10, OBJ_VAL(attrs));
     }
     
+    vm->stackTop--;
     return OBJ_VAL(map);
 }
 
@@ -834,7 +836,7 @@ static Value scraper_parse(VM* vm, Value* args, int argCount) {
     
     // If 2nd arg is TRUE, dump the tree
     if (argCount == 2 && IS_BOOL(args[1]) && AS_BOOL(args[1])) {
-        printNode(doc, 0);
+        printNode(vm, doc, 0);
     }
     
     freeNode(doc);
@@ -842,28 +844,12 @@ static Value scraper_parse(VM* vm, Value* args, int argCount) {
 }
 
 void registerUCoreScraper(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreScraper", 12);
-    char* modName = modNameObj->chars;
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName);
-    mod->obj.isMarked = true;
-    mod->obj.isPermanent = true;
-    
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true;
-    modEnv->obj.isPermanent = true;
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreScraper");
+    defineModuleAlias(vm, mod, "scraper");
     
     defineNative(vm, mod->env, "parse", scraper_parse, 1); // parse(html, [debug])
     defineNative(vm, mod->env, "select", scraper_select, 2); // select(html, selector)
     defineNative(vm, mod->env, "parseFile", scraper_parseFile, 2); // parseFile(path, selector)
     defineNative(vm, mod->env, "fetch", scraper_fetch, 1); // fetch(url) -> string
     defineNative(vm, mod->env, "download", scraper_download, 2); // download(url, path) -> bool
-    
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreScraper", vMod);
 }
@@ -19,7 +19,19 @@ static ObjString* copyString(VM* vm, const char* chars, int length) {
 // Core String Manipulation
 // ============================================================================
 
+// Byte length of the UTF-8 sequence starting with 'lead' (1 for invalid bytes)
+static int utf8SeqLen(unsigned char lead) {
+    if (lead >= 0xF0 && lead <= 0xF4) return 4;
+    if (lead >= 0xE0) return lead <= 0xEF ? 3 : 1;
+    if (lead >= 0xC2) return 2;
+    return 1;
+}
+
 // ucoreString.split(str, delimiter) -> List<String>
+// Also available as the global split(str, delimiter).
+//   ""  delimiter   -> one element per UTF-8 character
+//   not found       -> [str]
+//   trailing delim  -> trailing "" element
 static Value str_split(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
         return NIL_VAL;
@@ -30,44 +42,47 @@ static Value str_split(VM* vm, Value* args, int argCount) {
     
     const char* str = strObj->chars;
     const char* delim = delimObj->chars;
-    int delimLen = strlen(delim);
+    int len = strObj->length;
+    int delimLen = delimObj->length;
     
     // Create result array
     Array* array = newArray(vm);
     vm->stack[vm->stackTop++] = OBJ_VAL(array); // Root the array
     
     if (delimLen == 0) {
-        // Split by character
-        for (int i = 0; i < strObj->length; i++) {
-            char temp[2] = { str[i], '\0' };
-            Value val = OBJ_VAL(internString(vm, temp, 1));
-            arrayPush(vm, array, val);
+        // Split by character (whole UTF-8 sequences, never partial bytes)
+        int i = 0;
+        while (i < len) {
+            int n = utf8SeqLen((unsigned char)str[i]);
+            if (i + n > len) n = len - i;
+            arrayPush(vm, array, OBJ_VAL(copyString(vm, str + i, n)));
+            i += n;
         }
         vm->stackTop--; // Pop array
         return OBJ_VAL(array);
     }
     
-    const char* start = str;
-    const char* p = strstr(start, delim);
-    
-    while (p) {
-        int len = p - start;
-        Value val = OBJ_VAL(copyString(vm, start, len)); // efficient copy
-        arrayPush(vm, array, val);
-        
-        start = p + delimLen;
-        p = strstr(start, delim);
+    int start = 0;
+    for (int i = 0; i + delimLen <= len; ) {
+        if (memcmp(str + i, delim, delimLen) == 0) {
+            arrayPush(vm, array, OBJ_VAL(copyString(vm, str + start, i - start)));
+            i += delimLen;
+            start = i;
+        } else {
+            i++;
+        }
     }
     
-    // Last segment
-    Value val = OBJ_VAL(copyString(vm, start, strlen(start)));
-    arrayPush(vm, array, val);
+    // Last segment (empty if the string ends with the delimiter)
+    arrayPush(vm, array, OBJ_VAL(copyString(vm, str + start, len - start)));
     
     vm->stackTop--; // Pop array
     return OBJ_VAL(array);
 }
 
 // ucoreString.join(list, delimiter) -> String
+// Also available as the global join(list, delimiter).
+// Non-string items are converted the same way as with "+" concatenation.
 static Value str_join(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_ARRAY(args[0]) || !IS_STRING(args[1])) {
         return NIL_VAL;
@@ -83,14 +98,14 @@ static Value str_join(VM* vm, Value* args, int argCount) {
     // Calculate total length first to allocate once (Performance improvement)
     size_t totalLen = 0;
     int delimLen = delim->length;
+    char buf[64];
     
     for (int i = 0; i < list->count; i++) {
         Value item = list->items[i];
         if (IS_STRING(item)) {
             totalLen += AS_STRING(item)->length;
         } else {
-            // Non-string items? For now ignore or simple error. 
-            // Or assume toString logic exists. Let's just handle strings for speed.
+            totalLen += strlen(valueToChars(item, buf, sizeof(buf)));
         }
         if (i < list->count - 1) totalLen += delimLen;
     }
@@ -104,6 +119,11 @@ static Value str_join(VM* vm, Value* args, int argCount) {
             ObjString* s = AS_STRING(item);
             memcpy(ptr, s->chars, s->length);
             ptr += s->length;
+        } else {
+            const char* text = valueToChars(item, buf, sizeof(buf));
+            size_t textLen = strlen(text);
+            memcpy(ptr, text, textLen);
+            ptr += textLen;
         }
         
         if (i < list->count - 1) {
@@ -113,17 +133,26 @@ static Value str_join(VM* vm, Value* args, int argCount) {
     }
     *ptr = '\0';
     
-    // takeString assumes ownership of 'result' pointer
-    // We need to implement takeString or use internString and free result.
-    // 'takeString' usually exists in VM to avoid copy.
-    // Checking vm.h: only internString is exposed.
-    // So we use internString, then free result.
+    // internString copies, so the scratch buffer is ours to free
     ObjString* resObj = internString(vm, result, totalLen);
     free(result);
     return OBJ_VAL(resObj);
 }
 
+// Byte offset of the first 'needle' in 'hay' at or after 'from', or -1.
+// An empty needle is found at 'from'.
+static int findSubstring(const char* hay, int hayLen, const char* needle, int needleLen, int from) {
+    for (int i = from; i + needleLen <= hayLen; i++) {
+        if (memcmp(hay + i, needle, needleLen) == 0) return i;
+    }
+    return -1;
+}
+
 // ucoreString.replace(str, search, replace) -> String
+// Also available as the global replace(str, search, replace).
+// Every occurrence is replaced, scanning left to right: a match starts
+// after the end of the previous one, so "aaa" with "aa" -> "b" gives "ba".
+// An empty search string matches nothing and returns str unchanged.
 static Value str_replace(VM* vm, Value* args, int argCount) {
     if (argCount != 3 || !IS_STRING(args[0]) || !IS_STRING(args[1]) || !IS_STRING(args[2])) {
         return NIL_VAL;
@@ -132,50 +161,47 @@ static Value str_replace(VM* vm, Value* args, int argCount) {
     ObjString* strObj = AS_STRING(args[0]);
     ObjString* searchObj = AS_STRING(args[1]);
     ObjString* repObj = AS_STRING(args[2]);
+    int searchLen = searchObj->length;
 
-    if (searchObj->length == 0) return args[0]; // No change
+    if (searchLen == 0) return args[0]; // No change
 
-    const char* str = strObj->chars;
-    const char* search = searchObj->chars;
-    const char* rep = repObj->chars;
-    
     // Count occurrences
     int count = 0;
-    const char* tmp = str;
-    while((tmp = strstr(tmp, search))) {
+    for (int at = findSubstring(strObj->chars, strObj->length, searchObj->chars, searchLen, 0);
+         at >= 0;
+         at = findSubstring(strObj->chars, strObj->length, searchObj->chars, searchLen, at + searchLen)) {
         count++;
-        tmp += searchObj->length;
     }
-    
+
     if (count == 0) return args[0];
-    
+
     // Allocate new string
-    size_t newLen = strObj->length + count * (repObj->length - searchObj->length);
+    size_t newLen = (size_t)strObj->length + (size_t)count * repObj->length - (size_t)count * searchLen;
     char* result = malloc(newLen + 1);
-    
+
     char* dst = result;
-    const char* src = str;
-    tmp = strstr(src, search);
-    
-    while (tmp) {
-        int len = tmp - src;
-        memcpy(dst, src, len);
-        dst += len;
-        
-        memcpy(dst, rep, repObj->length);
+    int src = 0;
+    int at = findSubstring(strObj->chars, strObj->length, searchObj->chars, searchLen, 0);
+    while (at >= 0) {
+        memcpy(dst, strObj->chars + src, at - src);
+        dst += at - src;
+
+        memcpy(dst, repObj->chars, repObj->length);
         dst += repObj->length;
-        
-        src = tmp + searchObj->length;
-        tmp = strstr(src, search);
+
+        src = at + searchLen;
+        at = findSubstring(strObj->chars, strObj->length, searchObj->chars, searchLen, src);
     }
-    strcpy(dst, src);
-    
-    ObjString* resObj = internString(vm, result, newLen);
+    memcpy(dst, strObj->chars + src, strObj->length - src);
+    result[newLen] = '\0';
+
+    ObjString* resObj = internString(vm, result, (int)newLen);
     free(result);
     return OBJ_VAL(resObj);
 }
 
 // ucoreString.trim(str) -> String
+// Also available as the global trim(str). Strips ASCII whitespace from both ends.
 static Value str_trim(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) return NIL_VAL;
     
@@ -195,14 +221,54 @@ static Value str_trim(VM* vm, Value* args, int argCount) {
     return OBJ_VAL(copyString(vm, start, len));
 }
 
-// ucoreString.toLower(str) -> String
-static Value str_toLower(VM* vm, Value* args, int argCount) {
-    if (argCount != 1 || !IS_STRING(args[0])) return NIL_VAL;
-    ObjString* str = AS_STRING(args[0]);
-    
+// Case mapping for the letters that have a same-length counterpart: ASCII,
+// Latin-1 (à-þ), Greek (α-ω, ά-ώ) and Cyrillic (а-я, ѐ-џ). Others map to themselves.
+static int caseMap(int cp, bool upper) {
+    if (upper) {
+        if (cp >= 'a' && cp <= 'z') return cp - 32;
+        if (cp >= 0xE0 && cp <= 0xFE && cp != 0xF7) return cp - 0x20;
+        if (cp >= 0x3B1 && cp <= 0x3C9 && cp != 0x3C2) return cp - 0x20;
+        if (cp == 0x3C2) return 0x3A3; // Final sigma
+        if (cp == 0x3AC) return 0x386; // Accented vowels
+        if (cp >= 0x3AD && cp <= 0x3AF) return cp - 0x25;
+        if (cp == 0x3CC) return 0x38C;
+        if (cp == 0x3CD || cp == 0x3CE) return cp - 0x3F;
+        if (cp >= 0x430 && cp <= 0x44F) return cp - 0x20;
+        if (cp >= 0x450 && cp <= 0x45F) return cp - 0x50;
+    } else {
+        if (cp >= 'A' && cp <= 'Z') return cp + 32;
+        if (cp >= 0xC0 && cp <= 0xDE && cp != 0xD7) return cp + 0x20;
+        if (cp >= 0x391 && cp <= 0x3A9 && cp != 0x3A2) return cp + 0x20;
+        if (cp == 0x386) return 0x3AC;
+        if (cp >= 0x388 && cp <= 0x38A) return cp + 0x25;
+        if (cp == 0x38C) return 0x3CC;
+        if (cp == 0x38E || cp == 0x38F) return cp + 0x3F;
+        if (cp >= 0x410 && cp <= 0x42F) return cp + 0x20;
+        if (cp >= 0x400 && cp <= 0x40F) return cp + 0x50;
+    }
+    return cp;
+}
+
+// Copy of str with every letter case-mapped. Two-byte UTF-8 letters map to
+// two-byte letters, so the length never changes; other bytes are copied.
+static Value convertCase(VM* vm, ObjString* str, bool upper) {
     char* buf = malloc(str->length + 1);
-    for(int i=0; i<str->length; i++) {
-        buf[i] = tolower((unsigned char)str->chars[i]);
+    const unsigned char* s = (const unsigned char*)str->chars;
+    int i = 0;
+    while (i < str->length) {
+        unsigned char c = s[i];
+        if (c < 0x80) {
+            buf[i] = (char)caseMap(c, upper);
+            i++;
+        } else if (utf8SeqLen(c) == 2 && i + 1 < str->length && (s[i + 1] & 0xC0) == 0x80) {
+            int cp = caseMap(((c & 0x1F) << 6) | (s[i + 1] & 0x3F), upper);
+            buf[i] = (char)(0xC0 | (cp >> 6));
+            buf[i + 1] = (char)(0x80 | (cp & 0x3F));
+            i += 2;
+        } else {
+            buf[i] = (char)c;
+            i++;
+        }
     }
     buf[str->length] = '\0';
     ObjString* res = internString(vm, buf, str->length);
@@ -210,28 +276,171 @@ static Value str_toLower(VM* vm, Value* args, int argCount) {
     return OBJ_VAL(res);
 }
 
+// ucoreString.toLower(str) -> String
+// Also available as the global lower(str).
+static Value str_toLower(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_STRING(args[0])) return NIL_VAL;
+    return convertCase(vm, AS_STRING(args[0]), false);
+}
+
 // ucoreString.toUpper(str) -> String
+// Also available as the global upper(str).
 static Value str_toUpper(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) return NIL_VAL;
-    ObjString* str = AS_STRING(args[0]);
-    
-    char* buf = malloc(str->length + 1);
-    for(int i=0; i<str->length; i++) {
-        buf[i] = toupper((unsigned char)str->chars[i]);
-    }
-    buf[str->length] = '\0';
-    ObjString* res = internString(vm, buf, str->length);
-    free(buf);
-    return OBJ_VAL(res);
+    return convertCase(vm, AS_STRING(args[0]), true);
 }
 
 // ucoreString.contains(str, substr) -> bool
+// Also available as the global contains(str, substr).
 static Value str_contains(VM* vm, Value* args, int argCount) {
     (void)vm;
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) return BOOL_VAL(false);
     ObjString* haystack = AS_STRING(args[0]);
     ObjString* needle = AS_STRING(args[1]);
-    return BOOL_VAL(strstr(haystack->chars, needle->chars) != NULL);
+    return BOOL_VAL(findSubstring(haystack->chars, haystack->length, needle->chars, needle->length, 0) >= 0);
+}
+
+// ucoreString.indexOf(str, substr) -> Int
+// Also available as the global index_of(str, substr).
+// Byte offset of the first occurrence, usable with slicing; -1 if absent.
+static Value str_indexOf(VM* vm, Value* args, int argCount) {
+    (void)vm;
+    if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) return NIL_VAL;
+    ObjString* haystack = AS_STRING(args[0]);
+    ObjString* needle = AS_STRING(args[1]);
+    return INT_VAL(findSubstring(haystack->chars, haystack->length, needle->chars, needle->length, 0));
+}
+
+// ============================================================================
+// Characters and Codepoints
+// ============================================================================
+
+// Decode the UTF-8 character at s[0..len): its byte length, and its
+// codepoint in *cp. A byte that doesn't start a well-formed sequence is a
+// character by itself, decoded as U+FFFD.
+static int utf8Decode(const unsigned char* s, int len, int* cp) {
+    int n = utf8SeqLen(s[0]);
+    if (n == 1) {
+        *cp = s[0] < 0x80 ? s[0] : 0xFFFD;
+        return 1;
+    }
+    if (n > len) {
+        *cp = 0xFFFD;
+        return 1;
+    }
+    int value = s[0] & (0x7F >> n);
+    for (int i = 1; i < n; i++) {
+        if ((s[i] & 0xC0) != 0x80) {
+            *cp = 0xFFFD;
+            return 1;
+        }
+        value = (value << 6) | (s[i] & 0x3F);
+    }
+    // Overlong forms, surrogates and values past U+10FFFF are not characters
+    static const int minimum[] = { 0, 0, 0x80, 0x800, 0x10000 };
+    if (value < minimum[n] || (value >= 0xD800 && value <= 0xDFFF) || value > 0x10FFFF) {
+        *cp = 0xFFFD;
+        return 1;
+    }
+    *cp = value;
+    return n;
+}
+
+// UTF-8 encoding of a valid codepoint into out (4 bytes): its length
+static int utf8Encode(int cp, char* out) {
+    if (cp < 0x80) {
+        out[0] = (char)cp;
+        return 1;
+    }
+    if (cp < 0x800) {
+        out[0] = (char)(0xC0 | (cp >> 6));
+        out[1] = (char)(0x80 | (cp & 0x3F));
+        return 2;
+    }
+    if (cp < 0x10000) {
+        out[0] = (char)(0xE0 | (cp >> 12));
+        out[1] = (char)(0x80 | ((cp >> 6) & 0x3F));
+        out[2] = (char)(0x80 | (cp & 0x3F));
+        return 3;
+    }
+    out[0] = (char)(0xF0 | (cp >> 18));
+    out[1] = (char)(0x80 | ((cp >> 12) & 0x3F));
+    out[2] = (char)(0x80 | ((cp >> 6) & 0x3F));
+    out[3] = (char)(0x80 | (cp & 0x3F));
+    return 4;
+}
+
+// chars(str) -> List<String>
+// One string per character. An invalid byte is a character of its own, so
+// join(chars(str), "") is always str.
+static Value str_chars(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_STRING(args[0])) {
+        return nativeError(vm, "chars() expects a string.");
+    }
+    ObjString* str = AS_STRING(args[0]);
+    const unsigned char* s = (const unsigned char*)str->chars;
+    Array* array = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(array); // Root the array
+    int cp;
+    for (int i = 0; i < str->length; ) {
+        int n = utf8Decode(s + i, str->length - i, &cp);
+        arrayPush(vm, array, OBJ_VAL(copyString(vm, str->chars + i, n)));
+        i += n;
+    }
+    vm->stackTop--;
+    return OBJ_VAL(array);
+}
+
+// bytes(str) -> List<Int>
+// The value of each byte, 0 to 255.
+static Value str_bytes(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_STRING(args[0])) {
+        return nativeError(vm, "bytes() expects a string.");
+    }
+    ObjString* str = AS_STRING(args[0]);
+    Array* array = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(array);
+    for (int i = 0; i < str->length; i++) {
+        arrayPush(vm, array, INT_VAL((unsigned char)str->chars[i]));
+    }
+    vm->stackTop--;
+    return OBJ_VAL(array);
+}
+
+// codepoint(str, i) -> Int
+// Codepoint of the character at character index i (not byte offset i);
+// 0xFFFD for an invalid byte.
+static Value str_codepoint(VM* vm, Value* args, int argCount) {
+    if (argCount != 2 || !IS_STRING(args[0]) || !IS_INT(args[1])) {
+        return nativeError(vm, "codepoint() expects a string and an int index.");
+    }
+    ObjString* str = AS_STRING(args[0]);
+    const unsigned char* s = (const unsigned char*)str->chars;
+    int64_t index = AS_INT(args[1]);
+    int64_t count = 0;
+    int cp;
+    for (int i = 0; i < str->length; count++) {
+        int n = utf8Decode(s + i, str->length - i, &cp);
+        if (count == index) return INT_VAL(cp);
+        i += n;
+    }
+    return nativeError(vm, "codepoint() index %lld out of range for a string of %lld characters.",
+                       (long long)index, (long long)count);
+}
+
+// from_codepoint(n) -> String
+// The one-character string for codepoint n.
+static Value str_fromCodepoint(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_INT(args[0])) {
+        return nativeError(vm, "from_codepoint() expects an int.");
+    }
+    int64_t cp = AS_INT(args[0]);
+    if (cp < 0 || cp > 0x10FFFF || (cp >= 0xD800 && cp <= 0xDFFF)) {
+        return nativeError(vm, "from_codepoint() got %lld, which is not a Unicode codepoint.", (long long)cp);
+    }
+    char buf[4];
+    int n = utf8Encode((int)cp, buf);
+    return OBJ_VAL(copyString(vm, buf, n));
 }
 
 // ============================================================================
@@ -311,21 +520,8 @@ static Value str_extract(VM* vm, Value* args, int argCount) {
 // ============================================================================
 
 void registerUCoreString(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreString", 11);
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modNameObj->chars);
-    mod->source = NULL;
-    mod->obj.isMarked = true;
-    mod->obj.isPermanent = true; // Prevent GC from collecting the module
-    
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true;
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreString");
+    defineModuleAlias(vm, mod, "string");
 
     defineNative(vm, mod->env, "split", str_split, 2);
     defineNative(vm, mod->env, "join", str_join, 2);
@@ -334,9 +530,26 @@ void registerUCoreString(VM* vm) {
     defineNative(vm, mod->env, "toLower", str_toLower, 1);
     defineNative(vm, mod->env, "toUpper", str_toUpper, 1);
     defineNative(vm, mod->env, "contains", str_contains, 2);
+    defineNative(vm, mod->env, "indexOf", str_indexOf, 2);
     defineNative(vm, mod->env, "match", str_match, 2);
     defineNative(vm, mod->env, "extract", str_extract, 2);
-    
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreString", vMod);
+    defineNative(vm, mod->env, "chars", str_chars, 1);
+    defineNative(vm, mod->env, "bytes", str_bytes, 1);
+    defineNative(vm, mod->env, "codepoint", str_codepoint, 2);
+    defineNative(vm, mod->env, "fromCodepoint", str_fromCodepoint, 1);
+    
+    // Deprecated flat spellings of the common transforms; string.split
+    // and the rest are the names to use
+    defineNative(vm, vm->globalEnv, "split", str_split, 2);
+    defineNative(vm, vm->globalEnv, "join", str_join, 2);
+    defineNative(vm, vm->globalEnv, "trim", str_trim, 1);
+    defineNative(vm, vm->globalEnv, "upper", str_toUpper, 1);
+    defineNative(vm, vm->globalEnv, "lower", str_toLower, 1);
+    defineNative(vm, vm->globalEnv, "replace", str_replace, 3);
+    defineNative(vm, vm->globalEnv, "index_of", str_indexOf, 2);
+    defineNative(vm, vm->globalEnv, "contains", str_contains, 2);
+    defineNative(vm, vm->globalEnv, "chars", str_chars, 1);
+    defineNative(vm, vm->globalEnv, "bytes", str_bytes, 1);
+    defineNative(vm, vm->globalEnv, "codepoint", str_codepoint, 2);
+    defineNative(vm, vm->globalEnv, "from_codepoint", str_fromCodepoint, 1);
 }
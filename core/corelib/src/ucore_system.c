@@ -6,32 +6,43 @@
 #include <time.h>
 #include <unistd.h>
 
-// args() -> ["arg1", "arg2"]
-// args() -> ["arg1", "arg2"]
-static Value sys_args(VM* vm, Value* args, int argCount) {
-    (void)args; (void)argCount;
+// vm->argv from 'first' on, as an array of strings
+static Value argvArray(VM* vm, int first) {
     Array* arr = newArray(vm);
-    for (int i = 0; i < vm->argc; i++) {
+    vm->stack[vm->stackTop++] = OBJ_VAL(arr); // Root while the strings are made
+    for (int i = first; i < vm->argc; i++) {
         ObjString* s = internString(vm, vm->argv[i], strlen(vm->argv[i]));
-        Value v = OBJ_VAL(s);
-        arrayPush(vm, arr, v);
+        arrayPush(vm, arr, OBJ_VAL(s));
     }
-    Value vArr = OBJ_VAL(arr);
-    return vArr;
+    vm->stackTop--;
+    return OBJ_VAL(arr);
+}
+
+// ucoreSystem.args() -> ["script.unna", "arg1", "arg2"]
+static Value sys_args(VM* vm, Value* args, int argCount) {
+    (void)args; (void)argCount;
+    return argvArray(vm, 0);
+}
+
+// args() -> ["arg1", "arg2"]: the arguments after the script's path
+static Value sys_scriptArgs(VM* vm, Value* args, int argCount) {
+    (void)args; (void)argCount;
+    return argvArray(vm, 1);
 }
 
 // input(prompt) -> string
 static Value sys_input(VM* vm, Value* args, int argCount) {
     if (argCount > 0 && IS_STRING(args[0])) {
-        printf("%s", AS_CSTRING(args[0]));
-        fflush(stdout); // Ensure prompt is visible
+        writeOutput(vm, AS_CSTRING(args[0]), (size_t)AS_STRING(args[0])->length);
     }
+    flushOutput(vm); // The prompt and what was printed before it are visible
     
     char* line = NULL;
     size_t len = 0;
     ssize_t read;
     
     read = getline(&line, &len, stdin);
+    noteIOProgress(vm);
     if (read != -1) {
         // Remove newline
         int realLen = read;
@@ -69,6 +80,32 @@ static Value sys_getenv(VM* vm, Value* args, int argCount) {
     return OBJ_VAL(empty);
 }
 
+// getenv(name) -> string or nil (the global; ucoreSystem.getenv gives "")
+static Value sys_getenvOrNil(VM* vm, Value* args, int argCount) {
+    if (argCount != 1 || !IS_STRING(args[0])) return nativeError(vm, "getenv() expects a name string.");
+    char* val = getenv(AS_CSTRING(args[0]));
+    if (!val) return NIL_VAL;
+    return OBJ_VAL(internString(vm, val, strlen(val)));
+}
+
+// setenv(name, value) -> nil. A nil value removes the variable. Commands
+// run by exec() see the change.
+static Value sys_setenv(VM* vm, Value* args, int argCount) {
+    if (argCount != 2 || !IS_STRING(args[0])) return nativeError(vm, "setenv() expects a name string and a value.");
+    const char* name = AS_CSTRING(args[0]);
+    if (name[0] == '\0' || strchr(name, '=')) {
+        return nativeError(vm, "setenv(): invalid name \"%s\".", name);
+    }
+    if (IS_NIL(args[1])) {
+        unsetenv(name);
+    } else if (IS_STRING(args[1])) {
+        if (setenv(name, AS_CSTRING(args[1]), 1) != 0) return nativeError(vm, "setenv(): could not set \"%s\".", name);
+    } else {
+        return nativeError(vm, "setenv() expects a string or nil value, got %s.", valueTypeName(args[1]));
+    }
+    return NIL_VAL;
+}
+
 // fileExists(path) -> bool
 static Value sys_fileExists(VM* vm, Value* args, int argCount) {
     if (argCount != 1 || !IS_STRING(args[0])) return BOOL_VAL(false);
@@ -83,7 +120,7 @@ static Value sys_fileExists(VM* vm, Value* args, int argCount) {
 // writeFile(path, content) -> bool
 static Value sys_writeFile(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_STRING(args[0]) || !IS_STRING(args[1])) {
-        printf("Error: ucoreSystem.writeFile(path, content) expects 2 string arguments.\n");
+        writeOutputf(vm, "Error: ucoreSystem.writeFile(path, content) expects 2 string arguments.\n");
         return BOOL_VAL(false);
     }
     
@@ -92,7 +129,7 @@ static Value sys_writeFile(VM* vm, Value* args, int argCount) {
     
     FILE* f = fopen(path, "w");
     if (!f) {
-        printf("Error: Could not open file for writing: %s\n", path);
+        writeOutputf(vm, "Error: Could not open file for writing: %s\n", path);
         free(path);
         return BOOL_VAL(false);
     }
@@ -144,24 +181,24 @@ static Value sys_readFile(VM* vm, Value* args, int argCount) {
 
 // exit(code)
 static Value sys_exit(VM* vm, Value* args, int argCount) {
-    (void)vm;
     int code = 0;
     if (argCount > 0) {
         if (IS_INT(args[0])) code = AS_INT(args[0]);
         else if (IS_FLOAT(args[0])) code = (int)AS_FLOAT(args[0]);
     }
+    flushOutput(vm);
     exit(code);
     return NIL_VAL; 
 }
 
 // exec(command) -> exitCode (int)
 static Value sys_exec(VM* vm, Value* args, int argCount) {
-    (void)vm;
     if (argCount != 1 || !IS_STRING(args[0])) {
         return INT_VAL(-1);
     }
     
     ObjString* cmd = AS_STRING(args[0]);
+    flushOutput(vm); // The command writes to the same stdout
     int result = system(cmd->chars);
     return INT_VAL(result); // Usually 0 is success
 }
@@ -182,27 +219,49 @@ static Value sys_sleep(VM* vm, Value* args, int argCount) {
     return NIL_VAL;
 }
 
+// gc() -> bytes freed by a full collection
+static Value sys_gc(VM* vm, Value* args, int argCount) {
+    (void)args; (void)argCount;
+    size_t before = vm->bytesAllocated;
+    collectGarbage(vm);
+    return INT_VAL(before > vm->bytesAllocated ? (int64_t)(before - vm->bytesAllocated) : 0);
+}
+
+// gcStats() -> map of heap counters
+static Value sys_gcStats(VM* vm, Value* args, int argCount) {
+    (void)args; (void)argCount;
+    Map* m = newMap(vm);
+    mapSetStr(vm, m, "heapBytes", 9, INT_VAL((int64_t)vm->bytesAllocated));
+    mapSetStr(vm, m, "nextGC", 6, INT_VAL((int64_t)vm->nextGC));
+    mapSetStr(vm, m, "peakBytes", 9, INT_VAL((int64_t)vm->gcPeakMemory));
+    mapSetStr(vm, m, "collections", 11, INT_VAL((int64_t)vm->gcCollectCount));
+    mapSetStr(vm, m, "freedBytes", 10, INT_VAL((int64_t)vm->gcTotalFreed));
+    mapSetStr(vm, m, "reusedBlocks", 12, INT_VAL((int64_t)vm->gcBlocksReused));
+    mapSetStr(vm, m, "newBlocks", 9, INT_VAL((int64_t)vm->gcBlocksNew));
+    mapSetStr(vm, m, "youngCollections", 16, INT_VAL((int64_t)vm->gcYoungCount));
+    mapSetStr(vm, m, "youngTraced", 11, INT_VAL((int64_t)vm->gcYoungTraced));
+    mapSetStr(vm, m, "lastTraced", 10, INT_VAL((int64_t)vm->gcLastTraced));
+    mapSetStr(vm, m, "promoted", 8, INT_VAL((int64_t)vm->gcPromoted));
+    mapSetStr(vm, m, "remembered", 10, INT_VAL((int64_t)vm->gcRememberedTotal));
+    return OBJ_VAL(m);
+}
+
+// identical(a, b) -> whether a and b are the same object (or the same
+// number, bool or nil). Unlike ==, two equal strings need not be identical.
+static Value sys_identical(VM* vm, Value* args, int argCount) {
+    (void)vm;
+    if (argCount != 2) return BOOL_VAL(false);
+    return BOOL_VAL(args[0] == args[1]);
+}
+
 void registerUCoreSystem(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreSystem", 11);
-    char* modName = modNameObj->chars;
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName);
-    mod->source = NULL;
-    mod->obj.isMarked = true; // PERMANENT ROOT
-    
-    // CRITICAL: Use ALLOCATE_OBJ for Environment to enable GC tracking
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true; // PERMANENT ROOT
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreSystem");
+    defineModuleAlias(vm, mod, "system");
 
     defineNative(vm, mod->env, "args", sys_args, 0);
     defineNative(vm, mod->env, "input", sys_input, 1);
     defineNative(vm, mod->env, "getenv", sys_getenv, 1);
+    defineNative(vm, mod->env, "setenv", sys_setenv, 2);
     defineNative(vm, mod->env, "exec", sys_exec, 1);
     defineNative(vm, mod->env, "exit", sys_exit, 1);
     defineNative(vm, mod->env, "fileExists", sys_fileExists, 1);
@@ -210,7 +269,12 @@ void registerUCoreSystem(VM* vm) {
     defineNative(vm, mod->env, "writeFile", sys_writeFile, 2);
     defineNative(vm, mod->env, "readFile", sys_readFile, 1);
     defineNative(vm, mod->env, "sleep", sys_sleep, 1);
+    defineNative(vm, mod->env, "gc", sys_gc, 0);
+    defineNative(vm, mod->env, "gcStats", sys_gcStats, 0);
+    defineNative(vm, mod->env, "identical", sys_identical, 2);
 
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreSystem", vMod);
+    // Globals for command-line scripts
+    defineNative(vm, vm->globalEnv, "args", sys_scriptArgs, 0);
+    defineNative(vm, vm->globalEnv, "getenv", sys_getenvOrNil, 1);
+    defineNative(vm, vm->globalEnv, "setenv", sys_setenv, 2);
 }
@@ -0,0 +1,62 @@
+#include "ucore_time.h"
+#include <time.h>
+#include <errno.h>
+#include <math.h>
+
+// Times are doubles in seconds. ucoreTimer offers the same clocks in
+// milliseconds; this library matches time.Now()-style code in other languages.
+
+static double secondsOf(const struct timespec* ts) {
+    return (double)ts->tv_sec + (double)ts->tv_nsec / 1e9;
+}
+
+// ucoreTime.now(): wall-clock Unix time
+static Value utime_now(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (!checkArgCount(vm, "ucoreTime.now", argCount, 0)) return NIL_VAL;
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    return FLOAT_VAL(secondsOf(&ts));
+}
+
+// ucoreTime.clock(): monotonic seconds from an arbitrary start. Setting
+// the system clock never moves it backwards, so it is the one to time with.
+static Value utime_clock(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (!checkArgCount(vm, "ucoreTime.clock", argCount, 0)) return NIL_VAL;
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return FLOAT_VAL(secondsOf(&ts));
+}
+
+// ucoreTime.sleep(seconds): block for at least 'seconds' (int or double)
+static Value utime_sleep(VM* vm, Value* args, int argCount) {
+    if (!checkArgCount(vm, "ucoreTime.sleep", argCount, 1)) return NIL_VAL;
+    if (!IS_NUMERIC(args[0])) {
+        return nativeError(vm, "ucoreTime.sleep expects a number but got %s.", valueTypeName(args[0]));
+    }
+    double seconds = AS_NUMERIC(args[0]);
+    if (!(seconds >= 0) || isinf(seconds)) {
+        return nativeError(vm, "ucoreTime.sleep expects a finite, non-negative duration.");
+    }
+    struct timespec req;
+    req.tv_sec = (time_t)seconds;
+    // Round up so the sleep is never shorter than asked
+    req.tv_nsec = (long)ceil((seconds - (double)req.tv_sec) * 1e9);
+    if (req.tv_nsec > 999999999L) {
+        req.tv_sec++;
+        req.tv_nsec = 0;
+    }
+    // A signal cuts nanosleep short; sleep for whatever remains
+    while (nanosleep(&req, &req) == -1 && errno == EINTR) { }
+    return NIL_VAL;
+}
+
+void registerUCoreTime(VM* vm) {
+    Module* mod = defineNativeModule(vm, "ucoreTime");
+    defineModuleAlias(vm, mod, "time");
+
+    defineNative(vm, mod->env, "now", utime_now, 0);
+    defineNative(vm, mod->env, "clock", utime_clock, 0);
+    defineNative(vm, mod->env, "sleep", utime_sleep, 1);
+}
@@ -22,7 +22,7 @@ static Value utimer_now(VM* vm, Value* args, int argCount) {
 static Value utimer_sleep(VM* vm, Value* args, int argCount) {
     (void)vm;
     if (argCount != 1 || !IS_INT(args[0])) {
-        printf("Error: ucoreTimer.sleep expects 1 int argument (ms).\n");
+        writeOutputf(vm, "Error: ucoreTimer.sleep expects 1 int argument (ms).\n");
         return INT_VAL(0);
     }
     
@@ -36,27 +36,9 @@ static Value utimer_sleep(VM* vm, Value* args, int argCount) {
 }
 
 void registerUCoreTimer(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreTimer", 10);
-    // Use raw chars
-    char* modName = modNameObj->chars;
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName);
-    mod->obj.isMarked = true; 
-    mod->obj.isPermanent = true; // PERMANENT ROOT
-    
-    // CRITICAL: Use ALLOCATE_OBJ for Environment to enable GC tracking
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true; // PERMANENT ROOT
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreTimer");
+    defineModuleAlias(vm, mod, "timer");
 
     defineNative(vm, mod->env, "now", utimer_now, 0);
     defineNative(vm, mod->env, "sleep", utimer_sleep, 1);
-
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreTimer", vMod);
 }
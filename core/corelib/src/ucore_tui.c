@@ -151,9 +151,13 @@ static const char* colorNameToBg(const char* name) {
 // Terminal Primitives
 // ============================================================================
 
+// The functions in this module that write to the terminal do it with
+// printf, after flushOutput so that what print has buffered comes first.
+
 // clear() - Clear entire screen
 static Value tui_clear(VM* vm, Value* args, int argCount) {
-    (void)vm; (void)args; (void)argCount;
+    (void)args; (void)argCount;
+    flushOutput(vm);
     printf(CSI "2J" CSI "H");
     fflush(stdout);
     return NIL_VAL;
@@ -161,7 +165,8 @@ static Value tui_clear(VM* vm, Value* args, int argCount) {
 
 // clearLine() - Clear current line
 static Value tui_clearLine(VM* vm, Value* args, int argCount) {
-    (void)vm; (void)args; (void)argCount;
+    (void)args; (void)argCount;
+    flushOutput(vm);
     printf(CSI "2K\r");
     fflush(stdout);
     return NIL_VAL;
@@ -169,12 +174,12 @@ static Value tui_clearLine(VM* vm, Value* args, int argCount) {
 
 // moveTo(row, col) - Move cursor to position (1-indexed)
 static Value tui_moveTo(VM* vm, Value* args, int argCount) {
-    (void)vm;
     if (argCount < 2) return NIL_VAL;
     
     int row = IS_INT(args[0]) ? AS_INT(args[0]) : (int)AS_FLOAT(args[0]);
     int col = IS_INT(args[1]) ? AS_INT(args[1]) : (int)AS_FLOAT(args[1]);
     
+    flushOutput(vm);
     printf(CSI "%d;%dH", row, col);
     fflush(stdout);
     return NIL_VAL;
@@ -182,7 +187,8 @@ static Value tui_moveTo(VM* vm, Value* args, int argCount) {
 
 // hideCursor()
 static Value tui_hideCursor(VM* vm, Value* args, int argCount) {
-    (void)vm; (void)args; (void)argCount;
+    (void)args; (void)argCount;
+    flushOutput(vm);
     printf(CSI "?25l");
     fflush(stdout);
     return NIL_VAL;
@@ -190,7 +196,8 @@ static Value tui_hideCursor(VM* vm, Value* args, int argCount) {
 
 // showCursor()
 static Value tui_showCursor(VM* vm, Value* args, int argCount) {
-    (void)vm; (void)args; (void)argCount;
+    (void)args; (void)argCount;
+    flushOutput(vm);
     printf(CSI "?25h");
     fflush(stdout);
     return NIL_VAL;
@@ -207,8 +214,8 @@ static Value tui_size(VM* vm, Value* args, int argCount) {
     Map* m = newMap(vm);
     
     // Add rows and cols using available API
-    mapSetStr(m, "rows", 4, INT_VAL(w.ws_row));
-    mapSetStr(m, "cols", 4, INT_VAL(w.ws_col));
+    mapSetStr(vm, m, "rows", 4, INT_VAL(w.ws_row));
+    mapSetStr(vm, m, "cols", 4, INT_VAL(w.ws_col));
     
     return OBJ_VAL(m);
 }
@@ -407,6 +414,7 @@ static Value tui_input(VM* vm, Value* args, int argCount) {
         prompt = AS_CSTRING(args[0]);
     }
     
+    flushOutput(vm);
     printf("%s", prompt);
     fflush(stdout);
     
@@ -492,6 +500,7 @@ static Value tui_inputPassword(VM* vm, Value* args, int argCount) {
         prompt = AS_CSTRING(args[0]);
     }
     
+    flushOutput(vm);
     printf("%s", prompt);
     fflush(stdout);
     
@@ -533,12 +542,12 @@ static Value tui_inputPassword(VM* vm, Value* args, int argCount) {
 
 // confirm(prompt) - Yes/No prompt
 static Value tui_confirm(VM* vm, Value* args, int argCount) {
-    (void)vm;
     const char* prompt = "Confirm?";
     if (argCount >= 1 && IS_STRING(args[0])) {
         prompt = AS_CSTRING(args[0]);
     }
     
+    flushOutput(vm);
     printf("%s [y/n] ", prompt);
     fflush(stdout);
     
@@ -566,7 +575,6 @@ static Value tui_confirm(VM* vm, Value* args, int argCount) {
 
 // select(prompt, options) - Arrow-key selection menu
 static Value tui_select(VM* vm, Value* args, int argCount) {
-    (void)vm;
     if (argCount < 2 || !IS_STRING(args[0]) || !IS_ARRAY(args[1])) {
         return INT_VAL(-1);
     }
@@ -578,6 +586,7 @@ static Value tui_select(VM* vm, Value* args, int argCount) {
     
     int selected = 0;
     
+    flushOutput(vm);
     printf("%s\r\n", prompt);
     
     // Flush any existing garbage in input buffer BEFORE enabling raw mode
@@ -705,6 +714,7 @@ static Value tui_inputBox(VM* vm, Value* args, int argCount) {
     // Top border: ╭─ Title ─...─╮
     // Chars: TL(1) + dash(1) + space(1) + title + space(1) + dashes(remaining) + TR(1) = width
     // Save cursor position before drawing
+    flushOutput(vm);
     printf(CSI "s");
     
     // Top border: ╭─ Title ─...─╮
@@ -971,7 +981,7 @@ static Value tui_table(VM* vm, Value* args, int argCount) {
             if (IS_STRING(row->items[j])) {
                 strncpy(cellBuf, AS_CSTRING(row->items[j]), sizeof(cellBuf) - 1);
             } else if (IS_INT(row->items[j])) {
-                snprintf(cellBuf, sizeof(cellBuf), "%d", AS_INT(row->items[j]));
+                snprintf(cellBuf, sizeof(cellBuf), "%lld", (long long)AS_INT(row->items[j]));
             } else if (IS_FLOAT(row->items[j])) {
                 snprintf(cellBuf, sizeof(cellBuf), "%.2f", AS_FLOAT(row->items[j]));
             }
@@ -1009,7 +1019,7 @@ static Value tui_table(VM* vm, Value* args, int argCount) {
                 if (IS_STRING(row->items[j])) {
                     strncpy(cellBuf, AS_CSTRING(row->items[j]), sizeof(cellBuf) - 1);
                 } else if (IS_INT(row->items[j])) {
-                    snprintf(cellBuf, sizeof(cellBuf), "%d", AS_INT(row->items[j]));
+                    snprintf(cellBuf, sizeof(cellBuf), "%lld", (long long)AS_INT(row->items[j]));
                 } else if (IS_FLOAT(row->items[j])) {
                     snprintf(cellBuf, sizeof(cellBuf), "%.2f", AS_FLOAT(row->items[j]));
                 }
@@ -1444,22 +1454,8 @@ static Value tui_boxEnd(VM* vm, Value* args, int argCount) {
 
 // Module Registration
 void registerUCoreTui(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreTui", 8);
-    char* modName = modNameObj->chars;
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName);
-    mod->source = NULL;
-    mod->obj.isMarked = true;
-    mod->obj.isPermanent = true;
-    
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true;
-    modEnv->obj.isPermanent = true;
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreTui");
+    defineModuleAlias(vm, mod, "tui");
 
     // Terminal primitives
     defineNative(vm, mod->env, "clear", tui_clear, 0);
@@ -1506,7 +1502,4 @@ void registerUCoreTui(VM* vm) {
     defineNative(vm, mod->env, "inputBox", tui_inputBox, 3);
     defineNative(vm, mod->env, "inputPasswordBox", tui_inputPasswordBox, 2);
     defineNative(vm, mod->env, "keypress", tui_keypress, 0);
-
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreTui", vMod);
 }
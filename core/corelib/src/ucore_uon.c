@@ -5,9 +5,6 @@
 #include <stdio.h>
 #include <unistd.h>
 
-// Schema storage only - we don't store data anymore
-static Map* uonSchemas = NULL; // TableName -> StructDef
-
 // Cursor structure for streaming
 typedef struct {
     FILE* file;
@@ -17,8 +14,9 @@ typedef struct {
 
 static void cursorCleanup(void* data);
 
+// Schemas live in the VM, which marks them
 static void ensureInit(VM* vm) {
-    if (!uonSchemas) uonSchemas = newMap(vm);
+    if (!vm->uonSchemas) vm->uonSchemas = newMap(vm);
 }
 
 // ---- Parser Utils ----
@@ -95,6 +93,10 @@ static void parseSchemaBlock(VM* vm, const char** p) {
         def->name = tableName;
         def->fields = malloc(16 * sizeof(char*));
         def->fieldCount = 0;
+        def->defaults = NULL;
+        def->methods = NULL;
+        def->methodCount = 0;
+        def->shape = ++vm->structShapes;
         int cap = 16;
         
         while (peek(*p) && peek(*p) != ']') {
@@ -118,7 +120,7 @@ static void parseSchemaBlock(VM* vm, const char** p) {
         if (peek(*p) == ']') (*p)++;
         
         Value vDef = OBJ_VAL(def);
-        mapSetStr(uonSchemas, tableName, (int)strlen(tableName), vDef);
+        mapSetStr(vm, vm->uonSchemas, tableName, (int)strlen(tableName), vDef);
         
         skipSpace(p);
         if (peek(*p) == ',') (*p)++;
@@ -223,7 +225,7 @@ static Value uon_next_impl(VM* vm, Value* args, int argCount) {
         fskipSpace(f);
         if (fgetc(f) == ':') {
              Value val = fparseValue(vm, f);
-             mapSetStr(m, key, (int)strlen(key), val);
+             mapSetStr(vm, m, key, (int)strlen(key), val);
         }
         free(key);
         
@@ -356,7 +358,7 @@ static Value fparseValue(VM* vm, FILE* f) {
         if (strchr(buf, '.')) {
             return FLOAT_VAL(atof(buf));
         } else {
-            return INT_VAL(atoi(buf));
+            return intValue(vm, strtoll(buf, NULL, 10));
         }
     }
     
@@ -431,7 +433,7 @@ static void uon_serialize_val(Value v, char** buf, int* len, int* cap) {
 // dataMap: { tableName: [{ field1: val, ... }, ...], ... }
 static Value uon_generate(VM* vm, Value* args, int argCount) {
     if (argCount != 2 || !IS_OBJ(args[0]) || !IS_OBJ(args[1])) {
-        printf("Error: ucoreUon.generate(schema, data) expects 2 map arguments.\n");
+        writeOutputf(vm, "Error: ucoreUon.generate(schema, data) expects 2 map arguments.\n");
         ObjString* empty = internString(vm, "", 0);
         return OBJ_VAL(empty);
     }
@@ -440,7 +442,7 @@ static Value uon_generate(VM* vm, Value* args, int argCount) {
     Obj* dataObj = AS_OBJ(args[1]);
     
     if (schemaObj->type != OBJ_MAP || dataObj->type != OBJ_MAP) {
-        printf("Error: ucoreUon.generate expects map arguments.\n");
+        writeOutputf(vm, "Error: ucoreUon.generate expects map arguments.\n");
         ObjString* empty = internString(vm, "", 0);
         return OBJ_VAL(empty);
     }
@@ -457,29 +459,25 @@ static Value uon_generate(VM* vm, Value* args, int argCount) {
     uon_buf_append(&buf, &len, &cap, "@schema {\n");
     
     bool firstTable = true;
-    for (int i = 0; i < TABLE_SIZE; i++) {
-        MapEntry* e = schema->buckets[i];
-        while (e) {
-            if (!firstTable) uon_buf_append(&buf, &len, &cap, ",\n");
-            firstTable = false;
-            
-            uon_buf_append(&buf, &len, &cap, "    ");
-            uon_buf_append(&buf, &len, &cap, e->key);
-            uon_buf_append(&buf, &len, &cap, ": [");
-            
-            // Schema value should be an array of field names
-            if (IS_OBJ(e->value) && AS_OBJ(e->value)->type == OBJ_ARRAY) {
-                Array* fields = (Array*)AS_OBJ(e->value);
-                for (int j = 0; j < fields->count; j++) {
-                    if (j > 0) uon_buf_append(&buf, &len, &cap, ", ");
-                    if (IS_STRING(fields->items[j])) {
-                        uon_buf_append(&buf, &len, &cap, AS_CSTRING(fields->items[j]));
-                    }
+    for (MapEntry* e = mapFirstEntry(schema); e; e = mapNextEntry(schema, e)) {
+        if (!firstTable) uon_buf_append(&buf, &len, &cap, ",\n");
+        firstTable = false;
+        
+        uon_buf_append(&buf, &len, &cap, "    ");
+        uon_buf_append(&buf, &len, &cap, e->key);
+        uon_buf_append(&buf, &len, &cap, ": [");
+        
+        // Schema value should be an array of field names
+        if (IS_OBJ(e->value) && AS_OBJ(e->value)->type == OBJ_ARRAY) {
+            Array* fields = (Array*)AS_OBJ(e->value);
+            for (int j = 0; j < fields->count; j++) {
+                if (j > 0) uon_buf_append(&buf, &len, &cap, ", ");
+                if (IS_STRING(fields->items[j])) {
+                    uon_buf_append(&buf, &len, &cap, AS_CSTRING(fields->items[j]));
                 }
             }
-            uon_buf_append(&buf, &len, &cap, "]");
-            e = e->next;
         }
+        uon_buf_append(&buf, &len, &cap, "]");
     }
     uon_buf_append(&buf, &len, &cap, "\n}\n\n");
     
@@ -487,44 +485,36 @@ static Value uon_generate(VM* vm, Value* args, int argCount) {
     uon_buf_append(&buf, &len, &cap, "@flow {\n");
     
     firstTable = true;
-    for (int i = 0; i < TABLE_SIZE; i++) {
-        MapEntry* e = data->buckets[i];
-        while (e) {
-            if (!firstTable) uon_buf_append(&buf, &len, &cap, ",\n");
-            firstTable = false;
-            
-            uon_buf_append(&buf, &len, &cap, "    ");
-            uon_buf_append(&buf, &len, &cap, e->key);
-            uon_buf_append(&buf, &len, &cap, ": [\n");
-            
-            // Data value should be an array of maps (records)
-            if (IS_OBJ(e->value) && AS_OBJ(e->value)->type == OBJ_ARRAY) {
-                Array* records = (Array*)AS_OBJ(e->value);
-                for (int j = 0; j < records->count; j++) {
-                    if (j > 0) uon_buf_append(&buf, &len, &cap, ",\n");
-                    uon_buf_append(&buf, &len, &cap, "        { ");
-                    
-                    if (IS_OBJ(records->items[j]) && AS_OBJ(records->items[j])->type == OBJ_MAP) {
-                        Map* record = (Map*)AS_OBJ(records->items[j]);
-                        bool firstField = true;
-                        for (int k = 0; k < TABLE_SIZE; k++) {
-                            MapEntry* f = record->buckets[k];
-                            while (f) {
-                                if (!firstField) uon_buf_append(&buf, &len, &cap, ", ");
-                                firstField = false;
-                                uon_buf_append(&buf, &len, &cap, f->key);
-                                uon_buf_append(&buf, &len, &cap, ": ");
-                                uon_serialize_val(f->value, &buf, &len, &cap);
-                                f = f->next;
-                            }
-                        }
+    for (MapEntry* e = mapFirstEntry(data); e; e = mapNextEntry(data, e)) {
+        if (!firstTable) uon_buf_append(&buf, &len, &cap, ",\n");
+        firstTable = false;
+        
+        uon_buf_append(&buf, &len, &cap, "    ");
+        uon_buf_append(&buf, &len, &cap, e->key);
+        uon_buf_append(&buf, &len, &cap, ": [\n");
+        
+        // Data value should be an array of maps (records)
+        if (IS_OBJ(e->value) && AS_OBJ(e->value)->type == OBJ_ARRAY) {
+            Array* records = (Array*)AS_OBJ(e->value);
+            for (int j = 0; j < records->count; j++) {
+                if (j > 0) uon_buf_append(&buf, &len, &cap, ",\n");
+                uon_buf_append(&buf, &len, &cap, "        { ");
+                
+                if (IS_OBJ(records->items[j]) && AS_OBJ(records->items[j])->type == OBJ_MAP) {
+                    Map* record = (Map*)AS_OBJ(records->items[j]);
+                    bool firstField = true;
+                    for (MapEntry* f = mapFirstEntry(record); f; f = mapNextEntry(record, f)) {
+                        if (!firstField) uon_buf_append(&buf, &len, &cap, ", ");
+                        firstField = false;
+                        uon_buf_append(&buf, &len, &cap, f->key);
+                        uon_buf_append(&buf, &len, &cap, ": ");
+                        uon_serialize_val(f->value, &buf, &len, &cap);
                     }
-                    uon_buf_append(&buf, &len, &cap, " }");
                 }
+                uon_buf_append(&buf, &len, &cap, " }");
             }
-            uon_buf_append(&buf, &len, &cap, "\n    ]");
-            e = e->next;
         }
+        uon_buf_append(&buf, &len, &cap, "\n    ]");
     }
     uon_buf_append(&buf, &len, &cap, "\n}\n");
     
@@ -535,7 +525,7 @@ static Value uon_generate(VM* vm, Value* args, int argCount) {
 
 static Value uon_save_dummy(VM* vm, Value* args, int argCount) {
     (void)vm; (void)args; (void)argCount;
-    printf("Warning: ucoreUon.save() disabled in lazy mode (read-only optimization).\n");
+    writeOutputf(vm, "Warning: ucoreUon.save() disabled in lazy mode (read-only optimization).\n");
     return BOOL_VAL(true);
 }
 
@@ -545,21 +535,8 @@ static Value uon_noop(VM* vm, Value* args, int argCount) {
 }
 
 void registerUCoreUON(VM* vm) {
-    ObjString* modNameObj = internString(vm, "ucoreUon", 8);
-    char* modName = modNameObj->chars; 
-    
-    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-    mod->name = strdup(modName); 
-    mod->obj.isMarked = true; // PERMANENT ROOT
-    
-    // CRITICAL: Use ALLOCATE_OBJ for Environment to enable GC tracking
-    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
-    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
-    modEnv->enclosing = NULL;
-    modEnv->obj.isMarked = true; 
-    modEnv->obj.isPermanent = true; // PERMANENT ROOT
-    mod->env = modEnv;
+    Module* mod = defineNativeModule(vm, "ucoreUon");
+    defineModuleAlias(vm, mod, "uon");
 
     defineNative(vm, mod->env, "parse", uon_parse, 1);
     defineNative(vm, mod->env, "load", uon_load_impl, 1);
@@ -568,7 +545,4 @@ void registerUCoreUON(VM* vm) {
     defineNative(vm, mod->env, "generate", uon_generate, 2);
     defineNative(vm, mod->env, "save", uon_save_dummy, 1);
     defineNative(vm, mod->env, "insert", uon_noop, 2);
-
-    Value vMod = OBJ_VAL(mod);
-    defineGlobal(vm, "ucoreUon", vMod);
 }
@@ -12,6 +12,28 @@
  * Optimized for cache-friendly sequential execution.
  */
 
+// Where an instruction came from in the source
+typedef struct SourceLocation {
+    int line;
+    int column;                 // 1-based, 0 when unknown
+} SourceLocation;
+
+// Where a named local lives, for the debugger
+typedef struct LocalDebugInfo {
+    char* name;
+    int reg;                    // Register holding the local
+    int startPc;                // First instruction where the local is in scope
+    int endPc;                  // First one after its scope, or -1 (end of chunk)
+} LocalDebugInfo;
+
+// What the GETPROP or SETPROP at one offset last found: the field
+// 'slot' of instances of the struct with this shape, or for a negative
+// slot its method ~slot. Shape 0 is never handed out, an empty cache.
+typedef struct PropertyCache {
+    uint32_t shape;
+    int slot;
+} PropertyCache;
+
 typedef struct BytecodeChunk {
     // === Code Stream (32-bit instructions) ===
     uint32_t* code;             // Register-based instruction words
@@ -24,11 +46,20 @@ typedef struct BytecodeChunk {
     int constantCapacity;
 
     // === Debug Info ===
-    int* lineNumbers;           // Line number per instruction
-    int lineCapacity;
+    SourceLocation* locations;  // Source position per instruction
+    int locationCapacity;
+    char* sourcePath;           // Source file the positions refer to, when the
+                                // chunk was loaded from a .unc; NULL otherwise
+    LocalDebugInfo* locals;     // Named locals in declaration order
+    int localCount;
+    int localCapacity;
 
     // === Register Info ===
     int maxRegs;                // Maximum register index used by this chunk
+
+    // === Inline Caches ===
+    PropertyCache* propertyCaches; // One per instruction, made on the first property access
+    int propertyCacheCount;
 } BytecodeChunk;
 
 // Chunk lifecycle
@@ -36,16 +67,31 @@ void initChunk(BytecodeChunk* chunk);
 void freeChunk(BytecodeChunk* chunk);
 
 // Code emission (32-bit instruction words)
-void writeChunk(BytecodeChunk* chunk, uint32_t instruction, int line);
+void writeChunk(BytecodeChunk* chunk, uint32_t instruction, int line, int column);
+
+// Source line of the instruction at 'offset', or 0 when out of range
+int chunkLine(BytecodeChunk* chunk, int offset);
 
 // Patch jump target at given instruction index
 void patchJump(BytecodeChunk* chunk, int offset);
 
+// The inline cache of the property access at 'offset'
+PropertyCache* growPropertyCaches(BytecodeChunk* chunk, int offset);
+static inline PropertyCache* propertyCache(BytecodeChunk* chunk, int offset) {
+    if (offset < chunk->propertyCacheCount) return &chunk->propertyCaches[offset];
+    return growPropertyCaches(chunk, offset);
+}
+
 // Constant pool
 int addConstant(BytecodeChunk* chunk, Value value);
 
-// Debug
+// Record a named local in register 'reg', in scope from 'startPc'; returns its index
+int addLocalInfo(BytecodeChunk* chunk, const char* name, int reg, int startPc);
+
+// Debug: disassembleChunk also lists every nested function chunk
 void disassembleChunk(BytecodeChunk* chunk, const char* name);
 int disassembleInstruction(BytecodeChunk* chunk, int offset);
+// The opcode and operands of one instruction, without offset, line or newline
+void describeInstruction(FILE* out, BytecodeChunk* chunk, int offset);
 
 #endif // BYTECODE_CHUNK_H
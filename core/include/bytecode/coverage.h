@@ -0,0 +1,39 @@
+#ifndef BYTECODE_COVERAGE_H
+#define BYTECODE_COVERAGE_H
+
+#include <stdio.h>
+#include "bytecode/chunk.h"
+#include "vm.h"
+
+/**
+ * Line Coverage ('unnarize --coverage', 'unnarize test --coverage')
+ *
+ * While vm->coverage is set the interpreter calls coverInstruction before
+ * every instruction, through the same hook table as the debugger, and the
+ * line that instruction came from is marked as run. A line is executable
+ * when some instruction came from it; comments, blank lines and lines of
+ * braces alone have none and are not counted.
+ *
+ * The first instruction run from a chunk counts the lines of that chunk and
+ * of every function nested in it, so a function that is never called shows
+ * its body as not run. The return the compiler adds at the end of each
+ * function is left out: it carries the declaration's line.
+ */
+
+typedef struct Coverage Coverage;
+
+Coverage* newCoverage(void);
+void freeCoverage(Coverage* coverage);
+
+// Marks the line of the instruction at 'ip' as run
+void coverInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip);
+
+// Drops the chunks of a VM about to be freed; the lines they counted stay,
+// so one report can cover several runs
+void forgetCoverageChunks(Coverage* coverage);
+
+// Per file: executable lines, the lines run and their share, then the lines
+// that never ran
+void printCoverage(Coverage* coverage, FILE* out);
+
+#endif // BYTECODE_COVERAGE_H
@@ -0,0 +1,49 @@
+#ifndef BYTECODE_DEBUGGER_H
+#define BYTECODE_DEBUGGER_H
+
+#include <stdio.h>
+#include "bytecode/chunk.h"
+#include "vm.h"
+
+/**
+ * Source-Level Debugger ('unnarize debug')
+ *
+ * While vm->debugger is set the interpreter calls debugHook before every
+ * instruction. The hook stops when execution enters a line that has a
+ * breakpoint or ends a step, then reads commands until one resumes.
+ */
+
+#define DEBUG_BREAKPOINT_MAX 64
+
+typedef enum {
+    DEBUG_CONTINUE,     // Run until a breakpoint
+    DEBUG_STEP,         // Stop at the next line, entering calls
+    DEBUG_NEXT          // Stop at the next line of this frame or a caller
+} DebugMode;
+
+typedef struct Debugger {
+    const char* scriptPath;     // Breakpoint lines refer to this file
+    const char* source;         // Its text, or NULL for a bytecode image
+    BytecodeChunk* script;      // Top-level chunk, searched for breakpoint lines
+    FILE* in;                   // Command input
+
+    int breakpoints[DEBUG_BREAKPOINT_MAX]; // Source line per breakpoint, 0 once deleted
+    int breakpointCount;
+
+    DebugMode mode;
+    int stepDepth;              // Frame depth 'next' was given at
+
+    // The instruction that ran before the current one
+    BytecodeChunk* prevChunk;
+    uint32_t* prevIp;
+    int prevDepth;
+} Debugger;
+
+// Start stopped at the first line of 'script'
+void initDebugger(Debugger* dbg, const char* scriptPath, const char* source,
+                  BytecodeChunk* script, FILE* in);
+
+// Called with the instruction about to run and the current frame's registers
+void debugHook(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs);
+
+#endif // BYTECODE_DEBUGGER_H
@@ -13,4 +13,36 @@
 // Execute bytecode chunk
 uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth);
 
+// Call a bytecode function from a native and return its first result
+Value callBytecodeFunction(VM* vm, Function* func, Value* args, int argCount);
+
+// Call func with 'args' from outside the VM loop, leaving its return value
+// in *result when that is not NULL. A throw nothing catches is returned in
+// *thrown, with vm->errorTrace set, instead of ending the program; returns
+// false when that happens.
+bool callProtected(VM* vm, Function* func, Value* args, int argCount, Value* result, Value* thrown);
+
+// callProtected for a native calling back into the script: the callee's
+// frame returns to the call site in vm->nativeChunk/nativeIp, and natives
+// are called directly
+bool callGuarded(VM* vm, Function* func, Value* args, int argCount, Value* result, Value* thrown);
+
+// Start the vm->timeoutMs clock for a run (no deadline when it is 0)
+void startTimeout(VM* vm);
+// Stop the clock while a stepped run is paused and start it again where it
+// stopped, so the timeout counts only the time the run spends running
+void pauseTimeout(VM* vm);
+void resumeTimeout(VM* vm);
+
+// Before each instruction while vm->stepper is set (embed.c): once the
+// step's instructions are used up it switches back to the host, and
+// returns when the host steps the run again
+void stepHook(VM* vm);
+
+// Start the --watchdog timer thread when vm->watchdogMs is set. Once the
+// script has gone that long without input or output, the next limit check
+// stops it with an error that no try block catches.
+void startWatchdog(VM* vm);
+void stopWatchdog(VM* vm);
+
 #endif // BYTECODE_INTERPRETER_H
@@ -29,6 +29,7 @@ typedef enum {
     OP_GETGLOBAL,       // ABx:  R(A) = globals[K(Bx)]
     OP_SETGLOBAL,       // ABx:  globals[K(Bx)] = R(A)
     OP_DEFGLOBAL,       // ABx:  define globals[K(Bx)] = R(A)
+    OP_DEFCONST,        // ABx:  define globals[K(Bx)] = R(A), never to be rebound
 
     // === Arithmetic ===
     OP_ADD,             // ABC:  R(A) = R(B) + R(C)
@@ -36,9 +37,18 @@ typedef enum {
     OP_SUB,             // ABC:  R(A) = R(B) - R(C)
     OP_SUBI,            // AsBx: R(A) = R(B) - sBx
     OP_MUL,             // ABC:  R(A) = R(B) * R(C)
-    OP_DIV,             // ABC:  R(A) = R(B) / R(C)
+    OP_DIV,             // ABC:  R(A) = R(B) / R(C)  (always a double)
+    OP_IDIV,            // ABC:  R(A) = R(B) ~/ R(C)  (floor division)
     OP_MOD,             // ABC:  R(A) = R(B) % R(C)
     OP_NEG,             // ABC:  R(A) = -R(B)
+    OP_BAND,            // ABC:  R(A) = R(B) & R(C)
+    OP_BOR,             // ABC:  R(A) = R(B) | R(C)
+    OP_BXOR,            // ABC:  R(A) = R(B) ^ R(C)
+    OP_SHL,             // ABC:  R(A) = R(B) << R(C)
+    OP_SHR,             // ABC:  R(A) = R(B) >> R(C)  (arithmetic)
+    OP_BNOT,            // ABC:  R(A) = ~R(B)
+    OP_INC,             // ABC:  R(A) = R(B) + 1  (numbers only, for ++)
+    OP_DEC,             // ABC:  R(A) = R(B) - 1  (numbers only, for --)
 
     // === Comparisons ===
     OP_LT,              // ABC:  R(A) = R(B) < R(C)
@@ -56,30 +66,49 @@ typedef enum {
     OP_JMPF,            // AsBx: if !R(A): pc += sBx
     OP_JMPT,            // AsBx: if  R(A): pc += sBx
     OP_LOOP,            // sBx:  pc -= sBx  (backward jump, 24-bit)
+    OP_JMPARG,          // AsBx: if argument A was passed and not left out by name: pc += sBx  (skips a parameter default)
+    OP_JMPNIL,          // AsBx: if R(A) is nil: pc += sBx  (ends a ?. chain)
+    OP_JMPNOTNIL,       // AsBx: if R(A) is not nil: pc += sBx  (?? and ??= keep the left value)
 
     // === Function Calls ===
     OP_CALL,            // ABC:  call R(A) with B args at R(A+1..A+B), C result regs
-    OP_RETURN,          // A:    return R(A)
+    OP_TAILCALL,        // ABC:  as OP_CALL, but the callee takes over the current frame
+    OP_CALLSPREAD,      // ABC:  call R(A) with the elements of array R(B) as args, C result regs
+    OP_CALLNAMED,       // ABC:  as OP_CALL, the last of the B args named by the words of the string R(A+B+1)
+    OP_RETURN,          // AB:   return B values R(A..A+B-1)
     OP_RETURNNIL,       // -:    return nil
 
+    // === Closures ===
+    OP_CLOSURE,         // ABx:  R(A) = closure of K(Bx), followed by one capture word per upvalue:
+                        //       MOVE 0 B 0 captures R(B), GETUPVAL 0 B 0 re-captures Upvalue[B]
+    OP_GETUPVAL,        // ABC:  R(A) = Upvalue[B]
+    OP_SETUPVAL,        // ABC:  Upvalue[B] = R(A)
+    OP_CLOSE,           // A:    close open upvalues for R(A) and above
+
     // === Object / Property Access ===
     OP_GETPROP,         // ABC:  R(A) = R(B).K(C)   (property name from constant pool)
     OP_SETPROP,         // ABC:  R(A).K(B) = R(C)
+    OP_GETPROPR,        // ABC:  R(A) = R(B).R(C)   (the name string in R(C), for a constant past K(255))
+    OP_SETPROPR,        // ABC:  R(A).R(B) = R(C)
 
     // === Index Access ===
     OP_GETIDX,          // ABC:  R(A) = R(B)[R(C)]
     OP_SETIDX,          // ABC:  R(A)[R(B)] = R(C)
+    OP_SLICE,           // ABC:  R(A) = R(B)[R(C):R(C+1)]  (nil bound = omitted)
 
     // === Object Creation ===
     OP_NEWARRAY,        // ABx:  R(A) = new array with Bx initial elements from R(A+1..A+Bx)
     OP_NEWMAP,          // A:    R(A) = {}
+    OP_NEWSET,          // A:    R(A) = #{}
     OP_NEWSTRUCT,       // ABC:  R(A) = new instance of StructDef R(B) with C field values
 
     // === Struct Definition ===
     OP_STRUCTDEF,       // ABx:  define struct K(Bx) with A field names from K pool
+    OP_METHOD,          // ABC:  add function R(B) as a method of StructDef R(A)
 
     // === Array Builtins ===
-    OP_PUSH,            // ABC:  push(R(A), R(B))
+    OP_PUSH,            // ABC:  push(R(A), R(B)), or add R(B) to the set R(A)
+    OP_SPREAD,          // ABC:  push every element of iterable R(B) onto array or set R(A)
     OP_POP,             // ABC:  R(A) = pop(R(B))
     OP_LEN,             // ABC:  R(A) = len(R(B))
 
@@ -91,6 +120,9 @@ typedef enum {
     // === Async ===
     OP_ASYNC,           // ABC:  R(A) = async call R(B) with C args
     OP_AWAIT,           // ABC:  R(A) = await R(B)
+    OP_SPAWN,           // ABC:  spawn R(A) with B args R(A+1)..; C=1: the args are the array R(A+1)
+    OP_WITH,            // A:    push a handler that closes R(A) on throw; R(A) must be nil or have __close__
+    OP_ENDWITH,         // A:    pop the innermost handler and close R(A)
 
     // === Special ===
     OP_PRINT,           // A:    print R(A)
@@ -98,12 +130,18 @@ typedef enum {
     OP_NOP,             // -:    no operation
 
     // === Foreach ===
-    OP_FOREACH_PREP,    // ABC:  prepare foreach: R(A)=iterator, R(B)=collection
-    OP_FOREACH_NEXT,    // AsBx: R(A) = next element, jump sBx if exhausted
+    OP_FOREACH_PREP,    // ABC:  R(A) = iterable R(B), R(A+1) = cursor 0
+    OP_FOREACH_NEXT,    // AsBx: R(A+2) = next element of R(A), jump sBx if exhausted
 
     // === Concatenation (fast path) ===
     OP_CONCAT,          // ABC:  R(A) = R(B) .. R(C)  (string concat)
 
+    // === Exceptions ===
+    OP_TRY,             // AsBx: push handler; on throw R(A) = value, pc += sBx
+    OP_ENDTRY,          // -:    pop the innermost handler
+    OP_THROW,           // A:    throw R(A)
+    OP_DEFER,           // ABC:  run R(A) with B args R(A+1).. when the function ends; C=1: the args are the array R(A+1)
+
     OPCODE_COUNT
 } OpCode;
 
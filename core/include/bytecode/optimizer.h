@@ -0,0 +1,31 @@
+#ifndef BYTECODE_OPTIMIZER_H
+#define BYTECODE_OPTIMIZER_H
+
+#include "bytecode/chunk.h"
+
+/**
+ * Peephole Optimizer
+ *
+ * Rewrites a finished chunk in place, repeating until nothing changes:
+ *   - a jump to an unconditional JMP goes straight to that JMP's target,
+ *     and a JMP to a LOOP or a return becomes a copy of it
+ *   - JMPF/JMPT over a lone JMP becomes the opposite test jumping there
+ *   - JMP/JMPF/JMPT to the next instruction and MOVE R(A) R(A) are dropped
+ *   - LOADI R(A) n; NEG R(A) R(A) becomes LOADI R(A) -n
+ *   - a load is dropped when the next instruction overwrites its register
+ *     without reading it
+ *   - MOVE R(A) R(B); MOVE R(B) R(A) drops the second move
+ *   - MOVE R(A) R(B); RETURN R(A) 1 returns R(B), unless a closure
+ *     captures R(A)
+ *
+ * Two instructions are only merged when no jump lands on the second one.
+ * Removed instructions take their line entries with them, and every jump
+ * offset and debugger scope is repatched to the code that is left.
+ * Conditional jumps never become backward jumps, so every loop still runs
+ * through an OP_LOOP.
+ */
+
+// Optimize one compiled chunk; the compiler calls it for each function
+void optimizeChunk(BytecodeChunk* chunk);
+
+#endif // BYTECODE_OPTIMIZER_H
@@ -0,0 +1,30 @@
+#ifndef BYTECODE_PROFILER_H
+#define BYTECODE_PROFILER_H
+
+#include <stdio.h>
+#include "bytecode/chunk.h"
+#include "vm.h"
+
+/**
+ * Function Profiler ('unnarize --profile')
+ *
+ * While vm->profiler is set the interpreter calls profileInstruction before
+ * every instruction, through the same hook table as the debugger and
+ * --trace. It compares the call stack with the one it saw last, so every
+ * way a frame starts or ends (calls, tail calls, returns, throws, callbacks
+ * from natives, coroutine switches) is seen without hooks of its own.
+ */
+
+typedef struct Profiler Profiler;
+
+Profiler* newProfiler(void);
+void freeProfiler(Profiler* profiler);
+
+// Records the calls and returns since the previous instruction
+void profileInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip);
+
+// Ends the activations still open and prints calls, total and self time
+// per function, the most self time first
+void printProfile(VM* vm, FILE* out);
+
+#endif // BYTECODE_PROFILER_H
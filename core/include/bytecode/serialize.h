@@ -0,0 +1,82 @@
+#ifndef BYTECODE_SERIALIZE_H
+#define BYTECODE_SERIALIZE_H
+
+#include "bytecode/chunk.h"
+
+/**
+ * Bytecode Serialization (.unc files)
+ *
+ * Layout (all integers little-endian):
+ *   magic    "UNNC"               4 bytes
+ *   version  UNC_FORMAT_VERSION   1 byte
+ *   opcodes  OPCODE_COUNT         1 byte
+ *   source   int32 length + bytes: the file it was compiled from, relative
+ *            to the .unc's directory ("" when unknown)
+ *   chunk    (see writeChunkData in serialize.c)
+ *
+ * Nested function chunks are written recursively inside the constant
+ * pool of their parent. Bump UNC_FORMAT_VERSION whenever the instruction
+ * encoding, the opcode table or the constant layout changes.
+ *
+ * Every instruction keeps the line and column it was compiled from, and
+ * runtime errors in loaded code report them against the recorded source
+ * file, as they would for the source itself.
+ */
+
+#define UNC_MAGIC          "UNNC"
+#define UNC_MAGIC_LEN      4
+#define UNC_FORMAT_VERSION 23
+
+// True if the buffer starts with the .unc magic header
+bool isBytecodeImage(const char* data, size_t size);
+
+// Write a compiled chunk to 'path', recording 'sourcePath' (the file it was
+// compiled from, or NULL) for error reports. Returns false (and prints why)
+// on failure.
+bool writeBytecodeFile(BytecodeChunk* chunk, const char* path, const char* sourcePath);
+
+// Rehydrate a chunk from an in-memory .unc image into 'chunk' (already
+// initialized and reachable by the GC). 'modulePath' is recorded on the
+// loaded functions, and the source path recorded in the image is resolved
+// against its directory. An operand outside its chunk makes the image
+// corrupt, like a short read. Returns false (and prints why to the VM's
+// errorOut) on failure.
+bool loadBytecode(VM* vm, const char* data, size_t size, BytecodeChunk* chunk, const char* modulePath);
+
+/**
+ * Bytecode Cache
+ *
+ * A script run from source is compiled once and its bytecode kept in the
+ * cache directory: $UNNARIZE_CACHE_DIR, else $XDG_CACHE_HOME/unnarize, else
+ * ~/.cache/unnarize. A cache file is a key followed by a .unc image:
+ *
+ *   magic    "UNCK"               4 bytes
+ *   version  int32 length + UNNARIZE_VERSION
+ *   options  uint8: 1 when optimized
+ *   binary   uint64 size, uint64 mtime of the interpreter that wrote it
+ *   source   uint64 size, uint64 FNV-1a hash of the source
+ *   image    uint64 size, uint64 FNV-1a hash of the image that follows
+ *
+ * The image records no source path: the functions loaded from it report
+ * errors against the script's path, as compiled ones do. A key that does
+ * not match the script, the interpreter or the options makes the file
+ * stale, and so does an image that no longer matches its size and hash;
+ * the script is compiled again and the file replaced. An image the loader
+ * rejects all the same (see loadBytecode) is compiled again too.
+ */
+
+// Path of the cache file for the script at 'sourcePath' in 'out', making
+// the cache directory when needed. False when caching is off
+// (UNNARIZE_CACHE_DIR set but empty) or no directory can be made.
+bool bytecodeCachePath(const char* sourcePath, char* out, size_t size);
+
+// The .unc image cached in 'path' for this source and options, as a buffer
+// to free, with its size in *imageSize; NULL when there is none, it is
+// stale or it was damaged
+char* readBytecodeCache(const char* path, const char* source, size_t sourceSize, bool optimized, size_t* imageSize);
+
+// Cache the freshly compiled 'chunk' for 'source' in 'path'. Returns false,
+// quietly, when the file cannot be written.
+bool writeBytecodeCache(BytecodeChunk* chunk, const char* path, const char* source, size_t sourceSize, bool optimized);
+
+#endif // BYTECODE_SERIALIZE_H
@@ -0,0 +1,19 @@
+#ifndef BYTECODE_TRACER_H
+#define BYTECODE_TRACER_H
+
+#include <stdio.h>
+#include "bytecode/chunk.h"
+#include "vm.h"
+
+/**
+ * Execution Trace ('unnarize --trace')
+ *
+ * While vm->traceOut is set the interpreter calls traceInstruction before
+ * every instruction, through the same hook table as the debugger, so runs
+ * without --trace dispatch exactly as before.
+ */
+
+// One line: frame depth and function, offset, line, opcode, operands, registers
+void traceInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs);
+
+#endif // BYTECODE_TRACER_H
@@ -14,6 +14,7 @@
 #include <string.h>
 #include <stdbool.h>
 #include <ctype.h>
+#include <setjmp.h>
 
 // Unnarize interpreter version
 // Update this string when making a release.
@@ -35,6 +36,7 @@ typedef enum {
     TOKEN_MINUS,
     TOKEN_STAR,
     TOKEN_SLASH,
+    TOKEN_TILDE_SLASH, // ~/ (floor division)
     TOKEN_PERCENT,
     TOKEN_EQUAL,
     TOKEN_EQUAL_EQUAL,
@@ -47,17 +49,20 @@ typedef enum {
     TOKEN_LEFT_PAREN,
     TOKEN_RIGHT_PAREN,
     TOKEN_LEFT_BRACE,
+    TOKEN_HASH_LEFT_BRACE, // #{ (set literal)
     TOKEN_RIGHT_BRACE,
     TOKEN_LEFT_BRACKET,
     TOKEN_RIGHT_BRACKET,
     TOKEN_SEMICOLON,
     TOKEN_DOT,
+    TOKEN_ELLIPSIS,    // ... (rest parameters, spread arguments)
     TOKEN_VAR,
     TOKEN_PRINT,
     TOKEN_IF,
     TOKEN_ELSE,
     TOKEN_WHILE,
     TOKEN_FOR,
+    TOKEN_IN,          // in (for x in iterable)
     TOKEN_FUNCTION,
     TOKEN_RETURN,
     TOKEN_COMMA,
@@ -65,14 +70,48 @@ typedef enum {
     TOKEN_TRUE,
     TOKEN_FALSE,
     TOKEN_NIL,
-    TOKEN_AND, // &&
-    TOKEN_OR,  // ||
+    TOKEN_AND, // && or 'and'
+    TOKEN_OR,  // || or 'or'
     TOKEN_PLUS_EQUAL,  // +=
     TOKEN_MINUS_EQUAL, // -=
     TOKEN_STAR_EQUAL,  // *=
     TOKEN_SLASH_EQUAL, // /=
+    TOKEN_TILDE_SLASH_EQUAL, // ~/=
+    TOKEN_PERCENT_EQUAL, // %=
+    TOKEN_PLUS_PLUS,   // ++
+    TOKEN_MINUS_MINUS, // --
+    TOKEN_AMPERSAND,   // & (bitwise and)
+    TOKEN_PIPE,        // | (bitwise or)
+    TOKEN_CARET,       // ^ (bitwise xor)
+    TOKEN_TILDE,       // ~ (bitwise not)
+    TOKEN_LESS_LESS,   // <<
+    TOKEN_GREATER_GREATER, // >>
     TOKEN_COLON,       // :
-    TOKEN_STRUCT       // struct
+    TOKEN_QUESTION,    // ?
+    TOKEN_QUESTION_DOT, // ?. (optional chaining)
+    TOKEN_QUESTION_QUESTION,       // ?? (nil coalescing)
+    TOKEN_QUESTION_QUESTION_EQUAL, // ??=
+    TOKEN_ARROW,       // => (arrow functions)
+    TOKEN_STRUCT,      // struct
+    TOKEN_ENUM,        // enum
+    TOKEN_CONST,       // const
+    TOKEN_BREAK,       // break
+    TOKEN_CONTINUE,    // continue
+    TOKEN_TRY,         // try
+    TOKEN_CATCH,       // catch
+    TOKEN_THROW,       // throw
+    TOKEN_SPAWN,       // spawn
+    TOKEN_DEFER,       // defer
+    TOKEN_SWITCH,      // switch
+    TOKEN_CASE,        // case
+    TOKEN_DEFAULT,     // default
+    TOKEN_FALLTHROUGH, // fallthrough
+    TOKEN_DO,          // do (do { } while (cond))
+    TOKEN_LOOP,        // loop
+    TOKEN_WITH,        // with
+    TOKEN_INTERPOLATION, // "text${ or }text${ (a string piece before an embedded expression)
+    TOKEN_COMMENT,     // // to end of line, only from a lexer with keepComments set
+    TOKEN_ERROR        // Malformed input; the token text is the message
 } TokenType;
 
 // Token structure
@@ -81,14 +120,24 @@ typedef struct {
     const char* start;
     int length;
     int line;
+    int column;   // 1-based, of the first character; 0 for made-up tokens
 } Token;
 
 // Error reporting
 // Error reporting
-extern const char* g_source;
-extern const char* g_filename;
+extern _Thread_local const char* g_source;
+extern _Thread_local const char* g_filename;
+// When set (REPL), error() and errorAtToken() longjmp here instead of exiting
+extern _Thread_local jmp_buf* g_errorJump;
+// When set (try block in the AST walker), errors are caught here first;
+// the message and its line are left in g_catchMessage and g_catchLine
+extern _Thread_local jmp_buf* g_catchJump;
+extern _Thread_local char g_catchMessage[256];
+extern _Thread_local int g_catchLine;
 void error(const char* message, int line);
 void errorAtToken(Token token, const char* message);
+void reportAtToken(FILE* out, Token token, const char* message);
+int firstReportedError(char* text, char** message);
 
 #define GROW_CAPACITY(capacity) \
     ((capacity) < 8 ? 8 : (capacity) * 2)
@@ -0,0 +1,25 @@
+#ifndef FORMATTER_H
+#define FORMATTER_H
+
+#include "common.h"
+#include "parser.h"
+
+/**
+ * Source Formatter ('unnarize fmt')
+ *
+ * Prints a parsed script back as canonical source: 4-space indentation,
+ * braced bodies, one statement per line and the minimum of parentheses.
+ * The AST has no comments, so the driver lexes with keepComments and
+ * passes the TOKEN_COMMENT tokens here; each is placed before the first
+ * statement that follows it or, when it trailed code, at the end of that
+ * line. At most one blank line is kept between statements.
+ *
+ * @param ast Root block from parse()
+ * @param source The text 'ast' and 'comments' point into
+ * @param comments Comment tokens in source order
+ * @param commentCount Number of comment tokens
+ * @return The formatted text (malloc'd), ending in a single newline
+ */
+char* formatSource(Node* ast, const char* source, Token* comments, int commentCount);
+
+#endif // FORMATTER_H
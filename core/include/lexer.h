@@ -2,12 +2,21 @@
 #define LEXER_H
 
 #include "common.h"
+#include <stdint.h>
+
+#define INTERPOLATION_MAX 16 // Nesting limit for "${...}" inside "${...}"
 
 // Lexer structure
 typedef struct {
     const char* start;
     const char* current;
     int line;
+    const char* lineStart;  // First character of the line 'current' is on
+    int column;             // Of 'start'
+    // Open "${" expressions, innermost last, with the '{' count inside each
+    int braceDepth[INTERPOLATION_MAX];
+    int interpolationDepth;
+    bool keepComments;  // Return comments as TOKEN_COMMENT instead of skipping them (for 'fmt')
 } Lexer;
 
 // Initialize lexer
@@ -16,4 +25,24 @@ void initLexer(Lexer* lexer, const char* source);
 // Scan next token
 Token scanToken(Lexer* lexer);
 
+// Value of a TOKEN_NUMBER without a fraction; '_' separators and 0x/0b/0o
+// prefixes are understood. Returns false if it is over 2^63, the magnitude
+// of the smallest int.
+bool integerLiteral(Token token, uint64_t* out);
+
+// Value of any TOKEN_NUMBER as a double
+double floatLiteral(Token token);
+
+// Whether a TOKEN_STRING is a triple-quoted raw string
+bool isRawString(Token token);
+
+// Text of a raw string, without its first newline, its closing line if
+// that holds only whitespace, and that line's indentation on every line.
+// The result is from malloc.
+char* rawStringText(Token token, int* length);
+
+// Text of any TOKEN_STRING: a raw string's as above, any other with its
+// quotes dropped and its escapes decoded. The result is from malloc.
+char* stringLiteralText(Token token);
+
 #endif // LEXER_H
\ No newline at end of file
@@ -1,7 +1,9 @@
 #ifndef PARSER_H
 #define PARSER_H
 
+#include <stdint.h>
 #include "common.h"
+#include "lexer.h"
 
 // AST Node types (simplified)
 typedef enum {
@@ -13,12 +15,22 @@ typedef enum {
     NODE_EXPR_CALL,        // function calls
     NODE_EXPR_GET,         // object.property
     NODE_EXPR_INDEX,       // target[index]
+    NODE_EXPR_MAP_LITERAL, // { key: value, ... }
+    NODE_EXPR_TERNARY,     // cond ? a : b
+    NODE_EXPR_SLICE,       // target[start:end]
+    NODE_EXPR_SPREAD,      // ...expr (call arguments, array elements)
+    NODE_EXPR_OPTIONAL,    // A postfix chain with ?. links, e.g. a?.b.c()
+    NODE_EXPR_STRUCT_LITERAL, // Name{ field: value, ... }
+    NODE_EXPR_UPDATE,      // ++x, x--: on a variable, an index or a property
+    NODE_EXPR_FUNCTION,    // function(x) { ... } or (x) => x * 2, as a value
     NODE_STMT_VAR_DECL,
     NODE_STMT_ASSIGN,
     NODE_STMT_INDEX_ASSIGN,
     NODE_STMT_PRINT,
     NODE_STMT_IF,
     NODE_STMT_WHILE,
+    NODE_STMT_DO_WHILE,    // do { } while (cond): the body runs before each check
+    NODE_STMT_LOOP,        // loop { }: runs until break; whileStmt with no condition
     NODE_STMT_FOR,
     NODE_STMT_BLOCK,
     NODE_STMT_FUNCTION,
@@ -28,6 +40,16 @@ typedef enum {
     NODE_EXPR_ARRAY_LITERAL,
     NODE_STMT_FOREACH,
     NODE_STMT_STRUCT_DECL,
+    NODE_STMT_MULTI_ASSIGN, // a, b = x, y  /  var a, b = f()
+    NODE_STMT_BREAK,
+    NODE_STMT_CONTINUE,
+    NODE_STMT_TRY,
+    NODE_STMT_THROW,
+    NODE_STMT_ENUM_DECL,   // enum { A, B = 4, C }
+    NODE_STMT_SWITCH,      // switch (x) { case 1, 2: ... default: ... }
+    NODE_STMT_SPAWN,       // spawn f(args);
+    NODE_STMT_DEFER,       // defer f(args);
+    NODE_STMT_WITH,        // with name = resource { ... }
     NODE_STMT_PROP_ASSIGN
 } NodeType;
 
@@ -37,6 +59,8 @@ typedef struct Node Node;
 // AST Node structure
 struct Node {
     NodeType type;
+    int line;     // Source line, for diagnostics
+    int column;   // 1-based column on that line, 0 when unknown
     union {
         // Literals
         struct {
@@ -47,6 +71,8 @@ struct Node {
             Node* left;
             Token op;
             Node* right;
+            bool chained;   // a < b < c: left is the comparison a < b, and means (a < b) and (b < c)
+            bool interpolated; // A '+' joining the pieces of "text ${expr}"
         } binary;
         // Unary
         struct {
@@ -58,27 +84,46 @@ struct Node {
             Token name;
             int slot; // Stack slot index, -1 if global
         } var;
-        // Function call: callee(arguments)
+        // Increment or decrement: ++target, target++, --target, target--
+        struct {
+            Token op;       // TOKEN_PLUS_PLUS or TOKEN_MINUS_MINUS
+            Node* target;   // NODE_EXPR_VAR, NODE_EXPR_INDEX or NODE_EXPR_GET
+            bool prefix;    // ++x is the new value, x++ the old one
+        } update;
+        // Function call: callee(arguments), the last namedCount of them
+        // written 'name: value'
         struct {
             Node* callee;
             Node* arguments; // linked list via next
             int argumentCount;
+            Token* names;    // Parameter names of the named arguments, NULL if none
+            int namedCount;
         } call;
-        // Member access: object.name
+        // Member access: object.name, or object?.name
         struct {
             Node* object;
             Token name;
+            bool optional;  // ?.: a nil object makes the enclosing NODE_EXPR_OPTIONAL nil
         } get;
-        // Indexing: target[index]
+        // Indexing: target[index], or target?.[index]
         struct {
             Node* target;
             Node* index;
+            bool optional;
         } index;
+        // Slicing: target[start:end], an omitted bound is NULL
+        struct {
+            Node* target;
+            Node* start;
+            Node* end;
+            bool optional;
+        } slice;
         // Var decl
         struct {
             Token name;
             Node* initializer;
             int slot; // Stack slot index, -1 if global
+            bool isConst; // Declared with const: never assigned again
         } varDecl;
         // Assign
         struct {
@@ -104,10 +149,17 @@ struct Node {
             Node* thenBranch;
             Node* elseBranch;
         } ifStmt;
-        // While
+        // Ternary cond ? thenExpr : elseExpr
+        struct {
+            Node* condition;
+            Node* thenExpr;
+            Node* elseExpr;
+        } ternary;
+        // While, do-while and loop
         struct {
             Node* condition;
             Node* body;
+            Token label;   // 'name:' before the loop, length 0 when unlabeled
         } whileStmt;
         // For (init; cond; incr; body)
         struct {
@@ -115,25 +167,78 @@ struct Node {
             Node* condition;
             Node* increment;
             Node* body;
+            Token label;
         } forStmt;
         // Block { statements }
         struct {
             Node** statements;
             int count;
             int capacity;
+            int endLine;  // Line of the closing '}'
         } block;
-        // Function
+        // Function declaration, or a function expression named <lambda>
         struct {
             Token name;
             Token* params;
+            Node** defaults;      // Default value per parameter, NULL if required
             int paramCount;
+            int requiredCount;    // Leading parameters without a default
+            bool isVariadic;      // Last parameter is '...name', collecting extra arguments
+            bool isMethod;        // Declared in a struct body; params[0] is the implicit self
             Node* body;
             bool isAsync;
+            bool isArrow;         // Written (params) => body
+            bool isExpressionBody; // (params) => expr: body is a block holding 'return expr;'
         } function;
         // Return
         struct {
-            Node* value;
+            Node* value; // First value; further values linked via next
+            int count;   // Number of returned values (0 for bare 'return;')
         } returnStmt;
+        // try { ... } catch (name) { ... }
+        struct {
+            Node* tryBlock;
+            Token catchName;
+            Node* catchBlock;
+            int slot; // Stack slot index for the caught value
+        } tryStmt;
+        // break / continue, optionally naming an enclosing loop
+        struct {
+            Token keyword;  // For the line number
+            Token label;    // Length 0 for the innermost loop
+        } loopJump;
+        // throw value
+        struct {
+            Token keyword;  // For the line number
+            Node* value;
+        } throwStmt;
+        // spawn callee(arguments)
+        struct {
+            Token keyword;  // For the line number
+            Node* call;     // NODE_EXPR_CALL
+        } spawnStmt;
+        // defer callee(arguments)
+        struct {
+            Token keyword;  // For the line number
+            Node* call;     // NODE_EXPR_CALL
+        } deferStmt;
+        // with name = resource { body }: resource.__close__() runs however
+        // the body is left
+        struct {
+            Token keyword;  // For the line number
+            Token name;
+            Node* resource;
+            Node* body;     // NODE_STMT_BLOCK
+            int slot;       // Stack slot index for the resource
+        } withStmt;
+        // Multiple assignment / declaration
+        struct {
+            Node* targets;   // Linked list of VAR, INDEX or GET nodes
+            int targetCount;
+            Node* values;    // Linked list
+            int valueCount;
+            bool isDecl;     // 'var a, b = ...'
+        } multiAssign;
         // Import statement: import module as alias;
         struct {
             Token module;
@@ -141,24 +246,53 @@ struct Node {
         } importStmt;
         // importStmt...
 
-        // Array literal [e1, e2, ...]
+        // Array literal [e1, e2, ...], or set literal #{e1, e2, ...}
         struct {
             Node* elements; // Linked list
             int count;
+            int endLine;    // Line of the closing ']' or '}'
+            bool isSet;
         } arrayLiteral;
+        // Map literal { k1: v1, k2: v2, ... }
+        struct {
+            Node* keys;   // Linked list, parallel to values
+            Node* values; // Linked list
+            int count;
+            int endLine;  // Line of the closing '}'
+        } mapLiteral;
+        // Struct literal Name{ f1: v1, f2: v2, ... }
+        struct {
+            Token name;
+            Token* fields; // Parallel to values
+            Node* values;  // Linked list
+            int count;
+            int endLine;   // Line of the closing '}'
+        } structLiteral;
         // Foreach (var item : collection)
         struct {
             Token iterator;
             Node* collection;
             Node* body;
             int slot; // Stack slot index for iterator
+            Token label;
         } foreachStmt;
         // Struct Declaration
         struct {
             Token name;
             Token* fields;
+            Node** defaults; // Default value per field, NULL if none
             int fieldCount;
+            Node** methods;  // NODE_STMT_FUNCTION, params[0] is the implicit self
+            int methodCount;
+            int endLine;     // Line of the closing '}'
         } structDecl;
+        // Enum declaration: members and their resolved values
+        struct {
+            Token* names;
+            int64_t* values;
+            int count;
+            int endLine;  // Line of the closing '}'
+        } enumDecl;
         // Property Assignment (obj.prop = val)
         struct {
             Node* object;
@@ -166,16 +300,35 @@ struct Node {
             Token operator;
             Node* value;
         } propAssign;
+        // switch (subject) { case a, b: ... default: ... }
+        struct {
+            Node* subject;
+            Node** values;       // Per case: linked list of values, NULL for default
+            Node** bodies;       // Per case: NODE_STMT_BLOCK of its statements
+            bool* fallsThrough;  // Per case: ends in 'fallthrough'
+            int caseCount;
+            int endLine;         // Line of the closing '}'
+        } switchStmt;
     };
     Node* next; // For linked list (function arguments)
 };
 
+// Label of a loop being parsed; a stack through the enclosing loops
+typedef struct LoopLabel {
+    Token name;
+    struct LoopLabel* enclosing;
+} LoopLabel;
+
 // Parser structure with dynamic token array
 typedef struct {
     Token* tokens;      // Dynamic array of tokens
     int current;
     int count;
     int capacity;       // Current capacity of the array
+    int loopDepth;      // Enclosing loops in the current function (for break/continue)
+    LoopLabel* labels;  // Innermost labeled loop in the current function, or NULL
+    int functionDepth;  // Enclosing function bodies (for defer)
+    bool implicitSemicolon; // A ';' missing at the end of the source is supplied (REPL, eval())
 } Parser;
 
 // Initialize parser
@@ -190,4 +343,11 @@ void addToken(Parser* parser, Token token);
 // Parse tokens into AST
 Node* parse(Parser* parser);
 
+// Free an AST from parse()
+void freeAST(Node* node);
+
+// Whether a node is an expression (one standing as a statement has a value
+// the REPL shows), not a statement
+bool isExpressionNode(Node* node);
+
 #endif // PARSER_H
\ No newline at end of file
@@ -0,0 +1,92 @@
+#ifndef SCHEDULER_H
+#define SCHEDULER_H
+
+#include <setjmp.h>
+#include "vm.h"
+
+/**
+ * Coroutine Scheduler
+ *
+ * 'spawn f(args)' starts f as a coroutine: a green thread with its own
+ * register file, call stack, try blocks and C stack, multiplexed on the
+ * one VM thread. The script itself runs as the main coroutine. Only one
+ * runs at a time, until it
+ *   - blocks in send() or recv() on a channel,
+ *   - calls yield(),
+ *   - finishes, or
+ *   - reaches the interpreter's periodic check (every LIMIT_POLL_INTERVAL
+ *     loop iterations and calls) while others are waiting to run.
+ * The next ready coroutine is then picked round-robin in spawn order.
+ *
+ * When the script finishes the program ends, whatever coroutines are left.
+ * An error no coroutine catches ends the program too, with that
+ * coroutine's stack trace. When every coroutine is blocked the main one's
+ * send or recv fails with a deadlock error instead.
+ */
+
+typedef struct Scheduler Scheduler;
+
+typedef enum {
+    CO_READY,       // Waiting for its turn
+    CO_RUNNING,
+    CO_BLOCKED,     // Parked on a channel until a send or recv there
+    CO_DONE         // Finished; its stacks are freed once switched away from
+} CoroutineStatus;
+
+// The VM fields a coroutine owns, saved while it is not running
+typedef struct {
+    Value* registers;
+    int regTop;
+    int regBase;
+    ObjUpvalue* openUpvalues;
+    Value* stack;
+    int stackTop;
+    int fp;
+    LoopSignal loopSignal;
+    Token loopLabel;
+    int currentLine;
+    Environment* env;
+    Environment* globalEnv;
+    Environment* defEnv;
+    CallFrame* callStack;
+    int callStackTop;
+    TryHandler* tryHandlers;
+    int tryHandlerCount;
+    struct BytecodeChunk* nativeChunk;
+    uint32_t* nativeIp;
+    Function* nativeCallee;
+    ModuleEntry* importing;
+    bool panicking;
+    jmp_buf* catchJump;     // g_catchJump and g_errorJump (AST walker)
+    jmp_buf* errorJump;
+} ExecState;
+
+// Start a coroutine running 'callee' (a function or bound method) with
+// 'args'. It first runs when the spawner blocks or yields. False with an
+// error pending when 'callee' cannot be spawned.
+bool spawnCoroutine(VM* vm, Value callee, Value* args, int argCount);
+
+Channel* newChannel(VM* vm, int capacity);
+
+// The calls below may switch coroutines. They return false with an error
+// pending on a deadlock, or when another coroutine failed.
+
+// Queue 'value' on 'ch', then block until a receiver has taken it or, for
+// a buffered channel, until at most 'capacity' values are waiting
+bool channelSend(VM* vm, Channel* ch, Value value);
+// Block until a value is queued on 'ch' and take it
+bool channelReceive(VM* vm, Channel* ch, Value* out);
+
+// Let every other ready coroutine run first; the interpreter also calls
+// it at its periodic check
+bool yieldCoroutine(VM* vm);
+
+// The running coroutine's state, as saved when switching away from it
+void saveExecState(VM* vm, ExecState* state);
+// Roots of an execution state (gc.c)
+void markExecState(VM* vm, ExecState* state);
+// Roots of every suspended coroutine, for the collector
+void markCoroutines(VM* vm);
+void freeScheduler(VM* vm);
+
+#endif // SCHEDULER_H
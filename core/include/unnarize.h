@@ -0,0 +1,148 @@
+#ifndef UNNARIZE_H
+#define UNNARIZE_H
+
+// Embedding API: run Unnarize code inside a host program without shelling
+// out. Build the library with 'make lib' and link bin/libunnarize.a with
+// -lm -ldl -lpthread. Any language that can call C (Go through cgo, for
+// instance) can use it.
+//
+// An interpreter has no locking of its own: calls on one interpreter must
+// not overlap. Separate interpreters on separate threads run independently,
+// so the usual layout is one interpreter per thread.
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+typedef struct UnnInterp UnnInterp;
+
+typedef enum {
+    UNN_NIL,
+    UNN_BOOL,
+    UNN_INT,
+    UNN_DOUBLE,
+    UNN_STRING,
+    UNN_OBJECT      // Array, map, function, struct instance...: only its type is visible
+} UnnType;
+
+// Values are copied across the boundary. Strings are the exception:
+//  - unnString() only points at the host's text; the interpreter copies it
+//    when it keeps the value. A callback's result is copied after it
+//    returns, so it must not point into the callback's own stack.
+//  - Strings from unnRun and unnGetGlobal are the caller's copies, released
+//    with unnFreeValue.
+//  - Strings passed to a callback are borrowed and valid until it returns.
+typedef struct {
+    UnnType type;
+    union {
+        bool boolean;
+        int64_t integer;
+        double number;
+        const char* string;
+        const char* typeName;   // UNN_OBJECT: what typeof() reports
+    } as;
+} UnnValue;
+
+UnnValue unnNil(void);
+UnnValue unnBool(bool b);
+UnnValue unnInt(int64_t n);
+UnnValue unnDouble(double d);
+UnnValue unnString(const char* s);
+
+bool unnIsNumber(UnnValue v);           // int or double
+double unnAsNumber(UnnValue v);         // An int or double as a double, else 0
+int64_t unnAsInt(UnnValue v);           // An int, or a double truncated, else 0
+bool unnAsBool(UnnValue v);             // Truthiness: only nil and false are false
+const char* unnAsString(UnnValue v);    // The text of a string, else NULL
+const char* unnTypeName(UnnValue v);    // The name typeof() uses
+void unnFreeValue(UnnValue* v);         // Release a string returned to the host
+
+// Fix the seed of the string hash for every interpreter in the process,
+// so a map's keys come out in the same order on every run. Otherwise the
+// process picks one at random, and which keys collide can't be planned.
+// False once an interpreter has been created, as the seed is then in use.
+bool unnSetHashSeed(uint32_t seed);
+
+// A new interpreter with every built-in library loaded, or NULL when out
+// of memory. Globals persist across unnRun calls until unnFree.
+UnnInterp* unnNew(void);
+void unnFree(UnnInterp* interp);
+
+// Compile and run 'source'. On success *result (when not NULL) holds the
+// value of a top-level 'return', or nil. On failure the message is in
+// unnLastError: syntax and compile errors, or a throw nothing caught.
+bool unnRun(UnnInterp* interp, const char* source, UnnValue* result);
+
+// Stepped runs, for a host with an event loop of its own. unnStart
+// compiles 'source' as unnRun does but runs none of it; false on a syntax
+// or compile error, or while another stepped run is unfinished. Each
+// unnStep then runs at most 'maxInstructions' bytecode instructions and
+// returns, keeping the whole run, native calls in progress included, for
+// the next unnStep. Output is flushed before every return. While a run is
+// paused unnRun and unnStart fail; globals can be read and set. The
+// timeout counts only the time spent in unnStep. Step a run on the thread
+// that started it; unnFree drops one that is unfinished.
+typedef enum {
+    UNN_STEP_PAUSED,    // Out of instructions: call unnStep again to go on
+    UNN_STEP_DONE,      // Finished: *result holds its value, as with unnRun
+    UNN_STEP_FAILED     // Failed, or there was no run to step: see unnLastError
+} UnnStepStatus;
+bool unnStart(UnnInterp* interp, const char* source);
+UnnStepStatus unnStep(UnnInterp* interp, int64_t maxInstructions, UnnValue* result);
+const char* unnLastError(UnnInterp* interp);
+
+// Sandbox limits for later unnRun calls. Going past the frame depth
+// raises a catchable "Stack overflow."; going past the heap size or the
+// per-run timeout ends the run with an error no try/catch intercepts.
+// A heap size or timeout of 0 turns that limit off. unnSetMaxStack is
+// false for a depth outside 1..1000000, keeping the old one (1024).
+bool unnSetMaxStack(UnnInterp* interp, int frames);
+void unnSetMaxHeap(UnnInterp* interp, size_t bytes);
+void unnSetTimeout(UnnInterp* interp, int64_t ms);
+// eval() is allowed until turned off. While it is off, calling eval()
+// throws a catchable "eval() is disabled in this interpreter."
+void unnSetEval(UnnInterp* interp, bool enabled);
+
+// Where print sends its output, stdout until set; NULL goes back to
+// stdout. What scripts print is buffered and handed to 'write' in pieces:
+// when the buffer fills, when a script calls flush(), and before unnRun
+// returns, also when the run failed.
+typedef void (*UnnWriteFn)(const char* data, size_t length, void* userData);
+
+void unnSetOutput(UnnInterp* interp, UnnWriteFn write, void* userData);
+
+void unnSetGlobal(UnnInterp* interp, const char* name, UnnValue value);
+// False when no global has that name
+bool unnGetGlobal(UnnInterp* interp, const char* name, UnnValue* out);
+
+// A host function callable from scripts. To fail, return unnThrow(...):
+// the script sees a catchable Error with that message.
+typedef UnnValue (*UnnFn)(UnnInterp* interp, const UnnValue* args, int argCount, void* userData);
+
+void unnRegisterFn(UnnInterp* interp, const char* name, UnnFn fn, void* userData);
+
+// A module of host functions, called from scripts as name.fn(...) like the
+// built-in libraries. 'fns' ends with an entry whose name is NULL; every
+// function gets 'userData'. Reading a name the module lacks is a catchable
+// "Undefined property" error.
+typedef struct {
+    const char* name;
+    UnnFn fn;
+} UnnModuleFn;
+
+void unnRegisterModule(UnnInterp* interp, const char* name, const UnnModuleFn* fns, void* userData);
+// One more function in the module 'module', made as unnRegisterModule
+// with no functions would when no global has that name: for a host whose
+// functions each need user data of their own
+void unnRegisterModuleFn(UnnInterp* interp, const char* module, const char* name, UnnFn fn, void* userData);
+UnnValue unnThrow(UnnInterp* interp, const char* format, ...);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif // UNNARIZE_H
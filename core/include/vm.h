@@ -4,6 +4,7 @@
 #include "common.h"
 #include "parser.h"
 #include <pthread.h>
+#include <stdatomic.h>
 #include <stdint.h>
 #include <string.h> // For NanBoxing memcpy
 
@@ -20,9 +21,17 @@ typedef enum {
     OBJ_NATIVE,
     OBJ_FUTURE,
     OBJ_UPVALUE,
-    OBJ_ENVIRONMENT
+    OBJ_ENVIRONMENT,
+    OBJ_RANGE,
+    OBJ_BOUND_METHOD,
+    OBJ_CHANNEL,
+    OBJ_SET,
+    OBJ_STRING_BUILDER,
+    OBJ_INT
 } ObjType;
 
+#define OBJ_TYPE_COUNT (OBJ_INT + 1)
+
 typedef struct Obj Obj;
 
 struct Obj {
@@ -30,6 +39,7 @@ struct Obj {
     bool isMarked;
     bool isPermanent;   // If true, never swept or unmarked
     uint8_t generation;  // 0 = young (nursery), 1+ = old
+    bool remembered;     // Listed in vm->remembered
     Obj* next;
 };
 
@@ -64,15 +74,41 @@ static inline Value numToValue(double d) {
 #define TAG_NIL   1
 #define TAG_BOOL  2
 #define TAG_INT   3
+#define TAG_MASK      ((uint64_t)0x0003000000000000)
 #define TAG_INT_BIT   ((uint64_t)0x0001000000000000)
 
 #define IS_OBJ(v)     (((v) & (QNAN | SIGN_BIT)) == (QNAN | SIGN_BIT)) 
 #define AS_OBJ(v)     ((Obj*)(uintptr_t)((v) & ~(SIGN_BIT | QNAN)))
 #define OBJ_VAL(obj)  ((Value)(SIGN_BIT | QNAN | (uint64_t)(uintptr_t)(obj)))
 
-#define IS_INT(v)     (((v) & (QNAN | TAG_INT_BIT)) == (QNAN | TAG_INT_BIT))
-#define AS_INT(v)     ((int32_t)(v & 0xFFFFFFFF))
-#define INT_VAL(num)  ((Value)(QNAN | TAG_INT_BIT | ((uint32_t)(num))))
+// Integers are 64-bit. One that fits in 48 bits is stored inline, as the
+// low 48 bits of the boxed value; a wider one is an ObjInt on the heap.
+// intValue picks between them, so a number always has one form: two inline
+// ints are equal when their bits are, and a boxed int never equals an
+// inline one. INT_VAL makes the inline form and is only for a number known
+// to fit (a length, an index, a count). Arithmetic is done in int64_t; +,
+// -, * and ~/ raise an overflow error when the result does not fit 64
+// bits (see intAdd below) and wadd/wsub/wmul wrap it.
+#define INT_PAYLOAD_MASK ((uint64_t)0x0000FFFFFFFFFFFF)
+#define INLINE_INT_MAX   ((int64_t)0x00007FFFFFFFFFFF)
+#define INLINE_INT_MIN   (-INLINE_INT_MAX - 1)
+#define INT_FITS_INLINE(n) ((n) >= INLINE_INT_MIN && (n) <= INLINE_INT_MAX)
+
+typedef struct {
+    Obj obj;
+    int64_t value;
+} ObjInt;
+
+#define IS_INLINE_INT(v) (((v) & (SIGN_BIT | QNAN | TAG_MASK)) == (QNAN | TAG_INT_BIT))
+#define IS_BOXED_INT(v)  (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_INT)
+#define IS_INT(v)     (IS_INLINE_INT(v) || IS_BOXED_INT(v))
+#define AS_INT(v)     asInt(v)
+#define INT_VAL(num)  ((Value)(QNAN | TAG_INT_BIT | ((uint64_t)(int64_t)(num) & INT_PAYLOAD_MASK)))
+
+static inline int64_t asInt(Value v) {
+    if (__builtin_expect(IS_INLINE_INT(v), 1)) return (int64_t)(v << 16) >> 16;
+    return ((ObjInt*)AS_OBJ(v))->value;
+}
 
 // Internal Tagged Values
 #define TAGGED_NIL    ((Value)(QNAN | 0x0002000000000000))
@@ -82,6 +118,11 @@ static inline Value numToValue(double d) {
 #define IS_NIL(v)     ((v) == TAGGED_NIL)
 #define NIL_VAL       TAGGED_NIL
 
+// Stands in for a parameter a named call leaves out (see
+// bindNamedArguments), so the callee takes its default. Replaced before
+// the callee's body runs; scripts never see it.
+#define OMITTED_VAL   ((Value)(QNAN | 0x0002000000000001))
+
 #define IS_BOOL(v)    (((v) & 0xFFFFFFFFFFFFFFFE) == TAGGED_FALSE)
 #define AS_BOOL(v)    ((v) == TAGGED_TRUE)
 #define BOOL_VAL(b)   ((b) ? TAGGED_TRUE : TAGGED_FALSE)
@@ -91,7 +132,47 @@ static inline Value numToValue(double d) {
 #define AS_FLOAT(v)   valueToNum(v)
 #define FLOAT_VAL(v)  numToValue(v)
 
-void printValue(Value val);
+// Either numeric variant; AS_NUMERIC widens ints to double for mixed math
+#define IS_NUMERIC(v) (IS_INT(v) || IS_NUMBER(v))
+#define AS_NUMERIC(v) (IS_INT(v) ? (double)AS_INT(v) : AS_FLOAT(v))
+
+// Checked integer arithmetic for the operators: false when the exact
+// result does not fit 64 bits
+static inline bool intAdd(int64_t a, int64_t b, int64_t* out) {
+    return !__builtin_add_overflow(a, b, out);
+}
+static inline bool intSub(int64_t a, int64_t b, int64_t* out) {
+    return !__builtin_sub_overflow(a, b, out);
+}
+static inline bool intMul(int64_t a, int64_t b, int64_t* out) {
+    return !__builtin_mul_overflow(a, b, out);
+}
+
+// a ~/ b for ints: the quotient rounded toward negative infinity, so
+// -7 ~/ 2 is -4. 'b' must not be 0, and INT64_MIN ~/ -1 overflows.
+static inline int64_t intFloorDiv(int64_t a, int64_t b) {
+    int64_t q = a / b;
+    return (a % b != 0 && (a < 0) != (b < 0)) ? q - 1 : q;
+}
+
+// Shifts work on the 64 bits, two's complement. '<<' drops the bits
+// shifted past the top one and '>>' copies the sign bit down, so a count of
+// 64 or more leaves 0 (or -1 for a negative '>>'). The count must not be
+// negative.
+#define INT_BITS 64
+static inline int64_t intShiftLeft(int64_t a, int64_t n) {
+    return n >= INT_BITS ? 0 : (int64_t)((uint64_t)a << n);
+}
+static inline int64_t intShiftRight(int64_t a, int64_t n) {
+    return a >> (n >= INT_BITS ? INT_BITS - 1 : n);
+}
+
+// Text used when a value is joined with a string ("+" concatenation, join).
+// Scalars are formatted into 'buf' (at least 64 bytes); strings return their chars.
+const char* valueToChars(Value val, char* buf, size_t bufSize);
+// How print and concatenation write a double: the shortest digits that read
+// back as the same value. 'buf' needs at least 32 bytes.
+const char* formatDouble(double d, char* buf, size_t bufSize);
 
 // Helper for switch cases
 static inline ValueType getValueType(Value v) {
@@ -109,14 +190,26 @@ static inline ValueType getValueType(Value v) {
 #define IS_STRING(value)  (IS_OBJ(value) && AS_OBJ(value)->type == OBJ_STRING)
 #define IS_ARRAY(value)   (IS_OBJ(value) && AS_OBJ(value)->type == OBJ_ARRAY)
 #define IS_MAP(value)     (IS_OBJ(value) && AS_OBJ(value)->type == OBJ_MAP)
+#define IS_SET(value)     (IS_OBJ(value) && AS_OBJ(value)->type == OBJ_SET)
+#define IS_STRING_BUILDER(value) (IS_OBJ(value) && AS_OBJ(value)->type == OBJ_STRING_BUILDER)
 
+// Strings never change once made, so the hash is computed when they are
 typedef struct ObjString {
     Obj obj;
     char* chars;
     int length;
-    unsigned int hash;
+    unsigned int hash;      // Full hashString(); hash % TABLE_SIZE is the bucket
+    bool interned;          // In the string pool: no other interned string is equal
+    bool pooledChars;       // chars came from allocateBlock(length + 1)
 } ObjString;
 
+// Two interned strings are equal only when they are the same object
+static inline bool stringsEqual(ObjString* a, ObjString* b) {
+    if (a == b) return true;
+    if (a->interned && b->interned) return false;
+    return a->length == b->length && a->hash == b->hash && memcmp(a->chars, b->chars, a->length) == 0;
+}
+
 // Forward declarations
 typedef struct VarEntry VarEntry;
 typedef struct FuncEntry FuncEntry;
@@ -134,6 +227,10 @@ typedef struct Map Map;
 typedef struct StructDef StructDef;
 typedef struct StructInstance StructInstance;
 typedef struct Future Future;
+typedef struct Range Range;
+typedef struct BoundMethod BoundMethod;
+typedef struct Channel Channel;
+typedef struct StringBuilder StringBuilder;
 
 // Native function type for external C functions
 typedef Value (*NativeFn)(VM*, Value* args, int argCount);
@@ -145,6 +242,7 @@ struct VarEntry {
     bool ownsKey; 
     ObjString* keyString;   // Reference to interned string for GC marking
     Value value;            // Variable value
+    bool isConst;           // A top-level const, function or enum member: never rebound
     struct VarEntry* next;  // Next entry in hash bucket
 };
 
@@ -159,15 +257,22 @@ struct FuncEntry {
 // Initial hash table size for environments (increased to next prime ~256)
 #define TABLE_SIZE 1021
 
-// String interning pool for performance optimization
+// String interning pool: open addressing on the string's hash
 typedef struct StringPool {
-    char** strings;  // Actually ObjString* cast to char*
-    unsigned int* hashes;
+    ObjString** slots;    // NULL when empty
     int count;
-    int capacity;
+    int capacity;         // Power of two, kept at least twice count
     pthread_mutex_t lock; // Protects concurrent access
 } StringPool;
 
+// Block pool: freed blocks of up to BLOCK_POOL_MAX bytes are kept on a free
+// list per BLOCK_POOL_STEP-byte size class and handed out again, at most
+// BLOCK_POOL_LIMIT per class by default (see allocateBlock in gc.c)
+#define BLOCK_POOL_STEP 16
+#define BLOCK_POOL_MAX 64
+#define BLOCK_POOL_CLASSES (BLOCK_POOL_MAX / BLOCK_POOL_STEP)
+#define BLOCK_POOL_LIMIT 16384
+
 // Value pool for basic types to reduce malloc/free overhead
 typedef struct ValuePool {
     Value* values;
@@ -198,20 +303,31 @@ struct Array {
     Value* items;
     int count;
     int capacity;
+    bool frozen;        // Set by freeze(): writes throw
 };
 
 // Map entry
 struct MapEntry {
     bool isIntKey;
-    char* key; // Or ObjString*? For now char* interned
-    int intKey;
+    char* key;          // Own copy of a string key
+    int keyLength;
+    int64_t intKey;
     Value value;
     MapEntry* next;
+    MapEntry* before;   // Neighbours in insertion order (ordered maps only)
+    MapEntry* after;
 };
 
+// Also the body of a set (OBJ_SET): each element is both the key and the
+// value of its entry, and the entries stay in the order they were added
 struct Map {
     Obj obj;
     MapEntry* buckets[TABLE_SIZE];
+    int count;          // Live entries, kept in sync by mapSet*/mapDelete*
+    bool frozen;        // Set by freeze(): writes throw
+    bool ordered;       // Made by ordered_map(): iterates in insertion order
+    MapEntry* first;    // Oldest and newest entry (ordered maps only)
+    MapEntry* last;
 };
 
 struct StructDef {
@@ -219,6 +335,10 @@ struct StructDef {
     char* name;
     char** fields;
     int fieldCount;
+    Node** defaults;        // Default value per field, NULL if none (AST walker)
+    Function** methods;     // Declared in the struct body, self is their first parameter
+    int methodCount;
+    uint32_t shape;         // Never shared by two definitions, see PropertyCache
 };
 
 struct StructInstance {
@@ -235,6 +355,55 @@ struct Future {
     pthread_cond_t cv;      // condition variable
 };
 
+// range(start, stop, step): integers from start towards stop (exclusive),
+// produced on demand while iterating
+struct Range {
+    Obj obj;
+    int64_t start;
+    int64_t stop;
+    int64_t step;           // Never zero
+};
+
+// obj.method read off a struct instance: calling it passes the receiver
+// as the method's first argument, self
+struct BoundMethod {
+    Obj obj;
+    Value receiver;
+    Function* method;
+};
+
+// channel(capacity): values queued between coroutines (see scheduler.h).
+// 'sent' and 'received' count every value ever passed through, so a
+// sender can tell when the value it queued has been taken.
+struct Channel {
+    Obj obj;
+    Value* items;           // Queued values from items[head]
+    int head;
+    int count;
+    int itemCapacity;       // Allocated slots in items
+    int capacity;           // Values a send may leave unreceived; 0 is unbuffered
+    int64_t sent;
+    int64_t received;
+};
+
+// string_builder(): text appended in place, doubling its buffer as it
+// grows, until to_string copies it out as a string
+struct StringBuilder {
+    Obj obj;
+    char* chars;            // Not NUL-terminated
+    int length;
+    int capacity;
+};
+
+// The text, tokens and tree of one eval() call. Functions it defined
+// point into them, so they are kept until the VM is freed.
+typedef struct EvalSource {
+    char* source;
+    Parser parser;
+    Node* ast;
+    struct EvalSource* next;
+} EvalSource;
+
 typedef void (*ResourceCleanupFn)(void* data);
 typedef struct {
     Obj obj;
@@ -242,28 +411,49 @@ typedef struct {
     ResourceCleanupFn cleanup;
 } ObjResource;
 
+// Captured variable cell shared by closures.
+// Open: 'location' points at the owning register. Closed: it points at 'closed'.
+typedef struct ObjUpvalue {
+    Obj obj;
+    Value* location;
+    Value closed;
+    struct ObjUpvalue* next; // Next open upvalue (sorted by location, highest first)
+} ObjUpvalue;
+
 // Function structure
 struct Function {
     Obj obj; // Function is an object now
     Token name;
     Token* params;
     int paramCount;
+    int requiredCount; // Parameters without a default; calls pass requiredCount..paramCount args
+    Node** defaults; // Default value per parameter, NULL if required (AST walker)
+    bool isVariadic; // Last parameter is an array of the arguments past the others
+    bool isMethod; // Declared in a struct body; params[0] is the implicit self
     Node* body;
     Environment* closure;
     bool isNative;
     NativeFn native;
+    void* nativeData; // Context for a native shared by several functions (embedding API)
     bool isAsync;
     struct BytecodeChunk* bytecodeChunk; // Bytecode for this function
     char* modulePath; // Path of the module/file this function is defined in
     Environment* moduleEnv; // The global environment where this function was defined
+    int upvalueCount; // Variables captured from enclosing functions
+    ObjUpvalue** upvalues; // Captured cells (closure instances only)
+    struct Function* proto; // Prototype a closure was created from (owns bytecodeChunk)
 };
 
 // Forward declaration
 struct BytecodeChunk;
 
 #define STACK_MAX 65536           // Register file size (shared across all frames)
-#define CALL_STACK_MAX 1024       // Maximum call stack depth
+#define WALKER_STACK_MAX 8192     // AST walker's value stack, also used to root values
+#define CALL_STACK_MAX 1024       // Default call stack depth (--max-stack sets another)
+#define LIMIT_POLL_INTERVAL 1024  // Back jumps and calls between checks of --max-heap and --timeout
 #define FRAME_REG_MAX 256         // Maximum registers per function frame
+#define TRY_HANDLER_MAX 256       // Maximum active try blocks across all frames
+#define TRACE_MAX 64              // Frames kept in a runtime error's stack trace
 
 // Call frame structure for function calls
 struct CallFrame {
@@ -273,6 +463,15 @@ struct CallFrame {
     Value returnValue;      // Function return value
     bool hasReturned;       // Whether function has returned
     int resultReg;          // Caller's register to store return value
+    int resultCount;        // Values the caller expects (OP_CALL C)
+    int argCount;           // Arguments the callee received (OP_JMPARG)
+    Array* defers;          // Calls scheduled by 'defer', each [function, args...], or NULL
+
+    // AST walker support
+    jmp_buf* catchJump;     // g_catchJump when the call began, to tell a return inside a try
+    bool returnsMany;       // returnValue is an array of the values 'return' gave
+    bool tailCall;          // returnValue is [callee, args...] to run in this call's place
+    int tailCallLine;       // Line of that 'return', where errors in making the call are reported
 
     // Bytecode support
     uint32_t* ip;           // Return address (caller's IP)
@@ -280,11 +479,38 @@ struct CallFrame {
     struct Function* function;   // Executing function (GC Root)
 };
 
+// Active try block in the bytecode VM (see OP_TRY)
+typedef struct {
+    int frameDepth;              // callStackTop when the try began
+    int regBase;                 // Register base of the frame owning the try
+    struct BytecodeChunk* chunk; // Chunk containing the catch block
+    uint32_t* catchIp;           // First instruction of the catch block
+    uint8_t errorReg;            // Register receiving the thrown value, or the resource of a with
+    Environment* globalEnv;      // Module globals in effect at the try
+    bool closes;                 // A with block (see OP_WITH): close errorReg and keep unwinding
+} TryHandler;
+
+// One frame of a runtime error's stack trace
+typedef struct {
+    struct Function* function;   // Running function (the script or a module at the bottom)
+    int line;                    // Line being executed, or the call site for callers
+    int column;                  // Column on that line, 0 when unknown
+} TraceEntry;
+
+// Loop control raised by break/continue in the AST walker
+typedef enum {
+    LOOP_SIGNAL_NONE,
+    LOOP_SIGNAL_BREAK,
+    LOOP_SIGNAL_CONTINUE
+} LoopSignal;
+
 // Module cache entry
 struct ModuleEntry {
-    char* name;
+    char* name;                 // Canonical file path
     int nameLen;
-    Module* module;
+    Module* module;             // NULL until the top-level code has finished
+    bool loading;               // Top-level code is running (cycle detection)
+    struct ModuleEntry* importer; // Module that was loading when this one started
     struct ModuleEntry* next;
 };
 
@@ -309,23 +535,89 @@ typedef struct {
     bool completed;        // Is execution complete?
 } Task;
 
+// Script output: what print writes collects here and goes to 'write' in
+// one piece when the buffer fills, on flush(), when the VM is freed and
+// before anything else is written to the terminal (error reports, input()
+// prompts, the tui module). flushEachLine also sends it after every print,
+// which the CLI does on a terminal and with --unbuffered.
+#define OUTPUT_BUFFER_SIZE 8192
+
+typedef void (*OutputWriter)(const char* data, size_t length, void* userData);
+
+typedef struct {
+    char data[OUTPUT_BUFFER_SIZE];
+    size_t length;
+    OutputWriter write;             // NULL: stdout
+    void* userData;
+    bool flushEachLine;
+    VM* nextVM;                     // The other VMs on this thread (see flushAllOutput)
+} OutputBuffer;
+
+// How print writes a value, into vm->output
+void printValue(VM* vm, Value val);
+// The print statement: the value and a newline
+void printLine(VM* vm, Value val);
+void writeOutput(VM* vm, const char* data, size_t length);
+void writeOutputf(VM* vm, const char* format, ...);
+// Hand what is buffered to the writer
+void flushOutput(VM* vm);
+// flushOutput for every VM on this thread, before a fatal error report
+void flushAllOutput(void);
+
 // Virtual Machine structure
 struct VM {
-    Value registers[STACK_MAX];     // Register file (shared across all frames)
+    Value* registers;               // Register file, STACK_MAX slots (shared across all frames)
     int regTop;                     // Next free register index
     int regBase;                    // Current frame's base register
+    ObjUpvalue* openUpvalues;       // Upvalues still pointing into the register file
     // Legacy stack compat (used by AST walker)
-    Value stack[8192];              // Small stack for AST walker compatibility
+    Value* stack;                   // WALKER_STACK_MAX slots for AST walker compatibility
     int stackTop;                   // Stack pointer (AST walker)
     int fp;                         // Frame pointer (AST walker)
+    LoopSignal loopSignal;          // Pending break/continue (AST walker)
+    Token loopLabel;                // Loop it targets, length 0 for the innermost
+    bool chainSkipped;              // A ?. link met nil: the rest of its chain is skipped (AST walker)
+    int currentLine;                // Line of the statement or expression being run, for errors (AST walker)
     Environment* env;               // Current environment
     Environment* globalEnv;         // Global environment
     Environment* defEnv;            // Target environment for function definitions
-    CallFrame callStack[CALL_STACK_MAX]; // Call stack
+    CallFrame* callStack;           // Call stack, maxFrames entries
+    int maxFrames;                  // Call depth limit (see setMaxFrames)
     int callStackTop;               // Call stack pointer
+    TryHandler* tryHandlers;        // TRY_HANDLER_MAX active try blocks, innermost last
+    int tryHandlerCount;
+    Value thrownValue;              // Value in flight between throw and catch
+    bool throwPending;              // A throw is unwinding (set until caught)
+    bool panicking;                 // The throw is a panic, which only recover() stops
+    StructDef* errorDef;            // Built-in Error struct thrown by runtime errors
+    uint32_t structShapes;          // Shapes handed out so far, the last one is this count
+    TraceEntry errorTrace[TRACE_MAX]; // Where the last throw happened, innermost first
+    int errorTraceCount;            // Entries kept (the last one is the outermost frame)
+    int errorTraceDepth;            // Frames that were active at the throw
+    struct BytecodeChunk* nativeChunk; // Chunk and instruction that called the running native
+    uint32_t* nativeIp;
+    Function* nativeCallee;         // The native function being called, for its nativeData
+    int nativeLine;                 // Line of the call when the AST walker made it
+    Value calledValues;             // The AST walker's last call's values as an array when it returned several, else nil
+    struct Debugger* debugger;      // Set by 'unnarize debug': checked before each instruction
+    FILE* traceOut;                 // Set by --trace: each instruction is printed here
+    struct Profiler* profiler;      // Set by --profile: calls and returns are timed per function
+    struct Coverage* coverage;      // Set by --coverage: the source line of each instruction run is marked
+    struct Stepper* stepper;        // Set while unnStep runs a script: counted down before each instruction
+    bool optimizeBytecode;          // Peephole-optimize compiled chunks (off with --no-optimize)
+    FILE* errorOut;                 // Compile errors are written here (stderr unless embedded)
+    OutputBuffer output;            // Where print writes (see OutputBuffer)
+    int assertsPassed;              // assert() calls so far, by outcome ('unnarize test')
+    int assertsFailed;
+    uint64_t rngState[4];           // xoshiro256** state behind rand() and ucoreRandom
+    struct RegexCache* regexCache;  // Compiled regex_* patterns by source, or NULL before the first
+    Map* uonSchemas;                // ucoreUon's struct definitions by table name, or NULL before the first
     char projectRoot[1024];         // Project root directory for module search
     char scriptDir[1024];            // Directory containing the running script (for relative paths)
-    ModuleEntry* moduleBuckets[TABLE_SIZE]; // Module cache by name
+    ModuleEntry* moduleBuckets[TABLE_SIZE]; // Module cache by canonical path
+    ModuleEntry* importing;         // Innermost module whose top-level code is running
+    EvalSource* evalSources;        // Every eval() so far, newest first
+    bool evalDisabled;              // Set by unnSetEval(interp, false): eval() throws
     void* externHandles[TABLE_SIZE]; // Handles for dlopen() libraries
     int externHandleCount;          // Count of loaded extern libraries
     StringPool stringPool;          // String interning pool for performance
@@ -335,24 +627,59 @@ struct VM {
     Obj* objects;                   // Linked list of all objects (old gen)
     Obj* nursery;                   // Young generation objects
     int nurseryCount;               // Count of nursery objects
-    int nurseryThreshold;           // Trigger minor GC when exceeded
+    Obj** remembered;               // Old objects given a young reference since the last young collection
+    int rememberedCount;
+    int rememberedCapacity;
+    bool gcYoungOnly;               // The collection in progress marks the nursery alone
+    int gcYoungHold;                // Compiles in progress; no young collection runs during one
     int grayCount;
     int grayCapacity;
     Obj** grayStack;
     size_t bytesAllocated;
     size_t nextGC;
     int gcPhase;                    // 0=idle, 1=marking, 2=sweeping
+
+    // GC Tuning (see configureGC)
+    size_t gcInitialHeap;           // First threshold and floor for nextGC
+    double gcGrowthFactor;          // nextGC = live bytes * factor after a collection
+    bool gcStress;                  // Collect before every allocation
+    size_t gcYoungLimit;            // Bytes allocated between young collections, 0 for full ones only
+    void* blockPool[BLOCK_POOL_CLASSES]; // Free blocks by size class, linked through their first word
+    int blockPoolCount[BLOCK_POOL_CLASSES];
+    int blockPoolLimit;             // Free blocks kept per class; 0 turns the pool off
+
+    struct Scheduler* scheduler;    // Coroutines started by 'spawn', or NULL before the first
+
+    // Resource limits (--max-heap, --timeout, --watchdog)
+    size_t maxHeap;                 // Live heap bytes allowed, 0 for no limit
+    int64_t timeoutMs;              // Run time allowed from startTimeout(), 0 for no limit
+    uint64_t deadline;              // Wall clock (us) when the run times out, 0 for none
+    uint64_t timeLeft;              // Of the timeout while a stepped run is paused (pauseTimeout)
+    int64_t watchdogMs;             // Time allowed without input or output, 0 for no watchdog
+    struct Watchdog* watchdog;      // Its timer thread, from startWatchdog() to stopWatchdog()
+    atomic_uint_fast64_t ioProgress; // Bumped by each write and read the watchdog counts
+    int limitCountdown;             // Polls left before the limits are checked
+    bool limitAbort;                // The throw in flight is a broken limit: no try block catches it
     
     // GC Statistics
     uint64_t gcCollectCount;        // Total GC runs
+    uint64_t gcYoungCount;          // Of those, young collections
+    uint64_t gcYoungTraced;         // Objects scanned by young collections
+    uint64_t gcLastTraced;          // Objects scanned by the last collection
+    uint64_t gcPromoted;            // Nursery objects moved to the old generation
+    uint64_t gcRememberedTotal;     // Objects ever added to the remembered set
     uint64_t gcTotalPauseUs;        // Total pause time (microseconds)
     uint64_t gcLastPauseUs;         // Last GC pause time
     uint64_t gcTotalFreed;          // Total bytes freed
-    size_t gcPeakMemory;            // Peak memory usage
+    size_t gcPeakMemory;            // High-water mark of bytesAllocated
+    uint64_t gcTotalAllocated;      // Bytes ever allocated, freed or not
+    uint64_t gcObjectsAllocated[OBJ_TYPE_COUNT]; // Objects ever created, by type
+    uint64_t gcBlocksReused;        // Pool-sized blocks taken from the block pool
+    uint64_t gcBlocksNew;           // Pool-sized blocks the pool had none of, from malloc
     uint64_t gcLastCollectTime;     // Timestamp of last GC (for pacing)
-    size_t gcBytesAllocSinceGC;     // Bytes allocated since last GC
+    size_t gcBytesAllocSinceGC;     // Bytes allocated since last GC, against gcYoungLimit
     
-    // CLI Arguments
+    // CLI Arguments: the script's path, then the arguments after it
     int argc;
     char** argv;
     
@@ -362,6 +689,13 @@ struct VM {
     int taskCapacity;
 };
 
+// Record input or output for --watchdog. Only this thread writes the
+// counter, so a relaxed load and store is enough.
+static inline void noteIOProgress(VM* vm) {
+    uint_fast64_t n = atomic_load_explicit(&vm->ioProgress, memory_order_relaxed);
+    atomic_store_explicit(&vm->ioProgress, n + 1, memory_order_relaxed);
+}
+
 // VM function prototypes
 
 /**
@@ -383,41 +717,133 @@ void freeVM(VM* vm);
  */
 void interpret(VM* vm, Node* ast);
 
+/**
+ * Interpret one line of REPL input against the persistent global environment
+ * @param vm Pointer to VM structure
+ * @param ast Root block parsed from the line
+ * @param result Receives the value of a trailing expression statement
+ * @return true if the last statement was an expression (result is set)
+ */
+bool interpretLine(VM* vm, Node* ast, Value* result);
+
 // Exposed internal API for external libraries to register native functions
 void registerNativeFunction(VM* vm, const char* name, NativeFn function);
 
 // Core Helpers exposed for corelib
-unsigned int hash(const char* key, int length);
+unsigned int hash(const char* key, int length);         // Bucket: hashString() % TABLE_SIZE
+unsigned int hashString(const char* key, int length);   // Full hash, as kept in ObjString
+// The seed every string hash in the process starts from. setHashSeed fixes
+// it, and is false once a VM has started and the seed is in use.
+bool setHashSeed(uint32_t seed);
+uint32_t currentHashSeed(void);
 Map* newMap(VM* vm);
 Array* newArray(VM* vm);
-void mapSetStr(Map* m, const char* key, int len, Value v);
-void mapSetInt(Map* m, int ikey, Value v);
+Value newError(VM* vm, const char* message);
+void describeThrown(VM* vm, Value thrown, char* buf, size_t bufSize);
+const char* valueTypeName(Value v);
+int compareStrings(ObjString* a, ObjString* b); // Bytewise: <0, 0 or >0
+Value nativeError(VM* vm, const char* format, ...); // Throw from a native: return nativeError(vm, ...)
+bool checkArgCount(VM* vm, const char* name, int argCount, int expected); // False after throwing "name expects N arguments"
+void mapSetStr(VM* vm, Map* m, const char* key, int len, Value v);
+void mapSetString(VM* vm, Map* m, ObjString* key, Value v);            // Uses key's stored hash
+void mapSetInt(VM* vm, Map* m, int64_t ikey, Value v);
 MapEntry* mapFindEntry(Map* m, const char* skey, int slen, int* bucketOut);
-MapEntry* mapFindEntryInt(Map* m, int ikey, int* bucketOut);
+MapEntry* mapFindString(Map* m, ObjString* key, int* bucketOut); // Uses key's stored hash
+MapEntry* mapFindEntryInt(Map* m, int64_t ikey, int* bucketOut);
+bool mapDeleteStr(Map* m, const char* key, int len);
+bool mapDeleteInt(Map* m, int64_t ikey);
+// Walk a map's entries: insertion order for an ordered map, bucket order
+// otherwise. The map must not change during the walk.
+MapEntry* mapFirstEntry(Map* m);
+MapEntry* mapNextEntry(Map* m, MapEntry* e);
+// Sets hold ints and strings. setAdd returns false, changing nothing, for
+// an element already there; the caller checks isSetElement first.
+Map* newSet(VM* vm);
+static inline bool isSetElement(Value v) { return IS_INT(v) || IS_STRING(v); }
+bool setAdd(VM* vm, Map* set, Value element);
+bool setHas(Map* set, Value element);
+bool setRemove(Map* set, Value element);
+// a | b, a & b or a - b of two sets as a new set, for 'op' TOKEN_PIPE,
+// TOKEN_AMPERSAND or TOKEN_MINUS
+Map* setOperation(VM* vm, TokenType op, Map* a, Map* b);
 void arrayPush(VM* vm, Array* a, Value v);
+Value sliceValue(VM* vm, Value target, Value start, Value end); // target[start:end], nil bound = omitted
 bool arrayPop(Array* array, Value* value);
 char* readFileAll(const char* path);
 Value callFunction(VM* vm, Function* func, Value* args, int argCount);
+// The error for calling 'func' with a count of arguments it does not take
+void formatArityError(Function* func, int argCount, char* buf, size_t size);
+// f(a, b, name: value): lay the arguments out by parameter. The
+// 'positional' values in 'args' fill func's parameters from 'first' on
+// (1 when a bound method passes self), then each of the 'named' values
+// goes to the parameter 'names' gives it; a left-out parameter with a
+// default gets OMITTED_VAL. 'out' has room for every parameter. Returns
+// the argument count, or -1 with the error in 'buf'.
+int bindNamedArguments(Function* func, int first, Value* args, int positional, Token* names,
+                       Value* named, int namedCount, Value* out, char* buf, size_t size);
+// 'defer callee(args)': keep the call, with these arguments, in 'frame' to
+// run when its function ends. False with an error pending when 'callee'
+// can't be called this way.
+bool deferCall(VM* vm, CallFrame* frame, Value callee, Value* args, int argCount);
 Function* findFunctionByName(VM* vm, const char* name);
 void defineGlobal(VM* vm, const char* name, Value value);
-void defineNative(VM* vm, Environment* env, const char* name, NativeFn fn, int arity);
-ObjString* internString(VM* vm, const char* str, int length);
+Function* defineNative(VM* vm, Environment* env, const char* name, NativeFn fn, int arity);
+void defineNativeValue(VM* vm, Environment* env, const char* name, Value value);
+// A library of natives bound to the global 'name', as ucoreMath is; fill
+// mod->env with defineNative and defineNativeValue
+Module* defineNativeModule(VM* vm, const char* name);
+// Bind 'mod' to the global 'alias' too, the short name a core library
+// goes by in scripts ('math' for ucoreMath)
+void defineModuleAlias(VM* vm, Module* mod, const char* alias);
+ObjString* internString(VM* vm, const char* str, int length);   // Up to 256 bytes interned
+ObjString* internConstant(VM* vm, const char* str, int length); // Interned at any length
+ObjString* takeString(VM* vm, char* chars, int length);         // As internString, adopting malloc'd chars
+// An int of any size: inline when it fits, else a new ObjInt
+Value intValue(VM* vm, int64_t n);
+// Value of a number literal: an int unless it has a fraction. The lexer
+// and parser reject integers outside the range, so one never turns into a
+// double; only -9223372036854775808 keeps its '-' in the token.
+Value numberLiteral(VM* vm, Token token);
 
 // Path Resolution
 void setScriptDir(VM* vm, const char* scriptPath);
 char* resolvePath(VM* vm, const char* path);  // Caller must free() the result
+// Canonical path of an import, relative to the importing file's directory
+// (falling back to the project root). Returns NULL if it doesn't exist.
+char* resolveImportPath(VM* vm, const char* importerPath, const char* path);
+// Absolute form of 'path' with "." and ".." removed; false if it won't fit
+bool normalizePath(const char* path, char* out, size_t size);
+// 'path' relative to the project root when it is under it, as reports show it
+const char* displayPath(VM* vm, const char* path);
+
+// Module Cache
+ModuleEntry* findModuleEntry(VM* vm, const char* path, bool insert);
+void removeModuleEntry(VM* vm, ModuleEntry* entry);
+// "a.unna -> b.unna -> a.unna" for an import of 'target' while it loads
+void describeImportCycle(VM* vm, ModuleEntry* target, char* out, size_t size);
+// A module's syntax tree, or NULL with the syntax error in 'message'
+Node* parseModule(VM* vm, const char* path, const char* source, char* message, size_t size);
 
 // Memory Management
 void* reallocate(VM* vm, void* pointer, size_t oldSize, size_t newSize);
 void collectGarbage(VM* vm);
+// Apply UNNARIZE_GC_HEAP / UNNARIZE_GC_GROWTH / UNNARIZE_GC_STRESS
+void configureGC(VM* vm);
 bool collectGarbageIncremental(VM* vm, int workUnits);
 void collectGarbageConcurrent(VM* vm, int workUnits);
 bool isGCActive(void);
+// Heap and collector counters for '--stats', written to 'out'
+void printMemoryStats(VM* vm, FILE* out);
 #define ALLOCATE_OBJ(vm, type, objectType) \
     (type*)allocateObject(vm, sizeof(type), objectType)
 
 Obj* allocateObject(VM* vm, size_t size, ObjType type);
 void freeObject(VM* vm, Obj* object);
+// Uncounted memory for small blocks, recycled through the block pool; a
+// block goes back to freeBlock with the size it was allocated with
+void* allocateBlock(VM* vm, size_t size);
+void freeBlock(VM* vm, void* block, size_t size);
+void freeBlockPool(VM* vm);
 void grayObject(VM* vm, Obj* object);
 void markObject(VM* vm, Obj* object);
 void markValue(VM* vm, Value value);
@@ -437,10 +863,90 @@ void markValue(VM* vm, Value value);
         if (IS_OBJ(val)) WRITE_BARRIER(vm, AS_OBJ(val)); \
     } while(0)
 
+// Generational barrier: 'owner' now references 'child'. An old owner of a
+// young child joins the remembered set, which a young collection scans in
+// place of the old generation, so every store of an object into another
+// object goes through one of these.
+void rememberObject(VM* vm, Obj* owner);
+
+#define GEN_BARRIER(vm, owner, child) \
+    do { \
+        Obj* gbChild_ = (Obj*)(child); \
+        if (((Obj*)(owner))->generation && gbChild_ && !gbChild_->generation) { \
+            rememberObject((vm), (Obj*)(owner)); \
+        } \
+    } while(0)
+
+#define GEN_BARRIER_VALUE(vm, owner, val) \
+    do { \
+        Value gbValue_ = (val); \
+        if (IS_OBJ(gbValue_)) GEN_BARRIER(vm, owner, AS_OBJ(gbValue_)); \
+    } while(0)
+
 
 // String concatenation helper (exposed for VM)
 Value vm_concatenate(VM* vm, Value a, Value b);
 
+// Iteration protocol behind for-each loops. The cursor starts at INT_VAL(0)
+// and counts the elements produced; iteratorNext stores the next element
+// in *out and advances it, or returns false once the iterable is exhausted.
+// Arrays are re-checked each step, so elements pushed mid-loop are visited.
+// A range element too wide to store inline is a new ObjInt, so the caller
+// has what it roots rooted.
+static inline bool isIterable(Value v) {
+    return IS_OBJ(v) && (AS_OBJ(v)->type == OBJ_ARRAY || AS_OBJ(v)->type == OBJ_RANGE);
+}
+
+static inline bool iteratorNext(VM* vm, Value iterable, Value* cursor, Value* out) {
+    int64_t k = AS_INT(*cursor);
+    Obj* o = AS_OBJ(iterable);
+    if (o->type == OBJ_ARRAY) {
+        Array* arr = (Array*)o;
+        if (k >= arr->count) return false;
+        *out = arr->items[k];
+    } else {
+        Range* r = (Range*)o;
+        __int128 v = (__int128)r->start + (__int128)k * r->step; // Can pass either end of the ints
+        if (r->step > 0 ? v >= r->stop : v <= r->stop) return false;
+        *out = INT_FITS_INLINE(v) ? INT_VAL(v) : intValue(vm, (int64_t)v);
+    }
+    *cursor = INT_VAL(k + 1);
+    return true;
+}
+
+// What a loop or spread over 'v' walks: for a set, a new array of its
+// elements as they are when it starts, which the caller roots; anything
+// else as it is
+Value iterableOf(VM* vm, Value v);
+
+// Number of values a range produces
+int64_t rangeLength(Range* r);
+
+// Resize the call stack to 'frames' entries (1 to MAX_FRAMES_LIMIT); only
+// when nothing is running. Returns false for a size out of range.
+#define MAX_FRAMES_LIMIT 1000000
+bool setMaxFrames(VM* vm, int frames);
+
+// Method of a struct by name, or NULL
+Function* findMethod(StructDef* def, const char* name, int length);
+// The __close__ method a 'with' block calls on 'resource', or NULL
+Function* resourceCloser(Value resource);
+// The special method 'name' (__len__, __index__, __setindex__, __add__...)
+// of a struct instance, or NULL when 'v' is not one or its struct does not
+// define it
+Function* specialMethod(Value v, const char* name);
+// left's operator method 'name' (__add__, __sub__, __mul__) called with
+// right; false when left defines none. A throw leaves throwPending set.
+bool callOperator(VM* vm, const char* name, Value left, Value right, Value* result);
+// A comparison (== != < <= > >=) through left's __eq__ or __lt__: <= and
+// > also ask ==, and >= is the opposite of <. False when left lacks the
+// method the comparison needs.
+bool compareOperator(VM* vm, TokenType op, Value left, Value right, bool* result);
+// What a struct instance's __str__ returns, or NULL when it has none. NULL
+// with throwPending set when __str__ throws or doesn't return a string.
+ObjString* structString(VM* vm, Value v);
+BoundMethod* newBoundMethod(VM* vm, Value receiver, Function* method);
+
 void registerUCoreTimer(VM* vm);
 void registerUCoreUON(VM* vm);
 void registerUCoreScraper(VM* vm);
@@ -448,4 +954,10 @@ void registerUCoreScraper(VM* vm);
 // Register core built-in functions (has, keys, len, etc.)
 void registerBuiltins(VM* vm);
 
+// Register every built-in library and native, then apply the GC settings
+void registerLibraries(VM* vm);
+
+// Function object for a script's top-level code in 'chunk'
+Function* newBytecodeScript(VM* vm, struct BytecodeChunk* chunk, const char* path);
+
 #endif // VM_H
\ No newline at end of file
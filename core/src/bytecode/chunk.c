@@ -1,6 +1,7 @@
 #include "bytecode/chunk.h"
 #include <stdlib.h>
 #include <stdio.h>
+#include <string.h>
 
 /**
  * Register-based Bytecode Chunk Management
@@ -19,20 +20,31 @@ void initChunk(BytecodeChunk* chunk) {
     chunk->constantCount = 0;
     chunk->constantCapacity = 0;
 
-    chunk->lineNumbers = NULL;
-    chunk->lineCapacity = 0;
+    chunk->locations = NULL;
+    chunk->locationCapacity = 0;
+    chunk->sourcePath = NULL;
+    chunk->locals = NULL;
+    chunk->localCount = 0;
+    chunk->localCapacity = 0;
 
     chunk->maxRegs = 0;
+
+    chunk->propertyCaches = NULL;
+    chunk->propertyCacheCount = 0;
 }
 
 void freeChunk(BytecodeChunk* chunk) {
     if (chunk->code) free(chunk->code);
     if (chunk->constants) free(chunk->constants);
-    if (chunk->lineNumbers) free(chunk->lineNumbers);
+    free(chunk->locations);
+    free(chunk->sourcePath);
+    for (int i = 0; i < chunk->localCount; i++) free(chunk->locals[i].name);
+    free(chunk->locals);
+    free(chunk->propertyCaches);
     initChunk(chunk);
 }
 
-void writeChunk(BytecodeChunk* chunk, uint32_t instruction, int line) {
+void writeChunk(BytecodeChunk* chunk, uint32_t instruction, int line, int column) {
     if (chunk->codeCapacity < chunk->codeSize + 1) {
         int oldCapacity = chunk->codeCapacity;
         chunk->codeCapacity = GROW_CAPACITY(oldCapacity);
@@ -41,16 +53,32 @@ void writeChunk(BytecodeChunk* chunk, uint32_t instruction, int line) {
 
     chunk->code[chunk->codeSize] = instruction;
 
-    if (chunk->lineCapacity < chunk->codeSize + 1) {
-        int oldCapacity = chunk->lineCapacity;
-        chunk->lineCapacity = GROW_CAPACITY(oldCapacity);
-        chunk->lineNumbers = realloc(chunk->lineNumbers, chunk->lineCapacity * sizeof(int));
+    if (chunk->locationCapacity < chunk->codeSize + 1) {
+        int oldCapacity = chunk->locationCapacity;
+        chunk->locationCapacity = GROW_CAPACITY(oldCapacity);
+        chunk->locations = realloc(chunk->locations, chunk->locationCapacity * sizeof(SourceLocation));
     }
-    chunk->lineNumbers[chunk->codeSize] = line;
+    chunk->locations[chunk->codeSize] = (SourceLocation){line, column};
 
     chunk->codeSize++;
 }
 
+int chunkLine(BytecodeChunk* chunk, int offset) {
+    if (!chunk || offset < 0 || offset >= chunk->codeSize) return 0;
+    return chunk->locations[offset].line;
+}
+
+// Made for the whole code stream at once, so a chunk allocates its
+// caches a single time unless it is written to after it first ran
+PropertyCache* growPropertyCaches(BytecodeChunk* chunk, int offset) {
+    int count = chunk->codeSize > offset ? chunk->codeSize : offset + 1;
+    chunk->propertyCaches = realloc(chunk->propertyCaches, count * sizeof(PropertyCache));
+    memset(chunk->propertyCaches + chunk->propertyCacheCount, 0,
+           (count - chunk->propertyCacheCount) * sizeof(PropertyCache));
+    chunk->propertyCacheCount = count;
+    return &chunk->propertyCaches[offset];
+}
+
 int addConstant(BytecodeChunk* chunk, Value value) {
     if (chunk->constantCapacity < chunk->constantCount + 1) {
         int oldCapacity = chunk->constantCapacity;
@@ -61,6 +89,20 @@ int addConstant(BytecodeChunk* chunk, Value value) {
     return chunk->constantCount++;
 }
 
+int addLocalInfo(BytecodeChunk* chunk, const char* name, int reg, int startPc) {
+    if (chunk->localCapacity < chunk->localCount + 1) {
+        int oldCapacity = chunk->localCapacity;
+        chunk->localCapacity = GROW_CAPACITY(oldCapacity);
+        chunk->locals = realloc(chunk->locals, chunk->localCapacity * sizeof(LocalDebugInfo));
+    }
+    LocalDebugInfo* info = &chunk->locals[chunk->localCount];
+    info->name = strdup(name);
+    info->reg = reg;
+    info->startPc = startPc;
+    info->endPc = -1;
+    return chunk->localCount++;
+}
+
 void patchJump(BytecodeChunk* chunk, int instrIndex) {
     // Patch the jump offset in instruction at instrIndex
     // Jump distance = current position - instrIndex - 1
@@ -80,64 +122,240 @@ void patchJump(BytecodeChunk* chunk, int instrIndex) {
 
 // Disassembler
 
+// Constants as they would be written in source: strings quoted
+static void printConstant(FILE* out, Value v) {
+    if (IS_STRING(v)) {
+        fputc('"', out);
+        for (const char* p = AS_CSTRING(v); *p; p++) {
+            switch (*p) {
+                case '\n': fprintf(out, "\\n"); break;
+                case '\t': fprintf(out, "\\t"); break;
+                case '\r': fprintf(out, "\\r"); break;
+                case '"':  fprintf(out, "\\\""); break;
+                case '\\': fprintf(out, "\\\\"); break;
+                default:   fputc(*p, out); break;
+            }
+        }
+        fputc('"', out);
+    } else if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_FUNCTION) {
+        Function* fn = (Function*)AS_OBJ(v);
+        fprintf(out, "<fn %.*s>", fn->name.length, fn->name.start);
+    } else {
+        char buf[64];
+        fprintf(out, "%s", valueToChars(v, buf, sizeof(buf)));
+    }
+}
+
+static void printK(FILE* out, BytecodeChunk* chunk, int index) {
+    if (index < chunk->constantCount) {
+        fprintf(out, "  ; ");
+        printConstant(out, chunk->constants[index]);
+    }
+}
+
+// Prints the chunk, then every function chunk in its constant pool
 void disassembleChunk(BytecodeChunk* chunk, const char* name) {
     printf("== %s (regs: %d) ==\n", name, chunk->maxRegs);
-    for (int offset = 0; offset < chunk->codeSize; offset++) {
-        disassembleInstruction(chunk, offset);
+    for (int offset = 0; offset < chunk->codeSize;) {
+        offset = disassembleInstruction(chunk, offset);
+    }
+
+    for (int i = 0; i < chunk->constantCount; i++) {
+        Value v = chunk->constants[i];
+        if (!IS_OBJ(v) || AS_OBJ(v)->type != OBJ_FUNCTION) continue;
+        Function* fn = (Function*)AS_OBJ(v);
+        if (fn->isNative || !fn->bytecodeChunk) continue;
+        char fname[256];
+        snprintf(fname, sizeof(fname), "%.*s", fn->name.length, fn->name.start);
+        printf("\n");
+        disassembleChunk(fn->bytecodeChunk, fname);
     }
 }
 
-int disassembleInstruction(BytecodeChunk* chunk, int offset) {
+static void printPrefix(BytecodeChunk* chunk, int offset) {
     printf("%04d ", offset);
-
-    if (offset > 0 && chunk->lineNumbers[offset] == chunk->lineNumbers[offset - 1]) {
+    int line = chunk->locations[offset].line;
+    if (offset > 0 && line == chunk->locations[offset - 1].line) {
         printf("   | ");
     } else {
-        printf("%4d ", chunk->lineNumbers[offset]);
+        printf("%4d ", line);
     }
+}
 
+void describeInstruction(FILE* out, BytecodeChunk* chunk, int offset) {
     uint32_t inst = chunk->code[offset];
     uint8_t op = DECODE_OP(inst);
     const OpcodeInfo* info = getOpcodeInfo(op);
 
     if (!info || !info->name) {
-        printf("Unknown opcode %d\n", op);
-        return offset + 1;
+        fprintf(out, "Unknown opcode %d", op);
+        return;
     }
 
-    uint8_t a = DECODE_A(inst);
-    uint8_t b = DECODE_B(inst);
-    uint8_t c = DECODE_C(inst);
-    uint16_t bx = DECODE_Bx(inst);
-
-    switch (info->format) {
-        case 0: // ABC
-            printf("%-16s R%-3d R%-3d R%-3d\n", info->name, a, b, c);
-            break;
-        case 1: // ABx
-            printf("%-16s R%-3d %5d", info->name, a, bx);
-            // Show constant value if it's a LOADK or global access
-            if ((op == OP_LOADK || op == OP_GETGLOBAL || op == OP_SETGLOBAL ||
-                 op == OP_DEFGLOBAL) && bx < (uint16_t)chunk->constantCount) {
-                printf("  ; K(");
-                printValue(chunk->constants[bx]);
-                printf(")");
-            }
-            printf("\n");
+    int a = DECODE_A(inst);
+    int b = DECODE_B(inst);
+    int c = DECODE_C(inst);
+    int bx = DECODE_Bx(inst);
+    int sbx = DECODE_sBx(inst);
+
+    if (op == OP_RETURNNIL || op == OP_HALT || op == OP_NOP || op == OP_ENDTRY) {
+        fprintf(out, "%s", info->name);
+        return;
+    }
+
+    fprintf(out, "%-13s ", info->name);
+    switch (op) {
+        // R(A)
+        case OP_LOADNIL:
+        case OP_LOADTRUE:
+        case OP_LOADFALSE:
+        case OP_CLOSE:
+        case OP_NEWMAP:
+        case OP_NEWSET:
+        case OP_PRINT:
+        case OP_THROW:
+        case OP_WITH:
+        case OP_ENDWITH:
+            fprintf(out, "R%d", a);
             break;
-        case 2: // AsBx
-            printf("%-16s R%-3d -> %d\n", info->name, a, offset + 1 + DECODE_sBx(inst));
+
+        // R(A) R(B)
+        case OP_MOVE:
+        case OP_NEG:
+        case OP_BNOT:
+        case OP_INC:
+        case OP_DEC:
+        case OP_NOT:
+        case OP_POP:
+        case OP_LEN:
+        case OP_AWAIT:
+        case OP_FOREACH_PREP:
+        case OP_SPREAD:
+        case OP_METHOD:
+            fprintf(out, "R%d R%d", a, b);
             break;
-        case 3: // sBx24
-            printf("%-16s -> %d\n", info->name, offset + 1 + DECODE_sBx24(inst));
+
+        case OP_GETUPVAL:
+            fprintf(out, "R%d U%d", a, b);
             break;
-        case 4: // A-only
-            printf("%-16s R%-3d\n", info->name, a);
+        case OP_SETUPVAL:
+            fprintf(out, "U%d R%d", b, a);
             break;
+
+        case OP_LOADK:
+        case OP_GETGLOBAL:
+        case OP_SETGLOBAL:
+        case OP_DEFGLOBAL:
+        case OP_DEFCONST:
+        case OP_IMPORT:
+            fprintf(out, "R%d K%d", a, bx);
+            printK(out, chunk, bx);
+            break;
+
+        case OP_LOADI:
+        case OP_ADDI:
+        case OP_SUBI:
+            fprintf(out, "R%d %d", a, sbx);
+            break;
+
+        // Jumps show their absolute target
+        case OP_JMP:
+            fprintf(out, "-> %04d", offset + 1 + DECODE_sBx24(inst));
+            break;
+        case OP_LOOP:
+            fprintf(out, "-> %04d", offset + 1 - DECODE_sBx24(inst));
+            break;
+        case OP_JMPF:
+        case OP_JMPT:
+        case OP_JMPNIL:
+        case OP_JMPNOTNIL:
+        case OP_FOREACH_NEXT:
+        case OP_TRY:
+            fprintf(out, "R%d -> %04d", a, offset + 1 + sbx);
+            break;
+        case OP_JMPARG:
+            fprintf(out, "%d -> %04d", a, offset + 1 + sbx);
+            break;
+
+        case OP_CALL:
+        case OP_TAILCALL:
+            fprintf(out, "R%d %d %d", a, b, c);
+            fprintf(out, "  ; %d arg%s", b, b == 1 ? "" : "s");
+            break;
+        case OP_CALLNAMED:
+            fprintf(out, "R%d %d %d", a, b, c);
+            fprintf(out, "  ; %d arg%s, names in R%d", b, b == 1 ? "" : "s", a + b + 1);
+            break;
+        case OP_SPAWN:
+        case OP_DEFER:
+            fprintf(out, "R%d %d %d", a, b, c);
+            if (c) fprintf(out, "  ; spread args");
+            else fprintf(out, "  ; %d arg%s", b, b == 1 ? "" : "s");
+            break;
+        case OP_RETURN:
+            fprintf(out, "R%d %d", a, b);
+            break;
+
+        case OP_GETPROP:
+            fprintf(out, "R%d R%d K%d", a, b, c);
+            printK(out, chunk, c);
+            break;
+        case OP_SETPROP:
+            fprintf(out, "R%d K%d R%d", a, b, c);
+            printK(out, chunk, b);
+            break;
+        case OP_GETPROPR:
+        case OP_SETPROPR:
+            fprintf(out, "R%d R%d R%d", a, b, c);
+            break;
+
+        case OP_NEWARRAY:
+            fprintf(out, "R%d %d", a, bx);
+            break;
+        case OP_NEWSTRUCT:
+        case OP_ASYNC:
+        case OP_CALLSPREAD:
+            fprintf(out, "R%d R%d %d", a, b, c);
+            break;
+        case OP_STRUCTDEF:
+            fprintf(out, "%d K%d", a, bx);
+            printK(out, chunk, bx);
+            break;
+
+        case OP_CLOSURE:
+            fprintf(out, "R%d K%d", a, bx);
+            printK(out, chunk, bx);
+            break;
+
+        // Remaining three-register instructions
         default:
-            printf("%-16s ???\n", info->name);
+            fprintf(out, "R%d R%d R%d", a, b, c);
             break;
     }
+}
+
+// Returns the offset of the next instruction; OP_CLOSURE consumes its
+// capture words, which are printed beneath it
+int disassembleInstruction(BytecodeChunk* chunk, int offset) {
+    printPrefix(chunk, offset);
+    describeInstruction(stdout, chunk, offset);
+    printf("\n");
 
+    uint32_t inst = chunk->code[offset];
+    if (DECODE_OP(inst) != OP_CLOSURE) return offset + 1;
+
+    int bx = DECODE_Bx(inst);
+    int upvalues = 0;
+    if (bx < chunk->constantCount && IS_OBJ(chunk->constants[bx]) &&
+        AS_OBJ(chunk->constants[bx])->type == OBJ_FUNCTION) {
+        upvalues = ((Function*)AS_OBJ(chunk->constants[bx]))->upvalueCount;
+    }
+    for (int i = 0; i < upvalues && offset + 1 < chunk->codeSize; i++) {
+        offset++;
+        uint32_t word = chunk->code[offset];
+        printPrefix(chunk, offset);
+        printf("%-13s %s%d\n", "  capture",
+               DECODE_OP(word) == OP_MOVE ? "R" : "U", DECODE_B(word));
+    }
     return offset + 1;
 }
@@ -1,6 +1,9 @@
 #include "bytecode/compiler.h"
 #include "bytecode/opcodes.h"
 #include "lexer.h"
+#include "bytecode/optimizer.h"
+#include <math.h>
+#include <stdarg.h>
 
 // #define DEBUG_PRINT_CODE
 
@@ -16,51 +19,101 @@
  * No push/pop stack operations needed.
  */
 
-// Helper to process string escapes
-static char* parseStringLiteral(const char* start, int length) {
-    char* buffer = malloc(length + 1);
-    char* dest = buffer;
-    const char* src = start;
-    const char* end = start + length;
-
-    while (src < end) {
-        if (*src == '\\' && src + 1 < end) {
-            src++;
-            switch (*src) {
-                case 'n': *dest++ = '\n'; break;
-                case 't': *dest++ = '\t'; break;
-                case 'r': *dest++ = '\r'; break;
-                case '"': *dest++ = '"'; break;
-                case '\'': *dest++ = '\''; break;
-                case '\\': *dest++ = '\\'; break;
-                default:
-                    *dest++ = '\\';
-                    *dest++ = *src;
-            }
-            src++;
-        } else {
-            *dest++ = *src++;
-        }
-    }
-    *dest = '\0';
-    return buffer;
-}
-
-typedef struct {
+#define LOOP_JUMP_MAX 256
+
+// Innermost-first stack of loops being compiled, for break/continue
+typedef struct Loop {
+    struct Loop* enclosing;
+    int bodyLocal;          // First local declared inside the body
+    int bodyReg;            // First register owned by the body
+    int tryDepth;           // Compiler tryDepth outside the loop
+    int continueTarget;     // Known target (while), or -1 until patchContinues
+    Token label;            // 'name:' before the loop, length 0 when unlabeled
+    int breakJumps[LOOP_JUMP_MAX];
+    int breakCount;
+    int continueJumps[LOOP_JUMP_MAX];
+    int continueCount;
+} Loop;
+
+// Innermost-first stack of with blocks being compiled, for the jumps and
+// returns that leave them
+typedef struct WithBlock {
+    struct WithBlock* enclosing;
+    int reg;                // The resource's register
+    int tryDepth;           // Compiler tryDepth inside the block
+} WithBlock;
+
+#define CHAIN_JUMP_MAX 256
+
+// Innermost-first stack of ?. chains being compiled: each ?. link jumps
+// to the end of its chain when the object is nil
+typedef struct OptionalChain {
+    struct OptionalChain* enclosing;
+    int nilJumps[CHAIN_JUMP_MAX];
+    int nilCount;
+} OptionalChain;
+
+// A call whose arguments don't fit the function its callee was declared
+// as; reported once the whole script is compiled, unless that variable
+// turns out to be assigned somewhere
+typedef struct MismatchedCall {
+    Node* decl;
+    Token name;
+    char problem[96]; // "expects 2 arguments but got 1", after the function's name
+} MismatchedCall;
+
+typedef struct Compiler {
     VM* vm;
     BytecodeChunk* chunk;
+    struct Compiler* enclosing; // Compiler of the surrounding function (NULL for script)
 
     // Register-based local variable tracking
     struct {
         const char* name;
         int depth;
         int reg;        // Register index for this variable
+        bool isCaptured; // Referenced by an inner function -> needs OP_CLOSE on scope exit
+        bool isConst;    // Declared with const: assignments are rejected
+        int debugInfo;   // Index in chunk->locals, or -1 for hidden locals
+        Node* structDecl; // Set for a local struct: its declaration
+        Node* functionDecl; // Set for a local bound to a function: its declaration
     } locals[256];
     int localCount;
 
+    // Variables captured from enclosing functions
+    struct {
+        uint8_t index;  // Register (isLocal) or upvalue index in the enclosing function
+        bool isLocal;
+    } upvalues[256];
+    int upvalueCount;
+
     int nextReg;        // Next free register index
     int scopeDepth;
     const char* modulePath;
+    Loop* loop;         // Innermost enclosing loop (NULL outside loops)
+    OptionalChain* chain; // Innermost ?. chain (NULL outside one)
+    int tryDepth;       // try blocks open at this point of the function
+    WithBlock* with;    // Innermost enclosing with block (NULL outside one)
+    Node* node;         // Innermost node being compiled, for emit()'s columns
+
+    // Enum members, top-level consts and top-level structs of the script;
+    // only the outermost compiler fills these in
+    Token* enumNames;
+    int enumCount;
+    Token* constNames;
+    int constCount;
+    Node** structs;
+    int structCount;
+    int structsCompiled;    // How many of those the code so far declared
+    // Top-level declarations binding the only global of their name to a
+    // function, the declarations whose variable is assigned somewhere, and
+    // the calls that don't match theirs
+    Node** functions;
+    int functionCount;
+    Node** rebound;
+    int reboundCount;
+    MismatchedCall* mismatchedCalls;
+    int mismatchedCallCount;
 
     bool hadError;
 } Compiler;
@@ -69,6 +122,26 @@ static void initCompiler(Compiler* c, VM* vm, BytecodeChunk* chunk, const char*
     c->vm = vm;
     c->chunk = chunk;
     c->modulePath = modulePath;
+    c->enclosing = NULL;
+    c->loop = NULL;
+    c->chain = NULL;
+    c->tryDepth = 0;
+    c->with = NULL;
+    c->node = NULL;
+    c->upvalueCount = 0;
+    c->enumNames = NULL;
+    c->enumCount = 0;
+    c->constNames = NULL;
+    c->constCount = 0;
+    c->structs = NULL;
+    c->structCount = 0;
+    c->structsCompiled = 0;
+    c->functions = NULL;
+    c->functionCount = 0;
+    c->rebound = NULL;
+    c->reboundCount = 0;
+    c->mismatchedCalls = NULL;
+    c->mismatchedCallCount = 0;
     c->hadError = false;
     c->scopeDepth = 0;
 
@@ -77,13 +150,28 @@ static void initCompiler(Compiler* c, VM* vm, BytecodeChunk* chunk, const char*
     c->locals[0].depth = 0;
     c->locals[0].name = "";
     c->locals[0].reg = 0;
+    c->locals[0].debugInfo = -1;
+    c->locals[0].structDecl = NULL;
+    c->locals[0].functionDecl = NULL;
     c->nextReg = 1;
 }
 
+// Report a compile error at 'token', with its line and a caret under it.
+// Compiling carries on, to find any further errors.
+static void errorAt(Compiler* c, Token token, const char* format, ...) {
+    char message[256];
+    va_list args;
+    va_start(args, format);
+    vsnprintf(message, sizeof(message), format, args);
+    va_end(args);
+    reportAtToken(c->vm->errorOut, token, message);
+    c->hadError = true;
+}
+
 // Allocate a temporary register
 static int allocReg(Compiler* c) {
     if (c->nextReg >= FRAME_REG_MAX) {
-        fprintf(stderr, "Register overflow (%d)\n", c->nextReg);
+        fprintf(c->vm->errorOut, "Register overflow (%d)\n", c->nextReg);
         c->hadError = true;
         return 0;
     }
@@ -97,9 +185,11 @@ static void freeRegsTo(Compiler* c, int target) {
     if (target < c->nextReg) c->nextReg = target;
 }
 
-// Emit a 32-bit instruction
+// Emit a 32-bit instruction. It takes the column of the node being
+// compiled when it is on that node's line; otherwise the column is unknown.
 static void emit(Compiler* c, uint32_t inst, int line) {
-    writeChunk(c->chunk, inst, line);
+    int column = c->node && c->node->line == line ? c->node->column : 0;
+    writeChunk(c->chunk, inst, line, column);
 }
 
 // Emit jump placeholder, return instruction index for patching
@@ -113,21 +203,56 @@ static int emitJumpPlaceholder(Compiler* c, uint8_t op, uint8_t a, int line) {
     return idx;
 }
 
-// Resolve local variable -> register
-static int resolveLocal(Compiler* c, const char* name, int length) {
+// Resolve local variable -> index into c->locals
+static int findLocal(Compiler* c, const char* name, int length) {
     for (int i = c->localCount - 1; i >= 0; i--) {
         if (strlen(c->locals[i].name) == (size_t)length &&
             memcmp(c->locals[i].name, name, length) == 0) {
-            return c->locals[i].reg;
+            return i;
         }
     }
-    return -1; // Not found, assume global
+    return -1;
+}
+
+// Resolve local variable -> register
+static int resolveLocal(Compiler* c, const char* name, int length) {
+    int i = findLocal(c, name, length);
+    return i != -1 ? c->locals[i].reg : -1; // Not found, assume global
+}
+
+static int addUpvalue(Compiler* c, uint8_t index, bool isLocal) {
+    for (int i = 0; i < c->upvalueCount; i++) {
+        if (c->upvalues[i].index == index && c->upvalues[i].isLocal == isLocal) return i;
+    }
+    if (c->upvalueCount >= 256) {
+        fprintf(c->vm->errorOut, "Too many captured variables in one function\n");
+        c->hadError = true;
+        return 0;
+    }
+    c->upvalues[c->upvalueCount].index = index;
+    c->upvalues[c->upvalueCount].isLocal = isLocal;
+    return c->upvalueCount++;
+}
+
+// Resolve a local of an enclosing function -> upvalue index, or -1 (global)
+static int resolveUpvalue(Compiler* c, const char* name, int length) {
+    if (!c->enclosing) return -1;
+
+    int local = findLocal(c->enclosing, name, length);
+    if (local != -1) {
+        c->enclosing->locals[local].isCaptured = true;
+        return addUpvalue(c, (uint8_t)c->enclosing->locals[local].reg, true);
+    }
+
+    int upvalue = resolveUpvalue(c->enclosing, name, length);
+    if (upvalue != -1) return addUpvalue(c, (uint8_t)upvalue, false);
+    return -1;
 }
 
 // Add local variable in the current register
 static int addLocal(Compiler* c, const char* name) {
     if (c->localCount >= 256) {
-        fprintf(stderr, "Too many local variables\n");
+        fprintf(c->vm->errorOut, "Too many local variables\n");
         c->hadError = true;
         return 0;
     }
@@ -135,10 +260,415 @@ static int addLocal(Compiler* c, const char* name) {
     c->locals[c->localCount].name = name;
     c->locals[c->localCount].depth = c->scopeDepth;
     c->locals[c->localCount].reg = reg;
+    c->locals[c->localCount].isCaptured = false;
+    c->locals[c->localCount].isConst = false;
+    c->locals[c->localCount].structDecl = NULL;
+    c->locals[c->localCount].functionDecl = NULL;
+    // Names starting with '.' are compiler temporaries the debugger doesn't show
+    c->locals[c->localCount].debugInfo = name[0] != '.'
+        ? addLocalInfo(c->chunk, name, reg, c->chunk->codeSize) : -1;
     c->localCount++;
     return reg;
 }
 
+// A declared local: an error when the innermost scope already has one of
+// that name. Inner blocks may shadow outer locals.
+static int declareLocal(Compiler* c, Token name) {
+    for (int i = c->localCount - 1; i >= 0 && c->locals[i].depth == c->scopeDepth; i--) {
+        if (strlen(c->locals[i].name) == (size_t)name.length &&
+            memcmp(c->locals[i].name, name.start, name.length) == 0) {
+            errorAt(c, name, "Variable '%.*s' is already declared in this scope.", name.length, name.start);
+            break;
+        }
+    }
+    return addLocal(c, strndup(name.start, name.length));
+}
+
+// Leaving a scope: locals from 'fromLocal' on are out of scope from here
+static void dropLocals(Compiler* c, int fromLocal) {
+    for (int i = fromLocal; i < c->localCount; i++) {
+        int info = c->locals[i].debugInfo;
+        if (info >= 0) c->chunk->locals[info].endPc = c->chunk->codeSize;
+    }
+    c->localCount = fromLocal;
+}
+
+// Leaving a scope: captured locals from 'fromLocal' on must be closed
+// before their registers are reused
+static void closeScope(Compiler* c, int fromLocal, int fromReg, int line) {
+    for (int i = fromLocal; i < c->localCount; i++) {
+        if (c->locals[i].isCaptured) {
+            emit(c, ENCODE_A(OP_CLOSE, fromReg), line);
+            return;
+        }
+    }
+}
+
+// Enter a loop whose body starts at the current local/register
+static void beginLoop(Compiler* c, Loop* loop, int continueTarget, Token label) {
+    loop->enclosing = c->loop;
+    loop->label = label;
+    loop->bodyLocal = c->localCount;
+    loop->bodyReg = c->nextReg;
+    loop->tryDepth = c->tryDepth;
+    loop->continueTarget = continueTarget;
+    loop->breakCount = 0;
+    loop->continueCount = 0;
+    c->loop = loop;
+}
+
+// Continue jumps land here (for loops whose continue target follows the body)
+static void patchContinues(Compiler* c, Loop* loop) {
+    for (int i = 0; i < loop->continueCount; i++) {
+        patchJump(c->chunk, loop->continueJumps[i]);
+    }
+    loop->continueCount = 0;
+}
+
+// Leave the loop; pending breaks land on the next instruction
+static void endLoop(Compiler* c, Loop* loop) {
+    for (int i = 0; i < loop->breakCount; i++) {
+        patchJump(c->chunk, loop->breakJumps[i]);
+    }
+    c->loop = loop->enclosing;
+}
+
+// A ?. link: skip to the end of the chain when R(reg) is nil
+static void emitChainJump(Compiler* c, bool optional, int reg, int line) {
+    if (!optional) return;
+    OptionalChain* chain = c->chain;
+    if (chain->nilCount >= CHAIN_JUMP_MAX) {
+        Token at = {TOKEN_EOF, NULL, 0, line, 0};
+        errorAt(c, at, "Too many '?.' links in one chain.");
+        return;
+    }
+    chain->nilJumps[chain->nilCount++] = emitJumpPlaceholder(c, OP_JMPNIL, reg, line);
+}
+
+// Leave the try blocks open above 'tryDepth', the innermost first: drop
+// their handlers, and close the resources of the with blocks among them
+static void leaveTries(Compiler* c, int tryDepth, int line) {
+    WithBlock* with = c->with;
+    for (int depth = c->tryDepth; depth > tryDepth; depth--) {
+        if (with && with->tryDepth == depth) {
+            emit(c, ENCODE_A(OP_ENDWITH, with->reg), line);
+            with = with->enclosing;
+        } else {
+            emit(c, ENCODE_A(OP_ENDTRY, 0), line);
+        }
+    }
+}
+
+// Before a return: close the resources of the with blocks it leaves. The
+// returning frame drops the handlers of plain try blocks outside them.
+static void closeWithBlocks(Compiler* c, int line) {
+    if (!c->with) return;
+    WithBlock* outermost = c->with;
+    while (outermost->enclosing) outermost = outermost->enclosing;
+    leaveTries(c, outermost->tryDepth - 1, line);
+}
+
+// break / continue: close body locals still open, then jump. A label
+// names the loop to leave or continue; the loops inside it end too.
+static void compileLoopJump(Compiler* c, Node* node, int line) {
+    bool isBreak = node->type == NODE_STMT_BREAK;
+    Token label = node->loopJump.label;
+    Loop* loop = c->loop;
+    while (loop && label.length > 0 &&
+           (loop->label.length != label.length || memcmp(loop->label.start, label.start, label.length) != 0)) {
+        loop = loop->enclosing;
+    }
+    if (!loop) {
+        if (label.length > 0) {
+            errorAt(c, label, "No enclosing loop is labeled '%.*s'.", label.length, label.start);
+        } else {
+            errorAt(c, node->loopJump.keyword, "Can't use '%s' outside of a loop.", isBreak ? "break" : "continue");
+        }
+        return;
+    }
+
+    // Closures created this iteration must not see the registers reused
+    if (c->localCount > loop->bodyLocal) {
+        emit(c, ENCODE_A(OP_CLOSE, loop->bodyReg), line);
+    }
+    // Leaving try blocks inside the loop drops their handlers
+    leaveTries(c, loop->tryDepth, line);
+
+    if (!isBreak && loop->continueTarget >= 0) {
+        int backOffset = c->chunk->codeSize - loop->continueTarget + 1;
+        emit(c, ENCODE_sBx(OP_LOOP, backOffset), line);
+        return;
+    }
+
+    int* jumps = isBreak ? loop->breakJumps : loop->continueJumps;
+    int* count = isBreak ? &loop->breakCount : &loop->continueCount;
+    if (*count >= LOOP_JUMP_MAX) {
+        errorAt(c, node->loopJump.keyword, "Too many '%s' statements in one loop.", isBreak ? "break" : "continue");
+        return;
+    }
+    jumps[(*count)++] = emitJumpPlaceholder(c, OP_JMP, 0, line);
+}
+
+static bool hasName(Token* names, int count, Token name) {
+    for (int i = 0; i < count; i++) {
+        if (names[i].length == name.length && memcmp(names[i].start, name.start, name.length) == 0) return true;
+    }
+    return false;
+}
+
+// Enum members, top-level consts and top-level functions are known before
+// any code is compiled
+static bool isEnumConstant(Compiler* c, Token name) {
+    while (c->enclosing) c = c->enclosing;
+    return hasName(c->enumNames, c->enumCount, name);
+}
+
+static bool isGlobalConst(Compiler* c, Token name) {
+    while (c->enclosing) c = c->enclosing;
+    return hasName(c->constNames, c->constCount, name);
+}
+
+// The declaration of the struct 'name' refers to here: a local struct of
+// this or an enclosing function, else a top-level one. NULL when the name
+// is some other variable or not declared in this script. A top-level name
+// declared more than once refers to the last declaration before this
+// point; *ambiguous is set when that can't be known, in a function, which
+// may run with any of them in place.
+static Node* findStruct(Compiler* c, Token name, bool* ambiguous) {
+    *ambiguous = false;
+    for (Compiler* fc = c; fc; fc = fc->enclosing) {
+        int local = findLocal(fc, name.start, name.length);
+        if (local != -1) return fc->locals[local].structDecl;
+    }
+    bool inFunction = c->enclosing != NULL;
+    while (c->enclosing) c = c->enclosing;
+    Node* found = NULL;
+    for (int i = 0; i < c->structCount; i++) {
+        Token other = c->structs[i]->structDecl.name;
+        if (other.length != name.length || memcmp(other.start, name.start, name.length) != 0) continue;
+        if (found && inFunction) *ambiguous = true;
+        if (found && i >= c->structsCompiled) break;
+        found = c->structs[i];
+    }
+    return found;
+}
+
+// The function node of a declaration in Compiler.functions or in a local's
+// functionDecl: the function itself, or a var's function expression
+static Node* declaredFunction(Node* decl) {
+    return decl->type == NODE_STMT_VAR_DECL ? decl->varDecl.initializer : decl;
+}
+
+// The declaration binding 'name' to a function: a local of this or an
+// enclosing function, else a top-level function or const (see
+// collectFunctions). NULL when the name is some other variable.
+static Node* findFunction(Compiler* c, Token name) {
+    for (Compiler* fc = c; fc; fc = fc->enclosing) {
+        int local = findLocal(fc, name.start, name.length);
+        if (local != -1) return fc->locals[local].functionDecl;
+    }
+    while (c->enclosing) c = c->enclosing;
+    for (int i = 0; i < c->functionCount; i++) {
+        Node* decl = c->functions[i];
+        Token other = decl->type == NODE_STMT_VAR_DECL ? decl->varDecl.name : decl->function.name;
+        if (other.length == name.length && memcmp(other.start, name.start, name.length) == 0) return decl;
+    }
+    return NULL;
+}
+
+// A write to 'name' other than its own declaration: the function it was
+// bound to can no longer be assumed at its calls
+static void noteRebinding(Compiler* c, Token name) {
+    Node* decl = findFunction(c, name);
+    if (!decl || decl == c->node) return;
+    while (c->enclosing) c = c->enclosing;
+    c->rebound = realloc(c->rebound, (c->reboundCount + 1) * sizeof(Node*));
+    c->rebound[c->reboundCount++] = decl;
+}
+
+// Why 'call' can't bind to the parameters of the function 'fn', in 'buf';
+// false when it can
+static bool callProblem(Node* fn, Node* call, char* buf, size_t size) {
+    int required = fn->function.requiredCount, params = fn->function.paramCount;
+    bool variadic = fn->function.isVariadic;
+    int argCount = call->call.argumentCount;
+    if (call->call.namedCount == 0) {
+        if (argCount >= required && (variadic || argCount <= params)) return false;
+        char expected[48];
+        int last = variadic ? required : params; // The count 'argument' agrees with
+        if (variadic) {
+            snprintf(expected, sizeof(expected), "at least %d", required);
+        } else if (required == params) {
+            snprintf(expected, sizeof(expected), "%d", params);
+        } else {
+            snprintf(expected, sizeof(expected), "%d to %d", required, params);
+        }
+        snprintf(buf, size, "expects %s argument%s but got %d", expected, last == 1 ? "" : "s", argCount);
+        return true;
+    }
+
+    // The leading positional arguments, then one parameter per name
+    int positional = argCount - call->call.namedCount;
+    int fixed = variadic ? params - 1 : params;
+    for (int i = 0; i < call->call.namedCount; i++) {
+        Token name = call->call.names[i];
+        int param = -1;
+        for (int j = 0; j < params && param == -1; j++) {
+            if (hasName(&fn->function.params[j], 1, name)) param = j;
+        }
+        if (param == -1) {
+            snprintf(buf, size, "has no parameter named '%.*s'", name.length, name.start);
+        } else if (param >= fixed) {
+            snprintf(buf, size, "can't take the rest parameter '%.*s' by name", name.length, name.start);
+        } else if (param < positional) {
+            snprintf(buf, size, "is given '%.*s' twice", name.length, name.start);
+        } else {
+            continue;
+        }
+        return true;
+    }
+    for (int j = positional; j < required; j++) {
+        Token param = fn->function.params[j];
+        if (!hasName(call->call.names, call->call.namedCount, param)) {
+            snprintf(buf, size, "is missing argument '%.*s'", param.length, param.start);
+            return true;
+        }
+    }
+    return false;
+}
+
+// A call f(args) with no spread argument, where f names a function
+// declaration: arguments that don't fit its parameters are recorded
+static void checkCall(Compiler* c, Node* call) {
+    Node* callee = call->call.callee;
+    if (callee->type != NODE_EXPR_VAR) return;
+    Node* decl = findFunction(c, callee->var.name);
+    if (!decl) return;
+    MismatchedCall mismatch = {decl, callee->var.name, ""};
+    if (!callProblem(declaredFunction(decl), call, mismatch.problem, sizeof(mismatch.problem))) return;
+    while (c->enclosing) c = c->enclosing;
+    c->mismatchedCalls = realloc(c->mismatchedCalls, (c->mismatchedCallCount + 1) * sizeof(MismatchedCall));
+    c->mismatchedCalls[c->mismatchedCallCount++] = mismatch;
+}
+
+// Report the recorded calls whose function's variable is never assigned,
+// so the call always reaches that function
+static void reportMismatchedCalls(Compiler* c) {
+    for (int i = 0; i < c->mismatchedCallCount; i++) {
+        MismatchedCall* call = &c->mismatchedCalls[i];
+        bool rebound = false;
+        for (int j = 0; j < c->reboundCount && !rebound; j++) rebound = c->rebound[j] == call->decl;
+        if (rebound) continue;
+        errorAt(c, call->name, "'%.*s' %s.", call->name.length, call->name.start, call->problem);
+    }
+}
+
+// Whether the top-level statement 'node' declares a global named 'name'
+static bool declaresGlobal(Node* node, Token name) {
+    static Token none = {TOKEN_EOF, "", 0, 0, 0};
+    Token declared = none;
+    switch (node->type) {
+        case NODE_STMT_FUNCTION:    declared = node->function.name; break;
+        case NODE_STMT_VAR_DECL:    declared = node->varDecl.name; break;
+        case NODE_STMT_STRUCT_DECL: declared = node->structDecl.name; break;
+        case NODE_STMT_IMPORT:      declared = node->importStmt.alias; break;
+        case NODE_STMT_ENUM_DECL:
+            return hasName(node->enumDecl.names, node->enumDecl.count, name);
+        case NODE_STMT_MULTI_ASSIGN:
+            if (!node->multiAssign.isDecl) return false;
+            for (Node* t = node->multiAssign.targets; t; t = t->next) {
+                if (hasName(&t->var.name, 1, name)) return true;
+            }
+            return false;
+        default:
+            return false;
+    }
+    return hasName(&declared, 1, name);
+}
+
+// Record every top-level function declaration, and every top-level const
+// holding a function expression, that is the only top-level declaration of
+// its name; calls to it get their argument counts checked. Both are
+// defined with OP_DEFCONST, so eval() can't rebind them after this script
+// is compiled; other globals are left to the runtime check.
+static void collectFunctions(Compiler* c, Node* ast) {
+    if (ast->type != NODE_STMT_BLOCK) return;
+    for (int i = 0; i < ast->block.count; i++) {
+        Node* node = ast->block.statements[i];
+        Token name;
+        if (node->type == NODE_STMT_FUNCTION) {
+            name = node->function.name;
+        } else if (node->type == NODE_STMT_VAR_DECL && node->varDecl.isConst && node->varDecl.initializer &&
+                   node->varDecl.initializer->type == NODE_EXPR_FUNCTION) {
+            name = node->varDecl.name;
+        } else {
+            continue;
+        }
+        int declarations = 0;
+        for (int j = 0; j < ast->block.count && declarations < 2; j++) {
+            if (declaresGlobal(ast->block.statements[j], name)) declarations++;
+        }
+        if (declarations != 1) continue;
+        c->functions = realloc(c->functions, (c->functionCount + 1) * sizeof(Node*));
+        c->functions[c->functionCount++] = node;
+    }
+}
+
+// A write to 'name': rejected when the variable it resolves to (a local of
+// this or an enclosing function, else a global) was declared const, or
+// when it names an enum member
+static void checkConstWrite(Compiler* c, Token name) {
+    noteRebinding(c, name);
+    for (Compiler* fc = c; fc; fc = fc->enclosing) {
+        int local = findLocal(fc, name.start, name.length);
+        if (local == -1) continue;
+        if (!fc->locals[local].isConst) return;
+        errorAt(c, name, "Cannot assign to constant '%.*s'.", name.length, name.start);
+        return;
+    }
+    if (isEnumConstant(c, name)) {
+        errorAt(c, name, "Cannot assign to enum constant '%.*s'.", name.length, name.start);
+    } else if (isGlobalConst(c, name)) {
+        errorAt(c, name, "Cannot assign to constant '%.*s'.", name.length, name.start);
+    }
+}
+
+// Record the members of every top-level enum and every top-level const or
+// function declaration, so that writes anywhere in the script (including
+// functions declared earlier) can be rejected, and every top-level struct,
+// so that struct literals anywhere can be checked against its fields
+static void collectConstants(Compiler* c, Node* ast) {
+    int count = ast->type == NODE_STMT_BLOCK ? ast->block.count : 1;
+    for (int i = 0; i < count; i++) {
+        Node* node = ast->type == NODE_STMT_BLOCK ? ast->block.statements[i] : ast;
+        if (node->type == NODE_STMT_STRUCT_DECL) {
+            c->structs = realloc(c->structs, (c->structCount + 1) * sizeof(Node*));
+            c->structs[c->structCount++] = node;
+            continue;
+        }
+        if ((node->type == NODE_STMT_VAR_DECL && node->varDecl.isConst) || node->type == NODE_STMT_FUNCTION) {
+            Token name = node->type == NODE_STMT_FUNCTION ? node->function.name : node->varDecl.name;
+            if (isEnumConstant(c, name) || isGlobalConst(c, name)) {
+                errorAt(c, name, "Constant '%.*s' is already declared.", name.length, name.start);
+                continue;
+            }
+            c->constNames = realloc(c->constNames, (c->constCount + 1) * sizeof(Token));
+            c->constNames[c->constCount++] = name;
+            continue;
+        }
+        if (node->type != NODE_STMT_ENUM_DECL) continue;
+        for (int j = 0; j < node->enumDecl.count; j++) {
+            Token name = node->enumDecl.names[j];
+            if (isEnumConstant(c, name) || isGlobalConst(c, name)) {
+                errorAt(c, name, "Enum constant '%.*s' is already declared.", name.length, name.start);
+                continue;
+            }
+            c->enumNames = realloc(c->enumNames, (c->enumCount + 1) * sizeof(Token));
+            c->enumNames[c->enumCount++] = name;
+        }
+    }
+}
+
 // Add constant and return its index
 static int emitConstant(Compiler* c, Value value) {
     return addConstant(c->chunk, value);
@@ -147,15 +677,52 @@ static int emitConstant(Compiler* c, Value value) {
 // Intern a name token and add to constant pool
 static int internNameConst(Compiler* c, Token name) {
     char* str = strndup(name.start, name.length);
-    ObjString* obj = internString(c->vm, str, name.length);
+    ObjString* obj = internConstant(c->vm, str, name.length);
     free(str);
     return addConstant(c->chunk, OBJ_VAL(obj));
 }
 
+// R(dest) = R(obj).K(ki). GETPROP holds 8 bits of constant index, so a
+// name further into the pool goes through a register and GETPROPR
+static void emitGetProp(Compiler* c, int dest, int obj, int ki, int line) {
+    if (ki <= UINT8_MAX) {
+        emit(c, ENCODE_ABC(OP_GETPROP, dest, obj, ki), line);
+        return;
+    }
+    int reg = allocReg(c);
+    emit(c, ENCODE_ABx(OP_LOADK, reg, ki), line);
+    emit(c, ENCODE_ABC(OP_GETPROPR, dest, obj, reg), line);
+    freeRegsTo(c, reg);
+}
+
+// R(obj).K(ki) = R(src), through SETPROPR as emitGetProp does
+static void emitSetProp(Compiler* c, int obj, int ki, int src, int line) {
+    if (ki <= UINT8_MAX) {
+        emit(c, ENCODE_ABC(OP_SETPROP, obj, ki, src), line);
+        return;
+    }
+    int reg = allocReg(c);
+    emit(c, ENCODE_ABx(OP_LOADK, reg, ki), line);
+    emit(c, ENCODE_ABC(OP_SETPROPR, obj, reg, src), line);
+    freeRegsTo(c, reg);
+}
+
 // Forward declarations
 static void compileNode(Compiler* c, Node* node);
 static void compileExpr(Compiler* c, Node* node, int dest);
 static void compileStmt(Compiler* c, Node* node);
+static void compileFunction(Compiler* c, Node* node, int reg, int line);
+
+// A for-loop init or increment clause; assignments parse as statements
+static void compileForClause(Compiler* c, Node* clause) {
+    if (!isExpressionNode(clause) || clause->type == NODE_EXPR_UPDATE) {
+        compileStmt(c, clause);
+    } else {
+        int tmp = allocReg(c);
+        compileExpr(c, clause, tmp);
+        freeRegsTo(c, tmp);
+    }
+}
 
 // Helper to get register without forcing a MOVE if it's a local variable.
 static int getOperandReg(Compiler* c, Node* node, bool* isTemp) {
@@ -174,34 +741,596 @@ static int getOperandReg(Compiler* c, Node* node, bool* isTemp) {
     return reg;
 }
 
+// ===== Constant Folding =====
+// An operator whose operands are all literals is evaluated here and loaded
+// as one constant. The rules are the opcode handlers' own: int results that
+// leave the payload become doubles and '+' with a string joins the operand
+// text. Anything that throws at run time (division by zero, '-' on a
+// string) is left for the VM, as is any variable, which might hold a string.
+
+// R(dest) = v with the shortest load: LOADI for small ints, LOADK otherwise
+static void emitLoadValue(Compiler* c, Value v, int dest, int line) {
+    if (IS_NIL(v)) {
+        emit(c, ENCODE_A(OP_LOADNIL, dest), line);
+    } else if (IS_BOOL(v)) {
+        emit(c, ENCODE_A(AS_BOOL(v) ? OP_LOADTRUE : OP_LOADFALSE, dest), line);
+    } else if (IS_INT(v) && AS_INT(v) >= -32767 && AS_INT(v) <= 32767) {
+        emit(c, ENCODE_ABx(OP_LOADI, dest, (uint16_t)(AS_INT(v) + 0x7FFF)), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_LOADK, dest, emitConstant(c, v)), line);
+    }
+}
+
+static bool constTruthy(Value v) {
+    return !IS_NIL(v) && !(IS_BOOL(v) && !AS_BOOL(v));
+}
+
+// OP_EQ on two constants
+static bool constEqual(Value a, Value b) {
+    if (IS_INT(a) && IS_INT(b)) return AS_INT(a) == AS_INT(b);
+    if (IS_NUMERIC(a) && IS_NUMERIC(b)) return AS_NUMERIC(a) == AS_NUMERIC(b);
+    if (IS_BOOL(a) && IS_BOOL(b)) return AS_BOOL(a) == AS_BOOL(b);
+    if (IS_NIL(a) && IS_NIL(b)) return true;
+    if (IS_OBJ(a) && IS_OBJ(b)) return AS_OBJ(a) == AS_OBJ(b); // Interned strings
+    return false;
+}
+
+// a op b for the arithmetic, bitwise and comparison operators; false to leave it
+// for the VM, which also reports integer overflow at run time
+static bool foldOperator(Compiler* c, TokenType op, Value a, Value b, Value* out) {
+    bool ints = IS_INT(a) && IS_INT(b);
+    bool nums = IS_NUMERIC(a) && IS_NUMERIC(b);
+    int64_t r;
+    switch (op) {
+        case TOKEN_PLUS:
+            if (ints) {
+                if (!intAdd(AS_INT(a), AS_INT(b), &r)) return false;
+                *out = intValue(c->vm, r);
+                return true;
+            }
+            if (nums) { *out = FLOAT_VAL(AS_NUMERIC(a) + AS_NUMERIC(b)); return true; }
+            if (IS_STRING(a) || IS_STRING(b)) {
+                char bufA[64], bufB[64];
+                const char* sA = valueToChars(a, bufA, sizeof(bufA));
+                const char* sB = valueToChars(b, bufB, sizeof(bufB));
+                size_t lenA = strlen(sA), lenB = strlen(sB);
+                char* joined = malloc(lenA + lenB + 1);
+                memcpy(joined, sA, lenA);
+                memcpy(joined + lenA, sB, lenB);
+                joined[lenA + lenB] = '\0';
+                *out = OBJ_VAL(internConstant(c->vm, joined, (int)(lenA + lenB)));
+                free(joined);
+                return true;
+            }
+            return false;
+        case TOKEN_MINUS:
+            if (ints) {
+                if (!intSub(AS_INT(a), AS_INT(b), &r)) return false;
+                *out = intValue(c->vm, r);
+                return true;
+            }
+            if (nums) { *out = FLOAT_VAL(AS_NUMERIC(a) - AS_NUMERIC(b)); return true; }
+            return false;
+        case TOKEN_STAR:
+            if (ints) {
+                if (!intMul(AS_INT(a), AS_INT(b), &r)) return false;
+                *out = intValue(c->vm, r);
+                return true;
+            }
+            if (nums) { *out = FLOAT_VAL(AS_NUMERIC(a) * AS_NUMERIC(b)); return true; }
+            return false;
+        case TOKEN_SLASH:
+            if (!nums || (ints && AS_INT(b) == 0)) return false;
+            *out = FLOAT_VAL(AS_NUMERIC(a) / AS_NUMERIC(b));
+            return true;
+        case TOKEN_TILDE_SLASH:
+            if (ints) {
+                if (AS_INT(b) == 0 || (AS_INT(b) == -1 && AS_INT(a) == INT64_MIN)) return false;
+                *out = intValue(c->vm, intFloorDiv(AS_INT(a), AS_INT(b)));
+                return true;
+            }
+            if (nums) { *out = FLOAT_VAL(floor(AS_NUMERIC(a) / AS_NUMERIC(b))); return true; }
+            return false;
+        case TOKEN_PERCENT:
+            if (ints) {
+                if (AS_INT(b) == 0) return false;
+                *out = intValue(c->vm, AS_INT(b) == -1 ? 0 : AS_INT(a) % AS_INT(b));
+                return true;
+            }
+            if (nums) { *out = FLOAT_VAL(fmod(AS_NUMERIC(a), AS_NUMERIC(b))); return true; }
+            return false;
+        // The type errors (and negative shift counts) are left to run time
+        case TOKEN_AMPERSAND:
+        case TOKEN_PIPE:
+        case TOKEN_CARET:
+            if (!ints) return false;
+            *out = intValue(c->vm, op == TOKEN_AMPERSAND ? AS_INT(a) & AS_INT(b)
+                                 : op == TOKEN_PIPE ? AS_INT(a) | AS_INT(b) : AS_INT(a) ^ AS_INT(b));
+            return true;
+        case TOKEN_LESS_LESS:
+        case TOKEN_GREATER_GREATER:
+            if (!ints || AS_INT(b) < 0) return false;
+            *out = intValue(c->vm, op == TOKEN_LESS_LESS ? intShiftLeft(AS_INT(a), AS_INT(b))
+                                                         : intShiftRight(AS_INT(a), AS_INT(b)));
+            return true;
+        case TOKEN_LESS:
+        case TOKEN_LESS_EQUAL:
+        case TOKEN_GREATER:
+        case TOKEN_GREATER_EQUAL: {
+            if (!nums) return false;
+            int cmp;
+            if (ints) cmp = (AS_INT(a) > AS_INT(b)) - (AS_INT(a) < AS_INT(b));
+            else {
+                double x = AS_NUMERIC(a), y = AS_NUMERIC(b);
+                if (x != x || y != y) return false; // NaN compares false every way
+                cmp = (x > y) - (x < y);
+            }
+            bool r = op == TOKEN_LESS ? cmp < 0 : op == TOKEN_LESS_EQUAL ? cmp <= 0
+                   : op == TOKEN_GREATER ? cmp > 0 : cmp >= 0;
+            *out = BOOL_VAL(r);
+            return true;
+        }
+        case TOKEN_EQUAL_EQUAL: *out = BOOL_VAL(constEqual(a, b)); return true;
+        case TOKEN_BANG_EQUAL:  *out = BOOL_VAL(!constEqual(a, b)); return true;
+        default: return false;
+    }
+}
+
+// The value of a literal-only expression, if it has one at compile time
+static bool foldConstant(Compiler* c, Node* node, Value* out) {
+    switch (node->type) {
+        case NODE_EXPR_LITERAL: {
+            Token tok = node->literal.token;
+            switch (tok.type) {
+                case TOKEN_NUMBER: *out = numberLiteral(c->vm, tok); return true;
+                case TOKEN_TRUE:   *out = BOOL_VAL(true); return true;
+                case TOKEN_FALSE:  *out = BOOL_VAL(false); return true;
+                case TOKEN_NIL:    *out = NIL_VAL; return true;
+                case TOKEN_STRING: {
+                    char* str = stringLiteralText(tok);
+                    *out = OBJ_VAL(internConstant(c->vm, str, strlen(str)));
+                    free(str);
+                    return true;
+                }
+                default: return false;
+            }
+        }
+        case NODE_EXPR_UNARY: {
+            Value v;
+            if (!foldConstant(c, node->unary.expr, &v)) return false;
+            if (node->unary.op.type == TOKEN_BANG) {
+                *out = BOOL_VAL(!constTruthy(v));
+                return true;
+            }
+            if (node->unary.op.type == TOKEN_TILDE) {
+                if (!IS_INT(v)) return false;
+                *out = intValue(c->vm, ~AS_INT(v));
+                return true;
+            }
+            if (node->unary.op.type != TOKEN_MINUS) return false;
+            if (IS_INT(v)) {
+                if (AS_INT(v) == INT64_MIN) return false;
+                *out = intValue(c->vm, -AS_INT(v));
+            } else if (IS_FLOAT(v)) *out = FLOAT_VAL(-AS_FLOAT(v));
+            else return false;
+            return true;
+        }
+        case NODE_EXPR_BINARY: {
+            TokenType op = node->binary.op.type;
+            Value a, b;
+            if (node->binary.chained) return false;
+            if (!foldConstant(c, node->binary.left, &a)) return false;
+            if (op == TOKEN_AND || op == TOKEN_OR) {
+                // A left operand that decides is the result
+                if ((op == TOKEN_AND) != constTruthy(a)) { *out = a; return true; }
+                return foldConstant(c, node->binary.right, out);
+            }
+            if (op == TOKEN_QUESTION_QUESTION) {
+                if (!IS_NIL(a)) { *out = a; return true; }
+                return foldConstant(c, node->binary.right, out);
+            }
+            // A folded string stays rooted while the right side allocates
+            c->vm->stack[c->vm->stackTop++] = a;
+            bool folded = foldConstant(c, node->binary.right, &b) && foldOperator(c, op, a, b, out);
+            c->vm->stackTop--;
+            return folded;
+        }
+        default:
+            return false;
+    }
+}
+
+// Arithmetic opcode behind a compound assignment (+= -> OP_ADD), or -1 for '='
+static int compoundOpcode(TokenType type) {
+    switch (type) {
+        case TOKEN_PLUS_EQUAL:    return OP_ADD;
+        case TOKEN_MINUS_EQUAL:   return OP_SUB;
+        case TOKEN_STAR_EQUAL:    return OP_MUL;
+        case TOKEN_SLASH_EQUAL:   return OP_DIV;
+        case TOKEN_TILDE_SLASH_EQUAL: return OP_IDIV;
+        case TOKEN_PERCENT_EQUAL: return OP_MOD;
+        default:                  return -1;
+    }
+}
+
+// name op= value, compiled as name = name op value. When dest is not -1 it
+// also receives the new value.
+static void compileCompoundAssign(Compiler* c, Node* node, int opcode, int dest, int line) {
+    Token name = node->assign.name;
+    checkConstWrite(c, name);
+    bool tempC;
+    int local = resolveLocal(c, name.start, name.length);
+    if (local != -1) {
+        int regC = getOperandReg(c, node->assign.value, &tempC);
+        emit(c, ENCODE_ABC(opcode, local, local, regC), line);
+        if (tempC) freeRegsTo(c, regC);
+        if (dest != -1 && dest != local) {
+            emit(c, ENCODE_ABC(OP_MOVE, dest, local, 0), line);
+        }
+        return;
+    }
+
+    int reg = dest != -1 ? dest : allocReg(c);
+    int upvalue = resolveUpvalue(c, name.start, name.length);
+    int ki = upvalue == -1 ? internNameConst(c, name) : -1;
+    if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_GETUPVAL, reg, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_GETGLOBAL, reg, ki), line);
+    }
+    int regC = getOperandReg(c, node->assign.value, &tempC);
+    emit(c, ENCODE_ABC(opcode, reg, reg, regC), line);
+    if (tempC) freeRegsTo(c, regC);
+    if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_SETUPVAL, reg, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_SETGLOBAL, reg, ki), line);
+    }
+    if (dest == -1) freeRegsTo(c, reg);
+}
+
+// name ??= value: the value is evaluated and stored only while name is nil.
+// When dest is not -1 it also receives the variable's value afterwards.
+static void compileNilAssign(Compiler* c, Node* node, int dest, int line) {
+    Token name = node->assign.name;
+    checkConstWrite(c, name);
+    int local = resolveLocal(c, name.start, name.length);
+    if (local != -1) {
+        int skip = emitJumpPlaceholder(c, OP_JMPNOTNIL, local, line);
+        compileExpr(c, node->assign.value, local);
+        patchJump(c->chunk, skip);
+        if (dest != -1 && dest != local) {
+            emit(c, ENCODE_ABC(OP_MOVE, dest, local, 0), line);
+        }
+        return;
+    }
+
+    int reg = dest != -1 ? dest : allocReg(c);
+    int upvalue = resolveUpvalue(c, name.start, name.length);
+    int ki = upvalue == -1 ? internNameConst(c, name) : -1;
+    if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_GETUPVAL, reg, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_GETGLOBAL, reg, ki), line);
+    }
+    int skip = emitJumpPlaceholder(c, OP_JMPNOTNIL, reg, line);
+    compileExpr(c, node->assign.value, reg);
+    if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_SETUPVAL, reg, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_SETGLOBAL, reg, ki), line);
+    }
+    patchJump(c->chunk, skip);
+    if (dest == -1) freeRegsTo(c, reg);
+}
+
+// ++target or target-- (NODE_EXPR_UPDATE): the target's object and index
+// are evaluated once. When dest is not -1 it receives the new value for a
+// prefix and the old one for a postfix.
+static void compileUpdate(Compiler* c, Node* node, int dest, int line) {
+    int opcode = node->update.op.type == TOKEN_PLUS_PLUS ? OP_INC : OP_DEC;
+    bool keepOld = dest != -1 && !node->update.prefix;
+    Node* target = node->update.target;
+    int mark = c->nextReg;
+
+    if (target->type == NODE_EXPR_VAR) {
+        Token name = target->var.name;
+        checkConstWrite(c, name);
+        int local = resolveLocal(c, name.start, name.length);
+        if (local != -1) {
+            if (keepOld && dest == local) {
+                // x = x++ stores the old value back; only the type check is left
+                int tmp = allocReg(c);
+                emit(c, ENCODE_ABC(opcode, tmp, local, 0), line);
+            } else {
+                if (keepOld) emit(c, ENCODE_ABC(OP_MOVE, dest, local, 0), line);
+                emit(c, ENCODE_ABC(opcode, local, local, 0), line);
+                if (dest != -1 && !keepOld && dest != local) {
+                    emit(c, ENCODE_ABC(OP_MOVE, dest, local, 0), line);
+                }
+            }
+            freeRegsTo(c, mark);
+            return;
+        }
+    }
+
+    // The current value goes to R(cur), the stepped one to R(result)
+    int regObj = -1, regIdx = -1, upvalue = -1, ki = -1;
+    if (target->type == NODE_EXPR_VAR) {
+        Token name = target->var.name;
+        upvalue = resolveUpvalue(c, name.start, name.length);
+        if (upvalue == -1) ki = internNameConst(c, name);
+    } else if (target->type == NODE_EXPR_INDEX) {
+        regObj = allocReg(c);
+        regIdx = allocReg(c);
+        compileExpr(c, target->index.target, regObj);
+        compileExpr(c, target->index.index, regIdx);
+    } else {
+        regObj = allocReg(c);
+        compileExpr(c, target->get.object, regObj);
+        ki = internNameConst(c, target->get.name);
+    }
+    int cur = dest != -1 ? dest : allocReg(c);
+    if (target->type == NODE_EXPR_INDEX) {
+        emit(c, ENCODE_ABC(OP_GETIDX, cur, regObj, regIdx), line);
+    } else if (target->type == NODE_EXPR_GET) {
+        emitGetProp(c, cur, regObj, ki, line);
+    } else if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_GETUPVAL, cur, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_GETGLOBAL, cur, ki), line);
+    }
+    int result = keepOld ? allocReg(c) : cur;
+    emit(c, ENCODE_ABC(opcode, result, cur, 0), line);
+    if (target->type == NODE_EXPR_INDEX) {
+        emit(c, ENCODE_ABC(OP_SETIDX, regObj, regIdx, result), line);
+    } else if (target->type == NODE_EXPR_GET) {
+        emitSetProp(c, regObj, ki, result, line);
+    } else if (upvalue != -1) {
+        emit(c, ENCODE_ABC(OP_SETUPVAL, result, upvalue, 0), line);
+    } else {
+        emit(c, ENCODE_ABx(OP_SETGLOBAL, result, ki), line);
+    }
+    freeRegsTo(c, mark);
+}
+
+// Names compiled to dedicated opcodes instead of OP_CALL (see NODE_EXPR_CALL);
+// map(arr, fn) is the native, only map() is a new map
+static bool isInlinedBuiltin(Node* call) {
+    static const char* names[] = { "push", "pop", "length", "len", "array", "map" };
+    Node* callee = call->call.callee;
+    if (callee->type != NODE_EXPR_VAR || call->call.namedCount > 0) return false;
+    Token name = callee->var.name;
+    if (name.length == 3 && memcmp(name.start, "map", 3) == 0 && call->call.arguments) return false;
+    for (size_t i = 0; i < sizeof(names) / sizeof(names[0]); i++) {
+        if (strlen(names[i]) == (size_t)name.length && memcmp(names[i], name.start, name.length) == 0) {
+            return true;
+        }
+    }
+    return false;
+}
+
+static bool hasSpreadArgument(Node* call) {
+    for (Node* arg = call->call.arguments; arg; arg = arg->next) {
+        if (arg->type == NODE_EXPR_SPREAD) return true;
+    }
+    return false;
+}
+
+// Regular function call; 'count' results land in R(dest)..R(dest+count-1).
+// 'op' is OP_CALL, OP_TAILCALL for a call in tail position, or OP_SPAWN
+// or OP_DEFER with no results.
+static void emitCallOp(Compiler* c, OpCode op, Node* node, int dest, int count, int line) {
+    // Layout: funcReg, arg0, arg1, ..., argN (contiguous)
+    int funcReg = allocReg(c);
+    compileExpr(c, node->call.callee, funcReg);
+
+    if (hasSpreadArgument(node)) {
+        // The argument count is only known at run time: collect the
+        // arguments into an array in R(funcReg+1) and let OP_CALLSPREAD
+        // lay them out. Never a tail call; the RETURN after it still runs.
+        int argsReg = allocReg(c);
+        emit(c, ENCODE_ABx(OP_NEWARRAY, argsReg, 0), line);
+        for (Node* arg = node->call.arguments; arg; arg = arg->next) {
+            int argReg = allocReg(c);
+            if (arg->type == NODE_EXPR_SPREAD) {
+                compileExpr(c, arg->unary.expr, argReg);
+                emit(c, ENCODE_ABC(OP_SPREAD, argsReg, argReg, 0), line);
+            } else {
+                compileExpr(c, arg, argReg);
+                emit(c, ENCODE_ABC(OP_PUSH, argsReg, argReg, 0), line);
+            }
+            freeRegsTo(c, argReg);
+        }
+        if (op == OP_SPAWN || op == OP_DEFER) {
+            emit(c, ENCODE_ABC(op, funcReg, 1, 1), line);
+        } else {
+            op = OP_CALLSPREAD;
+            while (c->nextReg < funcReg + count) allocReg(c);
+            emit(c, ENCODE_ABC(op, funcReg, argsReg, count), line);
+        }
+    } else if (node->call.namedCount > 0) {
+        // The parameters the names stand for are only known once the
+        // callee is: the positional arguments, then the named ones as
+        // written, then the names for OP_CALLNAMED to lay them out
+        checkCall(c, node);
+        for (Node* arg = node->call.arguments; arg; arg = arg->next) {
+            compileExpr(c, arg, allocReg(c));
+        }
+        int length = 0;
+        for (int i = 0; i < node->call.namedCount; i++) length += node->call.names[i].length + 1;
+        char* names = malloc(length);
+        length = 0;
+        for (int i = 0; i < node->call.namedCount; i++) {
+            Token name = node->call.names[i];
+            if (i > 0) names[length++] = ' ';
+            memcpy(names + length, name.start, name.length);
+            length += name.length;
+        }
+        int namesReg = allocReg(c);
+        int ki = emitConstant(c, OBJ_VAL(internConstant(c->vm, names, length)));
+        free(names);
+        emit(c, ENCODE_ABx(OP_LOADK, namesReg, ki), line);
+        while (c->nextReg < funcReg + count) allocReg(c);
+        emit(c, ENCODE_ABC(OP_CALLNAMED, funcReg, node->call.argumentCount, count), line);
+    } else {
+        checkCall(c, node);
+        int argCount = 0;
+        Node* arg = node->call.arguments;
+        while (arg) {
+            int argReg = allocReg(c);
+            compileExpr(c, arg, argReg);
+            argCount++;
+            arg = arg->next;
+        }
+
+        // Results are written from funcReg upward; keep those registers reserved
+        while (c->nextReg < funcReg + count) allocReg(c);
+
+        // OP_CALL A=funcReg B=argCount C=resultCount
+        // Results go into funcReg.., then MOVE to dest..
+        emit(c, ENCODE_ABC(op, funcReg, argCount, count), line);
+    }
+    if (funcReg != dest) {
+        for (int i = 0; i < count; i++) {
+            emit(c, ENCODE_ABC(OP_MOVE, dest + i, funcReg + i, 0), line);
+        }
+    }
+    freeRegsTo(c, funcReg);
+}
+
+static void emitCall(Compiler* c, Node* node, int dest, int count, int line) {
+    emitCallOp(c, OP_CALL, node, dest, count, line);
+}
+
+// 'return f(...)' inside a function, outside any try block: the frame can
+// be handed to f. Not for 'return f(), g()', inlined builtins or named
+// arguments.
+static bool isTailCall(Compiler* c, Node* returnStmt) {
+    Node* value = returnStmt->returnStmt.value;
+    return c->enclosing && c->tryDepth == 0 &&
+           returnStmt->returnStmt.count == 1 &&
+           value->type == NODE_EXPR_CALL && !isInlinedBuiltin(value) &&
+           value->call.namedCount == 0;
+}
+
+// Compile 'node' into 'count' consecutive registers starting at 'dest'.
+// Only a regular call can produce more than one value; anything else
+// fills the first register and pads the rest with nil.
+static void compileExprMulti(Compiler* c, Node* node, int dest, int count, int line) {
+    if (node->type == NODE_EXPR_CALL && !isInlinedBuiltin(node)) {
+        emitCall(c, node, dest, count, line);
+        return;
+    }
+    compileExpr(c, node, dest);
+    for (int i = 1; i < count; i++) {
+        emit(c, ENCODE_A(OP_LOADNIL, dest + i), line);
+    }
+}
+
+// Store R(src) into an assignment target (variable, index or property)
+static void assignTarget(Compiler* c, Node* target, int src, int line) {
+    switch (target->type) {
+        case NODE_EXPR_VAR: {
+            Token name = target->var.name;
+            if (name.length == 1 && name.start[0] == '_') return; // Placeholder
+            checkConstWrite(c, name);
+            int local = resolveLocal(c, name.start, name.length);
+            if (local != -1) {
+                if (local != src) emit(c, ENCODE_ABC(OP_MOVE, local, src, 0), line);
+                return;
+            }
+            int upvalue = resolveUpvalue(c, name.start, name.length);
+            if (upvalue != -1) {
+                emit(c, ENCODE_ABC(OP_SETUPVAL, src, upvalue, 0), line);
+            } else {
+                int ki = internNameConst(c, name);
+                emit(c, ENCODE_ABx(OP_SETGLOBAL, src, ki), line);
+            }
+            break;
+        }
+        case NODE_EXPR_INDEX: {
+            int regObj = allocReg(c);
+            int regIdx = allocReg(c);
+            compileExpr(c, target->index.target, regObj);
+            compileExpr(c, target->index.index, regIdx);
+            emit(c, ENCODE_ABC(OP_SETIDX, regObj, regIdx, src), line);
+            freeRegsTo(c, regObj);
+            break;
+        }
+        case NODE_EXPR_GET: {
+            int regObj = allocReg(c);
+            compileExpr(c, target->get.object, regObj);
+            int ki = internNameConst(c, target->get.name);
+            emitSetProp(c, regObj, ki, src, line);
+            freeRegsTo(c, regObj);
+            break;
+        }
+        default:
+            break;
+    }
+}
+
+static uint8_t comparisonOpcode(TokenType op) {
+    switch (op) {
+        case TOKEN_LESS:       return OP_LT;
+        case TOKEN_LESS_EQUAL: return OP_LE;
+        case TOKEN_GREATER:    return OP_GT;
+        default:               return OP_GE;
+    }
+}
+
+// a < b < c: R(dest) = (a < b) and (b < c), with each operand evaluated
+// once. regL and regR hold the two sides of the link being compared; a
+// false link jumps to the end with false already in the result.
+static void compileComparisonChain(Compiler* c, Node* node, int dest, int line) {
+    int count = 1;
+    for (Node* n = node; n->binary.chained; n = n->binary.left) count++;
+    Node** links = malloc(sizeof(Node*) * count);
+    int* exits = malloc(sizeof(int) * count);
+    Node* n = node;
+    for (int i = count - 1; i >= 0; i--, n = n->binary.left) links[i] = n;
+
+    int regT = allocReg(c);
+    int regL = allocReg(c);
+    int regR = allocReg(c);
+    compileExpr(c, links[0]->binary.left, regL);
+    for (int i = 0; i < count; i++) {
+        compileExpr(c, links[i]->binary.right, regR);
+        emit(c, ENCODE_ABC(comparisonOpcode(links[i]->binary.op.type), regT, regL, regR), links[i]->binary.op.line);
+        if (i < count - 1) {
+            exits[i] = emitJumpPlaceholder(c, OP_JMPF, regT, line);
+            emit(c, ENCODE_ABC(OP_MOVE, regL, regR, 0), line);
+        }
+    }
+    for (int i = 0; i < count - 1; i++) patchJump(c->chunk, exits[i]);
+    emit(c, ENCODE_ABC(OP_MOVE, dest, regT, 0), line);
+    freeRegsTo(c, regT);
+    free(links);
+    free(exits);
+}
+
 /**
  * Compile expression, result goes into register 'dest'
  */
+static void compileExprNode(Compiler* c, Node* node, int dest);
+
 static void compileExpr(Compiler* c, Node* node, int dest) {
     if (!node) return;
-    int line = node->literal.token.line > 0 ? node->literal.token.line : 1;
+    Node* outer = c->node;
+    c->node = node;
+    compileExprNode(c, node, dest);
+    c->node = outer;
+}
+
+static void compileExprNode(Compiler* c, Node* node, int dest) {
+    int line = node->line > 0 ? node->line : 1;
 
     switch (node->type) {
         case NODE_EXPR_LITERAL: {
             Token tok = node->literal.token;
-            line = tok.line > 0 ? tok.line : 1;
             if (tok.type == TOKEN_NUMBER) {
-                char* str = strndup(tok.start, tok.length);
-                if (strchr(str, '.')) {
-                    double val = atof(str);
-                    int ki = emitConstant(c, FLOAT_VAL(val));
-                    emit(c, ENCODE_ABx(OP_LOADK, dest, ki), line);
-                } else {
-                    int64_t val = atoll(str);
-                    // Use LOADI for small integers that fit in signed 16-bit
-                    if (val >= -32767 && val <= 32767) {
-                        emit(c, ENCODE_ABx(OP_LOADI, dest, (uint16_t)(val + 0x7FFF)), line);
-                    } else {
-                        int ki = emitConstant(c, INT_VAL(val));
-                        emit(c, ENCODE_ABx(OP_LOADK, dest, ki), line);
-                    }
-                }
-                free(str);
+                emitLoadValue(c, numberLiteral(c->vm, tok), dest, line);
             } else if (tok.type == TOKEN_TRUE) {
                 emit(c, ENCODE_A(OP_LOADTRUE, dest), line);
             } else if (tok.type == TOKEN_FALSE) {
@@ -209,8 +1338,8 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
             } else if (tok.type == TOKEN_NIL) {
                 emit(c, ENCODE_A(OP_LOADNIL, dest), line);
             } else if (tok.type == TOKEN_STRING) {
-                char* str = parseStringLiteral(tok.start + 1, tok.length - 2);
-                ObjString* objStr = internString(c->vm, str, strlen(str));
+                char* str = stringLiteralText(tok);
+                ObjString* objStr = internConstant(c->vm, str, strlen(str));
                 free(str);
                 int ki = emitConstant(c, OBJ_VAL(objStr));
                 emit(c, ENCODE_ABx(OP_LOADK, dest, ki), line);
@@ -220,20 +1349,67 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
 
         case NODE_EXPR_VAR: {
             Token name = node->var.name;
-            line = name.line > 0 ? name.line : 1;
             int local = resolveLocal(c, name.start, name.length);
             if (local != -1) {
                 if (local != dest) {
                     emit(c, ENCODE_ABC(OP_MOVE, dest, local, 0), line);
                 }
             } else {
-                int ki = internNameConst(c, name);
-                emit(c, ENCODE_ABx(OP_GETGLOBAL, dest, ki), line);
+                int upvalue = resolveUpvalue(c, name.start, name.length);
+                if (upvalue != -1) {
+                    emit(c, ENCODE_ABC(OP_GETUPVAL, dest, upvalue, 0), line);
+                } else {
+                    int ki = internNameConst(c, name);
+                    emit(c, ENCODE_ABx(OP_GETGLOBAL, dest, ki), line);
+                }
             }
             break;
         }
 
         case NODE_EXPR_BINARY: {
+            Value folded;
+            if (foldConstant(c, node, &folded)) {
+                emitLoadValue(c, folded, dest, line);
+                break;
+            }
+            // and/or: the result is whichever operand decided it, so the
+            // right side only runs when the left one doesn't settle it.
+            // A scratch register keeps dest (maybe a local the right side
+            // reads, as in x = y or x) intact until the end.
+            if (node->binary.op.type == TOKEN_AND || node->binary.op.type == TOKEN_OR) {
+                if (foldConstant(c, node->binary.left, &folded)) {
+                    // A constant left side that didn't decide: only the right is left
+                    compileExpr(c, node->binary.right, dest);
+                    break;
+                }
+                int regT = allocReg(c);
+                compileExpr(c, node->binary.left, regT);
+                int skip = emitJumpPlaceholder(c, node->binary.op.type == TOKEN_AND ? OP_JMPF : OP_JMPT, regT, line);
+                compileExpr(c, node->binary.right, regT);
+                patchJump(c->chunk, skip);
+                emit(c, ENCODE_ABC(OP_MOVE, dest, regT, 0), line);
+                freeRegsTo(c, regT);
+                break;
+            }
+            // a ?? b: only a nil left side runs the right one
+            if (node->binary.op.type == TOKEN_QUESTION_QUESTION) {
+                if (foldConstant(c, node->binary.left, &folded)) {
+                    compileExpr(c, node->binary.right, dest);
+                    break;
+                }
+                int regT = allocReg(c);
+                compileExpr(c, node->binary.left, regT);
+                int skip = emitJumpPlaceholder(c, OP_JMPNOTNIL, regT, line);
+                compileExpr(c, node->binary.right, regT);
+                patchJump(c->chunk, skip);
+                emit(c, ENCODE_ABC(OP_MOVE, dest, regT, 0), line);
+                freeRegsTo(c, regT);
+                break;
+            }
+            if (node->binary.chained) {
+                compileComparisonChain(c, node, dest, line);
+                break;
+            }
             bool tempB, tempC;
             int regB = getOperandReg(c, node->binary.left, &tempB);
             int regC = getOperandReg(c, node->binary.right, &tempC);
@@ -243,7 +1419,13 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
                 case TOKEN_MINUS:         emit(c, ENCODE_ABC(OP_SUB, dest, regB, regC), line); break;
                 case TOKEN_STAR:          emit(c, ENCODE_ABC(OP_MUL, dest, regB, regC), line); break;
                 case TOKEN_SLASH:         emit(c, ENCODE_ABC(OP_DIV, dest, regB, regC), line); break;
+                case TOKEN_TILDE_SLASH:   emit(c, ENCODE_ABC(OP_IDIV, dest, regB, regC), line); break;
                 case TOKEN_PERCENT:       emit(c, ENCODE_ABC(OP_MOD, dest, regB, regC), line); break;
+                case TOKEN_AMPERSAND:     emit(c, ENCODE_ABC(OP_BAND, dest, regB, regC), line); break;
+                case TOKEN_PIPE:          emit(c, ENCODE_ABC(OP_BOR, dest, regB, regC), line); break;
+                case TOKEN_CARET:         emit(c, ENCODE_ABC(OP_BXOR, dest, regB, regC), line); break;
+                case TOKEN_LESS_LESS:     emit(c, ENCODE_ABC(OP_SHL, dest, regB, regC), line); break;
+                case TOKEN_GREATER_GREATER: emit(c, ENCODE_ABC(OP_SHR, dest, regB, regC), line); break;
                 case TOKEN_LESS:          emit(c, ENCODE_ABC(OP_LT,  dest, regB, regC), line); break;
                 case TOKEN_LESS_EQUAL:    emit(c, ENCODE_ABC(OP_LE,  dest, regB, regC), line); break;
                 case TOKEN_GREATER:       emit(c, ENCODE_ABC(OP_GT,  dest, regB, regC), line); break;
@@ -258,12 +1440,19 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
         }
 
         case NODE_EXPR_UNARY: {
+            Value folded;
+            if (foldConstant(c, node, &folded)) {
+                emitLoadValue(c, folded, dest, line);
+                break;
+            }
             bool tempB;
             int regB = getOperandReg(c, node->unary.expr, &tempB);
             if (node->unary.op.type == TOKEN_MINUS) {
                 emit(c, ENCODE_ABC(OP_NEG, dest, regB, 0), line);
             } else if (node->unary.op.type == TOKEN_BANG) {
                 emit(c, ENCODE_ABC(OP_NOT, dest, regB, 0), line);
+            } else if (node->unary.op.type == TOKEN_TILDE) {
+                emit(c, ENCODE_ABC(OP_BNOT, dest, regB, 0), line);
             }
             if (tempB) freeRegsTo(c, regB);
             break;
@@ -278,8 +1467,9 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
         }
 
         case NODE_EXPR_CALL: {
-            // Check builtins
-            if (node->call.callee->type == NODE_EXPR_VAR) {
+            // Check builtins; a spread or named argument makes it a regular call
+            if (node->call.callee->type == NODE_EXPR_VAR && !hasSpreadArgument(node) &&
+                node->call.namedCount == 0) {
                 Token name = node->call.callee->var.name;
                 char* funcName = strndup(name.start, name.length);
 
@@ -306,7 +1496,7 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
                     }
                     free(funcName);
                     break;
-                } else if (strcmp(funcName, "length") == 0) {
+                } else if ((strcmp(funcName, "length") == 0 || strcmp(funcName, "len") == 0)) {
                     Node* arg = node->call.arguments;
                     if (arg) {
                         int regArr = allocReg(c);
@@ -320,7 +1510,7 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
                     emit(c, ENCODE_ABx(OP_NEWARRAY, dest, 0), line);
                     free(funcName);
                     break;
-                } else if (strcmp(funcName, "map") == 0) {
+                } else if (strcmp(funcName, "map") == 0 && !node->call.arguments) {
                     emit(c, ENCODE_A(OP_NEWMAP, dest), line);
                     free(funcName);
                     break;
@@ -328,27 +1518,7 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
                 free(funcName);
             }
 
-            // Regular function call: R(dest) = call R(funcReg) with args
-            // Layout: funcReg, arg0, arg1, ..., argN (contiguous)
-            int funcReg = allocReg(c);
-            compileExpr(c, node->call.callee, funcReg);
-
-            int argCount = 0;
-            Node* arg = node->call.arguments;
-            while (arg) {
-                int argReg = allocReg(c);
-                compileExpr(c, arg, argReg);
-                argCount++;
-                arg = arg->next;
-            }
-
-            // OP_CALL A=funcReg B=argCount C=resultCount
-            // Result goes into funcReg, then MOVE to dest
-            emit(c, ENCODE_ABC(OP_CALL, funcReg, argCount, 1), line);
-            if (funcReg != dest) {
-                emit(c, ENCODE_ABC(OP_MOVE, dest, funcReg, 0), line);
-            }
-            freeRegsTo(c, funcReg);
+            emitCall(c, node, dest, 1, line);
             break;
         }
 
@@ -356,17 +1526,64 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
             int regB = allocReg(c);
             int regC = allocReg(c);
             compileExpr(c, node->index.target, regB);
+            emitChainJump(c, node->index.optional, regB, line);
             compileExpr(c, node->index.index, regC);
             emit(c, ENCODE_ABC(OP_GETIDX, dest, regB, regC), line);
             freeRegsTo(c, regB);
             break;
         }
 
+        case NODE_EXPR_SLICE: {
+            // Bounds go in two consecutive registers, nil when omitted
+            int regB = allocReg(c);
+            int regC = allocReg(c);
+            allocReg(c);
+            compileExpr(c, node->slice.target, regB);
+            emitChainJump(c, node->slice.optional, regB, line);
+            if (node->slice.start) compileExpr(c, node->slice.start, regC);
+            else emit(c, ENCODE_A(OP_LOADNIL, regC), line);
+            if (node->slice.end) compileExpr(c, node->slice.end, regC + 1);
+            else emit(c, ENCODE_A(OP_LOADNIL, regC + 1), line);
+            emit(c, ENCODE_ABC(OP_SLICE, dest, regB, regC), line);
+            freeRegsTo(c, regB);
+            break;
+        }
+
         case NODE_EXPR_ARRAY_LITERAL: {
+            // A set literal is built the same way: PUSH and SPREAD add to
+            // the set NEWSET makes
+            bool isSet = node->arrayLiteral.isSet;
             // Count elements
             int count = 0;
+            bool hasSpread = false;
             Node* el = node->arrayLiteral.elements;
-            while (el) { count++; el = el->next; }
+            while (el) {
+                if (el->type == NODE_EXPR_SPREAD) hasSpread = true;
+                count++;
+                el = el->next;
+            }
+
+            if (hasSpread) {
+                // The length is only known at run time: build the array in
+                // a scratch register, so elements may still read dest, and
+                // append each element or spread iterable in order
+                int arrReg = allocReg(c);
+                emit(c, isSet ? ENCODE_A(OP_NEWSET, arrReg) : ENCODE_ABx(OP_NEWARRAY, arrReg, 0), line);
+                for (el = node->arrayLiteral.elements; el; el = el->next) {
+                    int elReg = allocReg(c);
+                    if (el->type == NODE_EXPR_SPREAD) {
+                        compileExpr(c, el->unary.expr, elReg);
+                        emit(c, ENCODE_ABC(OP_SPREAD, arrReg, elReg, 0), el->line);
+                    } else {
+                        compileExpr(c, el, elReg);
+                        emit(c, ENCODE_ABC(OP_PUSH, arrReg, elReg, 0), line);
+                    }
+                    freeRegsTo(c, elReg);
+                }
+                emit(c, ENCODE_ABC(OP_MOVE, dest, arrReg, 0), line);
+                freeRegsTo(c, arrReg);
+                break;
+            }
 
             // Allocate contiguous regs for elements
             int baseReg = c->nextReg;
@@ -380,7 +1597,7 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
             // Put array into dest, init with baseReg..baseReg+count-1
             // OP_NEWARRAY A=dest Bx=count; elements in R(dest+1)..R(dest+count)
             // Actually, simpler: create empty array then push
-            emit(c, ENCODE_ABx(OP_NEWARRAY, dest, 0), line);
+            emit(c, isSet ? ENCODE_A(OP_NEWSET, dest) : ENCODE_ABx(OP_NEWARRAY, dest, 0), line);
             for (int i = 0; i < count; i++) {
                 emit(c, ENCODE_ABC(OP_PUSH, dest, baseReg + i, 0), line);
             }
@@ -388,18 +1605,141 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
             break;
         }
 
+        case NODE_EXPR_FUNCTION:
+            compileFunction(c, node, dest, line);
+            break;
+
+        case NODE_EXPR_TERNARY: {
+            // Same jump shape as if/else; both arms write into dest
+            int condReg = allocReg(c);
+            compileExpr(c, node->ternary.condition, condReg);
+            int elseJmp = emitJumpPlaceholder(c, OP_JMPF, condReg, line);
+            freeRegsTo(c, condReg);
+
+            compileExpr(c, node->ternary.thenExpr, dest);
+            int endJmp = emitJumpPlaceholder(c, OP_JMP, 0, line);
+            patchJump(c->chunk, elseJmp);
+            compileExpr(c, node->ternary.elseExpr, dest);
+            patchJump(c->chunk, endJmp);
+            break;
+        }
+
+        case NODE_EXPR_MAP_LITERAL: {
+            // Create empty map, then store each pair in source order
+            emit(c, ENCODE_A(OP_NEWMAP, dest), line);
+            Node* key = node->mapLiteral.keys;
+            Node* value = node->mapLiteral.values;
+            while (key) {
+                int regK = allocReg(c);
+                int regV = allocReg(c);
+                compileExpr(c, key, regK);
+                compileExpr(c, value, regV);
+                emit(c, ENCODE_ABC(OP_SETIDX, dest, regK, regV), line);
+                freeRegsTo(c, regK);
+                key = key->next;
+                value = value->next;
+            }
+            break;
+        }
+
+        case NODE_EXPR_STRUCT_LITERAL: {
+            // The def, then one register per field in declaration order:
+            // the given values in the order written, then the defaults
+            Token name = node->structLiteral.name;
+            bool ambiguous;
+            Node* decl = findStruct(c, name, &ambiguous);
+            if (!decl) {
+                errorAt(c, name, "Unknown struct '%.*s'.", name.length, name.start);
+                break;
+            }
+            if (ambiguous) {
+                errorAt(c, name, "Struct '%.*s' is declared more than once, so a literal of it in a function can't tell which.",
+                        name.length, name.start);
+                break;
+            }
+            int fieldCount = decl->structDecl.fieldCount;
+            int base = allocReg(c);
+            Node def = {.type = NODE_EXPR_VAR, .line = line};
+            def.var.name = name;
+            def.var.slot = -1;
+            compileExpr(c, &def, base);
+            for (int i = 0; i < fieldCount; i++) allocReg(c);
+
+            bool given[256] = {false};
+            Node* value = node->structLiteral.values;
+            for (int i = 0; i < node->structLiteral.count; i++, value = value->next) {
+                Token field = node->structLiteral.fields[i];
+                int slot = 0;
+                for (; slot < fieldCount; slot++) {
+                    Token declared = decl->structDecl.fields[slot];
+                    if (declared.length == field.length && memcmp(declared.start, field.start, field.length) == 0) break;
+                }
+                if (slot == fieldCount) {
+                    errorAt(c, field, "Struct '%.*s' has no field '%.*s'.", name.length, name.start, field.length, field.start);
+                    continue;
+                }
+                compileExpr(c, value, base + 1 + slot);
+                given[slot] = true;
+            }
+            for (int i = 0; i < fieldCount; i++) {
+                if (given[i]) continue;
+                Node* fallback = decl->structDecl.defaults[i];
+                if (fallback) {
+                    compileExpr(c, fallback, base + 1 + i);
+                } else {
+                    emit(c, ENCODE_A(OP_LOADNIL, base + 1 + i), line);
+                }
+            }
+            emit(c, ENCODE_ABC(OP_NEWSTRUCT, base, base, fieldCount), line);
+            if (dest != base) emit(c, ENCODE_ABC(OP_MOVE, dest, base, 0), line);
+            freeRegsTo(c, base);
+            break;
+        }
+
         case NODE_EXPR_GET: {
             int regB = allocReg(c);
             compileExpr(c, node->get.object, regB);
+            emitChainJump(c, node->get.optional, regB, line);
             int ki = internNameConst(c, node->get.name);
-            emit(c, ENCODE_ABC(OP_GETPROP, dest, regB, ki), line);
+            emitGetProp(c, dest, regB, ki, line);
             freeRegsTo(c, regB);
             break;
         }
 
+        case NODE_EXPR_OPTIONAL: {
+            // The whole chain lands in dest; any nil link leaves nil there
+            OptionalChain chain;
+            chain.enclosing = c->chain;
+            chain.nilCount = 0;
+            c->chain = &chain;
+            compileExpr(c, node->unary.expr, dest);
+            c->chain = chain.enclosing;
+            int endJmp = emitJumpPlaceholder(c, OP_JMP, 0, line);
+            for (int i = 0; i < chain.nilCount; i++) {
+                patchJump(c->chunk, chain.nilJumps[i]);
+            }
+            emit(c, ENCODE_A(OP_LOADNIL, dest), line);
+            patchJump(c->chunk, endJmp);
+            break;
+        }
+
+        case NODE_EXPR_UPDATE:
+            compileUpdate(c, node, dest, line);
+            break;
+
         case NODE_STMT_ASSIGN: {
             // Assignment used as expression
+            int opcode = compoundOpcode(node->assign.operator.type);
+            if (opcode != -1) {
+                compileCompoundAssign(c, node, opcode, dest, line);
+                break;
+            }
+            if (node->assign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                compileNilAssign(c, node, dest, line);
+                break;
+            }
             Token name = node->assign.name;
+            checkConstWrite(c, name);
             int local = resolveLocal(c, name.start, name.length);
             if (local != -1) {
                 compileExpr(c, node->assign.value, local);
@@ -408,8 +1748,13 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
                 }
             } else {
                 compileExpr(c, node->assign.value, dest);
-                int ki = internNameConst(c, name);
-                emit(c, ENCODE_ABx(OP_SETGLOBAL, dest, ki), line);
+                int upvalue = resolveUpvalue(c, name.start, name.length);
+                if (upvalue != -1) {
+                    emit(c, ENCODE_ABC(OP_SETUPVAL, dest, upvalue, 0), line);
+                } else {
+                    int ki = internNameConst(c, name);
+                    emit(c, ENCODE_ABx(OP_SETGLOBAL, dest, ki), line);
+                }
             }
             break;
         }
@@ -422,11 +1767,106 @@ static void compileExpr(Compiler* c, Node* node, int dest) {
 /**
  * Compile statement (no result register needed)
  */
+// Compile a function declaration into its own chunk and load the
+// function, or a closure over the current one, into 'reg'
+static void compileFunction(Compiler* c, Node* node, int reg, int line) {
+    Function* func = ALLOCATE_OBJ(c->vm, Function, OBJ_FUNCTION);
+
+    func->name = node->function.name;
+    func->params = node->function.params;
+    func->paramCount = node->function.paramCount;
+    func->requiredCount = node->function.requiredCount;
+    func->isVariadic = node->function.isVariadic;
+    func->isMethod = node->function.isMethod;
+    func->defaults = node->function.defaults;
+    func->isNative = false;
+    func->isAsync = false;
+    func->modulePath = c->modulePath ? strdup(c->modulePath) : NULL;
+    func->moduleEnv = c->vm->globalEnv;
+    func->closure = NULL;
+    func->native = NULL;
+    func->upvalueCount = 0;
+    func->upvalues = NULL;
+    func->proto = NULL;
+
+    // Compile function body into new chunk
+    func->bytecodeChunk = malloc(sizeof(BytecodeChunk));
+    initChunk(func->bytecodeChunk);
+
+    // Root function for GC safety
+    if (c->vm->stackTop < 8192) {
+        c->vm->stack[c->vm->stackTop++] = OBJ_VAL(func);
+    }
+
+    Compiler funcCompiler;
+    initCompiler(&funcCompiler, c->vm, func->bytecodeChunk, c->modulePath);
+    funcCompiler.enclosing = c;
+
+    // Parameters occupy registers 1..paramCount
+    for (int i = 0; i < func->paramCount; i++) {
+        Token p = func->params[i];
+        char* pname = strndup(p.start, p.length);
+        addLocal(&funcCompiler, pname);
+    }
+
+    // Fill omitted arguments from their defaults. Hiding the later
+    // parameters lets a default refer only to the ones before it.
+    // A rest parameter has none; the call always fills it.
+    int defaultedEnd = func->isVariadic ? func->paramCount - 1 : func->paramCount;
+    for (int i = func->requiredCount; i < defaultedEnd; i++) {
+        int skip = emitJumpPlaceholder(&funcCompiler, OP_JMPARG, i, line);
+        funcCompiler.localCount = i + 1;
+        compileExpr(&funcCompiler, node->function.defaults[i], i + 1);
+        funcCompiler.localCount = func->paramCount + 1;
+        patchJump(func->bytecodeChunk, skip);
+    }
+
+    // Compile body
+    compileNode(&funcCompiler, node->function.body);
+
+    // Implicit return nil
+    emit(&funcCompiler, ENCODE_A(OP_RETURNNIL, 0), line);
+    if (c->vm->optimizeBytecode && !funcCompiler.hadError) optimizeChunk(func->bytecodeChunk);
+    func->upvalueCount = funcCompiler.upvalueCount;
+    if (funcCompiler.hadError) c->hadError = true;
+
+    // Unroot
+    c->vm->stackTop--;
+
+    // Store function in parent scope
+    int funcConstIdx = emitConstant(c, OBJ_VAL(func));
+
+    if (func->upvalueCount > 0) {
+        // Instantiate a closure; one capture word per upvalue follows
+        emit(c, ENCODE_ABx(OP_CLOSURE, reg, funcConstIdx), line);
+        for (int i = 0; i < funcCompiler.upvalueCount; i++) {
+            uint8_t op = funcCompiler.upvalues[i].isLocal ? OP_MOVE : OP_GETUPVAL;
+            emit(c, ENCODE_ABC(op, 0, funcCompiler.upvalues[i].index, 0), line);
+        }
+    } else {
+        emit(c, ENCODE_ABx(OP_LOADK, reg, funcConstIdx), line);
+    }
+}
+
+static void compileStmtNode(Compiler* c, Node* node);
+
 static void compileStmt(Compiler* c, Node* node) {
     if (!node) return;
-    int line = 1;
+    Node* outer = c->node;
+    c->node = node;
+    compileStmtNode(c, node);
+    c->node = outer;
+}
+
+static void compileStmtNode(Compiler* c, Node* node) {
+    int line = node->line > 0 ? node->line : 1;
 
     switch (node->type) {
+        case NODE_EXPR_UPDATE:
+            // i++; as a statement: no register for the unused result
+            compileUpdate(c, node, -1, line);
+            break;
+
         case NODE_STMT_PRINT: {
             int reg = allocReg(c);
             compileExpr(c, node->print.expr, reg);
@@ -437,18 +1877,25 @@ static void compileStmt(Compiler* c, Node* node) {
 
         case NODE_STMT_VAR_DECL: {
             Token name = node->varDecl.name;
-            line = name.line > 0 ? name.line : 1;
 
             if (c->scopeDepth > 0) {
                 // Local variable -> allocate register
-                int reg = addLocal(c, strndup(name.start, name.length));
+                int reg = declareLocal(c, name);
+                c->locals[c->localCount - 1].isConst = node->varDecl.isConst;
+                if (node->varDecl.initializer && node->varDecl.initializer->type == NODE_EXPR_FUNCTION) {
+                    c->locals[c->localCount - 1].functionDecl = node;
+                }
                 if (node->varDecl.initializer) {
                     compileExpr(c, node->varDecl.initializer, reg);
                 } else {
                     emit(c, ENCODE_A(OP_LOADNIL, reg), line);
                 }
+                // The debugger shows the variable once it holds its value
+                int info = c->locals[c->localCount - 1].debugInfo;
+                if (info >= 0) c->chunk->locals[info].startPc = c->chunk->codeSize;
             } else {
-                // Global variable
+                // Global variable; a top-level const is its own declaration
+                if (!node->varDecl.isConst) checkConstWrite(c, name);
                 int reg = allocReg(c);
                 if (node->varDecl.initializer) {
                     compileExpr(c, node->varDecl.initializer, reg);
@@ -456,14 +1903,24 @@ static void compileStmt(Compiler* c, Node* node) {
                     emit(c, ENCODE_A(OP_LOADNIL, reg), line);
                 }
                 int ki = internNameConst(c, name);
-                emit(c, ENCODE_ABx(OP_DEFGLOBAL, reg, ki), line);
+                emit(c, ENCODE_ABx(node->varDecl.isConst ? OP_DEFCONST : OP_DEFGLOBAL, reg, ki), line);
                 freeRegsTo(c, reg);
             }
             break;
         }
 
         case NODE_STMT_ASSIGN: {
+            int opcode = compoundOpcode(node->assign.operator.type);
+            if (opcode != -1) {
+                compileCompoundAssign(c, node, opcode, -1, line);
+                break;
+            }
+            if (node->assign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                compileNilAssign(c, node, -1, line);
+                break;
+            }
             Token name = node->assign.name;
+            checkConstWrite(c, name);
             int local = resolveLocal(c, name.start, name.length);
 
             // Pattern: i = i + 1 / i = i - 1 -> ADD/SUB in place
@@ -477,22 +1934,17 @@ static void compileStmt(Compiler* c, Node* node) {
                         if (bin->binary.right && bin->binary.right->type == NODE_EXPR_LITERAL) {
                             Token tok = bin->binary.right->literal.token;
                             if (tok.type == TOKEN_NUMBER) {
-                                char* str = strndup(tok.start, tok.length);
-                                if (!strchr(str, '.')) {
-                                    int64_t val = atoll(str);
-                                    if (val >= -32767 && val <= 32767) {
-                                        if (bin->binary.op.type == TOKEN_PLUS) {
-                                            emit(c, ENCODE_AsBx(OP_ADDI, local, (int)val), line);
-                                            free(str);
-                                            break;
-                                        } else if (bin->binary.op.type == TOKEN_MINUS) {
-                                            emit(c, ENCODE_AsBx(OP_SUBI, local, (int)val), line);
-                                            free(str);
-                                            break;
-                                        }
+                                Value num = numberLiteral(c->vm, tok);
+                                if (IS_INT(num) && AS_INT(num) >= -32767 && AS_INT(num) <= 32767) {
+                                    int val = (int)AS_INT(num);
+                                    if (bin->binary.op.type == TOKEN_PLUS) {
+                                        emit(c, ENCODE_AsBx(OP_ADDI, local, val), line);
+                                        break;
+                                    } else if (bin->binary.op.type == TOKEN_MINUS) {
+                                        emit(c, ENCODE_AsBx(OP_SUBI, local, val), line);
+                                        break;
                                     }
                                 }
-                                free(str);
                             }
                         }
 
@@ -518,8 +1970,13 @@ static void compileStmt(Compiler* c, Node* node) {
             } else {
                 int reg = allocReg(c);
                 compileExpr(c, node->assign.value, reg);
-                int ki = internNameConst(c, name);
-                emit(c, ENCODE_ABx(OP_SETGLOBAL, reg, ki), line);
+                int upvalue = resolveUpvalue(c, name.start, name.length);
+                if (upvalue != -1) {
+                    emit(c, ENCODE_ABC(OP_SETUPVAL, reg, upvalue, 0), line);
+                } else {
+                    int ki = internNameConst(c, name);
+                    emit(c, ENCODE_ABx(OP_SETGLOBAL, reg, ki), line);
+                }
                 freeRegsTo(c, reg);
             }
             break;
@@ -531,7 +1988,27 @@ static void compileStmt(Compiler* c, Node* node) {
             int regC = allocReg(c);
             compileExpr(c, node->indexAssign.target, regA);
             compileExpr(c, node->indexAssign.index, regB);
-            compileExpr(c, node->indexAssign.value, regC);
+            if (node->indexAssign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                // A missing key reads as nil, so it is filled in too
+                emit(c, ENCODE_ABC(OP_GETIDX, regC, regA, regB), line);
+                int skip = emitJumpPlaceholder(c, OP_JMPNOTNIL, regC, line);
+                compileExpr(c, node->indexAssign.value, regC);
+                emit(c, ENCODE_ABC(OP_SETIDX, regA, regB, regC), line);
+                patchJump(c->chunk, skip);
+                freeRegsTo(c, regA);
+                break;
+            }
+            int opcode = compoundOpcode(node->indexAssign.operator.type);
+            if (opcode != -1) {
+                // Target and index are evaluated once and reused for the write
+                bool tempD;
+                emit(c, ENCODE_ABC(OP_GETIDX, regC, regA, regB), line);
+                int regD = getOperandReg(c, node->indexAssign.value, &tempD);
+                emit(c, ENCODE_ABC(opcode, regC, regC, regD), line);
+                if (tempD) freeRegsTo(c, regD);
+            } else {
+                compileExpr(c, node->indexAssign.value, regC);
+            }
             emit(c, ENCODE_ABC(OP_SETIDX, regA, regB, regC), line);
             freeRegsTo(c, regA);
             break;
@@ -557,6 +2034,63 @@ static void compileStmt(Compiler* c, Node* node) {
             break;
         }
 
+        case NODE_STMT_SWITCH: {
+            c->scopeDepth++;
+            int savedLocalCount = c->localCount;
+            int savedNextReg = c->nextReg;
+
+            int subjectReg = addLocal(c, strdup(".switch"));
+            compileExpr(c, node->switchStmt.subject, subjectReg);
+
+            // Compare against every case value in order; the first match
+            // jumps to its body, no match jumps to 'default' or past the end
+            int caseCount = node->switchStmt.caseCount;
+            int jumpCount = 0;
+            for (int i = 0; i < caseCount; i++) {
+                for (Node* v = node->switchStmt.values[i]; v; v = v->next) jumpCount++;
+            }
+            int* matchJumps = malloc((jumpCount > 0 ? jumpCount : 1) * sizeof(int));
+            int jump = 0;
+            int defaultCase = -1;
+            int testReg = allocReg(c);
+            for (int i = 0; i < caseCount; i++) {
+                if (!node->switchStmt.values[i]) defaultCase = i;
+                for (Node* v = node->switchStmt.values[i]; v; v = v->next) {
+                    compileExpr(c, v, testReg);
+                    emit(c, ENCODE_ABC(OP_EQ, testReg, subjectReg, testReg), v->line);
+                    matchJumps[jump++] = emitJumpPlaceholder(c, OP_JMPT, testReg, v->line);
+                }
+            }
+            freeRegsTo(c, testReg);
+            int noMatchJmp = emitJumpPlaceholder(c, OP_JMP, 0, line);
+
+            // Bodies in source order; each leaves the switch unless it
+            // ends in 'fallthrough'
+            int* endJumps = malloc((caseCount > 0 ? caseCount : 1) * sizeof(int));
+            int endCount = 0;
+            jump = 0;
+            for (int i = 0; i < caseCount; i++) {
+                for (Node* v = node->switchStmt.values[i]; v; v = v->next) {
+                    patchJump(c->chunk, matchJumps[jump++]);
+                }
+                if (i == defaultCase) patchJump(c->chunk, noMatchJmp);
+                compileStmt(c, node->switchStmt.bodies[i]);
+                if (!node->switchStmt.fallsThrough[i] && i < caseCount - 1) {
+                    endJumps[endCount++] = emitJumpPlaceholder(c, OP_JMP, 0, line);
+                }
+            }
+            if (defaultCase == -1) patchJump(c->chunk, noMatchJmp);
+            for (int i = 0; i < endCount; i++) patchJump(c->chunk, endJumps[i]);
+            free(matchJumps);
+            free(endJumps);
+            closeScope(c, savedLocalCount, savedNextReg, line);
+
+            c->scopeDepth--;
+            dropLocals(c, savedLocalCount);
+            c->nextReg = savedNextReg;
+            break;
+        }
+
         case NODE_STMT_WHILE: {
             int loopStart = c->chunk->codeSize;
 
@@ -565,6 +2099,8 @@ static void compileStmt(Compiler* c, Node* node) {
             int exitJmp = emitJumpPlaceholder(c, OP_JMPF, condReg, line);
             freeRegsTo(c, condReg);
 
+            Loop loop;
+            beginLoop(c, &loop, loopStart, node->whileStmt.label);
             compileStmt(c, node->whileStmt.body);
 
             // Loop back
@@ -572,6 +2108,44 @@ static void compileStmt(Compiler* c, Node* node) {
             emit(c, ENCODE_sBx(OP_LOOP, backOffset), line);
 
             patchJump(c->chunk, exitJmp);
+            endLoop(c, &loop);
+            break;
+        }
+
+        case NODE_STMT_DO_WHILE: {
+            int loopStart = c->chunk->codeSize;
+
+            Loop loop;
+            beginLoop(c, &loop, -1, node->whileStmt.label);
+            compileStmt(c, node->whileStmt.body);
+
+            // 'continue' goes on to the condition, after the body
+            patchContinues(c, &loop);
+            int condLine = node->whileStmt.condition->line;
+            int condReg = allocReg(c);
+            compileExpr(c, node->whileStmt.condition, condReg);
+            int exitJmp = emitJumpPlaceholder(c, OP_JMPF, condReg, condLine);
+            freeRegsTo(c, condReg);
+
+            // Back through OP_LOOP, which checks the limits
+            int backOffset = c->chunk->codeSize - loopStart + 1;
+            emit(c, ENCODE_sBx(OP_LOOP, backOffset), condLine);
+
+            patchJump(c->chunk, exitJmp);
+            endLoop(c, &loop);
+            break;
+        }
+
+        case NODE_STMT_LOOP: {
+            int loopStart = c->chunk->codeSize;
+
+            Loop loop;
+            beginLoop(c, &loop, loopStart, node->whileStmt.label);
+            compileStmt(c, node->whileStmt.body);
+
+            int backOffset = c->chunk->codeSize - loopStart + 1;
+            emit(c, ENCODE_sBx(OP_LOOP, backOffset), line);
+            endLoop(c, &loop);
             break;
         }
 
@@ -580,15 +2154,8 @@ static void compileStmt(Compiler* c, Node* node) {
             int savedLocalCount = c->localCount;
             int savedNextReg = c->nextReg;
 
-            if (node->forStmt.initializer) {
-                if (node->forStmt.initializer->type == NODE_STMT_VAR_DECL) {
-                    compileStmt(c, node->forStmt.initializer);
-                } else {
-                    int tmp = allocReg(c);
-                    compileExpr(c, node->forStmt.initializer, tmp);
-                    freeRegsTo(c, tmp);
-                }
-            }
+            // Runs once; a 'var' here is scoped to the loop
+            if (node->forStmt.initializer) compileForClause(c, node->forStmt.initializer);
 
             int loopStart = c->chunk->codeSize;
             int exitJmp = -1;
@@ -600,26 +2167,23 @@ static void compileStmt(Compiler* c, Node* node) {
                 freeRegsTo(c, condReg);
             }
 
+            Loop loop;
+            beginLoop(c, &loop, -1, node->forStmt.label);
             compileStmt(c, node->forStmt.body);
 
-            if (node->forStmt.increment) {
-                if (node->forStmt.increment->type >= NODE_STMT_VAR_DECL &&
-                    node->forStmt.increment->type <= NODE_STMT_PROP_ASSIGN) {
-                    compileStmt(c, node->forStmt.increment);
-                } else {
-                    int tmp = allocReg(c);
-                    compileExpr(c, node->forStmt.increment, tmp);
-                    freeRegsTo(c, tmp);
-                }
-            }
+            // 'continue' runs the increment before re-checking the condition
+            patchContinues(c, &loop);
+            if (node->forStmt.increment) compileForClause(c, node->forStmt.increment);
 
             int backOffset = c->chunk->codeSize - loopStart + 1;
             emit(c, ENCODE_sBx(OP_LOOP, backOffset), line);
 
             if (exitJmp != -1) patchJump(c->chunk, exitJmp);
+            endLoop(c, &loop);
+            closeScope(c, savedLocalCount, savedNextReg, line);
 
             c->scopeDepth--;
-            c->localCount = savedLocalCount;
+            dropLocals(c, savedLocalCount);
             c->nextReg = savedNextReg;
             break;
         }
@@ -629,53 +2193,118 @@ static void compileStmt(Compiler* c, Node* node) {
             int savedLocalCount = c->localCount;
             int savedNextReg = c->nextReg;
 
-            // Collection register
+            // Iterable and cursor registers; the element follows them
             int colReg = addLocal(c, strdup(".col"));
             compileExpr(c, node->foreachStmt.collection, colReg);
+            addLocal(c, strdup(".idx"));
+            emit(c, ENCODE_ABC(OP_FOREACH_PREP, colReg, colReg, 0), line);
 
-            // Index register = 0
-            int idxReg = addLocal(c, strdup(".idx"));
-            emit(c, ENCODE_ABx(OP_LOADI, idxReg, 0 + 0x7FFF), line); // 0
-
-            // Loop start
+            // Loop start: next element, or leave once exhausted
             int loopStart = c->chunk->codeSize;
+            int exitJmp = emitJumpPlaceholder(c, OP_FOREACH_NEXT, colReg, line);
 
-            // Condition: idx < len(col)
-            int lenReg = allocReg(c);
-            int condReg = allocReg(c);
-            emit(c, ENCODE_ABC(OP_LEN, lenReg, colReg, 0), line);
-            emit(c, ENCODE_ABC(OP_LT, condReg, idxReg, lenReg), line);
-            int exitJmp = emitJumpPlaceholder(c, OP_JMPF, condReg, line);
-            freeRegsTo(c, lenReg);
-
-            // Iterator variable = col[idx]
+            // Iterator variable, written by OP_FOREACH_NEXT
             c->scopeDepth++;
             Token iterator = node->foreachStmt.iterator;
+            int iterLocal = c->localCount;
+            Loop loop;
+            beginLoop(c, &loop, -1, node->foreachStmt.label); // The iterator belongs to the body scope
             int iterReg = addLocal(c, strndup(iterator.start, iterator.length));
-            emit(c, ENCODE_ABC(OP_GETIDX, iterReg, colReg, idxReg), line);
 
             // Body
             compileStmt(c, node->foreachStmt.body);
+            patchContinues(c, &loop);
 
-            // Increment idx
-            int oneReg = allocReg(c);
-            emit(c, ENCODE_ABx(OP_LOADI, oneReg, 1 + 0x7FFF), line); // 1
-            emit(c, ENCODE_ABC(OP_ADD, idxReg, idxReg, oneReg), line);
-            freeRegsTo(c, oneReg);
+            // Each iteration gets a fresh captured cell for the iterator
+            closeScope(c, iterLocal, iterReg, line);
 
             // Loop back
             int backOffset = c->chunk->codeSize - loopStart + 1;
             emit(c, ENCODE_sBx(OP_LOOP, backOffset), line);
 
             patchJump(c->chunk, exitJmp);
+            endLoop(c, &loop);
 
             c->scopeDepth--;
             c->scopeDepth--;
-            c->localCount = savedLocalCount;
+            dropLocals(c, savedLocalCount);
             c->nextReg = savedNextReg;
             break;
         }
 
+        case NODE_STMT_TRY: {
+            // The thrown value lands below every register the try block
+            // uses, so unwinding closes upvalues from there
+            int errReg = c->nextReg;
+            int tryJmp = emitJumpPlaceholder(c, OP_TRY, errReg, line);
+            c->tryDepth++;
+            compileStmt(c, node->tryStmt.tryBlock);
+            c->tryDepth--;
+            emit(c, ENCODE_A(OP_ENDTRY, 0), line);
+            int endJmp = emitJumpPlaceholder(c, OP_JMP, 0, line);
+
+            // Catch block with the caught value as its first local
+            patchJump(c->chunk, tryJmp);
+            c->scopeDepth++;
+            int savedLocalCount = c->localCount;
+            int savedNextReg = c->nextReg;
+            Token name = node->tryStmt.catchName;
+            addLocal(c, strndup(name.start, name.length));
+            compileStmt(c, node->tryStmt.catchBlock);
+            closeScope(c, savedLocalCount, savedNextReg, line);
+            c->scopeDepth--;
+            dropLocals(c, savedLocalCount);
+            c->nextReg = savedNextReg;
+
+            patchJump(c->chunk, endJmp);
+            break;
+        }
+
+        case NODE_STMT_WITH: {
+            // The resource is the block's first local; its handler closes
+            // it when an error leaves the body
+            c->scopeDepth++;
+            int savedLocalCount = c->localCount;
+            int savedNextReg = c->nextReg;
+            int reg = declareLocal(c, node->withStmt.name);
+            compileExpr(c, node->withStmt.resource, reg);
+            int info = c->locals[c->localCount - 1].debugInfo;
+            if (info >= 0) c->chunk->locals[info].startPc = c->chunk->codeSize;
+            emit(c, ENCODE_A(OP_WITH, reg), line);
+            WithBlock with = {c->with, reg, ++c->tryDepth};
+            c->with = &with;
+            compileStmt(c, node->withStmt.body);
+            c->with = with.enclosing;
+            c->tryDepth--;
+            emit(c, ENCODE_A(OP_ENDWITH, reg), line);
+            closeScope(c, savedLocalCount, savedNextReg, line);
+            c->scopeDepth--;
+            dropLocals(c, savedLocalCount);
+            c->nextReg = savedNextReg;
+            break;
+        }
+
+        case NODE_STMT_SPAWN:
+            emitCallOp(c, OP_SPAWN, node->spawnStmt.call, c->nextReg, 0, line);
+            break;
+
+        case NODE_STMT_DEFER:
+            emitCallOp(c, OP_DEFER, node->deferStmt.call, c->nextReg, 0, line);
+            break;
+
+        case NODE_STMT_THROW: {
+            int reg = allocReg(c);
+            compileExpr(c, node->throwStmt.value, reg);
+            emit(c, ENCODE_A(OP_THROW, reg), line);
+            freeRegsTo(c, reg);
+            break;
+        }
+
+        case NODE_STMT_BREAK:
+        case NODE_STMT_CONTINUE:
+            compileLoopJump(c, node, line);
+            break;
+
         case NODE_STMT_BLOCK: {
             c->scopeDepth++;
             int savedLocalCount = c->localCount;
@@ -684,94 +2313,48 @@ static void compileStmt(Compiler* c, Node* node) {
             for (int i = 0; i < node->block.count; i++) {
                 compileNode(c, node->block.statements[i]);
             }
+            closeScope(c, savedLocalCount, savedNextReg, line);
 
             c->scopeDepth--;
-            c->localCount = savedLocalCount;
+            dropLocals(c, savedLocalCount);
             c->nextReg = savedNextReg;
             break;
         }
 
         case NODE_STMT_FUNCTION: {
-            // Allocate Function object
-            Function* func = malloc(sizeof(Function));
-            func->obj.type = OBJ_FUNCTION;
-            func->obj.isMarked = false;
-            func->obj.isPermanent = false;
-            func->obj.generation = 0;
-            func->obj.next = c->vm->objects;
-            c->vm->objects = (Obj*)func;
-
-            func->name = node->function.name;
-            func->params = node->function.params;
-            func->paramCount = node->function.paramCount;
-            func->isNative = false;
-            func->isAsync = false;
-            func->modulePath = c->modulePath ? strdup(c->modulePath) : NULL;
-            func->moduleEnv = c->vm->globalEnv;
-            func->closure = NULL;
-            func->native = NULL;
-
-            // Compile function body into new chunk
-            func->bytecodeChunk = malloc(sizeof(BytecodeChunk));
-            initChunk(func->bytecodeChunk);
-
-            // Root function for GC safety
-            if (c->vm->stackTop < 8192) {
-                c->vm->stack[c->vm->stackTop++] = OBJ_VAL(func);
-            }
-
-            Compiler funcCompiler;
-            initCompiler(&funcCompiler, c->vm, func->bytecodeChunk, c->modulePath);
-
-            // Parameters occupy registers 1..paramCount
-            for (int i = 0; i < func->paramCount; i++) {
-                Token p = func->params[i];
-                char* pname = strndup(p.start, p.length);
-                addLocal(&funcCompiler, pname);
-            }
-
-            // Compile body
-            compileNode(&funcCompiler, node->function.body);
-
-            // Implicit return nil
-            emit(&funcCompiler, ENCODE_A(OP_RETURNNIL, 0), line);
-
-#ifdef DEBUG_PRINT_CODE
-            if (!funcCompiler.hadError) {
-                char fname[256];
-                snprintf(fname, sizeof(fname), "%.*s", func->name.length, func->name.start);
-                disassembleChunk(func->bytecodeChunk, fname);
-            }
-#endif
-
-            // Unroot
-            c->vm->stackTop--;
-
-            // Store function in parent scope
-            int funcConstIdx = emitConstant(c, OBJ_VAL(func));
+            // Local functions get their register first so the body can refer to itself
+            int reg = c->scopeDepth > 0
+                ? declareLocal(c, node->function.name)
+                : allocReg(c);
+            if (c->scopeDepth > 0) c->locals[c->localCount - 1].functionDecl = node;
+            compileFunction(c, node, reg, line);
 
             if (c->scopeDepth == 0) {
-                // Global function
+                // Global function: fixed like a const, see collectConstants
                 int nameIdx = internNameConst(c, node->function.name);
-                int reg = allocReg(c);
-                emit(c, ENCODE_ABx(OP_LOADK, reg, funcConstIdx), line);
-                emit(c, ENCODE_ABx(OP_DEFGLOBAL, reg, nameIdx), line);
+                emit(c, ENCODE_ABx(OP_DEFCONST, reg, nameIdx), line);
                 freeRegsTo(c, reg);
-            } else {
-                // Local function
-                int reg = addLocal(c, strndup(node->function.name.start, node->function.name.length));
-                emit(c, ENCODE_ABx(OP_LOADK, reg, funcConstIdx), line);
             }
             break;
         }
 
         case NODE_STMT_RETURN: {
-            if (node->returnStmt.value) {
-                int reg = allocReg(c);
-                compileExpr(c, node->returnStmt.value, reg);
-                emit(c, ENCODE_A(OP_RETURN, reg), line);
-                freeRegsTo(c, reg);
+            if (node->returnStmt.value && isTailCall(c, node)) {
+                // The RETURN only runs when OP_TAILCALL falls back to a plain call
+                int base = c->nextReg;
+                emitCallOp(c, OP_TAILCALL, node->returnStmt.value, base, 1, line);
+                emit(c, ENCODE_ABC(OP_RETURN, base, 1, 0), line);
+            } else if (node->returnStmt.value) {
+                // Values go into consecutive registers; OP_RETURN A=first B=count
+                int base = c->nextReg;
+                for (Node* v = node->returnStmt.value; v; v = v->next) {
+                    compileExpr(c, v, allocReg(c));
+                }
+                closeWithBlocks(c, line);
+                emit(c, ENCODE_ABC(OP_RETURN, base, node->returnStmt.count, 0), line);
+                freeRegsTo(c, base);
             } else {
+                closeWithBlocks(c, line);
                 emit(c, ENCODE_A(OP_RETURNNIL, 0), line);
             }
             break;
@@ -781,8 +2364,13 @@ static void compileStmt(Compiler* c, Node* node) {
             Token name = node->structDecl.name;
             int nameIdx = internNameConst(c, name);
 
-            // Push struct name into a register
-            int nameReg = allocReg(c);
+            // Push struct name into a register. A local struct uses its own
+            // register, which OP_STRUCTDEF then overwrites with the def.
+            int nameReg = c->scopeDepth > 0 ? declareLocal(c, name) : allocReg(c);
+            if (c->scopeDepth > 0) c->locals[c->localCount - 1].structDecl = node;
+            for (int i = 0; c->scopeDepth == 0 && i < c->structCount; i++) {
+                if (c->structs[i] == node) c->structsCompiled = i + 1;
+            }
             emit(c, ENCODE_ABx(OP_LOADK, nameReg, nameIdx), line);
 
             // Field names into constant pool
@@ -801,10 +2389,86 @@ static void compileStmt(Compiler* c, Node* node) {
             if (c->scopeDepth == 0) {
                 emit(c, ENCODE_ABx(OP_DEFGLOBAL, nameReg, nameIdx), line);
             } else {
-                int reg = addLocal(c, strndup(name.start, name.length));
-                emit(c, ENCODE_ABC(OP_MOVE, reg, nameReg, 0), line);
+                emit(c, ENCODE_ABC(OP_MOVE, nameReg, nameReg, 0), line);
+            }
+            freeRegsTo(c, nameReg + 1);
+
+            // Attach each method to the def, still in nameReg
+            for (int i = 0; i < node->structDecl.methodCount; i++) {
+                int fnReg = allocReg(c);
+                compileFunction(c, node->structDecl.methods[i], fnReg, line);
+                emit(c, ENCODE_ABC(OP_METHOD, nameReg, fnReg, 0), line);
+                freeRegsTo(c, fnReg);
             }
-            freeRegsTo(c, nameReg);
+            if (c->scopeDepth == 0) freeRegsTo(c, nameReg);
+            break;
+        }
+
+        case NODE_STMT_MULTI_ASSIGN: {
+            // Evaluate every value into temporaries first, then assign.
+            // This is what makes 'a, b = b, a' swap.
+            int n = node->multiAssign.targetCount;
+            int base = c->nextReg;
+            for (int i = 0; i < n; i++) allocReg(c);
+
+            int filled = 0;
+            for (Node* v = node->multiAssign.values; v; v = v->next) {
+                if (!v->next && filled < n - 1) {
+                    // Last value spreads over the remaining targets
+                    compileExprMulti(c, v, base + filled, n - filled, line);
+                    filled = n;
+                } else if (filled < n) {
+                    compileExpr(c, v, base + filled);
+                    filled++;
+                } else {
+                    // Surplus values are still evaluated, then dropped
+                    int scratch = allocReg(c);
+                    compileExpr(c, v, scratch);
+                    freeRegsTo(c, scratch);
+                }
+            }
+            for (; filled < n; filled++) {
+                emit(c, ENCODE_A(OP_LOADNIL, base + filled), line);
+            }
+
+            if (node->multiAssign.isDecl && c->scopeDepth > 0) {
+                // The temporaries become the new locals' registers
+                freeRegsTo(c, base);
+                for (Node* t = node->multiAssign.targets; t; t = t->next) {
+                    declareLocal(c, t->var.name);
+                }
+            } else if (node->multiAssign.isDecl) {
+                int i = 0;
+                for (Node* t = node->multiAssign.targets; t; t = t->next, i++) {
+                    int ki = internNameConst(c, t->var.name);
+                    emit(c, ENCODE_ABx(OP_DEFGLOBAL, base + i, ki), line);
+                }
+                freeRegsTo(c, base);
+            } else {
+                int i = 0;
+                for (Node* t = node->multiAssign.targets; t; t = t->next, i++) {
+                    assignTarget(c, t, base + i, line);
+                }
+                freeRegsTo(c, base);
+            }
+            break;
+        }
+
+        case NODE_STMT_ENUM_DECL: {
+            if (c->enclosing || c->scopeDepth > 0) {
+                Token at = {TOKEN_EOF, NULL, 0, line, 0};
+                errorAt(c, node->enumDecl.count > 0 ? node->enumDecl.names[0] : at, "Enums can only be declared at the top level.");
+                break;
+            }
+            int reg = allocReg(c);
+            for (int i = 0; i < node->enumDecl.count; i++) {
+                int64_t value = node->enumDecl.values[i];
+                int ki = emitConstant(c, intValue(c->vm, value));
+                emit(c, ENCODE_ABx(OP_LOADK, reg, ki), line);
+                int ni = internNameConst(c, node->enumDecl.names[i]);
+                emit(c, ENCODE_ABx(OP_DEFCONST, reg, ni), line);
+            }
+            freeRegsTo(c, reg);
             break;
         }
 
@@ -812,9 +2476,27 @@ static void compileStmt(Compiler* c, Node* node) {
             int regObj = allocReg(c);
             int regVal = allocReg(c);
             compileExpr(c, node->propAssign.object, regObj);
-            compileExpr(c, node->propAssign.value, regVal);
             int ki = internNameConst(c, node->propAssign.name);
-            emit(c, ENCODE_ABC(OP_SETPROP, regObj, ki, regVal), line);
+            if (node->propAssign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                emitGetProp(c, regVal, regObj, ki, line);
+                int skip = emitJumpPlaceholder(c, OP_JMPNOTNIL, regVal, line);
+                compileExpr(c, node->propAssign.value, regVal);
+                emitSetProp(c, regObj, ki, regVal, line);
+                patchJump(c->chunk, skip);
+                freeRegsTo(c, regObj);
+                break;
+            }
+            int opcode = compoundOpcode(node->propAssign.operator.type);
+            if (opcode != -1) {
+                bool tempC;
+                emitGetProp(c, regVal, regObj, ki, line);
+                int regC = getOperandReg(c, node->propAssign.value, &tempC);
+                emit(c, ENCODE_ABC(opcode, regVal, regVal, regC), line);
+                if (tempC) freeRegsTo(c, regC);
+            } else {
+                compileExpr(c, node->propAssign.value, regVal);
+            }
+            emitSetProp(c, regObj, ki, regVal, line);
             freeRegsTo(c, regObj);
             break;
         }
@@ -829,7 +2511,7 @@ static void compileStmt(Compiler* c, Node* node) {
             } else {
                 modName = strndup(name.start, name.length);
             }
-            ObjString* modStr = internString(c->vm, modName, strlen(modName));
+            ObjString* modStr = internConstant(c->vm, modName, strlen(modName));
             free(modName);
             int modIdx = emitConstant(c, OBJ_VAL(modStr));
 
@@ -848,6 +2530,13 @@ static void compileStmt(Compiler* c, Node* node) {
         }
 
         default:
+            // A bare expression reaching here is the body of an if, a loop
+            // or a with written without braces: run it for its effects
+            if (isExpressionNode(node)) {
+                int reg = allocReg(c);
+                compileExpr(c, node, reg);
+                freeRegsTo(c, reg);
+            }
             break;
     }
 }
@@ -855,7 +2544,7 @@ static void compileStmt(Compiler* c, Node* node) {
 static void compileNode(Compiler* c, Node* node) {
     if (!node) return;
 
-    if (node->type >= NODE_STMT_VAR_DECL && node->type <= NODE_STMT_PROP_ASSIGN) {
+    if (!isExpressionNode(node) || node->type == NODE_EXPR_UPDATE) {
         compileStmt(c, node);
     } else {
         // Expression statement -> result is discarded
@@ -870,8 +2559,14 @@ static void compileNode(Compiler* c, Node* node) {
 }
 
 bool compileToBytecode(VM* vm, Node* ast, BytecodeChunk* chunk, const char* modulePath) {
+    // Constants go into the chunks without a write barrier, so young
+    // collections wait until they are done; the chunks' functions are
+    // young, having been allocated just before
+    vm->gcYoungHold++;
     Compiler compiler;
     initCompiler(&compiler, vm, chunk, modulePath);
+    if (ast) collectConstants(&compiler, ast);
+    if (ast) collectFunctions(&compiler, ast);
 
     if (ast && ast->type == NODE_STMT_BLOCK) {
         for (int i = 0; i < ast->block.count; i++) {
@@ -881,8 +2576,11 @@ bool compileToBytecode(VM* vm, Node* ast, BytecodeChunk* chunk, const char* modu
         compileNode(&compiler, ast);
     }
 
+    reportMismatchedCalls(&compiler);
+
     // Implicit halt/return at end of script
     emit(&compiler, ENCODE_A(OP_RETURNNIL, 0), 0);
+    if (vm->optimizeBytecode && !compiler.hadError) optimizeChunk(chunk);
 
 #ifdef DEBUG_PRINT_CODE
     if (!compiler.hadError) {
@@ -891,5 +2589,12 @@ bool compileToBytecode(VM* vm, Node* ast, BytecodeChunk* chunk, const char* modu
     }
 #endif
 
+    free(compiler.enumNames);
+    free(compiler.constNames);
+    free(compiler.structs);
+    free(compiler.functions);
+    free(compiler.rebound);
+    free(compiler.mismatchedCalls);
+    vm->gcYoungHold--;
     return !compiler.hadError;
 }
@@ -0,0 +1,218 @@
+#include "bytecode/coverage.h"
+#include "bytecode/opcodes.h"
+#include <stdlib.h>
+#include <string.h>
+
+/**
+ * Keeps a state per source line of every file seen: not executable,
+ * executable, or run. Chunks are found by pointer through a small hash
+ * table, and the last one looked up is remembered, so an instruction in the
+ * same chunk as the one before costs a compare and a store.
+ */
+
+enum { LINE_NONE, LINE_EXECUTABLE, LINE_RUN };
+
+typedef struct {
+    char* path;          // As the functions record it, to match chunks
+    char* name;          // Shown in the report
+    uint8_t* lines;      // LINE_* by line number
+    int lineCount;
+} CoverageFile;
+
+typedef struct {
+    BytecodeChunk* chunk;
+    int file;
+} CoveredChunk;
+
+struct Coverage {
+    CoverageFile* files;
+    int fileCount;
+    CoveredChunk* buckets; // By chunk pointer, NULL chunk when empty
+    int bucketCount;       // Power of two, at least twice chunkCount
+    int chunkCount;
+    BytecodeChunk* lastChunk;
+    int lastFile;          // File of lastChunk, -1 when it has none
+};
+
+Coverage* newCoverage(void) {
+    Coverage* c = calloc(1, sizeof(Coverage));
+    c->bucketCount = 64;
+    c->buckets = calloc(c->bucketCount, sizeof(CoveredChunk));
+    c->lastFile = -1;
+    return c;
+}
+
+void freeCoverage(Coverage* c) {
+    if (!c) return;
+    for (int i = 0; i < c->fileCount; i++) {
+        free(c->files[i].path);
+        free(c->files[i].name);
+        free(c->files[i].lines);
+    }
+    free(c->files);
+    free(c->buckets);
+    free(c);
+}
+
+void forgetCoverageChunks(Coverage* c) {
+    memset(c->buckets, 0, sizeof(CoveredChunk) * c->bucketCount);
+    c->chunkCount = 0;
+    c->lastChunk = NULL;
+    c->lastFile = -1;
+}
+
+static int bucketOf(Coverage* c, BytecodeChunk* chunk) {
+    uintptr_t h = (uintptr_t)chunk >> 4;
+    h ^= h >> 16;
+    int mask = c->bucketCount - 1;
+    int b = (int)(h & (uintptr_t)mask);
+    while (c->buckets[b].chunk != NULL && c->buckets[b].chunk != chunk) b = (b + 1) & mask;
+    return b;
+}
+
+static void addChunk(Coverage* c, BytecodeChunk* chunk, int file) {
+    if ((c->chunkCount + 1) * 2 > c->bucketCount) {
+        CoveredChunk* old = c->buckets;
+        int oldCount = c->bucketCount;
+        c->bucketCount *= 2;
+        c->buckets = calloc(c->bucketCount, sizeof(CoveredChunk));
+        for (int i = 0; i < oldCount; i++) {
+            if (old[i].chunk) c->buckets[bucketOf(c, old[i].chunk)] = old[i];
+        }
+        free(old);
+    }
+    c->buckets[bucketOf(c, chunk)] = (CoveredChunk){chunk, file};
+    c->chunkCount++;
+}
+
+static int fileFor(VM* vm, Coverage* c, const char* path) {
+    for (int i = 0; i < c->fileCount; i++) {
+        if (strcmp(c->files[i].path, path) == 0) return i;
+    }
+    c->files = realloc(c->files, sizeof(CoverageFile) * (c->fileCount + 1));
+    CoverageFile* f = &c->files[c->fileCount];
+    memset(f, 0, sizeof(CoverageFile));
+    f->path = strdup(path);
+    f->name = strdup(displayPath(vm, path));
+    return c->fileCount++;
+}
+
+// The file a function's lines refer to, as in stack traces
+static const char* pathOf(Function* fn, BytecodeChunk* chunk, const char* fallback) {
+    if (chunk->sourcePath) return chunk->sourcePath;
+    if (fn && fn->modulePath) return fn->modulePath;
+    return fallback;
+}
+
+// Count the lines of 'chunk' and of the functions nested in it
+static void addChunkLines(VM* vm, Coverage* c, BytecodeChunk* chunk, const char* path) {
+    if (c->buckets[bucketOf(c, chunk)].chunk == chunk) return;
+    int file = fileFor(vm, c, path);
+    addChunk(c, chunk, file);
+
+    int end = chunk->codeSize;
+    if (end > 0 && DECODE_OP(chunk->code[end - 1]) == OP_RETURNNIL) end--;
+    CoverageFile* f = &c->files[file];
+    for (int pc = 0; pc < end; pc++) {
+        int line = chunk->locations[pc].line;
+        if (line <= 0) continue;
+        if (line >= f->lineCount) {
+            int count = f->lineCount ? f->lineCount : 64;
+            while (count <= line) count *= 2;
+            f->lines = realloc(f->lines, count);
+            memset(f->lines + f->lineCount, LINE_NONE, count - f->lineCount);
+            f->lineCount = count;
+        }
+        if (f->lines[line] == LINE_NONE) f->lines[line] = LINE_EXECUTABLE;
+    }
+
+    for (int i = 0; i < chunk->constantCount; i++) {
+        Value v = chunk->constants[i];
+        if (!IS_OBJ(v) || AS_OBJ(v)->type != OBJ_FUNCTION) continue;
+        Function* fn = (Function*)AS_OBJ(v);
+        if (fn->isNative || !fn->bytecodeChunk) continue;
+        addChunkLines(vm, c, fn->bytecodeChunk, pathOf(fn, fn->bytecodeChunk, path));
+    }
+}
+
+void coverInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip) {
+    Coverage* c = vm->coverage;
+    if (chunk != c->lastChunk) {
+        int b = bucketOf(c, chunk);
+        if (c->buckets[b].chunk != chunk) {
+            // First run of a chunk that is not nested in one seen before:
+            // a script or a module
+            Function* fn = vm->callStackTop > 0 ? vm->callStack[vm->callStackTop - 1].function : NULL;
+            addChunkLines(vm, c, chunk, pathOf(fn, chunk, "<unknown>"));
+            b = bucketOf(c, chunk);
+        }
+        c->lastChunk = chunk;
+        c->lastFile = c->buckets[b].file;
+    }
+    CoverageFile* f = &c->files[c->lastFile];
+    int line = chunk->locations[ip - chunk->code].line;
+    if (line > 0 && line < f->lineCount && f->lines[line] == LINE_EXECUTABLE) f->lines[line] = LINE_RUN;
+}
+
+static int compareFiles(const void* a, const void* b) {
+    return strcmp((*(CoverageFile* const*)a)->name, (*(CoverageFile* const*)b)->name);
+}
+
+static double percent(int run, int total) {
+    return total > 0 ? 100.0 * run / total : 100.0;
+}
+
+// "3, 7-9, 12": runs of executable lines that never ran, however many
+// lines without code lie between them
+static void printMissed(CoverageFile* f, FILE* out) {
+    int first = 0;
+    int last = 0;
+    bool any = false;
+    for (int line = 1; line <= f->lineCount; line++) {
+        uint8_t state = line < f->lineCount ? f->lines[line] : LINE_RUN;
+        if (state == LINE_EXECUTABLE) {
+            if (first == 0) first = line;
+            last = line;
+        } else if (state == LINE_RUN && first != 0) {
+            fprintf(out, any ? ", " : "      not run: ");
+            if (first == last) fprintf(out, "%d", first);
+            else fprintf(out, "%d-%d", first, last);
+            any = true;
+            first = 0;
+        }
+    }
+    if (any) fprintf(out, "\n");
+}
+
+void printCoverage(Coverage* c, FILE* out) {
+    CoverageFile** sorted = malloc(sizeof(CoverageFile*) * (c->fileCount + 1));
+    for (int i = 0; i < c->fileCount; i++) sorted[i] = &c->files[i];
+    qsort(sorted, c->fileCount, sizeof(CoverageFile*), compareFiles);
+    int width = 30; // The name column grows to the longest name
+    for (int i = 0; i < c->fileCount; i++) {
+        int len = (int)strlen(sorted[i]->name);
+        if (len > width) width = len;
+    }
+
+    fprintf(out, "\n=== Coverage ===\n");
+    fprintf(out, "%-*s %8s %8s %8s\n", width + 2, "File", "lines", "run", "cover");
+    int allLines = 0;
+    int allRun = 0;
+    for (int i = 0; i < c->fileCount; i++) {
+        CoverageFile* f = sorted[i];
+        int lines = 0;
+        int run = 0;
+        for (int line = 1; line < f->lineCount; line++) {
+            if (f->lines[line] != LINE_NONE) lines++;
+            if (f->lines[line] == LINE_RUN) run++;
+        }
+        fprintf(out, "  %-*s %8d %8d %7.1f%%\n", width, f->name, lines, run, percent(run, lines));
+        printMissed(f, out);
+        allLines += lines;
+        allRun += run;
+    }
+    if (c->fileCount > 1) {
+        fprintf(out, "  %-*s %8d %8d %7.1f%%\n", width, "total", allLines, allRun, percent(allRun, allLines));
+    }
+    free(sorted);
+}
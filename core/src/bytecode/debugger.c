@@ -0,0 +1,321 @@
+#include "bytecode/debugger.h"
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+
+/**
+ * Breakpoints, stepping and variable inspection for 'unnarize debug'.
+ * Commands are read from dbg->in, one per line.
+ */
+
+void initDebugger(Debugger* dbg, const char* scriptPath, const char* source,
+                  BytecodeChunk* script, FILE* in) {
+    dbg->scriptPath = scriptPath;
+    dbg->source = source;
+    dbg->script = script;
+    dbg->in = in;
+    dbg->breakpointCount = 0;
+    dbg->mode = DEBUG_STEP;
+    dbg->stepDepth = 0;
+    dbg->prevChunk = NULL;
+    dbg->prevIp = NULL;
+    dbg->prevDepth = 0;
+}
+
+// Source line of the instruction at ip, or 0 when unknown
+static int lineAt(BytecodeChunk* chunk, uint32_t* ip) {
+    if (!chunk || !ip) return 0;
+    return chunkLine(chunk, (int)(ip - chunk->code));
+}
+
+// Whether the instruction at ip starts a line: the first one of a call,
+// a different line of the same frame, or, after a return, a line other
+// than the call's own
+static bool entersLine(Debugger* dbg, BytecodeChunk* chunk, uint32_t* ip, int depth, int line) {
+    if (depth > dbg->prevDepth) return true;
+    if (depth < dbg->prevDepth) return line != lineAt(chunk, ip - 1);
+    if (chunk != dbg->prevChunk) return true; // Tail call
+    return line != lineAt(chunk, dbg->prevIp);
+}
+
+static bool inScript(Debugger* dbg, Function* fn) {
+    return fn && fn->modulePath && strcmp(fn->modulePath, dbg->scriptPath) == 0;
+}
+
+// Number of the breakpoint set on 'line', or 0
+static int breakpointAt(Debugger* dbg, int line) {
+    for (int i = 0; i < dbg->breakpointCount; i++) {
+        if (dbg->breakpoints[i] == line) return i + 1;
+    }
+    return 0;
+}
+
+// Whether the chunk or a function compiled inside it has code on 'line'
+static bool hasCodeAt(BytecodeChunk* chunk, int line) {
+    for (int i = 0; i < chunk->codeSize; i++) {
+        if (chunk->locations[i].line == line) return true;
+    }
+    for (int i = 0; i < chunk->constantCount; i++) {
+        Value v = chunk->constants[i];
+        if (!IS_OBJ(v) || AS_OBJ(v)->type != OBJ_FUNCTION) continue;
+        Function* fn = (Function*)AS_OBJ(v);
+        if (!fn->isNative && fn->bytecodeChunk && hasCodeAt(fn->bytecodeChunk, line)) return true;
+    }
+    return false;
+}
+
+static void printFrameName(Function* fn) {
+    if (fn && fn->name.length > 0) {
+        printf("%.*s", fn->name.length, fn->name.start);
+    } else {
+        printf("<module>");
+    }
+}
+
+static void printLocation(Function* fn, int line) {
+    printFrameName(fn);
+    printf(" (%s:%d)\n", fn && fn->modulePath ? fn->modulePath : "<unknown>", line);
+}
+
+static void printSourceLine(Debugger* dbg, int line) {
+    if (!dbg->source) return;
+    const char* start = dbg->source;
+    for (int current = 1; current < line && *start; start++) {
+        if (*start == '\n') current++;
+    }
+    if (!*start) return;
+    const char* end = start;
+    while (*end && *end != '\n') end++;
+    printf("%5d | %.*s\n", line, (int)(end - start), start);
+}
+
+// Strings are quoted so "" and nil can be told apart
+static void printInspected(VM* vm, Value v) {
+    if (IS_STRING(v)) {
+        printf("\"%s\"", AS_CSTRING(v));
+    } else {
+        printValue(vm, v);
+        flushOutput(vm);
+    }
+}
+
+// The innermost in-scope local called 'name' at ip, or NULL
+static LocalDebugInfo* findLocalInfo(BytecodeChunk* chunk, uint32_t* ip, const char* name) {
+    int pc = (int)(ip - chunk->code);
+    for (int i = chunk->localCount - 1; i >= 0; i--) {
+        LocalDebugInfo* info = &chunk->locals[i];
+        if (pc < info->startPc || (info->endPc != -1 && pc >= info->endPc)) continue;
+        if (strcmp(info->name, name) == 0) return info;
+    }
+    return NULL;
+}
+
+static bool findGlobal(VM* vm, const char* name, Value* out) {
+    int length = (int)strlen(name);
+    unsigned int h = hash(name, length) % TABLE_SIZE;
+    for (Environment* env = vm->globalEnv; env; env = env->enclosing) {
+        for (VarEntry* entry = env->buckets[h]; entry; entry = entry->next) {
+            if (entry->keyLength == length && memcmp(entry->key, name, length) == 0) {
+                *out = entry->value;
+                return true;
+            }
+        }
+    }
+    return false;
+}
+
+static void printVariable(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs, const char* name) {
+    Value value;
+    LocalDebugInfo* info = findLocalInfo(chunk, ip, name);
+    if (info) {
+        value = regs[info->reg];
+    } else if (!findGlobal(vm, name, &value)) {
+        printf("No variable named '%s' here.\n", name);
+        return;
+    }
+    printf("%s = ", name);
+    printInspected(vm, value);
+    printf("\n");
+}
+
+// Every in-scope local, in declaration order; a shadowed one is left out
+static void printLocals(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs) {
+    int pc = (int)(ip - chunk->code);
+    int shown = 0;
+    for (int i = 0; i < chunk->localCount; i++) {
+        LocalDebugInfo* info = &chunk->locals[i];
+        if (pc < info->startPc || (info->endPc != -1 && pc >= info->endPc)) continue;
+        if (findLocalInfo(chunk, ip, info->name) != info) continue;
+        printf("  %s = ", info->name);
+        printInspected(vm, regs[info->reg]);
+        printf("\n");
+        shown++;
+    }
+    if (shown == 0) printf("No locals.\n");
+}
+
+// Innermost frame first; callers are shown at their call sites
+static void printBacktrace(VM* vm, BytecodeChunk* chunk, uint32_t* ip) {
+    int depth = vm->callStackTop;
+    for (int k = 0; k < depth; k++) {
+        int line;
+        if (k == 0) {
+            line = lineAt(chunk, ip);
+        } else {
+            CallFrame* callee = &vm->callStack[depth - k];
+            line = callee->ip ? lineAt(callee->chunk, callee->ip - 1) : 0;
+        }
+        printf("#%d ", k);
+        printLocation(vm->callStack[depth - 1 - k].function, line);
+    }
+}
+
+static void addBreakpoint(Debugger* dbg, const char* arg) {
+    char* end;
+    long line = strtol(arg, &end, 10);
+    if (*arg == '\0' || *end != '\0' || line <= 0) {
+        printf("Usage: break <line>\n");
+    } else if (!hasCodeAt(dbg->script, (int)line)) {
+        printf("No code at line %ld.\n", line);
+    } else if (breakpointAt(dbg, (int)line)) {
+        printf("Breakpoint %d is already at line %ld.\n", breakpointAt(dbg, (int)line), line);
+    } else if (dbg->breakpointCount >= DEBUG_BREAKPOINT_MAX) {
+        printf("Too many breakpoints.\n");
+    } else {
+        dbg->breakpoints[dbg->breakpointCount++] = (int)line;
+        printf("Breakpoint %d at line %ld.\n", dbg->breakpointCount, line);
+    }
+}
+
+static void listBreakpoints(Debugger* dbg) {
+    int shown = 0;
+    for (int i = 0; i < dbg->breakpointCount; i++) {
+        if (dbg->breakpoints[i] == 0) continue;
+        printf("  %d: line %d\n", i + 1, dbg->breakpoints[i]);
+        shown++;
+    }
+    if (shown == 0) printf("No breakpoints.\n");
+}
+
+static void deleteBreakpoints(Debugger* dbg, const char* arg) {
+    if (*arg == '\0') {
+        for (int i = 0; i < dbg->breakpointCount; i++) dbg->breakpoints[i] = 0;
+        printf("Deleted all breakpoints.\n");
+        return;
+    }
+    char* end;
+    long n = strtol(arg, &end, 10);
+    if (*end != '\0' || n < 1 || n > dbg->breakpointCount || dbg->breakpoints[n - 1] == 0) {
+        printf("No breakpoint %s.\n", arg);
+        return;
+    }
+    dbg->breakpoints[n - 1] = 0;
+    printf("Deleted breakpoint %ld.\n", n);
+}
+
+static void printHelp(void) {
+    printf("Commands:\n");
+    printf("  break <line>  (b)   stop when execution reaches <line>\n");
+    printf("  break               list breakpoints\n");
+    printf("  delete [n]    (d)   remove breakpoint n, or all of them\n");
+    printf("  continue      (c)   run until the next breakpoint\n");
+    printf("  step          (s)   run to the next line, entering calls\n");
+    printf("  next          (n)   run to the next line, stepping over calls\n");
+    printf("  print <name>  (p)   show a local or global variable\n");
+    printf("  locals              show the locals of the current function\n");
+    printf("  backtrace     (bt)  show the active calls\n");
+    printf("  quit          (q)   stop the program\n");
+}
+
+static bool isCommand(const char* cmd, const char* name, const char* shortName) {
+    return strcmp(cmd, name) == 0 || (shortName && strcmp(cmd, shortName) == 0);
+}
+
+// Read commands until one resumes the program
+static void runPrompt(VM* vm, Debugger* dbg, BytecodeChunk* chunk, uint32_t* ip, Value* regs) {
+    char buf[512];
+    for (;;) {
+        printf("(udb) ");
+        fflush(stdout);
+        if (!fgets(buf, sizeof(buf), dbg->in)) {
+            // End of input: let the program finish
+            printf("\n");
+            vm->debugger = NULL;
+            return;
+        }
+
+        // Split into a command word and the trimmed rest of the line
+        char* cmd = buf;
+        while (isspace((unsigned char)*cmd)) cmd++;
+        char* arg = cmd;
+        while (*arg && !isspace((unsigned char)*arg)) arg++;
+        if (*arg) *arg++ = '\0';
+        while (isspace((unsigned char)*arg)) arg++;
+        char* end = arg + strlen(arg);
+        while (end > arg && isspace((unsigned char)end[-1])) *--end = '\0';
+
+        if (*cmd == '\0') {
+            continue;
+        } else if (isCommand(cmd, "continue", "c")) {
+            dbg->mode = DEBUG_CONTINUE;
+            return;
+        } else if (isCommand(cmd, "step", "s")) {
+            dbg->mode = DEBUG_STEP;
+            return;
+        } else if (isCommand(cmd, "next", "n")) {
+            dbg->mode = DEBUG_NEXT;
+            dbg->stepDepth = vm->callStackTop;
+            return;
+        } else if (isCommand(cmd, "break", "b")) {
+            if (*arg) {
+                addBreakpoint(dbg, arg);
+            } else {
+                listBreakpoints(dbg);
+            }
+        } else if (isCommand(cmd, "delete", "d")) {
+            deleteBreakpoints(dbg, arg);
+        } else if (isCommand(cmd, "print", "p")) {
+            if (*arg) {
+                printVariable(vm, chunk, ip, regs, arg);
+            } else {
+                printf("Usage: print <name>\n");
+            }
+        } else if (isCommand(cmd, "locals", NULL)) {
+            printLocals(vm, chunk, ip, regs);
+        } else if (isCommand(cmd, "backtrace", "bt")) {
+            printBacktrace(vm, chunk, ip);
+        } else if (isCommand(cmd, "help", "h")) {
+            printHelp();
+        } else if (isCommand(cmd, "quit", "q")) {
+            fflush(stdout);
+            exit(0);
+        } else {
+            printf("Unknown command '%s'. Type 'help' for a list.\n", cmd);
+        }
+    }
+}
+
+void debugHook(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs) {
+    Debugger* dbg = vm->debugger;
+    if (!dbg) return;
+
+    int depth = vm->callStackTop;
+    int line = lineAt(chunk, ip);
+    bool entered = entersLine(dbg, chunk, ip, depth, line);
+    dbg->prevChunk = chunk;
+    dbg->prevIp = ip;
+    dbg->prevDepth = depth;
+    if (!entered || line <= 0) return;
+
+    Function* fn = depth > 0 ? vm->callStack[depth - 1].function : NULL;
+    int hit = inScript(dbg, fn) ? breakpointAt(dbg, line) : 0;
+    bool stepDone = dbg->mode == DEBUG_STEP ||
+                    (dbg->mode == DEBUG_NEXT && depth <= dbg->stepDepth);
+    if (!hit && !stepDone) return;
+
+    flushOutput(vm);
+    if (hit) printf("Breakpoint %d at ", hit);
+    printLocation(fn, line);
+    if (inScript(dbg, fn)) printSourceLine(dbg, line);
+    runPrompt(vm, dbg, chunk, ip, regs);
+}
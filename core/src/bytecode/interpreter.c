@@ -4,9 +4,16 @@
 #include "parser.h"
 #include "lexer.h"
 #include "bytecode/compiler.h"
+#include "bytecode/debugger.h"
+#include "bytecode/profiler.h"
+#include "bytecode/coverage.h"
+#include "bytecode/tracer.h"
 #include "vm.h"
-#include <libgen.h>
+#include "scheduler.h"
 #include <stdio.h>
+#include <limits.h>
+#include <math.h>
+#include <time.h>
 #include <sys/time.h>
 
 /**
@@ -21,6 +28,128 @@ static inline uint64_t getMicroseconds() {
     return (uint64_t)tv.tv_sec * 1000000 + tv.tv_usec;
 }
 
+void startTimeout(VM* vm) {
+    vm->deadline = vm->timeoutMs > 0 ? getMicroseconds() + (uint64_t)vm->timeoutMs * 1000 : 0;
+    vm->limitAbort = false;
+    vm->limitCountdown = LIMIT_POLL_INTERVAL;
+}
+
+void pauseTimeout(VM* vm) {
+    if (vm->deadline == 0) return;
+    uint64_t now = getMicroseconds();
+    vm->timeLeft = vm->deadline > now ? vm->deadline - now : 1;
+}
+
+void resumeTimeout(VM* vm) {
+    if (vm->deadline > 0) vm->deadline = getMicroseconds() + vm->timeLeft;
+}
+
+// The --watchdog thread wakes a few times per period and compares the
+// VM's I/O counter with what it saw last. It never touches the VM beyond
+// that: it raises 'fired', and limitExceeded() does the rest on the VM's
+// own thread.
+typedef struct Watchdog {
+    pthread_t thread;
+    pthread_mutex_t mu;
+    pthread_cond_t cv;              // Signalled by stopWatchdog()
+    bool stop;                      // Under mu
+    atomic_bool fired;
+} Watchdog;
+
+static void* watchdogMain(void* arg) {
+    VM* vm = arg;
+    Watchdog* w = vm->watchdog;
+    uint64_t limit = (uint64_t)vm->watchdogMs * 1000;
+    uint64_t tick = limit / 10 < 100000 ? limit / 10 : 100000;
+    uint64_t seen = atomic_load_explicit(&vm->ioProgress, memory_order_relaxed);
+    uint64_t quietSince = getMicroseconds();
+
+    pthread_mutex_lock(&w->mu);
+    while (!w->stop) {
+        struct timespec until;
+        clock_gettime(CLOCK_REALTIME, &until);
+        uint64_t ns = (uint64_t)until.tv_nsec + tick * 1000;
+        until.tv_sec += (time_t)(ns / 1000000000);
+        until.tv_nsec = (long)(ns % 1000000000);
+        pthread_cond_timedwait(&w->cv, &w->mu, &until);
+
+        uint64_t progress = atomic_load_explicit(&vm->ioProgress, memory_order_relaxed);
+        uint64_t now = getMicroseconds();
+        if (progress != seen) {
+            seen = progress;
+            quietSince = now;
+        } else if (now - quietSince >= limit) {
+            atomic_store(&w->fired, true);
+            break;
+        }
+    }
+    pthread_mutex_unlock(&w->mu);
+    return NULL;
+}
+
+void startWatchdog(VM* vm) {
+    if (vm->watchdogMs <= 0 || vm->watchdog) return;
+    Watchdog* w = calloc(1, sizeof(Watchdog));
+    if (!w) return;
+    pthread_mutex_init(&w->mu, NULL);
+    pthread_cond_init(&w->cv, NULL);
+    atomic_init(&w->fired, false);
+    vm->watchdog = w;
+    if (pthread_create(&w->thread, NULL, watchdogMain, vm) != 0) {
+        vm->watchdog = NULL;
+        pthread_cond_destroy(&w->cv);
+        pthread_mutex_destroy(&w->mu);
+        free(w);
+    }
+}
+
+void stopWatchdog(VM* vm) {
+    Watchdog* w = vm->watchdog;
+    if (!w) return;
+    pthread_mutex_lock(&w->mu);
+    w->stop = true;
+    pthread_cond_signal(&w->cv);
+    pthread_mutex_unlock(&w->mu);
+    pthread_join(w->thread, NULL);
+    pthread_cond_destroy(&w->cv);
+    pthread_mutex_destroy(&w->mu);
+    free(w);
+    vm->watchdog = NULL;
+}
+
+// Whether 'extra' more bytes would take the heap past --max-heap, with a
+// full collection first as limitExceeded() does; if so the Error for it is
+// pending and marked uncatchable. A large allocation asks before it is
+// made, so it can't take the memory the limit is there to keep.
+static bool heapLimitExceeded(VM* vm, size_t extra) {
+    if (vm->maxHeap == 0 || vm->bytesAllocated + extra <= vm->maxHeap) return false;
+    collectGarbage(vm);
+    if (vm->bytesAllocated + extra <= vm->maxHeap) return false;
+    nativeError(vm, "Heap limit of %zu bytes exceeded.", vm->maxHeap);
+    vm->limitAbort = true;
+    return true;
+}
+
+// Whether --max-heap or --timeout has been broken; if so the Error for it
+// is pending and marked uncatchable. Live bytes only count after a full
+// collection, so garbage alone never breaks the heap limit.
+static bool limitExceeded(VM* vm) {
+    vm->limitCountdown = LIMIT_POLL_INTERVAL;
+    if (heapLimitExceeded(vm, 0)) return true;
+    if (vm->deadline > 0 && getMicroseconds() >= vm->deadline) {
+        nativeError(vm, "Script timed out after %lld ms.", (long long)vm->timeoutMs);
+        vm->limitAbort = true;
+        return true;
+    }
+    if (vm->watchdog && atomic_load_explicit(&vm->watchdog->fired, memory_order_relaxed)) {
+        nativeError(vm, "Watchdog: no input or output for %lld s; the script looks stuck here.",
+                    (long long)(vm->watchdogMs / 1000));
+        vm->limitAbort = true;
+        return true;
+    }
+    return false;
+}
+
 static char* readFile_internal(const char* path) {
     FILE* file = fopen(path, "rb");
     if (!file) return NULL;
@@ -36,17 +165,362 @@ static char* readFile_internal(const char* path) {
     return buffer;
 }
 
-// Truthiness evaluation
+// Paths under the project root are shown relative to it
+const char* displayPath(VM* vm, const char* path) {
+    size_t rootLen = strlen(vm->projectRoot);
+    if (strncmp(path, vm->projectRoot, rootLen) == 0 && path[rootLen] == '/') return path + rootLen + 1;
+    return path;
+}
+
+// Source position of the instruction at ip, line 0 when unknown
+static SourceLocation locationAt(BytecodeChunk* chunk, uint32_t* ip) {
+    int offset = chunk && ip ? (int)(ip - chunk->code) : -1;
+    if (offset < 0 || offset >= chunk->codeSize) return (SourceLocation){0, 0};
+    return chunk->locations[offset];
+}
+
+// Record where the value being thrown came from: the running function at ip,
+// then every caller at its call site. Deep stacks keep the innermost frames
+// and the bottom one.
+static void captureTrace(VM* vm, BytecodeChunk* chunk, uint32_t* ip) {
+    int depth = vm->callStackTop;
+    vm->errorTraceDepth = depth;
+    vm->errorTraceCount = 0;
+    for (int k = 0; k < depth; k++) {
+        if (k == TRACE_MAX - 1 && depth > TRACE_MAX) k = depth - 1;
+        TraceEntry* entry = &vm->errorTrace[vm->errorTraceCount++];
+        entry->function = vm->callStack[depth - 1 - k].function;
+        SourceLocation at = {0, 0};
+        if (k == 0) {
+            at = locationAt(chunk, ip);
+        } else {
+            // The frame above holds the return address into this one
+            CallFrame* callee = &vm->callStack[depth - k];
+            if (callee->ip) at = locationAt(callee->chunk, callee->ip - 1);
+        }
+        entry->line = at.line;
+        entry->column = at.column;
+    }
+}
+
+// The file a function's lines refer to: for code loaded from a .unc, the
+// source it was compiled from when that was recorded
+static const char* sourcePathOf(Function* f) {
+    if (!f) return NULL;
+    if (f->bytecodeChunk && f->bytecodeChunk->sourcePath) return f->bytecodeChunk->sourcePath;
+    return f->modulePath;
+}
+
+// Line 'line' of a source file with a caret under 'column' (when known),
+// as in compile errors
+static void printSourceLine(const char* path, int line, int column) {
+    size_t len = strlen(path);
+    if (line <= 0 || (len > 4 && strcmp(path + len - 4, ".unc") == 0)) return;
+    char* source = readFile_internal(path);
+    if (!source) return;
+    const char* start = source;
+    for (int current = 1; current < line && *start; start++) {
+        if (*start == '\n') current++;
+    }
+    if (*start) {
+        const char* end = start;
+        while (*end && *end != '\n') end++;
+        fprintf(stderr, "\n   %4d | %.*s\n", line, (int)(end - start), start);
+        if (column > 0 && column <= end - start) {
+            fprintf(stderr, "          ");
+            // Tabs stay tabs so the caret lines up
+            for (int i = 0; i < column - 1; i++) fputc(start[i] == '\t' ? '\t' : ' ', stderr);
+            fprintf(stderr, "^\n");
+        }
+    }
+    free(source);
+}
+
+static void printTraceEntry(VM* vm, TraceEntry* entry) {
+    Function* f = entry->function;
+    const char* path = sourcePathOf(f);
+    const char* file = path ? displayPath(vm, path) : "<unknown>";
+    if (f && f->name.length > 0) {
+        fprintf(stderr, "  at %.*s (%s", f->name.length, f->name.start, file);
+    } else {
+        fprintf(stderr, "  at <module> (%s", file);
+    }
+    if (entry->line > 0) fprintf(stderr, ":%d", entry->line);
+    fprintf(stderr, ")\n");
+}
+
+// Report an exception nothing caught: the message, where it was thrown and
+// the stack captured at that point
+static void reportUncaught(VM* vm) {
+    char msg[512];
+    describeThrown(vm, vm->thrownValue, msg, sizeof(msg));
+    flushOutput(vm);
+
+    TraceEntry* top = vm->errorTraceCount > 0 ? &vm->errorTrace[0] : NULL;
+    const char* path = top ? sourcePathOf(top->function) : NULL;
+    fprintf(stderr, "Runtime Error in %s", path ? displayPath(vm, path) : "<unknown>");
+    if (top && top->line > 0) fprintf(stderr, " at line %d", top->line);
+    fprintf(stderr, ":\n  %s\n", msg);
+    if (path) printSourceLine(path, top->line, top->column);
+
+    if (vm->errorTraceCount == 0) return;
+    fprintf(stderr, "\nStack trace (most recent call first):\n");
+    for (int i = 0; i < vm->errorTraceCount; i++) {
+        if (i == TRACE_MAX - 1 && vm->errorTraceDepth > TRACE_MAX) {
+            fprintf(stderr, "  ... %d more frames\n", vm->errorTraceDepth - TRACE_MAX);
+        }
+        printTraceEntry(vm, &vm->errorTrace[i]);
+    }
+}
+
+// Truthiness: only nil and false are falsy (0 and "" are truthy)
 static inline bool isTruthy(Value v) {
     if (IS_BOOL(v)) return AS_BOOL(v);
     if (IS_NIL(v))  return false;
-    if (IS_INT(v))  return AS_INT(v) != 0;
-    if (IS_FLOAT(v)) return AS_FLOAT(v) != 0.0;
-    return true; // Objects are truthy
+    return true;
 }
 
-#define likely(x)   __builtin_expect(!!(x), 1)
-#define unlikely(x) __builtin_expect(!!(x), 0)
+// Find or create the open upvalue for a register slot.
+// The open list is sorted by slot address, highest first, so closing is a prefix walk.
+static ObjUpvalue* captureUpvalue(VM* vm, Value* slot) {
+    ObjUpvalue* prev = NULL;
+    ObjUpvalue* uv = vm->openUpvalues;
+    while (uv && uv->location > slot) {
+        prev = uv;
+        uv = uv->next;
+    }
+    if (uv && uv->location == slot) return uv;
+
+    ObjUpvalue* created = ALLOCATE_OBJ(vm, ObjUpvalue, OBJ_UPVALUE);
+    created->location = slot;
+    created->closed = NIL_VAL;
+    created->next = uv;
+    if (prev) prev->next = created;
+    else vm->openUpvalues = created;
+    return created;
+}
+
+// Move every open upvalue at or above 'last' off the register file
+static void closeUpvalues(VM* vm, Value* last) {
+    while (vm->openUpvalues && vm->openUpvalues->location >= last) {
+        ObjUpvalue* uv = vm->openUpvalues;
+        uv->closed = *uv->location;
+        uv->location = &uv->closed;
+        GEN_BARRIER_VALUE(vm, uv, uv->closed);
+        vm->openUpvalues = uv->next;
+    }
+}
+
+// A call may pass requiredCount..paramCount arguments, or any number from
+// requiredCount up when the last parameter collects the rest
+static inline bool arityFits(Function* func, int argCount) {
+    return argCount >= func->requiredCount && (argCount <= func->paramCount || func->isVariadic);
+}
+
+// OP_CALLNAMED: lay the 'argCount' arguments after R(funcReg) out by
+// parameter, as bindNamedArguments does, using the names in the string
+// after them. Returns the new argument count, or -1 with the error in 'msg'.
+static int bindCallNamed(VM* vm, Value* regs, int funcReg, int argCount, char* msg, size_t size) {
+    Value callee = regs[funcReg];
+    Function* func = NULL;
+    int first = 0;
+    if (IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_FUNCTION) {
+        func = (Function*)AS_OBJ(callee);
+    } else if (IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_BOUND_METHOD) {
+        func = ((BoundMethod*)AS_OBJ(callee))->method;
+        first = 1; // The receiver is passed when the call is made
+    }
+    if (!func) {
+        snprintf(msg, size, "Cannot pass named arguments to %s.", valueTypeName(callee));
+        return -1;
+    }
+
+    // "host port": one word per named argument
+    ObjString* list = (ObjString*)AS_OBJ(regs[funcReg + argCount + 1]);
+    Token names[FRAME_REG_MAX];
+    int namedCount = 0;
+    for (const char* p = list->chars; *p; ) {
+        const char* end = strchr(p, ' ');
+        int length = end ? (int)(end - p) : (int)strlen(p);
+        names[namedCount++] = (Token){TOKEN_IDENTIFIER, p, length, 0, 0};
+        p += length + (end ? 1 : 0);
+    }
+
+    int positional = argCount - namedCount;
+    if (func->paramCount > FRAME_REG_MAX || vm->regBase + funcReg + func->paramCount + 1 >= STACK_MAX) {
+        snprintf(msg, size, "Stack overflow.");
+        return -1;
+    }
+    Value out[FRAME_REG_MAX];
+    Value* args = &regs[funcReg + 1];
+    int count = bindNamedArguments(func, first, args, positional, names, args + positional,
+                                   namedCount, out, msg, size);
+    if (count >= 0) memcpy(args, out, sizeof(Value) * count);
+    return count;
+}
+
+// Gather the arguments past a variadic function's other parameters into a
+// new array for its last one. The caller keeps 'args' rooted. Returns how
+// many of the other parameters were passed, the count OP_JMPARG tests.
+static int collectRest(VM* vm, Function* func, Value* args, int argCount, Value* rest) {
+    int fixed = func->paramCount - 1;
+    Array* arr = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(arr); // Root while it grows
+    for (int i = fixed; i < argCount; i++) arrayPush(vm, arr, args[i]);
+    vm->stackTop--;
+    *rest = OBJ_VAL(arr);
+    return argCount < fixed ? argCount : fixed;
+}
+
+bool callGuarded(VM* vm, Function* func, Value* args, int argCount, Value* result, Value* thrown) {
+    if (vm->tryHandlerCount >= TRY_HANDLER_MAX) {
+        *thrown = newError(vm, "Too many nested try blocks.");
+        return false;
+    }
+    int depth = vm->callStackTop;
+    int base = vm->regTop;
+    int savedHandlers = vm->tryHandlerCount;
+
+    // A handler below the call makes an uncaught throw return instead of
+    // exiting (see throw_value); it is never jumped to
+    TryHandler* guard = &vm->tryHandlers[vm->tryHandlerCount++];
+    memset(guard, 0, sizeof(*guard));
+    guard->frameDepth = depth;
+
+    Value value;
+    if (func->isNative) {
+        vm->nativeCallee = func;
+        value = func->native(vm, args, argCount);
+    } else {
+        value = callBytecodeFunction(vm, func, args, argCount);
+    }
+    vm->tryHandlerCount = savedHandlers;
+    if (!vm->throwPending) {
+        if (result) *result = value;
+        return true;
+    }
+
+    // Unwind what the throw left behind. A broken limit stays broken, so
+    // the caller's own throw of it ends the run too
+    if (vm->openUpvalues) closeUpvalues(vm, vm->registers + base);
+    vm->callStackTop = depth;
+    *thrown = vm->thrownValue;
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    return false;
+}
+
+// The trace of an error in flight, put aside while deferred calls run
+typedef struct {
+    TraceEntry entries[TRACE_MAX];
+    int count;
+    int depth;
+} SavedTrace;
+
+static void saveTrace(VM* vm, SavedTrace* trace) {
+    memcpy(trace->entries, vm->errorTrace, sizeof(TraceEntry) * vm->errorTraceCount);
+    trace->count = vm->errorTraceCount;
+    trace->depth = vm->errorTraceDepth;
+}
+
+static void restoreTrace(VM* vm, SavedTrace* trace) {
+    memcpy(vm->errorTrace, trace->entries, sizeof(TraceEntry) * trace->count);
+    vm->errorTraceCount = trace->count;
+    vm->errorTraceDepth = trace->depth;
+}
+
+// Run the calls deferred in the frame at 'depth', the top frame, the last
+// one first. 'chunk' and 'ip' are where that frame stopped. Every call runs
+// even when one before it throws; false when any threw, with the last of
+// those errors in vm->thrownValue and its trace in vm->errorTrace.
+static bool runDefers(VM* vm, int depth, BytecodeChunk* chunk, uint32_t* ip) {
+    Array* defers = vm->callStack[depth].defers;
+    vm->callStack[depth].defers = NULL;
+    int root = vm->stackTop;
+    vm->stack[vm->stackTop++] = OBJ_VAL(defers);
+    vm->stack[vm->stackTop++] = NIL_VAL; // The last error thrown
+    SavedTrace trace;
+    saveTrace(vm, &trace);
+
+    bool ok = true;
+    for (int i = defers->count - 1; i >= 0; i--) {
+        Array* call = (Array*)AS_OBJ(defers->items[i]);
+        Value thrown;
+        vm->nativeChunk = chunk;
+        vm->nativeIp = ip;
+        vm->errorTraceCount = 0;
+        if (callGuarded(vm, (Function*)AS_OBJ(call->items[0]), call->items + 1, call->count - 1, NULL, &thrown)) {
+            continue;
+        }
+        if (vm->errorTraceCount == 0) captureTrace(vm, chunk, ip); // A native threw
+        saveTrace(vm, &trace);
+        vm->stack[root + 1] = thrown;
+        ok = false;
+    }
+    restoreTrace(vm, &trace);
+    if (!ok) vm->thrownValue = vm->stack[root + 1];
+    vm->stackTop = root;
+    return ok;
+}
+
+// A throw is leaving the frames from the top down to 'floorDepth': run their
+// deferred calls, the innermost frame's first. An error from one of them
+// replaces the one in flight. 'chunk' and 'ip' are where the throw happened.
+static void unwindDefers(VM* vm, int floorDepth, BytecodeChunk* chunk, uint32_t* ip) {
+    int top = vm->callStackTop;
+    int depth = top - 1;
+    while (depth >= floorDepth && !vm->callStack[depth].defers) depth--;
+    if (depth < floorDepth) return;
+
+    // The calls run as usual, catching what they throw even in a panic; a
+    // panic from one of them makes the error in flight one
+    bool panicking = vm->panicking;
+    vm->panicking = false;
+    int root = vm->stackTop;
+    vm->stack[vm->stackTop++] = vm->thrownValue;
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    for (; depth >= floorDepth; depth--) {
+        if (!vm->callStack[depth].defers) continue;
+        // A frame below the top stopped at its call into the one above
+        BytecodeChunk* atChunk = chunk;
+        uint32_t* atIp = ip;
+        if (depth < top - 1) {
+            CallFrame* above = &vm->callStack[depth + 1];
+            atChunk = above->chunk;
+            atIp = above->ip ? above->ip - 1 : NULL;
+        }
+        vm->callStackTop = depth + 1;
+        if (!runDefers(vm, depth, atChunk, atIp)) vm->stack[root] = vm->thrownValue;
+    }
+    vm->thrownValue = vm->stack[root];
+    vm->throwPending = true;
+    vm->panicking = panicking || vm->panicking;
+    vm->stackTop = root;
+}
+
+// Call the __close__ of a with block's resource; 'chunk' and 'ip' are the
+// instruction closing it. A nil resource has nothing to close. False when
+// __close__ threw, with its error in vm->thrownValue.
+static bool closeResource(VM* vm, Value resource, BytecodeChunk* chunk, uint32_t* ip) {
+    Function* closer = resourceCloser(resource);
+    if (!closer) return true;
+    Value thrown;
+    vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+    vm->nativeChunk = chunk;
+    vm->nativeIp = ip;
+    vm->errorTraceCount = 0;
+    if (callGuarded(vm, closer, &resource, 1, NULL, &thrown)) return true;
+    if (vm->errorTraceCount == 0) captureTrace(vm, chunk, ip);
+    vm->thrownValue = thrown;
+    return false;
+}
+
+// Threaded dispatch needs labels-as-values (GCC/Clang); build with
+// -DUNNARIZE_SWITCH_DISPATCH (make DISPATCH=switch) to use a plain switch
+#if defined(__GNUC__) && !defined(UNNARIZE_SWITCH_DISPATCH)
+#define UNNARIZE_COMPUTED_GOTO
+#endif
 
 uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
     uint64_t startTime = getMicroseconds();
@@ -58,71 +532,192 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
     register uint32_t* ip = chunk->code;
     register Value* constants = chunk->constants;
 
-#ifdef __GNUC__
-    // Computed goto dispatch table (must match OpCode enum order exactly)
-    static void* dispatchTable[OPCODE_COUNT] = {
-        [OP_MOVE]       = &&op_move,
-        [OP_LOADK]      = &&op_loadk,
-        [OP_LOADI]      = &&op_loadi,
-        [OP_LOADNIL]    = &&op_loadnil,
-        [OP_LOADTRUE]   = &&op_loadtrue,
-        [OP_LOADFALSE]  = &&op_loadfalse,
-        [OP_GETGLOBAL]  = &&op_getglobal,
-        [OP_SETGLOBAL]  = &&op_setglobal,
-        [OP_DEFGLOBAL]  = &&op_defglobal,
-        [OP_ADD]        = &&op_add,
-        [OP_ADDI]       = &&op_addi,
-        [OP_SUB]        = &&op_sub,
-        [OP_SUBI]       = &&op_subi,
-        [OP_MUL]        = &&op_mul,
-        [OP_DIV]        = &&op_div,
-        [OP_MOD]        = &&op_mod,
-        [OP_NEG]        = &&op_neg,
-        [OP_LT]         = &&op_lt,
-        [OP_LE]         = &&op_le,
-        [OP_GT]         = &&op_gt,
-        [OP_GE]         = &&op_ge,
-        [OP_EQ]         = &&op_eq,
-        [OP_NE]         = &&op_ne,
-        [OP_NOT]        = &&op_not,
-        [OP_JMP]        = &&op_jmp,
-        [OP_JMPF]       = &&op_jmpf,
-        [OP_JMPT]       = &&op_jmpt,
-        [OP_LOOP]       = &&op_loop,
-        [OP_CALL]       = &&op_call,
-        [OP_RETURN]     = &&op_return,
-        [OP_RETURNNIL]  = &&op_returnnil,
-        [OP_GETPROP]    = &&op_getprop,
-        [OP_SETPROP]    = &&op_setprop,
-        [OP_GETIDX]     = &&op_getidx,
-        [OP_SETIDX]     = &&op_setidx,
-        [OP_NEWARRAY]   = &&op_newarray,
-        [OP_NEWMAP]     = &&op_newmap,
-        [OP_NEWSTRUCT]  = &&op_newstruct,
-        [OP_STRUCTDEF]  = &&op_structdef,
-        [OP_PUSH]       = &&op_push,
-        [OP_POP]        = &&op_pop_arr,
-        [OP_LEN]        = &&op_len,
-        [OP_IMPORT]     = &&op_import,
-        [OP_ASYNC]      = &&op_async,
-        [OP_AWAIT]      = &&op_await,
-        [OP_PRINT]      = &&op_print,
-        [OP_HALT]       = &&op_halt,
-        [OP_NOP]        = &&op_nop,
-        [OP_FOREACH_PREP] = &&op_nop,
-        [OP_FOREACH_NEXT] = &&op_nop,
-        [OP_CONCAT]     = &&op_concat,
-    };
+    // Handlers below this belong to an outer activation (e.g. the importer)
+    int handlerFloor = vm->tryHandlerCount;
+
+    // Operands of the call being made, shared by OP_CALL, OP_CALLSPREAD and OP_CALLNAMED
+    int callReg = 0, callArgCount = 0, callResultCount = 0;
+
+    // Handler label for each opcode
+    #define OPCODE_HANDLERS(X) \
+    X(OP_MOVE,         op_move) \
+    X(OP_LOADK,        op_loadk) \
+    X(OP_LOADI,        op_loadi) \
+    X(OP_LOADNIL,      op_loadnil) \
+    X(OP_LOADTRUE,     op_loadtrue) \
+    X(OP_LOADFALSE,    op_loadfalse) \
+    X(OP_GETGLOBAL,    op_getglobal) \
+    X(OP_SETGLOBAL,    op_setglobal) \
+    X(OP_DEFGLOBAL,    op_defglobal) \
+    X(OP_DEFCONST,     op_defconst) \
+    X(OP_ADD,          op_add) \
+    X(OP_ADDI,         op_addi) \
+    X(OP_SUB,          op_sub) \
+    X(OP_SUBI,         op_subi) \
+    X(OP_MUL,          op_mul) \
+    X(OP_DIV,          op_div) \
+    X(OP_IDIV,         op_idiv) \
+    X(OP_MOD,          op_mod) \
+    X(OP_NEG,          op_neg) \
+    X(OP_BAND,         op_band) \
+    X(OP_BOR,          op_bor) \
+    X(OP_BXOR,         op_bxor) \
+    X(OP_SHL,          op_shl) \
+    X(OP_SHR,          op_shr) \
+    X(OP_BNOT,         op_bnot) \
+    X(OP_INC,          op_inc) \
+    X(OP_DEC,          op_dec) \
+    X(OP_LT,           op_lt) \
+    X(OP_LE,           op_le) \
+    X(OP_GT,           op_gt) \
+    X(OP_GE,           op_ge) \
+    X(OP_EQ,           op_eq) \
+    X(OP_NE,           op_ne) \
+    X(OP_NOT,          op_not) \
+    X(OP_JMP,          op_jmp) \
+    X(OP_JMPF,         op_jmpf) \
+    X(OP_JMPT,         op_jmpt) \
+    X(OP_LOOP,         op_loop) \
+    X(OP_JMPARG,       op_jmparg) \
+    X(OP_JMPNIL,       op_jmpnil) \
+    X(OP_JMPNOTNIL,    op_jmpnotnil) \
+    X(OP_CALL,         op_call) \
+    X(OP_TAILCALL,     op_tailcall) \
+    X(OP_CALLSPREAD,   op_callspread) \
+    X(OP_CALLNAMED,    op_callnamed) \
+    X(OP_RETURN,       op_return) \
+    X(OP_RETURNNIL,    op_returnnil) \
+    X(OP_CLOSURE,      op_closure) \
+    X(OP_GETUPVAL,     op_getupval) \
+    X(OP_SETUPVAL,     op_setupval) \
+    X(OP_CLOSE,        op_close) \
+    X(OP_GETPROP,      op_getprop) \
+    X(OP_SETPROP,      op_setprop) \
+    X(OP_GETPROPR,     op_getprop) \
+    X(OP_SETPROPR,     op_setprop) \
+    X(OP_GETIDX,       op_getidx) \
+    X(OP_SETIDX,       op_setidx) \
+    X(OP_SLICE,        op_slice) \
+    X(OP_NEWARRAY,     op_newarray) \
+    X(OP_NEWMAP,       op_newmap) \
+    X(OP_NEWSET,       op_newset) \
+    X(OP_NEWSTRUCT,    op_newstruct) \
+    X(OP_STRUCTDEF,    op_structdef) \
+    X(OP_METHOD,       op_method) \
+    X(OP_PUSH,         op_push) \
+    X(OP_SPREAD,       op_spread) \
+    X(OP_POP,          op_pop_arr) \
+    X(OP_LEN,          op_len) \
+    X(OP_IMPORT,       op_import) \
+    X(OP_ASYNC,        op_async) \
+    X(OP_AWAIT,        op_await) \
+    X(OP_SPAWN,        op_spawn) \
+    X(OP_PRINT,        op_print) \
+    X(OP_HALT,         op_halt) \
+    X(OP_NOP,          op_nop) \
+    X(OP_FOREACH_PREP, op_foreach_prep) \
+    X(OP_FOREACH_NEXT, op_foreach_next) \
+    X(OP_CONCAT,       op_concat) \
+    X(OP_TRY,          op_try) \
+    X(OP_ENDTRY,       op_endtry) \
+    X(OP_THROW,        op_throw) \
+    X(OP_DEFER,        op_defer) \
+    X(OP_WITH,         op_with) \
+    X(OP_ENDWITH,      op_endwith)
+
+#ifdef UNNARIZE_COMPUTED_GOTO
+    // Direct threading: each handler jumps straight to the next one
+    #define TABLE_ENTRY(op, label) [op] = &&label,
+    static void* dispatchTable[OPCODE_COUNT] = { OPCODE_HANDLERS(TABLE_ENTRY) };
+    #undef TABLE_ENTRY
+
+    // Under the debugger, --trace, --profile, --coverage or unnStep every
+    // opcode enters debug_hook first, so normal runs pay nothing for any of them
+    static void* debugTable[OPCODE_COUNT] = { [0 ... OPCODE_COUNT - 1] = &&debug_hook };
+    void** handlers = (vm->debugger || vm->traceOut || vm->profiler || vm->coverage || vm->stepper) ? debugTable : dispatchTable;
 
     #define DISPATCH() do { \
         uint32_t _inst = *ip; \
-        goto *dispatchTable[DECODE_OP(_inst)]; \
+        goto *handlers[DECODE_OP(_inst)]; \
     } while(0)
+#else
+    // Portable fallback: every handler returns to one switch (see dispatch_switch)
+    #define DISPATCH() goto dispatch_switch
+#endif
     #define NEXT() do { ip++; DISPATCH(); } while(0)
     #define FETCH() (*ip)
 
+    // --max-heap and --timeout, checked every LIMIT_POLL_INTERVAL polls.
+    // Loops poll at their back jump and recursion at each call, so no
+    // script runs long without one. Spawned coroutines take turns here too.
+    #define POLL_LIMITS() do { \
+            if (unlikely(--vm->limitCountdown <= 0)) { \
+                vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1); \
+                if (limitExceeded(vm)) { \
+                    captureTrace(vm, chunk, ip); \
+                    goto throw_value; \
+                } \
+                if (vm->scheduler && !yieldCoroutine(vm)) { \
+                    if (vm->errorTraceCount == 0) captureTrace(vm, chunk, ip); \
+                    goto throw_value; \
+                } \
+            } \
+        } while (0)
+
+    // Runtime errors throw an Error value so try/catch can handle them
+    #define RUNTIME_ERROR(...) do { \
+        char _msg[256]; \
+        snprintf(_msg, sizeof(_msg), __VA_ARGS__); \
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1); \
+        vm->thrownValue = newError(vm, _msg); \
+        captureTrace(vm, chunk, ip); \
+        goto throw_value; \
+    } while (0)
+
+    // Returning from a frame drops the try blocks it left open
+    #define POP_FRAME_HANDLERS() do { \
+        while (vm->tryHandlerCount > handlerFloor && \
+               vm->tryHandlers[vm->tryHandlerCount - 1].frameDepth > vm->callStackTop) { \
+            vm->tryHandlerCount--; \
+        } \
+    } while (0)
+
+    // Compiled code pairs every ENDTRY and ENDWITH with a handler its own
+    // frame pushed; a loaded image is not trusted to
+    #define POP_OWN_HANDLER() do { \
+        if (unlikely(vm->tryHandlerCount <= handlerFloor || \
+                     vm->tryHandlers[vm->tryHandlerCount - 1].frameDepth != vm->callStackTop)) { \
+            RUNTIME_ERROR("Bytecode ends a try block it never started."); \
+        } \
+        vm->tryHandlerCount--; \
+    } while (0)
+
+#ifdef UNNARIZE_COMPUTED_GOTO
     DISPATCH();
 
+debug_hook:
+    if (vm->profiler) profileInstruction(vm, chunk, ip);
+    if (vm->coverage) coverInstruction(vm, chunk, ip);
+    if (vm->traceOut) traceInstruction(vm, chunk, ip, regs);
+    if (vm->debugger) debugHook(vm, chunk, ip, regs);
+    if (vm->stepper) stepHook(vm);
+    if (!vm->debugger && !vm->traceOut && !vm->profiler && !vm->coverage && !vm->stepper) handlers = dispatchTable;
+    goto *dispatchTable[DECODE_OP(*ip)];
+#else
+dispatch_switch:
+    if (vm->profiler) profileInstruction(vm, chunk, ip);
+    if (vm->coverage) coverInstruction(vm, chunk, ip);
+    if (vm->traceOut) traceInstruction(vm, chunk, ip, regs);
+    if (vm->debugger) debugHook(vm, chunk, ip, regs);
+    if (vm->stepper) stepHook(vm);
+    switch (DECODE_OP(*ip)) {
+        #define SWITCH_CASE(op, label) case op: goto label;
+        OPCODE_HANDLERS(SWITCH_CASE)
+        #undef SWITCH_CASE
+        default: RUNTIME_ERROR("Unknown opcode %d.", (int)DECODE_OP(*ip));
+    }
+#endif
+
     // ===== DATA MOVEMENT =====
     op_move: {
         uint32_t inst = FETCH();
@@ -168,17 +763,19 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint16_t bx = DECODE_Bx(inst);
         ObjString* name = AS_STRING(constants[bx]);
         unsigned int h = name->hash % TABLE_SIZE;
-        VarEntry* entry = vm->globalEnv->buckets[h];
-        while (entry) {
-            if (entry->key == name->chars ||
-                (entry->keyLength == name->length && memcmp(entry->key, name->chars, name->length) == 0)) {
-                regs[a] = entry->value;
-                goto getglobal_done;
+        // Module globals first, then the script's (natives, core libraries)
+        for (Environment* env = vm->globalEnv; env; env = env->enclosing) {
+            VarEntry* entry = env->buckets[h];
+            while (entry) {
+                if (entry->key == name->chars ||
+                    (entry->keyLength == name->length && memcmp(entry->key, name->chars, name->length) == 0)) {
+                    regs[a] = entry->value;
+                    goto getglobal_done;
+                }
+                entry = entry->next;
             }
-            entry = entry->next;
         }
-        printf("Runtime Error: Undefined variable '%s'\n", name->chars);
-        exit(1);
+        RUNTIME_ERROR("Undefined variable '%s'", name->chars);
         getglobal_done:
         NEXT();
     }
@@ -193,8 +790,12 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         while (entry) {
             if (entry->key == name->chars ||
                 (entry->keyLength == name->length && memcmp(entry->key, name->chars, name->length) == 0)) {
+                // The compiler knows only its own script's consts; code
+                // compiled apart from them, as eval() is, meets them here
+                if (unlikely(entry->isConst)) RUNTIME_ERROR("Cannot assign to constant '%s'", name->chars);
                 entry->value = regs[a];
                 WRITE_BARRIER(vm, vm->globalEnv);
+                GEN_BARRIER_VALUE(vm, vm->globalEnv, regs[a]);
                 NEXT();
             }
             entry = entry->next;
@@ -206,16 +807,21 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         ne->keyLength = name->length;
         ne->ownsKey = false;
         ne->value = regs[a];
+        ne->isConst = false;
         ne->next = vm->globalEnv->buckets[h];
         vm->globalEnv->buckets[h] = ne;
         WRITE_BARRIER(vm, vm->globalEnv);
+        GEN_BARRIER(vm, vm->globalEnv, name);
+        GEN_BARRIER_VALUE(vm, vm->globalEnv, regs[a]);
         NEXT();
     }
 
-    op_defglobal: {
+    op_defglobal:
+    op_defconst: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst);
         uint16_t bx = DECODE_Bx(inst);
+        bool isConst = DECODE_OP(inst) == OP_DEFCONST;
         ObjString* name = AS_STRING(constants[bx]);
         unsigned int h = name->hash % TABLE_SIZE;
 
@@ -223,8 +829,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         while (entry) {
             if (entry->key == name->chars ||
                 (entry->keyLength == name->length && memcmp(entry->key, name->chars, name->length) == 0)) {
+                if (unlikely(entry->isConst)) {
+                    if (isConst) RUNTIME_ERROR("Constant '%s' is already declared", name->chars);
+                    RUNTIME_ERROR("Cannot assign to constant '%s'", name->chars);
+                }
                 entry->value = regs[a];
+                entry->isConst = isConst;
                 WRITE_BARRIER(vm, vm->globalEnv);
+                GEN_BARRIER_VALUE(vm, vm->globalEnv, regs[a]);
                 goto defglobal_done;
             }
             entry = entry->next;
@@ -237,57 +849,107 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
             ne->keyLength = name->length;
             ne->ownsKey = false;
             ne->value = regs[a];
+            ne->isConst = isConst;
             ne->next = vm->globalEnv->buckets[h];
             vm->globalEnv->buckets[h] = ne;
             WRITE_BARRIER(vm, vm->globalEnv);
+            GEN_BARRIER(vm, vm->globalEnv, name);
+            GEN_BARRIER_VALUE(vm, vm->globalEnv, regs[a]);
         }
         defglobal_done:
         NEXT();
     }
 
     // ===== ARITHMETIC =====
+    #define OVERFLOW_ERROR(x, sym, y) \
+        RUNTIME_ERROR("Integer overflow in %lld " sym " %lld.", (long long)(x), (long long)(y))
+
+    // R(dest) = an int result; one too wide to store inline is boxed, with
+    // the frame's registers rooted in case that collects
+    #define INT_RESULT(dest, n) do { \
+            int64_t n_ = (n); \
+            if (likely(INT_FITS_INLINE(n_))) { regs[dest] = INT_VAL(n_); } \
+            else { \
+                vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1); \
+                regs[dest] = intValue(vm, n_); \
+            } \
+        } while (0)
+
+    // Runs script code from inside a handler: the frame's registers stay
+    // in use and a throw from the callee is rethrown at this instruction
+    #define CALL_BACK(call) do { \
+            vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1); \
+            vm->nativeChunk = chunk; \
+            vm->nativeIp = ip; \
+            call; \
+            if (unlikely(vm->throwPending)) { \
+                if (vm->errorTraceCount == 0) captureTrace(vm, chunk, ip); \
+                goto throw_value; \
+            } \
+        } while (0)
+
+    // A struct on the left of the operator may define it (__add__, __lt__,
+    // ...); without the method the opcode goes on to its own fallback
+    #define STRUCT_OPERATOR(name, x, y) do { \
+            if (IS_OBJ(x) && AS_OBJ(x)->type == OBJ_STRUCT_INSTANCE) { \
+                Value opResult; \
+                bool found; \
+                CALL_BACK(found = callOperator(vm, name, x, y, &opResult)); \
+                if (found) { regs[a] = opResult; NEXT(); } \
+            } \
+        } while (0)
+    // Two sets: '|' is the union, '&' the intersection and '-' the difference
+    #define SET_OPERATOR(op, dest, x, y) do { \
+            if (IS_SET(x) && IS_SET(y)) { \
+                vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1); \
+                regs[dest] = OBJ_VAL(setOperation(vm, op, (Map*)AS_OBJ(x), (Map*)AS_OBJ(y))); \
+                NEXT(); \
+            } \
+        } while (0)
+    #define STRUCT_COMPARE(op, x, y) do { \
+            if (IS_OBJ(x) && AS_OBJ(x)->type == OBJ_STRUCT_INSTANCE) { \
+                bool holds = false; \
+                bool found; \
+                CALL_BACK(found = compareOperator(vm, op, x, y, &holds)); \
+                if (found) { regs[a] = BOOL_VAL(holds); NEXT(); } \
+            } \
+        } while (0)
+
     op_add: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
 
         if (likely(IS_INT(vb) && IS_INT(vc))) {
-            regs[a] = INT_VAL(AS_INT(vb) + AS_INT(vc));
-        } else if (IS_NUMBER(vb) && IS_NUMBER(vc)) {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = FLOAT_VAL(db + dc);
-        } else if (IS_STRING(vb) || IS_STRING(vc)) {
-            // String concatenation
+            int64_t r;
+            if (unlikely(!intAdd(AS_INT(vb), AS_INT(vc), &r))) OVERFLOW_ERROR(AS_INT(vb), "+", AS_INT(vc));
+            INT_RESULT(a, r);
+        } else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = FLOAT_VAL(AS_NUMERIC(vb) + AS_NUMERIC(vc));
+        } else {
+            STRUCT_OPERATOR("__add__", vb, vc);
+            if (!IS_STRING(vb) && !IS_STRING(vc)) RUNTIME_ERROR("Operands of '+' must be numbers.");
+            // String concatenation; a struct with __str__ joins in as its text
+            ObjString* text = NULL;
+            if (IS_OBJ(vb) && AS_OBJ(vb)->type == OBJ_STRUCT_INSTANCE) {
+                CALL_BACK(text = structString(vm, vb));
+                if (text) vb = OBJ_VAL(text);
+            } else if (IS_OBJ(vc) && AS_OBJ(vc)->type == OBJ_STRUCT_INSTANCE) {
+                CALL_BACK(text = structString(vm, vc));
+                if (text) vc = OBJ_VAL(text);
+            }
             vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
             char bufB[64], bufC[64];
-            const char* sB;
-            const char* sC;
-
-            if (IS_STRING(vb)) sB = AS_CSTRING(vb);
-            else if (IS_INT(vb)) { snprintf(bufB, 64, "%ld", (long)AS_INT(vb)); sB = bufB; }
-            else if (IS_FLOAT(vb)) { snprintf(bufB, 64, "%.14g", AS_FLOAT(vb)); sB = bufB; }
-            else if (IS_BOOL(vb)) sB = AS_BOOL(vb) ? "true" : "false";
-            else if (IS_NIL(vb)) sB = "nil";
-            else sB = "[object]";
-
-            if (IS_STRING(vc)) sC = AS_CSTRING(vc);
-            else if (IS_INT(vc)) { snprintf(bufC, 64, "%ld", (long)AS_INT(vc)); sC = bufC; }
-            else if (IS_FLOAT(vc)) { snprintf(bufC, 64, "%.14g", AS_FLOAT(vc)); sC = bufC; }
-            else if (IS_BOOL(vc)) sC = AS_BOOL(vc) ? "true" : "false";
-            else if (IS_NIL(vc)) sC = "nil";
-            else sC = "[object]";
-
-            size_t lenB = strlen(sB), lenC = strlen(sC);
+            const char* sB = valueToChars(vb, bufB, sizeof(bufB));
+            const char* sC = valueToChars(vc, bufC, sizeof(bufC));
+
+            size_t lenB = IS_STRING(vb) ? (size_t)AS_STRING(vb)->length : strlen(sB);
+            size_t lenC = IS_STRING(vc) ? (size_t)AS_STRING(vc)->length : strlen(sC);
             char* result = malloc(lenB + lenC + 1);
             memcpy(result, sB, lenB);
             memcpy(result + lenB, sC, lenC);
             result[lenB + lenC] = '\0';
-            ObjString* str = internString(vm, result, lenB + lenC);
-            free(result);
-            regs[a] = OBJ_VAL(str);
-        } else {
-            regs[a] = NIL_VAL;
+            regs[a] = OBJ_VAL(takeString(vm, result, (int)(lenB + lenC)));
         }
         NEXT();
     }
@@ -299,11 +961,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         Value vb = regs[a]; // For ADDI, we usually accumulate to R(A), wait, format is AsBx?
         // Let's use AsBx format: R(A) = R(A) + sBx
         if (likely(IS_INT(vb))) {
-            regs[a] = INT_VAL(AS_INT(vb) + val);
+            int64_t r;
+            if (unlikely(!intAdd(AS_INT(vb), val, &r))) OVERFLOW_ERROR(AS_INT(vb), "+", val);
+            INT_RESULT(a, r);
         } else if (IS_FLOAT(vb)) {
             regs[a] = FLOAT_VAL(AS_FLOAT(vb) + (double)val);
         } else {
-            // Unlikely string fallback
+            STRUCT_OPERATOR("__add__", vb, INT_VAL(val));
+            RUNTIME_ERROR("Operands of '+' must be numbers.");
         }
         NEXT();
     }
@@ -313,11 +978,15 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) {
-            regs[a] = INT_VAL(AS_INT(vb) - AS_INT(vc));
+            int64_t r;
+            if (unlikely(!intSub(AS_INT(vb), AS_INT(vc), &r))) OVERFLOW_ERROR(AS_INT(vb), "-", AS_INT(vc));
+            INT_RESULT(a, r);
+        } else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = FLOAT_VAL(AS_NUMERIC(vb) - AS_NUMERIC(vc));
         } else {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = FLOAT_VAL(db - dc);
+            STRUCT_OPERATOR("__sub__", vb, vc);
+            SET_OPERATOR(TOKEN_MINUS, a, vb, vc);
+            RUNTIME_ERROR("Operands of '-' must be numbers.");
         }
         NEXT();
     }
@@ -328,11 +997,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         int val = DECODE_sBx(inst);
         Value vb = regs[a]; // R(A) = R(A) - sBx
         if (likely(IS_INT(vb))) {
-            regs[a] = INT_VAL(AS_INT(vb) - val);
+            int64_t r;
+            if (unlikely(!intSub(AS_INT(vb), val, &r))) OVERFLOW_ERROR(AS_INT(vb), "-", val);
+            INT_RESULT(a, r);
         } else if (IS_FLOAT(vb)) {
             regs[a] = FLOAT_VAL(AS_FLOAT(vb) - (double)val);
         } else {
-            // Unlikely string fallback
+            STRUCT_OPERATOR("__sub__", vb, INT_VAL(val));
+            RUNTIME_ERROR("Operands of '-' must be numbers.");
         }
         NEXT();
     }
@@ -342,36 +1014,65 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) {
-            regs[a] = INT_VAL(AS_INT(vb) * AS_INT(vc));
+            int64_t r;
+            if (unlikely(!intMul(AS_INT(vb), AS_INT(vc), &r))) OVERFLOW_ERROR(AS_INT(vb), "*", AS_INT(vc));
+            INT_RESULT(a, r);
+        } else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = FLOAT_VAL(AS_NUMERIC(vb) * AS_NUMERIC(vc));
         } else {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = FLOAT_VAL(db * dc);
+            STRUCT_OPERATOR("__mul__", vb, vc);
+            RUNTIME_ERROR("Operands of '*' must be numbers.");
         }
         NEXT();
     }
 
+    // '/' always gives a double. Only an integer 0 as the divisor is an
+    // error; a double one gives inf or NaN.
     op_div: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
+        Value vb = regs[b], vc = regs[c];
+        if (likely(IS_NUMERIC(vb) && IS_NUMERIC(vc))) {
+            if (unlikely(IS_INT(vb) && IS_INT(vc) && AS_INT(vc) == 0)) { RUNTIME_ERROR("Division by zero."); }
+            regs[a] = FLOAT_VAL(AS_NUMERIC(vb) / AS_NUMERIC(vc));
+        } else {
+            RUNTIME_ERROR("Operands of '/' must be numbers.");
+        }
+        NEXT();
+    }
+
+    op_idiv: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) {
             int64_t ic = AS_INT(vc);
-            if (unlikely(ic == 0)) { printf("Runtime Error: Division by zero.\n"); exit(1); }
-            regs[a] = INT_VAL(AS_INT(vb) / ic);
+            if (unlikely(ic == 0)) { RUNTIME_ERROR("Division by zero."); }
+            // Only INT64_MIN ~/ -1 leaves the range
+            if (unlikely(ic == -1 && AS_INT(vb) == INT64_MIN)) OVERFLOW_ERROR(AS_INT(vb), "~/", ic);
+            INT_RESULT(a, intFloorDiv(AS_INT(vb), ic));
+        } else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = FLOAT_VAL(floor(AS_NUMERIC(vb) / AS_NUMERIC(vc)));
         } else {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = FLOAT_VAL(db / dc);
+            RUNTIME_ERROR("Operands of '~/' must be numbers.");
         }
         NEXT();
     }
 
+    // The remainder takes the dividend's sign, for ints as for fmod()
     op_mod: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
-        if (IS_INT(regs[b]) && IS_INT(regs[c])) {
-            regs[a] = INT_VAL(AS_INT(regs[b]) % AS_INT(regs[c]));
+        Value vb = regs[b], vc = regs[c];
+        if (likely(IS_INT(vb) && IS_INT(vc))) {
+            int64_t ic = AS_INT(vc);
+            if (unlikely(ic == 0)) { RUNTIME_ERROR("Modulo by zero."); }
+            // INT64_MIN % -1 traps in C; every remainder by -1 is 0
+            INT_RESULT(a, ic == -1 ? 0 : AS_INT(vb) % ic);
+        } else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = FLOAT_VAL(fmod(AS_NUMERIC(vb), AS_NUMERIC(vc)));
+        } else {
+            RUNTIME_ERROR("Operands of '%%' must be numbers.");
         }
         NEXT();
     }
@@ -379,22 +1080,126 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
     op_neg: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst);
-        if (IS_INT(regs[b])) regs[a] = INT_VAL(-AS_INT(regs[b]));
-        else if (IS_FLOAT(regs[b])) regs[a] = FLOAT_VAL(-AS_FLOAT(regs[b]));
+        if (IS_INT(regs[b])) {
+            if (unlikely(AS_INT(regs[b]) == INT64_MIN)) {
+                RUNTIME_ERROR("Integer overflow in -(%lld).", (long long)INT64_MIN);
+            }
+            INT_RESULT(a, -AS_INT(regs[b]));
+        } else if (IS_FLOAT(regs[b])) {
+            regs[a] = FLOAT_VAL(-AS_FLOAT(regs[b]));
+        }
+        NEXT();
+    }
+
+    // ===== BITWISE =====
+    // Integers only: a double is a type error even when it is whole
+    #define BITWISE_OPERANDS(sym, x, y) \
+        if (unlikely(!IS_INT(x) || !IS_INT(y))) { \
+            RUNTIME_ERROR("Operands of '" sym "' must be integers, got %s and %s.", \
+                          valueTypeName(x), valueTypeName(y)); \
+        }
+
+    op_band: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)], vc = regs[DECODE_C(inst)];
+        SET_OPERATOR(TOKEN_AMPERSAND, DECODE_A(inst), vb, vc);
+        BITWISE_OPERANDS("&", vb, vc);
+        INT_RESULT(DECODE_A(inst), AS_INT(vb) & AS_INT(vc));
+        NEXT();
+    }
+
+    op_bor: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)], vc = regs[DECODE_C(inst)];
+        SET_OPERATOR(TOKEN_PIPE, DECODE_A(inst), vb, vc);
+        BITWISE_OPERANDS("|", vb, vc);
+        INT_RESULT(DECODE_A(inst), AS_INT(vb) | AS_INT(vc));
+        NEXT();
+    }
+
+    op_bxor: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)], vc = regs[DECODE_C(inst)];
+        BITWISE_OPERANDS("^", vb, vc);
+        INT_RESULT(DECODE_A(inst), AS_INT(vb) ^ AS_INT(vc));
+        NEXT();
+    }
+
+    op_shl: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)], vc = regs[DECODE_C(inst)];
+        BITWISE_OPERANDS("<<", vb, vc);
+        if (unlikely(AS_INT(vc) < 0)) RUNTIME_ERROR("Shift count must not be negative, got %lld.", (long long)AS_INT(vc));
+        INT_RESULT(DECODE_A(inst), intShiftLeft(AS_INT(vb), AS_INT(vc)));
+        NEXT();
+    }
+
+    op_shr: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)], vc = regs[DECODE_C(inst)];
+        BITWISE_OPERANDS(">>", vb, vc);
+        if (unlikely(AS_INT(vc) < 0)) RUNTIME_ERROR("Shift count must not be negative, got %lld.", (long long)AS_INT(vc));
+        INT_RESULT(DECODE_A(inst), intShiftRight(AS_INT(vb), AS_INT(vc)));
+        NEXT();
+    }
+
+    op_bnot: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)];
+        if (unlikely(!IS_INT(vb))) RUNTIME_ERROR("Operand of '~' must be an integer, got %s.", valueTypeName(vb));
+        INT_RESULT(DECODE_A(inst), ~AS_INT(vb));
+        NEXT();
+    }
+
+    // ++ and --: unlike ADDI, anything but a number is an error
+    op_inc: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)];
+        if (likely(IS_INT(vb))) {
+            int64_t r;
+            if (unlikely(!intAdd(AS_INT(vb), 1, &r))) OVERFLOW_ERROR(AS_INT(vb), "+", 1);
+            INT_RESULT(DECODE_A(inst), r);
+        } else if (IS_FLOAT(vb)) {
+            regs[DECODE_A(inst)] = FLOAT_VAL(AS_FLOAT(vb) + 1.0);
+        } else {
+            RUNTIME_ERROR("Operand of '++' must be a number, got %s.", valueTypeName(vb));
+        }
+        NEXT();
+    }
+
+    op_dec: {
+        uint32_t inst = FETCH();
+        Value vb = regs[DECODE_B(inst)];
+        if (likely(IS_INT(vb))) {
+            int64_t r;
+            if (unlikely(!intSub(AS_INT(vb), 1, &r))) OVERFLOW_ERROR(AS_INT(vb), "-", 1);
+            INT_RESULT(DECODE_A(inst), r);
+        } else if (IS_FLOAT(vb)) {
+            regs[DECODE_A(inst)] = FLOAT_VAL(AS_FLOAT(vb) - 1.0);
+        } else {
+            RUNTIME_ERROR("Operand of '--' must be a number, got %s.", valueTypeName(vb));
+        }
         NEXT();
     }
 
     // ===== COMPARISONS =====
+    // Only two numbers or two strings have an order; == and != take anything
+    #define ORDER_ERROR(sym, x, y) \
+        RUNTIME_ERROR("Cannot compare %s with %s using '" sym "'.", valueTypeName(x), valueTypeName(y))
+
     op_lt: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) { regs[a] = BOOL_VAL(AS_INT(vb) < AS_INT(vc)); }
-        else if (IS_NUMBER(vb) && IS_NUMBER(vc)) {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = BOOL_VAL(db < dc);
-        } else regs[a] = BOOL_VAL(false);
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = BOOL_VAL(AS_NUMERIC(vb) < AS_NUMERIC(vc));
+        } else if (IS_STRING(vb) && IS_STRING(vc)) {
+            regs[a] = BOOL_VAL(compareStrings(AS_STRING(vb), AS_STRING(vc)) < 0);
+        } else {
+            STRUCT_COMPARE(TOKEN_LESS, vb, vc);
+            ORDER_ERROR("<", vb, vc);
+        }
         NEXT();
     }
 
@@ -403,11 +1208,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) { regs[a] = BOOL_VAL(AS_INT(vb) <= AS_INT(vc)); }
-        else if (IS_NUMBER(vb) && IS_NUMBER(vc)) {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = BOOL_VAL(db <= dc);
-        } else regs[a] = BOOL_VAL(false);
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = BOOL_VAL(AS_NUMERIC(vb) <= AS_NUMERIC(vc));
+        } else if (IS_STRING(vb) && IS_STRING(vc)) {
+            regs[a] = BOOL_VAL(compareStrings(AS_STRING(vb), AS_STRING(vc)) <= 0);
+        } else {
+            STRUCT_COMPARE(TOKEN_LESS_EQUAL, vb, vc);
+            ORDER_ERROR("<=", vb, vc);
+        }
         NEXT();
     }
 
@@ -416,11 +1224,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) { regs[a] = BOOL_VAL(AS_INT(vb) > AS_INT(vc)); }
-        else if (IS_NUMBER(vb) && IS_NUMBER(vc)) {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = BOOL_VAL(db > dc);
-        } else regs[a] = BOOL_VAL(false);
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = BOOL_VAL(AS_NUMERIC(vb) > AS_NUMERIC(vc));
+        } else if (IS_STRING(vb) && IS_STRING(vc)) {
+            regs[a] = BOOL_VAL(compareStrings(AS_STRING(vb), AS_STRING(vc)) > 0);
+        } else {
+            STRUCT_COMPARE(TOKEN_GREATER, vb, vc);
+            ORDER_ERROR(">", vb, vc);
+        }
         NEXT();
     }
 
@@ -429,11 +1240,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (likely(IS_INT(vb) && IS_INT(vc))) { regs[a] = BOOL_VAL(AS_INT(vb) >= AS_INT(vc)); }
-        else if (IS_NUMBER(vb) && IS_NUMBER(vc)) {
-            double db = IS_INT(vb) ? (double)AS_INT(vb) : AS_FLOAT(vb);
-            double dc = IS_INT(vc) ? (double)AS_INT(vc) : AS_FLOAT(vc);
-            regs[a] = BOOL_VAL(db >= dc);
-        } else regs[a] = BOOL_VAL(false);
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) {
+            regs[a] = BOOL_VAL(AS_NUMERIC(vb) >= AS_NUMERIC(vc));
+        } else if (IS_STRING(vb) && IS_STRING(vc)) {
+            regs[a] = BOOL_VAL(compareStrings(AS_STRING(vb), AS_STRING(vc)) >= 0);
+        } else {
+            STRUCT_COMPARE(TOKEN_GREATER_EQUAL, vb, vc);
+            ORDER_ERROR(">=", vb, vc);
+        }
         NEXT();
     }
 
@@ -442,11 +1256,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (IS_INT(vb) && IS_INT(vc)) { regs[a] = BOOL_VAL(AS_INT(vb) == AS_INT(vc)); }
-        else if (IS_FLOAT(vb) && IS_FLOAT(vc)) { regs[a] = BOOL_VAL(AS_FLOAT(vb) == AS_FLOAT(vc)); }
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) { regs[a] = BOOL_VAL(AS_NUMERIC(vb) == AS_NUMERIC(vc)); }
         else if (IS_BOOL(vb) && IS_BOOL(vc)) { regs[a] = BOOL_VAL(AS_BOOL(vb) == AS_BOOL(vc)); }
         else if (IS_NIL(vb) && IS_NIL(vc)) { regs[a] = BOOL_VAL(true); }
-        else if (IS_OBJ(vb) && IS_OBJ(vc)) { regs[a] = BOOL_VAL(AS_OBJ(vb) == AS_OBJ(vc)); }
-        else regs[a] = BOOL_VAL(false);
+        else if (IS_STRING(vb) && IS_STRING(vc)) { regs[a] = BOOL_VAL(stringsEqual(AS_STRING(vb), AS_STRING(vc))); }
+        else {
+            STRUCT_COMPARE(TOKEN_EQUAL_EQUAL, vb, vc);
+            regs[a] = BOOL_VAL(IS_OBJ(vb) && IS_OBJ(vc) && AS_OBJ(vb) == AS_OBJ(vc));
+        }
         NEXT();
     }
 
@@ -455,10 +1272,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value vb = regs[b], vc = regs[c];
         if (IS_INT(vb) && IS_INT(vc)) { regs[a] = BOOL_VAL(AS_INT(vb) != AS_INT(vc)); }
-        else if (IS_FLOAT(vb) && IS_FLOAT(vc)) { regs[a] = BOOL_VAL(AS_FLOAT(vb) != AS_FLOAT(vc)); }
+        else if (IS_NUMERIC(vb) && IS_NUMERIC(vc)) { regs[a] = BOOL_VAL(AS_NUMERIC(vb) != AS_NUMERIC(vc)); }
         else if (IS_BOOL(vb) && IS_BOOL(vc)) { regs[a] = BOOL_VAL(AS_BOOL(vb) != AS_BOOL(vc)); }
         else if (IS_NIL(vb) && IS_NIL(vc)) { regs[a] = BOOL_VAL(false); }
-        else regs[a] = BOOL_VAL(true);
+        else if (IS_STRING(vb) && IS_STRING(vc)) { regs[a] = BOOL_VAL(!stringsEqual(AS_STRING(vb), AS_STRING(vc))); }
+        else {
+            STRUCT_COMPARE(TOKEN_BANG_EQUAL, vb, vc);
+            regs[a] = BOOL_VAL(!IS_OBJ(vb) || !IS_OBJ(vc) || AS_OBJ(vb) != AS_OBJ(vc));
+        }
         NEXT();
     }
 
@@ -498,58 +1319,164 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
 
     op_loop: {
         uint32_t inst = FETCH();
+        POLL_LIMITS();
         int offset = DECODE_sBx24(inst);
         ip -= offset - 1;
         DISPATCH();
     }
 
+    op_jmparg: {
+        uint32_t inst = FETCH();
+        int param = DECODE_A(inst);
+        if (vm->callStack[vm->callStackTop - 1].argCount > param && regs[param + 1] != OMITTED_VAL) {
+            ip += DECODE_sBx(inst) + 1;
+            DISPATCH();
+        }
+        NEXT();
+    }
+
+    op_jmpnil: {
+        uint32_t inst = FETCH();
+        if (IS_NIL(regs[DECODE_A(inst)])) {
+            ip += DECODE_sBx(inst) + 1;
+            DISPATCH();
+        }
+        NEXT();
+    }
+
+    op_jmpnotnil: {
+        uint32_t inst = FETCH();
+        if (!IS_NIL(regs[DECODE_A(inst)])) {
+            ip += DECODE_sBx(inst) + 1;
+            DISPATCH();
+        }
+        NEXT();
+    }
+
     // ===== FUNCTION CALLS =====
     op_call: {
         uint32_t inst = FETCH();
-        uint8_t funcReg = DECODE_A(inst);
-        uint8_t argCount = DECODE_B(inst);
+        callReg = DECODE_A(inst);
+        callArgCount = DECODE_B(inst);
+        callResultCount = DECODE_C(inst);
+        goto call_value;
+    }
+
+    // f(...xs): the arguments were gathered into the array R(B) at run time.
+    // They are laid out over R(A+1).. and called as OP_CALL would.
+    op_callspread: {
+        uint32_t inst = FETCH();
+        // The compiler always builds the array; a loaded image may not
+        if (unlikely(!IS_ARRAY(regs[DECODE_B(inst)]))) RUNTIME_ERROR("Spread call needs an array of arguments.");
+        Array* argArray = (Array*)AS_OBJ(regs[DECODE_B(inst)]);
+        callReg = DECODE_A(inst);
+        callArgCount = argArray->count;
+        callResultCount = DECODE_C(inst);
+        if (vm->regBase + callReg + callArgCount + 1 >= STACK_MAX) {
+            RUNTIME_ERROR("Stack overflow.");
+        }
+        // An empty array may have no items buffer at all
+        if (callArgCount > 0) memmove(&regs[callReg + 1], argArray->items, sizeof(Value) * callArgCount);
+        goto call_value;
+    }
+
+    // f(a, name: value): the arguments are laid out by parameter over
+    // R(A+1).. and called as OP_CALL would
+    op_callnamed: {
+        uint32_t inst = FETCH();
+        callReg = DECODE_A(inst);
+        callResultCount = DECODE_C(inst);
+        char msg[256];
+        callArgCount = bindCallNamed(vm, regs, callReg, DECODE_B(inst), msg, sizeof(msg));
+        if (callArgCount < 0) RUNTIME_ERROR("%s", msg);
+        goto call_value;
+    }
+
+    call_value: {
+        int funcReg = callReg;
+        int argCount = callArgCount;
+        int resultCount = callResultCount;
+        // Spread arguments can reach past this frame's registers; anything
+        // that allocates before the callee runs must keep them rooted
+        int argTop = funcReg + argCount + 1;
+        int rootTop = argTop > (int)chunk->maxRegs + 1 ? argTop : (int)chunk->maxRegs + 1;
 
         Value funcVal = regs[funcReg];
-        if (!IS_OBJ(funcVal)) {
-            printf("Runtime Error: Attempt to call non-function value.\n");
-            exit(1);
+        if (!IS_OBJ(funcVal) || IS_BOXED_INT(funcVal)) {
+            RUNTIME_ERROR("Attempt to call non-function value.");
         }
 
         Obj* obj = AS_OBJ(funcVal);
         if (obj->type != OBJ_FUNCTION && obj->type != OBJ_STRUCT_DEF) {
-             printf("Runtime Error: Attempt to call non-function object.\n");
-             exit(1);
+            if (obj->type != OBJ_BOUND_METHOD) {
+                RUNTIME_ERROR("Attempt to call non-function object.");
+            }
+            // Shift the arguments up one and pass the receiver first, as self
+            BoundMethod* bound = (BoundMethod*)obj;
+            if (vm->regBase + funcReg + argCount + 2 >= STACK_MAX) {
+                RUNTIME_ERROR("Stack overflow.");
+            }
+            memmove(&regs[funcReg + 2], &regs[funcReg + 1], sizeof(Value) * argCount);
+            regs[funcReg + 1] = bound->receiver;
+            regs[funcReg] = OBJ_VAL(bound->method);
+            callArgCount = argCount + 1;
+            goto call_value;
         }
 
         if (obj->type == OBJ_FUNCTION) {
             Function* func = (Function*)obj;
             if (func->isNative) {
                 // Native call: pass args from regs[funcReg+1..funcReg+argCount]
-                vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+                vm->regTop = vm->regBase + rootTop;
                 Value* args = &regs[funcReg + 1];
+                vm->nativeChunk = chunk; // Call site for callBytecodeFunction
+                vm->nativeIp = ip;
+                vm->nativeCallee = func;
                 Value result = func->native(vm, args, argCount);
+                if (unlikely(vm->throwPending)) {
+                    // Raised with nativeError(), or escaped from a callback
+                    // that already captured its trace
+                    if (vm->errorTraceCount == 0) captureTrace(vm, chunk, ip);
+                    goto throw_value;
+                }
                 regs[funcReg] = result;
+                // Natives return a single value; pad any extra results
+                for (int i = 1; i < resultCount; i++) regs[funcReg + i] = NIL_VAL;
                 NEXT();
             }
 
-            if (argCount != func->paramCount) {
-                printf("Runtime Error: Expected %d args but got %d.\n", func->paramCount, argCount);
-                exit(1);
+            if (unlikely(!arityFits(func, argCount))) {
+                char msg[128];
+                formatArityError(func, argCount, msg, sizeof(msg));
+                RUNTIME_ERROR("%s", msg);
+            }
+
+            // Deep recursion can run out of frames or of register file
+            if (unlikely(vm->callStackTop >= vm->maxFrames ||
+                         vm->regBase + funcReg + func->bytecodeChunk->maxRegs + 1 > STACK_MAX)) {
+                RUNTIME_ERROR("Stack overflow.");
             }
+            POLL_LIMITS();
 
-            if (unlikely(vm->callStackTop >= CALL_STACK_MAX)) {
-                printf("Runtime Error: Stack overflow.\n");
-                exit(1);
+            Value rest = NIL_VAL;
+            if (func->isVariadic) {
+                vm->regTop = vm->regBase + rootTop;
+                argCount = collectRest(vm, func, &regs[funcReg + 1], argCount, &rest);
             }
 
             // Save current frame
             CallFrame* frame = &vm->callStack[vm->callStackTop++];
             frame->ip = ip + 1; // Return after this CALL instruction
             frame->chunk = chunk;
-            frame->function = NULL;
+            frame->function = func; // Callee, for resolving relative imports
+            frame->env = NULL;      // Only AST walker frames have one
             frame->regBase = vm->regBase;
             frame->resultReg = funcReg; // Caller wants result in this register
+            frame->resultCount = resultCount;
+            frame->argCount = argCount;
             frame->prevGlobalEnv = vm->globalEnv;
+            frame->returnValue = NIL_VAL;
+            frame->defers = NULL;
 
             if (func->moduleEnv) {
                 vm->globalEnv = func->moduleEnv;
@@ -562,6 +1489,13 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
             vm->regBase = vm->regBase + funcReg;
             regs = vm->registers + vm->regBase;
 
+            // Registers past the params may still hold values from an
+            // earlier call, already freed; the GC scans the whole window
+            for (int i = argCount + 1; i <= func->bytecodeChunk->maxRegs; i++) {
+                regs[i] = NIL_VAL;
+            }
+            if (func->isVariadic) regs[func->paramCount] = rest;
+
             chunk = func->bytecodeChunk;
             constants = chunk->constants;
             ip = chunk->code;
@@ -570,12 +1504,11 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         } else if (obj->type == OBJ_STRUCT_DEF) {
             StructDef* def = (StructDef*)obj;
             if (argCount != def->fieldCount) {
-                printf("Runtime Error: Struct '%s' expected %d args but got %d.\n",
+                RUNTIME_ERROR("Struct '%s' expected %d args but got %d.",
                        def->name, def->fieldCount, argCount);
-                exit(1);
             }
 
-            vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+            vm->regTop = vm->regBase + rootTop;
             StructInstance* inst = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
             inst->def = def;
             inst->fields = malloc(sizeof(Value) * def->fieldCount);
@@ -583,19 +1516,71 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
                 inst->fields[i] = regs[funcReg + 1 + i];
             }
             regs[funcReg] = OBJ_VAL(inst);
+            for (int i = 1; i < resultCount; i++) regs[funcReg + i] = NIL_VAL;
             NEXT();
         } else {
-            printf("Runtime Error: Call on non-function object (type %d).\n", obj->type);
-            exit(1);
+            RUNTIME_ERROR("Call on non-function object (type %d).", obj->type);
         }
     }
 
+    // 'return f(...)': f reuses the current frame and register window, so
+    // tail recursion runs in constant stack space. Anything else (natives,
+    // structs, bad arity) and callers wanting several results, which would
+    // otherwise receive all of f's values, take the plain OP_CALL path and
+    // the OP_RETURN compiled after this instruction.
+    op_tailcall: {
+        uint32_t inst = FETCH();
+        uint8_t funcReg = DECODE_A(inst);
+        uint8_t argCount = DECODE_B(inst);
+        Value funcVal = regs[funcReg];
+        CallFrame* frame = &vm->callStack[vm->callStackTop - 1];
+        if (!IS_OBJ(funcVal) || AS_OBJ(funcVal)->type != OBJ_FUNCTION) goto op_call;
+        Function* func = (Function*)AS_OBJ(funcVal);
+        // Deferred calls run when the frame ends, so it can't be reused
+        if (func->isNative || !arityFits(func, argCount) || frame->resultCount > 1 || frame->defers ||
+            vm->regBase + func->bytecodeChunk->maxRegs + 1 > STACK_MAX) goto op_call;
+        POLL_LIMITS();
+
+        Value rest = NIL_VAL;
+        if (func->isVariadic) {
+            vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+            argCount = collectRest(vm, func, &regs[funcReg + 1], argCount, &rest);
+        }
+
+        // Locals captured by closures must outlive the window being reused
+        if (vm->openUpvalues) closeUpvalues(vm, regs);
+        regs[0] = funcVal;
+        for (int i = 1; i <= argCount; i++) regs[i] = regs[funcReg + i];
+        for (int i = argCount + 1; i <= func->bytecodeChunk->maxRegs; i++) regs[i] = NIL_VAL;
+        if (func->isVariadic) regs[func->paramCount] = rest;
+
+        frame->function = func;
+        frame->argCount = argCount;
+        if (func->moduleEnv) {
+            vm->globalEnv = func->moduleEnv;
+        }
+        chunk = func->bytecodeChunk;
+        constants = chunk->constants;
+        ip = chunk->code;
+        DISPATCH();
+    }
+
     op_return: {
         uint32_t inst = FETCH();
-        Value retVal = regs[DECODE_A(inst)];
+        Value* values = regs + DECODE_A(inst);
+        int valueCount = DECODE_B(inst);
+        if (unlikely(vm->callStack[vm->callStackTop - 1].defers != NULL)) {
+            // Above the values being returned
+            vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+            if (!runDefers(vm, vm->callStackTop - 1, chunk, ip)) goto throw_value;
+        }
+        if (vm->openUpvalues) closeUpvalues(vm, regs);
 
         vm->callStackTop--;
+        POP_FRAME_HANDLERS();
         if (vm->callStackTop == entryStackDepth) {
+            // Leaving the activation: hand the result to callBytecodeFunction
+            vm->callStack[vm->callStackTop].returnValue = valueCount > 0 ? values[0] : NIL_VAL;
             return getMicroseconds() - startTime;
         }
 
@@ -610,14 +1595,27 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         constants = chunk->constants;
         ip = frame->ip;
 
-        // Store return value in caller's result register
-        regs[frame->resultReg] = retVal;
+        // Store return values in caller's result registers. The callee's
+        // window never starts below resultReg, so copying upward is safe.
+        // Missing values become nil, surplus values are dropped.
+        Value* results = regs + frame->resultReg;
+        int want = frame->resultCount;
+        int copy = valueCount < want ? valueCount : want;
+        for (int i = 0; i < copy; i++) results[i] = values[i];
+        for (int i = copy; i < want; i++) results[i] = NIL_VAL;
         DISPATCH();
     }
 
     op_returnnil: {
+        if (unlikely(vm->callStack[vm->callStackTop - 1].defers != NULL)) {
+            vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+            if (!runDefers(vm, vm->callStackTop - 1, chunk, ip)) goto throw_value;
+        }
+        if (vm->openUpvalues) closeUpvalues(vm, regs);
         vm->callStackTop--;
+        POP_FRAME_HANDLERS();
         if (vm->callStackTop == entryStackDepth) {
+            vm->callStack[vm->callStackTop].returnValue = NIL_VAL;
             return getMicroseconds() - startTime;
         }
 
@@ -632,28 +1630,115 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         constants = chunk->constants;
         ip = frame->ip;
 
-        regs[frame->resultReg] = NIL_VAL;
+        for (int i = 0; i < frame->resultCount; i++) {
+            regs[frame->resultReg + i] = NIL_VAL;
+        }
         DISPATCH();
     }
 
+    // ===== CLOSURES =====
+    op_closure: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        Function* proto = (Function*)AS_OBJ(constants[DECODE_Bx(inst)]);
+
+        // A closure is a copy of its prototype that shares the compiled chunk
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        Function* closure = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
+        Obj header = closure->obj;
+        *closure = *proto;
+        closure->obj = header;
+        closure->proto = proto;
+        closure->upvalues = calloc(proto->upvalueCount, sizeof(ObjUpvalue*));
+        regs[a] = OBJ_VAL(closure); // Rooted before capturing (may allocate)
+
+        Function* enclosing = (Function*)AS_OBJ(regs[0]);
+        for (int i = 0; i < proto->upvalueCount; i++) {
+            uint32_t capture = *++ip;
+            uint8_t index = DECODE_B(capture);
+            if (DECODE_OP(capture) == OP_MOVE) {
+                closure->upvalues[i] = captureUpvalue(vm, &regs[index]);
+            } else {
+                closure->upvalues[i] = enclosing->upvalues[index];
+            }
+            // Capturing may have collected and promoted the closure
+            GEN_BARRIER(vm, closure, closure->upvalues[i]);
+        }
+        NEXT();
+    }
+
+    op_getupval: {
+        uint32_t inst = FETCH();
+        Function* fn = (Function*)AS_OBJ(regs[0]);
+        regs[DECODE_A(inst)] = *fn->upvalues[DECODE_B(inst)]->location;
+        NEXT();
+    }
+
+    op_setupval: {
+        uint32_t inst = FETCH();
+        Function* fn = (Function*)AS_OBJ(regs[0]);
+        ObjUpvalue* uv = fn->upvalues[DECODE_B(inst)];
+        *uv->location = regs[DECODE_A(inst)];
+        GEN_BARRIER_VALUE(vm, uv, regs[DECODE_A(inst)]);
+        NEXT();
+    }
+
+    op_close: {
+        uint32_t inst = FETCH();
+        closeUpvalues(vm, &regs[DECODE_A(inst)]);
+        NEXT();
+    }
+
     // ===== PROPERTY ACCESS =====
+    // GETPROPR and SETPROPR share these, with the name in a register
+    // rather than the constant pool
+    #define PROP_NAME(name, inst, operand, constOp) \
+        do { \
+            Value _name = DECODE_OP(inst) == (constOp) ? constants[operand] : regs[operand]; \
+            if (unlikely(!IS_STRING(_name))) RUNTIME_ERROR("Bytecode names a property with a non-string."); \
+            name = AS_STRING(_name); \
+        } while (0)
+
     op_getprop: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value objVal = regs[b];
-        ObjString* name = AS_STRING(constants[c]);
+        ObjString* name;
+        PROP_NAME(name, inst, c, OP_GETPROP);
 
         if (IS_OBJ(objVal)) {
             Obj* obj = AS_OBJ(objVal);
 
             if (obj->type == OBJ_STRUCT_INSTANCE) {
                 StructInstance* si = (StructInstance*)obj;
-                for (int i = 0; i < si->def->fieldCount; i++) {
-                    if (strcmp(si->def->fields[i], name->chars) == 0) {
+                StructDef* def = si->def;
+                PropertyCache* cache = propertyCache(chunk, (int)(ip - chunk->code));
+                if (likely(cache->shape == def->shape)) {
+                    if (likely(cache->slot >= 0)) {
+                        regs[a] = si->fields[cache->slot];
+                        NEXT();
+                    }
+                    vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+                    regs[a] = OBJ_VAL(newBoundMethod(vm, objVal, def->methods[~cache->slot]));
+                    NEXT();
+                }
+                // Miss: look the name up and remember where it was found
+                for (int i = 0; i < def->fieldCount; i++) {
+                    if (strcmp(def->fields[i], name->chars) == 0) {
+                        *cache = (PropertyCache){def->shape, i};
                         regs[a] = si->fields[i];
                         NEXT();
                     }
                 }
+                for (int i = 0; i < def->methodCount; i++) {
+                    Token n = def->methods[i]->name;
+                    if (n.length == name->length && memcmp(n.start, name->chars, n.length) == 0) {
+                        *cache = (PropertyCache){def->shape, ~i};
+                        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+                        regs[a] = OBJ_VAL(newBoundMethod(vm, objVal, def->methods[i]));
+                        NEXT();
+                    }
+                }
                 regs[a] = NIL_VAL;
                 NEXT();
             }
@@ -662,14 +1747,13 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
                 unsigned int h = name->hash % TABLE_SIZE;
                 VarEntry* e = mod->env->buckets[h];
                 while (e) {
-                    if (strcmp(e->key, name->chars) == 0) {
+                    if (e->key == name->chars || strcmp(e->key, name->chars) == 0) {
                         regs[a] = e->value;
                         NEXT();
                     }
                     e = e->next;
                 }
-                printf("Runtime Error: Undefined property '%s' in module '%s'.\n", name->chars, mod->name);
-                exit(1);
+                RUNTIME_ERROR("Undefined property '%s' in module '%s'.", name->chars, mod->name);
             }
             else if (obj->type == OBJ_STRING) {
                 if (name->length == 6 && memcmp(name->chars, "length", 6) == 0) {
@@ -678,34 +1762,46 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
                 }
             }
         }
-        printf("Runtime Error: Cannot read property '%s' on this type.\n", name->chars);
-        exit(1);
+        RUNTIME_ERROR("Cannot read property '%s' on this type.", name->chars);
     }
 
     op_setprop: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         Value objVal = regs[a];
-        ObjString* name = AS_STRING(constants[b]);
+        ObjString* name;
+        PROP_NAME(name, inst, b, OP_SETPROP);
         Value val = regs[c];
 
         if (IS_OBJ(objVal) && AS_OBJ(objVal)->type == OBJ_STRUCT_INSTANCE) {
             StructInstance* si = (StructInstance*)AS_OBJ(objVal);
+            PropertyCache* cache = propertyCache(chunk, (int)(ip - chunk->code));
+            if (likely(cache->shape == si->def->shape)) {
+                si->fields[cache->slot] = val;
+                WRITE_BARRIER(vm, si);
+                GEN_BARRIER_VALUE(vm, si, val);
+                NEXT();
+            }
             for (int i = 0; i < si->def->fieldCount; i++) {
                 if (strcmp(si->def->fields[i], name->chars) == 0) {
+                    *cache = (PropertyCache){si->def->shape, i};
                     si->fields[i] = val;
                     WRITE_BARRIER(vm, si);
+                    GEN_BARRIER_VALUE(vm, si, val);
                     NEXT();
                 }
             }
-            printf("Runtime Error: Struct '%s' has no field '%s'.\n", si->def->name, name->chars);
-            exit(1);
+            RUNTIME_ERROR("Struct '%s' has no field '%s'.", si->def->name, name->chars);
         }
-        printf("Runtime Error: Only struct instances have settable properties.\n");
-        exit(1);
+        RUNTIME_ERROR("Only struct instances have settable properties.");
     }
 
     // ===== INDEX ACCESS =====
+    // A struct instance's __index__, __setindex__ or __len__ runs in place
+    // of the opcode like a native's callback; argv[0] is the instance
+    #define CALL_SPECIAL(result, method, argv, argc) \
+        CALL_BACK(result = callBytecodeFunction(vm, method, argv, argc))
+
     op_getidx: {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
@@ -713,20 +1809,34 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
 
         if (IS_ARRAY(target) && IS_INT(index)) {
             Array* arr = (Array*)AS_OBJ(target);
-            int idx = (int)AS_INT(index);
-            regs[a] = (idx >= 0 && idx < arr->count) ? arr->items[idx] : NIL_VAL;
+            int64_t idx = AS_INT(index);
+            if (unlikely(idx < 0 || idx >= arr->count)) {
+                RUNTIME_ERROR("Index %lld out of range for array of length %d.", (long long)idx, arr->count);
+            }
+            regs[a] = arr->items[idx];
         } else if (IS_MAP(target)) {
             Map* map = (Map*)AS_OBJ(target);
             if (IS_STRING(index)) {
                 ObjString* key = AS_STRING(index);
                 int bucket;
-                MapEntry* e = mapFindEntry(map, key->chars, key->length, &bucket);
+                MapEntry* e = mapFindString(map, key, &bucket);
                 regs[a] = e ? e->value : NIL_VAL;
             } else if (IS_INT(index)) {
                 int bucket;
-                MapEntry* e = mapFindEntryInt(map, (int)AS_INT(index), &bucket);
+                MapEntry* e = mapFindEntryInt(map, AS_INT(index), &bucket);
                 regs[a] = e ? e->value : NIL_VAL;
             } else regs[a] = NIL_VAL;
+        } else if (IS_OBJ(target) && AS_OBJ(target)->type == OBJ_STRUCT_INSTANCE) {
+            Function* method = specialMethod(target, "__index__");
+            if (!method) {
+                RUNTIME_ERROR("Struct '%s' has no __index__ method.", ((StructInstance*)AS_OBJ(target))->def->name);
+            }
+            Value argv[2] = { target, index };
+            Value result;
+            CALL_SPECIAL(result, method, argv, 2);
+            regs[a] = result;
+        } else if (IS_STRING(target)) {
+            RUNTIME_ERROR("Cannot index a string: slice it with s[i:i + 1], or use string.chars(s)[i].");
         } else regs[a] = NIL_VAL;
         NEXT();
     }
@@ -738,12 +1848,24 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
 
         if (IS_ARRAY(target) && IS_INT(index)) {
             Array* arr = (Array*)AS_OBJ(target);
-            int idx = (int)AS_INT(index);
+            int64_t idx = AS_INT(index);
+            if (unlikely(arr->frozen)) RUNTIME_ERROR("Cannot modify frozen array.");
+            // An array's length is an int: an index past that can't be grown to
+            if (unlikely(idx >= INT_MAX)) {
+                RUNTIME_ERROR("Index %lld out of range for array of length %d.", (long long)idx, arr->count);
+            }
             if (idx >= 0) {
                 if (idx >= arr->capacity) {
-                    int newCap = idx + 1;
-                    if (newCap < arr->capacity * 2) newCap = arr->capacity * 2;
-                    arr->items = realloc(arr->items, newCap * sizeof(Value));
+                    int newCap = (int)idx + 1;
+                    if (newCap < GROW_CAPACITY(arr->capacity)) newCap = GROW_CAPACITY(arr->capacity);
+                    size_t oldSize = sizeof(Value) * arr->capacity, newSize = sizeof(Value) * newCap;
+                    vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+                    if (unlikely(heapLimitExceeded(vm, newSize - oldSize))) {
+                        captureTrace(vm, chunk, ip);
+                        goto throw_value;
+                    }
+                    // Growing may collect: value is rooted in its register
+                    arr->items = (Value*)reallocate(vm, arr->items, oldSize, newSize);
                     arr->capacity = newCap;
                 }
                 if (idx >= arr->count) {
@@ -752,20 +1874,48 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
                 }
                 arr->items[idx] = value;
                 WRITE_BARRIER(vm, arr);
+                GEN_BARRIER_VALUE(vm, arr, value);
             }
         } else if (IS_MAP(target)) {
             Map* map = (Map*)AS_OBJ(target);
+            if (unlikely(map->frozen)) RUNTIME_ERROR("Cannot modify frozen map.");
             if (IS_STRING(index)) {
                 ObjString* key = AS_STRING(index);
-                mapSetStr(map, key->chars, key->length, value);
+                mapSetString(vm, map, key, value);
             } else if (IS_INT(index)) {
-                mapSetInt(map, (int)AS_INT(index), value);
+                mapSetInt(vm, map, AS_INT(index), value);
+            } else {
+                RUNTIME_ERROR("Map keys must be ints or strings, got %s.", valueTypeName(index));
             }
             WRITE_BARRIER(vm, map);
+        } else if (IS_OBJ(target) && AS_OBJ(target)->type == OBJ_STRUCT_INSTANCE) {
+            Function* method = specialMethod(target, "__setindex__");
+            if (!method) {
+                RUNTIME_ERROR("Struct '%s' has no __setindex__ method.", ((StructInstance*)AS_OBJ(target))->def->name);
+            }
+            Value argv[3] = { target, index, value };
+            Value ignored;
+            CALL_SPECIAL(ignored, method, argv, 3);
+            (void)ignored;
+        } else if (IS_STRING(target)) {
+            RUNTIME_ERROR("Cannot assign into a string: strings can't be changed.");
         }
         NEXT();
     }
 
+    op_slice: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        Value result = sliceValue(vm, regs[b], regs[c], regs[c + 1]);
+        if (unlikely(vm->throwPending)) {
+            captureTrace(vm, chunk, ip);
+            goto throw_value;
+        }
+        regs[a] = result;
+        NEXT();
+    }
+
     // ===== OBJECT CREATION =====
     op_newarray: {
         uint32_t inst = FETCH();
@@ -785,10 +1935,23 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         NEXT();
     }
 
+    op_newset: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        regs[a] = OBJ_VAL(newSet(vm));
+        NEXT();
+    }
+
     op_newstruct: {
         // OP_NEWSTRUCT A B C: R(A) = new instance of StructDef R(B) with C fields
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
+        // The name of a struct literal can be rebound after it was compiled
+        if (!IS_OBJ(regs[b]) || AS_OBJ(regs[b])->type != OBJ_STRUCT_DEF ||
+            ((StructDef*)AS_OBJ(regs[b]))->fieldCount != c) {
+            RUNTIME_ERROR("Struct literal needs the struct it was compiled for, got %s.", valueTypeName(regs[b]));
+        }
         StructDef* def = (StructDef*)AS_OBJ(regs[b]);
         vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
         StructInstance* si = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
@@ -810,6 +1973,10 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         StructDef* s = ALLOCATE_OBJ(vm, StructDef, OBJ_STRUCT_DEF);
         s->fieldCount = fieldCount;
         s->fields = malloc(sizeof(char*) * fieldCount);
+        s->defaults = NULL;
+        s->methods = NULL;
+        s->methodCount = 0;
+        s->shape = ++vm->structShapes;
 
         ObjString* nameStr = AS_STRING(constants[nameIdx]);
         s->name = nameStr->chars;
@@ -857,6 +2024,23 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         NEXT();
     }
 
+    // Methods follow their STRUCTDEF, one METHOD each
+    op_method: {
+        uint32_t inst = FETCH();
+        Value vd = regs[DECODE_A(inst)], vf = regs[DECODE_B(inst)];
+        if (unlikely(!IS_OBJ(vd) || AS_OBJ(vd)->type != OBJ_STRUCT_DEF ||
+                     !IS_OBJ(vf) || AS_OBJ(vf)->type != OBJ_FUNCTION)) {
+            RUNTIME_ERROR("Bytecode adds a method outside a struct definition.");
+        }
+        StructDef* def = (StructDef*)AS_OBJ(vd);
+        Function* method = (Function*)AS_OBJ(vf);
+        def->methods = realloc(def->methods, sizeof(Function*) * (def->methodCount + 1));
+        def->methods[def->methodCount++] = method;
+        WRITE_BARRIER(vm, def);
+        GEN_BARRIER(vm, def, method);
+        NEXT();
+    }
+
     // ===== ARRAY BUILTINS =====
     op_push: {
         uint32_t inst = FETCH();
@@ -865,9 +2049,47 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         if (IS_ARRAY(arrVal)) {
             vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
             Array* arr = (Array*)AS_OBJ(arrVal);
+            if (unlikely(arr->frozen)) RUNTIME_ERROR("Cannot modify frozen array.");
             arrayPush(vm, arr, val);
             WRITE_BARRIER(vm, arr);
+        } else if (IS_SET(arrVal)) {
+            // An element of a set literal
+            if (unlikely(!isSetElement(val))) {
+                RUNTIME_ERROR("Set elements must be ints or strings, got %s.", valueTypeName(val));
+            }
+            setAdd(vm, (Map*)AS_OBJ(arrVal), val);
+        }
+        NEXT();
+    }
+
+    // ...R(B): append every element of an iterable to the array or set R(A)
+    op_spread: {
+        uint32_t inst = FETCH();
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        Value iterable = iterableOf(vm, regs[DECODE_B(inst)]);
+        if (unlikely(!isIterable(iterable))) {
+            RUNTIME_ERROR("Cannot spread %s.", valueTypeName(iterable));
+        }
+        Value target = regs[DECODE_A(inst)];
+        Value cursor = INT_VAL(0), element;
+        if (IS_SET(target)) {
+            Map* set = (Map*)AS_OBJ(target);
+            while (iteratorNext(vm, iterable, &cursor, &element)) {
+                if (unlikely(!isSetElement(element))) {
+                    RUNTIME_ERROR("Set elements must be ints or strings, got %s.", valueTypeName(element));
+                }
+                setAdd(vm, set, element);
+            }
+            NEXT();
         }
+        if (unlikely(!IS_ARRAY(target))) RUNTIME_ERROR("Cannot spread into %s.", valueTypeName(target));
+        vm->stack[vm->stackTop++] = iterable; // A set's elements, while the array grows
+        Array* arr = (Array*)AS_OBJ(target);
+        while (iteratorNext(vm, iterable, &cursor, &element)) {
+            arrayPush(vm, arr, element);
+        }
+        vm->stackTop--;
+        WRITE_BARRIER(vm, arr);
         NEXT();
     }
 
@@ -877,6 +2099,7 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         Value arrVal = regs[b];
         if (IS_ARRAY(arrVal)) {
             Array* arr = (Array*)AS_OBJ(arrVal);
+            if (unlikely(arr->frozen)) RUNTIME_ERROR("Cannot modify frozen array.");
             Value result;
             if (arrayPop(arr, &result)) {
                 regs[a] = result;
@@ -893,17 +2116,23 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst);
         Value v = regs[b];
-        int count = 0;
+        int64_t count = 0;
         if (IS_ARRAY(v)) count = ((Array*)AS_OBJ(v))->count;
         else if (IS_STRING(v)) count = ((ObjString*)AS_OBJ(v))->length;
-        else if (IS_MAP(v)) {
-            Map* m = (Map*)AS_OBJ(v);
-            for (int i = 0; i < TABLE_SIZE; i++) {
-                MapEntry* e = m->buckets[i];
-                while (e) { count++; e = e->next; }
+        else if (IS_MAP(v) || IS_SET(v)) count = ((Map*)AS_OBJ(v))->count;
+        else if (IS_STRING_BUILDER(v)) count = ((StringBuilder*)AS_OBJ(v))->length;
+        else if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_RANGE) count = rangeLength((Range*)AS_OBJ(v));
+        else if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_STRUCT_INSTANCE) {
+            Function* method = specialMethod(v, "__len__");
+            if (!method) {
+                RUNTIME_ERROR("Struct '%s' has no __len__ method.", ((StructInstance*)AS_OBJ(v))->def->name);
             }
+            Value n;
+            CALL_SPECIAL(n, method, &v, 1);
+            if (!IS_INT(n)) RUNTIME_ERROR("__len__ must return an int, got %s.", valueTypeName(n));
+            count = AS_INT(n);
         }
-        regs[a] = INT_VAL(count);
+        INT_RESULT(a, count);
         NEXT();
     }
 
@@ -912,16 +2141,14 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         uint32_t inst = FETCH();
         uint8_t a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst);
         // Same as string concat in op_add
-        const char* sB = AS_CSTRING(regs[b]);
-        const char* sC = AS_CSTRING(regs[c]);
-        size_t lenB = strlen(sB), lenC = strlen(sC);
+        ObjString* sB = AS_STRING(regs[b]);
+        ObjString* sC = AS_STRING(regs[c]);
+        int lenB = sB->length, lenC = sC->length;
         char* result = malloc(lenB + lenC + 1);
-        memcpy(result, sB, lenB);
-        memcpy(result + lenB, sC, lenC);
+        memcpy(result, sB->chars, lenB);
+        memcpy(result + lenB, sC->chars, lenC);
         result[lenB + lenC] = '\0';
-        ObjString* str = internString(vm, result, lenB + lenC);
-        free(result);
-        regs[a] = OBJ_VAL(str);
+        regs[a] = OBJ_VAL(takeString(vm, result, lenB + lenC));
         NEXT();
     }
 
@@ -933,65 +2160,70 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         Value nameVal = constants[bx];
         char* rawPath = AS_CSTRING(nameVal);
 
-        char* importPath = rawPath;
-        char* resolvedPath = NULL;
-
-        if (rawPath[0] == '.') {
-            if (vm->callStackTop > 0) {
-                CallFrame* frame = &vm->callStack[vm->callStackTop - 1];
-                if (frame->function && frame->function->modulePath) {
-                    char* tmp = strdup(frame->function->modulePath);
-                    char* dir = dirname(tmp);
-                    size_t lenDir = strlen(dir);
-                    size_t lenName = strlen(rawPath);
-                    resolvedPath = malloc(lenDir + 1 + lenName + 1);
-                    sprintf(resolvedPath, "%s/%s", dir, rawPath);
-                    importPath = resolvedPath;
-                    free(tmp);
-                }
-            }
+        // Relative paths resolve against the file doing the import
+        const char* importerPath = NULL;
+        if (vm->callStackTop > 0) {
+            CallFrame* frame = &vm->callStack[vm->callStackTop - 1];
+            if (frame->function) importerPath = frame->function->modulePath;
+        }
+        char* importPath = resolveImportPath(vm, importerPath, rawPath);
+        if (!importPath) {
+            RUNTIME_ERROR("Could not import module '%s'.", rawPath);
+        }
+
+        // A module's top-level code runs once; later imports share it
+        ModuleEntry* entry = findModuleEntry(vm, importPath, true);
+        if (entry->module) {
+            free(importPath);
+            regs[a] = OBJ_VAL(entry->module);
+            NEXT();
+        }
+        if (entry->loading) {
+            char chain[224]; // Leaves room in the message for the prefix
+            describeImportCycle(vm, entry, chain, sizeof(chain));
+            free(importPath);
+            RUNTIME_ERROR("Circular import: %s", chain);
         }
 
         char* source = readFile_internal(importPath);
         if (!source) {
-            fprintf(stderr, "Runtime Error: Could not import module '%s'\n", rawPath);
-            exit(1);
+            removeModuleEntry(vm, entry);
+            free(importPath);
+            RUNTIME_ERROR("Could not import module '%s'.", rawPath);
         }
-
-        Lexer lex;
-        initLexer(&lex, source);
-        Parser p;
-        p.tokens = malloc(64 * sizeof(Token));
-        p.count = 0; p.capacity = 64; p.current = 0;
-        while (true) {
-            Token t = scanToken(&lex);
-            if (p.count >= p.capacity) { p.capacity *= 2; p.tokens = realloc(p.tokens, p.capacity * sizeof(Token)); }
-            p.tokens[p.count++] = t;
-            if (t.type == TOKEN_EOF) break;
+        char syntaxError[256];
+        Node* ast = parseModule(vm, importPath, source, syntaxError, sizeof(syntaxError));
+        if (!ast) {
+            removeModuleEntry(vm, entry);
+            free(importPath);
+            free(source);
+            RUNTIME_ERROR("%s", syntaxError);
         }
-        Node* ast = parse(&p);
+        entry->loading = true;
+        entry->importer = vm->importing;
+        vm->importing = entry;
 
+        // Modules see the script's globals and natives, not their importer's
         Environment* oldEnv = vm->globalEnv;
+        Environment* rootEnv = oldEnv;
+        while (rootEnv->enclosing) rootEnv = rootEnv->enclosing;
         Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-        modEnv->enclosing = oldEnv;
+        modEnv->enclosing = rootEnv;
         memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
         memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
         vm->globalEnv = modEnv;
 
         BytecodeChunk* modChunk = malloc(sizeof(BytecodeChunk));
         initChunk(modChunk);
-        compileToBytecode(vm, ast, modChunk, importPath);
 
-        Function* modFunc = malloc(sizeof(Function));
-        modFunc->obj.type = OBJ_FUNCTION;
-        modFunc->obj.isMarked = false;
-        modFunc->obj.isPermanent = false;
-        modFunc->obj.generation = 0;
-        modFunc->obj.next = vm->objects;
-        vm->objects = (Obj*)modFunc;
+        Function* modFunc = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
         modFunc->name = (Token){0};
         modFunc->params = NULL;
         modFunc->paramCount = 0;
+        modFunc->requiredCount = 0;
+        modFunc->isVariadic = false;
+        modFunc->isMethod = false;
+        modFunc->defaults = NULL;
         modFunc->isNative = false;
         modFunc->isAsync = false;
         modFunc->bytecodeChunk = modChunk;
@@ -1000,27 +2232,49 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         modFunc->closure = NULL;
         modFunc->native = NULL;
         modFunc->body = NULL;
+        modFunc->upvalueCount = 0;
+        modFunc->upvalues = NULL;
+        modFunc->proto = NULL;
+
+        // Root the module function so its constants survive collections
+        // triggered while compiling
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        vm->stack[vm->stackTop++] = OBJ_VAL(modFunc);
+        compileToBytecode(vm, ast, modChunk, importPath);
+        vm->stackTop--;
 
         // Execute module
-        if (vm->callStackTop >= CALL_STACK_MAX) {
-            printf("Runtime Error: Stack overflow during import\n");
-            exit(1);
+        if (vm->callStackTop >= vm->maxFrames) {
+            RUNTIME_ERROR("Stack overflow during import");
         }
         CallFrame* frame = &vm->callStack[vm->callStackTop++];
         frame->ip = ip + 1;
         frame->chunk = chunk;
         frame->function = modFunc;
+        frame->env = NULL;
         frame->regBase = vm->regBase;
         frame->resultReg = a;
+        frame->resultCount = 1;
         frame->prevGlobalEnv = oldEnv;
+        frame->returnValue = NIL_VAL;
+        frame->defers = NULL;
 
         // Allocate register window for module
         int modBase = vm->regBase + chunk->maxRegs + 1;
         vm->regBase = modBase;
         regs = vm->registers + vm->regBase;
+        for (int i = 0; i <= modChunk->maxRegs; i++) regs[i] = NIL_VAL; // See op_call
 
         int modEntryDepth = vm->callStackTop - 1;
         executeBytecode(vm, modChunk, modEntryDepth);
+        vm->importing = entry->importer;
+        if (vm->throwPending) {
+            // Uncaught inside the module: forget it so a later import retries
+            removeModuleEntry(vm, entry);
+            free(source);
+            free(importPath);
+            goto throw_value;
+        }
 
         // Restore
         vm->regBase = frame->regBase;
@@ -1031,16 +2285,19 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         ip = frame->ip;
         // vm->callStackTop-- is already done by return instruction inside executeBytecode
 
-        // Create module object
+        // Create module object (modEnv is unreachable until stored in it)
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        vm->stack[vm->stackTop++] = OBJ_VAL(modEnv);
         Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
+        vm->stackTop--;
         mod->env = modEnv;
-        mod->name = strdup(importPath);
+        mod->name = importPath;
         mod->source = NULL;
         regs[a] = OBJ_VAL(mod);
+        entry->module = mod;
+        entry->loading = false;
 
         free(source);
-        if (resolvedPath) free(resolvedPath);
-        if (p.tokens) free(p.tokens);
 
         DISPATCH();
     }
@@ -1053,7 +2310,7 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         // b = function reg, c = arg count
         Value funcVal = regs[b];
         if (!IS_OBJ(funcVal) || AS_OBJ(funcVal)->type != OBJ_FUNCTION) {
-            printf("Runtime Error: Async call on non-function\n"); exit(1);
+            RUNTIME_ERROR("Async call on non-function");
         }
         Function* func = (Function*)AS_OBJ(funcVal);
 
@@ -1093,11 +2350,79 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         NEXT();
     }
 
+    // spawn R(A)(args): the coroutine starts with copies of the arguments,
+    // so nothing here is left rooted by it
+    op_spawn: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        Value* args = &regs[a + 1];
+        int argCount = DECODE_B(inst);
+        if (DECODE_C(inst)) {
+            if (unlikely(!IS_ARRAY(regs[a + 1]))) RUNTIME_ERROR("Spread call needs an array of arguments.");
+            Array* argArray = (Array*)AS_OBJ(regs[a + 1]);
+            args = argArray->items;
+            argCount = argArray->count;
+        }
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        if (!spawnCoroutine(vm, regs[a], args, argCount)) {
+            captureTrace(vm, chunk, ip);
+            goto throw_value;
+        }
+        NEXT();
+    }
+
+    op_defer: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        Value* args = &regs[a + 1];
+        int argCount = DECODE_B(inst);
+        if (DECODE_C(inst)) {
+            if (unlikely(!IS_ARRAY(regs[a + 1]))) RUNTIME_ERROR("Spread call needs an array of arguments.");
+            Array* argArray = (Array*)AS_OBJ(regs[a + 1]);
+            args = argArray->items;
+            argCount = argArray->count;
+        }
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        if (!deferCall(vm, &vm->callStack[vm->callStackTop - 1], regs[a], args, argCount)) {
+            captureTrace(vm, chunk, ip);
+            goto throw_value;
+        }
+        NEXT();
+    }
+
+    // A with block is a handler that, instead of catching, closes the
+    // resource and lets the throw go on (see throw_value)
+    op_with: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        if (unlikely(!IS_NIL(regs[a]) && !resourceCloser(regs[a]))) {
+            RUNTIME_ERROR("with expects a value with a __close__ method, got %s.", valueTypeName(regs[a]));
+        }
+        if (unlikely(vm->tryHandlerCount >= TRY_HANDLER_MAX)) {
+            RUNTIME_ERROR("Too many nested try blocks.");
+        }
+        TryHandler* h = &vm->tryHandlers[vm->tryHandlerCount++];
+        h->frameDepth = vm->callStackTop;
+        h->regBase = vm->regBase;
+        h->chunk = chunk;
+        h->catchIp = ip; // Where an error's __close__ is called from
+        h->errorReg = a;
+        h->globalEnv = vm->globalEnv;
+        h->closes = true;
+        NEXT();
+    }
+
+    op_endwith: {
+        uint32_t inst = FETCH();
+        POP_OWN_HANDLER();
+        if (!closeResource(vm, regs[DECODE_A(inst)], chunk, ip)) goto throw_value;
+        NEXT();
+    }
+
     // ===== SPECIAL =====
     op_print: {
         uint32_t inst = FETCH();
-        printValue(regs[DECODE_A(inst)]);
-        printf("\n");
+        CALL_BACK(printLine(vm, regs[DECODE_A(inst)]));
         NEXT();
     }
 
@@ -1105,14 +2430,199 @@ uint64_t executeBytecode(VM* vm, BytecodeChunk* chunk, int entryStackDepth) {
         goto done;
     }
 
-    op_nop: {
+    // ===== EXCEPTIONS =====
+    op_try: {
+        uint32_t inst = FETCH();
+        if (unlikely(vm->tryHandlerCount >= TRY_HANDLER_MAX)) {
+            RUNTIME_ERROR("Too many nested try blocks.");
+        }
+        TryHandler* h = &vm->tryHandlers[vm->tryHandlerCount++];
+        h->frameDepth = vm->callStackTop;
+        h->regBase = vm->regBase;
+        h->chunk = chunk;
+        h->catchIp = ip + DECODE_sBx(inst) + 1;
+        h->errorReg = DECODE_A(inst);
+        h->globalEnv = vm->globalEnv;
+        h->closes = false;
         NEXT();
     }
 
-#else
-    #error "Computed goto not supported. Use GCC or Clang."
-#endif
+    op_endtry: {
+        POP_OWN_HANDLER();
+        NEXT();
+    }
+
+    op_throw: {
+        uint32_t inst = FETCH();
+        vm->thrownValue = regs[DECODE_A(inst)];
+        captureTrace(vm, chunk, ip);
+        goto throw_value;
+    }
+
+    // Unwind to the innermost handler: drop the frames above it, close
+    // their upvalues and resume at its catch block with the value in R(A)
+    throw_value: {
+        vm->throwPending = true;
+        // A broken resource limit skips every try block (and deferred call),
+        // ending the run
+        if (unlikely(vm->limitAbort)) {
+            vm->tryHandlerCount = handlerFloor;
+        } else {
+            // A panic passes every catch block; with blocks still close
+            if (unlikely(vm->panicking)) {
+                while (vm->tryHandlerCount > handlerFloor && !vm->tryHandlers[vm->tryHandlerCount - 1].closes) {
+                    vm->tryHandlerCount--;
+                }
+            }
+            // The frames being left run their deferred calls first
+            int floorDepth = vm->tryHandlerCount > handlerFloor
+                ? vm->tryHandlers[vm->tryHandlerCount - 1].frameDepth : entryStackDepth;
+            if (vm->regTop < vm->regBase + (int)(chunk->maxRegs + 1)) {
+                vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+            }
+            unwindDefers(vm, floorDepth, chunk, ip);
+        }
+        if (vm->tryHandlerCount == handlerFloor) {
+            // An outer activation may still catch it (see op_import)
+            if (handlerFloor > 0) return getMicroseconds() - startTime;
+            reportUncaught(vm);
+            exit(1);
+        }
+
+        TryHandler* h = &vm->tryHandlers[--vm->tryHandlerCount];
+        vm->callStackTop = h->frameDepth;
+        vm->regBase = h->regBase;
+        regs = vm->registers + vm->regBase;
+        if (vm->openUpvalues) closeUpvalues(vm, &regs[h->errorReg]);
+        vm->globalEnv = h->globalEnv;
+        chunk = h->chunk;
+        constants = chunk->constants;
+        ip = h->catchIp;
+
+        if (h->closes) {
+            // The error goes on unless __close__ throws one of its own
+            int root = vm->stackTop;
+            bool panicking = vm->panicking;
+            vm->stack[vm->stackTop++] = vm->thrownValue;
+            vm->thrownValue = NIL_VAL;
+            vm->throwPending = false;
+            vm->panicking = false;
+            SavedTrace trace;
+            saveTrace(vm, &trace);
+            if (closeResource(vm, regs[h->errorReg], chunk, ip)) {
+                restoreTrace(vm, &trace);
+                vm->thrownValue = vm->stack[root];
+            }
+            vm->panicking = panicking || vm->panicking;
+            vm->stackTop = root;
+            goto throw_value;
+        }
+
+        regs[h->errorReg] = vm->thrownValue;
+        vm->thrownValue = NIL_VAL;
+        vm->errorTraceCount = 0;
+        vm->throwPending = false;
+        DISPATCH();
+    }
+
+    // ===== FOREACH =====
+    // R(A) holds the iterable, R(A+1) the cursor and R(A+2) the element
+    op_foreach_prep: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        Value iterable = iterableOf(vm, regs[DECODE_B(inst)]);
+        if (unlikely(!isIterable(iterable))) {
+            RUNTIME_ERROR("Cannot iterate over %s.", valueTypeName(iterable));
+        }
+        regs[a] = iterable;
+        regs[a + 1] = INT_VAL(0);
+        NEXT();
+    }
+
+    op_foreach_next: {
+        uint32_t inst = FETCH();
+        uint8_t a = DECODE_A(inst);
+        vm->regTop = vm->regBase + (int)(chunk->maxRegs + 1);
+        if (!iteratorNext(vm, regs[a], &regs[a + 1], &regs[a + 2])) {
+            ip += DECODE_sBx(inst) + 1;
+            DISPATCH();
+        }
+        NEXT();
+    }
+
+    op_nop: {
+        NEXT();
+    }
 
 done:
     return getMicroseconds() - startTime;
 }
+
+// Call a bytecode function from inside a native (e.g. a sort comparator).
+// The callee gets a fresh register window above the native's caller and a
+// frame whose return address is the native's call site, so the caller's
+// registers stay rooted and stack traces run through it. If the callee
+// throws and a handler outside this activation exists, throwPending is
+// still set on return and the native must return at once.
+Value callBytecodeFunction(VM* vm, Function* func, Value* args, int argCount) {
+    BytecodeChunk* callee = func->bytecodeChunk;
+    if (!arityFits(func, argCount)) {
+        char msg[128];
+        formatArityError(func, argCount, msg, sizeof(msg));
+        return nativeError(vm, "%s", msg);
+    }
+    int base = vm->regTop;
+    if (vm->callStackTop >= vm->maxFrames || base + callee->maxRegs + 1 > STACK_MAX) {
+        return nativeError(vm, "Stack overflow.");
+    }
+
+    BytecodeChunk* callerChunk = vm->nativeChunk;
+    uint32_t* callerIp = vm->nativeIp;
+    int savedBase = vm->regBase, savedTop = vm->regTop;
+    Environment* savedGlobalEnv = vm->globalEnv;
+
+    Value rest = NIL_VAL;
+    if (func->isVariadic) argCount = collectRest(vm, func, args, argCount, &rest);
+
+    Value* regs = vm->registers + base;
+    regs[0] = OBJ_VAL(func);
+    for (int i = 0; i < argCount; i++) regs[i + 1] = args[i];
+    for (int i = argCount + 1; i <= callee->maxRegs; i++) regs[i] = NIL_VAL;
+    if (func->isVariadic) regs[func->paramCount] = rest;
+
+    int depth = vm->callStackTop;
+    CallFrame* frame = &vm->callStack[vm->callStackTop++];
+    frame->ip = callerIp ? callerIp + 1 : NULL;
+    frame->chunk = callerChunk;
+    frame->function = func;
+    frame->env = NULL;
+    frame->regBase = savedBase;
+    frame->resultReg = 0;
+    frame->resultCount = 1;
+    frame->argCount = argCount;
+    frame->prevGlobalEnv = savedGlobalEnv;
+    frame->returnValue = NIL_VAL;
+    frame->defers = NULL;
+    if (func->moduleEnv) vm->globalEnv = func->moduleEnv;
+
+    vm->regBase = base;
+    vm->regTop = base + callee->maxRegs + 1;
+    executeBytecode(vm, callee, depth);
+    Value result = vm->callStack[depth].returnValue;
+
+    vm->regBase = savedBase;
+    vm->regTop = savedTop;
+    vm->globalEnv = savedGlobalEnv;
+    vm->nativeChunk = callerChunk; // Natives run by the callee moved these
+    vm->nativeIp = callerIp;
+    return vm->throwPending ? NIL_VAL : result;
+}
+
+bool callProtected(VM* vm, Function* func, Value* args, int argCount, Value* result, Value* thrown) {
+    vm->nativeChunk = NULL;
+    vm->nativeIp = NULL;
+    bool returned = callGuarded(vm, func, args, argCount, result, thrown);
+    vm->limitAbort = false; // The caller has the limit error now
+    return returned;
+}
@@ -19,6 +19,7 @@ static const OpcodeInfo OPCODE_TABLE[] = {
     [OP_GETGLOBAL]  = {"GETGLOBAL",  1, false},
     [OP_SETGLOBAL]  = {"SETGLOBAL",  1, true},
     [OP_DEFGLOBAL]  = {"DEFGLOBAL",  1, true},
+    [OP_DEFCONST]   = {"DEFCONST",   1, true},
 
     // Arithmetic
     [OP_ADD]        = {"ADD",        0, false},
@@ -27,8 +28,17 @@ static const OpcodeInfo OPCODE_TABLE[] = {
     [OP_SUBI]       = {"SUBI",       2, false},
     [OP_MUL]        = {"MUL",        0, false},
     [OP_DIV]        = {"DIV",        0, false},
+    [OP_IDIV]       = {"IDIV",       0, false},
     [OP_MOD]        = {"MOD",        0, false},
     [OP_NEG]        = {"NEG",        0, false},
+    [OP_BAND]       = {"BAND",       0, false},
+    [OP_BOR]        = {"BOR",        0, false},
+    [OP_BXOR]       = {"BXOR",       0, false},
+    [OP_SHL]        = {"SHL",        0, false},
+    [OP_SHR]        = {"SHR",        0, false},
+    [OP_BNOT]       = {"BNOT",       0, false},
+    [OP_INC]        = {"INC",        0, false},
+    [OP_DEC]        = {"DEC",        0, false},
 
     // Comparisons
     [OP_LT]         = {"LT",        0, false},
@@ -46,30 +56,48 @@ static const OpcodeInfo OPCODE_TABLE[] = {
     [OP_JMPF]       = {"JMPF",       2, false},
     [OP_JMPT]       = {"JMPT",       2, false},
     [OP_LOOP]       = {"LOOP",       3, false},
+    [OP_JMPARG]     = {"JMPARG",     2, false},
+    [OP_JMPNIL]     = {"JMPNIL",     2, false},
+    [OP_JMPNOTNIL]  = {"JMPNOTNIL",  2, false},
 
     // Function calls
     [OP_CALL]       = {"CALL",       0, true},
-    [OP_RETURN]     = {"RETURN",     4, true},
+    [OP_TAILCALL]   = {"TAILCALL",   0, true},
+    [OP_CALLSPREAD] = {"CALLSPREAD", 0, true},
+    [OP_CALLNAMED]  = {"CALLNAMED",  0, true},
+    [OP_RETURN]     = {"RETURN",     0, true},
     [OP_RETURNNIL]  = {"RETURNNIL",  4, true},
 
+    // Closures
+    [OP_CLOSURE]    = {"CLOSURE",    1, true},
+    [OP_GETUPVAL]   = {"GETUPVAL",   0, false},
+    [OP_SETUPVAL]   = {"SETUPVAL",   0, true},
+    [OP_CLOSE]      = {"CLOSE",      4, true},
+
     // Property access
     [OP_GETPROP]    = {"GETPROP",    0, false},
     [OP_SETPROP]    = {"SETPROP",    0, true},
+    [OP_GETPROPR]   = {"GETPROPR",   0, false},
+    [OP_SETPROPR]   = {"SETPROPR",   0, true},
 
     // Index access
     [OP_GETIDX]     = {"GETIDX",     0, false},
     [OP_SETIDX]     = {"SETIDX",     0, true},
+    [OP_SLICE]      = {"SLICE",      0, false},
 
     // Object creation
     [OP_NEWARRAY]   = {"NEWARRAY",   1, true},
     [OP_NEWMAP]     = {"NEWMAP",     4, true},
+    [OP_NEWSET]     = {"NEWSET",     4, true},
     [OP_NEWSTRUCT]  = {"NEWSTRUCT",  0, true},
 
     // Struct definition
     [OP_STRUCTDEF]  = {"STRUCTDEF",  1, true},
+    [OP_METHOD]     = {"METHOD",     0, true},
 
     // Array builtins
     [OP_PUSH]       = {"PUSH",       0, true},
+    [OP_SPREAD]     = {"SPREAD",     0, true},
     [OP_POP]        = {"POP",        0, true},
     [OP_LEN]        = {"LEN",        0, false},
 
@@ -79,6 +107,7 @@ static const OpcodeInfo OPCODE_TABLE[] = {
     // Async
     [OP_ASYNC]      = {"ASYNC",      0, true},
     [OP_AWAIT]      = {"AWAIT",      0, true},
+    [OP_SPAWN]      = {"SPAWN",      0, true},
 
     // Special
     [OP_PRINT]      = {"PRINT",      4, true},
@@ -91,6 +120,14 @@ static const OpcodeInfo OPCODE_TABLE[] = {
 
     // Concatenation
     [OP_CONCAT]     = {"CONCAT",     0, false},
+
+    // Exceptions
+    [OP_TRY]        = {"TRY",        2, true},
+    [OP_ENDTRY]     = {"ENDTRY",     4, true},
+    [OP_THROW]      = {"THROW",      4, true},
+    [OP_DEFER]      = {"DEFER",      0, true},
+    [OP_WITH]       = {"WITH",       4, true},
+    [OP_ENDWITH]    = {"ENDWITH",    4, true},
 };
 
 const OpcodeInfo* getOpcodeInfo(OpCode op) {
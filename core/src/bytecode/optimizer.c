@@ -0,0 +1,278 @@
+#include "bytecode/optimizer.h"
+#include <stdlib.h>
+#include <string.h>
+
+/**
+ * Peephole pass over one chunk. Each round sweeps the code once, rewriting
+ * in place and marking what to remove, then compacts it; rounds repeat
+ * while anything changed. Within a round no jump is sent to an instruction
+ * that was already rewritten or removed, since it may now depend on the
+ * instruction before it having run.
+ */
+
+typedef struct {
+    BytecodeChunk* chunk;
+    bool* capture;      // Capture words after OP_CLOSURE: data, not instructions
+    int* landings;      // Number of jumps landing on each instruction
+    bool* removed;      // Marked this round, dropped by compact()
+    bool* touched;      // Rewritten or removed this round
+} Peephole;
+
+// Where the jump at 'pc' lands, or -1 when it is not a jump
+static int jumpTarget(uint32_t inst, int pc) {
+    switch (DECODE_OP(inst)) {
+        case OP_JMP:  return pc + 1 + DECODE_sBx24(inst);
+        case OP_LOOP: return pc + 1 - DECODE_sBx24(inst);
+        case OP_JMPF:
+        case OP_JMPT:
+        case OP_JMPARG:
+        case OP_JMPNIL:
+        case OP_JMPNOTNIL:
+        case OP_FOREACH_NEXT:
+        case OP_TRY:
+            return pc + 1 + DECODE_sBx(inst);
+        default:
+            return -1;
+    }
+}
+
+// Point the jump at 'pc' to 'target'; false when the offset doesn't fit.
+// JMP and LOOP swap so that backward jumps are always LOOPs.
+static bool retarget(uint32_t* inst, int pc, int target) {
+    uint8_t op = DECODE_OP(*inst);
+    int offset = target - pc - 1;
+    if (op == OP_JMP || op == OP_LOOP) {
+        if (offset > 0x7FFFFF || -offset > 0x7FFFFF) return false;
+        *inst = offset >= 0 ? ENCODE_sBx(OP_JMP, offset) : ENCODE_sBx(OP_LOOP, -offset);
+        return true;
+    }
+    if (offset < -0x7FFF || offset > 0x8000) return false;
+    *inst = ENCODE_AsBx(op, DECODE_A(*inst), offset);
+    return true;
+}
+
+static void markCaptures(Peephole* p) {
+    BytecodeChunk* chunk = p->chunk;
+    memset(p->capture, 0, sizeof(bool) * chunk->codeSize);
+    for (int pc = 0; pc < chunk->codeSize; pc++) {
+        uint32_t inst = chunk->code[pc];
+        if (DECODE_OP(inst) != OP_CLOSURE) continue;
+        Value k = chunk->constants[DECODE_Bx(inst)];
+        int upvalues = ((Function*)AS_OBJ(k))->upvalueCount;
+        for (int i = 0; i < upvalues && pc + 1 < chunk->codeSize; i++) p->capture[++pc] = true;
+    }
+}
+
+static void countLandings(Peephole* p) {
+    BytecodeChunk* chunk = p->chunk;
+    memset(p->landings, 0, sizeof(int) * (chunk->codeSize + 1));
+    for (int pc = 0; pc < chunk->codeSize; pc++) {
+        if (p->capture[pc]) continue;
+        int target = jumpTarget(chunk->code[pc], pc);
+        if (target >= 0 && target <= chunk->codeSize) p->landings[target]++;
+    }
+}
+
+// Whether a closure in this chunk captures register 'reg'
+static bool isCaptured(Peephole* p, int reg) {
+    for (int pc = 0; pc < p->chunk->codeSize; pc++) {
+        uint32_t word = p->chunk->code[pc];
+        if (p->capture[pc] && DECODE_OP(word) == OP_MOVE && (int)DECODE_B(word) == reg) return true;
+    }
+    return false;
+}
+
+// Follow unconditional jumps from the target of the jump at 'pc'. Only a
+// JMP itself may pass through a LOOP or a backward JMP; the others would
+// become backward conditional jumps. A cycle of jumps is left alone.
+static int threadTarget(Peephole* p, int pc) {
+    BytecodeChunk* chunk = p->chunk;
+    bool unconditional = DECODE_OP(chunk->code[pc]) == OP_JMP;
+    int first = jumpTarget(chunk->code[pc], pc);
+    int target = first;
+    for (int steps = 0; steps <= chunk->codeSize; steps++) {
+        if (target < 0 || target >= chunk->codeSize || p->capture[target]) return target;
+        uint32_t next = chunk->code[target];
+        uint8_t op = DECODE_OP(next);
+        if (op != OP_JMP && op != OP_LOOP) return target;
+        int further = jumpTarget(next, target);
+        if (!unconditional && (op == OP_LOOP || further <= target)) return target;
+        target = further;
+    }
+    return first;
+}
+
+// Send the jump at 'pc' to 'target' if the offset fits and that
+// instruction is unchanged this round
+static bool redirect(Peephole* p, int pc, int target) {
+    if (target < p->chunk->codeSize && p->touched[target]) return false;
+    if (!retarget(&p->chunk->code[pc], pc, target)) return false;
+    p->landings[target]++;
+    return true;
+}
+
+// A pure load: writes R(A) and nothing else, and cannot throw
+static bool isLoad(uint32_t inst) {
+    switch (DECODE_OP(inst)) {
+        case OP_MOVE:
+        case OP_LOADK:
+        case OP_LOADI:
+        case OP_LOADNIL:
+        case OP_LOADTRUE:
+        case OP_LOADFALSE:
+        case OP_GETUPVAL:
+            return true;
+        default:
+            return false;
+    }
+}
+
+// Patterns starting at 'pc'; returns true when something changed
+static bool rewrite(Peephole* p, int pc) {
+    BytecodeChunk* chunk = p->chunk;
+    uint32_t* code = chunk->code;
+    uint32_t inst = code[pc];
+    uint8_t op = DECODE_OP(inst);
+    uint8_t a = DECODE_A(inst);
+    int next = pc + 1;
+    bool hasNext = next < chunk->codeSize && !p->capture[next] && !p->removed[next];
+    bool nextIsEntry = hasNext && p->landings[next] > 0;
+
+    // Jumps to jumps
+    if (op == OP_JMP || op == OP_LOOP || op == OP_JMPF || op == OP_JMPT ||
+        op == OP_JMPARG || op == OP_JMPNIL || op == OP_JMPNOTNIL || op == OP_FOREACH_NEXT || op == OP_TRY) {
+        int target = jumpTarget(inst, pc);
+        if ((op == OP_JMP || op == OP_JMPF || op == OP_JMPT) && target == next) {
+            p->removed[pc] = true;
+            return true;
+        }
+        int threaded = threadTarget(p, pc);
+        if (threaded != target && redirect(p, pc, threaded)) return true;
+        if (op == OP_JMP && target < chunk->codeSize && !p->capture[target]) {
+            uint8_t landing = DECODE_OP(code[target]);
+            if (landing == OP_RETURN || landing == OP_RETURNNIL) {
+                code[pc] = code[target];
+                return true;
+            }
+        }
+    }
+
+    // JMPF R(A) over a JMP: one JMPT R(A) to where that JMP goes
+    if ((op == OP_JMPF || op == OP_JMPT) && hasNext && !nextIsEntry &&
+        jumpTarget(inst, pc) == next + 1 && DECODE_OP(code[next]) == OP_JMP) {
+        code[pc] = ENCODE_AsBx(op == OP_JMPF ? OP_JMPT : OP_JMPF, a, 0);
+        if (redirect(p, pc, jumpTarget(code[next], next))) {
+            p->removed[next] = true;
+            return true;
+        }
+        code[pc] = inst;
+    }
+
+    // A local struct's MOVE R(A) R(A) is where its STRUCTDEF puts the def
+    if (op == OP_MOVE && DECODE_B(inst) == a &&
+        !(pc > 0 && DECODE_OP(code[pc - 1]) == OP_STRUCTDEF)) {
+        p->removed[pc] = true;
+        return true;
+    }
+
+    if (!hasNext) return false;
+    uint32_t second = code[next];
+    uint8_t secondOp = DECODE_OP(second);
+
+    // A load overwritten before it is read
+    if (isLoad(inst) && isLoad(second) && DECODE_A(second) == a &&
+        !(secondOp == OP_MOVE && DECODE_B(second) == a)) {
+        p->removed[pc] = true;
+        return true;
+    }
+
+    if (nextIsEntry) return false;
+
+    if (op == OP_LOADI && secondOp == OP_NEG && DECODE_A(second) == a && DECODE_B(second) == a) {
+        int n = DECODE_sBx(inst);
+        if (-n >= -0x7FFF && -n <= 0x8000) {
+            code[pc] = ENCODE_AsBx(OP_LOADI, a, -n);
+            p->removed[next] = true;
+            return true;
+        }
+    }
+
+    if (op == OP_MOVE && secondOp == OP_MOVE &&
+        DECODE_A(second) == DECODE_B(inst) && DECODE_B(second) == a) {
+        p->removed[next] = true;
+        return true;
+    }
+
+    if (op == OP_MOVE && secondOp == OP_RETURN && DECODE_A(second) == a &&
+        DECODE_B(second) == 1 && !isCaptured(p, a)) {
+        code[next] = ENCODE_ABC(OP_RETURN, DECODE_B(inst), 1, 0);
+        p->removed[pc] = true;
+        return true;
+    }
+    return false;
+}
+
+// Drop removed instructions and their lines; repatch jumps and scopes
+static void compact(Peephole* p) {
+    BytecodeChunk* chunk = p->chunk;
+    int size = chunk->codeSize;
+    // Removed instructions map to the next one that stays
+    int* newIndex = malloc(sizeof(int) * (size + 1));
+    int kept = 0;
+    for (int pc = 0; pc < size; pc++) {
+        newIndex[pc] = kept;
+        if (!p->removed[pc]) kept++;
+    }
+    newIndex[size] = kept;
+
+    // Offsets only shrink, so every jump still fits
+    for (int pc = 0; pc < size; pc++) {
+        if (p->removed[pc] || p->capture[pc]) continue;
+        int target = jumpTarget(chunk->code[pc], pc);
+        if (target >= 0 && target <= size) retarget(&chunk->code[pc], newIndex[pc], newIndex[target]);
+    }
+    for (int pc = 0; pc < size; pc++) {
+        if (p->removed[pc]) continue;
+        chunk->code[newIndex[pc]] = chunk->code[pc];
+        chunk->locations[newIndex[pc]] = chunk->locations[pc];
+    }
+    for (int i = 0; i < chunk->localCount; i++) {
+        LocalDebugInfo* local = &chunk->locals[i];
+        if (local->startPc >= 0 && local->startPc <= size) local->startPc = newIndex[local->startPc];
+        if (local->endPc >= 0 && local->endPc <= size) local->endPc = newIndex[local->endPc];
+    }
+    chunk->codeSize = kept;
+    free(newIndex);
+}
+
+void optimizeChunk(BytecodeChunk* chunk) {
+    if (chunk->codeSize == 0) return;
+    Peephole p;
+    p.chunk = chunk;
+    p.capture = malloc(sizeof(bool) * chunk->codeSize);
+    p.landings = malloc(sizeof(int) * (chunk->codeSize + 1));
+    p.removed = malloc(sizeof(bool) * chunk->codeSize);
+    p.touched = malloc(sizeof(bool) * chunk->codeSize);
+
+    bool changed = true;
+    while (changed) {
+        changed = false;
+        markCaptures(&p);
+        countLandings(&p);
+        memset(p.removed, 0, sizeof(bool) * chunk->codeSize);
+        memset(p.touched, 0, sizeof(bool) * chunk->codeSize);
+        for (int pc = 0; pc < chunk->codeSize; pc++) {
+            if (p.capture[pc] || p.removed[pc] || !rewrite(&p, pc)) continue;
+            changed = true;
+            p.touched[pc] = true;
+            if (pc + 1 < chunk->codeSize) p.touched[pc + 1] = true;
+            pc++;   // The next instruction may be gone or merged
+        }
+        if (changed) compact(&p);
+    }
+
+    free(p.capture);
+    free(p.landings);
+    free(p.removed);
+    free(p.touched);
+}
@@ -0,0 +1,219 @@
+#include "bytecode/profiler.h"
+#include "bytecode/opcodes.h"
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+/**
+ * Keeps a shadow of each call stack, one activation per frame, with when
+ * it started and how much of that went to the frames it called. When a
+ * frame ends its time is added to its function:
+ *
+ *   total  call to return, added only for an activation that was the
+ *          function's outermost one, so recursion is not counted twice
+ *   self   the same minus the time in the functions it called
+ *
+ * Natives have no frame, so their time is their caller's self time. While
+ * a coroutine is suspended its clock is stopped.
+ */
+
+typedef struct {
+    Function* function;  // Prototype, shared by a function's closures
+    char* name;
+    uint64_t calls;
+    int64_t totalNs;
+    int64_t selfNs;
+    int active;          // Open activations
+} ProfileEntry;
+
+typedef struct {
+    Function* function;  // As in the frame, to notice when it is replaced
+    int entry;
+    int64_t start;
+    int64_t childNs;     // Time in the frames it called
+    bool outermost;      // No other activation of the function was open
+} Activation;
+
+// Shadow of one call stack: the script's or a coroutine's
+typedef struct {
+    CallFrame* frames;
+    Activation* items;
+    int count;
+    int capacity;
+    int64_t pausedAt;    // When another stack took over
+} ShadowStack;
+
+struct Profiler {
+    ProfileEntry* entries;
+    int entryCount;
+    int* buckets;        // Entry index + 1 by function pointer, 0 when empty
+    int bucketCount;     // Power of two, at least twice entryCount
+    ShadowStack* stacks;
+    int stackCount;
+    int current;         // The running stack, -1 before the first instruction
+    uint8_t lastOp;      // Opcode of the previous instruction
+};
+
+static int64_t nowNs(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (int64_t)ts.tv_sec * 1000000000LL + ts.tv_nsec;
+}
+
+Profiler* newProfiler(void) {
+    Profiler* p = calloc(1, sizeof(Profiler));
+    p->bucketCount = 64;
+    p->buckets = calloc(p->bucketCount, sizeof(int));
+    p->current = -1;
+    return p;
+}
+
+void freeProfiler(Profiler* p) {
+    if (!p) return;
+    for (int i = 0; i < p->entryCount; i++) free(p->entries[i].name);
+    for (int i = 0; i < p->stackCount; i++) free(p->stacks[i].items);
+    free(p->entries);
+    free(p->buckets);
+    free(p->stacks);
+    free(p);
+}
+
+static int bucketOf(Profiler* p, Function* fn) {
+    uintptr_t h = (uintptr_t)fn >> 4;
+    h ^= h >> 16;
+    int mask = p->bucketCount - 1;
+    int b = (int)(h & (uintptr_t)mask);
+    while (p->buckets[b] != 0 && p->entries[p->buckets[b] - 1].function != fn) b = (b + 1) & mask;
+    return b;
+}
+
+// Index of the entry for 'fn', added on its first call
+static int entryFor(Profiler* p, Function* fn) {
+    if (fn->proto) fn = fn->proto;
+    int b = bucketOf(p, fn);
+    if (p->buckets[b] != 0) return p->buckets[b] - 1;
+
+    if ((p->entryCount + 1) * 2 > p->bucketCount) {
+        free(p->buckets);
+        p->bucketCount *= 2;
+        p->buckets = calloc(p->bucketCount, sizeof(int));
+        for (int i = 0; i < p->entryCount; i++) {
+            p->buckets[bucketOf(p, p->entries[i].function)] = i + 1;
+        }
+        b = bucketOf(p, fn);
+    }
+    p->entries = realloc(p->entries, sizeof(ProfileEntry) * (p->entryCount + 1));
+    ProfileEntry* e = &p->entries[p->entryCount];
+    memset(e, 0, sizeof(ProfileEntry));
+    e->function = fn;
+    e->name = fn->name.length > 0 ? strndup(fn->name.start, fn->name.length) : strdup("<module>");
+    p->buckets[b] = ++p->entryCount;
+    return p->entryCount - 1;
+}
+
+static void push(Profiler* p, ShadowStack* s, Function* fn, int64_t now) {
+    if (s->count == s->capacity) {
+        s->capacity = s->capacity ? s->capacity * 2 : 64;
+        s->items = realloc(s->items, sizeof(Activation) * s->capacity);
+    }
+    int entry = entryFor(p, fn);
+    ProfileEntry* e = &p->entries[entry];
+    s->items[s->count++] = (Activation){fn, entry, now, 0, e->active == 0};
+    e->calls++;
+    e->active++;
+}
+
+static void pop(Profiler* p, ShadowStack* s, int64_t now) {
+    Activation* a = &s->items[--s->count];
+    int64_t elapsed = now - a->start;
+    ProfileEntry* e = &p->entries[a->entry];
+    e->selfNs += elapsed - a->childNs;
+    if (a->outermost) e->totalNs += elapsed;
+    e->active--;
+    if (s->count > 0) s->items[s->count - 1].childNs += elapsed;
+}
+
+// Make the shadow of 'frames' the running one; its clock restarts
+static ShadowStack* switchTo(Profiler* p, CallFrame* frames, int64_t now) {
+    if (p->current >= 0) p->stacks[p->current].pausedAt = now;
+    for (int i = 0; i < p->stackCount; i++) {
+        if (p->stacks[i].frames != frames) continue;
+        ShadowStack* s = &p->stacks[i];
+        int64_t paused = now - s->pausedAt;
+        for (int j = 0; j < s->count; j++) s->items[j].start += paused;
+        p->current = i;
+        return s;
+    }
+    p->stacks = realloc(p->stacks, sizeof(ShadowStack) * (p->stackCount + 1));
+    ShadowStack* s = &p->stacks[p->stackCount];
+    memset(s, 0, sizeof(ShadowStack));
+    s->frames = frames;
+    p->current = p->stackCount++;
+    return s;
+}
+
+void profileInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip) {
+    Profiler* p = vm->profiler;
+    int depth = vm->callStackTop;
+    // The top frame is a new one at the same depth after a tail call that
+    // reused the frame (landing on the callee's first instruction), and
+    // after a return straight into a native's next callback
+    bool replaced = (p->lastOp == OP_TAILCALL && ip == chunk->code) ||
+                    p->lastOp == OP_RETURN || p->lastOp == OP_RETURNNIL;
+    p->lastOp = DECODE_OP(*ip);
+
+    ShadowStack* s = NULL;
+    int64_t now = 0;
+    if (p->current < 0 || p->stacks[p->current].frames != vm->callStack) {
+        now = nowNs();
+        s = switchTo(p, vm->callStack, now);
+        replaced = false; // The previous instruction ran on another stack
+    } else {
+        s = &p->stacks[p->current];
+        // Most instructions run in the frame the previous one ran in
+        if (s->count == depth && !replaced &&
+            (depth == 0 || s->items[depth - 1].function == vm->callStack[depth - 1].function)) {
+            return;
+        }
+        now = nowNs();
+    }
+
+    if (s->count > depth) {
+        while (s->count > depth) pop(p, s, now); // Returned to a frame it saw
+    } else if (s->count == depth && depth > 0 &&
+               (replaced || s->items[depth - 1].function != vm->callStack[depth - 1].function)) {
+        pop(p, s, now);
+    }
+    while (s->count < depth) push(p, s, vm->callStack[s->count].function, now);
+}
+
+static int compareEntries(const void* a, const void* b) {
+    const ProfileEntry* x = a;
+    const ProfileEntry* y = b;
+    if (x->selfNs != y->selfNs) return x->selfNs > y->selfNs ? -1 : 1;
+    if (x->calls != y->calls) return x->calls > y->calls ? -1 : 1;
+    return strcmp(x->name, y->name);
+}
+
+void printProfile(VM* vm, FILE* out) {
+    Profiler* p = vm->profiler;
+    int64_t now = nowNs();
+    for (int i = 0; i < p->stackCount; i++) {
+        ShadowStack* s = &p->stacks[i];
+        int64_t end = i == p->current ? now : s->pausedAt;
+        while (s->count > 0) pop(p, s, end);
+    }
+    qsort(p->entries, p->entryCount, sizeof(ProfileEntry), compareEntries);
+    // Sorting moved the entries under the buckets
+    memset(p->buckets, 0, sizeof(int) * p->bucketCount);
+    for (int i = 0; i < p->entryCount; i++) p->buckets[bucketOf(p, p->entries[i].function)] = i + 1;
+
+    flushOutput(vm); // Keep program output ahead of the report
+    fprintf(out, "\n=== Profile ===\n");
+    fprintf(out, "%-24s %10s %12s %12s\n", "Function", "calls", "total ms", "self ms");
+    for (int i = 0; i < p->entryCount; i++) {
+        ProfileEntry* e = &p->entries[i];
+        fprintf(out, "  %-22s %10llu %12.3f %12.3f\n", e->name, (unsigned long long)e->calls,
+                e->totalNs / 1e6, e->selfNs / 1e6);
+    }
+}
@@ -0,0 +1,741 @@
+#include "bytecode/serialize.h"
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <unistd.h>
+#include <sys/stat.h>
+
+/**
+ * Bytecode Serialization
+ *
+ * Chunk layout:
+ *   int32 maxRegs
+ *   int32 codeSize, then codeSize x uint32 instruction words
+ *   codeSize x (int32 line, int32 column)
+ *   int32 constantCount, then one tagged constant each
+ *
+ * Constant tags:
+ *   K_NIL, K_TRUE, K_FALSE         no payload
+ *   K_INT                          int64
+ *   K_FLOAT                        raw IEEE 754 bits (uint64)
+ *   K_STRING                       int32 length + bytes
+ *   K_FUNCTION                     name (as K_STRING payload), int32 paramCount,
+ *                                  paramCount parameter names (as K_STRING
+ *                                  payloads), int32 requiredCount, uint8 isAsync,
+ *                                  uint8 isVariadic, uint8 isMethod,
+ *                                  int32 upvalueCount, nested chunk
+ */
+
+typedef enum {
+    K_NIL,
+    K_TRUE,
+    K_FALSE,
+    K_INT,
+    K_FLOAT,
+    K_STRING,
+    K_FUNCTION
+} ConstTag;
+
+// ===== Writer =====
+
+static void writeU8(FILE* f, uint8_t v) { fputc(v, f); }
+
+static void writeU32(FILE* f, uint32_t v) {
+    uint8_t b[4] = { v & 0xFF, (v >> 8) & 0xFF, (v >> 16) & 0xFF, (v >> 24) & 0xFF };
+    fwrite(b, 1, 4, f);
+}
+
+static void writeU64(FILE* f, uint64_t v) {
+    writeU32(f, (uint32_t)(v & 0xFFFFFFFF));
+    writeU32(f, (uint32_t)(v >> 32));
+}
+
+static void writeBytes(FILE* f, const char* s, int len) {
+    writeU32(f, (uint32_t)len);
+    fwrite(s, 1, len, f);
+}
+
+static bool writeChunkData(FILE* f, BytecodeChunk* chunk);
+
+static bool writeConstant(FILE* f, Value v) {
+    if (IS_NIL(v))  { writeU8(f, K_NIL); return true; }
+    if (IS_BOOL(v)) { writeU8(f, AS_BOOL(v) ? K_TRUE : K_FALSE); return true; }
+    if (IS_INT(v))  { writeU8(f, K_INT); writeU64(f, (uint64_t)AS_INT(v)); return true; }
+    if (IS_FLOAT(v)) { writeU8(f, K_FLOAT); writeU64(f, v); return true; }
+
+    Obj* o = AS_OBJ(v);
+    if (o->type == OBJ_STRING) {
+        ObjString* s = (ObjString*)o;
+        writeU8(f, K_STRING);
+        writeBytes(f, s->chars, s->length);
+        return true;
+    }
+    if (o->type == OBJ_FUNCTION) {
+        Function* fn = (Function*)o;
+        if (fn->isNative || !fn->bytecodeChunk) {
+            fprintf(stderr, "Error: Cannot serialize native function constant.\n");
+            return false;
+        }
+        writeU8(f, K_FUNCTION);
+        writeBytes(f, fn->name.start ? fn->name.start : "", fn->name.start ? fn->name.length : 0);
+        writeU32(f, (uint32_t)fn->paramCount);
+        // Named arguments are bound by these
+        for (int i = 0; i < fn->paramCount; i++) {
+            Token param = fn->params ? fn->params[i] : (Token){TOKEN_IDENTIFIER, "", 0, 0, 0};
+            writeBytes(f, param.start, param.length);
+        }
+        writeU32(f, (uint32_t)fn->requiredCount);
+        writeU8(f, fn->isAsync ? 1 : 0);
+        writeU8(f, fn->isVariadic ? 1 : 0);
+        writeU8(f, fn->isMethod ? 1 : 0);
+        writeU32(f, (uint32_t)fn->upvalueCount);
+        return writeChunkData(f, fn->bytecodeChunk);
+    }
+
+    fprintf(stderr, "Error: Cannot serialize constant of object type %d.\n", o->type);
+    return false;
+}
+
+static bool writeChunkData(FILE* f, BytecodeChunk* chunk) {
+    writeU32(f, (uint32_t)chunk->maxRegs);
+    writeU32(f, (uint32_t)chunk->codeSize);
+    for (int i = 0; i < chunk->codeSize; i++) writeU32(f, chunk->code[i]);
+    for (int i = 0; i < chunk->codeSize; i++) {
+        writeU32(f, (uint32_t)chunk->locations[i].line);
+        writeU32(f, (uint32_t)chunk->locations[i].column);
+    }
+
+    writeU32(f, (uint32_t)chunk->constantCount);
+    for (int i = 0; i < chunk->constantCount; i++) {
+        if (!writeConstant(f, chunk->constants[i])) return false;
+    }
+    return true;
+}
+
+// Directory part of 'path' ("." when it has none) in 'out'
+static void directoryOf(const char* path, char* out, size_t size) {
+    const char* slash = strrchr(path, '/');
+    if (!slash) snprintf(out, size, ".");
+    else if (slash == path) snprintf(out, size, "/");
+    else snprintf(out, size, "%.*s", (int)(slash - path), path);
+}
+
+// 'sourcePath' relative to the directory 'unc' is in, so the pair can move
+// together; "" when either cannot be resolved
+static void relativeSource(const char* sourcePath, const char* unc, char* out, size_t size) {
+    char dir[2048], from[2048], to[2048];
+    out[0] = '\0';
+    directoryOf(unc, dir, sizeof(dir));
+    if (!sourcePath || !normalizePath(dir, from, sizeof(from)) || !normalizePath(sourcePath, to, sizeof(to))) return;
+
+    // Longest common run of whole directories
+    size_t common = 0;
+    for (size_t i = 0; from[i] && from[i] == to[i]; i++) {
+        if (from[i + 1] == '\0' && to[i + 1] == '/') common = i + 1;
+        else if (from[i] == '/') common = i;
+    }
+    if (strcmp(from, "/") == 0) common = 0;
+
+    size_t used = 0;
+    for (const char* p = from + common; *p; p++) {
+        if (*p == '/' && used < size) used += snprintf(out + used, size - used, "../");
+    }
+    if (used < size) snprintf(out + used, size - used, "%s", to + common + 1);
+}
+
+// Header and chunk; 'source' is recorded as given
+static bool writeImage(FILE* f, BytecodeChunk* chunk, const char* source) {
+    fwrite(UNC_MAGIC, 1, UNC_MAGIC_LEN, f);
+    writeU8(f, UNC_FORMAT_VERSION);
+    writeU8(f, OPCODE_COUNT);
+    writeBytes(f, source, (int)strlen(source));
+    return writeChunkData(f, chunk);
+}
+
+bool writeBytecodeFile(BytecodeChunk* chunk, const char* path, const char* sourcePath) {
+    char source[2048];
+    relativeSource(sourcePath, path, source, sizeof(source));
+
+    FILE* f = fopen(path, "wb");
+    if (!f) {
+        fprintf(stderr, "Error: Could not open \"%s\" for writing.\n", path);
+        return false;
+    }
+
+    bool ok = writeImage(f, chunk, source);
+    if (fclose(f) != 0) ok = false;
+    if (!ok) remove(path);
+    return ok;
+}
+
+// ===== Reader =====
+
+typedef struct {
+    const uint8_t* data;
+    size_t size;
+    size_t pos;
+    bool failed;
+} Reader;
+
+static bool need(Reader* r, size_t n) {
+    if (r->failed || r->pos + n > r->size) {
+        r->failed = true;
+        return false;
+    }
+    return true;
+}
+
+static uint8_t readU8(Reader* r) {
+    if (!need(r, 1)) return 0;
+    return r->data[r->pos++];
+}
+
+static uint32_t readU32(Reader* r) {
+    if (!need(r, 4)) return 0;
+    const uint8_t* b = r->data + r->pos;
+    r->pos += 4;
+    return (uint32_t)b[0] | (uint32_t)b[1] << 8 | (uint32_t)b[2] << 16 | (uint32_t)b[3] << 24;
+}
+
+static uint64_t readU64(Reader* r) {
+    uint64_t lo = readU32(r);
+    uint64_t hi = readU32(r);
+    return lo | (hi << 32);
+}
+
+// Returns a pointer into the image; length in *len
+static const char* readBytes(Reader* r, int* len) {
+    uint32_t n = readU32(r);
+    if (!need(r, n)) return NULL;
+    const char* s = (const char*)(r->data + r->pos);
+    r->pos += n;
+    *len = (int)n;
+    return s;
+}
+
+typedef struct {
+    const char* modulePath;     // Recorded on every loaded function
+    const char* sourcePath;     // Copied to every loaded chunk, or NULL
+} LoadPaths;
+
+static bool readChunkData(VM* vm, Reader* r, BytecodeChunk* chunk, LoadPaths* paths, int upvalueCount);
+
+static bool readConstant(VM* vm, Reader* r, BytecodeChunk* chunk, LoadPaths* paths) {
+    uint8_t tag = readU8(r);
+    if (r->failed) return false;
+
+    switch (tag) {
+        case K_NIL:   addConstant(chunk, NIL_VAL); return true;
+        case K_TRUE:  addConstant(chunk, BOOL_VAL(true)); return true;
+        case K_FALSE: addConstant(chunk, BOOL_VAL(false)); return true;
+        case K_INT: {
+            int64_t n = (int64_t)readU64(r);
+            if (r->failed) return false;
+            addConstant(chunk, intValue(vm, n));
+            return true;
+        }
+        case K_FLOAT: addConstant(chunk, (Value)readU64(r)); return !r->failed;
+        case K_STRING: {
+            int len = 0;
+            const char* s = readBytes(r, &len);
+            if (!s) return false;
+            // Added to the (GC-reachable) chunk immediately so it stays rooted
+            addConstant(chunk, OBJ_VAL(internConstant(vm, s, len)));
+            return true;
+        }
+        case K_FUNCTION: {
+            int nameLen = 0;
+            const char* name = readBytes(r, &nameLen);
+            if (!name) return false;
+            int paramCount = (int)readU32(r);
+            if (r->failed || paramCount < 0 || (size_t)paramCount * 4 > r->size - r->pos) {
+                r->failed = true;
+                return false;
+            }
+            Token* params = malloc(sizeof(Token) * (paramCount > 0 ? paramCount : 1));
+            for (int i = 0; i < paramCount; i++) {
+                int paramLen = 0;
+                const char* param = readBytes(r, &paramLen);
+                if (!param) {
+                    for (int j = 0; j < i; j++) free((char*)params[j].start);
+                    free(params);
+                    return false;
+                }
+                params[i] = (Token){TOKEN_IDENTIFIER, strndup(param, paramLen), paramLen, 0, 0};
+            }
+
+            Function* func = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
+
+            // Token names normally point into the source; keep our own copy
+            func->name = (Token){TOKEN_IDENTIFIER, strndup(name, nameLen), nameLen, 0, 0};
+            func->params = params;
+            func->paramCount = paramCount;
+            func->requiredCount = (int)readU32(r);
+            func->defaults = NULL;
+            func->isAsync = readU8(r) != 0;
+            func->isVariadic = readU8(r) != 0;
+            func->isMethod = readU8(r) != 0;
+            func->isNative = false;
+            func->native = NULL;
+            func->body = NULL;
+            func->closure = NULL;
+            func->modulePath = paths->modulePath ? strdup(paths->modulePath) : NULL;
+            func->moduleEnv = vm->globalEnv;
+            func->upvalueCount = (int)readU32(r);
+            func->upvalues = NULL;
+            func->proto = NULL;
+            func->bytecodeChunk = malloc(sizeof(BytecodeChunk));
+            initChunk(func->bytecodeChunk);
+
+            // Reachable from the parent chunk before its own constants are loaded
+            addConstant(chunk, OBJ_VAL(func));
+            // A variadic function's rest array is its last parameter
+            if (r->failed || func->requiredCount < 0 || func->requiredCount > paramCount ||
+                (func->isVariadic && paramCount == 0) ||
+                func->upvalueCount < 0 || func->upvalueCount > FRAME_REG_MAX) {
+                r->failed = true;
+                return false;
+            }
+            if (!readChunkData(vm, r, func->bytecodeChunk, paths, func->upvalueCount)) return false;
+            // The parameters arrive in R(1)..R(paramCount)
+            if (paramCount > func->bytecodeChunk->maxRegs) {
+                fprintf(vm->errorOut, "Error: Function '%.*s' has more parameters than registers.\n", nameLen, name);
+                r->failed = true;
+                return false;
+            }
+            return true;
+        }
+        default:
+            fprintf(vm->errorOut, "Error: Unknown constant tag %d in bytecode.\n", tag);
+            r->failed = true;
+            return false;
+    }
+}
+
+// ===== Operand Checks =====
+//
+// The interpreter trusts its operands: registers, constant indices, upvalue
+// indices and jump targets are used without bounds checks. A loaded chunk
+// is held to what the compiler guarantees before any of it runs, so a
+// damaged or hand-made image is rejected instead of reading or writing
+// outside the chunk.
+
+typedef struct {
+    BytecodeChunk* chunk;
+    int upvalueCount;   // Of the function the chunk belongs to; 0 at top level
+    int pc;
+    bool ok;
+} OperandCheck;
+
+// R(first)..R(last) are inside the register window
+static void checkRegs(OperandCheck* k, int first, int last) {
+    if (first < 0 || last > k->chunk->maxRegs) k->ok = false;
+}
+
+static void checkReg(OperandCheck* k, int reg) { checkRegs(k, reg, reg); }
+
+static void checkConstant(OperandCheck* k, int index) {
+    if (index < 0 || index >= k->chunk->constantCount) k->ok = false;
+}
+
+static void checkString(OperandCheck* k, int index) {
+    checkConstant(k, index);
+    if (k->ok && !IS_STRING(k->chunk->constants[index])) k->ok = false;
+}
+
+static void checkUpvalue(OperandCheck* k, int index) {
+    if (index >= k->upvalueCount) k->ok = false;
+}
+
+// Jumps land on an instruction of the same chunk
+static void checkJump(OperandCheck* k, int offset) {
+    int target = k->pc + 1 + offset;
+    if (target < 0 || target >= k->chunk->codeSize) k->ok = false;
+}
+
+static void checkInstruction(OperandCheck* k, uint32_t inst) {
+    int a = DECODE_A(inst), b = DECODE_B(inst), c = DECODE_C(inst), bx = DECODE_Bx(inst);
+    switch ((OpCode)DECODE_OP(inst)) {
+        case OP_MOVE: case OP_NEG: case OP_BNOT: case OP_INC: case OP_DEC: case OP_NOT:
+        case OP_METHOD: case OP_PUSH: case OP_SPREAD: case OP_POP: case OP_LEN: case OP_AWAIT:
+            checkReg(k, a);
+            checkReg(k, b);
+            break;
+        case OP_ADD: case OP_SUB: case OP_MUL: case OP_DIV: case OP_IDIV: case OP_MOD:
+        case OP_BAND: case OP_BOR: case OP_BXOR: case OP_SHL: case OP_SHR:
+        case OP_LT: case OP_LE: case OP_GT: case OP_GE: case OP_EQ: case OP_NE:
+        case OP_GETIDX: case OP_SETIDX: case OP_CONCAT: case OP_GETPROPR: case OP_SETPROPR:
+            checkReg(k, a);
+            checkReg(k, b);
+            checkReg(k, c);
+            break;
+        case OP_LOADI: case OP_LOADNIL: case OP_LOADTRUE: case OP_LOADFALSE:
+        case OP_ADDI: case OP_SUBI: case OP_CLOSE: case OP_NEWMAP: case OP_NEWSET:
+        case OP_WITH: case OP_ENDWITH: case OP_PRINT: case OP_THROW:
+            checkReg(k, a);
+            break;
+        case OP_LOADK:
+            checkReg(k, a);
+            checkConstant(k, bx);
+            break;
+        case OP_GETGLOBAL: case OP_SETGLOBAL: case OP_DEFGLOBAL: case OP_DEFCONST: case OP_IMPORT:
+            checkReg(k, a);
+            checkString(k, bx);
+            break;
+        case OP_JMP:
+        case OP_LOOP: {
+            int offset = DECODE_sBx24(inst);
+            checkJump(k, DECODE_OP(inst) == OP_JMP ? offset : -offset);
+            break;
+        }
+        case OP_JMPF: case OP_JMPT: case OP_JMPNIL: case OP_JMPNOTNIL: case OP_TRY:
+            checkReg(k, a);
+            checkJump(k, DECODE_sBx(inst));
+            break;
+        case OP_JMPARG:
+            checkReg(k, a + 1);
+            checkJump(k, DECODE_sBx(inst));
+            break;
+        case OP_FOREACH_PREP:
+            checkRegs(k, a, a + 1);
+            checkReg(k, b);
+            break;
+        case OP_FOREACH_NEXT:
+            checkRegs(k, a, a + 2);
+            checkJump(k, DECODE_sBx(inst));
+            break;
+        case OP_CALL: case OP_TAILCALL:
+            checkRegs(k, a, a + b);
+            checkRegs(k, a, a + c - 1);
+            break;
+        case OP_CALLSPREAD:
+            checkReg(k, b);
+            checkRegs(k, a, a + c - 1);
+            break;
+        case OP_CALLNAMED:
+            checkRegs(k, a, a + b + 1);
+            checkRegs(k, a, a + c - 1);
+            break;
+        case OP_RETURN:
+            checkRegs(k, a, a + b - 1);
+            break;
+        case OP_CLOSURE:
+            checkReg(k, a);
+            checkConstant(k, bx);
+            if (k->ok) {
+                Value proto = k->chunk->constants[bx];
+                if (!IS_OBJ(proto) || AS_OBJ(proto)->type != OBJ_FUNCTION) {
+                    k->ok = false;
+                    break;
+                }
+                // One capture word per upvalue follows
+                int captures = ((Function*)AS_OBJ(proto))->upvalueCount;
+                if (k->pc + captures >= k->chunk->codeSize) {
+                    k->ok = false;
+                    break;
+                }
+                for (int i = 1; i <= captures; i++) {
+                    OpCode op = (OpCode)DECODE_OP(k->chunk->code[k->pc + i]);
+                    if (op != OP_MOVE && op != OP_GETUPVAL) k->ok = false;
+                }
+            }
+            break;
+        case OP_GETUPVAL: case OP_SETUPVAL:
+            checkReg(k, a);
+            checkUpvalue(k, b);
+            break;
+        case OP_GETPROP:
+            checkReg(k, a);
+            checkReg(k, b);
+            checkString(k, c);
+            break;
+        case OP_SETPROP:
+            checkReg(k, a);
+            checkString(k, b);
+            checkReg(k, c);
+            break;
+        case OP_SLICE:
+            checkReg(k, a);
+            checkReg(k, b);
+            checkRegs(k, c, c + 1);
+            break;
+        case OP_NEWARRAY:
+            checkRegs(k, a, a + bx);
+            break;
+        case OP_NEWSTRUCT:
+            checkRegs(k, a, a + c);
+            checkReg(k, b);
+            break;
+        case OP_STRUCTDEF:
+            // The name, then A field names; the result goes to the register
+            // of the instruction after it
+            for (int i = 0; i <= a && k->ok; i++) checkString(k, bx + i);
+            if (k->pc + 1 >= k->chunk->codeSize) k->ok = false;
+            break;
+        case OP_ASYNC:
+            checkReg(k, a);
+            checkRegs(k, b, b + c);
+            break;
+        case OP_SPAWN: case OP_DEFER:
+            checkRegs(k, a, a + (c ? 1 : b));
+            break;
+        case OP_RETURNNIL: case OP_HALT: case OP_NOP: case OP_ENDTRY:
+            break;
+        default:
+            k->ok = false;
+            break;
+    }
+}
+
+static bool checkChunk(VM* vm, BytecodeChunk* chunk, int upvalueCount) {
+    OperandCheck k = { chunk, upvalueCount, 0, true };
+    if (chunk->maxRegs < 0 || chunk->maxRegs >= FRAME_REG_MAX) {
+        fprintf(vm->errorOut, "Error: Chunk uses %d registers, more than a frame has.\n", chunk->maxRegs);
+        return false;
+    }
+    for (k.pc = 0; k.pc < chunk->codeSize; k.pc++) {
+        checkInstruction(&k, chunk->code[k.pc]);
+        if (!k.ok) {
+            OpCode op = (OpCode)DECODE_OP(chunk->code[k.pc]);
+            fprintf(vm->errorOut, "Error: Instruction %d (%s) has an operand outside its chunk.\n",
+                    k.pc, getOpcodeInfo(op)->name);
+            return false;
+        }
+    }
+
+    // Running off the end would read past the code
+    OpCode last = chunk->codeSize > 0 ? (OpCode)DECODE_OP(chunk->code[chunk->codeSize - 1]) : OP_NOP;
+    if (last != OP_RETURN && last != OP_RETURNNIL && last != OP_HALT &&
+        last != OP_JMP && last != OP_LOOP && last != OP_THROW) {
+        fprintf(vm->errorOut, "Error: Chunk does not end in a return.\n");
+        return false;
+    }
+    return true;
+}
+
+static bool readChunkData(VM* vm, Reader* r, BytecodeChunk* chunk, LoadPaths* paths, int upvalueCount) {
+    chunk->maxRegs = (int)readU32(r);
+    int codeSize = (int)readU32(r);
+    if (r->failed || codeSize < 0 || (size_t)codeSize * 12 > r->size - r->pos) {
+        r->failed = true;
+        return false;
+    }
+
+    for (int i = 0; i < codeSize; i++) {
+        uint32_t inst = readU32(r);
+        if (DECODE_OP(inst) >= OPCODE_COUNT) {
+            fprintf(vm->errorOut, "Error: Invalid opcode %d in bytecode.\n", DECODE_OP(inst));
+            r->failed = true;
+            return false;
+        }
+        writeChunk(chunk, inst, 0, 0);
+    }
+    for (int i = 0; i < codeSize; i++) {
+        chunk->locations[i].line = (int)readU32(r);
+        chunk->locations[i].column = (int)readU32(r);
+    }
+    if (paths->sourcePath) chunk->sourcePath = strdup(paths->sourcePath);
+
+    int constantCount = (int)readU32(r);
+    for (int i = 0; i < constantCount && !r->failed; i++) {
+        if (!readConstant(vm, r, chunk, paths)) return false;
+    }
+    if (r->failed) return false;
+    if (!checkChunk(vm, chunk, upvalueCount)) {
+        r->failed = true;
+        return false;
+    }
+    return true;
+}
+
+bool isBytecodeImage(const char* data, size_t size) {
+    return size >= UNC_MAGIC_LEN && memcmp(data, UNC_MAGIC, UNC_MAGIC_LEN) == 0;
+}
+
+bool loadBytecode(VM* vm, const char* data, size_t size, BytecodeChunk* chunk, const char* modulePath) {
+    if (!isBytecodeImage(data, size)) {
+        fprintf(vm->errorOut, "Error: Not an Unnarize bytecode file.\n");
+        return false;
+    }
+
+    Reader r = { (const uint8_t*)data, size, UNC_MAGIC_LEN, false };
+    uint8_t version = readU8(&r);
+    uint8_t opcodes = readU8(&r);
+    if (r.failed || version != UNC_FORMAT_VERSION || opcodes != OPCODE_COUNT) {
+        fprintf(vm->errorOut, "Error: Bytecode format version %d is not supported by unnarize %s "
+                        "(expected version %d). Recompile the source.\n",
+                version, UNNARIZE_VERSION, UNC_FORMAT_VERSION);
+        return false;
+    }
+
+    // The recorded source, found from the .unc's directory
+    int sourceLen = 0;
+    const char* source = readBytes(&r, &sourceLen);
+    char joined[4096], normal[2048];
+    LoadPaths paths = { modulePath, NULL };
+    if (source && sourceLen > 0 && sourceLen < 2048) {
+        char dir[2048];
+        directoryOf(modulePath ? modulePath : ".", dir, sizeof(dir));
+        snprintf(joined, sizeof(joined), "%s/%.*s", dir, sourceLen, source);
+        paths.sourcePath = normalizePath(joined, normal, sizeof(normal)) ? normal : joined;
+    }
+
+    // Young collections wait, as for compileToBytecode
+    vm->gcYoungHold++;
+    bool loaded = !r.failed && readChunkData(vm, &r, chunk, &paths, 0);
+    vm->gcYoungHold--;
+    if (!loaded) {
+        fprintf(vm->errorOut, "Error: Bytecode file is truncated or corrupt.\n");
+        return false;
+    }
+    return true;
+}
+
+// ===== Bytecode Cache =====
+
+#define CACHE_MAGIC "UNCK"
+
+// FNV-1a, 64-bit
+static uint64_t hashBytes(const char* data, size_t size) {
+    uint64_t h = 14695981039346656037ULL;
+    for (size_t i = 0; i < size; i++) {
+        h ^= (uint8_t)data[i];
+        h *= 1099511628211ULL;
+    }
+    return h;
+}
+
+// Creates 'path' and the directories above it as needed
+static bool makeDirectories(const char* path) {
+    char dir[2048];
+    snprintf(dir, sizeof(dir), "%s", path);
+    for (char* p = dir + 1; ; p++) {
+        if (*p != '/' && *p != '\0') continue;
+        char saved = *p;
+        *p = '\0';
+        if (mkdir(dir, 0755) != 0 && errno != EEXIST) return false;
+        *p = saved;
+        if (saved == '\0') return true;
+    }
+}
+
+bool bytecodeCachePath(const char* sourcePath, char* out, size_t size) {
+    char dir[2048];
+    const char* base = getenv("UNNARIZE_CACHE_DIR");
+    if (base) {
+        if (base[0] == '\0') return false;
+        snprintf(dir, sizeof(dir), "%s", base);
+    } else if ((base = getenv("XDG_CACHE_HOME")) && base[0] == '/') {
+        snprintf(dir, sizeof(dir), "%s/unnarize", base);
+    } else if ((base = getenv("HOME")) && base[0] != '\0') {
+        snprintf(dir, sizeof(dir), "%s/.cache/unnarize", base);
+    } else {
+        return false;
+    }
+
+    // One file per script, named after it and told apart by its full path
+    char full[2048];
+    if (!normalizePath(sourcePath, full, sizeof(full)) || !makeDirectories(dir)) return false;
+    const char* name = strrchr(full, '/') + 1;
+    const char* dot = strrchr(name, '.');
+    int stem = dot && dot != name ? (int)(dot - name) : (int)strlen(name);
+    int n = snprintf(out, size, "%s/%.*s-%016llx.unc", dir, stem, name,
+                     (unsigned long long)hashBytes(full, strlen(full)));
+    return n > 0 && (size_t)n < size;
+}
+
+// Size and modification time of the running interpreter, so a rebuild
+// drops what an older build wrote even when the version did not change
+static void interpreterStamp(uint64_t* size, uint64_t* mtime) {
+    struct stat st;
+    *size = 0;
+    *mtime = 0;
+    if (stat("/proc/self/exe", &st) == 0) {
+        *size = (uint64_t)st.st_size;
+        *mtime = (uint64_t)st.st_mtime;
+    }
+}
+
+static void writeCacheKey(FILE* f, const char* source, size_t sourceSize, bool optimized,
+                          const char* image, size_t imageSize) {
+    uint64_t exeSize, exeTime;
+    interpreterStamp(&exeSize, &exeTime);
+    fwrite(CACHE_MAGIC, 1, 4, f);
+    writeBytes(f, UNNARIZE_VERSION, (int)strlen(UNNARIZE_VERSION));
+    writeU8(f, optimized ? 1 : 0);
+    writeU64(f, exeSize);
+    writeU64(f, exeTime);
+    writeU64(f, (uint64_t)sourceSize);
+    writeU64(f, hashBytes(source, sourceSize));
+    writeU64(f, (uint64_t)imageSize);
+    writeU64(f, hashBytes(image, imageSize));
+}
+
+char* readBytecodeCache(const char* path, const char* source, size_t sourceSize, bool optimized, size_t* imageSize) {
+    FILE* f = fopen(path, "rb");
+    if (!f) return NULL;
+    fseek(f, 0, SEEK_END);
+    long size = ftell(f);
+    fseek(f, 0, SEEK_SET);
+    char* data = size > 0 ? malloc((size_t)size) : NULL;
+    bool read = data && fread(data, 1, (size_t)size, f) == (size_t)size;
+    fclose(f);
+    if (!read) {
+        free(data);
+        return NULL;
+    }
+
+    uint64_t exeSize, exeTime;
+    interpreterStamp(&exeSize, &exeTime);
+    Reader r = { (const uint8_t*)data, (size_t)size, 4, size < 4 || memcmp(data, CACHE_MAGIC, 4) != 0 };
+    int versionLen = 0;
+    const char* version = readBytes(&r, &versionLen);
+    bool valid = version && versionLen == (int)strlen(UNNARIZE_VERSION) &&
+                 memcmp(version, UNNARIZE_VERSION, versionLen) == 0;
+    valid = readU8(&r) == (optimized ? 1 : 0) && valid;
+    valid = readU64(&r) == exeSize && valid;
+    valid = readU64(&r) == exeTime && valid;
+    valid = readU64(&r) == (uint64_t)sourceSize && valid;
+    valid = readU64(&r) == hashBytes(source, sourceSize) && valid;
+    // The .unc image follows the key, and a file that was cut short or
+    // changed on disk no longer matches its hash
+    size_t recordedSize = (size_t)readU64(&r);
+    uint64_t recordedHash = readU64(&r);
+    if (r.failed || !valid || recordedSize != (size_t)size - r.pos ||
+        recordedHash != hashBytes(data + r.pos, recordedSize)) {
+        free(data);
+        return NULL;
+    }
+
+    *imageSize = recordedSize;
+    memmove(data, data + r.pos, *imageSize);
+    return data;
+}
+
+bool writeBytecodeCache(BytecodeChunk* chunk, const char* path, const char* source, size_t sourceSize, bool optimized) {
+    // Written aside and renamed into place, so a run at the same time
+    // never reads half a file
+    char temp[4096];
+    snprintf(temp, sizeof(temp), "%s.%ld.tmp", path, (long)getpid());
+
+    // The image is made first, as the key records its hash
+    char* image = NULL;
+    size_t imageSize = 0;
+    FILE* mem = open_memstream(&image, &imageSize);
+    if (!mem) return false;
+    bool ok = writeImage(mem, chunk, "");
+    if (fclose(mem) != 0) ok = false;
+    FILE* f = ok ? fopen(temp, "wb") : NULL;
+    if (!f) {
+        free(image);
+        return false;
+    }
+    writeCacheKey(f, source, sourceSize, optimized, image, imageSize);
+    ok = fwrite(image, 1, imageSize, f) == imageSize;
+    free(image);
+    if (fclose(f) != 0) ok = false;
+    if (ok && rename(temp, path) == 0) return true;
+    remove(temp);
+    return false;
+}
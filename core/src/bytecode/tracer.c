@@ -0,0 +1,98 @@
+#include "bytecode/tracer.h"
+#include <string.h>
+
+/**
+ * Prints each executed instruction to vm->traceOut, e.g.
+ *
+ *   [2 add]          0000    2  ADD           R3 R1 R2               | <fn add> 1 2 nil
+ *
+ * The registers shown are those of the running frame, R0 first.
+ */
+
+#define TRACE_REGS_MAX 16   // Registers shown per line before "..."
+#define TRACE_STRING_MAX 16 // String characters shown before "..."
+
+// Short form of a value that fits on a trace line
+static void traceValue(FILE* out, Value v) {
+    if (IS_NIL(v)) {
+        fprintf(out, "nil");
+    } else if (IS_BOOL(v)) {
+        fprintf(out, AS_BOOL(v) ? "true" : "false");
+    } else if (IS_INT(v)) {
+        fprintf(out, "%ld", (long)AS_INT(v));
+    } else if (IS_FLOAT(v)) {
+        char buf[48];
+        fprintf(out, "%s", formatDouble(AS_FLOAT(v), buf, sizeof(buf)));
+    } else if (IS_STRING(v)) {
+        ObjString* s = AS_STRING(v);
+        if (s->length > TRACE_STRING_MAX) {
+            fprintf(out, "\"%.*s...\"", TRACE_STRING_MAX, s->chars);
+        } else {
+            fprintf(out, "\"%s\"", s->chars);
+        }
+    } else {
+        Obj* o = AS_OBJ(v);
+        switch (o->type) {
+            case OBJ_ARRAY:
+                fprintf(out, "<array %d>", ((Array*)o)->count);
+                break;
+            case OBJ_MAP:
+                fprintf(out, "<map>");
+                break;
+            case OBJ_SET:
+                fprintf(out, "<set %d>", ((Map*)o)->count);
+                break;
+            case OBJ_FUNCTION: {
+                Function* fn = (Function*)o;
+                fprintf(out, "<fn %.*s>", fn->name.length, fn->name.start);
+                break;
+            }
+            case OBJ_STRUCT_DEF:
+                fprintf(out, "<struct def %s>", ((StructDef*)o)->name);
+                break;
+            case OBJ_STRUCT_INSTANCE:
+                fprintf(out, "<%s>", ((StructInstance*)o)->def->name);
+                break;
+            case OBJ_MODULE:
+                fprintf(out, "<module>");
+                break;
+            default:
+                fprintf(out, "<object>");
+                break;
+        }
+    }
+}
+
+void traceInstruction(VM* vm, BytecodeChunk* chunk, uint32_t* ip, Value* regs) {
+    FILE* out = vm->traceOut;
+    int offset = (int)(ip - chunk->code);
+
+    // Frame
+    Function* fn = vm->callStackTop > 0 ? vm->callStack[vm->callStackTop - 1].function : NULL;
+    char frame[64];
+    if (fn && fn->name.length > 0) {
+        snprintf(frame, sizeof(frame), "[%d %.*s]", vm->callStackTop, fn->name.length, fn->name.start);
+    } else {
+        snprintf(frame, sizeof(frame), "[%d <module>]", vm->callStackTop);
+    }
+
+    // Opcode and operands as the disassembler writes them, padded so the
+    // registers line up
+    char text[128] = "";
+    FILE* mem = fmemopen(text, sizeof(text), "w");
+    if (mem) {
+        describeInstruction(mem, chunk, offset);
+        fclose(mem);
+    }
+    fprintf(out, "%-16s %04d %4d  %-36s |", frame, offset, chunk->locations[offset].line, text);
+
+    // Registers
+    int count = chunk->maxRegs + 1;
+    int shown = count < TRACE_REGS_MAX ? count : TRACE_REGS_MAX;
+    for (int i = 0; i < shown; i++) {
+        fputc(' ', out);
+        traceValue(out, regs[i]);
+    }
+    if (count > shown) fprintf(out, " ...");
+    fputc('\n', out);
+}
@@ -0,0 +1,590 @@
+#include "unnarize.h"
+#include "common.h"
+#include "lexer.h"
+#include "parser.h"
+#include "vm.h"
+#include "bytecode/chunk.h"
+#include "bytecode/compiler.h"
+#include "bytecode/interpreter.h"
+#include <stdarg.h>
+#include <unistd.h>
+#include <ucontext.h>
+
+/**
+ * Embedding API (see unnarize.h)
+ *
+ * An interpreter is a VM plus what its scripts still point into: tokens,
+ * and so function names and string constants, refer to the source text
+ * and AST of the run that defined them, so every run is kept until
+ * unnFree. Host functions share one native, callHostFn, which finds the
+ * callback in the called Function's nativeData.
+ */
+
+#define EMBED_SCRIPT_NAME "<embed>"
+
+typedef struct EmbedRun {
+    char* source;
+    Parser parser;
+    Node* ast;
+    struct EmbedRun* next;
+} EmbedRun;
+
+typedef struct HostFn {
+    UnnInterp* interp;
+    UnnFn fn;
+    void* userData;
+    struct HostFn* next;
+} HostFn;
+
+typedef struct Stepper Stepper;
+
+struct UnnInterp {
+    VM vm;
+    EmbedRun* runs;
+    HostFn* hostFns;
+    Stepper* step;              // From unnStart until that run ends
+    char error[1024];
+};
+
+// --- Values ---
+
+UnnValue unnNil(void) {
+    UnnValue v;
+    v.type = UNN_NIL;
+    v.as.integer = 0;
+    return v;
+}
+
+UnnValue unnBool(bool b) {
+    UnnValue v;
+    v.type = UNN_BOOL;
+    v.as.boolean = b;
+    return v;
+}
+
+UnnValue unnInt(int64_t n) {
+    UnnValue v;
+    v.type = UNN_INT;
+    v.as.integer = n;
+    return v;
+}
+
+UnnValue unnDouble(double d) {
+    UnnValue v;
+    v.type = UNN_DOUBLE;
+    v.as.number = d;
+    return v;
+}
+
+UnnValue unnString(const char* s) {
+    UnnValue v;
+    v.type = UNN_STRING;
+    v.as.string = s ? s : "";
+    return v;
+}
+
+bool unnIsNumber(UnnValue v) {
+    return v.type == UNN_INT || v.type == UNN_DOUBLE;
+}
+
+double unnAsNumber(UnnValue v) {
+    if (v.type == UNN_INT) return (double)v.as.integer;
+    if (v.type == UNN_DOUBLE) return v.as.number;
+    return 0;
+}
+
+int64_t unnAsInt(UnnValue v) {
+    if (v.type == UNN_INT) return v.as.integer;
+    if (v.type == UNN_DOUBLE) return (int64_t)v.as.number;
+    return 0;
+}
+
+bool unnAsBool(UnnValue v) {
+    if (v.type == UNN_NIL) return false;
+    if (v.type == UNN_BOOL) return v.as.boolean;
+    return true;
+}
+
+const char* unnAsString(UnnValue v) {
+    return v.type == UNN_STRING ? v.as.string : NULL;
+}
+
+const char* unnTypeName(UnnValue v) {
+    switch (v.type) {
+        case UNN_NIL:    return "nil";
+        case UNN_BOOL:   return "bool";
+        case UNN_INT:    return "int";
+        case UNN_DOUBLE: return "double";
+        case UNN_STRING: return "string";
+        case UNN_OBJECT: return v.as.typeName;
+    }
+    return "nil";
+}
+
+void unnFreeValue(UnnValue* v) {
+    if (!v || v->type != UNN_STRING) return;
+    free((char*)v->as.string);
+    *v = unnNil();
+}
+
+// A VM value as the host sees it. Strings are borrowed from the VM unless
+// 'copy' is set.
+static UnnValue toHost(Value value, bool copy) {
+    if (IS_NIL(value)) return unnNil();
+    if (IS_BOOL(value)) return unnBool(AS_BOOL(value));
+    if (IS_INT(value)) return unnInt(AS_INT(value));
+    if (IS_FLOAT(value)) return unnDouble(AS_FLOAT(value));
+    if (IS_STRING(value)) {
+        const char* chars = AS_STRING(value)->chars;
+        return unnString(copy ? strdup(chars) : chars);
+    }
+    UnnValue v;
+    v.type = UNN_OBJECT;
+    v.as.typeName = valueTypeName(value);
+    return v;
+}
+
+// A host value in the VM. Strings are copied. Any NaN becomes the plain
+// quiet NaN, since other NaN bit patterns are how boxed values are spelled.
+static Value toVM(VM* vm, UnnValue v) {
+    switch (v.type) {
+        case UNN_BOOL:   return BOOL_VAL(v.as.boolean);
+        case UNN_INT:    return intValue(vm, v.as.integer);
+        case UNN_DOUBLE:
+            if (v.as.number != v.as.number) return (Value)0x7ff8000000000000;
+            return FLOAT_VAL(v.as.number);
+        case UNN_STRING: {
+            const char* s = v.as.string ? v.as.string : "";
+            return OBJ_VAL(internString(vm, s, (int)strlen(s)));
+        }
+        default:         return NIL_VAL;
+    }
+}
+
+// --- Interpreter ---
+
+bool unnSetHashSeed(uint32_t seed) {
+    return setHashSeed(seed);
+}
+
+UnnInterp* unnNew(void) {
+    UnnInterp* interp = malloc(sizeof(UnnInterp));
+    if (!interp) return NULL;
+    interp->runs = NULL;
+    interp->hostFns = NULL;
+    interp->step = NULL;
+    interp->error[0] = '\0';
+
+    VM* vm = &interp->vm;
+    initVM(vm);
+    setScriptDir(vm, NULL);
+    char* projectRoot = getenv("UNNARIZE_ROOT");
+    if (projectRoot) {
+        snprintf(vm->projectRoot, sizeof(vm->projectRoot), "%s", projectRoot);
+    } else if (getcwd(vm->projectRoot, sizeof(vm->projectRoot)) == NULL) {
+        vm->projectRoot[0] = '\0';
+    }
+    registerLibraries(vm);
+    return interp;
+}
+
+static void endStep(UnnInterp* interp);
+
+void unnFree(UnnInterp* interp) {
+    if (!interp) return;
+    endStep(interp);
+    freeVM(&interp->vm);
+    while (interp->runs) {
+        EmbedRun* run = interp->runs;
+        interp->runs = run->next;
+        freeAST(run->ast);
+        freeParser(&run->parser);
+        free(run->source);
+        free(run);
+    }
+    while (interp->hostFns) {
+        HostFn* host = interp->hostFns;
+        interp->hostFns = host->next;
+        free(host);
+    }
+    free(interp);
+}
+
+const char* unnLastError(UnnInterp* interp) {
+    return interp->error;
+}
+
+bool unnSetMaxStack(UnnInterp* interp, int frames) {
+    return setMaxFrames(&interp->vm, frames);
+}
+
+void unnSetMaxHeap(UnnInterp* interp, size_t bytes) {
+    interp->vm.maxHeap = bytes;
+}
+
+void unnSetTimeout(UnnInterp* interp, int64_t ms) {
+    interp->vm.timeoutMs = ms > 0 ? ms : 0;
+}
+
+void unnSetEval(UnnInterp* interp, bool enabled) {
+    interp->vm.evalDisabled = !enabled;
+}
+
+void unnSetOutput(UnnInterp* interp, UnnWriteFn write, void* userData) {
+    VM* vm = &interp->vm;
+    flushOutput(vm); // What was printed so far goes where it was headed
+    vm->output.write = write;
+    vm->output.userData = write ? userData : NULL;
+    vm->output.flushEachLine = !write && isatty(STDOUT_FILENO);
+}
+
+// What a run that got as far as running left: its value in *result, or
+// the message and line of the throw nothing caught
+static bool finishRun(UnnInterp* interp, bool returned, Value value, Value thrown, UnnValue* result) {
+    VM* vm = &interp->vm;
+    if (!returned) {
+        char message[900];
+        describeThrown(vm, thrown, message, sizeof(message));
+        int line = vm->errorTraceCount > 0 ? vm->errorTrace[0].line : 0;
+        snprintf(interp->error, sizeof(interp->error), "Error at line %d: %s", line, message);
+        vm->errorTraceCount = 0;
+        vm->panicking = false;
+        return false;
+    }
+    if (result) *result = toHost(value, true);
+    return true;
+}
+
+// After error() from the parser, or a fatal error while running: report
+// it and drop the frames and try blocks it left
+static void recoverFatal(UnnInterp* interp, int callStackTop, int regTop, int tryHandlerCount) {
+    VM* vm = &interp->vm;
+    snprintf(interp->error, sizeof(interp->error), "Error at line %d: %s", g_catchLine, g_catchMessage);
+    vm->errorOut = stderr;
+    vm->callStackTop = callStackTop;
+    vm->regTop = regTop;
+    vm->tryHandlerCount = tryHandlerCount;
+    vm->throwPending = false;
+    vm->panicking = false;
+    vm->thrownValue = NIL_VAL;
+}
+
+// Compile 'source' and run it, or with 'started' only compile it and
+// leave the script in *started, rooted on the VM's stack, for unnStep
+static bool runSource(UnnInterp* interp, const char* source, UnnValue* result, Function** started) {
+    VM* vm = &interp->vm;
+    if (result) *result = unnNil();
+    if (interp->step) {
+        snprintf(interp->error, sizeof(interp->error), "A stepped run is unfinished: step it to the end first.");
+        return false;
+    }
+    interp->error[0] = '\0';
+
+    EmbedRun* run = malloc(sizeof(EmbedRun));
+    run->source = strdup(source ? source : "");
+    run->ast = NULL;
+    initParser(&run->parser);
+    run->next = interp->runs;
+    interp->runs = run;
+
+    // Reports go to the host rather than stderr: syntax errors through
+    // g_catchJump, compile errors through the VM's errorOut
+    const char* savedSource = g_source;
+    const char* savedFilename = g_filename;
+    jmp_buf* savedCatch = g_catchJump;
+    g_source = run->source;
+    g_filename = EMBED_SCRIPT_NAME;
+
+    int savedStackTop = vm->stackTop;
+    int savedCallStackTop = vm->callStackTop;
+    int savedRegTop = vm->regTop;
+    int savedHandlers = vm->tryHandlerCount;
+    char* compileErrors = NULL;
+    size_t compileErrorsSize = 0;
+    FILE* errorOut = open_memstream(&compileErrors, &compileErrorsSize);
+    bool ok = false;
+
+    jmp_buf recover;
+    g_catchJump = &recover;
+    if (setjmp(recover) == 0) {
+        Lexer lexer;
+        initLexer(&lexer, run->source);
+        while (true) {
+            Token token = scanToken(&lexer);
+            addToken(&run->parser, token);
+            if (token.type == TOKEN_EOF) break;
+        }
+        run->ast = parse(&run->parser);
+
+        BytecodeChunk* chunk = malloc(sizeof(BytecodeChunk));
+        initChunk(chunk);
+        Function* script = newBytecodeScript(vm, chunk, EMBED_SCRIPT_NAME);
+        vm->stack[vm->stackTop++] = OBJ_VAL(script);
+
+        if (errorOut) vm->errorOut = errorOut;
+        bool compiled = compileToBytecode(vm, run->ast, chunk, EMBED_SCRIPT_NAME);
+        vm->errorOut = stderr;
+
+        Value value = NIL_VAL, thrown = NIL_VAL;
+        if (!compiled) {
+            if (errorOut) fflush(errorOut);
+            // The first error, on one line like the others
+            char* message = "Compilation failed.";
+            int line = compileErrors && compileErrors[0] ? firstReportedError(compileErrors, &message) : 0;
+            if (line > 0) {
+                snprintf(interp->error, sizeof(interp->error), "Error at line %d: %s", line, message);
+            } else {
+                snprintf(interp->error, sizeof(interp->error), "%s", message);
+            }
+        } else if (started) {
+            *started = script;
+            ok = true;
+        } else {
+            startTimeout(vm);
+            bool returned = callProtected(vm, script, NULL, 0, &value, &thrown);
+            ok = finishRun(interp, returned, value, thrown, result);
+        }
+    } else {
+        recoverFatal(interp, savedCallStackTop, savedRegTop, savedHandlers);
+    }
+    if (!started || !ok) vm->stackTop = savedStackTop;
+    flushOutput(vm);
+
+    g_catchJump = savedCatch;
+    g_source = savedSource;
+    g_filename = savedFilename;
+    if (errorOut) fclose(errorOut);
+    free(compileErrors);
+    return ok;
+}
+
+bool unnRun(UnnInterp* interp, const char* source, UnnValue* result) {
+    return runSource(interp, source, result, NULL);
+}
+
+// --- Stepped runs ---
+
+#define STEP_STACK_SIZE (8 * 1024 * 1024)   // C stack a stepped run runs on
+
+// A run unnStep advances. It runs on a C stack of its own, so stepHook can
+// switch back to the host from any depth, in a native calling back into
+// the script too, and carry on from there on the next unnStep.
+struct Stepper {
+    Function* script;           // Rooted on the VM's stack until the run ends
+    ucontext_t host;
+    ucontext_t run;
+    void* cStack;
+    int64_t budget;             // Instructions this step may still run
+    bool started;
+    bool finished;
+    bool returned;              // Finished without an uncaught throw
+    bool fatal;                 // Ended by error(): the message is in g_catchMessage
+    Value value;                // What it returned, or threw
+    Value thrown;
+    int stackTop;               // The VM as the run found it
+    int callStackTop;
+    int regTop;
+    int tryHandlerCount;
+    // The thread's source and error globals: the run's while the host
+    // has the thread, the host's while the run has it
+    const char* source;
+    const char* filename;
+    jmp_buf* catchJump;
+    jmp_buf* errorJump;
+};
+
+// makecontext's entry point takes no arguments; it finds its run here
+static _Thread_local UnnInterp* startingInterp = NULL;
+
+static void swapStepGlobals(Stepper* st) {
+    const char* source = g_source;
+    const char* filename = g_filename;
+    jmp_buf* catchJump = g_catchJump;
+    jmp_buf* errorJump = g_errorJump;
+    g_source = st->source;
+    g_filename = st->filename;
+    g_catchJump = st->catchJump;
+    g_errorJump = st->errorJump;
+    st->source = source;
+    st->filename = filename;
+    st->catchJump = catchJump;
+    st->errorJump = errorJump;
+}
+
+// Where the run's C stack starts; returning goes back to unnStep
+static void stepMain(void) {
+    UnnInterp* interp = startingInterp;
+    Stepper* st = interp->step;
+    jmp_buf recover;
+    g_catchJump = &recover;
+    if (setjmp(recover) == 0) {
+        st->returned = callProtected(&interp->vm, st->script, NULL, 0, &st->value, &st->thrown);
+    } else {
+        st->fatal = true;
+    }
+    st->finished = true;
+}
+
+void stepHook(VM* vm) {
+    Stepper* st = vm->stepper;
+    while (st->budget <= 0) swapcontext(&st->run, &st->host);
+    st->budget--;
+}
+
+static void endStep(UnnInterp* interp) {
+    Stepper* st = interp->step;
+    if (!st) return;
+    interp->step = NULL;
+    free(st->cStack);
+    free(st);
+}
+
+bool unnStart(UnnInterp* interp, const char* source) {
+    VM* vm = &interp->vm;
+    Stepper* st = interp->step ? NULL : calloc(1, sizeof(Stepper));
+    if (st) {
+        st->stackTop = vm->stackTop;
+        st->callStackTop = vm->callStackTop;
+        st->regTop = vm->regTop;
+        st->tryHandlerCount = vm->tryHandlerCount;
+        st->cStack = malloc(STEP_STACK_SIZE);
+    }
+    if (!interp->step && (!st || !st->cStack || getcontext(&st->run) != 0)) {
+        if (st) free(st->cStack);
+        free(st);
+        snprintf(interp->error, sizeof(interp->error), "Out of memory starting a stepped run.");
+        return false;
+    }
+    if (!runSource(interp, source, NULL, st ? &st->script : NULL)) {
+        if (st) free(st->cStack);
+        free(st);
+        return false;
+    }
+    st->run.uc_stack.ss_sp = st->cStack;
+    st->run.uc_stack.ss_size = STEP_STACK_SIZE;
+    st->run.uc_link = &st->host;
+    makecontext(&st->run, stepMain, 0);
+    st->source = interp->runs->source;
+    st->filename = EMBED_SCRIPT_NAME;
+    st->catchJump = NULL;
+    st->errorJump = g_errorJump;
+    st->value = NIL_VAL;
+    st->thrown = NIL_VAL;
+    interp->step = st;
+    return true;
+}
+
+UnnStepStatus unnStep(UnnInterp* interp, int64_t maxInstructions, UnnValue* result) {
+    VM* vm = &interp->vm;
+    Stepper* st = interp->step;
+    if (result) *result = unnNil();
+    if (!st || vm->stepper) {
+        snprintf(interp->error, sizeof(interp->error), "%s",
+                 st ? "unnStep called from inside the run it steps." : "No run to step: start one with unnStart.");
+        return UNN_STEP_FAILED;
+    }
+    interp->error[0] = '\0';
+
+    st->budget = maxInstructions > 0 ? maxInstructions : 0;
+    if (st->started) resumeTimeout(vm);
+    else startTimeout(vm);
+    st->started = true;
+    swapStepGlobals(st);
+    vm->stepper = st;
+    startingInterp = interp;
+    swapcontext(&st->host, &st->run);
+    vm->stepper = NULL;
+    swapStepGlobals(st);
+    flushOutput(vm);
+    if (!st->finished) {
+        pauseTimeout(vm);
+        return UNN_STEP_PAUSED;
+    }
+
+    bool ok = false;
+    if (st->fatal) recoverFatal(interp, st->callStackTop, st->regTop, st->tryHandlerCount);
+    else ok = finishRun(interp, st->returned, st->value, st->thrown, result);
+    vm->stackTop = st->stackTop;
+    endStep(interp);
+    return ok ? UNN_STEP_DONE : UNN_STEP_FAILED;
+}
+
+// --- Globals ---
+
+void unnSetGlobal(UnnInterp* interp, const char* name, UnnValue value) {
+    defineGlobal(&interp->vm, name, toVM(&interp->vm, value));
+}
+
+bool unnGetGlobal(UnnInterp* interp, const char* name, UnnValue* out) {
+    VM* vm = &interp->vm;
+    ObjString* key = internString(vm, name, (int)strlen(name));
+    for (VarEntry* e = vm->globalEnv->buckets[key->hash % TABLE_SIZE]; e; e = e->next) {
+        if (e->key == key->chars) {
+            if (out) *out = toHost(e->value, true);
+            return true;
+        }
+    }
+    if (out) *out = unnNil();
+    return false;
+}
+
+// --- Host functions ---
+
+static Value callHostFn(VM* vm, Value* args, int argCount) {
+    HostFn* host = (HostFn*)vm->nativeCallee->nativeData;
+    UnnValue* hostArgs = malloc(sizeof(UnnValue) * (argCount > 0 ? argCount : 1));
+    for (int i = 0; i < argCount; i++) hostArgs[i] = toHost(args[i], false);
+
+    UnnValue result = host->fn(host->interp, hostArgs, argCount, host->userData);
+    free(hostArgs);
+    if (vm->throwPending) return NIL_VAL;
+    return toVM(vm, result);
+}
+
+// 'fn' as native 'name' in 'env'
+static void defineHostFn(UnnInterp* interp, Environment* env, const char* name, UnnFn fn, void* userData) {
+    HostFn* host = malloc(sizeof(HostFn));
+    host->interp = interp;
+    host->fn = fn;
+    host->userData = userData;
+    host->next = interp->hostFns;
+    interp->hostFns = host;
+
+    Function* func = defineNative(&interp->vm, env, name, callHostFn, 0);
+    func->nativeData = host;
+}
+
+void unnRegisterFn(UnnInterp* interp, const char* name, UnnFn fn, void* userData) {
+    defineHostFn(interp, interp->vm.globalEnv, name, fn, userData);
+}
+
+void unnRegisterModule(UnnInterp* interp, const char* name, const UnnModuleFn* fns, void* userData) {
+    Module* mod = defineNativeModule(&interp->vm, name);
+    for (const UnnModuleFn* f = fns; f->name != NULL; f++) {
+        defineHostFn(interp, mod->env, f->name, f->fn, userData);
+    }
+}
+
+void unnRegisterModuleFn(UnnInterp* interp, const char* module, const char* name, UnnFn fn, void* userData) {
+    VM* vm = &interp->vm;
+    ObjString* key = internString(vm, module, (int)strlen(module));
+    Module* mod = NULL;
+    for (VarEntry* e = vm->globalEnv->buckets[key->hash % TABLE_SIZE]; e; e = e->next) {
+        if (e->key == key->chars) {
+            if (IS_OBJ(e->value) && AS_OBJ(e->value)->type == OBJ_MODULE) mod = (Module*)AS_OBJ(e->value);
+            break;
+        }
+    }
+    if (!mod) mod = defineNativeModule(vm, module);
+    defineHostFn(interp, mod->env, name, fn, userData);
+}
+
+UnnValue unnThrow(UnnInterp* interp, const char* format, ...) {
+    char message[512];
+    va_list args;
+    va_start(args, format);
+    vsnprintf(message, sizeof(message), format, args);
+    va_end(args);
+    nativeError(&interp->vm, "%s", message);
+    return unnNil();
+}
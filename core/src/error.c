@@ -0,0 +1,115 @@
+#include "common.h"
+#include "vm.h"
+
+// Error reporting for the lexer, parser and AST walker
+
+// Per thread, so each thread can run its own interpreter (see unnarize.h)
+_Thread_local const char* g_source = NULL;
+_Thread_local const char* g_filename = NULL;
+_Thread_local jmp_buf* g_errorJump = NULL;
+_Thread_local jmp_buf* g_catchJump = NULL;
+_Thread_local char g_catchMessage[256];
+_Thread_local int g_catchLine;
+
+// Helper to print error line with context
+static void printErrorLine(FILE* out, int line, const char* highlightStart, int highlightLen) {
+    if (!g_source || line <= 0) return;
+
+    // Find the start of the line
+    const char* start = g_source;
+    int currentLine = 1;
+    while (currentLine < line && *start != '\0') {
+        if (*start == '\n') currentLine++;
+        start++;
+    }
+
+    if (*start == '\0') return; // Line not found
+    // A token from some other source (an eval string) has no line to show
+    if (highlightStart && (highlightStart < g_source || highlightStart > g_source + strlen(g_source))) return;
+
+    // Find end of line
+    const char* end = start;
+    while (*end != '\0' && *end != '\n') {
+        end++;
+    }
+
+    // Print the code frame
+    // Line number margin
+    fprintf(out, "\n");
+    fprintf(out, "   %4d | ", line);
+    
+    // Print the line content
+    fprintf(out, "%.*s\n", (int)(end - start), start);
+
+    // Print highlight arrow
+    if (highlightStart && highlightLen > 0) {
+        fprintf(out, "          "); // Match "   %4d | " length (approximately 10 chars: 3+4+3)
+        // Adjust for indentation to match the code line
+        // Calculate offset from line start
+        int offset = (int)(highlightStart - start);
+        if (offset >= 0 && offset < (end - start)) {
+            for (int i = 0; i < offset; i++) {
+                if (start[i] == '\t') fprintf(out, "\t");
+                else fprintf(out, " ");
+            }
+            // Print caret(s)
+            for (int i = 0; i < highlightLen; i++) fprintf(out, "^");
+            fprintf(out, "\n");
+        }
+    }
+    fprintf(out, "\n");
+}
+
+// Generic error
+void error(const char* message, int line) {
+    if (g_catchJump) {
+        snprintf(g_catchMessage, sizeof(g_catchMessage), "%s", message);
+        g_catchLine = line;
+        longjmp(*g_catchJump, 1);
+    }
+    flushAllOutput(); // Program output first
+    fprintf(stderr, "Error in %s at line %d:\n", g_filename ? g_filename : "<unknown>", line);
+    fprintf(stderr, "  %s\n", message);
+    printErrorLine(stderr, line, NULL, 0);
+    if (g_errorJump) longjmp(*g_errorJump, 1);
+    exit(1);
+}
+
+// Error at specific token
+void errorAtToken(Token token, const char* message) {
+    if (g_catchJump) {
+        snprintf(g_catchMessage, sizeof(g_catchMessage), "%s", message);
+        g_catchLine = token.line;
+        longjmp(*g_catchJump, 1);
+    }
+    flushAllOutput();
+    reportAtToken(stderr, token, message);
+    if (g_errorJump) longjmp(*g_errorJump, 1);
+    exit(1);
+}
+
+// The report errorAtToken prints, to 'out', without stopping: for the
+// compiler, which carries on to find any further errors
+void reportAtToken(FILE* out, Token token, const char* message) {
+    fprintf(out, "Error in %s at line %d:\n", g_filename ? g_filename : "<unknown>", token.line);
+    fprintf(out, "  %s\n", message);
+    printErrorLine(out, token.line, token.start, token.length);
+}
+
+// The first error in 'text', a report as reportAtToken writes it: returns
+// its line and points *message at its message, cut off in place. Text in
+// any other form is a bare message, with line 0.
+int firstReportedError(char* text, char** message) {
+    *message = text;
+    char* end = strchr(text, '\n');
+    if (end) *end = '\0';
+    char* at = strstr(text, " at line ");
+    int line = 0;
+    if (!end || !at || strncmp(text, "Error in ", 9) != 0 || sscanf(at, " at line %d:", &line) != 1) return 0;
+    char* start = end + 1;
+    while (*start == ' ') start++;
+    char* stop = strchr(start, '\n');
+    if (stop) *stop = '\0';
+    *message = start;
+    return line;
+}
@@ -0,0 +1,997 @@
+#include "formatter.h"
+#include <limits.h>
+
+typedef struct {
+    Token token;
+    bool ownLine;   // Only whitespace before it on its line
+} Comment;
+
+typedef struct {
+    char* out;
+    size_t length;
+    size_t capacity;
+    int indent;
+
+    Comment* comments;
+    int commentCount;
+    int nextComment;        // First comment not printed yet
+
+    const char** lines;     // lines[n] is the start of source line n
+    int lineCount;
+    int maxLine;            // Last source line printed so far
+    bool atBlockStart;      // Nothing printed since the last '{' (or the top of the file)
+    int braceLine;          // Line of the '}' closing the innermost block being printed
+} Formatter;
+
+// Binding strength, loosest first; an operand that binds looser than its
+// position allows is parenthesized
+typedef enum {
+    PREC_NONE,
+    PREC_ASSIGNMENT,  // = += -= ...
+    PREC_TERNARY,     // ?:
+    PREC_COALESCE,    // ??
+    PREC_OR,          // or ||
+    PREC_AND,         // and &&
+    PREC_EQUALITY,    // == !=
+    PREC_COMPARISON,  // < > <= >=
+    PREC_BIT_OR,      // |
+    PREC_BIT_XOR,     // ^
+    PREC_BIT_AND,     // &
+    PREC_SHIFT,       // << >>
+    PREC_TERM,        // + -
+    PREC_FACTOR,      // * / %
+    PREC_UNARY,       // - + ! ~ await
+    PREC_PRIMARY      // Literals, names, calls, members, indexing
+} Precedence;
+
+static void printStatement(Formatter* f, Node* node);
+static void printStatementText(Formatter* f, Node* node);
+static void printExpr(Formatter* f, Node* node, Precedence prec);
+static void printFunctionExpression(Formatter* f, Node* node);
+
+// --- Output ---
+
+static void emitN(Formatter* f, const char* text, size_t length) {
+    if (f->length + length + 1 > f->capacity) {
+        while (f->length + length + 1 > f->capacity) f->capacity *= 2;
+        f->out = realloc(f->out, f->capacity);
+    }
+    memcpy(f->out + f->length, text, length);
+    f->length += length;
+    f->out[f->length] = '\0';
+}
+
+static void emit(Formatter* f, const char* text) {
+    emitN(f, text, strlen(text));
+}
+
+static void touch(Formatter* f, int line) {
+    if (line > f->maxLine) f->maxLine = line;
+}
+
+static void emitToken(Formatter* f, Token token) {
+    emitN(f, token.start, token.length);
+    touch(f, token.line);
+}
+
+static void emitIndent(Formatter* f) {
+    for (int i = 0; i < f->indent; i++) emit(f, "    ");
+}
+
+// --- Comments and blank lines ---
+
+static bool isBlankLine(Formatter* f, int line) {
+    if (line < 1 || line > f->lineCount) return false;
+    for (const char* p = f->lines[line]; *p && *p != '\n'; p++) {
+        if (!isspace((unsigned char)*p)) return false;
+    }
+    return true;
+}
+
+// A blank line in the source between what was printed last and 'line'
+static bool blankBefore(Formatter* f, int line) {
+    return !f->atBlockStart && line - 1 > f->maxLine && isBlankLine(f, line - 1);
+}
+
+static void emitCommentText(Formatter* f, Comment* comment) {
+    int length = comment->token.length;
+    while (length > 0 && isspace((unsigned char)comment->token.start[length - 1])) length--;
+    emitN(f, comment->token.start, length);
+    touch(f, comment->token.line);
+}
+
+static bool commentBefore(Formatter* f, int line) {
+    return f->nextComment < f->commentCount && f->comments[f->nextComment].token.line < line;
+}
+
+// Comments that come before source line 'line'. One that followed code
+// goes back to the end of the previous output line.
+static void flushComments(Formatter* f, int line) {
+    while (commentBefore(f, line)) {
+        Comment* comment = &f->comments[f->nextComment++];
+        if (!comment->ownLine && f->length > 0 && f->out[f->length - 1] == '\n') {
+            f->length--;
+            emit(f, " ");
+            emitCommentText(f, comment);
+            emit(f, "\n");
+            continue;
+        }
+        if (blankBefore(f, comment->token.line)) emit(f, "\n");
+        emitIndent(f);
+        emitCommentText(f, comment);
+        emit(f, "\n");
+        f->atBlockStart = false;
+    }
+}
+
+// Comments on lines already printed, at the end of the current line. One
+// on the line of the '}' closing the block being printed comes after that
+// '}', so it waits for it.
+static void trailingComments(Formatter* f) {
+    while (f->nextComment < f->commentCount &&
+           f->comments[f->nextComment].token.line <= f->maxLine) {
+        Comment* comment = &f->comments[f->nextComment];
+        if (comment->token.line == f->braceLine) break;
+        emit(f, " ");
+        emitCommentText(f, comment);
+        f->nextComment++;
+    }
+}
+
+// Start a statement or member that begins on source line 'line'
+static void beginItem(Formatter* f, int line) {
+    flushComments(f, line);
+    if (blankBefore(f, line)) emit(f, "\n");
+    f->atBlockStart = false;
+}
+
+// Line of the first token of a node: an operator's node records the line
+// of the operator, not of its left operand
+static int firstLine(Node* node) {
+    switch (node->type) {
+        case NODE_EXPR_BINARY:       return firstLine(node->binary.left);
+        case NODE_EXPR_CALL:         return firstLine(node->call.callee);
+        case NODE_EXPR_GET:          return firstLine(node->get.object);
+        case NODE_EXPR_INDEX:        return firstLine(node->index.target);
+        case NODE_EXPR_SLICE:        return firstLine(node->slice.target);
+        case NODE_EXPR_OPTIONAL:     return firstLine(node->unary.expr);
+        case NODE_EXPR_TERNARY:      return firstLine(node->ternary.condition);
+        case NODE_EXPR_AWAIT:        return node->unary.op.line;
+        case NODE_EXPR_UPDATE:       return node->update.prefix ? node->line : firstLine(node->update.target);
+        case NODE_STMT_ASSIGN:       return node->assign.name.line;
+        case NODE_STMT_INDEX_ASSIGN: return firstLine(node->indexAssign.target);
+        case NODE_STMT_PROP_ASSIGN:  return firstLine(node->propAssign.object);
+        case NODE_STMT_PRINT:        return firstLine(node->print.expr);
+        case NODE_STMT_MULTI_ASSIGN: return firstLine(node->multiAssign.targets);
+        default:                     return node->line;
+    }
+}
+
+// --- Expressions ---
+
+static bool isComparison(Node* node) {
+    if (node->type != NODE_EXPR_BINARY || node->binary.interpolated) return false;
+    TokenType op = node->binary.op.type;
+    return op == TOKEN_LESS || op == TOKEN_LESS_EQUAL || op == TOKEN_GREATER || op == TOKEN_GREATER_EQUAL;
+}
+
+static bool isSign(Node* node) {
+    return node->type == NODE_EXPR_UNARY &&
+           (node->unary.op.type == TOKEN_MINUS || node->unary.op.type == TOKEN_PLUS);
+}
+
+// Printed starting with '+' or '-': a sign, or a prefix ++ or --
+static bool startsWithSign(Node* node) {
+    return isSign(node) || (node->type == NODE_EXPR_UPDATE && node->update.prefix);
+}
+
+static Precedence precedence(Node* node) {
+    switch (node->type) {
+        case NODE_STMT_ASSIGN:
+        case NODE_STMT_INDEX_ASSIGN:
+        case NODE_STMT_PROP_ASSIGN:
+            return PREC_ASSIGNMENT;
+        case NODE_EXPR_TERNARY:
+            return PREC_TERNARY;
+        case NODE_EXPR_UNARY:
+        case NODE_EXPR_AWAIT:
+        case NODE_EXPR_UPDATE:
+            return PREC_UNARY;
+        case NODE_EXPR_OPTIONAL:
+            // Grouped when a postfix operator follows: (a?.b).c is not a?.b.c
+            return PREC_UNARY;
+        case NODE_EXPR_FUNCTION:
+            // An arrow's body takes in everything after it
+            return node->function.isArrow ? PREC_ASSIGNMENT : PREC_PRIMARY;
+        case NODE_EXPR_BINARY:
+            if (node->binary.interpolated) return PREC_PRIMARY;
+            switch (node->binary.op.type) {
+                case TOKEN_QUESTION_QUESTION: return PREC_COALESCE;
+                case TOKEN_OR:            return PREC_OR;
+                case TOKEN_AND:           return PREC_AND;
+                case TOKEN_EQUAL_EQUAL:
+                case TOKEN_BANG_EQUAL:    return PREC_EQUALITY;
+                case TOKEN_LESS:
+                case TOKEN_LESS_EQUAL:
+                case TOKEN_GREATER:
+                case TOKEN_GREATER_EQUAL: return PREC_COMPARISON;
+                case TOKEN_PIPE:          return PREC_BIT_OR;
+                case TOKEN_CARET:         return PREC_BIT_XOR;
+                case TOKEN_AMPERSAND:     return PREC_BIT_AND;
+                case TOKEN_LESS_LESS:
+                case TOKEN_GREATER_GREATER: return PREC_SHIFT;
+                case TOKEN_PLUS:
+                case TOKEN_MINUS:         return PREC_TERM;
+                default:                  return PREC_FACTOR;
+            }
+        default:
+            return PREC_PRIMARY;
+    }
+}
+
+// A string piece of an interpolation after the first: '}text$' or '}text"'
+static bool isInterpolationPiece(Node* node) {
+    return node->type == NODE_EXPR_LITERAL && node->literal.token.type == TOKEN_STRING &&
+           node->literal.token.start[0] == '}';
+}
+
+// "a ${x} b" parsed as ("a " + x) + " b"; the pieces still hold their
+// source delimiters, with the '{' of each "${" dropped by the parser
+static void printInterpolation(Formatter* f, Node* node) {
+    int count = 0;
+    for (Node* n = node; n->type == NODE_EXPR_BINARY && n->binary.interpolated; n = n->binary.left) count++;
+    Node** parts = malloc(sizeof(Node*) * (count + 1));
+    Node* n = node;
+    for (int i = count; i > 0; i--) {
+        parts[i] = n->binary.right;
+        n = n->binary.left;
+    }
+    parts[0] = n;
+
+    Token lead = parts[0]->literal.token;
+    char quote = lead.start[0];
+    emitN(f, lead.start, lead.length - 1);
+    touch(f, lead.line);
+    bool afterExpr = false;
+    for (int i = 1; i <= count; i++) {
+        Node* part = parts[i];
+        if (isInterpolationPiece(part)) {
+            Token piece = part->literal.token;
+            if (!afterExpr) emit(f, "${");   // "${}"
+            bool more = piece.start[piece.length - 1] == '$';
+            emitN(f, piece.start, more ? piece.length - 1 : piece.length);
+            touch(f, piece.line);
+            afterExpr = false;
+        } else {
+            if (afterExpr) emit(f, "}");
+            emit(f, "${");
+            printExpr(f, part, PREC_ASSIGNMENT);
+            afterExpr = true;
+        }
+    }
+    if (afterExpr) {
+        char close[3] = { '}', quote, '\0' };
+        emit(f, close);
+    }
+    free(parts);
+}
+
+static void printItems(Formatter* f, Node* items, const char* separator) {
+    for (Node* item = items; item; item = item->next) {
+        printExpr(f, item, PREC_ASSIGNMENT);
+        if (item->next) emit(f, separator);
+    }
+}
+
+static void printMapEntry(Formatter* f, Node* key, Node* value) {
+    printExpr(f, key, PREC_ASSIGNMENT);
+    emit(f, ": ");
+    printExpr(f, value, PREC_ASSIGNMENT);
+}
+
+// One "key: value" of a map or struct literal. A struct literal's keys
+// are field names rather than nodes; 'field' counts through them.
+static void printEntry(Formatter* f, Node* node, Node* item, Node* value, int* field) {
+    if (node->type == NODE_EXPR_STRUCT_LITERAL) {
+        emitToken(f, node->structLiteral.fields[(*field)++]);
+        emit(f, ": ");
+        printExpr(f, item, PREC_ASSIGNMENT);
+    } else {
+        printMapEntry(f, item, value);
+    }
+}
+
+// [a, b], #{a, b}, { k: v } and Name{ f: v } on one line, or one element
+// per line when the closing bracket was on a later line than the opening one
+static void printCollection(Formatter* f, Node* node) {
+    bool isStruct = node->type == NODE_EXPR_STRUCT_LITERAL;
+    bool isMap = node->type == NODE_EXPR_MAP_LITERAL || isStruct;
+    Node* item = isStruct ? node->structLiteral.values
+                          : isMap ? node->mapLiteral.keys : node->arrayLiteral.elements;
+    Node* value = node->type == NODE_EXPR_MAP_LITERAL ? node->mapLiteral.values : NULL;
+    int endLine = isStruct ? node->structLiteral.endLine
+                           : isMap ? node->mapLiteral.endLine : node->arrayLiteral.endLine;
+    bool isSet = node->type == NODE_EXPR_ARRAY_LITERAL && node->arrayLiteral.isSet;
+    const char* open = isMap ? "{" : isSet ? "#{" : "[";
+    const char* close = isMap || isSet ? "}" : "]";
+    int field = 0;
+    touch(f, node->line);
+    if (isStruct) emitToken(f, node->structLiteral.name);
+
+    if (!item) {
+        emit(f, open);
+        emit(f, close);
+        touch(f, endLine);
+        return;
+    }
+
+    if (endLine == node->line) {
+        emit(f, open);
+        if (isMap) emit(f, " ");
+        for (; item; item = item->next) {
+            if (isMap) {
+                printEntry(f, node, item, value, &field);
+                if (value) value = value->next;
+            } else {
+                printExpr(f, item, PREC_ASSIGNMENT);
+            }
+            if (item->next) emit(f, ", ");
+        }
+        if (isMap) emit(f, " ");
+        emit(f, close);
+        return;
+    }
+
+    emit(f, open);
+    if (firstLine(item) > f->maxLine) trailingComments(f);
+    emit(f, "\n");
+    f->indent++;
+    f->atBlockStart = true;
+    for (; item; item = item->next) {
+        beginItem(f, firstLine(item));
+        emitIndent(f);
+        if (isMap) {
+            printEntry(f, node, item, value, &field);
+            if (value) value = value->next;
+        } else {
+            printExpr(f, item, PREC_ASSIGNMENT);
+        }
+        if (item->next) emit(f, ",");
+        trailingComments(f);
+        emit(f, "\n");
+    }
+    flushComments(f, endLine);
+    f->indent--;
+    emitIndent(f);
+    emit(f, close);
+    touch(f, endLine);
+}
+
+static void printExprText(Formatter* f, Node* node) {
+    touch(f, node->line);
+    switch (node->type) {
+        case NODE_EXPR_LITERAL: {
+            Token token = node->literal.token;
+            if (token.type == TOKEN_STRING && token.start[token.length - 1] != token.start[0]) {
+                // "${}": the lead piece of an interpolation and nothing else
+                char text[3] = { token.start[0], token.start[0], '\0' };
+                emit(f, text);
+                touch(f, token.line);
+                break;
+            }
+            emitToken(f, token);
+            break;
+        }
+        case NODE_EXPR_VAR:
+            emitToken(f, node->var.name);
+            break;
+        case NODE_EXPR_BINARY: {
+            if (node->binary.interpolated) {
+                printInterpolation(f, node);
+                break;
+            }
+            Precedence prec = precedence(node);
+            // (a < b) < c is not the chain a < b < c
+            bool groupLeft = isComparison(node) && !node->binary.chained && isComparison(node->binary.left);
+            printExpr(f, node->binary.left, groupLeft ? prec + 1 : prec);
+            emit(f, " ");
+            emitToken(f, node->binary.op);
+            emit(f, " ");
+            printExpr(f, node->binary.right, prec + 1);
+            break;
+        }
+        case NODE_EXPR_UNARY:
+            emitToken(f, node->unary.op);
+            // -(-x) and -(--x), not --x and ---x
+            printExpr(f, node->unary.expr, isSign(node) && startsWithSign(node->unary.expr) ? PREC_PRIMARY : PREC_UNARY);
+            break;
+        case NODE_EXPR_UPDATE:
+            if (node->update.prefix) emitToken(f, node->update.op);
+            printExpr(f, node->update.target, PREC_PRIMARY);
+            if (!node->update.prefix) emitToken(f, node->update.op);
+            break;
+        case NODE_EXPR_AWAIT:
+            emit(f, "await ");
+            printExpr(f, node->unary.expr, PREC_UNARY);
+            break;
+        case NODE_EXPR_SPREAD:
+            emit(f, "...");
+            printExpr(f, node->unary.expr, PREC_ASSIGNMENT);
+            break;
+        case NODE_EXPR_OPTIONAL:
+            printExpr(f, node->unary.expr, PREC_PRIMARY);
+            break;
+        case NODE_EXPR_CALL: {
+            printExpr(f, node->call.callee, PREC_PRIMARY);
+            emit(f, "(");
+            // The last namedCount arguments are written 'name: value'
+            int firstNamed = node->call.argumentCount - node->call.namedCount, i = 0;
+            for (Node* arg = node->call.arguments; arg; arg = arg->next, i++) {
+                if (i >= firstNamed) {
+                    emitToken(f, node->call.names[i - firstNamed]);
+                    emit(f, ": ");
+                }
+                printExpr(f, arg, PREC_ASSIGNMENT);
+                if (arg->next) emit(f, ", ");
+            }
+            emit(f, ")");
+            break;
+        }
+        case NODE_EXPR_GET:
+            printExpr(f, node->get.object, PREC_PRIMARY);
+            emit(f, node->get.optional ? "?." : ".");
+            emitToken(f, node->get.name);
+            break;
+        case NODE_EXPR_INDEX:
+            printExpr(f, node->index.target, PREC_PRIMARY);
+            emit(f, node->index.optional ? "?.[" : "[");
+            printExpr(f, node->index.index, PREC_ASSIGNMENT);
+            emit(f, "]");
+            break;
+        case NODE_EXPR_SLICE:
+            printExpr(f, node->slice.target, PREC_PRIMARY);
+            emit(f, node->slice.optional ? "?.[" : "[");
+            if (node->slice.start) printExpr(f, node->slice.start, PREC_ASSIGNMENT);
+            emit(f, ":");
+            if (node->slice.end) printExpr(f, node->slice.end, PREC_ASSIGNMENT);
+            emit(f, "]");
+            break;
+        case NODE_EXPR_MAP_LITERAL:
+        case NODE_EXPR_ARRAY_LITERAL:
+        case NODE_EXPR_STRUCT_LITERAL:
+            printCollection(f, node);
+            break;
+        case NODE_EXPR_FUNCTION:
+            printFunctionExpression(f, node);
+            break;
+        case NODE_EXPR_TERNARY:
+            printExpr(f, node->ternary.condition, PREC_COALESCE);
+            emit(f, " ? ");
+            printExpr(f, node->ternary.thenExpr, PREC_TERNARY);
+            emit(f, " : ");
+            printExpr(f, node->ternary.elseExpr, PREC_TERNARY);
+            break;
+        case NODE_STMT_ASSIGN:
+            emitToken(f, node->assign.name);
+            emit(f, " ");
+            emitToken(f, node->assign.operator);
+            emit(f, " ");
+            printExpr(f, node->assign.value, PREC_ASSIGNMENT);
+            break;
+        case NODE_STMT_INDEX_ASSIGN:
+            printExpr(f, node->indexAssign.target, PREC_PRIMARY);
+            emit(f, "[");
+            printExpr(f, node->indexAssign.index, PREC_ASSIGNMENT);
+            emit(f, "] ");
+            emitToken(f, node->indexAssign.operator);
+            emit(f, " ");
+            printExpr(f, node->indexAssign.value, PREC_ASSIGNMENT);
+            break;
+        case NODE_STMT_PROP_ASSIGN:
+            printExpr(f, node->propAssign.object, PREC_PRIMARY);
+            emit(f, ".");
+            emitToken(f, node->propAssign.name);
+            emit(f, " ");
+            emitToken(f, node->propAssign.operator);
+            emit(f, " ");
+            printExpr(f, node->propAssign.value, PREC_ASSIGNMENT);
+            break;
+        default:
+            break;
+    }
+}
+
+static void printExpr(Formatter* f, Node* node, Precedence prec) {
+    bool group = precedence(node) < prec;
+    if (group) emit(f, "(");
+    printExprText(f, node);
+    if (group) emit(f, ")");
+}
+
+// The leftmost operand, which a statement would start with
+static Node* leftmost(Node* node) {
+    switch (node->type) {
+        case NODE_EXPR_BINARY:       return node->binary.interpolated ? node : leftmost(node->binary.left);
+        case NODE_EXPR_CALL:         return leftmost(node->call.callee);
+        case NODE_EXPR_GET:          return leftmost(node->get.object);
+        case NODE_EXPR_INDEX:        return leftmost(node->index.target);
+        case NODE_EXPR_SLICE:        return leftmost(node->slice.target);
+        case NODE_EXPR_OPTIONAL:     return leftmost(node->unary.expr);
+        case NODE_EXPR_TERNARY:      return leftmost(node->ternary.condition);
+        case NODE_EXPR_UPDATE:       return node->update.prefix ? node : leftmost(node->update.target);
+        case NODE_STMT_INDEX_ASSIGN: return leftmost(node->indexAssign.target);
+        case NODE_STMT_PROP_ASSIGN:  return leftmost(node->propAssign.object);
+        default:                     return node;
+    }
+}
+
+// --- Statements ---
+
+static void printBlockBody(Formatter* f, Node** statements, int count, int endLine) {
+    emit(f, "{");
+    // A comment after '{ stmt; }' on one line stays after the '}'
+    if (count == 0 || firstLine(statements[0]) > f->maxLine) trailingComments(f);
+    emit(f, "\n");
+    f->indent++;
+    f->atBlockStart = true;
+    for (int i = 0; i < count; i++) printStatement(f, statements[i]);
+    flushComments(f, endLine);
+    f->indent--;
+    emitIndent(f);
+    emit(f, "}");
+    touch(f, endLine);
+    f->atBlockStart = false;
+}
+
+static void printBlock(Formatter* f, Node* block) {
+    touch(f, block->line);
+    if (block->block.count == 0 && !commentBefore(f, block->block.endLine)) {
+        emit(f, "{}");
+        touch(f, block->block.endLine);
+        return;
+    }
+    int braceLine = f->braceLine;
+    f->braceLine = block->block.endLine;
+    printBlockBody(f, block->block.statements, block->block.count, block->block.endLine);
+    f->braceLine = braceLine;
+}
+
+// Loop and branch bodies are always braced
+static void printBody(Formatter* f, Node* body) {
+    if (body->type == NODE_STMT_BLOCK) {
+        printBlock(f, body);
+    } else {
+        printBlockBody(f, &body, 1, firstLine(body));
+    }
+}
+
+static void printVarDecl(Formatter* f, Node* node) {
+    emit(f, node->varDecl.isConst ? "const " : "var ");
+    emitToken(f, node->varDecl.name);
+    if (node->varDecl.initializer) {
+        emit(f, " = ");
+        printExpr(f, node->varDecl.initializer, PREC_ASSIGNMENT);
+    }
+}
+
+// (a, b = 1, ...rest) of a function
+static void printParameters(Formatter* f, Node* node) {
+    emit(f, "(");
+    int first = node->function.isMethod ? 1 : 0;  // self is implicit
+    for (int i = first; i < node->function.paramCount; i++) {
+        if (i > first) emit(f, ", ");
+        if (node->function.isVariadic && i == node->function.paramCount - 1) emit(f, "...");
+        emitToken(f, node->function.params[i]);
+        if (node->function.defaults[i]) {
+            emit(f, " = ");
+            printExpr(f, node->function.defaults[i], PREC_ASSIGNMENT);
+        }
+    }
+    emit(f, ")");
+}
+
+static void printFunction(Formatter* f, Node* node) {
+    if (node->function.isAsync) emit(f, "async ");
+    emit(f, "function ");
+    emitToken(f, node->function.name);
+    printParameters(f, node);
+    emit(f, " ");
+    printBlock(f, node->function.body);
+}
+
+// function(x) { ... }, (x) => { ... } or (x) => expr
+static void printFunctionExpression(Formatter* f, Node* node) {
+    if (!node->function.isArrow) emit(f, "function");
+    printParameters(f, node);
+    emit(f, node->function.isArrow ? " => " : " ");
+    if (node->function.isExpressionBody) {
+        printExpr(f, node->function.body->block.statements[0]->returnStmt.value, PREC_ASSIGNMENT);
+    } else {
+        printBlock(f, node->function.body);
+    }
+}
+
+static void printIf(Formatter* f, Node* node) {
+    emit(f, "if (");
+    printExpr(f, node->ifStmt.condition, PREC_ASSIGNMENT);
+    emit(f, ") ");
+    printBody(f, node->ifStmt.thenBranch);
+    Node* elseBranch = node->ifStmt.elseBranch;
+    if (!elseBranch) return;
+    emit(f, " else ");
+    if (elseBranch->type == NODE_STMT_IF) {
+        printIf(f, elseBranch);
+    } else {
+        printBody(f, elseBranch);
+    }
+}
+
+// Case labels one level in, their statements one further
+static void printSwitch(Formatter* f, Node* node) {
+    emit(f, "switch (");
+    printExpr(f, node->switchStmt.subject, PREC_ASSIGNMENT);
+    if (node->switchStmt.caseCount == 0 && !commentBefore(f, node->switchStmt.endLine)) {
+        emit(f, ") {}");
+        touch(f, node->switchStmt.endLine);
+        return;
+    }
+    int braceLine = f->braceLine;
+    f->braceLine = node->switchStmt.endLine;
+    emit(f, ") {");
+    trailingComments(f);
+    emit(f, "\n");
+    f->indent++;
+    f->atBlockStart = true;
+    for (int i = 0; i < node->switchStmt.caseCount; i++) {
+        Node* values = node->switchStmt.values[i];
+        Node* body = node->switchStmt.bodies[i];
+        beginItem(f, values ? firstLine(values) : body->line);
+        emitIndent(f);
+        if (values) {
+            emit(f, "case ");
+            printItems(f, values, ", ");
+            emit(f, ":");
+        } else {
+            emit(f, "default:");
+        }
+        touch(f, body->line);
+        if (body->block.count == 0 || firstLine(body->block.statements[0]) > f->maxLine) {
+            trailingComments(f);
+        }
+        emit(f, "\n");
+        f->indent++;
+        f->atBlockStart = true;
+        for (int j = 0; j < body->block.count; j++) printStatement(f, body->block.statements[j]);
+        if (node->switchStmt.fallsThrough[i]) {
+            beginItem(f, body->block.endLine);
+            emitIndent(f);
+            emit(f, "fallthrough;");
+            touch(f, body->block.endLine);
+            trailingComments(f);
+            emit(f, "\n");
+        }
+        f->indent--;
+        f->atBlockStart = false;
+    }
+    f->braceLine = braceLine;
+    flushComments(f, node->switchStmt.endLine);
+    f->indent--;
+    emitIndent(f);
+    emit(f, "}");
+    touch(f, node->switchStmt.endLine);
+}
+
+static void printStruct(Formatter* f, Node* node) {
+    emit(f, "struct ");
+    emitToken(f, node->structDecl.name);
+    emit(f, " ");
+    int fieldCount = node->structDecl.fieldCount;
+    int methodCount = node->structDecl.methodCount;
+    int endLine = node->structDecl.endLine;
+    if (fieldCount + methodCount == 0 && !commentBefore(f, endLine)) {
+        emit(f, "{}");
+        touch(f, endLine);
+        return;
+    }
+
+    int braceLine = f->braceLine;
+    f->braceLine = endLine;
+    emit(f, "{");
+    trailingComments(f);
+    emit(f, "\n");
+    f->indent++;
+    f->atBlockStart = true;
+    // Fields and methods in the order they were written
+    int i = 0, j = 0;
+    while (i < fieldCount || j < methodCount) {
+        if (i < fieldCount && (j == methodCount ||
+                               node->structDecl.fields[i].line <= node->structDecl.methods[j]->line)) {
+            Token field = node->structDecl.fields[i];
+            Node* fallback = node->structDecl.defaults[i++];
+            beginItem(f, field.line);
+            emitIndent(f);
+            emitToken(f, field);
+            if (fallback) {
+                emit(f, " = ");
+                printExpr(f, fallback, PREC_ASSIGNMENT);
+            }
+            emit(f, ";");
+            trailingComments(f);
+            emit(f, "\n");
+        } else {
+            printStatement(f, node->structDecl.methods[j++]);
+        }
+    }
+    f->braceLine = braceLine;
+    flushComments(f, endLine);
+    f->indent--;
+    emitIndent(f);
+    emit(f, "}");
+    touch(f, endLine);
+}
+
+// Members print their value only where it is not the previous one plus 1
+static void printEnum(Formatter* f, Node* node) {
+    int count = node->enumDecl.count;
+    int endLine = node->enumDecl.endLine;
+    emit(f, "enum ");
+    if (count == 0 && !commentBefore(f, endLine)) {
+        emit(f, "{}");
+        touch(f, endLine);
+        return;
+    }
+
+    bool multiline = endLine > node->line;
+    emit(f, multiline ? "{" : "{ ");
+    if (multiline) {
+        trailingComments(f);
+        emit(f, "\n");
+        f->indent++;
+        f->atBlockStart = true;
+    }
+    for (int i = 0; i < count; i++) {
+        Token name = node->enumDecl.names[i];
+        int64_t value = node->enumDecl.values[i];
+        if (multiline) {
+            beginItem(f, name.line);
+            emitIndent(f);
+        }
+        emitToken(f, name);
+        int64_t implicit = i == 0 ? 0 : node->enumDecl.values[i - 1] + 1;
+        if (value != implicit) {
+            char text[32];
+            snprintf(text, sizeof(text), " = %lld", (long long)value);
+            emit(f, text);
+        }
+        if (i < count - 1) emit(f, multiline ? "," : ", ");
+        if (multiline) {
+            trailingComments(f);
+            emit(f, "\n");
+        }
+    }
+    if (multiline) {
+        flushComments(f, endLine);
+        f->indent--;
+        emitIndent(f);
+        emit(f, "}");
+    } else {
+        emit(f, " }");
+    }
+    touch(f, endLine);
+}
+
+// 'name: ' before a labeled loop
+static void printLabel(Formatter* f, Token label) {
+    if (label.length == 0) return;
+    emitToken(f, label);
+    emit(f, ": ");
+}
+
+static void printStatementText(Formatter* f, Node* node) {
+    switch (node->type) {
+        case NODE_STMT_VAR_DECL:
+            printVarDecl(f, node);
+            emit(f, ";");
+            break;
+        case NODE_STMT_MULTI_ASSIGN:
+            if (node->multiAssign.isDecl) emit(f, "var ");
+            for (Node* target = node->multiAssign.targets; target; target = target->next) {
+                printExpr(f, target, PREC_PRIMARY);
+                if (target->next) emit(f, ", ");
+            }
+            if (node->multiAssign.values) {
+                emit(f, " = ");
+                printItems(f, node->multiAssign.values, ", ");
+            }
+            emit(f, ";");
+            break;
+        case NODE_STMT_PRINT:
+            emit(f, "print(");
+            printExpr(f, node->print.expr, PREC_ASSIGNMENT);
+            emit(f, ");");
+            break;
+        case NODE_STMT_IF:
+            printIf(f, node);
+            break;
+        case NODE_STMT_SWITCH:
+            printSwitch(f, node);
+            break;
+        case NODE_STMT_WHILE:
+            printLabel(f, node->whileStmt.label);
+            emit(f, "while (");
+            printExpr(f, node->whileStmt.condition, PREC_ASSIGNMENT);
+            emit(f, ") ");
+            printBody(f, node->whileStmt.body);
+            break;
+        case NODE_STMT_DO_WHILE:
+            printLabel(f, node->whileStmt.label);
+            emit(f, "do ");
+            printBody(f, node->whileStmt.body);
+            emit(f, " while (");
+            printExpr(f, node->whileStmt.condition, PREC_ASSIGNMENT);
+            emit(f, ");");
+            break;
+        case NODE_STMT_LOOP:
+            printLabel(f, node->whileStmt.label);
+            emit(f, "loop ");
+            printBody(f, node->whileStmt.body);
+            break;
+        case NODE_STMT_FOR:
+            printLabel(f, node->forStmt.label);
+            emit(f, "for (");
+            if (node->forStmt.initializer) {
+                if (node->forStmt.initializer->type == NODE_STMT_VAR_DECL) {
+                    printVarDecl(f, node->forStmt.initializer);
+                } else {
+                    printExpr(f, node->forStmt.initializer, PREC_ASSIGNMENT);
+                }
+            }
+            emit(f, ";");
+            if (node->forStmt.condition) {
+                emit(f, " ");
+                printExpr(f, node->forStmt.condition, PREC_ASSIGNMENT);
+            }
+            emit(f, ";");
+            if (node->forStmt.increment) {
+                emit(f, " ");
+                printExpr(f, node->forStmt.increment, PREC_ASSIGNMENT);
+            }
+            emit(f, ") ");
+            printBody(f, node->forStmt.body);
+            break;
+        case NODE_STMT_FOREACH:
+            printLabel(f, node->foreachStmt.label);
+            emit(f, "for (var ");
+            emitToken(f, node->foreachStmt.iterator);
+            emit(f, " : ");
+            printExpr(f, node->foreachStmt.collection, PREC_ASSIGNMENT);
+            emit(f, ") ");
+            printBody(f, node->foreachStmt.body);
+            break;
+        case NODE_STMT_BLOCK:
+            printBlock(f, node);
+            break;
+        case NODE_STMT_FUNCTION:
+            printFunction(f, node);
+            break;
+        case NODE_STMT_RETURN:
+            emit(f, "return");
+            if (node->returnStmt.value) {
+                emit(f, " ");
+                printItems(f, node->returnStmt.value, ", ");
+            }
+            emit(f, ";");
+            break;
+        case NODE_STMT_IMPORT:
+            emit(f, "import ");
+            emitToken(f, node->importStmt.module);
+            emit(f, " as ");
+            emitToken(f, node->importStmt.alias);
+            emit(f, ";");
+            break;
+        case NODE_STMT_STRUCT_DECL:
+            printStruct(f, node);
+            break;
+        case NODE_STMT_ENUM_DECL:
+            printEnum(f, node);
+            break;
+        case NODE_STMT_BREAK:
+        case NODE_STMT_CONTINUE:
+            emit(f, node->type == NODE_STMT_BREAK ? "break" : "continue");
+            if (node->loopJump.label.length > 0) {
+                emit(f, " ");
+                emitToken(f, node->loopJump.label);
+            }
+            emit(f, ";");
+            break;
+        case NODE_STMT_TRY:
+            emit(f, "try ");
+            printBlock(f, node->tryStmt.tryBlock);
+            emit(f, " catch (");
+            emitToken(f, node->tryStmt.catchName);
+            emit(f, ") ");
+            printBlock(f, node->tryStmt.catchBlock);
+            break;
+        case NODE_STMT_THROW:
+            emit(f, "throw ");
+            printExpr(f, node->throwStmt.value, PREC_ASSIGNMENT);
+            emit(f, ";");
+            break;
+        case NODE_STMT_SPAWN:
+            emit(f, "spawn ");
+            printExpr(f, node->spawnStmt.call, PREC_ASSIGNMENT);
+            emit(f, ";");
+            break;
+        case NODE_STMT_DEFER:
+            emit(f, "defer ");
+            printExpr(f, node->deferStmt.call, PREC_ASSIGNMENT);
+            emit(f, ";");
+            break;
+        case NODE_STMT_WITH:
+            emit(f, "with ");
+            emitToken(f, node->withStmt.name);
+            emit(f, " = ");
+            printExpr(f, node->withStmt.resource, PREC_ASSIGNMENT);
+            emit(f, " ");
+            printBlock(f, node->withStmt.body);
+            break;
+        default: {
+            // Expression statement; one starting with '{' would read as a block
+            bool group = leftmost(node)->type == NODE_EXPR_MAP_LITERAL;
+            if (group) emit(f, "(");
+            printExpr(f, node, PREC_NONE);
+            emit(f, group ? ");" : ";");
+            break;
+        }
+    }
+    touch(f, node->line);
+}
+
+static void printStatement(Formatter* f, Node* node) {
+    beginItem(f, firstLine(node));
+    emitIndent(f);
+    printStatementText(f, node);
+    trailingComments(f);
+    emit(f, "\n");
+}
+
+char* formatSource(Node* ast, const char* source, Token* comments, int commentCount) {
+    Formatter f;
+    f.capacity = 256;
+    f.out = malloc(f.capacity);
+    f.out[0] = '\0';
+    f.length = 0;
+    f.indent = 0;
+    f.maxLine = 0;
+    f.atBlockStart = true;
+    f.braceLine = 0;
+
+    f.lineCount = 1;
+    for (const char* p = source; *p; p++) {
+        if (*p == '\n') f.lineCount++;
+    }
+    f.lines = malloc(sizeof(char*) * (f.lineCount + 1));
+    f.lines[0] = source;
+    f.lines[1] = source;
+    int line = 1;
+    for (const char* p = source; *p; p++) {
+        if (*p == '\n') f.lines[++line] = p + 1;
+    }
+
+    f.comments = malloc(sizeof(Comment) * (commentCount > 0 ? commentCount : 1));
+    f.commentCount = commentCount;
+    f.nextComment = 0;
+    for (int i = 0; i < commentCount; i++) {
+        const char* p = comments[i].start;
+        while (p > source && (p[-1] == ' ' || p[-1] == '\t')) p--;
+        f.comments[i].token = comments[i];
+        f.comments[i].ownLine = p == source || p[-1] == '\n';
+    }
+
+    for (int i = 0; i < ast->block.count; i++) printStatement(&f, ast->block.statements[i]);
+    flushComments(&f, INT_MAX);
+
+    free(f.lines);
+    free(f.comments);
+    return f.out;
+}
@@ -4,6 +4,7 @@
 #include <time.h>
 #include <pthread.h>
 #include "bytecode/chunk.h"
+#include "scheduler.h"
 
 // Concurrent GC state
 static pthread_mutex_t gcMutex = PTHREAD_MUTEX_INITIALIZER;
@@ -16,18 +17,35 @@ static void markRoots(VM* vm);
 static void traceReferences(VM* vm);
 static size_t sweep(VM* vm, Obj** listHead);
 static void garbageCollect(VM* vm) { collectGarbage(vm); } // Wrapper or just rename prototypes
+static void collectYoungGarbage(VM* vm);
 
-void* reallocate(VM* vm, void* pointer, size_t oldSize, size_t newSize) {
+// Count a block growing from oldSize to newSize bytes, collecting first
+// when that takes the heap past the next threshold, or the nursery past
+// its size
+static void countGrowth(VM* vm, size_t oldSize, size_t newSize) {
     vm->bytesAllocated += newSize - oldSize;
     
     if (newSize > oldSize) {
-#ifdef DEBUG_STRESS_GC
-        garbageCollect(vm);
-#endif
-        if (vm->bytesAllocated > vm->nextGC) {
+        vm->gcTotalAllocated += newSize - oldSize;
+        vm->gcBytesAllocSinceGC += newSize - oldSize;
+        if (vm->bytesAllocated > vm->gcPeakMemory) vm->gcPeakMemory = vm->bytesAllocated;
+        bool young = vm->gcYoungLimit > 0 && vm->gcYoungHold == 0;
+        if (vm->gcStress) {
+            // Mostly young collections, so the barriers get exercised too
+            if (young && vm->gcCollectCount % 8 != 0) collectYoungGarbage(vm);
+            else garbageCollect(vm);
+        } else if (vm->bytesAllocated > vm->nextGC) {
             garbageCollect(vm);
+        } else if (young && vm->gcBytesAllocSinceGC > vm->gcYoungLimit) {
+            collectYoungGarbage(vm);
         }
+        // Over --max-heap: the interpreter checks again at its next poll
+        if (vm->maxHeap > 0 && vm->bytesAllocated > vm->maxHeap) vm->limitCountdown = 0;
     }
+}
+
+void* reallocate(VM* vm, void* pointer, size_t oldSize, size_t newSize) {
+    countGrowth(vm, oldSize, newSize);
 
     if (newSize == 0) {
         free(pointer);
@@ -39,9 +57,93 @@ void* reallocate(VM* vm, void* pointer, size_t oldSize, size_t newSize) {
     return result;
 }
 
+// ---- Block pool ----
+// Short-lived objects are mostly a few small sizes (array and string
+// headers, upvalues, short string payloads). A freed block of up to
+// BLOCK_POOL_MAX bytes goes on the free list of its size class instead of
+// back to malloc, and the next allocation of that class takes it from
+// there. Only the allocating thread touches the lists, so they take no
+// lock: a concurrent collection sweeps on its own thread and hands what it
+// frees straight back to malloc. Blocks are counted in bytesAllocated by
+// their callers exactly as before; only where the memory comes from changes.
+
+// Size class of a block, or -1 when it is too large to pool
+static int blockClass(size_t size) {
+    if (size == 0 || size > BLOCK_POOL_MAX) return -1;
+    return (int)((size - 1) / BLOCK_POOL_STEP);
+}
+
+void* allocateBlock(VM* vm, size_t size) {
+    int cls = blockClass(size);
+    void* block;
+    if (cls < 0) {
+        block = malloc(size);
+    } else if (vm->blockPool[cls]) {
+        block = vm->blockPool[cls];
+        vm->blockPool[cls] = *(void**)block;
+        vm->blockPoolCount[cls]--;
+        vm->gcBlocksReused++;
+        return block;
+    } else {
+        // Always the full class size, so any block of the class can serve
+        block = malloc((size_t)(cls + 1) * BLOCK_POOL_STEP);
+        vm->gcBlocksNew++;
+    }
+    if (block == NULL) exit(1);
+    return block;
+}
+
+void freeBlock(VM* vm, void* block, size_t size) {
+    if (block == NULL) return;
+    int cls = blockClass(size);
+    if (cls < 0 || vm->blockPoolCount[cls] >= vm->blockPoolLimit || gcConcurrentActive) {
+        free(block);
+        return;
+    }
+    *(void**)block = vm->blockPool[cls];
+    vm->blockPool[cls] = block;
+    vm->blockPoolCount[cls]++;
+}
+
+void freeBlockPool(VM* vm) {
+    for (int cls = 0; cls < BLOCK_POOL_CLASSES; cls++) {
+        void* block = vm->blockPool[cls];
+        while (block) {
+            void* next = *(void**)block;
+            free(block);
+            block = next;
+        }
+        vm->blockPool[cls] = NULL;
+        vm->blockPoolCount[cls] = 0;
+    }
+}
+
+// A recycled block still holds the fields of the object it was, so every
+// object starts zeroed
+Obj* allocateObject(VM* vm, size_t size, ObjType type) {
+    countGrowth(vm, 0, size);
+    Obj* object = (Obj*)allocateBlock(vm, size);
+    memset(object, 0, size);
+    object->type = type;
+    vm->gcObjectsAllocated[type]++;
+    object->isMarked = (vm->gcPhase == 1 || isGCActive()); // Allocate Black during Marking to prevent Stack leaks
+    object->isPermanent = false; // Default: subject to GC
+    object->generation = 0;
+    
+    // Generational allocation: add to nursery
+    object->next = vm->nursery;
+    vm->nursery = object;
+    vm->nurseryCount++;
+    
+    return object;
+}
+
 void markObject(VM* vm, Obj* object) {
     if (object == NULL) return;
     if (object->isMarked) return;
+    // A young collection stops at the old generation; what old objects
+    // reference in the nursery it finds through the remembered set
+    if (vm->gcYoungOnly && object->generation) return;
     
     // Thread Safety: Lock if concurrent GC is active
     if (gcConcurrentActive) pthread_mutex_lock(&gcMutex);
@@ -103,10 +205,14 @@ static void blackenObject(VM* vm, Obj* object) {
         case OBJ_STRING:
         case OBJ_NATIVE:
         case OBJ_RESOURCE:
+        case OBJ_RANGE:
+        case OBJ_STRING_BUILDER:
+        case OBJ_INT:
             break;
             
         case OBJ_UPVALUE:
-            // markValue(vm, ((ObjUpvalue*)object)->closed);
+            // Open upvalues point into the register file, which is a root
+            markValue(vm, ((ObjUpvalue*)object)->closed);
             break;
             
         case OBJ_FUNCTION: {
@@ -130,6 +236,13 @@ static void blackenObject(VM* vm, Obj* object) {
             if (function->closure) {
                  markObject(vm, (Obj*)function->closure); 
             }
+            if (function->proto) markObject(vm, (Obj*)function->proto);
+            markObject(vm, (Obj*)function->moduleEnv);
+            if (function->upvalues) {
+                for (int i = 0; i < function->upvalueCount; i++) {
+                    markObject(vm, (Obj*)function->upvalues[i]);
+                }
+            }
             if (function->bytecodeChunk) {
                 BytecodeChunk* chunk = function->bytecodeChunk;
                 for (int i = 0; i < chunk->constantCount; i++) {
@@ -145,7 +258,8 @@ static void blackenObject(VM* vm, Obj* object) {
             break;
         }
         
-        case OBJ_MAP: {
+        case OBJ_MAP:
+        case OBJ_SET: {
             Map* map = (Map*)object;
             for (int i = 0; i < TABLE_SIZE; i++) {
                 MapEntry* entry = map->buckets[i];
@@ -191,7 +305,26 @@ static void blackenObject(VM* vm, Obj* object) {
         }
 
         case OBJ_STRUCT_DEF: {
-            // StructDef string is interned, no nested GC objects
+            // StructDef string is interned; methods are the only nested objects
+            StructDef* def = (StructDef*)object;
+            for (int i = 0; i < def->methodCount; i++) {
+                markObject(vm, (Obj*)def->methods[i]);
+            }
+            break;
+        }
+
+        case OBJ_BOUND_METHOD: {
+            BoundMethod* bound = (BoundMethod*)object;
+            markValue(vm, bound->receiver);
+            markObject(vm, (Obj*)bound->method);
+            break;
+        }
+
+        case OBJ_CHANNEL: {
+            Channel* ch = (Channel*)object;
+            for (int i = 0; i < ch->count; i++) {
+                markValue(vm, ch->items[ch->head + i]);
+            }
             break;
         }
 
@@ -210,39 +343,84 @@ static void blackenObject(VM* vm, Obj* object) {
     }
 }
 
-static void markRoots(VM* vm) {
+// Registers, frames and scopes of the running coroutine or a suspended one
+void markExecState(VM* vm, ExecState* state) {
     // Mark current active register window
-    if (vm->regTop > vm->regBase) {
-        for (int i = vm->regBase; i < vm->regTop; i++) {
-            markValue(vm, vm->registers[i]);
+    if (state->regTop > state->regBase) {
+        for (int i = state->regBase; i < state->regTop; i++) {
+            markValue(vm, state->registers[i]);
         }
     }
 
     // Mark all suspended caller frames' registers
-    for (int i = 0; i < vm->callStackTop; i++) {
-        CallFrame* frame = &vm->callStack[i];
+    for (int i = 0; i < state->callStackTop; i++) {
+        CallFrame* frame = &state->callStack[i];
         if (frame->chunk) {
             int end = frame->regBase + frame->chunk->maxRegs + 1;
             for (int r = frame->regBase; r < end; r++) {
-                markValue(vm, vm->registers[r]);
+                markValue(vm, state->registers[r]);
             }
         }
     }
 
     // Mark legacy stack (AST walker compatibility)
-    for (Value* slot = vm->stack; slot < vm->stack + vm->stackTop; slot++) {
+    for (Value* slot = state->stack; slot < state->stack + state->stackTop; slot++) {
         markValue(vm, *slot);
     }
 
     // Mark Call Frames and their environments
-    for (int i = 0; i < vm->callStackTop; i++) {
-        markObject(vm, (Obj*)vm->callStack[i].env);
-        if (vm->callStack[i].function) markObject(vm, (Obj*)vm->callStack[i].function);
+    for (int i = 0; i < state->callStackTop; i++) {
+        markObject(vm, (Obj*)state->callStack[i].env);
+        markObject(vm, (Obj*)state->callStack[i].prevGlobalEnv);
+        if (state->callStack[i].function) markObject(vm, (Obj*)state->callStack[i].function);
+        markObject(vm, (Obj*)state->callStack[i].defers);
+        markValue(vm, state->callStack[i].returnValue); // Held while deferred calls run
+    }
+
+    // Open upvalues are only linked from closures and this list
+    for (ObjUpvalue* uv = state->openUpvalues; uv; uv = uv->next) {
+        markObject(vm, (Obj*)uv);
+    }
+
+    // AST walker's current scope (frames only hold their caller's)
+    markObject(vm, (Obj*)state->env);
+    markObject(vm, (Obj*)state->globalEnv);
+    markObject(vm, (Obj*)state->defEnv);
+}
+
+static void markRoots(VM* vm) {
+    ExecState running;
+    saveExecState(vm, &running);
+    markExecState(vm, &running);
+    markCoroutines(vm);
+
+    // A thrown value is unreachable while the stack unwinds
+    markValue(vm, vm->thrownValue);
+    markValue(vm, vm->calledValues);
+    markObject(vm, (Obj*)vm->errorDef);
+    markObject(vm, (Obj*)vm->uonSchemas);
+    for (int i = 0; i < vm->errorTraceCount; i++) {
+        if (vm->errorTrace[i].function) markObject(vm, (Obj*)vm->errorTrace[i].function);
+    }
+
+    // Imported modules stay cached for the lifetime of the VM
+    for (int i = 0; i < TABLE_SIZE; i++) {
+        for (ModuleEntry* e = vm->moduleBuckets[i]; e; e = e->next) {
+            markObject(vm, (Obj*)e->module);
+        }
+    }
+
+    // Permanent objects (core library modules, natives) are roots too:
+    // what they reference must survive even if no script value does. The
+    // old ones are left to the remembered set in a young collection.
+    Obj* lists[2] = { vm->objects, vm->nursery };
+    for (int l = vm->gcYoungOnly ? 1 : 0; l < 2; l++) {
+        for (Obj* o = lists[l]; o; o = o->next) {
+            if (!o->isPermanent) continue;
+            o->isMarked = false; // Registration pre-marks some of them
+            markObject(vm, o);
+        }
     }
-    
-    // Mark Global Environment
-    markObject(vm, (Obj*)vm->globalEnv);
-    markObject(vm, (Obj*)vm->defEnv);
 
     // Mark Global Handles (if any)
 }
@@ -251,6 +429,7 @@ static void traceReferences(VM* vm) {
     while (vm->grayCount > 0) {
         Obj* object = vm->grayStack[--vm->grayCount];
         blackenObject(vm, object);
+        vm->gcLastTraced++;
     }
 }
 
@@ -266,22 +445,53 @@ static int traceReferencesIncremental(VM* vm, int workUnits) {
     return vm->grayCount;
 }
 
+// The ALLOCATE_OBJ size of an object of this type
+static size_t objectSize(ObjType type) {
+    switch (type) {
+        case OBJ_STRING:          return sizeof(ObjString);
+        case OBJ_ARRAY:           return sizeof(Array);
+        case OBJ_MAP:             return sizeof(Map);
+        case OBJ_SET:             return sizeof(Map);
+        case OBJ_MODULE:          return sizeof(Module);
+        case OBJ_STRUCT_DEF:      return sizeof(StructDef);
+        case OBJ_STRUCT_INSTANCE: return sizeof(StructInstance);
+        case OBJ_RESOURCE:        return sizeof(ObjResource);
+        case OBJ_FUNCTION:        return sizeof(Function);
+        case OBJ_FUTURE:          return sizeof(Future);
+        case OBJ_RANGE:           return sizeof(Range);
+        case OBJ_CHANNEL:         return sizeof(Channel);
+        case OBJ_STRING_BUILDER:  return sizeof(StringBuilder);
+        case OBJ_BOUND_METHOD:    return sizeof(BoundMethod);
+        case OBJ_UPVALUE:         return sizeof(ObjUpvalue);
+        case OBJ_ENVIRONMENT:     return sizeof(Environment);
+        case OBJ_INT:             return sizeof(ObjInt);
+        default:                  return sizeof(Obj);
+    }
+}
+
 void freeObject(VM* vm, Obj* object) {
-    (void)vm;
     switch (object->type) {
         case OBJ_STRING: {
             ObjString* string = (ObjString*)object;
-            free(string->chars);
-            free(object);
+            if (string->pooledChars) freeBlock(vm, string->chars, string->length + 1);
+            else free(string->chars);
             break;
         }
         case OBJ_ARRAY: {
             Array* array = (Array*)object;
             free(array->items);
-            free(object);
             break;
         }
-        case OBJ_MAP: {
+        case OBJ_CHANNEL: {
+            free(((Channel*)object)->items);
+            break;
+        }
+        case OBJ_STRING_BUILDER: {
+            free(((StringBuilder*)object)->chars);
+            break;
+        }
+        case OBJ_MAP:
+        case OBJ_SET: {
             Map* map = (Map*)object;
             for (int i = 0; i < TABLE_SIZE; i++) {
                 MapEntry* entry = map->buckets[i];
@@ -292,15 +502,15 @@ void freeObject(VM* vm, Obj* object) {
                     entry = next;
                 }
             }
-            free(object);
             break;
         }
         case OBJ_FUNCTION: {
             Function* func = (Function*)object;
             // Debugging output for unwanted function freeing
             // if (func->name.length > 0) { ...
-            // Free bytecode chunk if it exists
-            if (func->bytecodeChunk) {
+            // Closures share their prototype's chunk; only the prototype frees it
+            free(func->upvalues);
+            if (func->bytecodeChunk && !func->proto) {
                 freeChunk(func->bytecodeChunk);
                 free(func->bytecodeChunk);
                 func->bytecodeChunk = NULL;
@@ -310,20 +520,18 @@ void freeObject(VM* vm, Obj* object) {
                 // params is allocated in parser, typically part of AST
                 // Don't free here as it's part of AST lifecycle
             }
-            free(object);
             break;
         }
         case OBJ_STRUCT_DEF: {
             StructDef* def = (StructDef*)object;
             for (int i = 0; i < def->fieldCount; i++) free(def->fields[i]);
             free(def->fields);
-            free(def);
+            free(def->methods);
             break;
         }
         case OBJ_STRUCT_INSTANCE: {
             StructInstance* inst = (StructInstance*)object;
             free(inst->fields);
-            free(object);
             break;
         }
         case OBJ_MODULE: {
@@ -335,20 +543,17 @@ void freeObject(VM* vm, Obj* object) {
             // Leaving Env leak for now significantly safer than double free if alias shared.
             // But we malloc'd it.
             // free(mod->env); // TODO: safe verify
-            free(object);
             break;
         }
         case OBJ_RESOURCE: {
             ObjResource* res = (ObjResource*)object;
             if (res->cleanup) res->cleanup(res->data);
-            free(object);
             break;
         }
         case OBJ_FUTURE: {
             Future* f = (Future*)object;
             pthread_mutex_destroy(&f->mu);
             pthread_cond_destroy(&f->cv);
-            free(object);
             break;
         }
         case OBJ_ENVIRONMENT: {
@@ -372,37 +577,88 @@ void freeObject(VM* vm, Obj* object) {
                     // In findModuleEntry we have issues.
                     // Generally functions use interned keys.
                     // Just free the entry struct.
-                    if (fEntry->key && fEntry->function && fEntry->function->isNative && !fEntry->function->name.start) {
-                        // Special case? No.
-                    }
                      free(fEntry); // Keys are usually shared/interned.
                      fEntry = next;
                 }
             }
-            free(object);
             break;
         }
 
         default:
-            free(object);
             break;
     }
+    freeBlock(vm, object, objectSize(object->type));
 }
 
-// Remove unmarked strings from the pool (must happen before sweep frees them)
+// Remove unmarked strings from the pool (must happen before sweep frees them).
+// Open addressing has no cheap removal, so the survivors are re-inserted.
 static void pruneStringPool(VM* vm) {
-    pthread_mutex_lock(&vm->stringPool.lock);
-    for (int i = 0; i < vm->stringPool.count; i++) {
-        ObjString* str = (ObjString*)vm->stringPool.strings[i];
+    StringPool* pool = &vm->stringPool;
+    pthread_mutex_lock(&pool->lock);
+    ObjString** old = pool->slots;
+    ObjString** slots = calloc(pool->capacity, sizeof(ObjString*));
+    if (!slots) error("Memory allocation failed for string pool.", 0);
+    int mask = pool->capacity - 1;
+    pool->count = 0;
+    for (int i = 0; i < pool->capacity; i++) {
+        ObjString* str = old[i];
+        if (!str) continue;
         if (!((Obj*)str)->isMarked) {
-            // Remove from pool (swap with last)
-            vm->stringPool.strings[i] = vm->stringPool.strings[vm->stringPool.count - 1];
-            vm->stringPool.hashes[i] = vm->stringPool.hashes[vm->stringPool.count - 1];
-            vm->stringPool.count--;
-            i--; // Retry this index with swapped element
+            str->interned = false; // No longer the only copy: compare bytes
+            continue;
         }
+        int j = (int)(str->hash & (unsigned int)mask);
+        while (slots[j]) j = (j + 1) & mask;
+        slots[j] = str;
+        pool->count++;
+    }
+    pool->slots = slots;
+    free(old);
+    pthread_mutex_unlock(&pool->lock);
+}
+
+// A young collection only frees nursery strings, so rather than rebuild
+// the pool it takes those out one at a time. Removing from a linear-probe
+// table leaves a hole a later entry of the same run may have probed past,
+// so each entry after it that belongs at or before the hole moves into it.
+static void pruneYoungStrings(VM* vm) {
+    StringPool* pool = &vm->stringPool;
+    pthread_mutex_lock(&pool->lock);
+    int mask = pool->capacity - 1;
+    for (Obj* o = vm->nursery; o; o = o->next) {
+        if (o->type != OBJ_STRING || o->isMarked || o->isPermanent) continue;
+        ObjString* str = (ObjString*)o;
+        if (!str->interned) continue;
+        str->interned = false;
+
+        int hole = (int)(str->hash & (unsigned int)mask);
+        while (pool->slots[hole] != str) hole = (hole + 1) & mask;
+        pool->slots[hole] = NULL;
+        pool->count--;
+        for (int i = (hole + 1) & mask; pool->slots[i]; i = (i + 1) & mask) {
+            int home = (int)(pool->slots[i]->hash & (unsigned int)mask);
+            // Distance from home: an entry farther from it than the hole is
+            // has probed past the hole
+            if (((i - home) & mask) >= ((i - hole) & mask)) {
+                pool->slots[hole] = pool->slots[i];
+                pool->slots[i] = NULL;
+                hole = i;
+            }
+        }
+    }
+    pthread_mutex_unlock(&pool->lock);
+}
+
+// Bytes counted in bytesAllocated for this object: its ALLOCATE_OBJ size
+// plus payloads allocated through reallocate() / internString()
+static size_t trackedSize(Obj* object) {
+    switch (object->type) {
+        case OBJ_STRING:  return sizeof(ObjString) + ((ObjString*)object)->length + 1;
+        case OBJ_ARRAY:   return sizeof(Array) + ((Array*)object)->capacity * sizeof(Value);
+        case OBJ_CHANNEL: return sizeof(Channel) + ((Channel*)object)->itemCapacity * sizeof(Value);
+        case OBJ_STRING_BUILDER: return sizeof(StringBuilder) + ((StringBuilder*)object)->capacity;
+        default:          return objectSize(object->type);
     }
-    pthread_mutex_unlock(&vm->stringPool.lock);
 }
 
 static size_t sweep(VM* vm, Obj** listHead) {
@@ -412,11 +668,10 @@ static size_t sweep(VM* vm, Obj** listHead) {
     size_t freedBytes = 0;
     
     while (object != NULL) {
-        // Permanent objects are always considered marked and their mark is never reset
+        // Permanent objects are never freed; their mark is reset like any
+        // other so markRoots traces them again next cycle
         if (object->isPermanent || object->isMarked) {
-            if (!object->isPermanent) {
-                object->isMarked = false;
-            }
+            object->isMarked = false;
             previous = object;
             object = object->next;
         } else {
@@ -425,21 +680,12 @@ static size_t sweep(VM* vm, Obj** listHead) {
             if (previous != NULL) {
                 previous->next = object;
             } else {
-                vm->objects = object;
+                *listHead = object;
             }
             
-            // Estimate freed bytes (rough estimation based on object type)
-            size_t objSize = sizeof(Obj);
-            switch (unreached->type) {
-                case OBJ_STRING: objSize = sizeof(ObjString) + ((ObjString*)unreached)->length; break;
-                case OBJ_ARRAY: objSize = sizeof(Array) + ((Array*)unreached)->capacity * sizeof(Value); break;
-                case OBJ_MAP: objSize = sizeof(Map); break;
-                case OBJ_FUNCTION: objSize = sizeof(Function); break;
-                case OBJ_ENVIRONMENT: objSize = sizeof(Environment); break;
-                default: objSize = sizeof(Obj); break;
-            }
-            freedBytes += objSize;
+            freedBytes += trackedSize(unreached);
             freedCount++;
+            if (listHead == &vm->nursery) vm->nurseryCount--;
             
             freeObject(vm, unreached);
         }
@@ -455,42 +701,127 @@ static uint64_t getCurrentTimeUs(void) {
     return (uint64_t)ts.tv_sec * 1000000ULL + (uint64_t)ts.tv_nsec / 1000ULL;
 }
 
-void collectGarbage(VM* vm) {
-    uint64_t startTime = getCurrentTimeUs();
-    size_t beforeBytes = vm->bytesAllocated;
-    
-    // Track peak memory
-    if (vm->bytesAllocated > vm->gcPeakMemory) {
-        vm->gcPeakMemory = vm->bytesAllocated;
+// Next collection once the heap has grown by gcGrowthFactor over what
+// survived, but never below the initial heap size
+static void updateThreshold(VM* vm) {
+    vm->nextGC = (size_t)((double)vm->bytesAllocated * vm->gcGrowthFactor);
+    if (vm->nextGC < vm->gcInitialHeap) vm->nextGC = vm->gcInitialHeap;
+}
+
+// Parse a byte count with an optional K / M / G suffix; 0 on error
+static size_t parseByteSize(const char* s) {
+    char* end = NULL;
+    double n = strtod(s, &end);
+    if (end == s || n <= 0) return 0;
+    switch (*end) {
+        case 'k': case 'K': n *= 1024.0; end++; break;
+        case 'm': case 'M': n *= 1024.0 * 1024.0; end++; break;
+        case 'g': case 'G': n *= 1024.0 * 1024.0 * 1024.0; end++; break;
+        default: break;
     }
-    
-    // Promote nursery to old generation
+    if (*end == 'b' || *end == 'B') end++;
+    return *end == '\0' ? (size_t)n : 0;
+}
+
+void configureGC(VM* vm) {
+    const char* heap = getenv("UNNARIZE_GC_HEAP");
+    if (heap) {
+        size_t bytes = parseByteSize(heap);
+        if (bytes > 0) {
+            vm->gcInitialHeap = bytes;
+            vm->nextGC = bytes;
+        } else {
+            fprintf(stderr, "Warning: ignoring invalid UNNARIZE_GC_HEAP \"%s\"\n", heap);
+        }
+    }
+
+    const char* growth = getenv("UNNARIZE_GC_GROWTH");
+    if (growth) {
+        char* end = NULL;
+        double factor = strtod(growth, &end);
+        if (end != growth && *end == '\0' && factor > 1.0) {
+            vm->gcGrowthFactor = factor;
+        } else {
+            fprintf(stderr, "Warning: ignoring invalid UNNARIZE_GC_GROWTH \"%s\" (must be > 1)\n", growth);
+        }
+    }
+
+#ifdef DEBUG_STRESS_GC
+    vm->gcStress = true;
+#endif
+    const char* stress = getenv("UNNARIZE_GC_STRESS");
+    if (stress) vm->gcStress = strcmp(stress, "0") != 0;
+
+    const char* young = getenv("UNNARIZE_GC_YOUNG");
+    if (young) {
+        size_t bytes = parseByteSize(young);
+        if (bytes > 0 || strcmp(young, "0") == 0) {
+            vm->gcYoungLimit = bytes;
+        } else {
+            fprintf(stderr, "Warning: ignoring invalid UNNARIZE_GC_YOUNG \"%s\"\n", young);
+        }
+    }
+
+    const char* pool = getenv("UNNARIZE_GC_POOL");
+    if (pool) vm->blockPoolLimit = strcmp(pool, "0") != 0 ? BLOCK_POOL_LIMIT : 0;
+}
+
+// ---- Generations ----
+// Objects are born in the nursery. A young collection marks from the
+// roots without entering the old generation, frees the unreached part of
+// the nursery and promotes what is left, so its cost follows what is
+// young and reachable rather than the whole heap. The old objects it
+// doesn't scan may still reference young ones: every store of an object
+// into another goes through GEN_BARRIER, which lists an old owner of a
+// young child in the remembered set, and a young collection scans those
+// owners as extra roots. Once the nursery is promoted nothing young is
+// left, so the set starts empty again. A full collection marks and sweeps
+// both generations when the heap passes nextGC.
+
+void rememberObject(VM* vm, Obj* owner) {
+    if (owner->remembered) return;
+    owner->remembered = true;
+    if (vm->rememberedCapacity < vm->rememberedCount + 1) {
+        vm->rememberedCapacity = GROW_CAPACITY(vm->rememberedCapacity);
+        vm->remembered = (Obj**)realloc(vm->remembered, sizeof(Obj*) * vm->rememberedCapacity);
+        if (vm->remembered == NULL) exit(1);
+    }
+    vm->remembered[vm->rememberedCount++] = owner;
+    vm->gcRememberedTotal++;
+}
+
+// Move the whole nursery to the old generation
+static void promoteNursery(VM* vm) {
     if (vm->nursery) {
         Obj* tail = vm->nursery;
-        while (tail->next) tail = tail->next;
+        for (;;) {
+            tail->generation = 1;
+            if (!tail->next) break;
+            tail = tail->next;
+        }
         tail->next = vm->objects;
         vm->objects = vm->nursery;
+        vm->gcPromoted += (uint64_t)vm->nurseryCount;
         vm->nursery = NULL;
         vm->nurseryCount = 0;
     }
+    for (int i = 0; i < vm->rememberedCount; i++) vm->remembered[i]->remembered = false;
+    vm->rememberedCount = 0;
+}
 
-    // Mark phase
-    vm->gcPhase = 1;  // GC_MARKING
-    markRoots(vm);
-    traceReferences(vm);
-    
-    // Sweep phase
-    pruneStringPool(vm);
-    vm->gcPhase = 2;  // GC_SWEEPING
-    size_t freedBytes = sweep(vm, &vm->objects);
-    vm->gcPhase = 0;  // GC_IDLE
-    
-    // Decrement bytesAllocated to reflect freed memory
-    if (freedBytes > vm->bytesAllocated) {
-        vm->bytesAllocated = 0;
-    } else {
-        vm->bytesAllocated -= freedBytes;
+// Drop the remembered objects a full collection is about to free
+static void pruneRemembered(VM* vm) {
+    int kept = 0;
+    for (int i = 0; i < vm->rememberedCount; i++) {
+        Obj* object = vm->remembered[i];
+        if (object->isMarked || object->isPermanent) vm->remembered[kept++] = object;
     }
+    vm->rememberedCount = kept;
+}
+
+// Statistics and bytesAllocated after a collection that began at startTime
+static void finishCollection(VM* vm, uint64_t startTime, size_t freedBytes) {
+    vm->bytesAllocated -= freedBytes;
     
     // Update statistics
     uint64_t pauseTime = getCurrentTimeUs() - startTime;
@@ -498,31 +829,61 @@ void collectGarbage(VM* vm) {
     vm->gcTotalPauseUs += pauseTime;
     vm->gcLastPauseUs = pauseTime;
     vm->gcTotalFreed += freedBytes;
-    
-    // Adaptive threshold: adjust based on heap pressure
-    // If we freed a lot (>50% of heap), we can be more relaxed
-    // If we freed little (<20%), trigger sooner
-    double freedRatio = (beforeBytes > 0) ? (double)freedBytes / (double)beforeBytes : 0.0;
-    
-    if (freedRatio > 0.5) {
-        // Freed a lot - can wait longer
-        vm->nextGC = vm->bytesAllocated * 3;
-    } else if (freedRatio < 0.2) {
-        // Freed little - trigger sooner
-        vm->nextGC = vm->bytesAllocated + (vm->bytesAllocated / 2);
-    } else {
-        // Normal doubling
-        vm->nextGC = vm->bytesAllocated * 2;
+    vm->gcBytesAllocSinceGC = 0;
+}
+
+static void collectYoungGarbage(VM* vm) {
+    uint64_t startTime = getCurrentTimeUs();
+    vm->gcLastTraced = 0;
+
+    // Mark phase: the roots, then the old objects holding young ones
+    vm->gcYoungOnly = true;
+    vm->gcPhase = 1;  // GC_MARKING
+    markRoots(vm);
+    for (int i = 0; i < vm->rememberedCount; i++) {
+        blackenObject(vm, vm->remembered[i]);
+        vm->gcLastTraced++;
     }
+    traceReferences(vm);
+
+    // Sweep phase: the nursery alone, then its survivors grow old
+    pruneYoungStrings(vm);
+    vm->gcPhase = 2;  // GC_SWEEPING
+    size_t freedBytes = sweep(vm, &vm->nursery);
+    vm->gcPhase = 0;  // GC_IDLE
+    vm->gcYoungOnly = false;
+    promoteNursery(vm);
+
+    finishCollection(vm, startTime, freedBytes);
+    vm->gcYoungCount++;
+    vm->gcYoungTraced += vm->gcLastTraced;
+}
+
+void collectGarbage(VM* vm) {
+    uint64_t startTime = getCurrentTimeUs();
+    vm->gcLastTraced = 0;
     
-    // Minimum threshold
-    if (vm->nextGC < 1024 * 32) {
-        vm->nextGC = 1024 * 32;  // 32KB minimum
-    }
-    // Maximum threshold: cap growth to prevent unbounded heap
-    if (vm->nextGC > 1024 * 1024 * 4) {
-        vm->nextGC = 1024 * 1024 * 4;  // 4MB maximum
+    // Track peak memory
+    if (vm->bytesAllocated > vm->gcPeakMemory) {
+        vm->gcPeakMemory = vm->bytesAllocated;
     }
+
+    // Mark phase
+    vm->gcPhase = 1;  // GC_MARKING
+    markRoots(vm);
+    traceReferences(vm);
+    
+    // Sweep phase. Nursery survivors stay young for the next young
+    // collection to promote: a compile in progress fills its young chunks
+    // without barriers (see gcYoungHold).
+    pruneStringPool(vm);
+    pruneRemembered(vm);
+    vm->gcPhase = 2;  // GC_SWEEPING
+    size_t freedBytes = sweep(vm, &vm->objects) + sweep(vm, &vm->nursery);
+    vm->gcPhase = 0;  // GC_IDLE
+    
+    finishCollection(vm, startTime, freedBytes);
+    updateThreshold(vm);
 }
 
 // Incremental GC for long-running processes
@@ -558,22 +919,13 @@ bool collectGarbageIncremental(VM* vm, int workUnits) {
         size_t freedBytes = sweep(vm, &vm->objects);
         vm->gcPhase = 0;  // GC_IDLE
         
-        // Decrement bytesAllocated to reflect freed memory
-        if (freedBytes > vm->bytesAllocated) {
-            vm->bytesAllocated = 0;
-        } else {
-            vm->bytesAllocated -= freedBytes;
-        }
+        vm->bytesAllocated -= freedBytes;
         
         // Update statistics
         vm->gcCollectCount++;
         vm->gcTotalFreed += freedBytes;
         
-        // Adaptive threshold
-        vm->nextGC = vm->bytesAllocated * 2;
-        if (vm->nextGC < 1024 * 32) vm->nextGC = 1024 * 32;
-        if (vm->nextGC > 1024 * 1024 * 4) vm->nextGC = 1024 * 1024 * 4;
-        
+        updateThreshold(vm);
         return true;  // Collection complete
     }
     
@@ -607,6 +959,12 @@ static void* concurrentMarkWorker(void* arg) {
                 case OBJ_FUNCTION: {
                     Function* func = (Function*)object;
                     if (func->closure) markObject(vm, (Obj*)func->closure);
+                    if (func->proto) markObject(vm, (Obj*)func->proto);
+                    if (func->upvalues) {
+                        for (int j = 0; j < func->upvalueCount; j++) {
+                            markObject(vm, (Obj*)func->upvalues[j]);
+                        }
+                    }
                     if (func->bytecodeChunk) {
                         for (int j = 0; j < func->bytecodeChunk->constantCount; j++) {
                             markValue(vm, func->bytecodeChunk->constants[j]);
@@ -614,6 +972,9 @@ static void* concurrentMarkWorker(void* arg) {
                     }
                     break;
                 }
+                case OBJ_UPVALUE:
+                    markValue(vm, ((ObjUpvalue*)object)->closed);
+                    break;
                 case OBJ_ARRAY: {
                     Array* arr = (Array*)object;
                     for (int j = 0; j < arr->count; j++) {
@@ -621,7 +982,8 @@ static void* concurrentMarkWorker(void* arg) {
                     }
                     break;
                 }
-                case OBJ_MAP: {
+                case OBJ_MAP:
+                case OBJ_SET: {
                     Map* m = (Map*)object;
                     for (int j = 0; j < TABLE_SIZE; j++) {
                         MapEntry* e = m->buckets[j];
@@ -657,20 +1019,13 @@ static void* concurrentMarkWorker(void* arg) {
     size_t freedBytes = sweep(vm, &vm->objects);
     vm->gcPhase = 0;
     
-    if (freedBytes > vm->bytesAllocated) {
-        vm->bytesAllocated = 0; // Guard against underflow due to estimations
-    } else {
-        vm->bytesAllocated -= freedBytes;
-    }
+    vm->bytesAllocated -= freedBytes;
 
     vm->gcCollectCount++;
     vm->gcTotalFreed += freedBytes;
     vm->gcLastCollectTime = getCurrentTimeUs();
     
-    // Adaptive threshold
-    vm->nextGC = vm->bytesAllocated * 2;
-    if (vm->nextGC < 1024 * 32) vm->nextGC = 1024 * 32;
-    if (vm->nextGC > 1024 * 1024 * 4) vm->nextGC = 1024 * 1024 * 4;
+    updateThreshold(vm);
     
     gcConcurrentActive = 0;
     pthread_mutex_unlock(&gcMutex);
@@ -687,14 +1042,7 @@ void collectGarbageConcurrent(VM* vm, int workUnits) {
     pthread_mutex_lock(&gcMutex);
     
     // Snapshot: Promote current nursery to Old Generation (vm->objects)
-    if (vm->nursery) {
-         Obj* tail = vm->nursery;
-         while (tail->next) tail = tail->next;
-         tail->next = vm->objects;
-         vm->objects = vm->nursery;
-         vm->nursery = NULL;
-         vm->nurseryCount = 0;
-    }
+    promoteNursery(vm);
     
     pthread_mutex_unlock(&gcMutex);
     
@@ -720,3 +1068,61 @@ void collectGarbageConcurrent(VM* vm, int workUnits) {
 bool isGCActive(void) {
     return gcConcurrentActive != 0;
 }
+
+// ===== Statistics =====
+
+static const char* objTypeNames[OBJ_TYPE_COUNT] = {
+    [OBJ_STRING] = "string",
+    [OBJ_MODULE] = "module",
+    [OBJ_ARRAY] = "array",
+    [OBJ_MAP] = "map",
+    [OBJ_STRUCT_DEF] = "struct def",
+    [OBJ_STRUCT_INSTANCE] = "struct",
+    [OBJ_RESOURCE] = "resource",
+    [OBJ_FUNCTION] = "function",
+    [OBJ_NATIVE] = "native",
+    [OBJ_FUTURE] = "future",
+    [OBJ_UPVALUE] = "upvalue",
+    [OBJ_ENVIRONMENT] = "environment",
+    [OBJ_RANGE] = "range",
+    [OBJ_BOUND_METHOD] = "bound method",
+    [OBJ_CHANNEL] = "channel",
+    [OBJ_SET] = "set",
+    [OBJ_STRING_BUILDER] = "string builder",
+    [OBJ_INT] = "int",
+};
+
+void printMemoryStats(VM* vm, FILE* out) {
+    uint64_t live[OBJ_TYPE_COUNT] = {0};
+    Obj* lists[2] = { vm->objects, vm->nursery };
+    for (int i = 0; i < 2; i++) {
+        for (Obj* o = lists[i]; o; o = o->next) live[o->type]++;
+    }
+
+    flushOutput(vm); // Keep program output ahead of the report
+    fprintf(out, "\n=== Memory Statistics ===\n");
+    fprintf(out, "Bytes allocated: %llu\n", (unsigned long long)vm->gcTotalAllocated);
+    fprintf(out, "Peak heap bytes: %zu\n", vm->gcPeakMemory);
+    fprintf(out, "Live heap bytes: %zu\n", vm->bytesAllocated);
+    fprintf(out, "GC cycles:       %llu (%llu bytes freed, %.3f ms paused)\n",
+            (unsigned long long)vm->gcCollectCount, (unsigned long long)vm->gcTotalFreed,
+            vm->gcTotalPauseUs / 1000.0);
+    fprintf(out, "Young GC:        %llu of the cycles (%llu objects traced, %llu promoted)\n",
+            (unsigned long long)vm->gcYoungCount, (unsigned long long)vm->gcYoungTraced,
+            (unsigned long long)vm->gcPromoted);
+    fprintf(out, "Pooled blocks:   %llu reused, %llu new\n",
+            (unsigned long long)vm->gcBlocksReused, (unsigned long long)vm->gcBlocksNew);
+
+    fprintf(out, "%-14s %12s %12s\n", "Objects", "allocated", "live");
+    uint64_t totalAllocated = 0;
+    uint64_t totalLive = 0;
+    for (int t = 0; t < OBJ_TYPE_COUNT; t++) {
+        if (vm->gcObjectsAllocated[t] == 0 && live[t] == 0) continue;
+        fprintf(out, "  %-12s %12llu %12llu\n", objTypeNames[t],
+                (unsigned long long)vm->gcObjectsAllocated[t], (unsigned long long)live[t]);
+        totalAllocated += vm->gcObjectsAllocated[t];
+        totalLive += live[t];
+    }
+    fprintf(out, "  %-12s %12llu %12llu\n", "total",
+            (unsigned long long)totalAllocated, (unsigned long long)totalLive);
+}
@@ -1,4 +1,5 @@
 #include "lexer.h"
+#include "vm.h"
 
 // Helper to check if char is digit
 static bool isDigit(char c) {
@@ -17,16 +18,18 @@ static Token makeToken(Lexer* lexer, TokenType type) {
     token.start = lexer->start;
     token.length = (int)(lexer->current - lexer->start);
     token.line = lexer->line;
+    token.column = lexer->column;
     return token;
 }
 
 // Error token
 static Token errorToken(Lexer* lexer, const char* message) {
     Token token;
-    token.type = TOKEN_EOF; // Use EOF for error
+    token.type = TOKEN_ERROR;
     token.start = message;
     token.length = (int)strlen(message);
     token.line = lexer->line;
+    token.column = lexer->column;
     return token;
 }
 
@@ -43,9 +46,11 @@ static void skipWhitespace(Lexer* lexer) {
             case '\n':
                 lexer->line++;
                 lexer->current++;
+                lexer->lineStart = lexer->current;
                 break;
             case '/':
                 if (*(lexer->current + 1) == '/') {
+                    if (lexer->keepComments) return;
                     // Comment until end of line
                     while (*lexer->current != '\n' && *lexer->current != '\0') {
                         lexer->current++;
@@ -73,29 +78,73 @@ static TokenType checkKeyword(Lexer* lexer, int start, int length, const char* r
 static TokenType identifierType(Lexer* lexer) {
     switch (*lexer->start) {
         case 'i': {
-            // import, if
+            // import, if, in
             if (lexer->current - lexer->start > 1) {
                 if (*(lexer->start + 1) == 'm') {
                     return checkKeyword(lexer, 1, 5, "mport", TOKEN_IMPORT);
                 } else if (*(lexer->start + 1) == 'f') {
                     return checkKeyword(lexer, 1, 1, "f", TOKEN_IF);
+                } else if (*(lexer->start + 1) == 'n') {
+                    return checkKeyword(lexer, 1, 1, "n", TOKEN_IN);
                 }
             }
             break;
         }
-        case 'l':
+        case 'l': return checkKeyword(lexer, 1, 3, "oop", TOKEN_LOOP);
+        case 'b': return checkKeyword(lexer, 1, 4, "reak", TOKEN_BREAK);
+        case 'c':
+            if (lexer->current - lexer->start > 1) {
+                switch (*(lexer->start + 1)) {
+                    case 'o':
+                        // const, continue
+                        if (lexer->current - lexer->start == 5) {
+                            return checkKeyword(lexer, 2, 3, "nst", TOKEN_CONST);
+                        }
+                        return checkKeyword(lexer, 2, 6, "ntinue", TOKEN_CONTINUE);
+                    case 'a':
+                        // case, catch
+                        if (lexer->current - lexer->start == 4) {
+                            return checkKeyword(lexer, 2, 2, "se", TOKEN_CASE);
+                        }
+                        return checkKeyword(lexer, 2, 3, "tch", TOKEN_CATCH);
+                }
+            }
             break;
+        case 'd':
+            // do, defer, default
+            if (lexer->current - lexer->start == 2) {
+                return checkKeyword(lexer, 1, 1, "o", TOKEN_DO);
+            }
+            if (lexer->current - lexer->start == 5) {
+                return checkKeyword(lexer, 1, 4, "efer", TOKEN_DEFER);
+            }
+            return checkKeyword(lexer, 1, 6, "efault", TOKEN_DEFAULT);
         case 'n': return checkKeyword(lexer, 1, 2, "il", TOKEN_NIL);
         case 'v': return checkKeyword(lexer, 1, 2, "ar", TOKEN_VAR);
         case 'p': return checkKeyword(lexer, 1, 4, "rint", TOKEN_PRINT);
-        case 'e': return checkKeyword(lexer, 1, 3, "lse", TOKEN_ELSE);
-        case 'w': return checkKeyword(lexer, 1, 4, "hile", TOKEN_WHILE);
+        case 'e':
+            if (lexer->current - lexer->start > 1) {
+                switch (*(lexer->start + 1)) {
+                    case 'l': return checkKeyword(lexer, 2, 2, "se", TOKEN_ELSE);
+                    case 'n': return checkKeyword(lexer, 2, 2, "um", TOKEN_ENUM);
+                }
+            }
+            break;
+        case 'w':
+            // while, with
+            if (lexer->current - lexer->start == 4) return checkKeyword(lexer, 1, 3, "ith", TOKEN_WITH);
+            return checkKeyword(lexer, 1, 4, "hile", TOKEN_WHILE);
         case 'f':
             if (lexer->current - lexer->start > 1) {
                 switch (*(lexer->start + 1)) {
                     case 'o': return checkKeyword(lexer, 2, 1, "r", TOKEN_FOR);
                     case 'u': return checkKeyword(lexer, 2, 6, "nction", TOKEN_FUNCTION);
-                    case 'a': return checkKeyword(lexer, 2, 3, "lse", TOKEN_FALSE);
+                    case 'a':
+                        // false, fallthrough
+                        if (lexer->current - lexer->start == 5) {
+                            return checkKeyword(lexer, 2, 3, "lse", TOKEN_FALSE);
+                        }
+                        return checkKeyword(lexer, 2, 9, "llthrough", TOKEN_FALLTHROUGH);
                 }
             }
             break;
@@ -110,14 +159,37 @@ static TokenType identifierType(Lexer* lexer) {
                         return checkKeyword(lexer, 1, 4, "sync", TOKEN_ASYNC);
                     case 'w':
                         return checkKeyword(lexer, 1, 4, "wait", TOKEN_AWAIT);
+                    case 'n':
+                        return checkKeyword(lexer, 2, 1, "d", TOKEN_AND);
                 }
             } else {
                 return checkKeyword(lexer, 1, 1, "s", TOKEN_AS);
             }
             break;
+        case 'o': return checkKeyword(lexer, 1, 1, "r", TOKEN_OR);
         case 'r': return checkKeyword(lexer, 1, 5, "eturn", TOKEN_RETURN);
-        case 's': return checkKeyword(lexer, 1, 5, "truct", TOKEN_STRUCT);
-        case 't': return checkKeyword(lexer, 1, 3, "rue", TOKEN_TRUE);
+        case 's':
+            if (lexer->current - lexer->start > 1) {
+                switch (*(lexer->start + 1)) {
+                    case 'p': return checkKeyword(lexer, 2, 3, "awn", TOKEN_SPAWN);
+                    case 't': return checkKeyword(lexer, 2, 4, "ruct", TOKEN_STRUCT);
+                    case 'w': return checkKeyword(lexer, 2, 4, "itch", TOKEN_SWITCH);
+                }
+            }
+            break;
+        case 't':
+            if (lexer->current - lexer->start > 1) {
+                switch (*(lexer->start + 1)) {
+                    case 'r':
+                        // true, try
+                        if (lexer->current - lexer->start == 3) {
+                            return checkKeyword(lexer, 2, 1, "y", TOKEN_TRY);
+                        }
+                        return checkKeyword(lexer, 2, 2, "ue", TOKEN_TRUE);
+                    case 'h': return checkKeyword(lexer, 2, 3, "row", TOKEN_THROW);
+                }
+            }
+            break;
     }
     return TOKEN_IDENTIFIER;
 }
@@ -130,21 +202,138 @@ static Token identifier(Lexer* lexer) {
     return makeToken(lexer, identifierType(lexer));
 }
 
-// Scan number
+static bool isBaseDigit(char c, int base) {
+    switch (base) {
+        case 2:  return c == '0' || c == '1';
+        case 8:  return c >= '0' && c <= '7';
+        case 16: return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F');
+        default: return isDigit(c);
+    }
+}
+
+static int digitValue(char c) {
+    if (isDigit(c)) return c - '0';
+    return (c | 0x20) - 'a' + 10;
+}
+
+// Radix given by a 0x/0b/0o prefix, or 10
+static int literalBase(const char* text, int length) {
+    if (length < 2 || text[0] != '0') return 10;
+    switch (text[1] | 0x20) {
+        case 'x': return 16;
+        case 'b': return 2;
+        case 'o': return 8;
+        default:  return 10;
+    }
+}
+
+// Digits of 'base' after the first one; a '_' must sit between two digits
+static bool scanDigits(Lexer* lexer, int base) {
+    while (true) {
+        if (*lexer->current == '_') {
+            if (!isBaseDigit(lexer->current[1], base)) return false;
+            lexer->current++;
+        } else if (!isBaseDigit(*lexer->current, base)) {
+            return true;
+        }
+        lexer->current++;
+    }
+}
+
+// An integer literal up to 2^63: one more than the largest int, which only
+// '-' may go before (the parser checks that)
+static Token integerToken(Lexer* lexer) {
+    uint64_t value;
+    if (!integerLiteral(makeToken(lexer, TOKEN_NUMBER), &value)) {
+        return errorToken(lexer, "Integer literal is too large.");
+    }
+    return makeToken(lexer, TOKEN_NUMBER);
+}
+
+// Scan number: decimal integers and doubles, or 0x/0b/0o integers, all
+// with optional '_' digit separators
 static Token number(Lexer* lexer) {
-    while (isDigit(*lexer->current)) lexer->current++;
+    static const char* const badSeparator = "Digit separator '_' must be between two digits.";
+    int base = literalBase(lexer->start, 2);
+    if (base != 10) {
+        lexer->current++; // Consume the prefix letter
+        if (!isBaseDigit(*lexer->current, base)) {
+            return errorToken(lexer, base == 16 ? "Expect hexadecimal digits after '0x'."
+                                   : base == 2 ? "Expect binary digits after '0b'."
+                                               : "Expect octal digits after '0o'.");
+        }
+        lexer->current++;
+    }
+
+    if (!scanDigits(lexer, base)) return errorToken(lexer, badSeparator);
+    if (base != 10) {
+        // 0b102 and 0xFFG are typos, not a number followed by a name
+        if (isAlpha(*lexer->current) || isDigit(*lexer->current)) {
+            return errorToken(lexer, "Invalid digit in number literal.");
+        }
+        return integerToken(lexer);
+    }
+
+    if (*lexer->current == '.' && lexer->current[1] == '_') return errorToken(lexer, badSeparator);
     if (*lexer->current == '.' && isDigit(*(lexer->current + 1))) {
-        lexer->current++; // Consume '.'
-        while (isDigit(*lexer->current)) lexer->current++;
+        lexer->current += 2; // Consume '.' and the first fraction digit
+        if (!scanDigits(lexer, 10)) return errorToken(lexer, badSeparator);
+        return makeToken(lexer, TOKEN_NUMBER);
     }
-    return makeToken(lexer, TOKEN_NUMBER);
+    return integerToken(lexer);
+}
+
+bool integerLiteral(Token token, uint64_t* out) {
+    int base = literalBase(token.start, token.length);
+    int i = base == 10 ? 0 : 2;
+    uint64_t value = 0;
+    uint64_t limit = (uint64_t)INT64_MAX + 1;
+    for (; i < token.length; i++) {
+        char c = token.start[i];
+        if (c == '_') continue;
+        int digit = digitValue(c);
+        if (value > (limit - (uint64_t)digit) / (uint64_t)base) return false;
+        value = value * base + digit;
+    }
+    *out = value;
+    return true;
+}
+
+double floatLiteral(Token token) {
+    char buf[128];
+    int len = 0;
+    for (int i = 0; i < token.length && len < (int)sizeof(buf) - 1; i++) {
+        if (token.start[i] != '_') buf[len++] = token.start[i];
+    }
+    buf[len] = '\0';
+    return strtod(buf, NULL);
 }
 
 // Scan string
-static Token string(Lexer* lexer) {
-    char quote = *(lexer->current - 1); // opening quote char (' or ")
+// Double-quoted strings stop at "${" with a TOKEN_INTERPOLATION piece; the
+// '}' that closes the expression resumes the string (see scanToken).
+static Token string(Lexer* lexer, char quote) {
     while (*lexer->current != quote && *lexer->current != '\0') {
-        if (*lexer->current == '\n') lexer->line++;
+        if (*lexer->current == '\n') {
+            lexer->line++;
+            lexer->lineStart = lexer->current + 1;
+        }
+        if (*lexer->current == '\\' && lexer->current[1] != '\0') {
+            if (lexer->current[1] == '\n') {
+                lexer->line++;
+                lexer->lineStart = lexer->current + 2;
+            }
+            lexer->current += 2; // Escapes never end the string: \" \${
+            continue;
+        }
+        if (quote == '"' && lexer->current[0] == '$' && lexer->current[1] == '{') {
+            if (lexer->interpolationDepth == INTERPOLATION_MAX) {
+                return errorToken(lexer, "Interpolation nested too deeply.");
+            }
+            lexer->current += 2;
+            lexer->braceDepth[lexer->interpolationDepth++] = 0;
+            return makeToken(lexer, TOKEN_INTERPOLATION);
+        }
         lexer->current++;
     }
     if (*lexer->current == '\0') return errorToken(lexer, "Unterminated string.");
@@ -152,60 +341,222 @@ static Token string(Lexer* lexer) {
     return makeToken(lexer, TOKEN_STRING);
 }
 
+// """...""" runs to the next three quotes, with no escapes and no "${".
+// Quotes just before the closing ones belong to the text: """say "hi"""".
+static Token rawString(Lexer* lexer) {
+    lexer->current += 2; // The opening quote after the first
+    while (*lexer->current != '\0') {
+        if (strncmp(lexer->current, "\"\"\"", 3) == 0) {
+            while (lexer->current[3] == '"') lexer->current++;
+            lexer->current += 3;
+            return makeToken(lexer, TOKEN_STRING);
+        }
+        if (*lexer->current == '\n') {
+            lexer->line++;
+            lexer->lineStart = lexer->current + 1;
+        }
+        lexer->current++;
+    }
+    return errorToken(lexer, "Unterminated raw string.");
+}
+
+bool isRawString(Token token) {
+    return token.length >= 6 && strncmp(token.start, "\"\"\"", 3) == 0;
+}
+
+char* rawStringText(Token token, int* length) {
+    const char* text = token.start + 3;
+    const char* end = token.start + token.length - 3;
+    if (text < end && *text == '\r') text++;
+    if (text < end && *text == '\n') text++;
+
+    // A closing """ alone on its line sets the indentation to strip
+    int indent = 0;
+    const char* last = end;
+    while (last > text && last[-1] != '\n') last--;
+    if (last > text) {
+        const char* p = last;
+        while (p < end && (*p == ' ' || *p == '\t')) p++;
+        if (p == end) {
+            indent = (int)(end - last);
+            end = last - 1; // Nor the newline before it
+            if (end > text && end[-1] == '\r') end--;
+        }
+    }
+
+    char* out = malloc(end - text + 1);
+    int n = 0;
+    bool lineStart = true;
+    for (const char* p = text; p < end; p++) {
+        if (lineStart) {
+            for (int i = 0; i < indent && p < end && (*p == ' ' || *p == '\t'); i++) p++;
+            lineStart = false;
+            if (p == end) break;
+        }
+        out[n++] = *p;
+        if (*p == '\n') lineStart = true;
+    }
+    out[n] = '\0';
+    *length = n;
+    return out;
+}
+
+// Helper to process string escapes
+static char* parseStringLiteral(const char* start, int length) {
+    char* buffer = malloc(length + 1);
+    char* dest = buffer;
+    const char* src = start;
+    const char* end = start + length;
+
+    while (src < end) {
+        if (*src == '\\' && src + 1 < end) {
+            src++;
+            switch (*src) {
+                case 'n': *dest++ = '\n'; break;
+                case 't': *dest++ = '\t'; break;
+                case 'r': *dest++ = '\r'; break;
+                case '"': *dest++ = '"'; break;
+                case '\'': *dest++ = '\''; break;
+                case '\\': *dest++ = '\\'; break;
+                case '$': *dest++ = '$'; break; // \${ is a literal "${"
+                default:
+                    *dest++ = '\\';
+                    *dest++ = *src;
+            }
+            src++;
+        } else {
+            *dest++ = *src++;
+        }
+    }
+    *dest = '\0';
+    return buffer;
+}
+
+char* stringLiteralText(Token token) {
+    if (isRawString(token)) {
+        int length;
+        return rawStringText(token, &length);
+    }
+    return parseStringLiteral(token.start + 1, token.length - 2);
+}
+
 void initLexer(Lexer* lexer, const char* source) {
     lexer->start = source;
     lexer->current = source;
     lexer->line = 1;
+    lexer->lineStart = source;
+    lexer->column = 1;
+    lexer->interpolationDepth = 0;
+    lexer->keepComments = false;
 }
 
 Token scanToken(Lexer* lexer) {
     skipWhitespace(lexer);
     lexer->start = lexer->current;
+    lexer->column = (int)(lexer->start - lexer->lineStart) + 1;
 
     if (*lexer->current == '\0') return makeToken(lexer, TOKEN_EOF);
 
     char c = *lexer->current++;
+    if (c == '/' && *lexer->current == '/' && lexer->keepComments) {
+        while (*lexer->current != '\n' && *lexer->current != '\0') lexer->current++;
+        return makeToken(lexer, TOKEN_COMMENT);
+    }
     if (isAlpha(c)) return identifier(lexer);
     if (isDigit(c)) return number(lexer);
 
     switch (c) {
         case '(': return makeToken(lexer, TOKEN_LEFT_PAREN);
         case ')': return makeToken(lexer, TOKEN_RIGHT_PAREN);
-        case '{': return makeToken(lexer, TOKEN_LEFT_BRACE);
-        case '}': return makeToken(lexer, TOKEN_RIGHT_BRACE);
+        case '{':
+            if (lexer->interpolationDepth > 0) lexer->braceDepth[lexer->interpolationDepth - 1]++;
+            return makeToken(lexer, TOKEN_LEFT_BRACE);
+        case '#':
+            if (*lexer->current != '{') break;
+            lexer->current++;
+            if (lexer->interpolationDepth > 0) lexer->braceDepth[lexer->interpolationDepth - 1]++;
+            return makeToken(lexer, TOKEN_HASH_LEFT_BRACE);
+        case '}':
+            if (lexer->interpolationDepth > 0) {
+                int* depth = &lexer->braceDepth[lexer->interpolationDepth - 1];
+                if (*depth == 0) {
+                    // End of an embedded expression: the rest is the same string
+                    lexer->interpolationDepth--;
+                    return string(lexer, '"');
+                }
+                (*depth)--;
+            }
+            return makeToken(lexer, TOKEN_RIGHT_BRACE);
         case '[': return makeToken(lexer, TOKEN_LEFT_BRACKET);
         case ']': return makeToken(lexer, TOKEN_RIGHT_BRACKET);
         case ':': return makeToken(lexer, TOKEN_COLON);
+        case '?':
+            if (*lexer->current == '?') {
+                lexer->current++;
+                if (*lexer->current == '=') {
+                    lexer->current++;
+                    return makeToken(lexer, TOKEN_QUESTION_QUESTION_EQUAL);
+                }
+                return makeToken(lexer, TOKEN_QUESTION_QUESTION);
+            }
+            if (*lexer->current == '.' && lexer->current[1] != '.') {
+                lexer->current++;
+                return makeToken(lexer, TOKEN_QUESTION_DOT);
+            }
+            return makeToken(lexer, TOKEN_QUESTION);
         case ';': return makeToken(lexer, TOKEN_SEMICOLON);
         case ',': return makeToken(lexer, TOKEN_COMMA);
-        case '.': return makeToken(lexer, TOKEN_DOT);
+        case '.':
+            if (lexer->current[0] == '.' && lexer->current[1] == '.') {
+                lexer->current += 2;
+                return makeToken(lexer, TOKEN_ELLIPSIS);
+            }
+            return makeToken(lexer, TOKEN_DOT);
         case '+': 
+            if (*lexer->current == '+') { lexer->current++; return makeToken(lexer, TOKEN_PLUS_PLUS); }
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_PLUS_EQUAL) : TOKEN_PLUS);
         case '-': 
+            if (*lexer->current == '-') { lexer->current++; return makeToken(lexer, TOKEN_MINUS_MINUS); }
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_MINUS_EQUAL) : TOKEN_MINUS);
         case '*': 
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_STAR_EQUAL) : TOKEN_STAR);
         case '/': 
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_SLASH_EQUAL) : TOKEN_SLASH);
-        case '%': return makeToken(lexer, TOKEN_PERCENT);
+        case '%': 
+            return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_PERCENT_EQUAL) : TOKEN_PERCENT);
         case '&':
             if (*lexer->current == '&') { lexer->current++; return makeToken(lexer, TOKEN_AND); }
-            else return errorToken(lexer, "Unexpected character '&'.");
+            return makeToken(lexer, TOKEN_AMPERSAND);
         case '|':
             if (*lexer->current == '|') { lexer->current++; return makeToken(lexer, TOKEN_OR); }
-            else return errorToken(lexer, "Unexpected character '|'.");
+            return makeToken(lexer, TOKEN_PIPE);
+        case '^': return makeToken(lexer, TOKEN_CARET);
+        case '~':
+            if (*lexer->current == '/') {
+                lexer->current++;
+                return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_TILDE_SLASH_EQUAL) : TOKEN_TILDE_SLASH);
+            }
+            return makeToken(lexer, TOKEN_TILDE);
         case '!':
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_BANG_EQUAL) : TOKEN_BANG); // ! or !=
         case '=':
+            if (*lexer->current == '>') {
+                lexer->current++;
+                return makeToken(lexer, TOKEN_ARROW);
+            }
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_EQUAL_EQUAL) : TOKEN_EQUAL);
         case '>':
+            if (*lexer->current == '>') { lexer->current++; return makeToken(lexer, TOKEN_GREATER_GREATER); }
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_GREATER_EQUAL) : TOKEN_GREATER);
         case '<':
+            if (*lexer->current == '<') { lexer->current++; return makeToken(lexer, TOKEN_LESS_LESS); }
             return makeToken(lexer, (*lexer->current == '=') ? (lexer->current++, TOKEN_LESS_EQUAL) : TOKEN_LESS);
         case '"':
+            if (lexer->current[0] == '"' && lexer->current[1] == '"') return rawString(lexer);
+            return string(lexer, c);
         case '\'':
-            return string(lexer);
+            return string(lexer, c);
     }
 
     return errorToken(lexer, "Unexpected character.");
-}
\ No newline at end of file
+}
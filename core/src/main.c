@@ -1,89 +1,22 @@
 #include "common.h"
 #include <unistd.h>
+#include <dirent.h>
+#include <sys/stat.h>
 #include "lexer.h"
 #include "parser.h"
+#include "formatter.h"
 #include "vm.h"
-#include "ucore_uon.h"
-#include "ucore_http.h"
-#include "ucore_timer.h"
-#include "ucore_system.h"
-#include "ucore_json.h"
-#include "ucore_string.h"
-#include "ucore_scraper.h"
-#include "ucore_tui.h"
 
 #include "bytecode/chunk.h"
 #include "bytecode/compiler.h"
 #include "bytecode/interpreter.h"
+#include "bytecode/serialize.h"
+#include "bytecode/debugger.h"
+#include "bytecode/profiler.h"
+#include "bytecode/coverage.h"
 
-const char* g_source = NULL;
-const char* g_filename = NULL;
-
-// Helper to print error line with context
-static void printErrorLine(int line, const char* highlightStart, int highlightLen) {
-    if (!g_source || line <= 0) return;
-
-    // Find the start of the line
-    const char* start = g_source;
-    int currentLine = 1;
-    while (currentLine < line && *start != '\0') {
-        if (*start == '\n') currentLine++;
-        start++;
-    }
-
-    if (*start == '\0') return; // Line not found
-
-    // Find end of line
-    const char* end = start;
-    while (*end != '\0' && *end != '\n') {
-        end++;
-    }
-
-    // Print the code frame
-    // Line number margin
-    fprintf(stderr, "\n");
-    fprintf(stderr, "   %4d | ", line);
-    
-    // Print the line content
-    fprintf(stderr, "%.*s\n", (int)(end - start), start);
-
-    // Print highlight arrow
-    if (highlightStart && highlightLen > 0) {
-        fprintf(stderr, "          "); // Match "   %4d | " length (approximately 10 chars: 3+4+3)
-        // Adjust for indentation to match the code line
-        // Calculate offset from line start
-        int offset = (int)(highlightStart - start);
-        if (offset >= 0 && offset < (end - start)) {
-            for (int i = 0; i < offset; i++) {
-                if (start[i] == '\t') fprintf(stderr, "\t");
-                else fprintf(stderr, " ");
-            }
-            // Print caret(s)
-            for (int i = 0; i < highlightLen; i++) fprintf(stderr, "^");
-            fprintf(stderr, "\n");
-        }
-    }
-    fprintf(stderr, "\n");
-}
-
-// Generic error
-void error(const char* message, int line) {
-    fprintf(stderr, "Error in %s at line %d:\n", g_filename ? g_filename : "<unknown>", line);
-    fprintf(stderr, "  %s\n", message);
-    printErrorLine(line, NULL, 0);
-    exit(1);
-}
-
-// Error at specific token
-void errorAtToken(Token token, const char* message) {
-    fprintf(stderr, "Error in %s at line %d:\n", g_filename ? g_filename : "<unknown>", token.line);
-    fprintf(stderr, "  %s\n", message);
-    printErrorLine(token.line, token.start, token.length);
-    exit(1);
-}
-
-// Read file
-static char* readFile(const char* path) {
+// Read file (binary safe; size returned through outSize when non-NULL)
+static char* readFile(const char* path, size_t* outSize) {
     FILE* file = fopen(path, "rb");
     if (!file) {
         fprintf(stderr, "Could not open file \"%s\".\n", path);
@@ -110,149 +43,559 @@ static char* readFile(const char* path) {
 
     buffer[bytesRead] = '\0';
     fclose(file);
+    if (outSize) *outSize = bytesRead;
     return buffer;
 }
 
-// Initialize parser
-void initParser(Parser* parser) {
-    parser->tokens = malloc(64 * sizeof(Token));  // Start with 64 tokens
-    if (!parser->tokens) {
-        error("Memory allocation failed.", 0);
+// Set by --coverage. The report is written when the run ends, also when
+// exit() or an uncaught error ends it from inside the VM.
+static Coverage* g_coverage = NULL;
+
+static void reportCoverage(void) {
+    if (!g_coverage) return;
+    fflush(stdout);
+    printCoverage(g_coverage, stderr);
+    freeCoverage(g_coverage);
+    g_coverage = NULL;
+}
+
+static void startCoverage(void) {
+    g_coverage = newCoverage();
+    atexit(reportCoverage);
+}
+
+static void printUsage(const char* prog) {
+    fprintf(stderr, "Usage: %s                                 start the REPL\n", prog);
+    fprintf(stderr, "       %s [--stats] [--trace] [--profile] [--coverage] [--no-optimize] [--no-cache] [--unbuffered] [--hash-seed <n>] [limits] <file.unna | file.unc> [args...]\n", prog);
+    fprintf(stderr, "       %s --ast-interp [--unbuffered] <file.unna> [args...]   run on the tree walker\n", prog);
+    fprintf(stderr, "       %s compile [--no-optimize] <file.unna> [-o <file.unc>]\n", prog);
+    fprintf(stderr, "       %s disasm [--no-optimize] <file.unna | file.unc>\n", prog);
+    fprintf(stderr, "       %s debug <file.unna | file.unc>\n", prog);
+    fprintf(stderr, "       %s test [--coverage] <dir>\n", prog);
+    fprintf(stderr, "       %s fmt [-w] <file.unna>...\n", prog);
+    fprintf(stderr, "       %s -v | --version\n", prog);
+    fprintf(stderr, "Limits: --max-stack <frames>  --max-heap <bytes, K/M/G suffix>  --timeout <ms>\n");
+    fprintf(stderr, "        --watchdog=<seconds>s  report and stop a script that is quiet that long\n");
+    fprintf(stderr, "Hashing: --hash-seed <n>  fix the string hash seed, otherwise random per run (also UNNARIZE_HASH_SEED)\n");
+}
+
+// A whole positive number with an optional K, M or G suffix (powers of
+// 1024 when 'sizeSuffix'), e.g. 64M; false for anything else
+static bool parseLimit(const char* text, bool sizeSuffix, uint64_t* out) {
+    char* end;
+    if (!text || !isdigit((unsigned char)text[0])) return false;
+    unsigned long long n = strtoull(text, &end, 10);
+    if (sizeSuffix && *end) {
+        switch (*end++) {
+            case 'K': case 'k': n <<= 10; break;
+            case 'M': case 'm': n <<= 20; break;
+            case 'G': case 'g': n <<= 30; break;
+            default: return false;
+        }
     }
-    parser->current = 0;
-    parser->count = 0;
-    parser->capacity = 64;
+    if (*end || n == 0) return false;
+    *out = n;
+    return true;
 }
 
-// Free parser resources
-void freeParser(Parser* parser) {
-    if (parser->tokens) {
-        free(parser->tokens);
-        parser->tokens = NULL;
+// Default output for 'compile': same path with the extension replaced by .unc
+static char* defaultBytecodePath(const char* src) {
+    const char* dot = strrchr(src, '.');
+    const char* slash = strrchr(src, '/');
+    size_t stem = (dot && (!slash || dot > slash)) ? (size_t)(dot - src) : strlen(src);
+    char* out = malloc(stem + 5);
+    memcpy(out, src, stem);
+    memcpy(out + stem, ".unc", 5);
+    return out;
+}
+
+// Tokenize and parse a whole script into 'parser' (not yet initialized)
+static Node* parseScript(Parser* parser, const char* source) {
+    Lexer lexer;
+    initLexer(&lexer, source);
+    initParser(parser);
+    while (true) {
+        Token token = scanToken(&lexer);
+        addToken(parser, token);
+        if (token.type == TOKEN_EOF) break;
     }
+    return parse(parser);
 }
 
-// Add token to parser (grows array as needed)
-void addToken(Parser* parser, Token token) {
-    // Grow array if needed
-    if (parser->count >= parser->capacity) {
-        parser->capacity *= 2;
-        parser->tokens = realloc(parser->tokens, parser->capacity * sizeof(Token));
-        if (!parser->tokens) {
-            error("Memory allocation failed.", token.line);
+// Initialize the VM and register every built-in library. argv holds the
+// script's path and the arguments after it (none for the REPL and tests).
+static void setupVM(VM* vm, int argc, char** argv, const char* filename) {
+    initVM(vm);
+    vm->argc = argc;
+    vm->argv = argv;
+
+    // Set script directory for relative paths
+    setScriptDir(vm, filename);
+
+    char* projectRoot = getenv("UNNARIZE_ROOT");
+    if (projectRoot) {
+        strncpy(vm->projectRoot, projectRoot, 1023);
+    } else {
+        if (getcwd(vm->projectRoot, 1024) == NULL) {
+            fprintf(stderr, "Check for getcwd failed.");
         }
     }
-    
-    parser->tokens[parser->count++] = token;
+
+    registerLibraries(vm);
 }
 
-// Free AST
-static void freeAST(Node* node) {
-    if (!node) return;
-    switch (node->type) {
-        case NODE_EXPR_LITERAL:
-            if (node->literal.token.type == TOKEN_STRING) {
-                // No need to free token.start, it's from source
+// ===== REPL =====
+
+// One evaluated entry. Functions defined at the prompt keep pointing into
+// its source and AST, so entries live until the session ends.
+typedef struct ReplEntry {
+    char* source;
+    Parser parser;
+    Node* ast;
+    struct ReplEntry* next;
+} ReplEntry;
+
+// Net count of open (, [ and { outside strings and comments; an open
+// """ string counts as one more
+static int bracketDepth(const char* src) {
+    int depth = 0;
+    for (const char* p = src; *p; p++) {
+        if (*p == '/' && p[1] == '/') {
+            while (*p && *p != '\n') p++;
+            if (!*p) break;
+        } else if (strncmp(p, "\"\"\"", 3) == 0) {
+            const char* close = strstr(p + 3, "\"\"\"");
+            if (!close) return depth + 1;
+            while (close[3] == '"') close++;
+            p = close + 2;
+        } else if (*p == '"' || *p == '\'') {
+            char quote = *p++;
+            while (*p && *p != quote) {
+                if (*p == '\\' && p[1]) p++;
+                p++;
             }
-            break;
-        case NODE_EXPR_BINARY:
-            freeAST(node->binary.left);
-            freeAST(node->binary.right);
-            break;
-        case NODE_EXPR_UNARY:
-            freeAST(node->unary.expr);
-            break;
-        case NODE_EXPR_AWAIT:
-            // await <expr> -> free inner expression
-            freeAST(node->unary.expr);
-            break;
-        case NODE_EXPR_VAR:
-            break;
-        case NODE_EXPR_GET:
-            // object.property -> free object
-            freeAST(node->get.object);
-            break;
-        case NODE_EXPR_INDEX:
-            // target[index] -> free both
-            freeAST(node->index.target);
-            freeAST(node->index.index);
-            break;
-        case NODE_EXPR_CALL:
-            freeAST(node->call.arguments);
-            break;
-        case NODE_STMT_VAR_DECL:
-            freeAST(node->varDecl.initializer);
-            break;
-        case NODE_STMT_ASSIGN:
-            freeAST(node->assign.value);
-            break;
-        case NODE_STMT_INDEX_ASSIGN:
-            // target[index] = value
-            freeAST(node->indexAssign.target);
-            freeAST(node->indexAssign.index);
-            freeAST(node->indexAssign.value);
-            break;
-        case NODE_STMT_PRINT:
-            freeAST(node->print.expr);
-            break;
-        case NODE_STMT_IF:
-            freeAST(node->ifStmt.condition);
-            freeAST(node->ifStmt.thenBranch);
-            freeAST(node->ifStmt.elseBranch);
-            break;
-        case NODE_STMT_WHILE:
-            freeAST(node->whileStmt.condition);
-            freeAST(node->whileStmt.body);
-            break;
-        case NODE_STMT_FOR:
-            freeAST(node->forStmt.initializer);
-            freeAST(node->forStmt.condition);
-            freeAST(node->forStmt.increment);
-            freeAST(node->forStmt.body);
-            break;
-        case NODE_STMT_FOREACH:
-            freeAST(node->foreachStmt.collection);
-            freeAST(node->foreachStmt.body);
-            break;
-        case NODE_STMT_STRUCT_DECL:
-            if (node->structDecl.fields) {
-                free(node->structDecl.fields);
+            if (!*p) break;
+        } else if (*p == '(' || *p == '[' || *p == '{') {
+            depth++;
+        } else if (*p == ')' || *p == ']' || *p == '}') {
+            depth--;
+        }
+    }
+    return depth;
+}
+
+// Read one line from stdin, appending to *buf. Returns false on EOF.
+static bool readLine(char** buf, size_t* len, size_t* cap) {
+    char chunk[1024];
+    bool gotAny = false;
+    while (fgets(chunk, sizeof(chunk), stdin)) {
+        gotAny = true;
+        size_t n = strlen(chunk);
+        if (*len + n + 2 > *cap) {
+            *cap = (*len + n + 2) * 2;
+            *buf = realloc(*buf, *cap);
+        }
+        memcpy(*buf + *len, chunk, n + 1);
+        *len += n;
+        if (n > 0 && chunk[n - 1] == '\n') break;
+    }
+    return gotAny;
+}
+
+// Parse and run one entry, printing the value of a trailing expression
+static void evalReplEntry(VM* vm, ReplEntry* entry) {
+    g_source = entry->source;
+
+    // Errors unwind back here; the session (and its globals) survive
+    int savedCallStackTop = vm->callStackTop;
+    int savedStackTop = vm->stackTop;
+    int savedFp = vm->fp;
+    Environment* savedEnv = vm->env;
+    Environment* savedGlobalEnv = vm->globalEnv;
+
+    jmp_buf recover;
+    g_errorJump = &recover;
+    if (setjmp(recover) == 0) {
+        Lexer lexer;
+        initLexer(&lexer, entry->source);
+        while (true) {
+            Token token = scanToken(&lexer);
+            addToken(&entry->parser, token);
+            if (token.type == TOKEN_EOF) break;
+        }
+        entry->ast = parse(&entry->parser);
+
+        Value result;
+        if (interpretLine(vm, entry->ast, &result) && !IS_NIL(result)) {
+            printLine(vm, result);
+            if (vm->throwPending) {
+                // Thrown by the result's __str__
+                char msg[512];
+                describeThrown(vm, vm->thrownValue, msg, sizeof(msg));
+                error(msg, entry->ast->block.statements[entry->ast->block.count - 1]->line);
             }
+        }
+    } else {
+        vm->callStackTop = savedCallStackTop;
+        vm->stackTop = savedStackTop;
+        vm->fp = savedFp;
+        vm->loopSignal = LOOP_SIGNAL_NONE;
+        vm->tryHandlerCount = 0;
+        vm->thrownValue = NIL_VAL;
+        vm->throwPending = false;
+        vm->panicking = false;
+        vm->env = savedEnv;
+        vm->globalEnv = savedGlobalEnv;
+    }
+    g_errorJump = NULL;
+}
+
+static int runRepl(VM* vm) {
+    printf("unnarize %s REPL. Type .exit or press Ctrl-D to quit.\n", UNNARIZE_VERSION);
+    g_filename = "<repl>";
+
+    ReplEntry* entries = NULL;
+    char* buf = NULL;
+    size_t cap = 0;
+
+    while (true) {
+        size_t len = 0;
+        if (buf) buf[0] = '\0';
+
+        // Keep reading while brackets are unbalanced
+        printf("> ");
+        fflush(stdout);
+        bool more = readLine(&buf, &len, &cap);
+        while (more && bracketDepth(buf) > 0) {
+            printf("... ");
+            fflush(stdout);
+            more = readLine(&buf, &len, &cap);
+        }
+        if (!more && len == 0) {
+            printf("\n");
             break;
-        case NODE_STMT_PROP_ASSIGN:
-            freeAST(node->propAssign.object);
-            freeAST(node->propAssign.value);
+        }
+
+        // Trim surrounding whitespace
+        char* start = buf;
+        while (isspace((unsigned char)*start)) start++;
+        char* end = start + strlen(start);
+        while (end > start && isspace((unsigned char)end[-1])) end--;
+        *end = '\0';
+        if (*start == '\0') {
+            if (!more) break;
+            continue;
+        }
+        if (strcmp(start, ".exit") == 0) break;
+
+        size_t n = (size_t)(end - start);
+        ReplEntry* entry = malloc(sizeof(ReplEntry));
+        entry->source = malloc(n + 1);
+        memcpy(entry->source, start, n);
+        entry->source[n] = '\0';
+        entry->ast = NULL;
+        initParser(&entry->parser);
+        // A statement needs no trailing semicolon at the prompt
+        entry->parser.implicitSemicolon = true;
+        entry->next = entries;
+        entries = entry;
+        evalReplEntry(vm, entry);
+        flushOutput(vm);
+
+        if (!more) {
+            printf("\n");
             break;
-        case NODE_STMT_BLOCK:
-            for (int i = 0; i < node->block.count; i++) {
-                freeAST(node->block.statements[i]);
+        }
+    }
+
+    free(buf);
+    freeVM(vm);
+    while (entries) {
+        ReplEntry* next = entries->next;
+        freeAST(entries->ast);
+        freeParser(&entries->parser);
+        free(entries->source);
+        free(entries);
+        entries = next;
+    }
+    return 0;
+}
+
+// ===== Test Runner =====
+
+typedef struct {
+    char** items;
+    int count;
+    int capacity;
+} PathList;
+
+static int comparePaths(const void* a, const void* b) {
+    return strcmp(*(char* const*)a, *(char* const*)b);
+}
+
+static bool isTestFile(const char* name) {
+    size_t n = strlen(name);
+    return n > 10 && strcmp(name + n - 10, "_test.unna") == 0;
+}
+
+// Collect every *_test.unna under dir, descending into subdirectories
+static void findTestFiles(const char* dir, PathList* out) {
+    DIR* d = opendir(dir);
+    if (!d) return;
+    struct dirent* ent;
+    while ((ent = readdir(d)) != NULL) {
+        if (ent->d_name[0] == '.') continue;
+        size_t len = strlen(dir) + strlen(ent->d_name) + 2;
+        char* path = malloc(len);
+        snprintf(path, len, "%s/%s", dir, ent->d_name);
+
+        struct stat st;
+        if (stat(path, &st) == 0 && S_ISDIR(st.st_mode)) {
+            findTestFiles(path, out);
+            free(path);
+        } else if (isTestFile(ent->d_name)) {
+            if (out->count == out->capacity) {
+                out->capacity = out->capacity ? out->capacity * 2 : 8;
+                out->items = realloc(out->items, sizeof(char*) * out->capacity);
             }
-            free(node->block.statements);
-            break;
-        case NODE_STMT_FUNCTION:
-            freeAST(node->function.body);
-            free(node->function.params);
-            break;
-        case NODE_STMT_RETURN:
-            freeAST(node->returnStmt.value);
-            break;
-        case NODE_STMT_IMPORT:
-            // tokens only; nothing to free
-            break;
+            out->items[out->count++] = path;
+        } else {
+            free(path);
+        }
+    }
+    closedir(d);
+}
 
-        case NODE_EXPR_ARRAY_LITERAL:
-            // Free elements linked list
-            {
-                Node* current = node->arrayLiteral.elements;
-                while (current) {
-                    Node* next = current->next;
-                    freeAST(current);
-                    current = next; // current->next pointer logic is slightly weird here as freeAST frees the node itself.
+static int compareTestLines(const void* a, const void* b) {
+    return (*(Function* const*)a)->name.line - (*(Function* const*)b)->name.line;
+}
+
+// Print why a test or file failed; assertion messages already name their line
+static void printFailure(VM* vm, Value thrown, bool fromAssert) {
+    char msg[512];
+    describeThrown(vm, thrown, msg, sizeof(msg));
+    TraceEntry* top = vm->errorTraceCount > 0 ? &vm->errorTrace[0] : NULL;
+    if (!fromAssert && top && top->function && top->function->modulePath && top->line > 0) {
+        printf("      %s (%s:%d)\n", msg, top->function->modulePath, top->line);
+    } else {
+        printf("      %s\n", msg);
+    }
+    vm->errorTraceCount = 0;
+    vm->panicking = false;
+}
+
+typedef struct {
+    int passed;
+    int failed;
+    int assertsPassed;
+    int assertsFailed;
+} TestTotals;
+
+// Run one file's top level, then each global function named test* in
+// source order. Returns false when the file itself could not run.
+static bool runTestFile(VM* vm, const char* path, TestTotals* totals) {
+    size_t sourceSize = 0;
+    char* source = readFile(path, &sourceSize);
+    g_filename = path;
+    g_source = source;
+
+    setupVM(vm, 0, NULL, path);
+    vm->coverage = g_coverage;
+    Parser parser;
+    initParser(&parser);
+    Node* ast = NULL;
+    bool ok = false;
+
+    // Syntax errors are reported and end just this file
+    jmp_buf recover;
+    g_errorJump = &recover;
+    if (setjmp(recover) == 0) {
+        Lexer lexer;
+        initLexer(&lexer, source);
+        while (true) {
+            Token token = scanToken(&lexer);
+            addToken(&parser, token);
+            if (token.type == TOKEN_EOF) break;
+        }
+        ast = parse(&parser);
+
+        BytecodeChunk* chunk = malloc(sizeof(BytecodeChunk));
+        initChunk(chunk);
+        Function* script = newBytecodeScript(vm, chunk, path);
+        vm->stack[vm->stackTop++] = OBJ_VAL(script);
+
+        char* scriptPath = resolveImportPath(vm, NULL, path);
+        if (scriptPath) {
+            vm->importing = findModuleEntry(vm, scriptPath, true);
+            vm->importing->loading = true;
+            free(scriptPath);
+        }
+
+        Value thrown;
+        if (!compileToBytecode(vm, ast, chunk, path)) {
+            printf("  ERROR %s: compilation failed\n", path);
+        } else if (!callProtected(vm, script, NULL, 0, NULL, &thrown)) {
+            flushOutput(vm);
+            printf("  ERROR %s: top level threw\n", path);
+            printFailure(vm, thrown, false);
+        } else {
+            ok = true;
+        }
+    } else {
+        printf("  ERROR %s: syntax error\n", path);
+    }
+    g_errorJump = NULL;
+
+    if (ok) {
+        // Global test functions, in the order they were written
+        int count = 0;
+        int capacity = 16;
+        Function** tests = malloc(sizeof(Function*) * capacity);
+        for (int i = 0; i < TABLE_SIZE; i++) {
+            for (VarEntry* e = vm->globalEnv->buckets[i]; e; e = e->next) {
+                if (!IS_OBJ(e->value) || AS_OBJ(e->value)->type != OBJ_FUNCTION) continue;
+                Function* fn = (Function*)AS_OBJ(e->value);
+                if (fn->isNative || fn->requiredCount > 0) continue;
+                if (e->keyLength < 4 || strncmp(e->key, "test", 4) != 0) continue;
+                if (count == capacity) {
+                    capacity *= 2;
+                    tests = realloc(tests, sizeof(Function*) * capacity);
                 }
+                tests[count++] = fn;
             }
-            break;
+        }
+        qsort(tests, count, sizeof(Function*), compareTestLines);
+
+        for (int i = 0; i < count; i++) {
+            Function* fn = tests[i];
+            int failedBefore = vm->assertsFailed;
+            Value thrown = NIL_VAL;
+            bool passed = callProtected(vm, fn, NULL, 0, NULL, &thrown) && vm->assertsFailed == failedBefore;
+            flushOutput(vm); // What the test printed goes before its result
+            printf("  %s %.*s\n", passed ? "PASS" : "FAIL", fn->name.length, fn->name.start);
+            if (passed) {
+                totals->passed++;
+            } else {
+                totals->failed++;
+                if (!IS_NIL(thrown)) printFailure(vm, thrown, vm->assertsFailed > failedBefore);
+            }
+            fflush(stdout);
+        }
+        free(tests);
+    }
+
+    totals->assertsPassed += vm->assertsPassed;
+    totals->assertsFailed += vm->assertsFailed;
+    if (vm->coverage) forgetCoverageChunks(vm->coverage);
+    freeVM(vm);
+    freeAST(ast);
+    freeParser(&parser);
+    free(source);
+    return ok;
+}
+
+// 'unnarize test <dir>': exit status is 1 if any test or file failed
+static int runTests(const char* dir) {
+    PathList files = { NULL, 0, 0 };
+    findTestFiles(dir, &files);
+    if (files.count == 0) {
+        fprintf(stderr, "Error: no *_test.unna files found in \"%s\"\n", dir);
+        return 1;
+    }
+    qsort(files.items, files.count, sizeof(char*), comparePaths);
+
+    static VM vm;
+    TestTotals totals = { 0, 0, 0, 0 };
+    int fileErrors = 0;
+    for (int i = 0; i < files.count; i++) {
+        printf("%s\n", files.items[i]);
+        fflush(stdout);
+        if (!runTestFile(&vm, files.items[i], &totals)) fileErrors++;
+        free(files.items[i]);
     }
-    free(node);
+    free(files.items);
+
+    printf("\nTests: %d passed, %d failed (%d total)\n",
+           totals.passed, totals.failed, totals.passed + totals.failed);
+    printf("Asserts: %d passed, %d failed\n", totals.assertsPassed, totals.assertsFailed);
+    if (fileErrors > 0) printf("Files with errors: %d\n", fileErrors);
+    reportCoverage();
+    return (totals.failed > 0 || fileErrors > 0) ? 1 : 0;
+}
+
+// ===== FORMATTER =====
+
+// Print one file formatted, or with 'write' rewrite it in place
+static void formatFile(const char* path, bool write) {
+    size_t sourceSize = 0;
+    char* source = readFile(path, &sourceSize);
+    if (isBytecodeImage(source, sourceSize)) {
+        fprintf(stderr, "Error: \"%s\" is compiled bytecode\n", path);
+        exit(1);
+    }
+    g_filename = path;
+    g_source = source;
+
+    // Comments don't reach the parser; the formatter places them
+    Lexer lexer;
+    initLexer(&lexer, source);
+    lexer.keepComments = true;
+    Parser parser;
+    initParser(&parser);
+    Token* comments = NULL;
+    int commentCount = 0;
+    int commentCapacity = 0;
+    while (true) {
+        Token token = scanToken(&lexer);
+        if (token.type == TOKEN_COMMENT) {
+            if (commentCount == commentCapacity) {
+                commentCapacity = commentCapacity < 16 ? 16 : commentCapacity * 2;
+                comments = realloc(comments, sizeof(Token) * commentCapacity);
+            }
+            comments[commentCount++] = token;
+            continue;
+        }
+        addToken(&parser, token);
+        if (token.type == TOKEN_EOF) break;
+    }
+    Node* ast = parse(&parser);
+    char* formatted = formatSource(ast, source, comments, commentCount);
+
+    if (!write) {
+        fputs(formatted, stdout);
+    } else if (strcmp(formatted, source) != 0) {
+        FILE* out = fopen(path, "wb");
+        if (!out || fputs(formatted, out) == EOF || fclose(out) != 0) {
+            fprintf(stderr, "Could not write file \"%s\".\n", path);
+            exit(1);
+        }
+    }
+
+    free(formatted);
+    free(comments);
+    freeAST(ast);
+    freeParser(&parser);
+    free(source);
+    g_source = NULL;
+}
+
+// 'unnarize fmt [-w] <file>...': syntax errors are reported and exit 1
+static int runFormat(int argc, char** argv) {
+    bool write = false;
+    int fileCount = 0;
+    for (int i = 2; i < argc; i++) {
+        if (strcmp(argv[i], "-w") == 0) write = true;
+        else fileCount++;
+    }
+    if (fileCount == 0) {
+        fprintf(stderr, "Error: No input file specified\n");
+        printUsage(argv[0]);
+        return 1;
+    }
+    for (int i = 2; i < argc; i++) {
+        if (strcmp(argv[i], "-w") != 0) formatFile(argv[i], write);
+    }
+    return 0;
 }
 
 int main(int argc, char** argv) {
@@ -262,119 +605,303 @@ int main(int argc, char** argv) {
         return 0;
     }
 
+    // No arguments: interactive session
     if (argc < 2) {
-        fprintf(stderr, "Usage: %s [--opt] <file.unna>\n", argv[0]);
-        fprintf(stderr, "       %s -v | --version\n", argv[0]);
-        return 1;
+        static VM vm;
+        setupVM(&vm, 0, NULL, NULL);
+        return runRepl(&vm);
     }
     
-    
-    // Parse arguments (keeping for future flags if needed)
+    // 'test' subcommand: run every *_test.unna under a directory
+    if (strcmp(argv[1], "test") == 0) {
+        int dirArg = 2;
+        if (argc > 2 && strcmp(argv[2], "--coverage") == 0) dirArg = 3;
+        if (argc <= dirArg) {
+            fprintf(stderr, "Error: No test directory specified\n");
+            printUsage(argv[0]);
+            return 1;
+        }
+        if (dirArg == 3) startCoverage();
+        return runTests(argv[dirArg]);
+    }
+
+    // 'fmt' subcommand: print canonical source, or rewrite files with -w
+    if (strcmp(argv[1], "fmt") == 0) {
+        return runFormat(argc, argv);
+    }
+
+    // 'compile' subcommand: write bytecode instead of running
+    // 'disasm' subcommand: print the bytecode instead of running
+    // 'debug' subcommand: run under the debugger, reading commands from stdin
+    bool compileOnly = false;
+    bool disasmOnly = false;
+    bool debugMode = false;
+    bool showStats = false;
+    bool traceExecution = false;
+    bool profile = false;
+    bool coverage = false;
+    bool optimize = true;
+    bool unbuffered = false;
+    bool astInterp = false;
+    bool noCache = false;
+    uint64_t maxStack = 0, maxHeap = 0, timeoutMs = 0, watchdogSec = 0;
+    const char* outPath = NULL;
+    int firstArg = 1;
+    if (strcmp(argv[1], "compile") == 0) {
+        compileOnly = true;
+        firstArg = 2;
+    } else if (strcmp(argv[1], "disasm") == 0) {
+        disasmOnly = true;
+        firstArg = 2;
+    } else if (strcmp(argv[1], "debug") == 0) {
+        debugMode = true;
+        firstArg = 2;
+    }
+
     char* filename = NULL;
+    int scriptArg = 0; // Index of filename in argv
     
-    for (int i = 1; i < argc; i++) {
-        if (filename == NULL) {
+    for (int i = firstArg; i < argc; i++) {
+        if (compileOnly && strcmp(argv[i], "-o") == 0) {
+            if (i + 1 >= argc) {
+                fprintf(stderr, "Error: -o requires an output path\n");
+                return 1;
+            }
+            outPath = argv[++i];
+        } else if (filename == NULL && strcmp(argv[i], "--stats") == 0) {
+            // Only before the file: later arguments belong to the script
+            showStats = true;
+        } else if (filename == NULL && strcmp(argv[i], "--trace") == 0) {
+            traceExecution = true;
+        } else if (filename == NULL && strcmp(argv[i], "--profile") == 0) {
+            profile = true;
+        } else if (filename == NULL && strcmp(argv[i], "--coverage") == 0) {
+            coverage = true;
+        } else if (filename == NULL && strcmp(argv[i], "--no-optimize") == 0) {
+            optimize = false;
+        } else if (filename == NULL && strcmp(argv[i], "--unbuffered") == 0) {
+            unbuffered = true;
+        } else if (filename == NULL && strcmp(argv[i], "--ast-interp") == 0) {
+            astInterp = true;
+        } else if (filename == NULL && strcmp(argv[i], "--no-cache") == 0) {
+            noCache = true;
+        } else if (filename == NULL && strncmp(argv[i], "--watchdog=", 11) == 0) {
+            // --watchdog=5s; the unit may be left out
+            char seconds[32];
+            snprintf(seconds, sizeof(seconds), "%s", argv[i] + 11);
+            size_t n = strlen(seconds);
+            if (n > 0 && seconds[n - 1] == 's') seconds[n - 1] = '\0';
+            if (!parseLimit(seconds, false, &watchdogSec) || watchdogSec > 86400) {
+                fprintf(stderr, "Error: --watchdog requires a number of seconds up to 86400, such as --watchdog=5s\n");
+                return 1;
+            }
+        } else if (filename == NULL && strcmp(argv[i], "--hash-seed") == 0) {
+            // Fixed before the VM starts, so a run's map order can be repeated
+            const char* text = i + 1 < argc ? argv[i + 1] : NULL;
+            char* end = NULL;
+            unsigned long long seed = text && isdigit((unsigned char)text[0]) ? strtoull(text, &end, 10) : 0;
+            if (!end || *end || seed > UINT32_MAX) {
+                fprintf(stderr, "Error: --hash-seed requires a number from 0 to 4294967295\n");
+                return 1;
+            }
+            setHashSeed((uint32_t)seed);
+            i++;
+        } else if (filename == NULL && (strcmp(argv[i], "--max-stack") == 0 ||
+                                        strcmp(argv[i], "--max-heap") == 0 ||
+                                        strcmp(argv[i], "--timeout") == 0)) {
+            const char* flag = argv[i];
+            bool isHeap = strcmp(flag, "--max-heap") == 0;
+            uint64_t* limit = isHeap ? &maxHeap : strcmp(flag, "--timeout") == 0 ? &timeoutMs : &maxStack;
+            if (!parseLimit(i + 1 < argc ? argv[i + 1] : NULL, isHeap, limit) ||
+                (limit == &maxStack && maxStack > MAX_FRAMES_LIMIT)) {
+                fprintf(stderr, "Error: %s requires a positive %s\n", flag,
+                        isHeap ? "size such as 64M" : limit == &maxStack ? "frame count up to 1000000" : "number of milliseconds");
+                return 1;
+            }
+            i++;
+        } else if (filename == NULL) {
             filename = argv[i];
+            scriptArg = i;
         }
     }
     
     if (!filename) {
         fprintf(stderr, "Error: No input file specified\n");
+        printUsage(argv[0]);
         return 1;
     }
 
     g_filename = filename;
-    char* source = readFile(filename);
-    g_source = source;
+    size_t sourceSize = 0;
+    char* source = readFile(filename, &sourceSize);
+    bool isBytecode = isBytecodeImage(source, sourceSize);
 
-    // Lexer
-    Lexer lexer;
-    initLexer(&lexer, source);
+    if (astInterp && (isBytecode || compileOnly || disasmOnly || debugMode)) {
+        fprintf(stderr, isBytecode ? "Error: --ast-interp needs source, not compiled bytecode\n"
+                                   : "Error: --ast-interp only runs a script\n");
+        return 1;
+    }
 
-    // Initialize parser with dynamic array
-    Parser parser;
-    initParser(&parser);
-    
-    // Tokenize - no more token limit!
-    while (true) {
-        Token token = scanToken(&lexer);
-        addToken(&parser, token);
-        if (token.type == TOKEN_EOF) break;
+    if (compileOnly && isBytecode) {
+        fprintf(stderr, "Error: \"%s\" is already compiled bytecode\n", filename);
+        return 1;
     }
 
-    printf("Tokenized %d tokens successfully.\n", parser.count);
+    // A script run from source loads from the bytecode cache when the
+    // cached copy is current, skipping the front end
+    char cachePath[4096];
+    char* cachedImage = NULL;
+    size_t cachedSize = 0;
+    bool useCache = !isBytecode && !noCache && !compileOnly && !disasmOnly && !debugMode && !astInterp &&
+                    bytecodeCachePath(filename, cachePath, sizeof(cachePath));
+    if (useCache) cachedImage = readBytecodeCache(cachePath, source, sourceSize, optimize, &cachedSize);
 
-    // Parse
-    Node* ast = parse(&parser);
+    Parser parser;
+    parser.tokens = NULL;
+    Node* ast = NULL;
+
+    if (!isBytecode) g_source = source;
+    if (!isBytecode && !cachedImage) ast = parseScript(&parser, source);
 
     // VM
     static VM vm;  // Static: too large for stack (~576KB)
-    initVM(&vm);
-    vm.argc = argc;
-    vm.argv = argv;
-
-    // Set script directory for relative paths
-    setScriptDir(&vm, filename);
-
-    char* projectRoot = getenv("UNNARIZE_ROOT");
-    if (projectRoot) {
-        strncpy(vm.projectRoot, projectRoot, 1023);
-    } else {
-        if (getcwd(vm.projectRoot, 1024) == NULL) {
-            fprintf(stderr, "Check for getcwd failed.");
-        }
-    }
-
-    registerUCoreUON(&vm); // Register built-in core libraries
-    registerUCoreHttp(&vm);
-    registerUCoreTimer(&vm); // Register Timer
-    registerUCoreJson(&vm);  // Register Json
-    registerUCoreScraper(&vm); // Register Scraper
-    registerUCoreString(&vm);  // Register String Utils
-    registerUCoreTui(&vm);      // Register TUI
-
-    registerUCoreSystem(&vm); // Register System
-    registerBuiltins(&vm);    // Register built-in natives (has, keys)
-    
+    // The script sees its path and the arguments after it
+    setupVM(&vm, argc - scriptArg, argv + scriptArg, filename);
+    // The debugger steps and breaks on the code exactly as written
+    vm.optimizeBytecode = optimize && !debugMode;
+    if (maxStack > 0) setMaxFrames(&vm, (int)maxStack);
+    vm.maxHeap = (size_t)maxHeap;
+    vm.timeoutMs = (int64_t)timeoutMs;
+    vm.watchdogMs = (int64_t)watchdogSec * 1000;
+    // Each print goes out on its own, as on a terminal
+    if (unbuffered) vm.output.flushEachLine = true;
 
-    
     // VM Execution
     BytecodeChunk* chunk = malloc(sizeof(BytecodeChunk));
     initChunk(chunk);
     
     // Allocate script function to root constants during compilation
-    Function* script = (Function*)ALLOCATE_OBJ(&vm, Function, OBJ_FUNCTION);
-    script->paramCount = 0;
-    script->name.start = "<script>";
-    script->name.length = 8;
-    script->name.line = 0;
-    script->body = NULL;
-    script->closure = NULL;
-    script->isNative = false;
-    script->bytecodeChunk = chunk;
-    script->modulePath = g_filename ? strdup(g_filename) : NULL;
+    Function* script = newBytecodeScript(&vm, chunk, g_filename);
     
     // Root script on stack
     vm.stack[vm.stackTop++] = OBJ_VAL(script);
     
-    if (compileToBytecode(&vm, ast, chunk, g_filename)) {
+    bool ready;
+    if (isBytecode) {
+        ready = loadBytecode(&vm, source, sourceSize, chunk, g_filename);
+    } else if (cachedImage) {
+        // Quietly: a cache file the loader turns away is compiled from the
+        // source instead, and written again below
+        char* loadErrors = NULL;
+        size_t loadErrorsSize = 0;
+        FILE* errorOut = open_memstream(&loadErrors, &loadErrorsSize);
+        FILE* savedErrorOut = vm.errorOut;
+        if (errorOut) vm.errorOut = errorOut;
+        ready = loadBytecode(&vm, cachedImage, cachedSize, chunk, g_filename);
+        vm.errorOut = savedErrorOut;
+        if (errorOut) fclose(errorOut);
+        free(loadErrors);
+        if (!ready) {
+            free(cachedImage);
+            cachedImage = NULL;
+            freeChunk(chunk);
+            ast = parseScript(&parser, source);
+            ready = compileToBytecode(&vm, ast, chunk, g_filename);
+        }
+    } else {
+        ready = compileToBytecode(&vm, ast, chunk, g_filename);
+    }
+
+    if (!ready) {
+        fprintf(stderr, isBytecode ? "Bytecode loading failed.\n" : "Bytecode compilation failed.\n");
+        exit(1);
+    }
+
+    // Cached before it runs, while the chunk is as compiled
+    const char* cacheState = NULL;
+    if (useCache) {
+        cacheState = cachedImage ? "hit"
+            : writeBytecodeCache(chunk, cachePath, source, sourceSize, optimize) ? "written" : "not written";
+    }
+
+    if (disasmOnly) {
+        disassembleChunk(chunk, "script");
+    } else if (compileOnly) {
+        char* target = outPath ? strdup(outPath) : defaultBytecodePath(filename);
+        bool written = writeBytecodeFile(chunk, target, filename);
+        free(target);
+        if (!written) exit(1);
+    } else if (astInterp) {
+        // Compiled only for its errors: the tree walker runs the script,
+        // which counts as loading as below
+        char* scriptPath = g_filename ? resolveImportPath(&vm, NULL, g_filename) : NULL;
+        if (scriptPath) {
+            vm.importing = findModuleEntry(&vm, scriptPath, true);
+            vm.importing->loading = true;
+            free(scriptPath);
+        }
+        interpret(&vm, ast);
+        flushOutput(&vm);
+    } else {
         // Setup CallFrame
-        if (vm.callStackTop < CALL_STACK_MAX) {
+        if (vm.callStackTop < vm.maxFrames) {
             CallFrame* frame = &vm.callStack[vm.callStackTop++];
             frame->function = script;
             frame->chunk = chunk;
             frame->ip = chunk->code;
             frame->env = vm.globalEnv; // Bind global env
+            frame->prevGlobalEnv = vm.globalEnv;
             frame->regBase = 0;
+            frame->returnValue = NIL_VAL;
+            frame->defers = NULL;
         }
         
+        // The script counts as loading, so importing it back is a cycle
+        char* scriptPath = g_filename ? resolveImportPath(&vm, NULL, g_filename) : NULL;
+        if (scriptPath) {
+            vm.importing = findModuleEntry(&vm, scriptPath, true);
+            vm.importing->loading = true;
+            free(scriptPath);
+        }
+
+        Debugger debugger;
+        if (debugMode) {
+            initDebugger(&debugger, g_filename, isBytecode ? NULL : source, chunk, stdin);
+            vm.debugger = &debugger;
+            printf("Debugging %s. Type 'help' for commands.\n", filename);
+        }
+
+        if (traceExecution) vm.traceOut = stderr;
+        if (profile) vm.profiler = newProfiler();
+        if (coverage) {
+            startCoverage();
+            vm.coverage = g_coverage;
+        }
+
         // Execute VM
+        startTimeout(&vm);
+        startWatchdog(&vm);
         executeBytecode(&vm, chunk, 0);
+        stopWatchdog(&vm);
+        vm.debugger = NULL;
+        vm.traceOut = NULL;
+        if (profile) {
+            printProfile(&vm, stderr);
+            freeProfiler(vm.profiler);
+            vm.profiler = NULL;
+        }
+        if (coverage) {
+            vm.coverage = NULL;
+            flushOutput(&vm);
+            reportCoverage();
+        }
+        if (showStats) {
+            printMemoryStats(&vm, stderr);
+            if (cacheState) fprintf(stderr, "Bytecode cache:  %s (%s)\n", cacheState, cachePath);
+            fprintf(stderr, "Hash seed:       %u\n", currentHashSeed());
+        }
         
         // vm.callStackTop-- is handled by the return instruction
-    } else {
-        fprintf(stderr, "Bytecode compilation failed.\n");
-        exit(1);
     }
     
     vm.stackTop--; // Pop script (script will be freed by freeVM -> freeObject)
@@ -385,7 +912,8 @@ int main(int argc, char** argv) {
     freeAST(ast);
     freeParser(&parser);
     freeVM(&vm);
+    free(cachedImage);
     free(source);
 
     return 0;
-}
\ No newline at end of file
+}
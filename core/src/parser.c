@@ -1,12 +1,277 @@
 
 #include "parser.h"
+#include "vm.h"
+
+// Initialize parser
+void initParser(Parser* parser) {
+    parser->tokens = malloc(64 * sizeof(Token));  // Start with 64 tokens
+    if (!parser->tokens) {
+        error("Memory allocation failed.", 0);
+    }
+    parser->current = 0;
+    parser->count = 0;
+    parser->capacity = 64;
+    parser->loopDepth = 0;
+    parser->labels = NULL;
+    parser->functionDepth = 0;
+    parser->implicitSemicolon = false;
+}
+
+// Free parser resources
+void freeParser(Parser* parser) {
+    if (parser->tokens) {
+        free(parser->tokens);
+        parser->tokens = NULL;
+    }
+}
+
+// Add token to parser (grows array as needed)
+void addToken(Parser* parser, Token token) {
+    // Grow array if needed
+    if (parser->count >= parser->capacity) {
+        parser->capacity *= 2;
+        parser->tokens = realloc(parser->tokens, parser->capacity * sizeof(Token));
+        if (!parser->tokens) {
+            error("Memory allocation failed.", token.line);
+        }
+    }
+    
+    parser->tokens[parser->count++] = token;
+}
+
+// Free AST
+void freeAST(Node* node) {
+    if (!node) return;
+    switch (node->type) {
+        case NODE_EXPR_LITERAL:
+            if (node->literal.token.type == TOKEN_STRING) {
+                // No need to free token.start, it's from source
+            }
+            break;
+        case NODE_EXPR_BINARY:
+            freeAST(node->binary.left);
+            freeAST(node->binary.right);
+            break;
+        case NODE_EXPR_UNARY:
+        case NODE_EXPR_SPREAD:
+        case NODE_EXPR_OPTIONAL:
+            freeAST(node->unary.expr);
+            break;
+        case NODE_EXPR_AWAIT:
+            // await <expr> -> free inner expression
+            freeAST(node->unary.expr);
+            break;
+        case NODE_EXPR_VAR:
+            break;
+        case NODE_EXPR_UPDATE:
+            freeAST(node->update.target);
+            break;
+        case NODE_EXPR_GET:
+            // object.property -> free object
+            freeAST(node->get.object);
+            break;
+        case NODE_EXPR_INDEX:
+            // target[index] -> free both
+            freeAST(node->index.target);
+            freeAST(node->index.index);
+            break;
+        case NODE_EXPR_SLICE:
+            freeAST(node->slice.target);
+            freeAST(node->slice.start);
+            freeAST(node->slice.end);
+            break;
+        case NODE_EXPR_CALL:
+            freeAST(node->call.arguments);
+            free(node->call.names);
+            break;
+        case NODE_STMT_VAR_DECL:
+            freeAST(node->varDecl.initializer);
+            break;
+        case NODE_STMT_ASSIGN:
+            freeAST(node->assign.value);
+            break;
+        case NODE_STMT_INDEX_ASSIGN:
+            // target[index] = value
+            freeAST(node->indexAssign.target);
+            freeAST(node->indexAssign.index);
+            freeAST(node->indexAssign.value);
+            break;
+        case NODE_STMT_PRINT:
+            freeAST(node->print.expr);
+            break;
+        case NODE_EXPR_TERNARY:
+            freeAST(node->ternary.condition);
+            freeAST(node->ternary.thenExpr);
+            freeAST(node->ternary.elseExpr);
+            break;
+        case NODE_STMT_IF:
+            freeAST(node->ifStmt.condition);
+            freeAST(node->ifStmt.thenBranch);
+            freeAST(node->ifStmt.elseBranch);
+            break;
+        case NODE_STMT_WHILE:
+        case NODE_STMT_DO_WHILE:
+        case NODE_STMT_LOOP:
+            freeAST(node->whileStmt.condition);
+            freeAST(node->whileStmt.body);
+            break;
+        case NODE_STMT_FOR:
+            freeAST(node->forStmt.initializer);
+            freeAST(node->forStmt.condition);
+            freeAST(node->forStmt.increment);
+            freeAST(node->forStmt.body);
+            break;
+        case NODE_STMT_FOREACH:
+            freeAST(node->foreachStmt.collection);
+            freeAST(node->foreachStmt.body);
+            break;
+        case NODE_STMT_STRUCT_DECL:
+            if (node->structDecl.fields) {
+                free(node->structDecl.fields);
+            }
+            for (int i = 0; i < node->structDecl.fieldCount; i++) {
+                freeAST(node->structDecl.defaults[i]);
+            }
+            free(node->structDecl.defaults);
+            for (int i = 0; i < node->structDecl.methodCount; i++) {
+                freeAST(node->structDecl.methods[i]);
+            }
+            free(node->structDecl.methods);
+            break;
+        case NODE_STMT_ENUM_DECL:
+            free(node->enumDecl.names);
+            free(node->enumDecl.values);
+            break;
+        case NODE_STMT_PROP_ASSIGN:
+            freeAST(node->propAssign.object);
+            freeAST(node->propAssign.value);
+            break;
+        case NODE_STMT_BREAK:
+        case NODE_STMT_CONTINUE:
+            break;
+        case NODE_STMT_TRY:
+            freeAST(node->tryStmt.tryBlock);
+            freeAST(node->tryStmt.catchBlock);
+            break;
+        case NODE_STMT_THROW:
+            freeAST(node->throwStmt.value);
+            break;
+        case NODE_STMT_SPAWN:
+            freeAST(node->spawnStmt.call);
+            break;
+        case NODE_STMT_DEFER:
+            freeAST(node->deferStmt.call);
+            break;
+        case NODE_STMT_WITH:
+            freeAST(node->withStmt.resource);
+            freeAST(node->withStmt.body);
+            break;
+        case NODE_STMT_BLOCK:
+            for (int i = 0; i < node->block.count; i++) {
+                freeAST(node->block.statements[i]);
+            }
+            free(node->block.statements);
+            break;
+        case NODE_STMT_FUNCTION:
+        case NODE_EXPR_FUNCTION:
+            freeAST(node->function.body);
+            for (int i = 0; i < node->function.paramCount; i++) {
+                freeAST(node->function.defaults[i]);
+            }
+            free(node->function.defaults);
+            free(node->function.params);
+            break;
+        case NODE_STMT_RETURN:
+            {
+                Node* current = node->returnStmt.value;
+                while (current) {
+                    Node* next = current->next;
+                    freeAST(current);
+                    current = next;
+                }
+            }
+            break;
+        case NODE_STMT_MULTI_ASSIGN:
+            {
+                Node* lists[2] = { node->multiAssign.targets, node->multiAssign.values };
+                for (int i = 0; i < 2; i++) {
+                    Node* current = lists[i];
+                    while (current) {
+                        Node* next = current->next;
+                        freeAST(current);
+                        current = next;
+                    }
+                }
+            }
+            break;
+        case NODE_STMT_IMPORT:
+            // tokens only; nothing to free
+            break;
+        case NODE_STMT_SWITCH:
+            freeAST(node->switchStmt.subject);
+            for (int i = 0; i < node->switchStmt.caseCount; i++) {
+                Node* current = node->switchStmt.values[i];
+                while (current) {
+                    Node* next = current->next;
+                    freeAST(current);
+                    current = next;
+                }
+                freeAST(node->switchStmt.bodies[i]);
+            }
+            free(node->switchStmt.values);
+            free(node->switchStmt.bodies);
+            free(node->switchStmt.fallsThrough);
+            break;
+
+        case NODE_EXPR_MAP_LITERAL:
+            // Free both parallel lists
+            {
+                Node* key = node->mapLiteral.keys;
+                Node* value = node->mapLiteral.values;
+                while (key) {
+                    Node* nextKey = key->next;
+                    Node* nextValue = value->next;
+                    freeAST(key);
+                    freeAST(value);
+                    key = nextKey;
+                    value = nextValue;
+                }
+            }
+            break;
+
+        case NODE_EXPR_STRUCT_LITERAL:
+            {
+                Node* value = node->structLiteral.values;
+                while (value) {
+                    Node* next = value->next;
+                    freeAST(value);
+                    value = next;
+                }
+            }
+            free(node->structLiteral.fields);
+            break;
+
+        case NODE_EXPR_ARRAY_LITERAL:
+            // Free elements linked list
+            {
+                Node* current = node->arrayLiteral.elements;
+                while (current) {
+                    Node* next = current->next;
+                    freeAST(current);
+                    current = next; // current->next pointer logic is slightly weird here as freeAST frees the node itself.
+                }
+            }
+            break;
+    }
+    free(node);
+}
 
 // Helper to advance parser
 static Token advance(Parser* parser) {
     if (parser->current < parser->count) {
         return parser->tokens[parser->current++];
     }
-    return (Token){TOKEN_EOF, NULL, 0, 0};
+    return (Token){TOKEN_EOF, NULL, 0, 0, 0};
 }
 
 // Check current token type
@@ -24,11 +289,44 @@ static bool match(Parser* parser, TokenType type) {
     return false;
 }
 
+// At the end of a source whose last statement may leave out its ';'
+static bool atImplicitSemicolon(Parser* parser) {
+    return parser->implicitSemicolon && check(parser, TOKEN_EOF);
+}
+
 // Consume token or error
 static Token consume(Parser* parser, TokenType type, const char* message) {
     if (check(parser, type)) return advance(parser);
+    if (type == TOKEN_SEMICOLON && atImplicitSemicolon(parser)) return parser->tokens[parser->current];
     errorAtToken(parser->tokens[parser->current], message);
-    return (Token){TOKEN_EOF, NULL, 0, 0};
+    return (Token){TOKEN_EOF, NULL, 0, 0, 0};
+}
+
+// Line of the most recently consumed token
+static int previousLine(Parser* parser) {
+    return parser->current > 0 ? parser->tokens[parser->current - 1].line : 0;
+}
+
+// The most recently consumed token
+static Token previousToken(Parser* parser) {
+    if (parser->current > 0) return parser->tokens[parser->current - 1];
+    return (Token){TOKEN_EOF, NULL, 0, 0, 0};
+}
+
+// Allocate a node; runtime errors in its code are reported at 'line' and
+// 'column' (0 when unknown)
+static Node* newNodeAt(NodeType type, int line, int column) {
+    Node* node = calloc(1, sizeof(Node));
+    node->type = type;
+    node->line = line;
+    node->column = column;
+    node->next = NULL;
+    return node;
+}
+
+// A node at the position of the token it starts or is named by
+static Node* newNode(NodeType type, Token at) {
+    return newNodeAt(type, at.line, at.column);
 }
 
 // Forward declarations for recursive parsing
@@ -39,45 +337,204 @@ static Node* declaration(Parser* parser);
 // Forward for postfix
 static Node* finishPostfix(Parser* parser, Node* expr);
 
+// Forward for function expressions
+static bool isArrowFunction(Parser* parser);
+static Node* functionExpression(Parser* parser, bool isArrow);
+
+// String literal node for one piece of an interpolated string. A piece's
+// lexeme ends in "${" (or is the final '}'...'"'); dropping the '{' leaves
+// one delimiter at each end, like a plain string.
+static Node* interpolationPiece(Token piece) {
+    if (piece.type == TOKEN_INTERPOLATION) piece.length--;
+    piece.type = TOKEN_STRING;
+    Node* node = newNode(NODE_EXPR_LITERAL, piece);
+    node->literal.token = piece;
+    return node;
+}
+
+// left + right, at the position of 'right'
+static Node* concatNode(Node* left, Node* right) {
+    Node* node = newNodeAt(NODE_EXPR_BINARY, right->line, right->column);
+    node->binary.left = left;
+    node->binary.op = (Token){TOKEN_PLUS, "+", 1, right->line, right->column};
+    node->binary.right = right;
+    node->binary.interpolated = true;
+    return node;
+}
+
+// "a ${x} b" parses as "a " + x + " b". The leading piece is kept even when
+// empty so the first '+' is always a string concatenation.
+static Node* interpolation(Parser* parser) {
+    Token piece = parser->tokens[parser->current - 1];
+    Node* expr = interpolationPiece(piece);
+    while (true) {
+        // "${}" adds nothing: the next piece follows at once and starts with '}'
+        bool empty = (check(parser, TOKEN_INTERPOLATION) || check(parser, TOKEN_STRING)) &&
+                     parser->tokens[parser->current].start[0] == '}';
+        if (!empty) {
+            Node* value = expression(parser);
+            expr = concatNode(expr, value);
+        }
+        bool more = check(parser, TOKEN_INTERPOLATION);
+        if (!more && !(check(parser, TOKEN_STRING) && parser->tokens[parser->current].start[0] == '}')) {
+            errorAtToken(parser->tokens[parser->current], "Expect '}' after interpolated expression.");
+        }
+        piece = advance(parser);
+        int textLength = piece.length - (more ? 3 : 2);
+        if (textLength > 0) expr = concatNode(expr, interpolationPiece(piece));
+        if (!more) return expr;
+    }
+}
+
+// Name{} or Name{ field: ... }; any other '{' after a name starts a block
+static bool isStructLiteral(Parser* parser) {
+    int i = parser->current;
+    if (i + 2 >= parser->count || parser->tokens[i + 1].type != TOKEN_LEFT_BRACE) return false;
+    if (parser->tokens[i + 2].type == TOKEN_RIGHT_BRACE) return true;
+    return i + 3 < parser->count && parser->tokens[i + 2].type == TOKEN_IDENTIFIER &&
+           parser->tokens[i + 3].type == TOKEN_COLON;
+}
+
+// Struct literal Name{ f1: v1, f2: v2, ... }; the compiler checks the
+// field names against the struct's declaration
+static Node* structLiteral(Parser* parser) {
+    Token name = advance(parser);
+    advance(parser); // '{'
+    Node* node = newNode(NODE_EXPR_STRUCT_LITERAL, name);
+    node->structLiteral.name = name;
+    node->structLiteral.fields = NULL;
+    node->structLiteral.values = NULL;
+    node->structLiteral.count = 0;
+
+    if (!check(parser, TOKEN_RIGHT_BRACE)) {
+        Node** currentValue = &node->structLiteral.values;
+        do {
+            if (check(parser, TOKEN_RIGHT_BRACE)) break; // trailing comma
+            Token field = consume(parser, TOKEN_IDENTIFIER, "Expect field name in struct literal.");
+            for (int i = 0; i < node->structLiteral.count; i++) {
+                Token other = node->structLiteral.fields[i];
+                if (other.length == field.length && memcmp(other.start, field.start, field.length) == 0) {
+                    errorAtToken(field, "Field is already initialized.");
+                }
+            }
+            consume(parser, TOKEN_COLON, "Expect ':' after field name.");
+            int count = node->structLiteral.count;
+            node->structLiteral.fields = realloc(node->structLiteral.fields, (count + 1) * sizeof(Token));
+            node->structLiteral.fields[count] = field;
+            *currentValue = expression(parser);
+            node->structLiteral.count++;
+            currentValue = &(*currentValue)->next;
+        } while (match(parser, TOKEN_COMMA));
+    }
+    consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after struct literal.");
+    node->structLiteral.endLine = previousLine(parser);
+    return finishPostfix(parser, node);
+}
+
+// The elements of an array or set literal after its opening bracket, up
+// to and including 'close'
+static Node* elementList(Parser* parser, TokenType close, const char* message) {
+    Node* node = newNode(NODE_EXPR_ARRAY_LITERAL, previousToken(parser));
+    node->arrayLiteral.elements = NULL;
+    node->arrayLiteral.count = 0;
+    node->arrayLiteral.isSet = false;
+
+    if (!check(parser, close)) {
+        Node** currentElem = &node->arrayLiteral.elements;
+        do {
+            if (match(parser, TOKEN_ELLIPSIS)) {
+                // ...expr: the elements of an iterable, inlined in place
+                Node* spread = newNode(NODE_EXPR_SPREAD, previousToken(parser));
+                spread->unary.op = parser->tokens[parser->current - 1];
+                spread->unary.expr = expression(parser);
+                *currentElem = spread;
+            } else {
+                *currentElem = expression(parser);
+            }
+            node->arrayLiteral.count++;
+            currentElem = &(*currentElem)->next;
+        } while (match(parser, TOKEN_COMMA));
+    }
+    consume(parser, close, message);
+    node->arrayLiteral.endLine = previousLine(parser);
+    return node;
+}
+
+// The integer literal 9223372036854775808 (2^63), which is only an int as
+// the operand of '-'
+static bool isIntMinMagnitude(Token token) {
+    uint64_t n;
+    return token.type == TOKEN_NUMBER && !memchr(token.start, '.', token.length) &&
+           integerLiteral(token, &n) && n == (uint64_t)INT64_MAX + 1;
+}
+
 // Parse primary (literals, vars, groups)
 static Node* primary(Parser* parser) {
+    if (match(parser, TOKEN_INTERPOLATION)) {
+        return interpolation(parser);
+    }
+    if (check(parser, TOKEN_NUMBER) && isIntMinMagnitude(parser->tokens[parser->current])) {
+        errorAtToken(parser->tokens[parser->current], "Integer literal is too large.");
+    }
     if (match(parser, TOKEN_NUMBER) || match(parser, TOKEN_STRING) || 
-        match(parser, TOKEN_TRUE) || match(parser, TOKEN_FALSE)) {
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_LITERAL;
+        match(parser, TOKEN_TRUE) || match(parser, TOKEN_FALSE) ||
+        match(parser, TOKEN_NIL)) {
+        Node* node = newNode(NODE_EXPR_LITERAL, previousToken(parser));
         node->literal.token = parser->tokens[parser->current - 1];
         return node;
     }
     if (match(parser, TOKEN_LEFT_BRACKET)) {
         // Array literal [e1, e2, ...]
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_ARRAY_LITERAL;
-        node->arrayLiteral.elements = NULL;
-        node->arrayLiteral.count = 0;
-
-        if (!check(parser, TOKEN_RIGHT_BRACKET)) {
-            Node** currentElem = &node->arrayLiteral.elements;
+        Node* node = elementList(parser, TOKEN_RIGHT_BRACKET, "Expect ']' after array literal.");
+        return finishPostfix(parser, node);
+    }
+    if (match(parser, TOKEN_HASH_LEFT_BRACE)) {
+        // Set literal #{e1, e2, ...}
+        Node* node = elementList(parser, TOKEN_RIGHT_BRACE, "Expect '}' after set literal.");
+        node->arrayLiteral.isSet = true;
+        return finishPostfix(parser, node);
+    }
+    if (match(parser, TOKEN_LEFT_BRACE)) {
+        // Map literal { k1: v1, k2: v2, ... }
+        Node* node = newNode(NODE_EXPR_MAP_LITERAL, previousToken(parser));
+        node->mapLiteral.keys = NULL;
+        node->mapLiteral.values = NULL;
+        node->mapLiteral.count = 0;
+
+        if (!check(parser, TOKEN_RIGHT_BRACE)) {
+            Node** currentKey = &node->mapLiteral.keys;
+            Node** currentValue = &node->mapLiteral.values;
             do {
-                *currentElem = expression(parser);
-                node->arrayLiteral.count++;
-                currentElem = &(*currentElem)->next;
+                if (check(parser, TOKEN_RIGHT_BRACE)) break; // trailing comma
+                *currentKey = expression(parser);
+                consume(parser, TOKEN_COLON, "Expect ':' after map key.");
+                *currentValue = expression(parser);
+                node->mapLiteral.count++;
+                currentKey = &(*currentKey)->next;
+                currentValue = &(*currentValue)->next;
             } while (match(parser, TOKEN_COMMA));
         }
-        consume(parser, TOKEN_RIGHT_BRACKET, "Expect ']' after array literal.");
+        consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after map literal.");
+        node->mapLiteral.endLine = previousLine(parser);
         return finishPostfix(parser, node);
     }
+    if (check(parser, TOKEN_IDENTIFIER) && isStructLiteral(parser)) {
+        return structLiteral(parser);
+    }
     if (match(parser, TOKEN_IDENTIFIER)) {
         // Variable reference base
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_VAR;
-        node->type = NODE_EXPR_VAR;
+        Node* node = newNode(NODE_EXPR_VAR, previousToken(parser));
         node->var.name = parser->tokens[parser->current - 1];
         node->var.slot = -1; // Initialize slot
         return finishPostfix(parser, node);
     }
+    if (match(parser, TOKEN_FUNCTION)) {
+        return finishPostfix(parser, functionExpression(parser, false));
+    }
+    if (check(parser, TOKEN_LEFT_PAREN) && isArrowFunction(parser)) {
+        advance(parser);
+        return functionExpression(parser, true);
+    }
     if (match(parser, TOKEN_LEFT_PAREN)) {
         Node* expr = expression(parser);
         consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after expression.");
@@ -87,85 +544,173 @@ static Node* primary(Parser* parser) {
     return NULL;
 }
 
+// ++target or target--; the target is one that could be assigned to
+static Node* updateNode(Token op, Node* target, bool prefix) {
+    bool assignable = target->type == NODE_EXPR_VAR ||
+                      (target->type == NODE_EXPR_INDEX && !target->index.optional) ||
+                      (target->type == NODE_EXPR_GET && !target->get.optional);
+    if (!assignable) {
+        errorAtToken(op, op.type == TOKEN_PLUS_PLUS ? "Invalid increment target." : "Invalid decrement target.");
+    }
+    Node* node = prefix ? newNode(NODE_EXPR_UPDATE, op) : newNodeAt(NODE_EXPR_UPDATE, target->line, target->column);
+    node->update.op = op;
+    node->update.target = target;
+    node->update.prefix = prefix;
+    return node;
+}
+
 // Unary
 static Node* unary(Parser* parser) {
     if (match(parser, TOKEN_AWAIT)) {
         // await expression
         Node* expr = unary(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_AWAIT;
+        Node* node = newNodeAt(NODE_EXPR_AWAIT, expr->line, expr->column);
         node->unary.op = parser->tokens[parser->current - 1]; // store 'await' token
         node->unary.expr = expr;
         return node;
     }
-    if (match(parser, TOKEN_MINUS) || match(parser, TOKEN_PLUS) || match(parser, TOKEN_BANG)) {
+    if (match(parser, TOKEN_PLUS_PLUS) || match(parser, TOKEN_MINUS_MINUS)) {
+        Token op = parser->tokens[parser->current - 1];
+        return updateNode(op, unary(parser), true);
+    }
+    if (match(parser, TOKEN_MINUS) || match(parser, TOKEN_PLUS) || match(parser, TOKEN_BANG) ||
+        match(parser, TOKEN_TILDE)) {
         Token op = parser->tokens[parser->current - 1];
+        Token next = parser->tokens[parser->current];
+        if (op.type == TOKEN_MINUS && next.start == op.start + 1 && isIntMinMagnitude(next)) {
+            // -9223372036854775808, the smallest int, is one literal: its
+            // magnitude alone is too large
+            parser->current++;
+            Node* node = newNode(NODE_EXPR_LITERAL, op);
+            node->literal.token = op;
+            node->literal.token.type = TOKEN_NUMBER;
+            node->literal.token.length = (int)(next.start - op.start) + next.length;
+            return node;
+        }
         Node* expr = unary(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_UNARY;
+        Node* node = newNode(NODE_EXPR_UNARY, op);
         node->unary.op = op;
         node->unary.expr = expr;
         return node;
     }
-    return primary(parser);
+    Node* expr = primary(parser);
+    if (match(parser, TOKEN_PLUS_PLUS) || match(parser, TOKEN_MINUS_MINUS)) {
+        return updateNode(parser->tokens[parser->current - 1], expr, false);
+    }
+    return expr;
 }
 
-// Postfix: calls, member access, indexing (left-assoc, chainable)
+// target[index] or target[start:end], after the '['
+static Node* finishIndex(Parser* parser, Node* target, bool optional) {
+    Node* indexExpr = check(parser, TOKEN_COLON) ? NULL : expression(parser);
+    if (match(parser, TOKEN_COLON)) {
+        // Slice: target[start:end], either bound may be left out
+        Node* slice = newNodeAt(NODE_EXPR_SLICE, target->line, target->column);
+        slice->slice.target = target;
+        slice->slice.start = indexExpr;
+        slice->slice.end = check(parser, TOKEN_RIGHT_BRACKET) ? NULL : expression(parser);
+        slice->slice.optional = optional;
+        consume(parser, TOKEN_RIGHT_BRACKET, "Expect ']' after slice.");
+        return slice;
+    }
+    consume(parser, TOKEN_RIGHT_BRACKET, "Expect ']' after index expression.");
+    Node* idx = newNodeAt(NODE_EXPR_INDEX, target->line, target->column);
+    idx->index.target = target;
+    idx->index.index = indexExpr;
+    idx->index.optional = optional;
+    return idx;
+}
+
+// Postfix: calls, member access, indexing (left-assoc, chainable). A chain
+// with a ?. link is wrapped in NODE_EXPR_OPTIONAL, which is nil as soon as
+// a ?. link meets nil; the rest of the chain is skipped.
 static Node* finishPostfix(Parser* parser, Node* expr) {
+    Token optional = {TOKEN_EOF, NULL, 0, 0, 0}; // The first ?.
     for (;;) {
         if (match(parser, TOKEN_LEFT_PAREN)) {
-            Node* call = malloc(sizeof(Node));
-            call->next = NULL;
-            call->type = NODE_EXPR_CALL;
+            Node* call = newNode(NODE_EXPR_CALL, previousToken(parser));
             call->call.callee = expr;
             call->call.arguments = NULL;
             call->call.argumentCount = 0;
+            call->call.names = NULL;
+            call->call.namedCount = 0;
 
             if (!check(parser, TOKEN_RIGHT_PAREN)) {
                 Node** currentArg = &call->call.arguments;
+                bool spread = false;
                 do {
-                    *currentArg = expression(parser);
+                    if (check(parser, TOKEN_IDENTIFIER) && parser->current + 1 < parser->count &&
+                        parser->tokens[parser->current + 1].type == TOKEN_COLON) {
+                        // name: expr binds the parameter of that name
+                        Token name = advance(parser);
+                        advance(parser); // ':'
+                        if (spread) errorAtToken(name, "Can't pass named arguments after a spread argument.");
+                        for (int i = 0; i < call->call.namedCount; i++) {
+                            Token other = call->call.names[i];
+                            if (other.length == name.length && memcmp(other.start, name.start, name.length) == 0) {
+                                errorAtToken(name, "Argument is already given.");
+                            }
+                        }
+                        int count = call->call.namedCount;
+                        call->call.names = realloc(call->call.names, (count + 1) * sizeof(Token));
+                        call->call.names[count] = name;
+                        call->call.namedCount++;
+                        *currentArg = expression(parser);
+                    } else if (call->call.namedCount > 0) {
+                        errorAtToken(parser->tokens[parser->current], "Expect a named argument after a named one.");
+                    } else if (match(parser, TOKEN_ELLIPSIS)) {
+                        spread = true;
+                        // ...expr: the elements of an iterable, as separate arguments
+                        Node* spread = newNode(NODE_EXPR_SPREAD, previousToken(parser));
+                        spread->unary.op = parser->tokens[parser->current - 1];
+                        spread->unary.expr = expression(parser);
+                        *currentArg = spread;
+                    } else {
+                        *currentArg = expression(parser);
+                    }
                     call->call.argumentCount++;
                     currentArg = &(*currentArg)->next;
                 } while (match(parser, TOKEN_COMMA));
             }
             consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after arguments.");
             expr = call;
-        } else if (match(parser, TOKEN_DOT)) {
-            Token name = consume(parser, TOKEN_IDENTIFIER, "Expect property name after '.'.");
-            Node* get = malloc(sizeof(Node));
-            get->next = NULL;
-            get->type = NODE_EXPR_GET;
+        } else if (match(parser, TOKEN_DOT) || match(parser, TOKEN_QUESTION_DOT)) {
+            Token dot = parser->tokens[parser->current - 1];
+            bool isOptional = dot.type == TOKEN_QUESTION_DOT;
+            if (isOptional && optional.type == TOKEN_EOF) optional = dot;
+            if (isOptional && match(parser, TOKEN_LEFT_BRACKET)) {
+                expr = finishIndex(parser, expr, true);
+                continue;
+            }
+            Token name = consume(parser, TOKEN_IDENTIFIER, isOptional
+                ? "Expect property name or '[' after '?.'."
+                : "Expect property name after '.'.");
+            Node* get = newNode(NODE_EXPR_GET, name);
             get->get.object = expr;
             get->get.name = name;
+            get->get.optional = isOptional;
             expr = get;
         } else if (match(parser, TOKEN_LEFT_BRACKET)) {
-            Node* indexExpr = expression(parser);
-            consume(parser, TOKEN_RIGHT_BRACKET, "Expect ']' after index expression.");
-            Node* idx = malloc(sizeof(Node));
-            idx->next = NULL;
-            idx->type = NODE_EXPR_INDEX;
-            idx->index.target = expr;
-            idx->index.index = indexExpr;
-            expr = idx;
+            expr = finishIndex(parser, expr, false);
         } else {
             break;
         }
     }
-    return expr;
+    if (optional.type == TOKEN_EOF) return expr;
+    Node* chain = newNode(NODE_EXPR_OPTIONAL, optional);
+    chain->unary.op = optional;
+    chain->unary.expr = expr;
+    return chain;
 }
 
-// Factor (* / %)
+// Factor (* / // %)
 static Node* factor(Parser* parser) {
     Node* expr = unary(parser);
-    while (match(parser, TOKEN_STAR) || match(parser, TOKEN_SLASH) || match(parser, TOKEN_PERCENT)) {
+    while (match(parser, TOKEN_STAR) || match(parser, TOKEN_SLASH) || match(parser, TOKEN_TILDE_SLASH) ||
+           match(parser, TOKEN_PERCENT)) {
         Token op = parser->tokens[parser->current - 1];
         Node* right = unary(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
@@ -180,9 +725,66 @@ static Node* term(Parser* parser) {
     while (match(parser, TOKEN_PLUS) || match(parser, TOKEN_MINUS)) {
         Token op = parser->tokens[parser->current - 1];
         Node* right = factor(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* node = newNode(NODE_EXPR_BINARY, op);
+        node->binary.left = expr;
+        node->binary.op = op;
+        node->binary.right = right;
+        expr = node;
+    }
+    return expr;
+}
+
+// Shift (<< >>)
+static Node* shift(Parser* parser) {
+    Node* expr = term(parser);
+    while (match(parser, TOKEN_LESS_LESS) || match(parser, TOKEN_GREATER_GREATER)) {
+        Token op = parser->tokens[parser->current - 1];
+        Node* right = term(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
+        node->binary.left = expr;
+        node->binary.op = op;
+        node->binary.right = right;
+        expr = node;
+    }
+    return expr;
+}
+
+// Bitwise AND, XOR and OR, in that order of binding. All three bind tighter
+// than the comparisons, so 'flags & MASK == 0' tests the masked bits.
+static Node* bitAnd(Parser* parser) {
+    Node* expr = shift(parser);
+    while (match(parser, TOKEN_AMPERSAND)) {
+        Token op = parser->tokens[parser->current - 1];
+        Node* right = shift(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
+        node->binary.left = expr;
+        node->binary.op = op;
+        node->binary.right = right;
+        expr = node;
+    }
+    return expr;
+}
+
+static Node* bitXor(Parser* parser) {
+    Node* expr = bitAnd(parser);
+    while (match(parser, TOKEN_CARET)) {
+        Token op = parser->tokens[parser->current - 1];
+        Node* right = bitAnd(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
+        node->binary.left = expr;
+        node->binary.op = op;
+        node->binary.right = right;
+        expr = node;
+    }
+    return expr;
+}
+
+static Node* bitOr(Parser* parser) {
+    Node* expr = bitXor(parser);
+    while (match(parser, TOKEN_PIPE)) {
+        Token op = parser->tokens[parser->current - 1];
+        Node* right = bitXor(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
@@ -193,17 +795,18 @@ static Node* term(Parser* parser) {
 
 // Comparison
 static Node* comparison(Parser* parser) {
-    Node* expr = term(parser);
+    Node* expr = bitOr(parser);
+    bool chained = false;
     while (match(parser, TOKEN_GREATER) || match(parser, TOKEN_GREATER_EQUAL) ||
            match(parser, TOKEN_LESS) || match(parser, TOKEN_LESS_EQUAL)) {
         Token op = parser->tokens[parser->current - 1];
-        Node* right = term(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* right = bitOr(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
+        node->binary.chained = chained; // a < b < c
+        chained = true;
         expr = node;
     }
     return expr;
@@ -215,9 +818,7 @@ static Node* equality(Parser* parser) {
     while (match(parser, TOKEN_EQUAL_EQUAL) || match(parser, TOKEN_BANG_EQUAL)) {
         Token op = parser->tokens[parser->current - 1];
         Node* right = comparison(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
@@ -226,15 +827,13 @@ static Node* equality(Parser* parser) {
     return expr;
 }
 
-// Logical AND (&&)
+// Logical AND (&& or 'and')
 static Node* logicAnd(Parser* parser) {
     Node* expr = equality(parser);
     while (match(parser, TOKEN_AND)) {
         Token op = parser->tokens[parser->current - 1];
         Node* right = equality(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
@@ -243,15 +842,28 @@ static Node* logicAnd(Parser* parser) {
     return expr;
 }
 
-// Logical OR (||)
+// Logical OR (|| or 'or')
 static Node* logicOr(Parser* parser) {
     Node* expr = logicAnd(parser);
     while (match(parser, TOKEN_OR)) {
         Token op = parser->tokens[parser->current - 1];
         Node* right = logicAnd(parser);
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_EXPR_BINARY;
+        Node* node = newNode(NODE_EXPR_BINARY, op);
+        node->binary.left = expr;
+        node->binary.op = op;
+        node->binary.right = right;
+        expr = node;
+    }
+    return expr;
+}
+
+// Nil coalescing: a ?? b is a unless a is nil
+static Node* nilCoalesce(Parser* parser) {
+    Node* expr = logicOr(parser);
+    while (match(parser, TOKEN_QUESTION_QUESTION)) {
+        Token op = parser->tokens[parser->current - 1];
+        Node* right = logicOr(parser);
+        Node* node = newNode(NODE_EXPR_BINARY, op);
         node->binary.left = expr;
         node->binary.op = op;
         node->binary.right = right;
@@ -260,23 +872,38 @@ static Node* logicOr(Parser* parser) {
     return expr;
 }
 
+// Conditional: cond ? a : b (right-assoc)
+static Node* conditional(Parser* parser) {
+    Node* expr = nilCoalesce(parser);
+    if (match(parser, TOKEN_QUESTION)) {
+        Node* node = newNodeAt(NODE_EXPR_TERNARY, expr->line, expr->column);
+        node->ternary.condition = expr;
+        node->ternary.thenExpr = conditional(parser);
+        consume(parser, TOKEN_COLON, "Expect ':' in conditional expression.");
+        node->ternary.elseExpr = conditional(parser);
+        return node;
+    }
+    return expr;
+}
+
 // Assignment (for var = expr)
 static Node* assignment(Parser* parser) {
-    Node* expr = logicOr(parser);
+    Node* expr = conditional(parser);
     
     if (match(parser, TOKEN_EQUAL) || 
         match(parser, TOKEN_PLUS_EQUAL) ||
         match(parser, TOKEN_MINUS_EQUAL) ||
         match(parser, TOKEN_STAR_EQUAL) ||
-        match(parser, TOKEN_SLASH_EQUAL)) {
+        match(parser, TOKEN_SLASH_EQUAL) ||
+        match(parser, TOKEN_TILDE_SLASH_EQUAL) ||
+        match(parser, TOKEN_PERCENT_EQUAL) ||
+        match(parser, TOKEN_QUESTION_QUESTION_EQUAL)) {
         
         Token op = parser->tokens[parser->current - 1];
         Node* value = assignment(parser); // Right-assoc
         
         if (expr->type == NODE_EXPR_VAR) {
-            Node* node = malloc(sizeof(Node));
-            node->next = NULL;
-            node->type = NODE_STMT_ASSIGN;
+            Node* node = newNode(NODE_STMT_ASSIGN, op);
             node->assign.name = expr->var.name;
             node->assign.operator = op;
             node->assign.value = value;
@@ -285,21 +912,16 @@ static Node* assignment(Parser* parser) {
             free(expr); 
             return node;
         } else if (expr->type == NODE_EXPR_INDEX) {
-            Node* node = malloc(sizeof(Node));
-            node->next = NULL;
-            node->type = NODE_STMT_INDEX_ASSIGN;
+            Node* node = newNode(NODE_STMT_INDEX_ASSIGN, op);
             node->indexAssign.target = expr->index.target;
             node->indexAssign.index = expr->index.index;
             node->indexAssign.operator = op;
             node->indexAssign.value = value;
-            node->indexAssign.value = value;
             // Free the index node structure (but keep children which are moved)
             free(expr);
             return node;
         } else if (expr->type == NODE_EXPR_GET) {
-            Node* node = malloc(sizeof(Node));
-            node->next = NULL;
-            node->type = NODE_STMT_PROP_ASSIGN;
+            Node* node = newNode(NODE_STMT_PROP_ASSIGN, op);
             node->propAssign.object = expr->get.object;
             node->propAssign.name = expr->get.name;
             node->propAssign.operator = op;
@@ -319,9 +941,7 @@ static Node* expression(Parser* parser) {
 
 // Block { ... }
 static Node* block(Parser* parser) {
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_BLOCK;
+    Node* node = newNode(NODE_STMT_BLOCK, previousToken(parser));
     node->block.statements = malloc(8 * sizeof(Node*));
     node->block.count = 0;
     node->block.capacity = 8;
@@ -336,20 +956,28 @@ static Node* block(Parser* parser) {
     }
 
     consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after block.");
+    node->block.endLine = previousLine(parser);
     return node;
 }
 
-// Function declaration
-static Node* function(Parser* parser) {
-    Token name = consume(parser, TOKEN_IDENTIFIER, "Expect function name.");
-    consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after function name.");
-
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_FUNCTION;
+// Function node with no parameters or body yet
+static Node* newFunction(NodeType type, Token name, Token at) {
+    Node* node = newNode(type, at);
     node->function.name = name;
     node->function.params = malloc(8 * sizeof(Token));
+    node->function.defaults = malloc(8 * sizeof(Node*));
     node->function.paramCount = 0;
+    node->function.requiredCount = 0;
+    node->function.isVariadic = false;
+    node->function.isMethod = false;
+    node->function.isAsync = false;
+    node->function.isArrow = false;
+    node->function.isExpressionBody = false;
+    return node;
+}
+
+// Parameter list after the '(', through the ')'
+static void parameters(Parser* parser, Node* node) {
     int capacity = 8;
 
     if (!check(parser, TOKEN_RIGHT_PAREN)) {
@@ -357,22 +985,179 @@ static Node* function(Parser* parser) {
             if (node->function.paramCount == capacity) {
                 capacity *= 2;
                 node->function.params = realloc(node->function.params, capacity * sizeof(Token));
+                node->function.defaults = realloc(node->function.defaults, capacity * sizeof(Node*));
+            }
+            if (node->function.isVariadic) {
+                errorAtToken(parser->tokens[parser->current],
+                             "Variadic parameter must be the last parameter.");
+            }
+            // ...name: an array of the arguments past the other parameters
+            bool isRest = match(parser, TOKEN_ELLIPSIS);
+            int index = node->function.paramCount++;
+            node->function.params[index] = consume(parser, TOKEN_IDENTIFIER, "Expect parameter name.");
+            node->function.defaults[index] = NULL;
+
+            if (isRest) {
+                node->function.isVariadic = true;
+                if (check(parser, TOKEN_EQUAL)) {
+                    errorAtToken(node->function.params[index],
+                                 "Variadic parameter cannot have a default value.");
+                }
+            } else if (match(parser, TOKEN_EQUAL)) {
+                // name = expr: evaluated at call time when the argument is omitted
+                node->function.defaults[index] = expression(parser);
+            } else if (index > node->function.requiredCount) {
+                errorAtToken(node->function.params[index],
+                             "Parameter without a default cannot follow one with a default.");
+            } else {
+                node->function.requiredCount++;
             }
-            node->function.params[node->function.paramCount++] = consume(parser, TOKEN_IDENTIFIER, "Expect parameter name.");
         } while (match(parser, TOKEN_COMMA));
     }
 
     consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after parameters.");
-    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before function body.");
-    node->function.body = block(parser);
+}
+
+// Function body: a block, or after '=>' a single expression that is
+// returned
+static void functionBody(Parser* parser, Node* node) {
+    // Loops outside the function don't count for break/continue inside it
+    int savedLoopDepth = parser->loopDepth;
+    LoopLabel* savedLabels = parser->labels;
+    parser->loopDepth = 0;
+    parser->labels = NULL;
+    parser->functionDepth++;
+    if (node->function.isArrow && !check(parser, TOKEN_LEFT_BRACE)) {
+        Node* value = expression(parser);
+        Node* ret = newNodeAt(NODE_STMT_RETURN, value->line, value->column);
+        ret->returnStmt.value = value;
+        ret->returnStmt.count = 1;
+        Node* body = newNodeAt(NODE_STMT_BLOCK, value->line, value->column);
+        body->block.statements = malloc(sizeof(Node*));
+        body->block.statements[0] = ret;
+        body->block.count = 1;
+        body->block.capacity = 1;
+        body->block.endLine = previousLine(parser);
+        node->function.body = body;
+        node->function.isExpressionBody = true;
+    } else {
+        consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before function body.");
+        node->function.body = block(parser);
+    }
+    parser->functionDepth--;
+    parser->loopDepth = savedLoopDepth;
+    parser->labels = savedLabels;
+}
+
+// Function declaration
+static Node* function(Parser* parser) {
+    Token name = consume(parser, TOKEN_IDENTIFIER, "Expect function name.");
+    consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after function name.");
+
+    Node* node = newFunction(NODE_STMT_FUNCTION, name, name);
+    parameters(parser, node);
+    functionBody(parser, node);
     // isAsync is set by caller (declaration) when seeing 'async function'
     return node;
 }
 
+// Whether the '(' at the current token opens the parameters of an arrow
+// function: its matching ')' is followed by '=>'
+static bool isArrowFunction(Parser* parser) {
+    int depth = 0;
+    for (int i = parser->current; i < parser->count; i++) {
+        TokenType type = parser->tokens[i].type;
+        if (type == TOKEN_LEFT_PAREN || type == TOKEN_LEFT_BRACKET || type == TOKEN_LEFT_BRACE) {
+            depth++;
+        } else if (type == TOKEN_RIGHT_PAREN || type == TOKEN_RIGHT_BRACKET || type == TOKEN_RIGHT_BRACE) {
+            if (--depth == 0) {
+                return i + 1 < parser->count && parser->tokens[i + 1].type == TOKEN_ARROW;
+            }
+        } else if (type == TOKEN_SEMICOLON || type == TOKEN_EOF) {
+            return false;
+        }
+    }
+    return false;
+}
+
+// Function expression, 'function' or '(' already consumed: an unnamed
+// function value closing over the variables around it
+static Node* functionExpression(Parser* parser, bool isArrow) {
+    Token at = previousToken(parser);
+    Token name = {TOKEN_IDENTIFIER, "<lambda>", 8, at.line, at.column};
+    Node* node = newFunction(NODE_EXPR_FUNCTION, name, at);
+    node->function.isArrow = isArrow;
+    if (!isArrow) consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'function'.");
+    parameters(parser, node);
+    if (isArrow) consume(parser, TOKEN_ARROW, "Expect '=>' after parameters.");
+    functionBody(parser, node);
+    return node;
+}
+
+// Comma-separated expression list (at least one); returns head, count in *count
+static Node* expressionList(Parser* parser, int* count) {
+    Node* head = NULL;
+    Node** tail = &head;
+    *count = 0;
+    do {
+        *tail = expression(parser);
+        (*count)++;
+        tail = &(*tail)->next;
+    } while (match(parser, TOKEN_COMMA));
+    return head;
+}
+
+// Rest of 'first, t2, ... = v1, v2, ...' after 'first' has been parsed
+static Node* multiAssignment(Parser* parser, Node* first, bool isDecl) {
+    Node* node = newNodeAt(NODE_STMT_MULTI_ASSIGN, first->line, first->column);
+    node->multiAssign.targets = first;
+    node->multiAssign.targetCount = 1;
+    node->multiAssign.values = NULL;
+    node->multiAssign.valueCount = 0;
+    node->multiAssign.isDecl = isDecl;
+
+    Node* last = first;
+    while (match(parser, TOKEN_COMMA)) {
+        Node* target;
+        if (isDecl) {
+            Token name = consume(parser, TOKEN_IDENTIFIER, "Expect variable name.");
+            target = newNode(NODE_EXPR_VAR, name);
+            target->var.name = name;
+            target->var.slot = -1;
+        } else {
+            target = conditional(parser);
+        }
+        target->next = NULL;
+        last->next = target;
+        last = target;
+        node->multiAssign.targetCount++;
+    }
+
+    for (Node* t = first; t; t = t->next) {
+        if (t->type != NODE_EXPR_VAR && t->type != NODE_EXPR_INDEX && t->type != NODE_EXPR_GET) {
+            error("Invalid assignment target.", parser->tokens[parser->current - 1].line);
+        }
+    }
+
+    if (isDecl && !check(parser, TOKEN_EQUAL)) return node; // var a, b;
+    consume(parser, TOKEN_EQUAL, "Expect '=' after assignment targets.");
+    node->multiAssign.values = expressionList(parser, &node->multiAssign.valueCount);
+    return node;
+}
+
 // Var declaration
 static Node* varDeclaration(Parser* parser) {
     Token name = consume(parser, TOKEN_IDENTIFIER, "Expect variable name.");
 
+    if (check(parser, TOKEN_COMMA)) {
+        Node* first = newNode(NODE_EXPR_VAR, name);
+        first->var.name = name;
+        first->var.slot = -1;
+        Node* node = multiAssignment(parser, first, true);
+        consume(parser, TOKEN_SEMICOLON, "Expect ';' after variable declaration.");
+        return node;
+    }
+
     Node* initializer = NULL;
     if (match(parser, TOKEN_EQUAL)) {
         initializer = expression(parser);
@@ -380,12 +1165,26 @@ static Node* varDeclaration(Parser* parser) {
 
     consume(parser, TOKEN_SEMICOLON, "Expect ';' after variable declaration.");
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_VAR_DECL;
+    Node* node = newNode(NODE_STMT_VAR_DECL, name);
     node->varDecl.name = name;
     node->varDecl.initializer = initializer;
     node->varDecl.slot = -1; // Initialize slot
+    node->varDecl.isConst = false;
+    return node;
+}
+
+// const NAME = expr;
+static Node* constDeclaration(Parser* parser) {
+    Token name = consume(parser, TOKEN_IDENTIFIER, "Expect constant name.");
+    consume(parser, TOKEN_EQUAL, "Expect '=' after constant name.");
+    Node* initializer = expression(parser);
+    consume(parser, TOKEN_SEMICOLON, "Expect ';' after constant declaration.");
+
+    Node* node = newNode(NODE_STMT_VAR_DECL, name);
+    node->varDecl.name = name;
+    node->varDecl.initializer = initializer;
+    node->varDecl.slot = -1;
+    node->varDecl.isConst = true;
     return node;
 }
 
@@ -394,30 +1193,227 @@ static Node* printStatement(Parser* parser) {
     Node* expr = expression(parser);
     consume(parser, TOKEN_SEMICOLON, "Expect ';' after print value.");
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_PRINT;
+    Node* node = newNodeAt(NODE_STMT_PRINT, expr->line, expr->column);
     node->print.expr = expr;
     return node;
 }
 
 // Return statement
 static Node* returnStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
     Node* value = NULL;
-    if (!check(parser, TOKEN_SEMICOLON)) {
-        value = expression(parser);
+    int count = 0;
+    if (!check(parser, TOKEN_SEMICOLON) && !atImplicitSemicolon(parser)) {
+        value = expressionList(parser, &count);
     }
     consume(parser, TOKEN_SEMICOLON, "Expect ';' after return value.");
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_RETURN;
+    Node* node = newNode(NODE_STMT_RETURN, keyword);
     node->returnStmt.value = value;
+    node->returnStmt.count = count;
+    return node;
+}
+
+static bool sameName(Token a, Token b) {
+    return a.length == b.length && memcmp(a.start, b.start, a.length) == 0;
+}
+
+static LoopLabel* findLabel(Parser* parser, Token name) {
+    for (LoopLabel* label = parser->labels; label; label = label->enclosing) {
+        if (sameName(label->name, name)) return label;
+    }
+    return NULL;
+}
+
+// Break / continue statement (keyword already consumed), with an optional
+// label naming the enclosing loop it leaves or continues
+static Node* loopJumpStatement(Parser* parser, NodeType type) {
+    Token keyword = previousToken(parser);
+    if (parser->loopDepth == 0) {
+        errorAtToken(keyword, type == NODE_STMT_BREAK
+            ? "Can't use 'break' outside of a loop."
+            : "Can't use 'continue' outside of a loop.");
+    }
+    Token label = {0};
+    if (match(parser, TOKEN_IDENTIFIER)) {
+        label = previousToken(parser);
+        if (!findLabel(parser, label)) {
+            char message[128];
+            snprintf(message, sizeof(message), "No enclosing loop is labeled '%.*s'.", label.length, label.start);
+            errorAtToken(label, message);
+        }
+    }
+    consume(parser, TOKEN_SEMICOLON, type == NODE_STMT_BREAK
+        ? "Expect ';' after 'break'."
+        : "Expect ';' after 'continue'.");
+
+    Node* node = newNode(type, keyword);
+    node->loopJump.keyword = keyword;
+    node->loopJump.label = label;
+    return node;
+}
+
+// Try statement: try { ... } catch (name) { ... }
+static Node* tryStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' after 'try'.");
+    Node* tryBlock = block(parser);
+    consume(parser, TOKEN_CATCH, "Expect 'catch' after try block.");
+    consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'catch'.");
+    Token name = consume(parser, TOKEN_IDENTIFIER, "Expect error variable name.");
+    consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after error variable.");
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before catch block.");
+    Node* catchBlock = block(parser);
+
+    Node* node = newNode(NODE_STMT_TRY, keyword);
+    node->tryStmt.tryBlock = tryBlock;
+    node->tryStmt.catchName = name;
+    node->tryStmt.catchBlock = catchBlock;
+    node->tryStmt.slot = -1;
+    return node;
+}
+
+// Throw statement
+static Node* throwStatement(Parser* parser) {
+    Token keyword = parser->tokens[parser->current - 1];
+    Node* value = expression(parser);
+    consume(parser, TOKEN_SEMICOLON, "Expect ';' after thrown value.");
+
+    Node* node = newNode(NODE_STMT_THROW, keyword);
+    node->throwStmt.keyword = keyword;
+    node->throwStmt.value = value;
+    return node;
+}
+
+// Spawn statement: spawn f(args); runs the call as a coroutine
+static Node* spawnStatement(Parser* parser) {
+    Token keyword = parser->tokens[parser->current - 1];
+    Node* call = expression(parser);
+    if (call->type != NODE_EXPR_CALL) errorAtToken(keyword, "Expect a function call after 'spawn'.");
+    if (call->call.namedCount > 0) errorAtToken(keyword, "Can't pass named arguments to a spawned call.");
+    consume(parser, TOKEN_SEMICOLON, "Expect ';' after spawned call.");
+
+    Node* node = newNode(NODE_STMT_SPAWN, keyword);
+    node->spawnStmt.keyword = keyword;
+    node->spawnStmt.call = call;
+    return node;
+}
+
+// Defer statement: defer f(args); runs the call when the function ends,
+// with the arguments it has now
+static Node* deferStatement(Parser* parser) {
+    Token keyword = parser->tokens[parser->current - 1];
+    if (parser->functionDepth == 0) errorAtToken(keyword, "Can't use 'defer' outside of a function.");
+    Node* call = expression(parser);
+    if (call->type != NODE_EXPR_CALL) errorAtToken(keyword, "Expect a function call after 'defer'.");
+    if (call->call.namedCount > 0) errorAtToken(keyword, "Can't pass named arguments to a deferred call.");
+    consume(parser, TOKEN_SEMICOLON, "Expect ';' after deferred call.");
+
+    Node* node = newNode(NODE_STMT_DEFER, keyword);
+    node->deferStmt.keyword = keyword;
+    node->deferStmt.call = call;
+    return node;
+}
+
+// with name = resource { ... }: name is a local of the block, and
+// resource.__close__() runs when the block is left, by an error too
+static Node* withStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
+    Token name = consume(parser, TOKEN_IDENTIFIER, "Expect resource name after 'with'.");
+    consume(parser, TOKEN_EQUAL, "Expect '=' after resource name.");
+    Node* resource = expression(parser);
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' after resource.");
+    Node* body = block(parser);
+
+    Node* node = newNode(NODE_STMT_WITH, keyword);
+    node->withStmt.keyword = keyword;
+    node->withStmt.name = name;
+    node->withStmt.resource = resource;
+    node->withStmt.body = body;
+    node->withStmt.slot = -1;
+    return node;
+}
+
+// Switch statement: switch (value) { case a, b: ... default: ... }. A case
+// ends at the next one; only an explicit 'fallthrough' runs on into it.
+static Node* switchStatement(Parser* parser) {
+    Token switchKeyword = previousToken(parser);
+    consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'switch'.");
+    Node* subject = expression(parser);
+    consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after switch value.");
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before switch cases.");
+
+    Node* node = newNode(NODE_STMT_SWITCH, switchKeyword);
+    node->switchStmt.subject = subject;
+    int capacity = 4;
+    node->switchStmt.values = malloc(capacity * sizeof(Node*));
+    node->switchStmt.bodies = malloc(capacity * sizeof(Node*));
+    node->switchStmt.fallsThrough = malloc(capacity * sizeof(bool));
+    node->switchStmt.caseCount = 0;
+    bool hasDefault = false;
+
+    while (!check(parser, TOKEN_RIGHT_BRACE) && !check(parser, TOKEN_EOF)) {
+        Token keyword = parser->tokens[parser->current];
+        Node* values = NULL;
+        if (match(parser, TOKEN_CASE)) {
+            int count;
+            values = expressionList(parser, &count);
+        } else if (match(parser, TOKEN_DEFAULT)) {
+            if (hasDefault) errorAtToken(keyword, "A switch can only have one 'default'.");
+            hasDefault = true;
+        } else {
+            errorAtToken(keyword, "Expect 'case' or 'default' in switch.");
+        }
+        consume(parser, TOKEN_COLON, keyword.type == TOKEN_CASE
+            ? "Expect ':' after case values."
+            : "Expect ':' after 'default'.");
+
+        Node* body = newNode(NODE_STMT_BLOCK, previousToken(parser));
+        body->block.statements = malloc(8 * sizeof(Node*));
+        body->block.count = 0;
+        body->block.capacity = 8;
+        bool fallsThrough = false;
+        while (!check(parser, TOKEN_CASE) && !check(parser, TOKEN_DEFAULT) &&
+               !check(parser, TOKEN_RIGHT_BRACE) && !check(parser, TOKEN_EOF)) {
+            if (match(parser, TOKEN_FALLTHROUGH)) {
+                Token fallthrough = parser->tokens[parser->current - 1];
+                consume(parser, TOKEN_SEMICOLON, "Expect ';' after 'fallthrough'.");
+                if (check(parser, TOKEN_RIGHT_BRACE)) {
+                    errorAtToken(fallthrough, "Can't fall through from the last case.");
+                } else if (!check(parser, TOKEN_CASE) && !check(parser, TOKEN_DEFAULT)) {
+                    errorAtToken(fallthrough, "'fallthrough' must be the last statement of a switch case.");
+                }
+                fallsThrough = true;
+                break;
+            }
+            Node* decl = declaration(parser);
+            if (body->block.count == body->block.capacity) {
+                body->block.capacity *= 2;
+                body->block.statements = realloc(body->block.statements, body->block.capacity * sizeof(Node*));
+            }
+            body->block.statements[body->block.count++] = decl;
+        }
+        body->block.endLine = previousLine(parser);
+
+        if (node->switchStmt.caseCount == capacity) {
+            capacity *= 2;
+            node->switchStmt.values = realloc(node->switchStmt.values, capacity * sizeof(Node*));
+            node->switchStmt.bodies = realloc(node->switchStmt.bodies, capacity * sizeof(Node*));
+            node->switchStmt.fallsThrough = realloc(node->switchStmt.fallsThrough, capacity * sizeof(bool));
+        }
+        int index = node->switchStmt.caseCount++;
+        node->switchStmt.values[index] = values;
+        node->switchStmt.bodies[index] = body;
+        node->switchStmt.fallsThrough[index] = fallsThrough;
+    }
+    consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after switch cases.");
+    node->switchStmt.endLine = previousLine(parser);
     return node;
 }
 
 // If statement
 static Node* ifStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
     consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'if'.");
     Node* condition = expression(parser);
     consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after if condition.");
@@ -428,9 +1424,7 @@ static Node* ifStatement(Parser* parser) {
         elseBranch = statement(parser);
     }
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_IF;
+    Node* node = newNode(NODE_STMT_IF, keyword);
     node->ifStmt.condition = condition;
     node->ifStmt.thenBranch = thenBranch;
     node->ifStmt.elseBranch = elseBranch;
@@ -439,21 +1433,79 @@ static Node* ifStatement(Parser* parser) {
 
 // While statement
 static Node* whileStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
     consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'while'.");
     Node* condition = expression(parser);
     consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after condition.");
+    parser->loopDepth++;
     Node* body = statement(parser);
+    parser->loopDepth--;
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_WHILE;
+    Node* node = newNode(NODE_STMT_WHILE, keyword);
     node->whileStmt.condition = condition;
     node->whileStmt.body = body;
     return node;
 }
 
+// do { body } while (condition);  The ';' is optional
+static Node* doWhileStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' after 'do'.");
+    parser->loopDepth++;
+    Node* body = block(parser);
+    parser->loopDepth--;
+    consume(parser, TOKEN_WHILE, "Expect 'while' after do-while body.");
+    consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'while'.");
+    Node* condition = expression(parser);
+    consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after condition.");
+    match(parser, TOKEN_SEMICOLON);
+
+    Node* node = newNode(NODE_STMT_DO_WHILE, keyword);
+    node->whileStmt.condition = condition;
+    node->whileStmt.body = body;
+    return node;
+}
+
+// loop { body }: left only by break, return or throw
+static Node* loopStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' after 'loop'.");
+    parser->loopDepth++;
+    Node* body = block(parser);
+    parser->loopDepth--;
+
+    Node* node = newNode(NODE_STMT_LOOP, keyword);
+    node->whileStmt.condition = NULL;
+    node->whileStmt.body = body;
+    return node;
+}
+
+// For-each loop over an iterable; both spellings produce this node
+static Node* foreachNode(Token keyword, Token name, Node* collection, Node* body) {
+    Node* node = newNode(NODE_STMT_FOREACH, keyword);
+    node->foreachStmt.iterator = name;
+    node->foreachStmt.collection = collection;
+    node->foreachStmt.body = body;
+    node->foreachStmt.slot = -1; // Initialize slot
+    return node;
+}
+
 // For statement
 static Node* forStatement(Parser* parser) {
+    Token keyword = previousToken(parser);
+
+    // for name in iterable { ... }
+    if (check(parser, TOKEN_IDENTIFIER)) {
+        Token name = advance(parser);
+        consume(parser, TOKEN_IN, "Expect 'in' after loop variable.");
+        Node* collection = expression(parser);
+        consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before loop body.");
+        parser->loopDepth++;
+        Node* body = block(parser);
+        parser->loopDepth--;
+        return foreachNode(keyword, name, collection, body);
+    }
+
     consume(parser, TOKEN_LEFT_PAREN, "Expect '(' after 'for'.");
     
     Node* initializer = NULL;
@@ -466,16 +1518,10 @@ static Node* forStatement(Parser* parser) {
         if (match(parser, TOKEN_COLON)) {
             Node* collection = expression(parser);
             consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after foreach collection.");
+            parser->loopDepth++;
             Node* body = statement(parser);
-            
-            Node* node = malloc(sizeof(Node));
-            node->next = NULL;
-            node->type = NODE_STMT_FOREACH;
-            node->foreachStmt.iterator = name;
-            node->foreachStmt.collection = collection;
-            node->foreachStmt.body = body;
-            node->foreachStmt.slot = -1; // Initialize slot
-            return node;
+            parser->loopDepth--;
+            return foreachNode(keyword, name, collection, body);
         }
 
         // Standard var declaration
@@ -485,11 +1531,10 @@ static Node* forStatement(Parser* parser) {
         }
         consume(parser, TOKEN_SEMICOLON, "Expect ';' after variable declaration.");
 
-        Node* varNode = malloc(sizeof(Node));
-        varNode->next = NULL;
-        varNode->type = NODE_STMT_VAR_DECL;
+        Node* varNode = newNode(NODE_STMT_VAR_DECL, name);
         varNode->varDecl.name = name;
         varNode->varDecl.initializer = initExpr;
+        varNode->varDecl.isConst = false;
         
         initializer = varNode;
     } else {
@@ -509,11 +1554,11 @@ static Node* forStatement(Parser* parser) {
     }
     consume(parser, TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.");
 
+    parser->loopDepth++;
     Node* body = statement(parser);
+    parser->loopDepth--;
 
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_FOR;
+    Node* node = newNode(NODE_STMT_FOR, keyword);
     node->forStmt.initializer = initializer;
     node->forStmt.condition = condition;
     node->forStmt.increment = increment;
@@ -521,53 +1566,212 @@ static Node* forStatement(Parser* parser) {
     return node;
 }
 
+// name: loop  (the label already consumed). Only loops take a label, and
+// it is in scope for break and continue inside the loop's body.
+static Node* labeledStatement(Parser* parser, Token name) {
+    if (findLabel(parser, name)) {
+        char message[128];
+        snprintf(message, sizeof(message), "Label '%.*s' is already used by an enclosing loop.", name.length, name.start);
+        errorAtToken(name, message);
+    }
+    LoopLabel label = { name, parser->labels };
+    parser->labels = &label;
+    Node* loop = NULL;
+    if (match(parser, TOKEN_WHILE)) loop = whileStatement(parser);
+    else if (match(parser, TOKEN_DO)) loop = doWhileStatement(parser);
+    else if (match(parser, TOKEN_LOOP)) loop = loopStatement(parser);
+    else if (match(parser, TOKEN_FOR)) loop = forStatement(parser);
+    else errorAtToken(parser->tokens[parser->current], "Expect a loop after a label.");
+    parser->labels = label.enclosing;
+
+    if (loop->type == NODE_STMT_FOR) loop->forStmt.label = name;
+    else if (loop->type == NODE_STMT_FOREACH) loop->foreachStmt.label = name;
+    else loop->whileStmt.label = name;
+    return loop;
+}
+
 // Statement
 static Node* statement(Parser* parser) {
     if (match(parser, TOKEN_PRINT)) return printStatement(parser);
     if (match(parser, TOKEN_IF)) return ifStatement(parser);
+    if (match(parser, TOKEN_SWITCH)) return switchStatement(parser);
+    if (match(parser, TOKEN_FALLTHROUGH)) {
+        errorAtToken(parser->tokens[parser->current - 1],
+                     "'fallthrough' must be the last statement of a switch case.");
+    }
     if (match(parser, TOKEN_WHILE)) return whileStatement(parser);
+    if (match(parser, TOKEN_DO)) return doWhileStatement(parser);
+    if (match(parser, TOKEN_LOOP)) return loopStatement(parser);
     if (match(parser, TOKEN_FOR)) return forStatement(parser);
     if (match(parser, TOKEN_RETURN)) return returnStatement(parser);
+    if (match(parser, TOKEN_BREAK)) return loopJumpStatement(parser, NODE_STMT_BREAK);
+    if (match(parser, TOKEN_CONTINUE)) return loopJumpStatement(parser, NODE_STMT_CONTINUE);
+    if (match(parser, TOKEN_TRY)) return tryStatement(parser);
+    if (match(parser, TOKEN_THROW)) return throwStatement(parser);
+    if (match(parser, TOKEN_SPAWN)) return spawnStatement(parser);
+    if (match(parser, TOKEN_DEFER)) return deferStatement(parser);
+    if (match(parser, TOKEN_WITH)) return withStatement(parser);
     if (match(parser, TOKEN_LEFT_BRACE)) return block(parser);
+    if (check(parser, TOKEN_IDENTIFIER) && parser->current + 1 < parser->count &&
+        parser->tokens[parser->current + 1].type == TOKEN_COLON) {
+        Token name = advance(parser);
+        advance(parser); // ':'
+        return labeledStatement(parser, name);
+    }
 
     Node* exprStmt = expression(parser);
+    if (check(parser, TOKEN_COMMA)) {
+        exprStmt = multiAssignment(parser, exprStmt, false);
+    }
     consume(parser, TOKEN_SEMICOLON, "Expect ';' after expression.");
     exprStmt->next = NULL; // Initialize next pointer to NULL
     return exprStmt;
 }
 
+// Struct member names must be unique across fields and methods
+static void checkMemberName(Token* fields, int fieldCount, Node** methods, int methodCount, Token name) {
+    for (int i = 0; i < fieldCount; i++) {
+        if (fields[i].length == name.length && memcmp(fields[i].start, name.start, name.length) == 0) {
+            errorAtToken(name, "Struct member is already declared.");
+        }
+    }
+    for (int i = 0; i < methodCount; i++) {
+        Token other = methods[i]->function.name;
+        if (other.length == name.length && memcmp(other.start, name.start, name.length) == 0) {
+            errorAtToken(name, "Struct member is already declared.");
+        }
+    }
+}
+
+// Method in a struct body: a function whose first parameter is self,
+// bound to the receiver when it is called as obj.name(...)
+static Node* method(Parser* parser) {
+    Node* fn = function(parser);
+    fn->function.isAsync = false;
+    fn->function.isMethod = true;
+
+    Token self = {TOKEN_IDENTIFIER, "self", 4, fn->function.name.line, 0};
+    int count = fn->function.paramCount + 1;
+    fn->function.params = realloc(fn->function.params, count * sizeof(Token));
+    fn->function.defaults = realloc(fn->function.defaults, count * sizeof(Node*));
+    memmove(fn->function.params + 1, fn->function.params, (count - 1) * sizeof(Token));
+    memmove(fn->function.defaults + 1, fn->function.defaults, (count - 1) * sizeof(Node*));
+    fn->function.params[0] = self;
+    fn->function.defaults[0] = NULL;
+    fn->function.paramCount = count;
+    fn->function.requiredCount++;
+    return fn;
+}
+
 // Struct declaration
 static Node* structDeclaration(Parser* parser) {
     Token name = consume(parser, TOKEN_IDENTIFIER, "Expect struct name.");
     consume(parser, TOKEN_LEFT_BRACE, "Expect '{' before struct body.");
 
     Token* fields = malloc(8 * sizeof(Token));
+    Node** defaults = malloc(8 * sizeof(Node*));
     int count = 0;
     int capacity = 8;
+    Node** methods = NULL;
+    int methodCount = 0;
     
     while (!check(parser, TOKEN_RIGHT_BRACE) && !check(parser, TOKEN_EOF)) {
+        if (match(parser, TOKEN_FUNCTION)) {
+            Node* fn = method(parser);
+            checkMemberName(fields, count, methods, methodCount, fn->function.name);
+            methods = realloc(methods, (methodCount + 1) * sizeof(Node*));
+            methods[methodCount++] = fn;
+            continue;
+        }
         if (count == capacity) {
             capacity *= 2;
             fields = realloc(fields, capacity * sizeof(Token));
+            defaults = realloc(defaults, capacity * sizeof(Node*));
+        }
+        Token field = consume(parser, TOKEN_IDENTIFIER, "Expect field name.");
+        checkMemberName(fields, count, methods, methodCount, field);
+        // 'name = expr;' gives the field a default for struct literals
+        defaults[count] = match(parser, TOKEN_EQUAL) ? expression(parser) : NULL;
+        fields[count++] = field;
+        if (!check(parser, TOKEN_RIGHT_BRACE)) {
+            consume(parser, TOKEN_SEMICOLON, "Expect ';' after field.");
         }
-        fields[count++] = consume(parser, TOKEN_IDENTIFIER, "Expect field name.");
-        consume(parser, TOKEN_SEMICOLON, "Expect ';' after field name.");
     }
     consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after struct body.");
     
-    Node* node = malloc(sizeof(Node));
-    node->next = NULL;
-    node->type = NODE_STMT_STRUCT_DECL;
+    Node* node = newNode(NODE_STMT_STRUCT_DECL, name);
     node->structDecl.name = name;
     node->structDecl.fields = fields;
+    node->structDecl.defaults = defaults;
     node->structDecl.fieldCount = count;
+    node->structDecl.methods = methods;
+    node->structDecl.methodCount = methodCount;
+    node->structDecl.endLine = previousLine(parser);
+    return node;
+}
+
+// Enum declaration: members count up from 0, or from the last explicit value
+static Node* enumDeclaration(Parser* parser) {
+    Token keyword = previousToken(parser);
+    consume(parser, TOKEN_LEFT_BRACE, "Expect '{' after 'enum'.");
+
+    Token* names = malloc(8 * sizeof(Token));
+    int64_t* values = malloc(8 * sizeof(int64_t));
+    int count = 0;
+    int capacity = 8;
+    int64_t next = 0;
+    bool pastMax = false; // The last member was INT64_MAX, so 'next' has no value
+
+    do {
+        if (check(parser, TOKEN_RIGHT_BRACE)) break; // Trailing comma
+        Token name = consume(parser, TOKEN_IDENTIFIER, "Expect enum member name.");
+        for (int i = 0; i < count; i++) {
+            if (names[i].length == name.length && memcmp(names[i].start, name.start, name.length) == 0) {
+                errorAtToken(name, "Enum member is already declared.");
+            }
+        }
+        if (match(parser, TOKEN_EQUAL)) {
+            bool negative = match(parser, TOKEN_MINUS);
+            Token number = consume(parser, TOKEN_NUMBER, "Expect integer value for enum member.");
+            if (memchr(number.start, '.', number.length)) {
+                errorAtToken(number, "Enum values must be integers.");
+            }
+            uint64_t magnitude = 0;
+            if (!integerLiteral(number, &magnitude) || magnitude > (uint64_t)INT64_MAX + negative) {
+                errorAtToken(number, "Enum value is too large.");
+            }
+            next = (int64_t)(negative ? 0 - magnitude : magnitude);
+            pastMax = false;
+        } else if (pastMax) {
+            errorAtToken(name, "Enum value is too large.");
+        }
+        if (count == capacity) {
+            capacity *= 2;
+            names = realloc(names, capacity * sizeof(Token));
+            values = realloc(values, capacity * sizeof(int64_t));
+        }
+        names[count] = name;
+        values[count] = next;
+        if (next == INT64_MAX) pastMax = true;
+        else next++;
+        count++;
+    } while (match(parser, TOKEN_COMMA));
+    consume(parser, TOKEN_RIGHT_BRACE, "Expect '}' after enum members.");
+
+    Node* node = newNode(NODE_STMT_ENUM_DECL, keyword);
+    node->enumDecl.names = names;
+    node->enumDecl.values = values;
+    node->enumDecl.count = count;
+    node->enumDecl.endLine = previousLine(parser);
     return node;
 }
 
 // Declaration (var or stmt or function)
 static Node* declaration(Parser* parser) {
     if (match(parser, TOKEN_STRUCT)) return structDeclaration(parser);
+    if (match(parser, TOKEN_ENUM)) return enumDeclaration(parser);
     if (match(parser, TOKEN_VAR)) return varDeclaration(parser);
+    if (match(parser, TOKEN_CONST)) return constDeclaration(parser);
     if (match(parser, TOKEN_IMPORT)) {
         Token module;
         if (check(parser, TOKEN_STRING)) {
@@ -579,9 +1783,7 @@ static Node* declaration(Parser* parser) {
         Token alias = consume(parser, TOKEN_IDENTIFIER, "Expect alias after 'as'.");
         consume(parser, TOKEN_SEMICOLON, "Expect ';' after import statement.");
 
-        Node* node = malloc(sizeof(Node));
-        node->next = NULL;
-        node->type = NODE_STMT_IMPORT;
+        Node* node = newNode(NODE_STMT_IMPORT, module);
         node->importStmt.module = module;
         node->importStmt.alias = alias;
         return node;
@@ -594,7 +1796,10 @@ static Node* declaration(Parser* parser) {
         fn->function.isAsync = true;
         return fn;
     }
-    if (match(parser, TOKEN_FUNCTION)) {
+    // 'function(' starts a function expression, not a declaration
+    if (check(parser, TOKEN_FUNCTION) && !(parser->current + 1 < parser->count &&
+                                           parser->tokens[parser->current + 1].type == TOKEN_LEFT_PAREN)) {
+        advance(parser);
         Node* fn = function(parser);
         fn->function.isAsync = false;
         return fn;
@@ -602,16 +1807,24 @@ static Node* declaration(Parser* parser) {
     return statement(parser);
 }
 
+// The array literal's kind is declared among the statements
+bool isExpressionNode(Node* node) {
+    return node->type < NODE_STMT_VAR_DECL || node->type == NODE_EXPR_ARRAY_LITERAL;
+}
+
 // Main parse function
 Node* parse(Parser* parser) {
     // Parse top-level declarations into a block
-    Node* root = malloc(sizeof(Node));
-    root->next = NULL;
-    root->type = NODE_STMT_BLOCK;
+    Node* root = newNodeAt(NODE_STMT_BLOCK, 1, 0);
     root->block.statements = malloc(8 * sizeof(Node*));
     root->block.count = 0;
     root->block.capacity = 8;
 
+    // The lexer hands malformed input over as a token holding the message
+    for (int i = 0; i < parser->count; i++) {
+        if (parser->tokens[i].type == TOKEN_ERROR) error(parser->tokens[i].start, parser->tokens[i].line);
+    }
+
     while (!match(parser, TOKEN_EOF)) {
         Node* decl = declaration(parser);
         if (root->block.count == root->block.capacity) {
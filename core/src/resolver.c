@@ -69,6 +69,10 @@ static void declareVariable(Resolver* r, Token name, Node* node) {
              node->varDecl.slot = local->slot;
         } else if (node->type == NODE_STMT_FOREACH) {
              node->foreachStmt.slot = local->slot;
+        } else if (node->type == NODE_STMT_TRY) {
+             node->tryStmt.slot = local->slot;
+        } else if (node->type == NODE_STMT_WITH) {
+             node->withStmt.slot = local->slot;
         }
     }
 }
@@ -96,8 +100,10 @@ static void resolve(Resolver* r, Node* node);
 static void resolveFunction(Resolver* r, Node* node) {
     beginScope(r);
     // Declare params
-    if (node->type == NODE_STMT_FUNCTION) {
+    if (node->type == NODE_STMT_FUNCTION || node->type == NODE_EXPR_FUNCTION) {
         for (int i=0; i < node->function.paramCount; i++) {
+            // A default sees only the parameters before it
+            resolve(r, node->function.defaults[i]);
             declareVariable(r, node->function.params[i], NULL); // No Node for param decl
             defineVariable(r);
         }
@@ -151,13 +157,33 @@ static void resolve(Resolver* r, Node* node) {
             }
             break;
 
+        case NODE_EXPR_FUNCTION: {
+            // Like a declaration, but with no name to declare
+            Resolver funcResolver;
+            initResolver(&funcResolver);
+            beginScope(&funcResolver);
+            resolveFunction(&funcResolver, node);
+            endScope(&funcResolver);
+            break;
+        }
+
         case NODE_STMT_IF:
             resolve(r, node->ifStmt.condition);
             resolve(r, node->ifStmt.thenBranch);
             if (node->ifStmt.elseBranch) resolve(r, node->ifStmt.elseBranch);
             break;
 
+        case NODE_STMT_SWITCH:
+            resolve(r, node->switchStmt.subject);
+            for (int i = 0; i < node->switchStmt.caseCount; i++) {
+                resolve(r, node->switchStmt.values[i]); // Follows 'next'
+                resolve(r, node->switchStmt.bodies[i]);
+            }
+            break;
+
         case NODE_STMT_WHILE:
+        case NODE_STMT_DO_WHILE:
+        case NODE_STMT_LOOP:
             resolve(r, node->whileStmt.condition);
             resolve(r, node->whileStmt.body);
             break;
@@ -180,6 +206,38 @@ static void resolve(Resolver* r, Node* node) {
             endScope(r);
             break;
             
+        case NODE_STMT_TRY:
+            resolve(r, node->tryStmt.tryBlock);
+            // The caught value is a local of the catch block
+            beginScope(r);
+            declareVariable(r, node->tryStmt.catchName, node);
+            defineVariable(r);
+            resolve(r, node->tryStmt.catchBlock);
+            endScope(r);
+            break;
+
+        case NODE_STMT_THROW:
+            resolve(r, node->throwStmt.value);
+            break;
+
+        case NODE_STMT_SPAWN:
+            resolve(r, node->spawnStmt.call);
+            break;
+
+        case NODE_STMT_DEFER:
+            resolve(r, node->deferStmt.call);
+            break;
+
+        case NODE_STMT_WITH:
+            resolve(r, node->withStmt.resource);
+            // The resource is a local of a scope around the body
+            beginScope(r);
+            declareVariable(r, node->withStmt.name, node);
+            defineVariable(r);
+            resolve(r, node->withStmt.body);
+            endScope(r);
+            break;
+
         case NODE_EXPR_BINARY:
             resolve(r, node->binary.left);
             resolve(r, node->binary.right);
@@ -199,6 +257,8 @@ static void resolve(Resolver* r, Node* node) {
             break;
             
         case NODE_EXPR_UNARY: 
+        case NODE_EXPR_SPREAD:
+        case NODE_EXPR_OPTIONAL:
              resolve(r, node->unary.expr);
              break;
 
@@ -206,11 +266,21 @@ static void resolve(Resolver* r, Node* node) {
              resolve(r, node->get.object);
              break;
 
+        case NODE_EXPR_UPDATE:
+             resolve(r, node->update.target);
+             break;
+
         case NODE_EXPR_INDEX:
              resolve(r, node->index.target);
              resolve(r, node->index.index);
              break;
 
+        case NODE_EXPR_SLICE:
+             resolve(r, node->slice.target);
+             resolve(r, node->slice.start);
+             resolve(r, node->slice.end);
+             break;
+
         case NODE_STMT_INDEX_ASSIGN:
              resolve(r, node->indexAssign.target);
              resolve(r, node->indexAssign.index);
@@ -229,6 +299,11 @@ static void resolve(Resolver* r, Node* node) {
              break;
         }
 
+        case NODE_EXPR_STRUCT_LITERAL:
+             // Field defaults are evaluated where the literal is, by name
+             resolve(r, node->structLiteral.values);
+             break;
+
         case NODE_EXPR_AWAIT:
              resolve(r, node->unary.expr); // Await is unary-like structure in some parsers?
              // In parser.h: NODE_EXPR_AWAIT uses unary structure? 
@@ -246,6 +321,14 @@ static void resolve(Resolver* r, Node* node) {
         case NODE_STMT_STRUCT_DECL:
              // Struct name is global usually? Or scoped?
              // Unnarize structs are currently globals.
+             // Methods get their own frame, like functions, with self in slot 0
+             for (int i = 0; i < node->structDecl.methodCount; i++) {
+                 Resolver methodResolver;
+                 initResolver(&methodResolver);
+                 beginScope(&methodResolver);
+                 resolveFunction(&methodResolver, node->structDecl.methods[i]);
+                 endScope(&methodResolver);
+             }
              break;
 
         case NODE_STMT_PROP_ASSIGN:
@@ -0,0 +1,397 @@
+#include "scheduler.h"
+#include "bytecode/interpreter.h"
+#include <stdlib.h>
+#include <string.h>
+#include <ucontext.h>
+
+#define COROUTINE_STACK_SIZE (1024 * 1024)   // C stack of each spawned coroutine
+
+typedef struct Coroutine {
+    ucontext_t context;
+    void* cStack;               // NULL for main, which runs on the thread's own
+    ExecState state;            // Saved while not running
+    CoroutineStatus status;
+    Channel* waitingOn;         // While blocked
+    struct Coroutine* next;     // Spawn order, main first
+} Coroutine;
+
+struct Scheduler {
+    Coroutine* main;
+    Coroutine* current;
+    Value failure;              // Uncaught error of a coroutine, raised in main
+    bool failed;
+    bool failurePanicked;       // The failure is a panic
+    int failureLine;            // Where the walker was when it was raised
+    bool deadlocked;            // Every coroutine blocked: main's wait fails
+};
+
+// A new coroutine's entry point has no arguments; it finds its VM here
+static _Thread_local VM* startingVM = NULL;
+
+void saveExecState(VM* vm, ExecState* state) {
+    state->registers = vm->registers;
+    state->regTop = vm->regTop;
+    state->regBase = vm->regBase;
+    state->openUpvalues = vm->openUpvalues;
+    state->stack = vm->stack;
+    state->stackTop = vm->stackTop;
+    state->fp = vm->fp;
+    state->loopSignal = vm->loopSignal;
+    state->loopLabel = vm->loopLabel;
+    state->currentLine = vm->currentLine;
+    state->env = vm->env;
+    state->globalEnv = vm->globalEnv;
+    state->defEnv = vm->defEnv;
+    state->callStack = vm->callStack;
+    state->callStackTop = vm->callStackTop;
+    state->tryHandlers = vm->tryHandlers;
+    state->tryHandlerCount = vm->tryHandlerCount;
+    state->nativeChunk = vm->nativeChunk;
+    state->nativeIp = vm->nativeIp;
+    state->nativeCallee = vm->nativeCallee;
+    state->importing = vm->importing;
+    state->panicking = vm->panicking;
+    state->catchJump = g_catchJump;
+    state->errorJump = g_errorJump;
+}
+
+static void loadExecState(VM* vm, ExecState* state) {
+    vm->registers = state->registers;
+    vm->regTop = state->regTop;
+    vm->regBase = state->regBase;
+    vm->openUpvalues = state->openUpvalues;
+    vm->stack = state->stack;
+    vm->stackTop = state->stackTop;
+    vm->fp = state->fp;
+    vm->loopSignal = state->loopSignal;
+    vm->loopLabel = state->loopLabel;
+    vm->currentLine = state->currentLine;
+    vm->env = state->env;
+    vm->globalEnv = state->globalEnv;
+    vm->defEnv = state->defEnv;
+    vm->callStack = state->callStack;
+    vm->callStackTop = state->callStackTop;
+    vm->tryHandlers = state->tryHandlers;
+    vm->tryHandlerCount = state->tryHandlerCount;
+    vm->nativeChunk = state->nativeChunk;
+    vm->nativeIp = state->nativeIp;
+    vm->nativeCallee = state->nativeCallee;
+    vm->importing = state->importing;
+    vm->panicking = state->panicking;
+    g_catchJump = state->catchJump;
+    g_errorJump = state->errorJump;
+}
+
+// Main's stacks belong to the VM and are freed with it
+static void freeCoroutine(Scheduler* s, Coroutine* co) {
+    if (co != s->main) {
+        free(co->state.registers);
+        free(co->state.stack);
+        free(co->state.tryHandlers);
+        free(co->state.callStack);
+        free(co->cStack);
+    }
+    free(co);
+}
+
+// Free the coroutines that finished; never the one running
+static void reapFinished(Scheduler* s) {
+    Coroutine** link = &s->main->next;
+    while (*link) {
+        Coroutine* co = *link;
+        if (co->status == CO_DONE && co != s->current) {
+            *link = co->next;
+            freeCoroutine(s, co);
+        } else {
+            link = &co->next;
+        }
+    }
+}
+
+// The first ready coroutine after 'from', round-robin
+static Coroutine* nextReady(Scheduler* s, Coroutine* from) {
+    Coroutine* co = from->next ? from->next : s->main;
+    for (; co != from; co = co->next ? co->next : s->main) {
+        if (co->status == CO_READY) return co;
+    }
+    return NULL;
+}
+
+// Returns once another coroutine switches back to 'from'
+static void switchTo(VM* vm, Coroutine* from, Coroutine* to) {
+    Scheduler* s = vm->scheduler;
+    saveExecState(vm, &from->state);
+    if (from->status == CO_RUNNING) from->status = CO_READY;
+    to->status = CO_RUNNING;
+    to->waitingOn = NULL;
+    s->current = to;
+    loadExecState(vm, &to->state);
+    startingVM = vm;
+    swapcontext(&from->context, &to->context);
+    reapFinished(s);
+}
+
+static bool deadlock(VM* vm) {
+    vm->errorTraceCount = 0; // Raised at main's own call
+    nativeError(vm, "Deadlock: every coroutine is blocked.");
+    return false;
+}
+
+// Back in a coroutine after a switch: main raises what the others left it.
+// Another coroutine's failure keeps its trace and skips every try block.
+static bool resumed(VM* vm) {
+    Scheduler* s = vm->scheduler;
+    if (s->current != s->main) return true;
+    if (s->failed) {
+        s->failed = false;
+        vm->thrownValue = s->failure;
+        vm->throwPending = true;
+        vm->panicking = s->failurePanicked;
+        vm->currentLine = s->failureLine;
+        vm->limitAbort = true;
+        s->failure = NIL_VAL;
+        return false;
+    }
+    if (s->deadlocked) {
+        s->deadlocked = false;
+        return deadlock(vm);
+    }
+    return true;
+}
+
+// Run the function the coroutine was spawned with, left on its walker
+// stack by spawnCoroutine
+static bool runCoroutine(VM* vm, Value* thrown) {
+    Function* func = (Function*)AS_OBJ(vm->stack[0]);
+    Value* args = &vm->stack[1];
+    int argCount = vm->stackTop - 1;
+    vm->nativeChunk = NULL;
+    vm->nativeIp = NULL;
+    if (func->bytecodeChunk) return callProtected(vm, func, args, argCount, NULL, thrown);
+
+    // Natives and the AST walker report errors through g_catchJump
+    jmp_buf recover;
+    g_catchJump = &recover;
+    if (setjmp(recover) == 0) {
+        callFunction(vm, func, args, argCount);
+        g_catchJump = NULL;
+        return true;
+    }
+    g_catchJump = NULL;
+    *thrown = vm->throwPending ? vm->thrownValue : newError(vm, g_catchMessage);
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    vm->errorTraceCount = 0;
+    return false;
+}
+
+static void coroutineMain(void) {
+    VM* vm = startingVM;
+    Scheduler* s = vm->scheduler;
+    Coroutine* self = s->current;
+
+    Value thrown = NIL_VAL;
+    bool ok = runCoroutine(vm, &thrown);
+    self->status = CO_DONE;
+
+    Coroutine* next = s->main;
+    if (!ok) {
+        s->failure = thrown;
+        s->failed = true;
+        s->failurePanicked = vm->panicking;
+        s->failureLine = vm->currentLine;
+    } else if ((next = nextReady(s, self)) == NULL) {
+        // Everyone left is blocked, main included
+        next = s->main;
+        s->deadlocked = true;
+    }
+    switchTo(vm, self, next); // Never returns: 'self' is freed by the next one
+}
+
+// Set the coroutine to start in coroutineMain on its own C stack
+static bool prepareContext(Coroutine* co) {
+    if (getcontext(&co->context) != 0) return false;
+    co->context.uc_stack.ss_sp = co->cStack;
+    co->context.uc_stack.ss_size = COROUTINE_STACK_SIZE;
+    co->context.uc_link = NULL;
+    makecontext(&co->context, coroutineMain, 0);
+    return true;
+}
+
+static Scheduler* ensureScheduler(VM* vm) {
+    if (vm->scheduler) return vm->scheduler;
+    Scheduler* s = malloc(sizeof(Scheduler));
+    Coroutine* main = calloc(1, sizeof(Coroutine));
+    if (!s || !main) {
+        free(s);
+        free(main);
+        return NULL;
+    }
+    main->status = CO_RUNNING;
+    s->main = main;
+    s->current = main;
+    s->failure = NIL_VAL;
+    s->failed = false;
+    s->failurePanicked = false;
+    s->failureLine = 0;
+    s->deadlocked = false;
+    vm->scheduler = s;
+    return s;
+}
+
+bool spawnCoroutine(VM* vm, Value callee, Value* args, int argCount) {
+    Value receiver = NIL_VAL;
+    bool isBound = IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_BOUND_METHOD;
+    if (isBound) {
+        receiver = ((BoundMethod*)AS_OBJ(callee))->receiver;
+        callee = OBJ_VAL(((BoundMethod*)AS_OBJ(callee))->method);
+    }
+    if (!IS_OBJ(callee) || AS_OBJ(callee)->type != OBJ_FUNCTION) {
+        nativeError(vm, "spawn expects a function call, got %s.", valueTypeName(callee));
+        return false;
+    }
+
+    Scheduler* s = ensureScheduler(vm);
+    Coroutine* co = s ? calloc(1, sizeof(Coroutine)) : NULL;
+    if (co) {
+        co->cStack = malloc(COROUTINE_STACK_SIZE);
+        co->state.registers = calloc(STACK_MAX, sizeof(Value));
+        co->state.stack = malloc(sizeof(Value) * WALKER_STACK_MAX);
+        co->state.tryHandlers = malloc(sizeof(TryHandler) * TRY_HANDLER_MAX);
+        co->state.callStack = calloc(vm->maxFrames, sizeof(CallFrame));
+    }
+    if (!co || !co->cStack || !co->state.registers || !co->state.stack ||
+        !co->state.tryHandlers || !co->state.callStack || !prepareContext(co)) {
+        if (co) freeCoroutine(s, co);
+        nativeError(vm, "Out of memory starting a coroutine.");
+        return false;
+    }
+
+    // The callee and its arguments wait on the new walker stack, rooted
+    ExecState* state = &co->state;
+    state->stack[state->stackTop++] = callee;
+    if (isBound) state->stack[state->stackTop++] = receiver;
+    for (int i = 0; i < argCount; i++) state->stack[state->stackTop++] = args[i];
+    state->env = vm->env;
+    state->globalEnv = vm->globalEnv;
+    state->defEnv = vm->defEnv;
+    state->loopSignal = LOOP_SIGNAL_NONE;
+    state->currentLine = vm->currentLine;
+
+    co->status = CO_READY;
+
+    Coroutine** link = &s->main->next;
+    while (*link) link = &(*link)->next;
+    *link = co;
+    return true;
+}
+
+// Make every coroutine parked on 'ch' check it again
+static void wakeWaiters(VM* vm, Channel* ch) {
+    Scheduler* s = vm->scheduler;
+    if (!s) return;
+    for (Coroutine* co = s->main; co; co = co->next) {
+        if (co->status == CO_BLOCKED && co->waitingOn == ch) co->status = CO_READY;
+    }
+}
+
+// Block the running coroutine on 'ch' until it is woken
+static bool park(VM* vm, Channel* ch) {
+    Scheduler* s = vm->scheduler;
+    if (!s) return deadlock(vm);
+    Coroutine* self = s->current;
+    Coroutine* next = nextReady(s, self);
+    if (!next) {
+        if (self == s->main) return deadlock(vm);
+        next = s->main;
+        s->deadlocked = true;
+    }
+    self->status = CO_BLOCKED;
+    self->waitingOn = ch;
+    switchTo(vm, self, next);
+    return resumed(vm);
+}
+
+Channel* newChannel(VM* vm, int capacity) {
+    Channel* ch = ALLOCATE_OBJ(vm, Channel, OBJ_CHANNEL);
+    ch->items = NULL;
+    ch->head = 0;
+    ch->count = 0;
+    ch->itemCapacity = 0;
+    ch->capacity = capacity;
+    ch->sent = 0;
+    ch->received = 0;
+    return ch;
+}
+
+bool channelSend(VM* vm, Channel* ch, Value value) {
+    if (ch->head + ch->count == ch->itemCapacity) {
+        if (ch->head > 0) {
+            memmove(ch->items, ch->items + ch->head, sizeof(Value) * ch->count);
+            ch->head = 0;
+        } else {
+            int oldCapacity = ch->itemCapacity;
+            int newCapacity = oldCapacity < 8 ? 8 : oldCapacity * 2;
+            // Growing may collect: keep the value rooted
+            vm->stack[vm->stackTop++] = value;
+            ch->items = reallocate(vm, ch->items, sizeof(Value) * oldCapacity, sizeof(Value) * newCapacity);
+            vm->stackTop--;
+            ch->itemCapacity = newCapacity;
+        }
+    }
+    ch->items[ch->head + ch->count++] = value;
+    WRITE_BARRIER(vm, ch);
+    GEN_BARRIER_VALUE(vm, ch, value);
+    int64_t ticket = ++ch->sent;
+    wakeWaiters(vm, ch);
+
+    while (ticket - ch->received > ch->capacity) {
+        if (!park(vm, ch)) return false;
+    }
+    return true;
+}
+
+bool channelReceive(VM* vm, Channel* ch, Value* out) {
+    while (ch->count == 0) {
+        if (!park(vm, ch)) return false;
+    }
+    *out = ch->items[ch->head++];
+    if (--ch->count == 0) ch->head = 0;
+    ch->received++;
+    wakeWaiters(vm, ch);
+    return true;
+}
+
+bool yieldCoroutine(VM* vm) {
+    Scheduler* s = vm->scheduler;
+    if (!s) return true;
+    Coroutine* next = nextReady(s, s->current);
+    if (!next) return true;
+    switchTo(vm, s->current, next);
+    return resumed(vm);
+}
+
+void markCoroutines(VM* vm) {
+    Scheduler* s = vm->scheduler;
+    if (!s) return;
+    markValue(vm, s->failure);
+    for (Coroutine* co = s->main; co; co = co->next) {
+        if (co != s->current && co->status != CO_DONE) markExecState(vm, &co->state);
+    }
+}
+
+void freeScheduler(VM* vm) {
+    Scheduler* s = vm->scheduler;
+    if (!s) return;
+    // The VM frees main's stacks
+    if (s->current != s->main) loadExecState(vm, &s->main->state);
+    Coroutine* co = s->main->next;
+    while (co) {
+        Coroutine* next = co->next;
+        freeCoroutine(s, co);
+        co = next;
+    }
+    free(s->main);
+    free(s);
+    vm->scheduler = NULL;
+}
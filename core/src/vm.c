@@ -5,10 +5,29 @@
 #include <unistd.h>
 #include "vm.h"
 #include "resolver.h"
+#include "bytecode/interpreter.h"
+#include "bytecode/compiler.h"
+#include "scheduler.h"
+#include "ucore_uon.h"
+#include "ucore_http.h"
+#include "ucore_timer.h"
+#include "ucore_system.h"
+#include "ucore_json.h"
+#include "ucore_string.h"
+#include "ucore_scraper.h"
+#include "ucore_tui.h"
+#include "ucore_math.h"
+#include "ucore_time.h"
+#include "ucore_regex.h"
+#include "ucore_file.h"
+#include "ucore_random.h"
 #include <dlfcn.h>
 #include <time.h>
 #include <math.h>
+#include <stdarg.h>
 #include <stdint.h>
+#include <limits.h>
+#include <errno.h>
 
 // TABLE_SIZE and CALL_STACK_MAX are in vm.h
 
@@ -77,15 +96,73 @@ static bool futureIsDone(Future* f) {
 */
 
 
-// Optimized FNV-1a hash function for variables (faster than previous implementation)
-unsigned int hash(const char* key, int length) {
-    unsigned int hash = 2166136261u;
+// Mixed into every string hash, so which keys share a bucket differs from
+// process to process and can't be planned by whoever supplies the keys.
+// The first VM to start picks it, from UNNARIZE_HASH_SEED or at random,
+// unless setHashSeed fixed it before; then it never changes, because every
+// table and interned string in the process was hashed with it.
+static uint32_t hashSeed = 0;
+static bool hashSeedInUse = false;
+static bool hashSeedChosen = false;
+static pthread_mutex_t hashSeedLock = PTHREAD_MUTEX_INITIALIZER;
+
+static uint32_t randomHashSeed(void) {
+    uint32_t seed = 0;
+    FILE* f = fopen("/dev/urandom", "rb");
+    bool read = f && fread(&seed, sizeof(seed), 1, f) == 1;
+    if (f) fclose(f);
+    if (!read) seed = (uint32_t)time(NULL) ^ ((uint32_t)getpid() << 16) ^ (uint32_t)clock();
+    return seed;
+}
+
+static void chooseHashSeed(void) {
+    pthread_mutex_lock(&hashSeedLock);
+    if (!hashSeedChosen) {
+        const char* fixed = getenv("UNNARIZE_HASH_SEED");
+        char* end = NULL;
+        unsigned long long n = fixed ? strtoull(fixed, &end, 10) : 0;
+        if (fixed && isdigit((unsigned char)fixed[0]) && *end == '\0' && n <= UINT32_MAX) {
+            hashSeed = (uint32_t)n;
+        } else {
+            if (fixed) fprintf(stderr, "Warning: ignoring invalid UNNARIZE_HASH_SEED \"%s\"\n", fixed);
+            hashSeed = randomHashSeed();
+        }
+        hashSeedChosen = true;
+    }
+    hashSeedInUse = true;
+    pthread_mutex_unlock(&hashSeedLock);
+}
+
+bool setHashSeed(uint32_t seed) {
+    pthread_mutex_lock(&hashSeedLock);
+    bool set = !hashSeedInUse;
+    if (set) {
+        hashSeed = seed;
+        hashSeedChosen = true;
+    }
+    pthread_mutex_unlock(&hashSeedLock);
+    return set;
+}
+
+uint32_t currentHashSeed(void) {
+    chooseHashSeed();
+    return hashSeed;
+}
+
+// FNV-1a over the bytes of a string, starting from the seeded offset basis
+unsigned int hashString(const char* key, int length) {
+    unsigned int hash = 2166136261u ^ hashSeed;
     const unsigned char* data = (const unsigned char*)key;
     for (int i = 0; i < length; i++) {
         hash ^= data[i];
         hash *= 16777619;
     }
-    return hash % TABLE_SIZE;
+    return hash;
+}
+
+// Bucket of a name or key in the TABLE_SIZE-bucket tables
+unsigned int hash(const char* key, int length) {
+    return hashString(key, length) % TABLE_SIZE;
 }
 
 // Set script directory from script path
@@ -148,22 +225,10 @@ char* resolvePath(VM* vm, const char* path) {
     ((capacity) < 8 ? 8 : (capacity) * 2)
 
 // Forward declarations
+static void freeOutput(VM* vm);
 /* GC Functions moved to gc.c */
 
-Obj* allocateObject(VM* vm, size_t size, ObjType type) {
-    Obj* object = (Obj*)reallocate(vm, NULL, 0, size);
-    object->type = type;
-    object->isMarked = (vm->gcPhase == 1 || isGCActive()); // Allocate Black during Marking to prevent Stack leaks
-    object->isPermanent = false; // Default: subject to GC
-    object->generation = 0;
-    
-    // Generational allocation: add to nursery
-    object->next = vm->nursery;
-    vm->nursery = object;
-    vm->nurseryCount++;
-    
-    return object;
-}
+/* allocateObject moved to gc.c */
 
 /* markObject moved to gc.c */
 
@@ -189,6 +254,7 @@ Obj* allocateObject(VM* vm, size_t size, ObjType type) {
 
 void freeVM(VM* vm) {
     if (!vm) return;
+    freeOutput(vm);
     
     // Close external libraries
     for (int i = 0; i < vm->externHandleCount; i++) {
@@ -196,13 +262,23 @@ void freeVM(VM* vm) {
         vm->externHandles[i] = NULL;
     }
     vm->externHandleCount = 0;
+    freeScheduler(vm);
+    freeRegexCache(vm);
 
+    for (int i = 0; i < TABLE_SIZE; i++) {
+        ModuleEntry* e = vm->moduleBuckets[i];
+        while (e) {
+            ModuleEntry* next = e->next;
+            free(e->name);
+            free(e);
+            e = next;
+        }
+        vm->moduleBuckets[i] = NULL;
+    }
 
-
-    if (vm->stringPool.strings) {
+    if (vm->stringPool.slots) {
          // Strings are managed as ObjStrings and will be freed by the object loop
-         free(vm->stringPool.strings);
-         free(vm->stringPool.hashes);
+         free(vm->stringPool.slots);
          pthread_mutex_destroy(&vm->stringPool.lock);
     }
     
@@ -222,8 +298,28 @@ void freeVM(VM* vm) {
         object = next;
     }
     
+    freeBlockPool(vm);
+
+    while (vm->evalSources) {
+        EvalSource* e = vm->evalSources;
+        vm->evalSources = e->next;
+        freeAST(e->ast);
+        freeParser(&e->parser);
+        free(e->source);
+        free(e);
+    }
+
     // Free gray stack
     if (vm->grayStack) free(vm->grayStack);
+    free(vm->remembered);
+    free(vm->callStack);
+    vm->callStack = NULL;
+    free(vm->registers);
+    vm->registers = NULL;
+    free(vm->stack);
+    vm->stack = NULL;
+    free(vm->tryHandlers);
+    vm->tryHandlers = NULL;
     
      // Free value pool
     if (vm->valuePool.values) {
@@ -232,25 +328,15 @@ void freeVM(VM* vm) {
     }
 }
 // Helper to check truthiness
+// Only nil and false are falsy; 0, "" and empty collections are truthy
 static bool isTruthy(Value v) {
     if (IS_NIL(v)) return false;
     if (IS_BOOL(v)) return AS_BOOL(v);
-    if (IS_INT(v)) return AS_INT(v) != 0;
-    if (IS_FLOAT(v)) return AS_FLOAT(v) != 0.0;
-    
-    if (IS_OBJ(v)) {
-        Obj* o = AS_OBJ(v);
-        if (o->type == OBJ_STRING) return ((ObjString*)o)->length > 0;
-        // Arrays/Maps: empty? strict?
-        // Let's say all objects are true for now to match typical dynamic langs, or specific check.
-        // Unnarize original logic: true.
-        return true;
-    }
     return true; 
 }
 
-static unsigned int hashIntKey(int k) {
-    unsigned int x = (unsigned int)k;
+static unsigned int hashIntKey(int64_t k) {
+    unsigned int x = (unsigned int)k ^ (unsigned int)((uint64_t)k >> 32);
     x ^= x >> 16; x *= 0x7feb352d; x ^= x >> 15; x *= 0x846ca68b; x ^= x >> 16;
     return x % TABLE_SIZE;
 }
@@ -264,6 +350,92 @@ static unsigned int hashPointer(const void* ptr) {
     return x % TABLE_SIZE;
 }
 
+// String payloads are malloc'd directly; count them like reallocate does
+static void countBytes(VM* vm, size_t size) {
+    vm->bytesAllocated += size;
+    vm->gcTotalAllocated += size;
+    if (vm->bytesAllocated > vm->gcPeakMemory) vm->gcPeakMemory = vm->bytesAllocated;
+    if (vm->maxHeap > 0 && vm->bytesAllocated > vm->maxHeap) vm->limitCountdown = 0;
+}
+
+// A string object owning 'chars', not yet in the pool
+static ObjString* allocateString(VM* vm, char* chars, int length, unsigned int h) {
+    ObjString* strObj = ALLOCATE_OBJ(vm, ObjString, OBJ_STRING);
+    strObj->length = length;
+    strObj->hash = h;
+    strObj->chars = chars;
+    strObj->interned = false;
+    countBytes(vm, length + 1);
+    return strObj;
+}
+
+// Slot of the pooled string equal to str, or the empty slot it would take.
+// Caller holds the pool lock.
+static ObjString** poolSlot(StringPool* pool, const char* str, int length, unsigned int h) {
+    int mask = pool->capacity - 1;
+    int i = (int)(h & (unsigned int)mask);
+    for (;;) {
+        ObjString* s = pool->slots[i];
+        if (!s) return &pool->slots[i];
+        if (s->hash == h && s->length == length && memcmp(s->chars, str, length) == 0) return &pool->slots[i];
+        i = (i + 1) & mask;
+    }
+}
+
+static void poolGrow(StringPool* pool) {
+    ObjString** old = pool->slots;
+    int oldCapacity = pool->capacity;
+    pool->capacity *= 2;
+    pool->slots = calloc(pool->capacity, sizeof(ObjString*));
+    if (!pool->slots) error("Memory allocation failed for string pool.", 0);
+    for (int i = 0; i < oldCapacity; i++) {
+        if (old[i]) *poolSlot(pool, old[i]->chars, old[i]->length, old[i]->hash) = old[i];
+    }
+    free(old);
+}
+
+// The pooled string equal to chars[0..length), made from 'chars' when there
+// is none yet. 'chars' is freed when an equal string was already pooled.
+static ObjString* poolString(VM* vm, const char* str, char* chars, int length, unsigned int h) {
+    StringPool* pool = &vm->stringPool;
+
+    // Step 1: Find existing match (Lock)
+    pthread_mutex_lock(&pool->lock);
+    ObjString* found = *poolSlot(pool, str, length, h);
+    pthread_mutex_unlock(&pool->lock);
+    if (found) {
+        free(chars);
+        return found;
+    }
+
+    // Step 2: Create new (No Lock, might trigger GC)
+    bool pooled = !chars;
+    if (pooled) {
+        chars = allocateBlock(vm, length + 1);
+        memcpy(chars, str, length);
+        chars[length] = '\0';
+    }
+    ObjString* strObj = allocateString(vm, chars, length, h);
+    strObj->pooledChars = pooled;
+
+    // Step 3: Add to pool (Lock again). A collection in step 2 may have
+    // rebuilt the pool, and another thread may have added the string.
+    pthread_mutex_lock(&pool->lock);
+    ObjString** slot = poolSlot(pool, strObj->chars, length, h);
+    if (*slot) {
+        // Lost the race: abandon our duplicate; GC will collect it.
+        ObjString* existing = *slot;
+        pthread_mutex_unlock(&pool->lock);
+        return existing;
+    }
+    *slot = strObj;
+    strObj->interned = true;
+    pool->count++;
+    if (pool->count * 2 > pool->capacity) poolGrow(pool);
+    pthread_mutex_unlock(&pool->lock);
+    return strObj;
+}
+
 ObjString* internString(VM* vm, const char* str, int length) {
     if (!str) return NULL;
     if (length <= 0) length = 0;
@@ -272,64 +444,42 @@ ObjString* internString(VM* vm, const char* str, int length) {
     // collected as soon as they become unreachable. This prevents the pool
     // from pinning megabytes of intermediate concatenation results.
     if (length > 256) {
-        ObjString* strObj = ALLOCATE_OBJ(vm, ObjString, OBJ_STRING);
-        strObj->length = length;
-        strObj->hash   = hash(str, length);
-        strObj->chars  = malloc(length + 1);
-        vm->bytesAllocated += (length + 1);
-        memcpy(strObj->chars, str, length);
-        strObj->chars[length] = '\0';
-        return strObj;
+        char* chars = malloc(length + 1);
+        memcpy(chars, str, length);
+        chars[length] = '\0';
+        return allocateString(vm, chars, length, hashString(str, length));
     }
+    return poolString(vm, str, NULL, length, hashString(str, length));
+}
 
-    unsigned int h = hash(str, length);
+// String literals and names live as long as their chunk, so they are
+// interned whatever their length
+ObjString* internConstant(VM* vm, const char* str, int length) {
+    if (length <= 0) length = 0;
+    return poolString(vm, str, NULL, length, hashString(str, length));
+}
 
-    // Step 1: Find existing match (Lock)
-    pthread_mutex_lock(&vm->stringPool.lock);
-    for (int i = 0; i < vm->stringPool.count; i++) {
-        ObjString* strObj = (ObjString*)vm->stringPool.strings[i];
-         if (strObj->hash == h && strObj->length == length && memcmp(strObj->chars, str, length) == 0) {
-             pthread_mutex_unlock(&vm->stringPool.lock);
-             return strObj;
-         }
-    }
-    pthread_mutex_unlock(&vm->stringPool.lock);
-    
-    // Step 2: Create new (No Lock, might trigger GC)
-    ObjString* strObj = ALLOCATE_OBJ(vm, ObjString, OBJ_STRING);
-    strObj->length = length;
-    strObj->hash = h;
-    strObj->chars = malloc(length + 1);
-    vm->bytesAllocated += (length + 1);
-    memcpy(strObj->chars, str, length);
-    strObj->chars[length] = '\0';
-    
-    // Step 3: Add to pool (Lock again)
-    pthread_mutex_lock(&vm->stringPool.lock);
-    
-    // Double Check (in case another thread inserted it while we were allocating)
-    for (int i = 0; i < vm->stringPool.count; i++) {
-        ObjString* existing = (ObjString*)vm->stringPool.strings[i];
-         if (existing->hash == h && existing->length == length && memcmp(existing->chars, str, length) == 0) {
-             pthread_mutex_unlock(&vm->stringPool.lock);
-             // Lost the race — abandon our duplicate; GC will collect it.
-             return existing;
-         }
-    }
+// Like internString, but for a NUL-terminated buffer from malloc. A long
+// string keeps the buffer, so building one costs a single copy.
+ObjString* takeString(VM* vm, char* chars, int length) {
+    unsigned int h = hashString(chars, length);
+    if (length > 256) return allocateString(vm, chars, length, h);
+    return poolString(vm, chars, chars, length, h);
+}
 
-    if (vm->stringPool.count == vm->stringPool.capacity) {
-        int oldCap = vm->stringPool.capacity;
-        vm->stringPool.capacity = oldCap < 8 ? 8 : oldCap * 2;
-        vm->stringPool.strings = (char**)realloc(vm->stringPool.strings, sizeof(char*) * vm->stringPool.capacity);
-        vm->stringPool.hashes = (unsigned int*)realloc(vm->stringPool.hashes, sizeof(unsigned int) * vm->stringPool.capacity);
-        if (!vm->stringPool.strings || !vm->stringPool.hashes) error("Memory allocation failed for string pool.", 0);
-    }
-    vm->stringPool.strings[vm->stringPool.count] = (char*)strObj;
-    vm->stringPool.hashes[vm->stringPool.count] = h;
-    vm->stringPool.count++;
-    pthread_mutex_unlock(&vm->stringPool.lock);
-    
-    return strObj;
+Value intValue(VM* vm, int64_t n) {
+    if (INT_FITS_INLINE(n)) return INT_VAL(n);
+    ObjInt* boxed = ALLOCATE_OBJ(vm, ObjInt, OBJ_INT);
+    boxed->value = n;
+    return OBJ_VAL(boxed);
+}
+
+Value numberLiteral(VM* vm, Token token) {
+    if (memchr(token.start, '.', token.length)) return FLOAT_VAL(floatLiteral(token));
+    if (token.start[0] == '-') return intValue(vm, INT64_MIN);
+    uint64_t n = 0;
+    integerLiteral(token, &n);
+    return intValue(vm, (int64_t)n);
 }
 
 
@@ -337,7 +487,9 @@ ObjString* internString(VM* vm, const char* str, int length) {
 static void internToken(VM* vm, Token* token) {
     if (token->length > 0) {
         // Intern the token string content
-        ObjString* internedObj = internString(vm, token->start, token->length);
+        ObjString* internedObj = internConstant(vm, token->start, token->length);
+        // The AST outlives any collection and nothing else roots these
+        internedObj->obj.isPermanent = true;
         char* interned = internedObj->chars;
         // DANGEROUS CAST: We are modifying the AST in place.
         // This is safe because we own the AST and it's read-only execution after parsing.
@@ -358,14 +510,23 @@ static void internAST(VM* vm, Node* node) {
             internAST(vm, node->binary.right);
             break;
         case NODE_EXPR_UNARY:
+        case NODE_EXPR_SPREAD:
+        case NODE_EXPR_OPTIONAL:
+        case NODE_EXPR_AWAIT:
             internAST(vm, node->unary.expr);
             break;
         case NODE_EXPR_VAR:
             internToken(vm, &node->var.name);
             break;
+        case NODE_EXPR_UPDATE:
+            internAST(vm, node->update.target);
+            break;
         case NODE_EXPR_CALL:
             internAST(vm, node->call.callee);
             internAST(vm, node->call.arguments);
+            for (int i = 0; i < node->call.namedCount; i++) {
+                internToken(vm, &node->call.names[i]);
+            }
             break;
         case NODE_EXPR_GET:
             internAST(vm, node->get.object);
@@ -375,6 +536,11 @@ static void internAST(VM* vm, Node* node) {
             internAST(vm, node->index.target);
             internAST(vm, node->index.index);
             break;
+        case NODE_EXPR_SLICE:
+            internAST(vm, node->slice.target);
+            internAST(vm, node->slice.start);
+            internAST(vm, node->slice.end);
+            break;
         case NODE_STMT_VAR_DECL:
             internToken(vm, &node->varDecl.name);
             internAST(vm, node->varDecl.initializer);
@@ -391,12 +557,26 @@ static void internAST(VM* vm, Node* node) {
         case NODE_STMT_PRINT:
             internAST(vm, node->print.expr);
             break;
+        case NODE_EXPR_TERNARY:
+            internAST(vm, node->ternary.condition);
+            internAST(vm, node->ternary.thenExpr);
+            internAST(vm, node->ternary.elseExpr);
+            break;
         case NODE_STMT_IF:
             internAST(vm, node->ifStmt.condition);
             internAST(vm, node->ifStmt.thenBranch);
             internAST(vm, node->ifStmt.elseBranch);
             break;
+        case NODE_STMT_SWITCH:
+            internAST(vm, node->switchStmt.subject);
+            for (int i = 0; i < node->switchStmt.caseCount; i++) {
+                internAST(vm, node->switchStmt.values[i]); // Follows 'next'
+                internAST(vm, node->switchStmt.bodies[i]);
+            }
+            break;
         case NODE_STMT_WHILE:
+        case NODE_STMT_DO_WHILE:
+        case NODE_STMT_LOOP:
             internAST(vm, node->whileStmt.condition);
             internAST(vm, node->whileStmt.body);
             break;
@@ -412,15 +592,40 @@ static void internAST(VM* vm, Node* node) {
             }
             break;
         case NODE_STMT_FUNCTION:
+        case NODE_EXPR_FUNCTION:
             internToken(vm, &node->function.name);
             for (int i = 0; i < node->function.paramCount; i++) {
                 internToken(vm, &node->function.params[i]);
+                internAST(vm, node->function.defaults[i]);
             }
             internAST(vm, node->function.body);
             break;
         case NODE_STMT_RETURN:
             internAST(vm, node->returnStmt.value);
             break;
+        case NODE_STMT_TRY:
+            internAST(vm, node->tryStmt.tryBlock);
+            internToken(vm, &node->tryStmt.catchName);
+            internAST(vm, node->tryStmt.catchBlock);
+            break;
+        case NODE_STMT_THROW:
+            internAST(vm, node->throwStmt.value);
+            break;
+        case NODE_STMT_SPAWN:
+            internAST(vm, node->spawnStmt.call);
+            break;
+        case NODE_STMT_DEFER:
+            internAST(vm, node->deferStmt.call);
+            break;
+        case NODE_STMT_WITH:
+            internToken(vm, &node->withStmt.name);
+            internAST(vm, node->withStmt.resource);
+            internAST(vm, node->withStmt.body);
+            break;
+        case NODE_STMT_MULTI_ASSIGN:
+            internAST(vm, node->multiAssign.targets);
+            internAST(vm, node->multiAssign.values);
+            break;
         case NODE_STMT_IMPORT:
             internToken(vm, &node->importStmt.module);
             internToken(vm, &node->importStmt.alias);
@@ -428,6 +633,17 @@ static void internAST(VM* vm, Node* node) {
         case NODE_EXPR_ARRAY_LITERAL:
             internAST(vm, node->arrayLiteral.elements);
             break;
+        case NODE_EXPR_MAP_LITERAL:
+            internAST(vm, node->mapLiteral.keys);
+            internAST(vm, node->mapLiteral.values);
+            break;
+        case NODE_EXPR_STRUCT_LITERAL:
+            internToken(vm, &node->structLiteral.name);
+            for (int i = 0; i < node->structLiteral.count; i++) {
+                internToken(vm, &node->structLiteral.fields[i]);
+            }
+            internAST(vm, node->structLiteral.values);
+            break;
         case NODE_STMT_FOREACH:
             internToken(vm, &node->foreachStmt.iterator);
             internAST(vm, node->foreachStmt.collection);
@@ -437,6 +653,15 @@ static void internAST(VM* vm, Node* node) {
             internToken(vm, &node->structDecl.name);
             for (int i = 0; i < node->structDecl.fieldCount; i++) {
                 internToken(vm, &node->structDecl.fields[i]);
+                internAST(vm, node->structDecl.defaults[i]);
+            }
+            for (int i = 0; i < node->structDecl.methodCount; i++) {
+                internAST(vm, node->structDecl.methods[i]);
+            }
+            break;
+        case NODE_STMT_ENUM_DECL:
+            for (int i = 0; i < node->enumDecl.count; i++) {
+                internToken(vm, &node->enumDecl.names[i]);
             }
             break;
         case NODE_STMT_PROP_ASSIGN:
@@ -450,34 +675,150 @@ static void internAST(VM* vm, Node* node) {
     internAST(vm, node->next);
 }
 
-// Module cache lookup/insert by logical module name
-/*
-static ModuleEntry* findModuleEntry(VM* vm, const char* name, int length, bool insert) {
-     unsigned int h = hashPointer(name) % TABLE_SIZE; // Assumes name is interned?
-     // Actually name might not be interned if searching.
-     // But for module registry, we typically intern keys.
-     // However, simpler hash:
-     // unsigned int h = hash(name, length) % TABLE_SIZE;
-     // vm->modules is Simple map?
-     // Let's rely on string interning for modules too?
-     return NULL;
+// Module cache lookup/insert by canonical path
+ModuleEntry* findModuleEntry(VM* vm, const char* path, bool insert) {
+    int len = (int)strlen(path);
+    unsigned int h = hash(path, len);
+    for (ModuleEntry* e = vm->moduleBuckets[h]; e; e = e->next) {
+        if (e->nameLen == len && memcmp(e->name, path, len) == 0) return e;
+    }
+    if (!insert) return NULL;
+
+    ModuleEntry* e = malloc(sizeof(ModuleEntry));
+    e->name = strdup(path);
+    e->nameLen = len;
+    e->module = NULL;
+    e->loading = false;
+    e->importer = NULL;
+    e->next = vm->moduleBuckets[h];
+    vm->moduleBuckets[h] = e;
+    return e;
 }
-*/
 
+// Forget a module whose top-level code failed, so a later import retries it
+void removeModuleEntry(VM* vm, ModuleEntry* entry) {
+    ModuleEntry** slot = &vm->moduleBuckets[hash(entry->name, entry->nameLen)];
+    while (*slot && *slot != entry) slot = &(*slot)->next;
+    if (*slot) *slot = entry->next;
+    free(entry->name);
+    free(entry);
+}
+
+// "a.unna -> b.unna -> a.unna" for an import of a module that is still loading
+void describeImportCycle(VM* vm, ModuleEntry* target, char* out, size_t size) {
+    ModuleEntry* chain[64];
+    int count = 0;
+    for (ModuleEntry* e = vm->importing; e && count < 64; e = e->importer) {
+        chain[count++] = e;
+        if (e == target) break;
+    }
+    size_t used = 0;
+    out[0] = '\0';
+    for (int i = count - 1; i >= -1 && used < size; i--) {
+        const char* name = displayPath(vm, i >= 0 ? chain[i]->name : target->name);
+        used += snprintf(out + used, size - used, "%s%s", name, i >= 0 ? " -> " : "");
+    }
+}
+
+// The tree of an imported module's source. A syntax error comes back as
+// NULL, with "Error in <path> at line N: message" in 'message' for the
+// import to throw, as eval() words its own.
+Node* parseModule(VM* vm, const char* path, const char* source, char* message, size_t size) {
+    Parser parser;
+    initParser(&parser);
+    Node* ast = NULL;
+    jmp_buf* savedCatch = g_catchJump;
+    jmp_buf parseJump;
+    g_catchJump = &parseJump;
+    if (setjmp(parseJump) == 0) {
+        Lexer lexer;
+        initLexer(&lexer, source);
+        while (true) {
+            Token token = scanToken(&lexer);
+            addToken(&parser, token);
+            if (token.type == TOKEN_EOF) break;
+        }
+        ast = parse(&parser);
+    } else {
+        snprintf(message, size, "Error in %s at line %d: %s", displayPath(vm, path), g_catchLine, g_catchMessage);
+    }
+    g_catchJump = savedCatch;
+    freeParser(&parser);
+    return ast;
+}
+
+// Absolute form of a path with "." and ".." segments removed
+bool normalizePath(const char* path, char* out, size_t size) {
+    char full[2048];
+    if (path[0] == '/') {
+        snprintf(full, sizeof(full), "%s", path);
+    } else {
+        char cwd[1024];
+        if (!getcwd(cwd, sizeof(cwd))) return false;
+        snprintf(full, sizeof(full), "%s/%s", cwd, path);
+    }
+
+    size_t len = 0;
+    const char* p = full;
+    while (*p) {
+        while (*p == '/') p++;
+        const char* start = p;
+        while (*p && *p != '/') p++;
+        size_t n = (size_t)(p - start);
+        if (n == 0 || (n == 1 && start[0] == '.')) continue;
+        if (n == 2 && start[0] == '.' && start[1] == '.') {
+            while (len > 0 && out[len - 1] != '/') len--;
+            if (len > 0) len--;
+            continue;
+        }
+        if (len + n + 2 > size) return false;
+        out[len++] = '/';
+        memcpy(out + len, start, n);
+        len += n;
+    }
+    if (len == 0) out[len++] = '/';
+    out[len] = '\0';
+    return true;
+}
 
 // Check if regular file exists
-/*
 static bool fileExists(const char* path) {
     struct stat st;
-    return stat(path, &st) == 0;
+    return stat(path, &st) == 0 && S_ISREG(st.st_mode);
 }
-*/
+
+char* resolveImportPath(VM* vm, const char* importerPath, const char* path) {
+    char candidate[2048];
+    char normal[2048];
+
+    // Next to the importing file (or the working directory without one)
+    const char* slash = importerPath ? strrchr(importerPath, '/') : NULL;
+    if (path[0] != '/' && slash) {
+        snprintf(candidate, sizeof(candidate), "%.*s/%s", (int)(slash - importerPath), importerPath, path);
+    } else {
+        snprintf(candidate, sizeof(candidate), "%s", path);
+    }
+    if (normalizePath(candidate, normal, sizeof(normal)) && fileExists(normal)) {
+        return strdup(normal);
+    }
+
+    // Under the project root
+    if (path[0] != '/') {
+        snprintf(candidate, sizeof(candidate), "%s/%s", vm->projectRoot, path);
+        if (normalizePath(candidate, normal, sizeof(normal)) && fileExists(normal)) {
+            return strdup(normal);
+        }
+    }
+    return NULL;
+}
+
 
 
 // Find or insert variable with proper scope resolution
 static VarEntry* findEntry(VM* vm, Token name, bool insert) {
-    // Assumption: name.start IS interned via internAST
-    unsigned int h = hashPointer(name.start) % TABLE_SIZE;
+    // Assumption: name.start IS interned via internAST. Variable buckets use
+    // the string hash, same as defineGlobal and the bytecode VM.
+    unsigned int h = hash(name.start, name.length);
     
     // If not inserting, search up the chain
     if (!insert) {
@@ -513,6 +854,7 @@ static VarEntry* findEntry(VM* vm, Token name, bool insert) {
         entry->ownsKey = false; // Owned by StringPool
         
         entry->value = INT_VAL(0); // Default init
+        entry->isConst = false;
         entry->next = vm->env->buckets[h];
         vm->env->buckets[h] = entry;
         return entry;
@@ -561,34 +903,9 @@ Function* findFunctionByName(VM* vm, const char* name) {
     return NULL;
 }
 
-static Function* findFunction(VM* vm, Token name) {
-    // name.start is interned
-    unsigned int h = hashPointer(name.start) % TABLE_SIZE;
-    FuncEntry* entry = vm->globalEnv->funcBuckets[h];
-    while (entry) {
-        if (entry->key == name.start) {
-            return entry->function;
-        }
-        entry = entry->next;
-    }
-    return NULL;
-}
-
-static Function* findFunctionInEnv(Environment* env, Token name) {
-    unsigned int h = hashPointer(name.start) % TABLE_SIZE;
-    FuncEntry* entry = env->funcBuckets[h];
-    while (entry) {
-        if (entry->key == name.start) {
-            return entry->function;
-        }
-        entry = entry->next;
-    }
-    return NULL;
-}
-
 // Find variable in a specific environment
 static VarEntry* findVarInEnv(Environment* env, Token name) {
-    unsigned int h = hashPointer(name.start) % TABLE_SIZE;
+    unsigned int h = hash(name.start, name.length);
     VarEntry* entry = env->buckets[h];
     while (entry) {
         if (entry->key == name.start) {
@@ -656,21 +973,68 @@ Array* newArray(VM* vm) {
     arr->items = NULL;
     arr->count = 0;
     arr->capacity = 0;
+    arr->frozen = false;
     return arr;
 }
 
 void arrayPush(VM* vm, Array* a, Value v) {
     if (a->count + 1 > a->capacity) {
         int oldCapacity = a->capacity;
-        a->capacity = GROW_CAPACITY(oldCapacity);
-        Value* newItems = (Value*)reallocate(vm, a->items, sizeof(Value) * oldCapacity, sizeof(Value) * a->capacity);
+        int newCapacity = GROW_CAPACITY(oldCapacity);
+        // Growing may collect: keep the (often freshly allocated) value rooted
+        vm->stack[vm->stackTop++] = v;
+        Value* newItems = (Value*)reallocate(vm, a->items, sizeof(Value) * oldCapacity, sizeof(Value) * newCapacity);
+        vm->stackTop--;
         if (!newItems) {
             printf("Fatal Error: Array allocation failed.\n");
             exit(1);
         }
         a->items = newItems;
+        a->capacity = newCapacity;
     }
     a->items[a->count++] = v;
+    GEN_BARRIER_VALUE(vm, a, v);
+}
+
+// Bound text for slice errors: the int as written, blank when omitted
+static const char* sliceBoundText(Value bound, char* buf, size_t size) {
+    if (IS_NIL(bound)) buf[0] = '\0';
+    else snprintf(buf, size, "%ld", (long)AS_INT(bound));
+    return buf;
+}
+
+// target[start:end] for arrays and strings. Omitted (nil) bounds default to
+// the ends and negative ones count back from the end. Returns a copy, or
+// raises with nativeError() on a bad bound.
+Value sliceValue(VM* vm, Value target, Value start, Value end) {
+    int length;
+    if (IS_ARRAY(target)) length = ((Array*)AS_OBJ(target))->count;
+    else if (IS_STRING(target)) length = AS_STRING(target)->length;
+    else return nativeError(vm, "Only arrays and strings can be sliced, got %s.", valueTypeName(target));
+
+    if ((!IS_NIL(start) && !IS_INT(start)) || (!IS_NIL(end) && !IS_INT(end))) {
+        return nativeError(vm, "Slice bounds must be integers.");
+    }
+    int64_t from = IS_NIL(start) ? 0 : AS_INT(start);
+    int64_t to = IS_NIL(end) ? length : AS_INT(end);
+    if (from < 0) from += length;
+    if (to < 0) to += length;
+    if (from < 0 || to > length || from > to) {
+        char a[24], b[24];
+        return nativeError(vm, "Slice [%s:%s] out of range for %s of length %d.",
+                           sliceBoundText(start, a, sizeof(a)), sliceBoundText(end, b, sizeof(b)),
+                           IS_ARRAY(target) ? "array" : "string", length);
+    }
+
+    if (IS_STRING(target)) {
+        return OBJ_VAL(internString(vm, AS_STRING(target)->chars + from, (int)(to - from)));
+    }
+    Array* src = (Array*)AS_OBJ(target);
+    Array* copy = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(copy); // arrayPush may collect
+    for (int64_t i = from; i < to; i++) arrayPush(vm, copy, src->items[i]);
+    vm->stackTop--;
+    return OBJ_VAL(copy);
 }
 /*
 static bool arrayPop(Array* a, Value* out) {
@@ -687,22 +1051,93 @@ bool arrayPop(Array* a, Value* out) {
 }
 
 // ---- Map helpers ----
-Map* newMap(VM* vm) {
-    Map* m = ALLOCATE_OBJ(vm, Map, OBJ_MAP);
+static Map* allocateMap(VM* vm, ObjType type) {
+    Map* m = ALLOCATE_OBJ(vm, Map, type);
     for (int i = 0; i < TABLE_SIZE; i++) m->buckets[i] = NULL;
+    m->count = 0;
+    m->frozen = false;
+    m->ordered = false;
+    m->first = NULL;
+    m->last = NULL;
     return m;
 }
-MapEntry* mapFindEntry(Map* m, const char* skey, int slen, int* bucketOut) {
-    unsigned int h = hash(skey, slen);
+
+Map* newMap(VM* vm) {
+    return allocateMap(vm, OBJ_MAP);
+}
+
+Map* newSet(VM* vm) {
+    Map* set = allocateMap(vm, OBJ_SET);
+    set->ordered = true;
+    return set;
+}
+// Built-in 'struct Error { message; }', also what runtime errors throw
+static void defineErrorStruct(VM* vm) {
+    ObjString* name = internString(vm, "Error", 5);
+    StructDef* def = ALLOCATE_OBJ(vm, StructDef, OBJ_STRUCT_DEF);
+    def->obj.isPermanent = true;
+    def->name = name->chars;
+    def->fieldCount = 1;
+    def->fields = malloc(sizeof(char*));
+    def->fields[0] = strdup("message");
+    def->defaults = NULL;
+    def->methods = NULL;
+    def->methodCount = 0;
+    def->shape = ++vm->structShapes;
+    vm->errorDef = def;
+    defineGlobal(vm, "Error", OBJ_VAL(def));
+}
+
+// New Error instance carrying 'message'
+Value newError(VM* vm, const char* message) {
+    ObjString* msg = internString(vm, message, (int)strlen(message));
+    vm->stack[vm->stackTop++] = OBJ_VAL(msg);
+    StructInstance* inst = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
+    vm->stackTop--;
+    inst->def = vm->errorDef;
+    inst->fields = malloc(sizeof(Value));
+    inst->fields[0] = OBJ_VAL(msg);
+    return OBJ_VAL(inst);
+}
+
+// Raise a catchable Error from a native function. The caller returns the
+// result (nil) at once; the VM throws when the native returns.
+Value nativeError(VM* vm, const char* format, ...) {
+    char message[256];
+    va_list args;
+    va_start(args, format);
+    vsnprintf(message, sizeof(message), format, args);
+    va_end(args);
+    vm->thrownValue = newError(vm, message);
+    vm->throwPending = true;
+    return NIL_VAL;
+}
+
+// Whether a native named 'name' got the 'expected' number of arguments;
+// false after throwing the error that says so
+bool checkArgCount(VM* vm, const char* name, int argCount, int expected) {
+    if (argCount == expected) return true;
+    nativeError(vm, "%s expects %d argument%s but got %d.",
+                name, expected, expected == 1 ? "" : "s", argCount);
+    return false;
+}
+
+static MapEntry* mapFindInBucket(Map* m, const char* skey, int slen, unsigned int h, int* bucketOut) {
     if (bucketOut) *bucketOut = (int)h;
     MapEntry* e = m->buckets[h];
     while (e) {
-        if (!e->isIntKey && e->key && (int)strlen(e->key) == slen && strncmp(e->key, skey, slen) == 0) return e;
+        if (!e->isIntKey && e->keyLength == slen && memcmp(e->key, skey, slen) == 0) return e;
         e = e->next;
     }
     return NULL;
 }
-MapEntry* mapFindEntryInt(Map* m, int ikey, int* bucketOut) {
+MapEntry* mapFindEntry(Map* m, const char* skey, int slen, int* bucketOut) {
+    return mapFindInBucket(m, skey, slen, hash(skey, slen), bucketOut);
+}
+MapEntry* mapFindString(Map* m, ObjString* key, int* bucketOut) {
+    return mapFindInBucket(m, key->chars, key->length, key->hash % TABLE_SIZE, bucketOut);
+}
+MapEntry* mapFindEntryInt(Map* m, int64_t ikey, int* bucketOut) {
     unsigned int h = hashIntKey(ikey);
     if (bucketOut) *bucketOut = (int)h;
     MapEntry* e = m->buckets[h];
@@ -712,55 +1147,160 @@ MapEntry* mapFindEntryInt(Map* m, int ikey, int* bucketOut) {
     }
     return NULL;
 }
-void mapSetStr(Map* m, const char* key, int len, Value v) {
-    int b; MapEntry* e = mapFindEntry(m, key, len, &b);
+// A new entry goes last in an ordered map; overwriting keeps its place
+static void mapAppendOrder(Map* m, MapEntry* e) {
+    e->before = NULL;
+    e->after = NULL;
+    if (!m->ordered) return;
+    e->before = m->last;
+    if (m->last) m->last->after = e;
+    else m->first = e;
+    m->last = e;
+}
+
+static void mapSetInBucket(VM* vm, Map* m, const char* key, int len, unsigned int h, Value v) {
+    GEN_BARRIER_VALUE(vm, m, v);
+    int b; MapEntry* e = mapFindInBucket(m, key, len, h, &b);
     if (e) { e->value = v; return; }
-    e = (MapEntry*)malloc(sizeof(MapEntry)); if (!e) error("Memory allocation failed.", 0);
-    e->isIntKey = false; e->intKey = 0;
-    e->key = strndup(key, len); if (!e->key) { free(e); error("Memory allocation failed.", 0);} 
+    char* copy = malloc(len + 1); if (!copy) error("Memory allocation failed.", 0);
+    memcpy(copy, key, len); copy[len] = '\0';
+    e = (MapEntry*)malloc(sizeof(MapEntry)); if (!e) { free(copy); error("Memory allocation failed.", 0); }
+    e->isIntKey = false; e->intKey = 0; e->key = copy; e->keyLength = len;
     e->value = v; e->next = m->buckets[b]; m->buckets[b] = e;
+    mapAppendOrder(m, e);
+    m->count++;
 }
-void mapSetInt(Map* m, int ikey, Value v) {
+void mapSetStr(VM* vm, Map* m, const char* key, int len, Value v) {
+    mapSetInBucket(vm, m, key, len, hash(key, len), v);
+}
+void mapSetString(VM* vm, Map* m, ObjString* key, Value v) {
+    mapSetInBucket(vm, m, key->chars, key->length, key->hash % TABLE_SIZE, v);
+}
+void mapSetInt(VM* vm, Map* m, int64_t ikey, Value v) {
+    GEN_BARRIER_VALUE(vm, m, v);
     int b; MapEntry* e = mapFindEntryInt(m, ikey, &b);
     if (e) { e->value = v; return; }
     e = (MapEntry*)malloc(sizeof(MapEntry)); if (!e) error("Memory allocation failed.", 0);
-    e->isIntKey = true; e->intKey = ikey; e->key = NULL; e->value = v; e->next = m->buckets[b]; m->buckets[b] = e;
+    e->isIntKey = true; e->intKey = ikey; e->key = NULL; e->keyLength = 0; e->value = v; e->next = m->buckets[b]; m->buckets[b] = e;
+    mapAppendOrder(m, e);
+    m->count++;
 }
-/*
-static bool mapDeleteInt(Map* m, int ikey) {
-    unsigned int h = hashInt(ikey) % TABLE_SIZE;
-    MapEntry* entry = m->buckets[h];
+// Unlink and free an entry; the bucket slot can be reused by the next insert
+static void mapUnlink(Map* m, unsigned int bucket, MapEntry* prev, MapEntry* entry) {
+    if (prev) prev->next = entry->next;
+    else m->buckets[bucket] = entry->next;
+    if (m->ordered) {
+        if (entry->before) entry->before->after = entry->after;
+        else m->first = entry->after;
+        if (entry->after) entry->after->before = entry->before;
+        else m->last = entry->before;
+    }
+    free(entry->key);
+    free(entry);
+    m->count--;
+}
+
+bool mapDeleteInt(Map* m, int64_t ikey) {
+    unsigned int h = hashIntKey(ikey);
     MapEntry* prev = NULL;
-    while (entry) {
-        if (entry->isIntKey && entry->intKey == ikey) {
-            if (prev) prev->next = entry->next;
-            else m->buckets[h] = entry->next;
-            free(entry);
-            m->count--;
+    for (MapEntry* e = m->buckets[h]; e; prev = e, e = e->next) {
+        if (e->isIntKey && e->intKey == ikey) {
+            mapUnlink(m, h, prev, e);
             return true;
         }
-        prev = entry;
-        entry = entry->next;
     }
     return false;
 }
-*/
 
+static MapEntry* firstInBuckets(Map* m, int from) {
+    for (int i = from; i < TABLE_SIZE; i++) {
+        if (m->buckets[i]) return m->buckets[i];
+    }
+    return NULL;
+}
+
+MapEntry* mapFirstEntry(Map* m) {
+    return m->ordered ? m->first : firstInBuckets(m, 0);
+}
 
-/*
-static bool mapDeleteStr(Map* m, const char* key, int len) {
-    unsigned int h = hash(key, len) % TABLE_SIZE;
-    // ... impl
+MapEntry* mapNextEntry(Map* m, MapEntry* e) {
+    if (m->ordered) return e->after;
+    if (e->next) return e->next;
+    unsigned int h = e->isIntKey ? hashIntKey(e->intKey) : hash(e->key, e->keyLength);
+    return firstInBuckets(m, (int)h + 1);
+}
+
+bool mapDeleteStr(Map* m, const char* key, int len) {
+    unsigned int h = hash(key, len);
+    MapEntry* prev = NULL;
+    for (MapEntry* e = m->buckets[h]; e; prev = e, e = e->next) {
+        if (!e->isIntKey && e->keyLength == len && memcmp(e->key, key, len) == 0) {
+            mapUnlink(m, h, prev, e);
+            return true;
+        }
+    }
     return false;
 }
-*/
+
+bool setAdd(VM* vm, Map* set, Value element) {
+    int before = set->count;
+    if (IS_INT(element)) mapSetInt(vm, set, AS_INT(element), element);
+    else mapSetString(vm, set, AS_STRING(element), element);
+    WRITE_BARRIER(vm, set);
+    return set->count > before;
+}
+
+bool setHas(Map* set, Value element) {
+    if (IS_INT(element)) return mapFindEntryInt(set, AS_INT(element), NULL) != NULL;
+    if (IS_STRING(element)) return mapFindString(set, AS_STRING(element), NULL) != NULL;
+    return false;
+}
+
+bool setRemove(Map* set, Value element) {
+    if (IS_INT(element)) return mapDeleteInt(set, AS_INT(element));
+    if (IS_STRING(element)) return mapDeleteStr(set, AS_CSTRING(element), AS_STRING(element)->length);
+    return false;
+}
+
+Map* setOperation(VM* vm, TokenType op, Map* a, Map* b) {
+    vm->stack[vm->stackTop++] = OBJ_VAL(a); // Both rooted while the result is made
+    vm->stack[vm->stackTop++] = OBJ_VAL(b);
+    Map* result = newSet(vm);
+    vm->stackTop -= 2;
+    for (MapEntry* e = a->first; e; e = e->after) {
+        bool inB = setHas(b, e->value);
+        if (op == TOKEN_PIPE || (op == TOKEN_AMPERSAND) == inB) setAdd(vm, result, e->value);
+    }
+    if (op == TOKEN_PIPE) {
+        for (MapEntry* e = b->first; e; e = e->after) setAdd(vm, result, e->value);
+    }
+    return result;
+}
+
+Value iterableOf(VM* vm, Value v) {
+    if (!IS_SET(v)) return v;
+    Map* set = (Map*)AS_OBJ(v);
+    vm->stack[vm->stackTop++] = v;
+    Array* elements = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(elements);
+    for (MapEntry* e = set->first; e; e = e->after) arrayPush(vm, elements, e->value);
+    vm->stackTop -= 2;
+    return OBJ_VAL(elements);
+}
 
 
 
 // Forward declarations
 static Value evaluate(VM* vm, Node* node);
+static Value setOfElements(VM* vm, Value* elements, int count);
 static void execute(VM* vm, Node* node);
 static void defineInEnv(VM* vm, Environment* env, Token name, Value value);
+static Environment* newBlockEnvironment(VM* vm, Environment* enclosing);
+static int pushArgs(VM* vm, Node* arg);
+static Value getProperty(VM* vm, Value obj, Token name, int line);
+static bool isInlinedBuiltin(Node* call);
+static bool pushCall(VM* vm, Node* node, int* argCount);
+static Value callValue(VM* vm, int base, int argCount, int line);
 
 // Exposed registration API for external libraries
 void registerNativeFunction(VM* vm, const char* name, Value (*function)(VM*, Value* args, int argCount)) {
@@ -787,52 +1327,224 @@ void registerNativeFunction(VM* vm, const char* name, Value (*function)(VM*, Val
     func->name.line = 0;
     func->params = NULL;
     func->paramCount = 0; // not enforced for native
+    func->requiredCount = 0;
+    func->isVariadic = false;
+    func->isMethod = false;
+    func->defaults = NULL;
     func->body = NULL;
     func->closure = NULL;
         func->native = function;
     entry->function = func;
 }
 
-// Helper to call a function
-Value callFunction(VM* vm, Function* func, Value* args, int argCount) {
-    if (func->isNative) {
-        // Direct call to native C function
-        return func->native(vm, args, argCount);
-    }
-    if (vm->callStackTop >= CALL_STACK_MAX) {
-        error("Call stack overflow.", 0);
-    }
-    
-    // Debug depth
-    // printf("Call depth: %d\n", vm->callStackTop);
-    // printf("Calling %.*s\n", func->name.length, func->name.start);
-    
-    // Create new environment for function execution
-    Environment* funcEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    funcEnv->enclosing = func->closure; // Lexical scoping from closure
-    memset(funcEnv->buckets, 0, sizeof(funcEnv->buckets));
-    memset(funcEnv->funcBuckets, 0, sizeof(funcEnv->funcBuckets));
-    
-    // Check parameter count
-    if (argCount != func->paramCount) {
-        char errorMsg[256];
-        snprintf(errorMsg, sizeof(errorMsg), "Expected %d arguments but got %d.", func->paramCount, argCount);
-        error(errorMsg, 0);
+// Raise a value left by nativeError(): same path as a 'throw' statement,
+// except that a coroutine's failure (limitAbort) skips every try block
+static void raisePending(VM* vm) {
+    if (vm->limitAbort) g_catchJump = NULL;
+    if (g_catchJump) longjmp(*g_catchJump, 1);
+    char msg[512];
+    describeThrown(vm, vm->thrownValue, msg, sizeof(msg));
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    error(msg, vm->currentLine);
+}
+
+bool deferCall(VM* vm, CallFrame* frame, Value callee, Value* args, int argCount) {
+    Value receiver = NIL_VAL;
+    bool isBound = IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_BOUND_METHOD;
+    if (isBound) {
+        receiver = ((BoundMethod*)AS_OBJ(callee))->receiver;
+        callee = OBJ_VAL(((BoundMethod*)AS_OBJ(callee))->method);
     }
-    // Check stack overflow
-    if (vm->stackTop + argCount + 64 > STACK_MAX) { // +64 safety margin
-        error("Stack overflow.", func->name.line); 
-        return NIL_VAL;
+    if (!IS_OBJ(callee) || AS_OBJ(callee)->type != OBJ_FUNCTION) {
+        nativeError(vm, "defer expects a function call, got %s.", valueTypeName(callee));
+        return false;
     }
 
-    // Push arguments to stack (They become locals 0..N-1 for the new frame)
-    int oldStackTop = vm->stackTop; // Save to restore later? No, return value replaces them
-    for (int i = 0; i < argCount; i++) {
-        vm->stack[vm->stackTop++] = args[i];
-    }
-    
+    Array* call = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(call);
+    arrayPush(vm, call, callee);
+    if (isBound) arrayPush(vm, call, receiver);
+    for (int i = 0; i < argCount; i++) arrayPush(vm, call, args[i]);
+    if (!frame->defers) frame->defers = newArray(vm);
+    arrayPush(vm, frame->defers, OBJ_VAL(call));
+    WRITE_BARRIER(vm, frame->defers);
+    vm->stackTop--;
+    return true;
+}
+
+// The error a walker longjmp carried: the thrown value, or an Error made
+// from the message of error()
+static Value takeCaughtError(VM* vm) {
+    if (!vm->throwPending) return newError(vm, g_catchMessage);
+    Value caught = vm->thrownValue;
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    return caught;
+}
+
+static Value unwindWalker(VM* vm, int depthFloor);
+
+// Call 'func' from the AST walker, catching what it throws; false with
+// *thrown set when it threw, else its result in *result when not NULL
+static bool callCaught(VM* vm, Function* func, Value* args, int argCount, Value* result, Value* thrown) {
+    jmp_buf buf;
+    jmp_buf* prevCatch = g_catchJump;
+    int savedCallStackTop = vm->callStackTop;
+    int savedStackTop = vm->stackTop;
+    int savedFp = vm->fp;
+    Environment* savedEnv = vm->env;
+    Environment* savedGlobalEnv = vm->globalEnv;
+
+    g_catchJump = &buf;
+    if (setjmp(buf) == 0) {
+        Value value = callFunction(vm, func, args, argCount);
+        g_catchJump = prevCatch;
+        if (result) *result = value;
+        return true;
+    }
+    g_catchJump = prevCatch;
+    *thrown = unwindWalker(vm, savedCallStackTop);
+    vm->callStackTop = savedCallStackTop;
+    vm->stackTop = savedStackTop;
+    vm->fp = savedFp;
+    vm->env = savedEnv;
+    vm->globalEnv = savedGlobalEnv;
+    vm->loopSignal = LOOP_SIGNAL_NONE;
+    return false;
+}
+
+// Run the calls deferred in the walker frame at 'depth', the last one
+// first. Every one runs even when one before it throws; false when any
+// threw, with the last of those errors in *failure.
+static bool runWalkerDefers(VM* vm, int depth, Value* failure) {
+    Array* defers = vm->callStack[depth].defers;
+    vm->callStack[depth].defers = NULL;
+    int root = vm->stackTop;
+    vm->stack[vm->stackTop++] = OBJ_VAL(defers);
+    vm->stack[vm->stackTop++] = NIL_VAL;
+    bool ok = true;
+    for (int i = defers->count - 1; i >= 0; i--) {
+        Value thrown = NIL_VAL;
+        Array* call = (Array*)AS_OBJ(defers->items[i]);
+        if (!callCaught(vm, (Function*)AS_OBJ(call->items[0]), call->items + 1, call->count - 1, NULL, &thrown)) {
+            vm->stack[root + 1] = thrown;
+            ok = false;
+        }
+    }
+    *failure = vm->stack[root + 1];
+    vm->stackTop = root;
+    return ok;
+}
+
+void formatArityError(Function* func, int argCount, char* buf, size_t size) {
+    // A method's self is passed for the caller, so it is left out of the counts
+    int self = func->isMethod ? 1 : 0;
+    int required = func->requiredCount - self, params = func->paramCount - self;
+    argCount -= self;
+    if (func->isVariadic) {
+        snprintf(buf, size, "Expected at least %d args but got %d.", required, argCount);
+    } else if (required == params) {
+        snprintf(buf, size, "Expected %d args but got %d.", params, argCount);
+    } else {
+        snprintf(buf, size, "Expected %d to %d args but got %d.", required, params, argCount);
+    }
+}
+
+int bindNamedArguments(Function* func, int first, Value* args, int positional, Token* names,
+                       Value* named, int namedCount, Value* out, char* buf, size_t size) {
+    if (func->isNative || !func->params) {
+        snprintf(buf, size, "Cannot pass named arguments to a native function.");
+        return -1;
+    }
+    int fixed = func->isVariadic ? func->paramCount - 1 : func->paramCount;
+    int count = positional;
+    for (int i = 0; i < positional && first + i < fixed; i++) out[i] = args[i];
+    for (int i = positional; first + i < fixed; i++) out[i] = OMITTED_VAL;
+
+    for (int j = 0; j < namedCount; j++) {
+        Token name = names[j];
+        int param = -1;
+        for (int i = first; i < func->paramCount && param == -1; i++) {
+            Token p = func->params[i];
+            if (p.length == name.length && memcmp(p.start, name.start, name.length) == 0) param = i;
+        }
+        if (param == -1) {
+            snprintf(buf, size, "Unknown parameter '%.*s'.", name.length, name.start);
+            return -1;
+        }
+        if (param >= fixed) {
+            snprintf(buf, size, "Cannot pass the rest parameter '%.*s' by name.", name.length, name.start);
+            return -1;
+        }
+        int slot = param - first;
+        if (slot < positional || out[slot] != OMITTED_VAL) {
+            snprintf(buf, size, "Argument '%.*s' is given twice.", name.length, name.start);
+            return -1;
+        }
+        out[slot] = named[j];
+        if (slot >= count) count = slot + 1;
+    }
+
+    for (int i = first; i < func->requiredCount; i++) {
+        if (i - first >= count || out[i - first] == OMITTED_VAL) {
+            Token p = func->params[i];
+            snprintf(buf, size, "Missing argument '%.*s'.", p.length, p.start);
+            return -1;
+        }
+    }
+    return count;
+}
+
+// Helper to call a function
+Value callFunction(VM* vm, Function* func, Value* args, int argCount) {
+    if (func->isNative) {
+        // Direct call to native C function
+        vm->nativeCallee = func;
+        Value result = func->native(vm, args, argCount);
+        if (vm->throwPending) raisePending(vm);
+        vm->calledValues = NIL_VAL;
+        return result;
+    }
+    int callBase = vm->stackTop;
+    bool tailCalled = false;
+tailCall:
+    if (vm->callStackTop >= vm->maxFrames) {
+        error("Stack overflow.", vm->currentLine);
+    }
+    
+    // Debug depth
+    // printf("Call depth: %d\n", vm->callStackTop);
+    // printf("Calling %.*s\n", func->name.length, func->name.start);
+    
+    // Create new environment for function execution
+    Environment* funcEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
+    funcEnv->enclosing = func->closure; // Lexical scoping from closure
+    memset(funcEnv->buckets, 0, sizeof(funcEnv->buckets));
+    memset(funcEnv->funcBuckets, 0, sizeof(funcEnv->funcBuckets));
+    
+    // Check parameter count
+    if (argCount < func->requiredCount || (argCount > func->paramCount && !func->isVariadic)) {
+        char errorMsg[128];
+        formatArityError(func, argCount, errorMsg, sizeof(errorMsg));
+        error(errorMsg, vm->currentLine);
+    }
+    // Check stack overflow
+    if (vm->stackTop + argCount + 64 > STACK_MAX) { // +64 safety margin
+        error("Stack overflow.", func->name.line); 
+        return NIL_VAL;
+    }
+
+    // A variadic function's last parameter collects the arguments past the
+    // others, so only the first 'bound' arguments bind one-to-one
+    int fixedCount = func->isVariadic ? func->paramCount - 1 : func->paramCount;
+    int bound = argCount < fixedCount ? argCount : fixedCount;
+
+    // Arguments are pushed as they are bound (they become locals 0..N-1 for the new frame)
+    int oldStackTop = vm->stackTop; // Save to restore later? No, return value replaces them
+    
     // Save current frame setup
-    if (vm->callStackTop >= CALL_STACK_MAX) {
+    if (vm->callStackTop >= vm->maxFrames) {
         error("Maximum call stack depth exceeded.", func->name.line); 
         return NIL_VAL; 
     }
@@ -843,6 +1555,13 @@ Value callFunction(VM* vm, Function* func, Value* args, int argCount) {
     frame->hasReturned = false;
     frame->returnValue = NIL_VAL;
     frame->function = func; // Root the function
+    frame->prevGlobalEnv = vm->globalEnv;
+    frame->chunk = NULL; // No bytecode call site to report
+    frame->ip = NULL;
+    frame->defers = NULL;
+    frame->catchJump = g_catchJump;
+    frame->returnsMany = false;
+    frame->tailCall = false;
     
     // Setup new frame
     vm->fp = oldStackTop; // New frame starts where arguments began
@@ -854,44 +1573,93 @@ Value callFunction(VM* vm, Function* func, Value* args, int argCount) {
     // We strictly put them on Stack. 
     // AND we probably should allow Env fallback for now to be safe with existing lookups?
     // Let's populate Env too just in case (redundant but safe for transition).
-    if (func->params) {
-        for (int i = 0; i < argCount; i++) {
-             Token param = func->params[i];
-             // Define in env (buckets)
-             char buf[64];
-             int len = param.length; if(len>63)len=63;
-             memcpy(buf, param.start, len); buf[len]=0;
-             
-             ObjString* keyStrObj = internString(vm, buf, len);
-             VarEntry* ve = malloc(sizeof(VarEntry));
-             ve->key = keyStrObj->chars;
-             ve->keyString = keyStrObj; // Store for GC marking
-             ve->keyLength = len;
-             ve->ownsKey = false;
-             ve->value = args[i];
-             ve->next = funcEnv->buckets[hashPointer(ve->key)%TABLE_SIZE];
-             funcEnv->buckets[hashPointer(ve->key)%TABLE_SIZE] = ve;
+    // An omitted argument, trailing or left out by a named call, takes its
+    // default, evaluated in the new frame after the parameters before it
+    // are bound.
+    for (int i = 0; i < fixedCount; i++) {
+        if (i >= bound || args[i] == OMITTED_VAL) {
+            Value value = evaluate(vm, func->defaults[i]);
+            vm->stack[vm->stackTop++] = value;
+            defineInEnv(vm, funcEnv, func->params[i], value);
+            continue;
         }
+        vm->stack[vm->stackTop++] = args[i];
+        if (!func->params) continue;
+        Token param = func->params[i];
+        // Define in env (buckets)
+        char buf[64];
+        int len = param.length; if(len>63)len=63;
+        memcpy(buf, param.start, len); buf[len]=0;
+
+        ObjString* keyStrObj = internString(vm, buf, len);
+        VarEntry* ve = malloc(sizeof(VarEntry));
+        ve->key = keyStrObj->chars;
+        ve->keyString = keyStrObj; // Store for GC marking
+        ve->keyLength = len;
+        ve->ownsKey = false;
+        ve->value = args[i];
+        ve->isConst = false;
+        ve->next = funcEnv->buckets[keyStrObj->hash % TABLE_SIZE];
+        funcEnv->buckets[keyStrObj->hash % TABLE_SIZE] = ve;
+        // Interning may have collected and promoted funcEnv
+        GEN_BARRIER(vm, funcEnv, keyStrObj);
+        GEN_BARRIER_VALUE(vm, funcEnv, args[i]);
     }
-    
+    if (func->isVariadic) {
+        Array* rest = newArray(vm);
+        vm->stack[vm->stackTop++] = OBJ_VAL(rest);
+        for (int i = fixedCount; i < argCount; i++) arrayPush(vm, rest, args[i]);
+        defineInEnv(vm, funcEnv, func->params[fixedCount], OBJ_VAL(rest));
+    }
+
     // Execute body
     execute(vm, func->body);
+    Value failure;
+    if (frame->defers && !runWalkerDefers(vm, vm->callStackTop - 1, &failure)) {
+        vm->thrownValue = failure;
+        vm->throwPending = true;
+        raisePending(vm);
+    }
     
     // Capture return value
     Value ret = frame->returnValue;
+    bool returnsMany = frame->returnsMany;
     
     // Restore frame
     vm->env = frame->env;
     vm->fp = frame->regBase;
     vm->stackTop = oldStackTop; // Pop args/locals
     vm->callStackTop--;
+
+    if (frame->tailCall) {
+        // 'return f(...)': f runs in this call's place, as with OP_TAILCALL,
+        // so tail recursion needs no more frames. Only the first of its
+        // values comes back, as from a plain call.
+        Array* call = (Array*)AS_OBJ(ret);
+        func = (Function*)AS_OBJ(call->items[0]);
+        argCount = call->count - 1;
+        memcpy(&vm->stack[callBase], call->items, sizeof(Value) * call->count);
+        vm->stackTop = callBase + call->count;
+        args = &vm->stack[callBase + 1];
+        vm->currentLine = frame->tailCallLine;
+        tailCalled = true;
+        goto tailCall;
+    }
+    vm->calledValues = NIL_VAL;
+    if (returnsMany) {
+        if (!tailCalled) vm->calledValues = ret; // For a caller that takes several
+        ret = ((Array*)AS_OBJ(ret))->items[0];
+    }
     
     // Environment is GC'd.
     
     // For async functions (MVP): wrap the result into an already-resolved Future
     if (func->isAsync) {
+        vm->stack[vm->stackTop++] = ret;
         Future* f = futureNew(vm);
+        vm->stackTop--;
         futureResolve(f, ret);
+        vm->calledValues = NIL_VAL;
         Value v = OBJ_VAL(f); return v;
     }
     return ret;
@@ -900,244 +1668,1312 @@ Value callFunction(VM* vm, Function* func, Value* args, int argCount) {
 // Helper for print (forward decl)
 
 
-// printValue implementation
-void printValue(Value val) {
-    if (IS_NIL(val)) { printf("nil"); return; }
+// Shortest decimal digits that read back as 'd': fixed notation for decimal
+// exponents -7..20, exponent notation outside that; "nan", "inf", "-inf"
+const char* formatDouble(double d, char* buf, size_t bufSize) {
+    if (isnan(d)) { snprintf(buf, bufSize, "nan"); return buf; }
+    if (isinf(d)) { snprintf(buf, bufSize, d < 0 ? "-inf" : "inf"); return buf; }
+    if (d == 0) { snprintf(buf, bufSize, signbit(d) ? "-0" : "0"); return buf; }
+
+    // d.ddde+XX with as few digits as round-trip
+    char sci[40];
+    for (int precision = 0; precision <= 16; precision++) {
+        snprintf(sci, sizeof(sci), "%.*e", precision, d);
+        if (strtod(sci, NULL) == d) break;
+    }
+
+    // Split into sign, digits and exponent
+    const char* p = sci;
+    bool negative = *p == '-';
+    if (negative) p++;
+    char digits[24];
+    int count = 0;
+    for (; *p && *p != 'e'; p++) {
+        if (isdigit((unsigned char)*p) && count < (int)sizeof(digits) - 1) digits[count++] = *p;
+    }
+    digits[count] = '\0';
+    while (count > 1 && digits[count - 1] == '0') digits[--count] = '\0';
+    int exponent = *p == 'e' ? atoi(p + 1) : 0;
+
+    char out[48];
+    int len = 0;
+    if (negative) out[len++] = '-';
+    if (exponent < -7 || exponent > 20) {
+        out[len++] = digits[0];
+        if (count > 1) {
+            out[len++] = '.';
+            memcpy(out + len, digits + 1, count - 1);
+            len += count - 1;
+        }
+        len += snprintf(out + len, sizeof(out) - len, "e%c%d", exponent < 0 ? '-' : '+', abs(exponent));
+    } else if (exponent < 0) {
+        // 0.000ddd
+        out[len++] = '0';
+        out[len++] = '.';
+        for (int i = 0; i < -exponent - 1; i++) out[len++] = '0';
+        memcpy(out + len, digits, count);
+        len += count;
+    } else {
+        // ddd[000][.ddd]
+        for (int i = 0; i <= exponent; i++) out[len++] = i < count ? digits[i] : '0';
+        if (count > exponent + 1) {
+            out[len++] = '.';
+            memcpy(out + len, digits + exponent + 1, count - exponent - 1);
+            len += count - exponent - 1;
+        }
+    }
+    out[len] = '\0';
+    snprintf(buf, bufSize, "%s", out);
+    return buf;
+}
+
+const char* valueToChars(Value val, char* buf, size_t bufSize) {
+    if (IS_STRING(val)) return AS_CSTRING(val);
+    if (IS_INT(val)) { snprintf(buf, bufSize, "%ld", (long)AS_INT(val)); return buf; }
+    if (IS_FLOAT(val)) return formatDouble(AS_FLOAT(val), buf, bufSize);
+    if (IS_BOOL(val)) return AS_BOOL(val) ? "true" : "false";
+    if (IS_NIL(val)) return "nil";
+    return "[object]";
+}
+
+// Text reported for an uncaught thrown value: an Error's message, else the value
+void describeThrown(VM* vm, Value thrown, char* buf, size_t bufSize) {
+    char tmp[64];
+    if (IS_OBJ(thrown) && AS_OBJ(thrown)->type == OBJ_STRUCT_INSTANCE &&
+        ((StructInstance*)AS_OBJ(thrown))->def == vm->errorDef) {
+        Value message = ((StructInstance*)AS_OBJ(thrown))->fields[0];
+        snprintf(buf, bufSize, "%s%s", vm->panicking ? "Panic: " : "", valueToChars(message, tmp, sizeof(tmp)));
+        return;
+    }
+    snprintf(buf, bufSize, "%s: %s", vm->panicking ? "Panic" : "Uncaught exception", valueToChars(thrown, tmp, sizeof(tmp)));
+}
+
+// ==========================
+// Script Output
+// ==========================
+
+// The VMs on this thread, linked through output.nextVM
+static _Thread_local VM* outputVMs = NULL;
+
+static void writeStdout(const char* data, size_t length, void* userData) {
+    (void)userData;
+    fwrite(data, 1, length, stdout);
+    fflush(stdout);
+}
+
+// exit() from anywhere (exit(), a fatal error) still writes what was printed
+static void flushOutputAtExit(void) {
+    flushAllOutput();
+}
+
+static void registerOutputFlush(void) {
+    atexit(flushOutputAtExit);
+}
+
+static void initOutput(VM* vm) {
+    static pthread_once_t atExitOnce = PTHREAD_ONCE_INIT;
+    pthread_once(&atExitOnce, registerOutputFlush);
+    vm->output.length = 0;
+    vm->output.write = NULL;
+    vm->output.userData = NULL;
+    vm->output.flushEachLine = isatty(STDOUT_FILENO);
+    for (VM* v = outputVMs; v; v = v->output.nextVM) {
+        if (v == vm) return; // Already listed: initialized again without freeVM
+    }
+    vm->output.nextVM = outputVMs;
+    outputVMs = vm;
+}
+
+static void freeOutput(VM* vm) {
+    flushOutput(vm);
+    for (VM** link = &outputVMs; *link; link = &(*link)->output.nextVM) {
+        if (*link == vm) {
+            *link = vm->output.nextVM;
+            break;
+        }
+    }
+}
+
+void flushOutput(VM* vm) {
+    OutputBuffer* out = &vm->output;
+    if (out->length == 0) return;
+    size_t length = out->length;
+    out->length = 0;
+    (out->write ? out->write : writeStdout)(out->data, length, out->userData);
+}
+
+void flushAllOutput(void) {
+    for (VM* v = outputVMs; v; v = v->output.nextVM) flushOutput(v);
+}
+
+void writeOutput(VM* vm, const char* data, size_t length) {
+    OutputBuffer* out = &vm->output;
+    noteIOProgress(vm);
+    if (out->length + length > OUTPUT_BUFFER_SIZE) {
+        flushOutput(vm);
+        if (length >= OUTPUT_BUFFER_SIZE) {
+            // Too big to be worth copying: straight to the writer
+            (out->write ? out->write : writeStdout)(data, length, out->userData);
+            return;
+        }
+    }
+    memcpy(out->data + out->length, data, length);
+    out->length += length;
+}
+
+static void writeOutputString(VM* vm, const char* text) {
+    writeOutput(vm, text, strlen(text));
+}
+
+void writeOutputf(VM* vm, const char* format, ...) {
+    char buf[256];
+    va_list args;
+    va_start(args, format);
+    int n = vsnprintf(buf, sizeof(buf), format, args);
+    va_end(args);
+    if (n < 0) return;
+    if ((size_t)n < sizeof(buf)) {
+        writeOutput(vm, buf, (size_t)n);
+        return;
+    }
+    char* big = malloc((size_t)n + 1);
+    va_start(args, format);
+    vsnprintf(big, (size_t)n + 1, format, args);
+    va_end(args);
+    writeOutput(vm, big, (size_t)n);
+    free(big);
+}
+
+void printValue(VM* vm, Value val) {
     switch (getValueType(val)) {
-        case VAL_BOOL: printf(AS_BOOL(val) ? "true" : "false"); break;
-        case VAL_INT: printf("%ld", (long)AS_INT(val)); break;
-        case VAL_FLOAT: printf("%.14g", AS_FLOAT(val)); break;
+        case VAL_NIL: writeOutputString(vm, "nil"); break;
+        case VAL_BOOL: writeOutputString(vm, AS_BOOL(val) ? "true" : "false"); break;
+        case VAL_INT: writeOutputf(vm, "%ld", (long)AS_INT(val)); break;
+        case VAL_FLOAT: {
+            char buf[48];
+            writeOutputString(vm, formatDouble(AS_FLOAT(val), buf, sizeof(buf)));
+            break;
+        }
         case VAL_OBJ: {
             Obj* o = AS_OBJ(val);
             if (IS_STRING(val)) {
-                printf("%s", AS_CSTRING(val));
+                ObjString* str = AS_STRING(val);
+                writeOutput(vm, str->chars, (size_t)str->length);
             } else if (o->type == OBJ_ARRAY) {
                 // Print array contents
                 Array* arr = (Array*)o;
-                printf("[");
-                for (int i = 0; i < arr->count; i++) {
-                    if (i > 0) printf(", ");
-                    printValue(arr->items[i]);
+                writeOutputString(vm, "[");
+                for (int i = 0; i < arr->count && !vm->throwPending; i++) {
+                    if (i > 0) writeOutputString(vm, ", ");
+                    printValue(vm, arr->items[i]);
                 }
-                printf("]");
+                writeOutputString(vm, "]");
             } else if (o->type == OBJ_MAP) {
-                printf("<map>");
+                writeOutputString(vm, "<map>");
+            } else if (o->type == OBJ_SET) {
+                Map* set = (Map*)o;
+                writeOutputString(vm, "#{");
+                for (MapEntry* e = set->first; e; e = e->after) {
+                    printValue(vm, e->value);
+                    if (e->after) writeOutputString(vm, ", ");
+                }
+                writeOutputString(vm, "}");
+            } else if (o->type == OBJ_RANGE) {
+                Range* r = (Range*)o;
+                writeOutputf(vm, "range(%lld, %lld, %lld)", (long long)r->start, (long long)r->stop, (long long)r->step);
             } else if (o->type == OBJ_FUNCTION) {
                  Function* f = (Function*)o;
-                 if(f->name.start) printf("<fn %.*s>", f->name.length, f->name.start); 
-                 else printf("<script>");
+                 if (f->name.start) writeOutputf(vm, "<fn %.*s>", f->name.length, f->name.start);
+                 else writeOutputString(vm, "<script>");
+            } else if (o->type == OBJ_BOUND_METHOD) {
+                 Function* f = ((BoundMethod*)o)->method;
+                 writeOutputf(vm, "<method %.*s>", f->name.length, f->name.start);
+            } else if (o->type == OBJ_CHANNEL) {
+                writeOutputString(vm, "<channel>");
+            } else if (o->type == OBJ_STRING_BUILDER) {
+                StringBuilder* sb = (StringBuilder*)o;
+                writeOutput(vm, sb->chars, (size_t)sb->length);
+            } else if (specialMethod(val, "__str__")) {
+                ObjString* text = structString(vm, val);
+                if (text) writeOutput(vm, text->chars, (size_t)text->length);
             } else {
-                printf("<obj>");
+                writeOutputString(vm, "<obj>");
             }
             break;
         }
-        default: printf("<unknown>"); break;
+        default: writeOutputString(vm, "<unknown>"); break;
     }
 }
-// Execute statement
-static void execute(VM* vm, Node* node) {
-    if (!node) {
-        // error("Null statement.", 0);
-        return;
+
+void printLine(VM* vm, Value val) {
+    printValue(vm, val);
+    if (vm->throwPending) return; // A __str__ threw
+    writeOutput(vm, "\n", 1);
+    if (vm->output.flushEachLine) flushOutput(vm);
+}
+
+// flush(): write out what print has buffered now
+static Value nativeFlush(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (argCount != 0) return nativeError(vm, "flush() takes no arguments, got %d.", argCount);
+    flushOutput(vm);
+    return NIL_VAL;
+}
+
+// Non-logical binary operators, shared by expressions and compound assignment
+// The result of the left operand's operator method for 'op', as
+// binaryValues gives it; false when its struct defines none
+static bool structOperator(VM* vm, TokenType op, Value left, Value right, Value* result) {
+    const char* name = op == TOKEN_PLUS ? "__add__" : op == TOKEN_MINUS ? "__sub__" : op == TOKEN_STAR ? "__mul__" : NULL;
+    bool compare = op == TOKEN_EQUAL_EQUAL || op == TOKEN_BANG_EQUAL || op == TOKEN_LESS ||
+                   op == TOKEN_LESS_EQUAL || op == TOKEN_GREATER || op == TOKEN_GREATER_EQUAL;
+    if (!name && !compare) return false;
+    vm->stack[vm->stackTop++] = left; // Both rooted while the method runs
+    vm->stack[vm->stackTop++] = right;
+    bool found;
+    if (name) {
+        found = callOperator(vm, name, left, right, result);
+    } else {
+        bool holds = false;
+        found = compareOperator(vm, op, left, right, &holds);
+        *result = BOOL_VAL(holds);
     }
-    
-    switch (node->type) {
-        case NODE_STMT_VAR_DECL: {
-            Value val;
-            if (node->varDecl.initializer) {
-                val = evaluate(vm, node->varDecl.initializer);
-            } else {
-                val = NIL_VAL;
-            }
-            
-            if (node->varDecl.slot != -1) {
-                // Local variable
-                vm->stack[vm->fp + node->varDecl.slot] = val;
-                // Hybrid: also put in Env for closures
-                defineInEnv(vm, vm->env, node->varDecl.name, val);
-            } else {
-                // Global variable
-                defineGlobal(vm, node->varDecl.name.start, val);
-            }
-            break;
+    vm->stackTop -= 2;
+    if (vm->throwPending) raisePending(vm);
+    return found;
+}
+
+static Value binaryValues(VM* vm, TokenType op, Value left, Value right, int line) {
+    // A struct on the left may define the operator
+    if (IS_OBJ(left) && AS_OBJ(left)->type == OBJ_STRUCT_INSTANCE) {
+        Value result;
+        if (structOperator(vm, op, left, right, &result)) return result;
+    }
+
+    // Concatenation
+    if (op == TOKEN_PLUS && (IS_STRING(left) || IS_STRING(right))) {
+        // A struct with __str__ joins in as the text it gives
+        Value* other = IS_STRING(left) ? &right : &left;
+        if (IS_OBJ(*other) && AS_OBJ(*other)->type == OBJ_STRUCT_INSTANCE) {
+            vm->stack[vm->stackTop++] = IS_STRING(left) ? left : right; // The string, while __str__ runs
+            ObjString* text = structString(vm, *other);
+            vm->stackTop--;
+            if (vm->throwPending) raisePending(vm);
+            if (text) *other = OBJ_VAL(text);
         }
-        
-        case NODE_STMT_ASSIGN: {
-            Value val = evaluate(vm, node->assign.value);
-            
-            if (node->assign.slot != -1) {
-                // Local variable
-                if (node->assign.operator.type == TOKEN_EQUAL) {
-                    vm->stack[vm->fp + node->assign.slot] = val;
-                    // Hybrid: sync to Env if exists
-                    VarEntry* e = findEntry(vm, node->assign.name, false); 
-                    if (e) e->value = val;
-                } else {
-                    Value current = vm->stack[vm->fp + node->assign.slot];
-                    Value newVal;
-                    
-                    int currentInt = (IS_INT(current)) ? AS_INT(current) : 0; 
-                    int valInt = (IS_INT(val)) ? AS_INT(val) : 0;
-                    
-                    switch (node->assign.operator.type) {
-                        case TOKEN_PLUS_EQUAL: newVal = INT_VAL(currentInt + valInt); break;
-                        case TOKEN_MINUS_EQUAL: newVal = INT_VAL(currentInt - valInt); break;
-                        case TOKEN_STAR_EQUAL: newVal = INT_VAL(currentInt * valInt); break;
-                        case TOKEN_SLASH_EQUAL: newVal = INT_VAL(currentInt / (valInt ? valInt : 1)); break;
-                        default: newVal = val; break;
-                    }
-                    vm->stack[vm->fp + node->assign.slot] = newVal;
-                }
-            } else {
-                // Global variable
-                if (node->assign.operator.type == TOKEN_EQUAL) {
-                    defineGlobal(vm, node->assign.name.start, val);
-                } else {
-                     VarEntry* entry = findEntry(vm, node->assign.name, false);
-                     if (!entry) {
-                         // Try defineGlobal if it's implicitly allowed? No, += requires value.
-                         // But if we want to be safe:
-                         // error("Undefined variable.", 0);
-                         // For now, assume 0/nil if not found?
-                         // "Undefined variable" is better.
-                         // But wait, findEntry checks current env chain.
-                         // If we are in function, we might finding global.
-                         // My generic resolveAST fix made top-level vars globals.
-                     }
-                     
-                     Value current = entry ? entry->value : INT_VAL(0); 
-                     Value newVal;
-                     
-                     int currentInt = (IS_INT(current)) ? AS_INT(current) : 0; 
-                     int valInt = (IS_INT(val)) ? AS_INT(val) : 0;
-                     
-                     switch (node->assign.operator.type) {
-                         case TOKEN_PLUS_EQUAL: newVal = INT_VAL(currentInt + valInt); break;
-                         case TOKEN_MINUS_EQUAL: newVal = INT_VAL(currentInt - valInt); break;
-                         case TOKEN_STAR_EQUAL: newVal = INT_VAL(currentInt * valInt); break;
-                         case TOKEN_SLASH_EQUAL: newVal = INT_VAL(currentInt / (valInt ? valInt : 1)); break;
-                         default: newVal = val; break;
-                     }
-                     defineGlobal(vm, node->assign.name.start, newVal);
-                }
+        char lBuf[64], rBuf[64];
+        const char* lStr = valueToChars(left, lBuf, sizeof(lBuf));
+        const char* rStr = valueToChars(right, rBuf, sizeof(rBuf));
+        size_t lLen = IS_STRING(left) ? (size_t)AS_STRING(left)->length : strlen(lStr);
+        size_t rLen = IS_STRING(right) ? (size_t)AS_STRING(right)->length : strlen(rStr);
+        char* combined = malloc(lLen + rLen + 1);
+        memcpy(combined, lStr, lLen);
+        memcpy(combined + lLen, rStr, rLen);
+        combined[lLen + rLen] = '\0';
+        return OBJ_VAL(takeString(vm, combined, (int)(lLen + rLen)));
+    }
+
+    // Equality
+    if (op == TOKEN_EQUAL_EQUAL || op == TOKEN_BANG_EQUAL) {
+        bool eq = false;
+        if (getValueType(left) != getValueType(right)) {
+            // Numeric mixed
+            if ((IS_INT(left) || IS_FLOAT(left)) && (IS_INT(right) || IS_FLOAT(right))) {
+                double a = (IS_INT(left)) ? (double)AS_INT(left) : AS_FLOAT(left);
+                double b = (IS_INT(right)) ? (double)AS_INT(right) : AS_FLOAT(right);
+                eq = (a == b);
+            } else eq = false;
+        } else {
+            switch (getValueType(left)) {
+                case VAL_BOOL: eq = (AS_BOOL(left) == AS_BOOL(right)); break;
+                case VAL_INT: eq = (AS_INT(left) == AS_INT(right)); break;
+                case VAL_FLOAT: eq = (AS_FLOAT(left) == AS_FLOAT(right)); break;
+                case VAL_NIL: eq = true; break;
+                case VAL_OBJ:
+                    eq = IS_STRING(left) && IS_STRING(right) ? stringsEqual(AS_STRING(left), AS_STRING(right))
+                                                             : AS_OBJ(left) == AS_OBJ(right);
+                    break;
+                default: eq = false; break;
             }
-            break;
         }
-        
-        case NODE_STMT_INDEX_ASSIGN: {
-            Value target = evaluate(vm, node->indexAssign.target);
-            Value idx = evaluate(vm, node->indexAssign.index);
-            Value val = evaluate(vm, node->indexAssign.value);
-            
-            if (IS_ARRAY(target) && IS_INT(idx)) {
-                Array* a = (Array*)AS_OBJ(target);
-                if (AS_INT(idx) >= 0 && AS_INT(idx) < a->count) {
-                    a->items[AS_INT(idx)] = val;
-                } else {
-                    error("Index out of bounds.", 0);
-                }
-            } else if (IS_MAP(target)) {
-                Map* m = (Map*)AS_OBJ(target);
-                if (IS_INT(idx)) {
-                    mapSetInt(m, AS_INT(idx), val);
-                } else if (IS_STRING(idx)) {
-                    ObjString* s = (ObjString*)AS_OBJ(idx);
-                    mapSetStr(m, s->chars, s->length, val);
-                } else {
-                    error("Invalid map key.", 0);
-                }
-            } else {
-                error("Index assignment not supported.", 0);
-            }
-            break;
+        if (op == TOKEN_BANG_EQUAL) eq = !eq;
+        return BOOL_VAL(eq);
+    }
+
+    // Sets: | is the union, & the intersection and - the difference
+    if (IS_SET(left) && IS_SET(right) && (op == TOKEN_PIPE || op == TOKEN_AMPERSAND || op == TOKEN_MINUS)) {
+        return OBJ_VAL(setOperation(vm, op, (Map*)AS_OBJ(left), (Map*)AS_OBJ(right)));
+    }
+
+    // Bitwise: integers only, a double is a type error even when whole
+    if (op == TOKEN_AMPERSAND || op == TOKEN_PIPE || op == TOKEN_CARET ||
+        op == TOKEN_LESS_LESS || op == TOKEN_GREATER_GREATER) {
+        const char* sym = op == TOKEN_AMPERSAND ? "&" : op == TOKEN_PIPE ? "|" : op == TOKEN_CARET ? "^"
+                        : op == TOKEN_LESS_LESS ? "<<" : ">>";
+        char msg[128];
+        if (!IS_INT(left) || !IS_INT(right)) {
+            snprintf(msg, sizeof(msg), "Operands of '%s' must be integers, got %s and %s.", sym,
+                     valueTypeName(left), valueTypeName(right));
+            error(msg, line);
         }
-        
-        case NODE_STMT_PRINT: {
-            Value val = evaluate(vm, node->print.expr);
-            printValue(val);
-            printf("\n");
-            break;
+        int64_t a = AS_INT(left), b = AS_INT(right);
+        if ((op == TOKEN_LESS_LESS || op == TOKEN_GREATER_GREATER) && b < 0) {
+            snprintf(msg, sizeof(msg), "Shift count must not be negative, got %lld.", (long long)b);
+            error(msg, line);
         }
-        
-        case NODE_STMT_IF: {
-            Value cond = evaluate(vm, node->ifStmt.condition);
-            if (isTruthy(cond)) {
-                execute(vm, node->ifStmt.thenBranch);
-            } else if (node->ifStmt.elseBranch) {
-                execute(vm, node->ifStmt.elseBranch);
-            }
-            break;
+        switch (op) {
+            case TOKEN_AMPERSAND: return intValue(vm, a & b);
+            case TOKEN_PIPE:      return intValue(vm, a | b);
+            case TOKEN_CARET:     return intValue(vm, a ^ b);
+            case TOKEN_LESS_LESS: return intValue(vm, intShiftLeft(a, b));
+            default:              return intValue(vm, intShiftRight(a, b));
         }
-        
-        case NODE_STMT_WHILE: {
-            while (isTruthy(evaluate(vm, node->whileStmt.condition))) {
-                execute(vm, node->whileStmt.body);
+    }
+
+    // Numeric
+    if ((IS_INT(left) || IS_FLOAT(left)) && (IS_INT(right) || IS_FLOAT(right))) {
+        if (IS_INT(left) && IS_INT(right)) {
+            int64_t a = AS_INT(left); int64_t b = AS_INT(right);
+            int64_t r = 0;
+            bool fits = true;
+            switch (op) {
+                case TOKEN_PLUS: fits = intAdd(a, b, &r); break;
+                case TOKEN_MINUS: fits = intSub(a, b, &r); break;
+                case TOKEN_STAR: fits = intMul(a, b, &r); break;
+                case TOKEN_TILDE_SLASH: fits = b != -1 || a != INT64_MIN; break;
+                default: break;
             }
-            break;
-        }
-        
-        case NODE_STMT_FOR: {
-            if (node->forStmt.initializer) execute(vm, node->forStmt.initializer);
-            while (true) {
-                if (node->forStmt.condition) {
-                   if (!isTruthy(evaluate(vm, node->forStmt.condition))) break;
-                }
-                execute(vm, node->forStmt.body);
-                if (node->forStmt.increment) execute(vm, node->forStmt.increment);
+            if (!fits) {
+                const char* sym = op == TOKEN_PLUS ? "+" : op == TOKEN_MINUS ? "-" : op == TOKEN_STAR ? "*" : "~/";
+                char msg[128];
+                snprintf(msg, sizeof(msg), "Integer overflow in %lld %s %lld.", (long long)a, sym, (long long)b);
+                error(msg, line);
+            }
+            switch (op) {
+                case TOKEN_PLUS:
+                case TOKEN_MINUS:
+                case TOKEN_STAR: return intValue(vm, r);
+                case TOKEN_SLASH: if (b == 0) error("Division by zero.", line); break;
+                case TOKEN_TILDE_SLASH: if (b == 0) error("Division by zero.", line); return intValue(vm, intFloorDiv(a, b));
+                case TOKEN_PERCENT: if (b == 0) error("Modulo by zero.", line); return intValue(vm, b == -1 ? 0 : a % b);
+                case TOKEN_GREATER: return BOOL_VAL(a > b);
+                case TOKEN_GREATER_EQUAL: return BOOL_VAL(a >= b);
+                case TOKEN_LESS: return BOOL_VAL(a < b);
+                case TOKEN_LESS_EQUAL: return BOOL_VAL(a <= b);
+                default: break;
             }
-            break;
         }
+        double a = (IS_INT(left)) ? (double)AS_INT(left) : AS_FLOAT(left);
+        double b = (IS_INT(right)) ? (double)AS_INT(right) : AS_FLOAT(right);
         
-        case NODE_STMT_FOREACH: {
-             Value collection = evaluate(vm, node->foreachStmt.collection);
-             if (IS_ARRAY(collection)) {
-                 Array* arr = (Array*)AS_OBJ(collection);
-                 for (int i = 0; i < arr->count; i++) {
-                     Value val = arr->items[i];
-                     int slot = node->foreachStmt.slot;
-                     if (slot != -1) {
-                         vm->stack[vm->fp + slot] = val;
-                         defineInEnv(vm, vm->env, node->foreachStmt.iterator, val);
-                     } else {
-                         defineGlobal(vm, node->foreachStmt.iterator.start, val);
-                     }
-                     execute(vm, node->foreachStmt.body);
-                     if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) break;
-                 }
-             }
-             break;
+        switch(op) {
+            case TOKEN_PLUS: return FLOAT_VAL(a + b);
+            case TOKEN_MINUS: return FLOAT_VAL(a - b);
+            case TOKEN_STAR: return FLOAT_VAL(a * b);
+            case TOKEN_SLASH: return FLOAT_VAL(a / b);
+            case TOKEN_TILDE_SLASH: return FLOAT_VAL(floor(a / b));
+            case TOKEN_PERCENT: return FLOAT_VAL(fmod(a, b));
+            case TOKEN_GREATER: return BOOL_VAL(a > b);
+            case TOKEN_GREATER_EQUAL: return BOOL_VAL(a >= b);
+            case TOKEN_LESS: return BOOL_VAL(a < b);
+            case TOKEN_LESS_EQUAL: return BOOL_VAL(a <= b);
+            default: break;
         }
-        
-        case NODE_STMT_BLOCK: {
-            for (int i = 0; i < node->block.count; i++) {
-                execute(vm, node->block.statements[i]);
-                if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) break;
+    }
+
+    // Ordering: numbers above, strings bytewise, nothing else
+    if (op == TOKEN_LESS || op == TOKEN_LESS_EQUAL || op == TOKEN_GREATER || op == TOKEN_GREATER_EQUAL) {
+        if (IS_STRING(left) && IS_STRING(right)) {
+            int cmp = compareStrings(AS_STRING(left), AS_STRING(right));
+            switch (op) {
+                case TOKEN_LESS: return BOOL_VAL(cmp < 0);
+                case TOKEN_LESS_EQUAL: return BOOL_VAL(cmp <= 0);
+                case TOKEN_GREATER: return BOOL_VAL(cmp > 0);
+                default: return BOOL_VAL(cmp >= 0);
             }
-            break;
         }
-        
-        case NODE_STMT_FUNCTION: {
-             Function* func = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
-             func->name = node->function.name;
-             func->isNative = false;
-             func->closure = vm->env; // Capture current environment
-             func->paramCount = node->function.paramCount;
-             func->body = node->function.body;
-             
-             Value v = OBJ_VAL(func);
-             
-             char buf[64];
-             int len = node->function.name.length;
-             if (len >= 64) len = 63;
-             memcpy(buf, node->function.name.start, len); buf[len] = '\0';
-             
-             defineGlobal(vm, buf, v);
-             break;
+        const char* sym = op == TOKEN_LESS ? "<" : op == TOKEN_LESS_EQUAL ? "<=" : op == TOKEN_GREATER ? ">" : ">=";
+        char msg[128];
+        snprintf(msg, sizeof(msg), "Cannot compare %s with %s using '%s'.", valueTypeName(left), valueTypeName(right), sym);
+        error(msg, line);
+    }
+    char msg[64];
+    snprintf(msg, sizeof(msg), "Operands of '%s' must be numbers.",
+             op == TOKEN_PLUS ? "+" : op == TOKEN_MINUS ? "-" : op == TOKEN_STAR ? "*" : op == TOKEN_SLASH ? "/" :
+             op == TOKEN_TILDE_SLASH ? "~/" : "%");
+    error(msg, line);
+    return NIL_VAL;
+}
+
+// Whether every comparison of a chain like a < b < c holds. Each operand
+// is evaluated once, left to right, stopping at the first that fails;
+// *right receives the comparison's right operand for the link after it.
+static bool compareChain(VM* vm, Node* node, Value* right) {
+    Value left;
+    if (node->binary.chained) {
+        if (!compareChain(vm, node->binary.left, &left)) return false;
+    } else {
+        left = evaluate(vm, node->binary.left);
+    }
+    vm->stack[vm->stackTop++] = left; // Rooted while the right side runs
+    *right = evaluate(vm, node->binary.right);
+    vm->stackTop--;
+    return AS_BOOL(binaryValues(vm, node->binary.op.type, left, *right, node->binary.op.line));
+}
+
+// A struct instance's __index__, __setindex__ or __len__ with the instance
+// and the rest of 'args' on the stack; errors when the struct has none
+static Value callSpecial(VM* vm, const char* name, Value* args, int argCount) {
+    Function* method = specialMethod(args[0], name);
+    if (!method) {
+        char msg[256];
+        snprintf(msg, sizeof(msg), "Struct '%s' has no %s method.",
+                 ((StructInstance*)AS_OBJ(args[0]))->def->name, name);
+        error(msg, vm->currentLine);
+    }
+    int base = vm->stackTop;
+    for (int k = 0; k < argCount; k++) vm->stack[vm->stackTop++] = args[k];
+    Value result = callFunction(vm, method, &vm->stack[base], argCount);
+    vm->stackTop = base;
+    return result;
+}
+
+// target[index] as OP_GETIDX reads it: a missing map key, or any other
+// target or index type but a string, is nil
+static Value indexValue(VM* vm, Value t, Value i) {
+    if (IS_ARRAY(t) && IS_INT(i)) {
+        Array* a = (Array*)AS_OBJ(t);
+        int64_t idx = AS_INT(i);
+        if (idx < 0 || idx >= a->count) {
+            char msg[96];
+            snprintf(msg, sizeof(msg), "Index %lld out of range for array of length %d.", (long long)idx, a->count);
+            error(msg, vm->currentLine);
         }
-        
-        case NODE_STMT_STRUCT_DECL: {
-             StructDef* s = ALLOCATE_OBJ(vm, StructDef, OBJ_STRUCT_DEF);
-             
+        return a->items[idx];
+    }
+    if (IS_MAP(t)) {
+        Map* m = (Map*)AS_OBJ(t);
+        MapEntry* e = NULL;
+        if (IS_INT(i)) e = mapFindEntryInt(m, AS_INT(i), NULL);
+        else if (IS_STRING(i)) e = mapFindString(m, AS_STRING(i), NULL);
+        return e ? e->value : NIL_VAL;
+    }
+    if (IS_OBJ(t) && AS_OBJ(t)->type == OBJ_STRUCT_INSTANCE) {
+        Value args[2] = { t, i };
+        return callSpecial(vm, "__index__", args, 2);
+    }
+    if (IS_STRING(t)) {
+        error("Cannot index a string: slice it with s[i:i + 1], or use string.chars(s)[i].", vm->currentLine);
+    }
+    return NIL_VAL;
+}
+
+// A map key that is neither an int nor a string, worded as OP_SETIDX's
+static void mapKeyError(VM* vm, Value key) {
+    char msg[96];
+    snprintf(msg, sizeof(msg), "Map keys must be ints or strings, got %s.", valueTypeName(key));
+    error(msg, vm->currentLine);
+}
+
+// target[index] = val as OP_SETIDX stores it: an array grows to take an
+// index past its end, padding with nil
+static void setIndexValue(VM* vm, Value target, Value idx, Value val) {
+    if (IS_ARRAY(target) && IS_INT(idx)) {
+        Array* a = (Array*)AS_OBJ(target);
+        if (a->frozen) error("Cannot modify frozen array.", vm->currentLine);
+        int64_t i = AS_INT(idx);
+        if (i >= INT_MAX) {
+            char msg[96];
+            snprintf(msg, sizeof(msg), "Index %lld out of range for array of length %d.", (long long)i, a->count);
+            error(msg, vm->currentLine);
+        }
+        if (i < 0) return;
+        while (a->count <= i) arrayPush(vm, a, NIL_VAL);
+        a->items[i] = val;
+        GEN_BARRIER_VALUE(vm, a, val);
+    } else if (IS_MAP(target)) {
+        Map* m = (Map*)AS_OBJ(target);
+        if (m->frozen) error("Cannot modify frozen map.", vm->currentLine);
+        if (IS_INT(idx)) {
+            mapSetInt(vm, m, AS_INT(idx), val);
+        } else if (IS_STRING(idx)) {
+            mapSetString(vm, m, AS_STRING(idx), val);
+        } else {
+            mapKeyError(vm, idx);
+        }
+    } else if (IS_OBJ(target) && AS_OBJ(target)->type == OBJ_STRUCT_INSTANCE) {
+        Value args[3] = { target, idx, val };
+        callSpecial(vm, "__setindex__", args, 3);
+    } else if (IS_STRING(target)) {
+        error("Cannot assign into a string: strings can't be changed.", vm->currentLine);
+    }
+}
+
+// The binary operator behind a compound assignment token (+= -> +)
+static TokenType compoundBinaryOp(TokenType type) {
+    switch (type) {
+        case TOKEN_PLUS_EQUAL:    return TOKEN_PLUS;
+        case TOKEN_MINUS_EQUAL:   return TOKEN_MINUS;
+        case TOKEN_STAR_EQUAL:    return TOKEN_STAR;
+        case TOKEN_SLASH_EQUAL:   return TOKEN_SLASH;
+        case TOKEN_TILDE_SLASH_EQUAL: return TOKEN_TILDE_SLASH;
+        case TOKEN_PERCENT_EQUAL: return TOKEN_PERCENT;
+        default:                  return type;
+    }
+}
+
+// Where field 'name' of the struct instance 'obj' is stored; a runtime
+// error, worded as OP_SETPROP's, for anything else
+static Value* fieldSlot(Value obj, Token name, int line) {
+    char msg[160];
+    if (!IS_OBJ(obj) || AS_OBJ(obj)->type != OBJ_STRUCT_INSTANCE) {
+        error("Only struct instances have settable properties.", line);
+    }
+    StructInstance* inst = (StructInstance*)AS_OBJ(obj);
+    for (int i = 0; i < inst->def->fieldCount; i++) {
+        if ((int)strlen(inst->def->fields[i]) == name.length &&
+            memcmp(inst->def->fields[i], name.start, name.length) == 0) {
+            return &inst->fields[i];
+        }
+    }
+    snprintf(msg, sizeof(msg), "Struct '%s' has no field '%.*s'.", inst->def->name, name.length, name.start);
+    error(msg, line);
+    return NULL;
+}
+
+// A runtime error when 'entry' is a top-level const, function or enum
+// member. The compiler rejects such writes within one script; this catches
+// those from code run beside it later, by eval() or at the REPL.
+static void checkConstEntry(VarEntry* entry, Token name) {
+    if (!entry || !entry->isConst) return;
+    char msg[160];
+    snprintf(msg, sizeof(msg), "Cannot assign to constant '%.*s'", name.length, name.start);
+    errorAtToken(name, msg);
+}
+
+// Declare a variable in the innermost environment, one per call and per
+// block that declares any, which closures made there share. Outside every
+// function and block it is a global.
+static void declareVariable(VM* vm, Token name, Value val) {
+    if (vm->env != vm->globalEnv) {
+        defineInEnv(vm, vm->env, name, val);
+    } else {
+        checkConstEntry(findVarInEnv(vm->globalEnv, name), name);
+        defineGlobal(vm, name.start, val);
+    }
+}
+
+// A top-level const, function or enum member, as OP_DEFCONST defines one
+static void defineConstant(VM* vm, Token name, Value val) {
+    VarEntry* entry = findVarInEnv(vm->globalEnv, name);
+    if (entry && entry->isConst) {
+        char msg[160];
+        snprintf(msg, sizeof(msg), "Constant '%.*s' is already declared", name.length, name.start);
+        errorAtToken(name, msg);
+    }
+    defineGlobal(vm, name.start, val);
+    findVarInEnv(vm->globalEnv, name)->isConst = true;
+}
+
+// Store into an entry findEntry found. The entry doesn't know its
+// environment, so the barrier looks for it only when that can matter.
+static void setEntry(VM* vm, Token name, VarEntry* entry, Value value) {
+    checkConstEntry(entry, name);
+    entry->value = value;
+    if (!IS_OBJ(value) || AS_OBJ(value)->generation) return;
+    unsigned int h = hash(entry->key, entry->keyLength);
+    for (Environment* env = vm->env; env; env = env->enclosing) {
+        for (VarEntry* e = env->buckets[h]; e; e = e->next) {
+            if (e == entry) {
+                GEN_BARRIER(vm, env, AS_OBJ(value));
+                return;
+            }
+        }
+    }
+}
+
+// The binding 'name' refers to, searched from the innermost environment
+// out; a runtime error when there is none
+static VarEntry* lookupVariable(VM* vm, Token name) {
+    VarEntry* entry = findEntry(vm, name, false);
+    if (!entry) {
+        char msg[160];
+        snprintf(msg, sizeof(msg), "Undefined variable '%.*s'", name.length, name.start);
+        errorAtToken(name, msg);
+    }
+    return entry;
+}
+
+// Store 'value' into an assignment target: a variable, '_' to drop it,
+// an element or a struct field
+static void assignTarget(VM* vm, Node* target, Value value) {
+    int base = vm->stackTop;
+    vm->stack[vm->stackTop++] = value;
+    if (target->type == NODE_EXPR_VAR) {
+        Token name = target->var.name;
+        if (name.length == 1 && name.start[0] == '_') return;
+        // Assigning a name that was never declared makes a global
+        VarEntry* entry = findEntry(vm, name, false);
+        if (entry) {
+            setEntry(vm, name, entry, value);
+        } else {
+            defineGlobal(vm, name.start, value);
+        }
+    } else if (target->type == NODE_EXPR_INDEX) {
+        Value obj = evaluate(vm, target->index.target);
+        vm->stack[vm->stackTop++] = obj;
+        Value idx = evaluate(vm, target->index.index);
+        vm->stack[vm->stackTop++] = idx;
+        setIndexValue(vm, obj, idx, value);
+    } else if (target->type == NODE_EXPR_GET) {
+        Value obj = evaluate(vm, target->get.object);
+        *fieldSlot(obj, target->get.name, target->line) = value;
+        GEN_BARRIER_VALUE(vm, AS_OBJ(obj), value);
+    }
+    vm->stackTop = base;
+}
+
+// a, b = x, y or var a, b = x, y: every value is evaluated before any
+// target is set, so a, b = b, a swaps. A call as the last value spreads
+// its results over the targets left; missing values are nil, and surplus
+// ones are evaluated and dropped.
+static void executeMultiAssign(VM* vm, Node* node) {
+    int count = node->multiAssign.targetCount;
+    int base = vm->stackTop;
+    for (int i = 0; i < count; i++) vm->stack[vm->stackTop++] = NIL_VAL;
+    int filled = 0;
+    for (Node* v = node->multiAssign.values; v; v = v->next) {
+        Value value = evaluate(vm, v);
+        if (filled == count) continue;
+        vm->stack[base + filled] = value;
+        if (!v->next && v->type == NODE_EXPR_CALL && !IS_NIL(vm->calledValues)) {
+            Array* values = (Array*)AS_OBJ(vm->calledValues);
+            for (int i = 1; i < values->count && filled + i < count; i++) {
+                vm->stack[base + filled + i] = values->items[i];
+            }
+            vm->calledValues = NIL_VAL;
+        }
+        filled++;
+    }
+    int i = 0;
+    for (Node* t = node->multiAssign.targets; t; t = t->next, i++) {
+        if (node->multiAssign.isDecl) {
+            declareVariable(vm, t->var.name, vm->stack[base + i]);
+        } else {
+            assignTarget(vm, t, vm->stack[base + i]);
+        }
+    }
+    vm->stackTop = base;
+}
+
+// return: several values go back packed in an array. A call that the
+// compiler makes an OP_TAILCALL leaves [callee, args...] for callFunction
+// to run in this call's place, unless a try or with, which must stay
+// around the call, or deferred calls, which run after it, are pending.
+static void executeReturn(VM* vm, Node* node) {
+    CallFrame* frame = &vm->callStack[vm->callStackTop - 1];
+    Node* value = node->returnStmt.value;
+    int base = vm->stackTop;
+    frame->returnValue = NIL_VAL;
+    if (node->returnStmt.count > 1) {
+        Array* values = newArray(vm);
+        frame->returnValue = OBJ_VAL(values);
+        for (; value; value = value->next) {
+            vm->stack[vm->stackTop++] = evaluate(vm, value);
+            arrayPush(vm, values, vm->stack[base]);
+            vm->stackTop = base;
+        }
+        frame->returnsMany = true;
+    } else if (value && value->type == NODE_EXPR_CALL && !isInlinedBuiltin(value) &&
+               value->call.namedCount == 0 && g_catchJump == frame->catchJump && !frame->defers && !frame->function->isAsync) {
+        int argCount;
+        if (pushCall(vm, value, &argCount)) {
+            Value callee = vm->stack[base];
+            if (IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_FUNCTION && !((Function*)AS_OBJ(callee))->isNative) {
+                Array* call = newArray(vm);
+                frame->returnValue = OBJ_VAL(call);
+                for (int i = 0; i <= argCount; i++) arrayPush(vm, call, vm->stack[base + i]);
+                frame->tailCall = true;
+                frame->tailCallLine = value->line;
+            } else {
+                frame->returnValue = callValue(vm, base, argCount, value->line);
+            }
+        }
+    } else if (value) {
+        frame->returnValue = evaluate(vm, value);
+    }
+    vm->stackTop = base;
+    frame->hasReturned = true;
+}
+
+// After a longjmp back to a try or with whose frame is 'depthFloor' deep:
+// the error, once the functions being left have run their deferred calls.
+// A throw leaves its value; a runtime error only its message. An error from
+// a deferred call replaces the one in flight.
+static Value unwindWalker(VM* vm, int depthFloor) {
+    Value caught = takeCaughtError(vm);
+    bool panicking = vm->panicking; // As in unwindDefers
+    vm->panicking = false;
+    vm->stack[vm->stackTop++] = caught;
+    for (int depth = vm->callStackTop - 1; depth >= depthFloor; depth--) {
+        if (!vm->callStack[depth].defers) continue;
+        vm->callStackTop = depth + 1;
+        Value failure;
+        if (!runWalkerDefers(vm, depth, &failure)) vm->stack[vm->stackTop - 1] = failure;
+    }
+    vm->panicking = panicking || vm->panicking;
+    return vm->stack[--vm->stackTop];
+}
+
+// try/catch: error() and throw longjmp to the innermost g_catchJump, and
+// the walker state is put back as it was at the try before the catch runs
+static void executeTry(VM* vm, Node* node) {
+    jmp_buf buf;
+    jmp_buf* prevCatch = g_catchJump;
+    int savedCallStackTop = vm->callStackTop;
+    int savedStackTop = vm->stackTop;
+    int savedFp = vm->fp;
+    Environment* savedEnv = vm->env;
+    Environment* savedGlobalEnv = vm->globalEnv;
+
+    g_catchJump = &buf;
+    if (setjmp(buf) == 0) {
+        execute(vm, node->tryStmt.tryBlock);
+        g_catchJump = prevCatch;
+        return;
+    }
+    g_catchJump = prevCatch;
+    Value caught = unwindWalker(vm, savedCallStackTop);
+
+    vm->callStackTop = savedCallStackTop;
+    vm->stackTop = savedStackTop;
+    vm->fp = savedFp;
+    vm->env = savedEnv;
+    vm->globalEnv = savedGlobalEnv;
+    vm->loopSignal = LOOP_SIGNAL_NONE;
+    if (vm->panicking) {
+        // Not for catch: on to the next try out, or recover()
+        vm->thrownValue = caught;
+        vm->throwPending = true;
+        raisePending(vm);
+    }
+
+    vm->stack[vm->stackTop++] = caught; // Root while the catch scope is made
+    vm->env = newBlockEnvironment(vm, savedEnv);
+    declareVariable(vm, node->tryStmt.catchName, caught);
+    vm->stackTop--;
+    execute(vm, node->tryStmt.catchBlock);
+    vm->env = savedEnv;
+}
+
+// Path of the file whose code is running, for an import relative to it:
+// that of the module the running function was declared in, else that of
+// the module or script still loading
+static const char* importerPath(VM* vm) {
+    Environment* env = vm->globalEnv;
+    if (vm->callStackTop > 0) {
+        Function* running = vm->callStack[vm->callStackTop - 1].function;
+        if (running && !running->isNative && running->moduleEnv) env = running->moduleEnv;
+    }
+    for (int i = 0; i < TABLE_SIZE; i++) {
+        for (ModuleEntry* e = vm->moduleBuckets[i]; e; e = e->next) {
+            if (e->module && e->module->env == env) return e->name;
+        }
+    }
+    return vm->importing ? vm->importing->name : NULL;
+}
+
+// import "path" as name, as OP_IMPORT does it: the path resolves against
+// the importing file, a module's top-level code runs once in globals of
+// its own and later imports share it, and importing a module that is
+// still loading is a circular import. A module failing at the top level
+// is forgotten, so a later import retries it.
+static Module* importModule(VM* vm, Node* node) {
+    char msg[320];
+    Token name = node->importStmt.module;
+    char rawPath[256];
+    bool quoted = name.type == TOKEN_STRING;
+    int len = quoted ? name.length - 2 : name.length;
+    if (len >= (int)sizeof(rawPath)) len = (int)sizeof(rawPath) - 1;
+    memcpy(rawPath, quoted ? name.start + 1 : name.start, len);
+    rawPath[len] = '\0';
+
+    char* importPath = resolveImportPath(vm, importerPath(vm), rawPath);
+    if (!importPath) {
+        snprintf(msg, sizeof(msg), "Could not import module '%s'.", rawPath);
+        error(msg, node->line);
+    }
+    ModuleEntry* entry = findModuleEntry(vm, importPath, true);
+    if (entry->module) {
+        free(importPath);
+        return entry->module;
+    }
+    if (entry->loading) {
+        char chain[224];
+        describeImportCycle(vm, entry, chain, sizeof(chain));
+        free(importPath);
+        snprintf(msg, sizeof(msg), "Circular import: %s", chain);
+        error(msg, node->line);
+    }
+    char* source = readFileAll(importPath);
+    if (!source) {
+        removeModuleEntry(vm, entry);
+        free(importPath);
+        snprintf(msg, sizeof(msg), "Could not import module '%s'.", rawPath);
+        error(msg, node->line);
+    }
+    Node* ast = parseModule(vm, importPath, source, msg, sizeof(msg));
+    if (!ast) {
+        removeModuleEntry(vm, entry);
+        free(importPath);
+        free(source);
+        error(msg, node->line);
+    }
+    entry->loading = true;
+    entry->importer = vm->importing;
+    vm->importing = entry;
+
+    // Modules see the script's globals and natives, not their importer's
+    Environment* rootEnv = vm->globalEnv;
+    while (rootEnv->enclosing) rootEnv = rootEnv->enclosing;
+    Environment* modEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
+    modEnv->enclosing = rootEnv;
+    memset(modEnv->buckets, 0, sizeof(modEnv->buckets));
+    memset(modEnv->funcBuckets, 0, sizeof(modEnv->funcBuckets));
+
+    jmp_buf buf;
+    jmp_buf* prevCatch = g_catchJump;
+    int savedCallStackTop = vm->callStackTop;
+    int savedStackTop = vm->stackTop;
+    int savedFp = vm->fp;
+    Environment* savedEnv = vm->env;
+    Environment* savedGlobalEnv = vm->globalEnv;
+    int savedLine = vm->currentLine;
+    vm->stack[vm->stackTop++] = OBJ_VAL(modEnv);
+
+    g_catchJump = &buf;
+    if (setjmp(buf) == 0) {
+        internAST(vm, ast);
+        resolveAST(vm, ast);
+
+        vm->env = modEnv;
+        vm->globalEnv = modEnv;
+        if (ast && ast->type == NODE_STMT_BLOCK) {
+            for (int i = 0; i < ast->block.count; i++) execute(vm, ast->block.statements[i]);
+        } else {
+            execute(vm, ast);
+        }
+        g_catchJump = prevCatch;
+    } else {
+        // Uncaught inside the module: put the importer back and throw on
+        g_catchJump = prevCatch;
+        Value caught = unwindWalker(vm, savedCallStackTop);
+        vm->callStackTop = savedCallStackTop;
+        vm->stackTop = savedStackTop;
+        vm->fp = savedFp;
+        vm->env = savedEnv;
+        vm->globalEnv = savedGlobalEnv;
+        vm->loopSignal = LOOP_SIGNAL_NONE;
+        vm->currentLine = savedLine;
+        vm->importing = entry->importer;
+        removeModuleEntry(vm, entry);
+        free(importPath);
+        vm->thrownValue = caught;
+        vm->throwPending = true;
+        raisePending(vm);
+    }
+    vm->env = savedEnv;
+    vm->globalEnv = savedGlobalEnv;
+    vm->currentLine = savedLine;
+    vm->importing = entry->importer;
+
+    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
+    vm->stackTop--; // modEnv is reachable from the module now
+    mod->env = modEnv;
+    mod->name = importPath;
+    mod->source = source; // The tree's tokens point into it
+    entry->module = mod;
+    entry->loading = false;
+    return mod;
+}
+
+// with name = resource { body }: the resource is bound in an environment
+// of its own, and its __close__ runs once the body is left, by break,
+// return or an error as well. An error from __close__ replaces one that
+// was leaving the body.
+static void executeWith(VM* vm, Node* node) {
+    Environment* outer = vm->env;
+    vm->env = newBlockEnvironment(vm, outer);
+    Value resource = evaluate(vm, node->withStmt.resource);
+    Function* closer = resourceCloser(resource);
+    if (!closer && !IS_NIL(resource)) {
+        char msg[128];
+        snprintf(msg, sizeof(msg), "with expects a value with a __close__ method, got %s.", valueTypeName(resource));
+        errorAtToken(node->withStmt.keyword, msg);
+    }
+    declareVariable(vm, node->withStmt.name, resource);
+
+    jmp_buf buf;
+    jmp_buf* prevCatch = g_catchJump;
+    int savedCallStackTop = vm->callStackTop;
+    int savedStackTop = vm->stackTop;
+    int savedFp = vm->fp;
+    Environment* savedEnv = vm->env;
+    Environment* savedGlobalEnv = vm->globalEnv;
+    bool failed = false;
+
+    g_catchJump = &buf;
+    if (setjmp(buf) == 0) {
+        execute(vm, node->withStmt.body);
+        g_catchJump = prevCatch;
+    } else {
+        g_catchJump = prevCatch;
+        Value caught = unwindWalker(vm, savedCallStackTop);
+        vm->callStackTop = savedCallStackTop;
+        vm->stackTop = savedStackTop;
+        vm->fp = savedFp;
+        vm->env = savedEnv;
+        vm->globalEnv = savedGlobalEnv;
+        vm->loopSignal = LOOP_SIGNAL_NONE;
+        vm->stack[vm->stackTop++] = caught;
+        failed = true;
+    }
+
+    if (closer) {
+        // A break or continue on its way out must survive the call
+        LoopSignal signal = vm->loopSignal;
+        Token label = vm->loopLabel;
+        bool panicking = vm->panicking;
+        vm->loopSignal = LOOP_SIGNAL_NONE;
+        vm->panicking = false;
+        Value thrown;
+        if (!callCaught(vm, closer, &resource, 1, NULL, &thrown)) {
+            if (failed) vm->stack[vm->stackTop - 1] = thrown;
+            else vm->stack[vm->stackTop++] = thrown;
+            failed = true;
+        }
+        vm->panicking = panicking || vm->panicking;
+        vm->loopSignal = signal;
+        vm->loopLabel = label;
+    }
+    vm->env = outer;
+    if (failed) {
+        vm->thrownValue = vm->stack[--vm->stackTop];
+        vm->throwPending = true;
+        raisePending(vm);
+    }
+}
+
+// After a loop body: consume a pending continue; true if the loop must stop
+// (break, a break or continue for an enclosing loop, or a return from the
+// enclosing function)
+static bool loopBodyExited(VM* vm, Token label) {
+    LoopSignal signal = vm->loopSignal;
+    Token target = vm->loopLabel;
+    if (signal != LOOP_SIGNAL_NONE && target.length > 0 &&
+        (target.length != label.length || memcmp(target.start, label.start, label.length) != 0)) {
+        return true; // Still pending, for the loop it names
+    }
+    vm->loopSignal = LOOP_SIGNAL_NONE;
+    if (signal == LOOP_SIGNAL_BREAK) return true;
+    if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) return true;
+    // Going round again: spawned coroutines take turns here, as they do at
+    // a compiled loop's back jump
+    if (--vm->limitCountdown <= 0) {
+        vm->limitCountdown = LIMIT_POLL_INTERVAL;
+        if (vm->scheduler && !yieldCoroutine(vm)) raisePending(vm);
+    }
+    return false;
+}
+
+// Function value for a declaration the walker runs, closing over the
+// current environment
+static Function* newScriptFunction(VM* vm, Node* node) {
+    Function* func = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
+    func->name = node->function.name;
+    func->isNative = false;
+    func->closure = vm->env; // Capture current environment
+    func->paramCount = node->function.paramCount;
+    func->requiredCount = node->function.requiredCount;
+    func->isVariadic = node->function.isVariadic;
+    func->isMethod = node->function.isMethod;
+    func->defaults = node->function.defaults;
+    func->body = node->function.body;
+    func->params = node->function.params;
+    func->isAsync = false;
+    func->bytecodeChunk = NULL;
+    func->modulePath = NULL;
+    func->moduleEnv = vm->globalEnv;
+    func->upvalueCount = 0;
+    func->upvalues = NULL;
+    func->proto = NULL;
+    return func;
+}
+
+// Whether a block declares locals of its own (top-level declarations are
+// globals, with no slot)
+static bool declaresLocals(Node* block) {
+    for (int i = 0; i < block->block.count; i++) {
+        Node* stmt = block->block.statements[i];
+        if (stmt->type == NODE_STMT_VAR_DECL && stmt->varDecl.slot != -1) return true;
+        if (stmt->type == NODE_STMT_FUNCTION) return true;
+        if (stmt->type == NODE_STMT_MULTI_ASSIGN && stmt->multiAssign.isDecl) return true;
+    }
+    return false;
+}
+
+static Environment* newBlockEnvironment(VM* vm, Environment* enclosing) {
+    Environment* env = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
+    env->enclosing = enclosing;
+    memset(env->buckets, 0, sizeof(env->buckets));
+    memset(env->funcBuckets, 0, sizeof(env->funcBuckets));
+    return env;
+}
+
+// Execute statement
+static void executeNode(VM* vm, Node* node) {
+    if (!node) {
+        // error("Null statement.", 0);
+        return;
+    }
+    
+    switch (node->type) {
+        case NODE_STMT_VAR_DECL: {
+            Value val;
+            if (node->varDecl.initializer) {
+                val = evaluate(vm, node->varDecl.initializer);
+            } else {
+                val = NIL_VAL;
+            }
+            
+            if (node->varDecl.isConst && vm->env == vm->globalEnv) {
+                defineConstant(vm, node->varDecl.name, val);
+            } else {
+                declareVariable(vm, node->varDecl.name, val);
+            }
+            break;
+        }
+        
+        case NODE_STMT_ASSIGN: {
+            Value val;
+            if (node->assign.operator.type == TOKEN_EQUAL) {
+                val = evaluate(vm, node->assign.value);
+            } else {
+                // name op= value behaves like name = name op value
+                Value current = lookupVariable(vm, node->assign.name)->value;
+                if (node->assign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                    // name ??= value: nothing is evaluated or stored unless name is nil
+                    if (!IS_NIL(current)) break;
+                    val = evaluate(vm, node->assign.value);
+                } else {
+                    vm->stack[vm->stackTop++] = current;
+                    Value rhs = evaluate(vm, node->assign.value);
+                    vm->stackTop--;
+                    val = binaryValues(vm, compoundBinaryOp(node->assign.operator.type), current, rhs, node->assign.operator.line);
+                }
+            }
+            
+            // Assigning a name that was never declared makes a global
+            VarEntry* entry = findEntry(vm, node->assign.name, false);
+            if (entry) {
+                setEntry(vm, node->assign.name, entry, val);
+            } else {
+                defineGlobal(vm, node->assign.name.start, val);
+            }
+            break;
+        }
+        
+        case NODE_STMT_INDEX_ASSIGN: {
+            Value target = evaluate(vm, node->indexAssign.target);
+            vm->stack[vm->stackTop++] = target;
+            Value idx = evaluate(vm, node->indexAssign.index);
+            vm->stack[vm->stackTop++] = idx;
+            Value val;
+            if (node->indexAssign.operator.type == TOKEN_EQUAL) {
+                val = evaluate(vm, node->indexAssign.value);
+            } else if (node->indexAssign.operator.type == TOKEN_QUESTION_QUESTION_EQUAL) {
+                // A missing map key counts as nil and is filled in
+                Value current = NIL_VAL;
+                if (IS_MAP(target)) {
+                    Map* m = (Map*)AS_OBJ(target);
+                    MapEntry* e = NULL;
+                    if (IS_INT(idx)) e = mapFindEntryInt(m, AS_INT(idx), NULL);
+                    else if (IS_STRING(idx)) e = mapFindString(m, AS_STRING(idx), NULL);
+                    if (e) current = e->value;
+                } else {
+                    current = indexValue(vm, target, idx);
+                }
+                if (!IS_NIL(current)) {
+                    vm->stackTop -= 2;
+                    break;
+                }
+                val = evaluate(vm, node->indexAssign.value);
+            } else {
+                // Target and index are evaluated once and reused for the write
+                Value current = indexValue(vm, target, idx);
+                vm->stack[vm->stackTop++] = current;
+                Value rhs = evaluate(vm, node->indexAssign.value);
+                vm->stackTop--;
+                val = binaryValues(vm, compoundBinaryOp(node->indexAssign.operator.type), current, rhs, node->indexAssign.operator.line);
+            }
+            vm->stackTop -= 2;
+            setIndexValue(vm, target, idx, val);
+            break;
+        }
+        
+        case NODE_STMT_PRINT: {
+            Value val = evaluate(vm, node->print.expr);
+            vm->stack[vm->stackTop++] = val; // Rooted while __str__ methods run
+            printLine(vm, val);
+            vm->stackTop--;
+            if (vm->throwPending) raisePending(vm);
+            break;
+        }
+        
+        case NODE_STMT_IF: {
+            Value cond = evaluate(vm, node->ifStmt.condition);
+            if (isTruthy(cond)) {
+                execute(vm, node->ifStmt.thenBranch);
+            } else if (node->ifStmt.elseBranch) {
+                execute(vm, node->ifStmt.elseBranch);
+            }
+            break;
+        }
+        
+        case NODE_STMT_SWITCH: {
+            Value subject = evaluate(vm, node->switchStmt.subject);
+            vm->stack[vm->stackTop++] = subject; // Root while the cases evaluate
+            int start = -1;
+            int defaultCase = -1;
+            for (int i = 0; i < node->switchStmt.caseCount && start == -1; i++) {
+                if (!node->switchStmt.values[i]) defaultCase = i;
+                for (Node* v = node->switchStmt.values[i]; v; v = v->next) {
+                    Value candidate = evaluate(vm, v);
+                    if (isTruthy(binaryValues(vm, TOKEN_EQUAL_EQUAL, subject, candidate, v->line))) {
+                        start = i;
+                        break;
+                    }
+                }
+            }
+            if (start == -1) {
+                // 'default' may come after the cases already tried
+                for (int i = 0; i < node->switchStmt.caseCount && defaultCase == -1; i++) {
+                    if (!node->switchStmt.values[i]) defaultCase = i;
+                }
+                start = defaultCase;
+            }
+            vm->stackTop--;
+            for (int i = start; i != -1 && i < node->switchStmt.caseCount; i++) {
+                execute(vm, node->switchStmt.bodies[i]);
+                if (vm->loopSignal != LOOP_SIGNAL_NONE) break;
+                if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) break;
+                if (!node->switchStmt.fallsThrough[i]) break;
+            }
+            break;
+        }
+
+        case NODE_STMT_WHILE: {
+            while (isTruthy(evaluate(vm, node->whileStmt.condition))) {
+                execute(vm, node->whileStmt.body);
+                if (loopBodyExited(vm, node->whileStmt.label)) break;
+            }
+            break;
+        }
+
+        case NODE_STMT_DO_WHILE: {
+            do {
+                execute(vm, node->whileStmt.body);
+                if (loopBodyExited(vm, node->whileStmt.label)) break;
+            } while (isTruthy(evaluate(vm, node->whileStmt.condition)));
+            break;
+        }
+
+        case NODE_STMT_LOOP: {
+            while (true) {
+                execute(vm, node->whileStmt.body);
+                if (loopBodyExited(vm, node->whileStmt.label)) break;
+            }
+            break;
+        }
+        
+        case NODE_STMT_FOR: {
+            // The initializer's variable is one binding for the whole loop
+            Environment* outer = vm->env;
+            vm->env = newBlockEnvironment(vm, outer);
+            if (node->forStmt.initializer) execute(vm, node->forStmt.initializer);
+            while (true) {
+                if (node->forStmt.condition) {
+                   if (!isTruthy(evaluate(vm, node->forStmt.condition))) break;
+                }
+                execute(vm, node->forStmt.body);
+                if (loopBodyExited(vm, node->forStmt.label)) break;
+                if (node->forStmt.increment) execute(vm, node->forStmt.increment);
+            }
+            vm->env = outer;
+            break;
+        }
+        
+        case NODE_STMT_FOREACH: {
+             Value collection = iterableOf(vm, evaluate(vm, node->foreachStmt.collection));
+             if (!isIterable(collection)) {
+                 char msg[128];
+                 snprintf(msg, sizeof(msg), "Cannot iterate over %s.", valueTypeName(collection));
+                 error(msg, node->line);
+             }
+             vm->stack[vm->stackTop++] = collection; // Root the iterable
+             // Each iteration binds the loop variable afresh
+             Environment* outer = vm->env;
+             Value cursor = INT_VAL(0);
+             Value val;
+             while (iteratorNext(vm, collection, &cursor, &val)) {
+                 vm->stack[vm->stackTop++] = val; // Root while its scope is made
+                 vm->env = newBlockEnvironment(vm, outer);
+                 declareVariable(vm, node->foreachStmt.iterator, val);
+                 vm->stackTop--;
+                 execute(vm, node->foreachStmt.body);
+                 if (loopBodyExited(vm, node->foreachStmt.label)) break;
+             }
+             vm->env = outer;
+             vm->stackTop--;
+             break;
+        }
+        
+        case NODE_STMT_BLOCK: {
+            // Block locals go in an environment of their own, so closures
+            // see them and names outside the block are only shadowed
+            Environment* outer = vm->env;
+            if (declaresLocals(node)) vm->env = newBlockEnvironment(vm, outer);
+            for (int i = 0; i < node->block.count; i++) {
+                execute(vm, node->block.statements[i]);
+                if (vm->loopSignal != LOOP_SIGNAL_NONE) break;
+                if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) break;
+            }
+            vm->env = outer;
+            break;
+        }
+        
+        case NODE_STMT_FUNCTION: {
+             Function* func = newScriptFunction(vm, node);
+             
+             Value v = OBJ_VAL(func);
+             // Declared in a function or block: a local, like a var
+             if (vm->env != vm->globalEnv) {
+                 vm->stack[vm->stackTop++] = v;
+                 defineInEnv(vm, vm->env, node->function.name, v);
+                 vm->stackTop--;
+                 break;
+             }
+             
+             // A global one is fixed like a const
+             vm->stack[vm->stackTop++] = v;
+             defineConstant(vm, node->function.name, v);
+             vm->stackTop--;
+             break;
+        }
+        
+        case NODE_STMT_STRUCT_DECL: {
+             StructDef* s = ALLOCATE_OBJ(vm, StructDef, OBJ_STRUCT_DEF);
+             
              char buf[64];
              int len = node->structDecl.name.length;
              if (len >= 64) len = 63;
@@ -1152,704 +2988,2924 @@ static void execute(VM* vm, Node* node) {
                  memcpy(f, ft.start, ft.length); f[ft.length]=0;
                  s->fields[i] = f;
              }
+             s->defaults = node->structDecl.defaults;
+             s->methods = NULL;
+             s->methodCount = 0;
+             s->shape = ++vm->structShapes;
+
+             vm->stack[vm->stackTop++] = OBJ_VAL(s); // Root while methods allocate
+             int methodCount = node->structDecl.methodCount;
+             if (methodCount > 0) s->methods = malloc(sizeof(Function*) * methodCount);
+             for (int i = 0; i < methodCount; i++) {
+                 s->methods[i] = newScriptFunction(vm, node->structDecl.methods[i]);
+                 s->methodCount++;
+                 GEN_BARRIER(vm, s, s->methods[i]);
+             }
+             vm->stackTop--;
              
              Value v = OBJ_VAL(s);
              defineGlobal(vm, buf, v);
              break;
         }
         
+        case NODE_STMT_ENUM_DECL:
+            for (int i = 0; i < node->enumDecl.count; i++) {
+                defineConstant(vm, node->enumDecl.names[i], intValue(vm, node->enumDecl.values[i]));
+            }
+            break;
+        
         case NODE_STMT_PROP_ASSIGN: {
+             // obj.name op= value reads the field as OP_GETPROP does first
              Value obj = evaluate(vm, node->propAssign.object);
-             Value val = evaluate(vm, node->propAssign.value);
-             
-             if (IS_OBJ(obj) && AS_OBJ(obj)->type == OBJ_STRUCT_INSTANCE) {
-                 StructInstance* inst = (StructInstance*)AS_OBJ(obj);
-                 int idx = -1;
-                 for(int i=0; i<inst->def->fieldCount; i++) {
-                     if (inst->def->fields[i] && 
-                         strncmp(inst->def->fields[i], node->propAssign.name.start, node->propAssign.name.length)==0) {
-                         idx = i; break;
+             vm->stack[vm->stackTop++] = obj;
+             TokenType op = node->propAssign.operator.type;
+             Value val = NIL_VAL;
+             if (op == TOKEN_EQUAL) {
+                 val = evaluate(vm, node->propAssign.value);
+             } else {
+                 Value current = getProperty(vm, obj, node->propAssign.name, node->line);
+                 if (op == TOKEN_QUESTION_QUESTION_EQUAL) {
+                     // Nothing is evaluated or stored unless the field is nil
+                     if (!IS_NIL(current)) {
+                         vm->stackTop--;
+                         break;
                      }
-                 }
-                 if (idx != -1) {
-                     inst->fields[idx] = val;
+                     val = evaluate(vm, node->propAssign.value);
                  } else {
-                     error("Unknown field assignment.", 0);
+                     vm->stack[vm->stackTop++] = current;
+                     Value rhs = evaluate(vm, node->propAssign.value);
+                     val = binaryValues(vm, compoundBinaryOp(op), current, rhs, node->propAssign.operator.line);
+                     vm->stackTop--;
                  }
-             } else {
-                 error("Property assignment requires struct instance.", 0);
              }
+             *fieldSlot(obj, node->propAssign.name, node->line) = val;
+             GEN_BARRIER_VALUE(vm, AS_OBJ(obj), val);
+             vm->stackTop--;
              break;
         }
-        
-        case NODE_STMT_IMPORT: {
-             // Simplified import
-             // In real impl, we load source, parse, execute.
-             // Here we just define a module placeholder if not exists.
-             if (node->importStmt.alias.length > 0) {
-                 char buf[64];
-                 int len = node->importStmt.alias.length;
-                 if (len >= 64) len = 63;
-                 memcpy(buf, node->importStmt.alias.start, len); buf[len] = '\0';
-                 
-                 Module* m = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
-                 m->name = internString(vm, buf, len)->chars;
-                 m->env = malloc(sizeof(Environment)); // Should use GC?
-                 memset(m->env, 0, sizeof(Environment));
-                 
-                 Value v = OBJ_VAL(m);
-                 defineGlobal(vm, buf, v);
-             }
-             break;
+
+        case NODE_STMT_MULTI_ASSIGN:
+            executeMultiAssign(vm, node);
+            break;
+        
+        case NODE_STMT_IMPORT: {
+             Value mod = OBJ_VAL(importModule(vm, node));
+             vm->stack[vm->stackTop++] = mod;
+             declareVariable(vm, node->importStmt.alias, mod);
+             vm->stackTop--;
+             break;
+        }
+        
+        case NODE_STMT_TRY:
+            executeTry(vm, node);
+            break;
+
+        case NODE_STMT_WITH:
+            executeWith(vm, node);
+            break;
+
+        case NODE_STMT_SPAWN: {
+            Node* call = node->spawnStmt.call;
+            int base = vm->stackTop;
+            vm->stack[vm->stackTop++] = evaluate(vm, call->call.callee);
+            int ac = pushArgs(vm, call->call.arguments);
+            bool spawned = spawnCoroutine(vm, vm->stack[base], &vm->stack[base + 1], ac);
+            vm->stackTop = base;
+            if (!spawned) raisePending(vm);
+            break;
+        }
+
+        case NODE_STMT_DEFER: {
+            Node* call = node->deferStmt.call;
+            int base = vm->stackTop;
+            vm->stack[vm->stackTop++] = evaluate(vm, call->call.callee);
+            int ac = pushArgs(vm, call->call.arguments);
+            bool deferred = deferCall(vm, &vm->callStack[vm->callStackTop - 1], vm->stack[base],
+                                      &vm->stack[base + 1], ac);
+            vm->stackTop = base;
+            if (!deferred) raisePending(vm);
+            break;
+        }
+
+        case NODE_STMT_THROW: {
+            Value thrown = evaluate(vm, node->throwStmt.value);
+            vm->thrownValue = thrown;
+            vm->throwPending = true;
+            if (g_catchJump) longjmp(*g_catchJump, 1);
+
+            char msg[512];
+            describeThrown(vm, thrown, msg, sizeof(msg));
+            vm->thrownValue = NIL_VAL;
+            vm->throwPending = false;
+            errorAtToken(node->throwStmt.keyword, msg);
+            break;
+        }
+
+        case NODE_STMT_BREAK:
+            vm->loopSignal = LOOP_SIGNAL_BREAK;
+            vm->loopLabel = node->loopJump.label;
+            break;
+
+        case NODE_STMT_CONTINUE:
+            vm->loopSignal = LOOP_SIGNAL_CONTINUE;
+            vm->loopLabel = node->loopJump.label;
+            break;
+
+        case NODE_STMT_RETURN: {
+            if (vm->callStackTop == 0) {
+                 error("Return outside function.", node->line);
+                 break;
+            }
+            executeReturn(vm, node);
+            break;
+        }
+        
+        default:
+             evaluate(vm, node);
+             break;
+    }
+}
+
+// Errors raised while 'node' runs report its line; the caller's comes back
+// after, so an error past a call is not put on the callee's last line
+static void execute(VM* vm, Node* node) {
+    int outerLine = vm->currentLine;
+    if (node && node->line > 0) vm->currentLine = node->line;
+    executeNode(vm, node);
+    vm->currentLine = outerLine;
+}
+
+// Evaluate call arguments onto the legacy stack so they stay rooted
+// while the call allocates; the caller restores stackTop
+static int pushArgs(VM* vm, Node* arg) {
+    int ac = 0;
+    while (arg) {
+        if (arg->type == NODE_EXPR_SPREAD) {
+            // ...expr: each element is its own argument. A range can box
+            // the ints it steps to, so the iterable is rooted in the slot
+            // past them, moving up as they are pushed.
+            Value iterable = iterableOf(vm, evaluate(vm, arg->unary.expr));
+            if (!isIterable(iterable)) {
+                char msg[64];
+                snprintf(msg, sizeof(msg), "Cannot spread %s.", valueTypeName(iterable));
+                errorAtToken(arg->unary.op, msg);
+            }
+            Value cursor = INT_VAL(0), element;
+            vm->stack[vm->stackTop] = iterable;
+            vm->stackTop++;
+            while (iteratorNext(vm, iterable, &cursor, &element)) {
+                if (vm->stackTop + 64 >= STACK_MAX) error("Stack overflow.", arg->line);
+                vm->stack[vm->stackTop - 1] = element;
+                vm->stack[vm->stackTop++] = iterable;
+                ac++;
+            }
+            vm->stackTop--;
+            arg = arg->next;
+            continue;
+        }
+        Value v = evaluate(vm, arg);
+        vm->stack[vm->stackTop++] = v;
+        ac++;
+        arg = arg->next;
+    }
+    return ac;
+}
+
+// At a link of a postfix chain: true when the rest of the chain is
+// skipped, because this ?. link or an earlier one met nil
+static bool skipChain(VM* vm, Value object, bool optional) {
+    if (optional && IS_NIL(object)) vm->chainSkipped = true;
+    return vm->chainSkipped;
+}
+
+// Name{ field: value, ... }: the given fields in the order written, then
+// the defaults of the others in declaration order
+static Value evaluateStructLiteral(VM* vm, Node* node) {
+    VarEntry* ve = findEntry(vm, node->structLiteral.name, false);
+    if (!ve || !IS_OBJ(ve->value) || AS_OBJ(ve->value)->type != OBJ_STRUCT_DEF) {
+        error("Unknown struct.", node->line);
+        return NIL_VAL;
+    }
+    StructDef* def = (StructDef*)AS_OBJ(ve->value);
+    StructInstance* inst = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
+    inst->def = def;
+    inst->fields = malloc(sizeof(Value) * def->fieldCount);
+    for (int i = 0; i < def->fieldCount; i++) inst->fields[i] = NIL_VAL;
+    vm->stack[vm->stackTop++] = OBJ_VAL(inst); // Root while evaluating fields
+
+    bool given[256] = {false};
+    Node* value = node->structLiteral.values;
+    for (int i = 0; i < node->structLiteral.count; i++, value = value->next) {
+        Token name = node->structLiteral.fields[i];
+        int field = 0;
+        while (field < def->fieldCount && !(strlen(def->fields[field]) == (size_t)name.length &&
+                                           memcmp(def->fields[field], name.start, name.length) == 0)) {
+            field++;
+        }
+        if (field == def->fieldCount) {
+            error("Unknown struct field.", node->line);
+            return NIL_VAL;
+        }
+        inst->fields[field] = evaluate(vm, value);
+        GEN_BARRIER_VALUE(vm, inst, inst->fields[field]);
+        given[field] = true;
+    }
+    for (int i = 0; i < def->fieldCount; i++) {
+        if (!given[i] && def->defaults && def->defaults[i]) {
+            inst->fields[i] = evaluate(vm, def->defaults[i]);
+            GEN_BARRIER_VALUE(vm, inst, inst->fields[i]);
+        }
+    }
+    vm->stackTop--;
+    return OBJ_VAL(inst);
+}
+
+// ++target or target--: the new value for a prefix, the old one otherwise.
+// An index target's object and index are evaluated once.
+static Value evaluateUpdate(VM* vm, Node* node) {
+    Token op = node->update.op;
+    Node* target = node->update.target;
+    int base = vm->stackTop;
+    Value current = NIL_VAL;
+    Value obj = NIL_VAL;
+    Value idx = NIL_VAL;
+    VarEntry* entry = NULL;
+
+    if (target->type == NODE_EXPR_VAR) {
+        entry = lookupVariable(vm, target->var.name);
+        current = entry->value;
+    } else if (target->type == NODE_EXPR_INDEX) {
+        obj = evaluate(vm, target->index.target);
+        vm->stack[vm->stackTop++] = obj;
+        idx = evaluate(vm, target->index.index);
+        vm->stack[vm->stackTop++] = idx;
+        current = indexValue(vm, obj, idx);
+    } else {
+        obj = evaluate(vm, target->get.object);
+        vm->stack[vm->stackTop++] = obj;
+        current = getProperty(vm, obj, target->get.name, op.line);
+    }
+
+    if (!IS_INT(current) && !IS_FLOAT(current)) {
+        char msg[96];
+        snprintf(msg, sizeof(msg), "Operand of '%s' must be a number, got %s.",
+                 op.type == TOKEN_PLUS_PLUS ? "++" : "--", valueTypeName(current));
+        errorAtToken(op, msg);
+    }
+    TokenType step = op.type == TOKEN_PLUS_PLUS ? TOKEN_PLUS : TOKEN_MINUS;
+    Value stepped = binaryValues(vm, step, current, INT_VAL(1), op.line);
+
+    if (target->type == NODE_EXPR_VAR) {
+        setEntry(vm, target->var.name, entry, stepped);
+    } else if (target->type == NODE_EXPR_INDEX) {
+        setIndexValue(vm, obj, idx, stepped);
+    } else {
+        *fieldSlot(obj, target->get.name, op.line) = stepped;
+        GEN_BARRIER_VALUE(vm, AS_OBJ(obj), stepped);
+    }
+    vm->stackTop = base;
+    return node->update.prefix ? stepped : current;
+}
+
+// obj.name as OP_GETPROP reads it: a field, else a method bound to the
+// instance (nil when it has neither), a module member or a string's length
+static Value getProperty(VM* vm, Value obj, Token name, int line) {
+    char msg[160];
+    if (IS_OBJ(obj)) {
+        Obj* o = AS_OBJ(obj);
+        if (o->type == OBJ_STRUCT_INSTANCE) {
+            StructInstance* inst = (StructInstance*)o;
+            for (int i = 0; i < inst->def->fieldCount; i++) {
+                if ((int)strlen(inst->def->fields[i]) == name.length &&
+                    memcmp(inst->def->fields[i], name.start, name.length) == 0) {
+                    return inst->fields[i];
+                }
+            }
+            Function* method = findMethod(inst->def, name.start, name.length);
+            if (!method) return NIL_VAL;
+            vm->stack[vm->stackTop++] = obj;
+            BoundMethod* bound = newBoundMethod(vm, obj, method);
+            vm->stackTop--;
+            return OBJ_VAL(bound);
+        } else if (o->type == OBJ_MODULE) {
+            VarEntry* ve = findVarInEnv(((Module*)o)->env, name);
+            if (ve) return ve->value;
+            snprintf(msg, sizeof(msg), "Undefined property '%.*s' in module '%s'.",
+                     name.length, name.start, ((Module*)o)->name);
+            error(msg, line);
+        } else if (o->type == OBJ_STRING && name.length == 6 && memcmp(name.start, "length", 6) == 0) {
+            return INT_VAL(((ObjString*)o)->length);
+        }
+    }
+    snprintf(msg, sizeof(msg), "Cannot read property '%.*s' on this type.", name.length, name.start);
+    error(msg, line);
+    return NIL_VAL;
+}
+
+// Call the callee at stack[base] with the 'argCount' values above it as
+// OP_CALL does: a bound method shifts them up to pass its receiver first,
+// as self, and a struct takes one per field
+static Value callValue(VM* vm, int base, int argCount, int line) {
+    char msg[160];
+    Value callee = vm->stack[base];
+    Value* args = &vm->stack[base + 1];
+    vm->calledValues = NIL_VAL;
+    if (!IS_OBJ(callee) || IS_BOXED_INT(callee)) error("Attempt to call non-function value.", line);
+    Obj* o = AS_OBJ(callee);
+    if (o->type == OBJ_FUNCTION) {
+        if (((Function*)o)->isNative) vm->nativeLine = line;
+        return callFunction(vm, (Function*)o, args, argCount);
+    }
+    if (o->type == OBJ_BOUND_METHOD) {
+        BoundMethod* bound = (BoundMethod*)o;
+        if (vm->stackTop + 1 >= STACK_MAX) error("Stack overflow.", line);
+        memmove(args + 1, args, sizeof(Value) * argCount);
+        vm->stackTop++;
+        args[0] = bound->receiver;
+        return callFunction(vm, bound->method, args, argCount + 1);
+    }
+    if (o->type == OBJ_STRUCT_DEF) {
+        StructDef* def = (StructDef*)o;
+        if (argCount != def->fieldCount) {
+            snprintf(msg, sizeof(msg), "Struct '%s' expected %d args but got %d.",
+                     def->name, def->fieldCount, argCount);
+            error(msg, line);
+        }
+        StructInstance* inst = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
+        inst->def = def;
+        inst->fields = malloc(sizeof(Value) * def->fieldCount);
+        for (int i = 0; i < argCount; i++) inst->fields[i] = args[i];
+        return OBJ_VAL(inst);
+    }
+    error("Attempt to call non-function object.", line);
+    return NIL_VAL;
+}
+
+// The compiler builds array() and map() inline, whatever the names hold
+static bool isInlinedBuiltin(Node* call) {
+    Node* callee = call->call.callee;
+    if (callee->type != NODE_EXPR_VAR || call->call.arguments) return false;
+    Token name = callee->var.name;
+    return (name.length == 5 && memcmp(name.start, "array", 5) == 0) ||
+           (name.length == 3 && memcmp(name.start, "map", 3) == 0);
+}
+
+// f(a, name: value) once pushCall has pushed the callee at 'base' and the
+// arguments as written: lay them out by parameter, as OP_CALLNAMED does
+static void bindNamedCall(VM* vm, Node* node, int base, int* argCount) {
+    Value callee = vm->stack[base];
+    Function* func = NULL;
+    int first = 0;
+    if (IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_FUNCTION) {
+        func = (Function*)AS_OBJ(callee);
+    } else if (IS_OBJ(callee) && AS_OBJ(callee)->type == OBJ_BOUND_METHOD) {
+        func = ((BoundMethod*)AS_OBJ(callee))->method;
+        first = 1; // callValue passes the receiver
+    }
+    char msg[256];
+    if (!func) {
+        snprintf(msg, sizeof(msg), "Cannot pass named arguments to %s.", valueTypeName(callee));
+        error(msg, node->line);
+    }
+    int namedCount = node->call.namedCount;
+    int positional = *argCount - namedCount;
+    Value* args = &vm->stack[base + 1];
+    Value* out = &vm->stack[vm->stackTop];
+    if (vm->stackTop + func->paramCount + 64 > WALKER_STACK_MAX) error("Stack overflow.", node->line);
+    int count = bindNamedArguments(func, first, args, positional, node->call.names,
+                                   args + positional, namedCount, out, msg, sizeof(msg));
+    if (count < 0) error(msg, node->line);
+    memmove(args, out, sizeof(Value) * count);
+    vm->stackTop = base + 1 + count;
+    *argCount = count;
+}
+
+// Push what a call runs for callValue: the callee, then its arguments. A
+// method called on an instance is pushed unbound with the instance as its
+// first argument, self. False when a ?. link met nil and nothing runs.
+static bool pushCall(VM* vm, Node* node, int* argCount) {
+    Node* callee = node->call.callee;
+    int base = vm->stackTop;
+    if (callee->type == NODE_EXPR_GET) {
+        // A field of the method's name shadows it, as when reading obj.name
+        Value obj = evaluate(vm, callee->get.object);
+        if (skipChain(vm, obj, callee->get.optional)) return false;
+        vm->stack[vm->stackTop++] = obj;
+        if (IS_OBJ(obj) && AS_OBJ(obj)->type == OBJ_STRUCT_INSTANCE) {
+            StructInstance* inst = (StructInstance*)AS_OBJ(obj);
+            Token name = callee->get.name;
+            bool isField = false;
+            for (int i = 0; i < inst->def->fieldCount && !isField; i++) {
+                isField = (int)strlen(inst->def->fields[i]) == name.length &&
+                          memcmp(inst->def->fields[i], name.start, name.length) == 0;
+            }
+            Function* method = isField ? NULL : findMethod(inst->def, name.start, name.length);
+            if (method) {
+                vm->stack[base] = OBJ_VAL(method);
+                vm->stack[vm->stackTop++] = obj; // self
+                *argCount = pushArgs(vm, node->call.arguments) + 1;
+                if (node->call.namedCount > 0) bindNamedCall(vm, node, base, argCount);
+                return true;
+            }
+        }
+        vm->stack[base] = getProperty(vm, obj, callee->get.name, node->line);
+    } else {
+        vm->stack[vm->stackTop++] = evaluate(vm, callee);
+    }
+    *argCount = pushArgs(vm, node->call.arguments);
+    if (node->call.namedCount > 0) bindNamedCall(vm, node, base, argCount);
+    return true;
+}
+
+static Value evaluateCall(VM* vm, Node* node) {
+    if (isInlinedBuiltin(node)) {
+        vm->calledValues = NIL_VAL;
+        return node->call.callee->var.name.length == 5 ? OBJ_VAL(newArray(vm)) : OBJ_VAL(newMap(vm));
+    }
+    int base = vm->stackTop;
+    int argCount;
+    if (!pushCall(vm, node, &argCount)) {
+        vm->calledValues = NIL_VAL;
+        return NIL_VAL;
+    }
+    return callValue(vm, base, argCount, node->line);
+}
+
+// Evaluate expression
+static Value evaluateNode(VM* vm, Node* node) {
+    if (!node) {
+        error("Null expression.", vm->currentLine);
+        return NIL_VAL;
+    }
+
+    switch (node->type) {
+        case NODE_EXPR_LITERAL: {
+            if (node->literal.token.type == TOKEN_NUMBER) {
+                return numberLiteral(vm, node->literal.token);
+            } else if (node->literal.token.type == TOKEN_STRING) {
+                char* text = stringLiteralText(node->literal.token);
+                return OBJ_VAL(takeString(vm, text, (int)strlen(text)));
+            } else if (node->literal.token.type == TOKEN_TRUE) {
+                return BOOL_VAL(true);
+            } else if (node->literal.token.type == TOKEN_FALSE) {
+                return BOOL_VAL(false);
+            } else if (node->literal.token.type == TOKEN_NIL) {
+                return NIL_VAL;
+            }
+            return NIL_VAL;
+        }
+
+        case NODE_EXPR_VAR: {
+            return lookupVariable(vm, node->var.name)->value;
+        }
+
+        case NODE_EXPR_UPDATE:
+            return evaluateUpdate(vm, node);
+
+        case NODE_EXPR_FUNCTION:
+            return OBJ_VAL(newScriptFunction(vm, node));
+
+        case NODE_EXPR_UNARY: {
+            Value expr = evaluate(vm, node->unary.expr);
+            if (node->unary.op.type == TOKEN_MINUS) {
+                if (IS_INT(expr) && AS_INT(expr) == INT64_MIN) {
+                    char msg[64];
+                    snprintf(msg, sizeof(msg), "Integer overflow in -(%lld).", (long long)INT64_MIN);
+                    errorAtToken(node->unary.op, msg);
+                }
+                if (IS_INT(expr)) expr = intValue(vm, -AS_INT(expr));
+                else if (IS_FLOAT(expr)) expr = FLOAT_VAL(-AS_FLOAT(expr));
+                else errorAtToken(node->unary.op, "Cannot negate non-numeric value.");
+            } else if (node->unary.op.type == TOKEN_PLUS) {
+                if (!IS_INT(expr) && !IS_FLOAT(expr)) errorAtToken(node->unary.op, "Unary '+' requires numeric value.");
+            } else if (node->unary.op.type == TOKEN_BANG) {
+                return BOOL_VAL(!isTruthy(expr));
+            } else if (node->unary.op.type == TOKEN_TILDE) {
+                if (!IS_INT(expr)) {
+                    char msg[96];
+                    snprintf(msg, sizeof(msg), "Operand of '~' must be an integer, got %s.", valueTypeName(expr));
+                    errorAtToken(node->unary.op, msg);
+                }
+                return intValue(vm, ~AS_INT(expr));
+            }
+            return expr;
+        }
+
+        case NODE_EXPR_BINARY: {
+             // Logical AND / OR yield the deciding operand itself
+             if (node->binary.op.type == TOKEN_AND) {
+                 Value left = evaluate(vm, node->binary.left);
+                 if (!isTruthy(left)) return left;
+                 return evaluate(vm, node->binary.right);
+             }
+             if (node->binary.op.type == TOKEN_OR) {
+                 Value left = evaluate(vm, node->binary.left);
+                 if (isTruthy(left)) return left;
+                 return evaluate(vm, node->binary.right);
+             }
+             if (node->binary.op.type == TOKEN_QUESTION_QUESTION) {
+                 Value left = evaluate(vm, node->binary.left);
+                 if (!IS_NIL(left)) return left;
+                 return evaluate(vm, node->binary.right);
+             }
+
+             if (node->binary.chained) {
+                 Value last;
+                 return BOOL_VAL(compareChain(vm, node, &last));
+             }
+
+             Value left = evaluate(vm, node->binary.left);
+             vm->stack[vm->stackTop++] = left; // Rooted while the right side runs
+             Value right = evaluate(vm, node->binary.right);
+             vm->stackTop--;
+
+             return binaryValues(vm, node->binary.op.type, left, right, node->binary.op.line);
+        }
+
+        case NODE_EXPR_CALL: {
+            int savedTop = vm->stackTop;
+            Value result = evaluateCall(vm, node);
+            vm->stackTop = savedTop;
+            return result;
+        }
+
+        case NODE_EXPR_AWAIT: {
+            Value v = evaluate(vm, node->unary.expr);
+            if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_FUTURE) return futureAwait((Future*)AS_OBJ(v));
+            return v;
+        }
+
+        case NODE_EXPR_GET: {
+            Value obj = evaluate(vm, node->get.object);
+            if (skipChain(vm, obj, node->get.optional)) return NIL_VAL;
+            return getProperty(vm, obj, node->get.name, node->line);
+        }
+
+        case NODE_EXPR_OPTIONAL: {
+            Value v = evaluate(vm, node->unary.expr);
+            vm->chainSkipped = false;
+            return v;
+        }
+
+        case NODE_EXPR_INDEX: {
+             Value t = evaluate(vm, node->index.target);
+             if (skipChain(vm, t, node->index.optional)) return NIL_VAL;
+             vm->stack[vm->stackTop++] = t;
+             Value i = evaluate(vm, node->index.index);
+             vm->stackTop--;
+             return indexValue(vm, t, i);
+        }
+
+        case NODE_EXPR_SLICE: {
+            Value t = evaluate(vm, node->slice.target);
+            if (skipChain(vm, t, node->slice.optional)) return NIL_VAL;
+            vm->stack[vm->stackTop++] = t; // root while evaluating the bounds
+            Value from = node->slice.start ? evaluate(vm, node->slice.start) : NIL_VAL;
+            Value to = node->slice.end ? evaluate(vm, node->slice.end) : NIL_VAL;
+            Value result = sliceValue(vm, t, from, to);
+            vm->stackTop--;
+            if (vm->throwPending) raisePending(vm);
+            return result;
+        }
+
+        case NODE_EXPR_ARRAY_LITERAL: {
+            Array* a = newArray(vm);
+            vm->stack[vm->stackTop++] = OBJ_VAL(a); // root while evaluating elements
+            Node* el = node->arrayLiteral.elements;
+            while(el) {
+                if (el->type == NODE_EXPR_SPREAD) {
+                    Value iterable = iterableOf(vm, evaluate(vm, el->unary.expr));
+                    if (!isIterable(iterable)) {
+                        char msg[64];
+                        snprintf(msg, sizeof(msg), "Cannot spread %s.", valueTypeName(iterable));
+                        errorAtToken(el->unary.op, msg);
+                    }
+                    vm->stack[vm->stackTop++] = iterable; // A set's elements, while the array grows
+                    Value cursor = INT_VAL(0), element;
+                    while (iteratorNext(vm, iterable, &cursor, &element)) {
+                        arrayPush(vm, a, element);
+                    }
+                    vm->stackTop--;
+                } else {
+                    arrayPush(vm, a, evaluate(vm, el));
+                }
+                el = el->next;
+            }
+            if (node->arrayLiteral.isSet) {
+                // #{...}: the elements as they would make an array, each kept once
+                Value set = setOfElements(vm, a->items, a->count);
+                vm->stackTop--;
+                if (vm->throwPending) raisePending(vm);
+                return set;
+            }
+            vm->stackTop--;
+            Value v = OBJ_VAL(a); return v;
+        }
+
+        case NODE_EXPR_TERNARY:
+            return isTruthy(evaluate(vm, node->ternary.condition))
+                ? evaluate(vm, node->ternary.thenExpr)
+                : evaluate(vm, node->ternary.elseExpr);
+
+        case NODE_EXPR_MAP_LITERAL: {
+            Map* m = newMap(vm);
+            vm->stack[vm->stackTop++] = OBJ_VAL(m); // root while evaluating pairs
+            Node* key = node->mapLiteral.keys;
+            Node* value = node->mapLiteral.values;
+            while (key) {
+                Value k = evaluate(vm, key);
+                Value v = evaluate(vm, value);
+                if (IS_INT(k)) {
+                    mapSetInt(vm, m, AS_INT(k), v);
+                } else if (IS_STRING(k)) {
+                    ObjString* s = AS_STRING(k);
+                    mapSetString(vm, m, s, v);
+                } else {
+                    mapKeyError(vm, k);
+                }
+                key = key->next;
+                value = value->next;
+            }
+            vm->stackTop--;
+            return OBJ_VAL(m);
+        }
+
+        case NODE_EXPR_STRUCT_LITERAL:
+            return evaluateStructLiteral(vm, node);
+
+        default:
+            return NIL_VAL;
+    }
+}
+
+// As execute() keeps the line
+static Value evaluate(VM* vm, Node* node) {
+    int outerLine = vm->currentLine;
+    if (node && node->line > 0) vm->currentLine = node->line;
+    Value value = evaluateNode(vm, node);
+    vm->currentLine = outerLine;
+    return value;
+}
+
+// Initialize VM
+void initVM(VM* vm) {
+    chooseHashSeed(); // Before the first string is interned
+    // Initialize GC State FIRST
+    vm->objects = NULL;
+    vm->nursery = NULL;
+    vm->openUpvalues = NULL;
+    vm->nurseryCount = 0;
+    vm->remembered = NULL;
+    vm->rememberedCount = 0;
+    vm->rememberedCapacity = 0;
+    vm->gcYoungOnly = false;
+    vm->gcYoungHold = 0;
+    vm->grayStack = NULL;
+    vm->grayCount = 0;
+    vm->grayCapacity = 0;
+    vm->bytesAllocated = 0;
+    vm->gcPeakMemory = 0;
+    vm->gcTotalAllocated = 0;
+    memset(vm->gcObjectsAllocated, 0, sizeof(vm->gcObjectsAllocated));
+    memset(vm->blockPool, 0, sizeof(vm->blockPool));
+    memset(vm->blockPoolCount, 0, sizeof(vm->blockPoolCount));
+    vm->blockPoolLimit = BLOCK_POOL_LIMIT;
+    vm->gcBlocksReused = 0;
+    vm->gcBlocksNew = 0;
+    vm->gcInitialHeap = 1024 * 1024; // Start GC at 1MB
+    vm->gcGrowthFactor = 2.0;
+    vm->gcStress = false;
+    vm->gcYoungLimit = 256 * 1024; // Young collection every 256KB allocated
+    vm->nextGC = vm->gcInitialHeap;
+    // Read by the first allocation: a VM in reused memory must not start
+    // with a collection already due
+    vm->gcPhase = 0;  // GC_IDLE
+    vm->gcBytesAllocSinceGC = 0;
+    vm->optimizeBytecode = true;
+    vm->registers = malloc(sizeof(Value) * STACK_MAX);
+    vm->stack = malloc(sizeof(Value) * WALKER_STACK_MAX);
+    vm->tryHandlers = malloc(sizeof(TryHandler) * TRY_HANDLER_MAX);
+    vm->callStack = malloc(sizeof(CallFrame) * CALL_STACK_MAX);
+    vm->maxFrames = CALL_STACK_MAX;
+    vm->scheduler = NULL;
+    vm->maxHeap = 0;
+    vm->timeoutMs = 0;
+    vm->deadline = 0;
+    vm->timeLeft = 0;
+    vm->watchdogMs = 0;
+    vm->watchdog = NULL;
+    atomic_init(&vm->ioProgress, 0);
+    vm->limitCountdown = LIMIT_POLL_INTERVAL;
+    vm->limitAbort = false;
+
+
+    vm->stackTop = 0;
+    vm->callStackTop = 0;
+    vm->fp = 0;
+    vm->loopSignal = LOOP_SIGNAL_NONE;
+    vm->chainSkipped = false;
+    vm->currentLine = 0;
+    vm->regBase = 0;
+    vm->regTop = 0;
+    vm->tryHandlerCount = 0;
+    vm->thrownValue = NIL_VAL;
+    vm->throwPending = false;
+    vm->panicking = false;
+    vm->errorDef = NULL;
+    vm->structShapes = 0;
+    vm->errorTraceCount = 0;
+    vm->errorTraceDepth = 0;
+    vm->nativeChunk = NULL;
+    vm->nativeIp = NULL;
+    vm->nativeCallee = NULL;
+    vm->nativeLine = 0;
+    vm->calledValues = NIL_VAL;
+    vm->regexCache = NULL;
+    vm->uonSchemas = NULL;
+    vm->debugger = NULL;
+    vm->traceOut = NULL;
+    vm->profiler = NULL;
+    vm->coverage = NULL;
+    vm->stepper = NULL;
+    vm->errorOut = stderr;
+    initOutput(vm);
+    vm->assertsPassed = 0;
+    vm->assertsFailed = 0;
+
+    // Initialize entire register file to NIL_VAL to prevent GC from scanning garbage
+    for (int i = 0; i < STACK_MAX; i++) {
+        vm->registers[i] = NIL_VAL;
+    }
+
+    vm->argc = 0;
+    vm->argv = NULL;
+    
+    // Create global environment (Starts GC allocation!)
+    vm->globalEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
+    vm->globalEnv->enclosing = NULL;
+    memset(vm->globalEnv->buckets, 0, sizeof(vm->globalEnv->buckets));
+    memset(vm->globalEnv->funcBuckets, 0, sizeof(vm->globalEnv->funcBuckets));
+    memset(vm->moduleBuckets, 0, sizeof(vm->moduleBuckets));
+    vm->importing = NULL;
+    vm->evalSources = NULL;
+    vm->evalDisabled = false;
+    
+    // Set current environment to global initially
+    vm->env = vm->globalEnv;
+    vm->defEnv = vm->globalEnv;
+    
+    // Set project root from current working directory
+    if (!getcwd(vm->projectRoot, sizeof(vm->projectRoot))) {
+        strcpy(vm->projectRoot, ".");
+    }
+    // Initialize extern handles
+    vm->externHandleCount = 0;
+    for (int i = 0; i < TABLE_SIZE; i++) vm->externHandles[i] = NULL;
+    
+    // Initialize string pool for performance optimization
+    vm->stringPool.capacity = 256;
+    vm->stringPool.slots = calloc(vm->stringPool.capacity, sizeof(ObjString*));
+    vm->stringPool.count = 0;
+    if (!vm->stringPool.slots) {
+        error("Memory allocation failed for string pool.", 0);
+    }
+    pthread_mutex_init(&vm->stringPool.lock, NULL);
+    
+    // Initialize value pool for basic types
+    vm->valuePool.capacity = 128;
+    vm->valuePool.values = malloc(vm->valuePool.capacity * sizeof(Value));
+    vm->valuePool.free_list = malloc(vm->valuePool.capacity * sizeof(int));
+    vm->valuePool.next_free = 0;
+    if (!vm->valuePool.values || !vm->valuePool.free_list) {
+        error("Memory allocation failed for value pool.", 0);
+    }
+    // Initialize free list
+    for (int i = 0; i < vm->valuePool.capacity - 1; i++) {
+        vm->valuePool.free_list[i] = i + 1;
+    }
+    vm->valuePool.free_list[vm->valuePool.capacity - 1] = -1;
+    
+    // Initialize async task queue
+    vm->taskQueue = NULL;
+    vm->taskCount = 0;
+    vm->taskCapacity = 0;
+    
+    // Initialize GC statistics
+    vm->gcPhase = 0;  // GC_IDLE
+    vm->gcCollectCount = 0;
+    vm->gcTotalPauseUs = 0;
+    vm->gcLastPauseUs = 0;
+    vm->gcTotalFreed = 0;
+    vm->gcLastCollectTime = 0;
+    vm->gcBytesAllocSinceGC = 0;
+    vm->gcYoungCount = 0;
+    vm->gcYoungTraced = 0;
+    vm->gcLastTraced = 0;
+    vm->gcPromoted = 0;
+    vm->gcRememberedTotal = 0;
+
+    defineErrorStruct(vm);
+}
+
+// Free VM memory
+// Old freeVM implementation removed (consolidated above)
+
+// Interpret AST
+void interpret(VM* vm, Node* ast) {
+    if (!ast) return;
+    
+    // Phase 0: Intern Strings (Critical for hashPointer)
+    internAST(vm, ast);
+    
+    // Phase 1: Resolve Locals (Calculate stack slots)
+    if (!resolveAST(vm, ast)) {
+        printf("Resolution failed.\n"); // Or handle error
+        return;
+    }
+    
+    // The script's own statements run in the globals, not in a block
+    // environment, so what it declares is global as in bytecode
+    if (ast->type != NODE_STMT_BLOCK) {
+        execute(vm, ast);
+        return;
+    }
+    for (int i = 0; i < ast->block.count; i++) {
+        execute(vm, ast->block.statements[i]);
+        if (vm->callStackTop > 0 && vm->callStack[vm->callStackTop - 1].hasReturned) break;
+    }
+}
+
+bool interpretLine(VM* vm, Node* ast, Value* result) {
+    if (!ast || ast->type != NODE_STMT_BLOCK || ast->block.count == 0) return false;
+
+    internAST(vm, ast);
+    if (!resolveAST(vm, ast)) {
+        printf("Resolution failed.\n");
+        return false;
+    }
+
+    // Everything but a trailing bare expression runs as usual
+    int last = ast->block.count - 1;
+    for (int i = 0; i < last; i++) {
+        execute(vm, ast->block.statements[i]);
+    }
+
+    Node* tail = ast->block.statements[last];
+    if (!isExpressionNode(tail)) {
+        execute(vm, tail);
+        return false;
+    }
+    *result = evaluate(vm, tail);
+    return true;
+}
+
+// Define a global variable with interning
+void defineGlobal(VM* vm, const char* name, Value value) {
+    vm->stack[vm->stackTop++] = value; // Interning may collect
+    ObjString* keyObj = internString(vm, name, (int)strlen(name));
+    vm->stackTop--;
+    char* key = keyObj->chars;
+    unsigned int h = keyObj->hash % TABLE_SIZE;
+    
+    // Check if exists
+    VarEntry* entry = vm->globalEnv->buckets[h];
+    while (entry) {
+        if (entry->key == key) {
+            entry->value = value;
+            GEN_BARRIER_VALUE(vm, vm->globalEnv, value);
+            return;
+        }
+        entry = entry->next;
+    }
+    
+    // Create new
+    entry = malloc(sizeof(VarEntry));
+    if (!entry) error("Memory allocation failed.", 0);
+    entry->key = key;
+    entry->keyString = keyObj; // Store for GC marking
+    entry->keyLength = (int)strlen(key);
+    entry->ownsKey = false;
+    entry->value = value;
+    entry->isConst = false;
+    entry->next = vm->globalEnv->buckets[h];
+    vm->globalEnv->buckets[h] = entry;
+    GEN_BARRIER(vm, vm->globalEnv, keyObj);
+    GEN_BARRIER_VALUE(vm, vm->globalEnv, value);
+}
+
+// Helper to define variable in current environment (for hybrid stack/env)
+static void defineInEnv(VM* vm, Environment* env, Token name, Value value) {
+    if (!env) return;
+    GEN_BARRIER_VALUE(vm, env, value);
+    // name.start is interned
+    unsigned int h = hash(name.start, name.length);
+    
+    // Check/Update existing in this env
+    VarEntry* entry = env->buckets[h];
+    while (entry) {
+        if (entry->key == name.start) {
+            entry->value = value;
+            return;
+        }
+        entry = entry->next;
+    }
+    
+    // Create new
+    entry = malloc(sizeof(VarEntry));
+    if (!entry) error("Memory allocation failed.", name.line);
+    entry->key = (char*)name.start;
+    entry->keyString = NULL; // Cannot get ObjString from Token here
+    entry->keyLength = name.length;
+    entry->ownsKey = false;
+    entry->value = value;
+    entry->isConst = false;
+    entry->next = env->buckets[h];
+    env->buckets[h] = entry;
+}
+
+// Set 'key' in env's variable buckets, adding an entry if needed
+static void setEnvValue(VM* vm, Environment* env, ObjString* keyObj, Value value) {
+    GEN_BARRIER(vm, env, keyObj);
+    GEN_BARRIER_VALUE(vm, env, value);
+    char* key = keyObj->chars;
+    unsigned int h = keyObj->hash % TABLE_SIZE;
+
+    // Check/Update existing in this env
+    VarEntry* ve = env->buckets[h];
+    while (ve) {
+        if (ve->key == key) {
+            ve->value = value;
+            return;
+        }
+        ve = ve->next;
+    }
+
+    // Create new variable entry
+    ve = malloc(sizeof(VarEntry));
+    ve->key = key;
+    ve->keyString = keyObj; // Store for GC marking
+    ve->keyLength = (int)strlen(key);
+    ve->ownsKey = false;
+    ve->value = value;
+    ve->isConst = false;
+    ve->next = env->buckets[h];
+    env->buckets[h] = ve;
+}
+
+// Define a native function in a specific environment with interning
+Function* defineNative(VM* vm, Environment* env, const char* name, NativeFn fn, int arity) {
+    ObjString* keyObj = internString(vm, name, (int)strlen(name));
+    char* key = keyObj->chars;
+    unsigned int h = keyObj->hash % TABLE_SIZE;
+    
+    FuncEntry* fe = malloc(sizeof(FuncEntry));
+    fe->key = key;
+    fe->keyString = keyObj; // Store for GC marking
+    fe->function = NULL;    // Allocating it below may collect
+    fe->next = env->funcBuckets[h];
+    env->funcBuckets[h] = fe;
+    GEN_BARRIER(vm, env, keyObj); // Before the allocation below can collect
+    
+    Function* func = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
+    func->isNative = true;
+    func->native = fn;
+    func->nativeData = NULL;
+    func->paramCount = arity;
+    func->requiredCount = arity;
+    func->isVariadic = false;
+    func->isMethod = false;
+    func->defaults = NULL;
+    func->name = (Token){TOKEN_IDENTIFIER, key, (int)strlen(key), 0, 0};
+    func->params = NULL;
+    func->body = NULL;
+    func->closure = NULL;
+    func->isAsync = false;
+    func->bytecodeChunk = NULL; // freeObject frees this if set
+    func->modulePath = NULL;
+    func->moduleEnv = env;
+    func->upvalueCount = 0;
+    func->upvalues = NULL;
+    func->proto = NULL;
+    func->obj.isMarked = true; // PERMANENT ROOT
+    func->obj.isPermanent = true; // Never sweep
+    
+    fe->function = func;
+    GEN_BARRIER(vm, env, func);
+
+    // ALSO register as a variable for Bytecode VM (OP_LOAD_GLOBAL checks variable buckets)
+    // We treat the function as a first-class object value
+    setEnvValue(vm, env, keyObj, OBJ_VAL(func));
+    return func;
+}
+
+// Define a plain value (such as ucoreMath.PI) in a library environment
+void defineNativeValue(VM* vm, Environment* env, const char* name, Value value) {
+    vm->stack[vm->stackTop++] = value; // Interning may collect
+    ObjString* keyObj = internString(vm, name, (int)strlen(name));
+    vm->stackTop--;
+    setEnvValue(vm, env, keyObj, value);
+}
+
+Module* defineNativeModule(VM* vm, const char* name) {
+    Module* mod = ALLOCATE_OBJ(vm, Module, OBJ_MODULE);
+    mod->name = strdup(name);
+    mod->env = NULL;
+    mod->source = NULL;
+    mod->obj.isMarked = true;
+    mod->obj.isPermanent = true; // PERMANENT ROOT
+
+    Environment* env = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
+    memset(env->buckets, 0, sizeof(env->buckets));
+    memset(env->funcBuckets, 0, sizeof(env->funcBuckets));
+    env->enclosing = NULL;
+    env->obj.isMarked = true;
+    env->obj.isPermanent = true; // PERMANENT ROOT
+    mod->env = env;
+    GEN_BARRIER(vm, mod, env);
+
+    defineGlobal(vm, name, OBJ_VAL(mod));
+    return mod;
+}
+
+void defineModuleAlias(VM* vm, Module* mod, const char* alias) {
+    defineGlobal(vm, alias, OBJ_VAL(mod));
+}
+
+// --- Built-in Natives Implementation ---
+
+static Value nativeHas(VM* vm, Value* args, int argCount) {
+    (void)vm;
+    if (argCount < 2) return NIL_VAL;
+    if (IS_SET(args[0])) return BOOL_VAL(setHas((Map*)AS_OBJ(args[0]), args[1]));
+    if (!IS_MAP(args[0])) return BOOL_VAL(false);
+    
+    Map* map = (Map*)AS_OBJ(args[0]);
+    
+    if (IS_STRING(args[1])) {
+        ObjString* key = AS_STRING(args[1]);
+        int bucket;
+        MapEntry* e = mapFindString(map, key, &bucket);
+        return BOOL_VAL(e != NULL);
+    } else if (IS_INT(args[1])) {
+        int bucket;
+        MapEntry* e = mapFindEntryInt(map, AS_INT(args[1]), &bucket);
+        return BOOL_VAL(e != NULL);
+    }
+    return BOOL_VAL(false);
+}
+
+static Value nativeDelete(VM* vm, Value* args, int argCount) {
+    if (argCount != 2 || !IS_MAP(args[0])) return BOOL_VAL(false);
+    Map* map = (Map*)AS_OBJ(args[0]);
+    if (map->frozen) return nativeError(vm, "Cannot modify frozen map.");
+    if (IS_STRING(args[1])) {
+        ObjString* key = AS_STRING(args[1]);
+        return BOOL_VAL(mapDeleteStr(map, key->chars, key->length));
+    } else if (IS_INT(args[1])) {
+        return BOOL_VAL(mapDeleteInt(map, AS_INT(args[1])));
+    }
+    return BOOL_VAL(false);
+}
+
+static Value nativeKeys(VM* vm, Value* args, int argCount) {
+    if (argCount < 1) return NIL_VAL;
+    if (!IS_MAP(args[0])) return NIL_VAL;
+    
+    Map* map = (Map*)AS_OBJ(args[0]);
+    Array* keys = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(keys); // root while interning keys
+    
+    for (MapEntry* e = mapFirstEntry(map); e; e = mapNextEntry(map, e)) {
+        if (e->key) {
+             ObjString* s = internString(vm, e->key, e->keyLength);
+             arrayPush(vm, keys, OBJ_VAL(s));
+        } else if (e->isIntKey) {
+             arrayPush(vm, keys, intValue(vm, e->intKey));
+        }
+    }
+    vm->stackTop--;
+    return OBJ_VAL(keys);
+}
+
+static Value nativeValues(VM* vm, Value* args, int argCount) {
+    if (argCount < 1) return NIL_VAL;
+    if (!IS_MAP(args[0])) return NIL_VAL;
+    
+    Map* map = (Map*)AS_OBJ(args[0]);
+    Array* values = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(values); // root while growing
+    
+    for (MapEntry* e = mapFirstEntry(map); e; e = mapNextEntry(map, e)) {
+        arrayPush(vm, values, e->value);
+    }
+    vm->stackTop--;
+    return OBJ_VAL(values);
+}
+
+// ordered_map(): an empty map whose keys(), values() and JSON encoding
+// follow insertion order
+static Value nativeOrderedMap(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (argCount != 0) return nativeError(vm, "ordered_map() expects 0 arguments but got %d.", argCount);
+    Map* m = newMap(vm);
+    m->ordered = true;
+    return OBJ_VAL(m);
+}
+
+// Add 'elements' to a new set, as set() and to_set() do; nil with an error
+// pending at the first that can't be an element
+static Value setOfElements(VM* vm, Value* elements, int count) {
+    Map* set = newSet(vm);
+    for (int i = 0; i < count; i++) {
+        if (!isSetElement(elements[i])) {
+            return nativeError(vm, "Set elements must be ints or strings, got %s.", valueTypeName(elements[i]));
+        }
+        setAdd(vm, set, elements[i]);
+    }
+    return OBJ_VAL(set);
+}
+
+// set(a, b, ...): a set of the arguments, the same as #{a, b, ...}
+static Value nativeSet(VM* vm, Value* args, int argCount) {
+    return setOfElements(vm, args, argCount);
+}
+
+// to_set(iterable): the distinct elements of an array, range or set, in
+// the order they first appear
+static Value nativeToSet(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "to_set() expects 1 argument but got %d.", argCount);
+    if (!isIterable(args[0]) && !IS_SET(args[0])) {
+        return nativeError(vm, "to_set() expects an array, range or set, got %s.", valueTypeName(args[0]));
+    }
+    Value source = iterableOf(vm, args[0]);
+    vm->stack[vm->stackTop++] = source;
+    Map* set = newSet(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(set); // A range may box the ints it steps to
+    Value cursor = INT_VAL(0), element;
+    while (iteratorNext(vm, source, &cursor, &element)) {
+        if (!isSetElement(element)) {
+            vm->stackTop -= 2;
+            return nativeError(vm, "Set elements must be ints or strings, got %s.", valueTypeName(element));
+        }
+        setAdd(vm, set, element);
+    }
+    vm->stackTop -= 2;
+    return OBJ_VAL(set);
+}
+
+// add(set, element): true when element was not in the set yet
+static Value nativeAdd(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "add() expects 2 arguments but got %d.", argCount);
+    if (!IS_SET(args[0])) return nativeError(vm, "add() expects a set, got %s.", valueTypeName(args[0]));
+    Map* set = (Map*)AS_OBJ(args[0]);
+    if (set->frozen) return nativeError(vm, "Cannot modify frozen set.");
+    if (!isSetElement(args[1])) {
+        return nativeError(vm, "Set elements must be ints or strings, got %s.", valueTypeName(args[1]));
+    }
+    return BOOL_VAL(setAdd(vm, set, args[1]));
+}
+
+// remove(set, element): true when element was in the set
+static Value nativeRemove(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "remove() expects 2 arguments but got %d.", argCount);
+    if (!IS_SET(args[0])) return nativeError(vm, "remove() expects a set, got %s.", valueTypeName(args[0]));
+    Map* set = (Map*)AS_OBJ(args[0]);
+    if (set->frozen) return nativeError(vm, "Cannot modify frozen set.");
+    return BOOL_VAL(setRemove(set, args[1]));
+}
+
+// Call a function value from a native, whichever mode defined it
+static Value invokeFunction(VM* vm, Function* func, Value* args, int argCount) {
+    if (func->isNative) {
+        vm->nativeCallee = func;
+        return func->native(vm, args, argCount);
+    }
+    if (func->bytecodeChunk) return callBytecodeFunction(vm, func, args, argCount);
+    return callFunction(vm, func, args, argCount);
+}
+
+static Value nativeLength(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return NIL_VAL;
+    if (IS_STRING(args[0])) return INT_VAL(((ObjString*)AS_OBJ(args[0]))->length);
+    if (IS_ARRAY(args[0])) return INT_VAL(((Array*)AS_OBJ(args[0]))->count);
+    if (IS_MAP(args[0]) || IS_SET(args[0])) return INT_VAL(((Map*)AS_OBJ(args[0]))->count);
+    if (IS_STRING_BUILDER(args[0])) return INT_VAL(((StringBuilder*)AS_OBJ(args[0]))->length);
+    if (IS_OBJ(args[0]) && AS_OBJ(args[0])->type == OBJ_RANGE) return intValue(vm, rangeLength((Range*)AS_OBJ(args[0])));
+    if (IS_OBJ(args[0]) && AS_OBJ(args[0])->type == OBJ_STRUCT_INSTANCE) {
+        Function* method = specialMethod(args[0], "__len__");
+        if (!method) {
+            return nativeError(vm, "Struct '%s' has no __len__ method.", ((StructInstance*)AS_OBJ(args[0]))->def->name);
+        }
+        Value n = invokeFunction(vm, method, args, 1);
+        if (vm->throwPending) return NIL_VAL;
+        if (!IS_INT(n)) return nativeError(vm, "__len__ must return an int, got %s.", valueTypeName(n));
+        return n;
+    }
+    return INT_VAL(0);
+}
+
+static Value nativePush(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return NIL_VAL;
+    if (!IS_ARRAY(args[0])) return NIL_VAL;
+    Array* arr = (Array*)AS_OBJ(args[0]);
+    if (arr->frozen) return nativeError(vm, "Cannot modify frozen array.");
+    arrayPush(vm, arr, args[1]);
+    return INT_VAL(arr->count);
+}
+
+static Value nativePop(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return NIL_VAL;
+    if (!IS_ARRAY(args[0])) return NIL_VAL;
+    if (((Array*)AS_OBJ(args[0]))->frozen) return nativeError(vm, "Cannot modify frozen array.");
+    Value v;
+    if (arrayPop((Array*)AS_OBJ(args[0]), &v)) return v;
+    return NIL_VAL;
+}
+
+// Bytewise order of two strings, a shorter prefix first: <0, 0 or >0
+int compareStrings(ObjString* a, ObjString* b) {
+    int n = a->length < b->length ? a->length : b->length;
+    int c = memcmp(a->chars, b->chars, n);
+    return c != 0 ? c : a->length - b->length;
+}
+
+// Natural order for sort(): numbers by value, strings bytewise
+static int compareNatural(Value a, Value b) {
+    if (IS_STRING(a)) return compareStrings(AS_STRING(a), AS_STRING(b));
+    if (IS_INT(a) && IS_INT(b)) return AS_INT(a) < AS_INT(b) ? -1 : AS_INT(a) > AS_INT(b);
+    double x = IS_INT(a) ? (double)AS_INT(a) : AS_FLOAT(a);
+    double y = IS_INT(b) ? (double)AS_INT(b) : AS_FLOAT(b);
+    return x < y ? -1 : x > y;
+}
+
+// Sign of cmp(a, b), or 0 with throwPending set when the call fails
+static int compareWith(VM* vm, Function* cmp, Value a, Value b) {
+    Value args[2] = {a, b};
+    Value r = invokeFunction(vm, cmp, args, 2);
+    if (vm->throwPending) return 0;
+    if (IS_INT(r)) return AS_INT(r) < 0 ? -1 : AS_INT(r) > 0;
+    if (IS_FLOAT(r)) return AS_FLOAT(r) < 0 ? -1 : AS_FLOAT(r) > 0;
+    nativeError(vm, "sort() comparator must return a number, got %s.", valueTypeName(r));
+    return 0;
+}
+
+// Stable merge sort of items[lo..hi) using tmp as scratch. Returns false
+// once a comparator call has thrown.
+static bool mergeSort(VM* vm, Value* items, Value* tmp, int lo, int hi, Function* cmp) {
+    if (hi - lo < 2) return true;
+    int mid = lo + (hi - lo) / 2;
+    if (!mergeSort(vm, items, tmp, lo, mid, cmp)) return false;
+    if (!mergeSort(vm, items, tmp, mid, hi, cmp)) return false;
+    int i = lo, j = mid, k = lo;
+    while (i < mid && j < hi) {
+        // Take from the right only when strictly smaller: keeps equal items in order
+        int c = cmp ? compareWith(vm, cmp, items[i], items[j]) : compareNatural(items[i], items[j]);
+        if (vm->throwPending) return false;
+        tmp[k++] = c > 0 ? items[j++] : items[i++];
+    }
+    while (i < mid) tmp[k++] = items[i++];
+    while (j < hi) tmp[k++] = items[j++];
+    memcpy(items + lo, tmp + lo, sizeof(Value) * (hi - lo));
+    return true;
+}
+
+// sort(arr) / sort(arr, cmp): stable in-place sort, returns arr
+static Value nativeSort(VM* vm, Value* args, int argCount) {
+    if (argCount < 1 || argCount > 2) return nativeError(vm, "sort() takes 1 or 2 arguments, got %d.", argCount);
+    if (!IS_ARRAY(args[0])) return nativeError(vm, "sort() expects an array, got %s.", valueTypeName(args[0]));
+    Function* cmp = NULL;
+    if (argCount == 2) {
+        if (!IS_OBJ(args[1]) || AS_OBJ(args[1])->type != OBJ_FUNCTION) {
+            return nativeError(vm, "sort() comparator must be a function, got %s.", valueTypeName(args[1]));
+        }
+        cmp = (Function*)AS_OBJ(args[1]);
+    }
+    Value arrVal = args[0];
+    Array* arr = (Array*)AS_OBJ(arrVal);
+    int n = arr->count;
+    if (arr->frozen) return nativeError(vm, "Cannot modify frozen array.");
+
+    if (!cmp) {
+        for (int i = 0; i < n; i++) {
+            Value v = arr->items[i];
+            bool number = IS_INT(v) || IS_FLOAT(v);
+            if (!number && !IS_STRING(v)) {
+                return nativeError(vm, "sort() cannot order %s values without a comparator.", valueTypeName(v));
+            }
+            if (i > 0 && number != (IS_INT(arr->items[0]) || IS_FLOAT(arr->items[0]))) {
+                return nativeError(vm, "sort() cannot compare %s with %s without a comparator.",
+                                   valueTypeName(arr->items[0]), valueTypeName(v));
+            }
+        }
+    }
+
+    // Sort a snapshot held in GC-visible arrays: the comparator may
+    // allocate, collect or even modify arr while the sort runs
+    Array* work = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(work);
+    Array* tmp = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(tmp);
+    vm->stack[vm->stackTop++] = arrVal;
+    if (cmp) vm->stack[vm->stackTop++] = OBJ_VAL(cmp);
+    for (int i = 0; i < n; i++) {
+        arrayPush(vm, work, arr->items[i]);
+        arrayPush(vm, tmp, NIL_VAL);
+    }
+
+    bool ok = mergeSort(vm, work->items, tmp->items, 0, n, cmp);
+    if (ok && arr->frozen) {
+        nativeError(vm, "Cannot modify frozen array."); // Frozen by the comparator
+        ok = false;
+    }
+    if (ok) {
+        arr->count = 0;
+        for (int i = 0; i < n; i++) arrayPush(vm, arr, work->items[i]);
+        WRITE_BARRIER(vm, arr);
+    }
+    vm->stackTop -= cmp ? 4 : 3;
+    return ok ? arrVal : NIL_VAL;
+}
+
+// The callback of map/filter/reduce, or NULL when 'v' is not a function
+static Function* callbackArg(Value v) {
+    if (!IS_OBJ(v) || AS_OBJ(v)->type != OBJ_FUNCTION) return NULL;
+    return (Function*)AS_OBJ(v);
+}
+
+// map() is an empty map; map(arr, fn) is a new array of fn(x) for each
+// element. The result is rooted while fn runs, since fn may allocate and
+// collect; arr is read by index so fn may even change it.
+static Value nativeMap(VM* vm, Value* args, int argCount) {
+    if (argCount == 0) return OBJ_VAL(newMap(vm));
+    if (argCount != 2) return nativeError(vm, "map() takes 0 or 2 arguments, got %d.", argCount);
+    if (!IS_ARRAY(args[0])) return nativeError(vm, "map() expects an array, got %s.", valueTypeName(args[0]));
+    Function* fn = callbackArg(args[1]);
+    if (!fn) return nativeError(vm, "map() callback must be a function, got %s.", valueTypeName(args[1]));
+
+    Value arrVal = args[0];
+    Array* arr = (Array*)AS_OBJ(arrVal);
+    Array* result = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(result);
+    vm->stack[vm->stackTop++] = arrVal;
+    vm->stack[vm->stackTop++] = OBJ_VAL(fn);
+    for (int i = 0; i < arr->count; i++) {
+        Value item = arr->items[i];
+        Value mapped = invokeFunction(vm, fn, &item, 1);
+        if (vm->throwPending) break;
+        arrayPush(vm, result, mapped);
+        WRITE_BARRIER(vm, result);
+    }
+    vm->stackTop -= 3;
+    return vm->throwPending ? NIL_VAL : OBJ_VAL(result);
+}
+
+// filter(arr, fn): a new array of the elements for which fn(x) is truthy
+static Value nativeFilter(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "filter() takes 2 arguments, got %d.", argCount);
+    if (!IS_ARRAY(args[0])) return nativeError(vm, "filter() expects an array, got %s.", valueTypeName(args[0]));
+    Function* fn = callbackArg(args[1]);
+    if (!fn) return nativeError(vm, "filter() callback must be a function, got %s.", valueTypeName(args[1]));
+
+    Value arrVal = args[0];
+    Array* arr = (Array*)AS_OBJ(arrVal);
+    Array* result = newArray(vm);
+    vm->stack[vm->stackTop++] = OBJ_VAL(result);
+    vm->stack[vm->stackTop++] = arrVal;
+    vm->stack[vm->stackTop++] = OBJ_VAL(fn);
+    for (int i = 0; i < arr->count; i++) {
+        Value item = arr->items[i];
+        vm->stack[vm->stackTop++] = item; // fn may drop it from arr
+        Value keep = invokeFunction(vm, fn, &item, 1);
+        vm->stackTop--;
+        if (vm->throwPending) break;
+        if (isTruthy(keep)) {
+            arrayPush(vm, result, item);
+            WRITE_BARRIER(vm, result);
+        }
+    }
+    vm->stackTop -= 3;
+    return vm->throwPending ? NIL_VAL : OBJ_VAL(result);
+}
+
+// reduce(arr, fn, init): fn(acc, x) over the elements from the left,
+// starting from init, or from the first element when init is omitted
+static Value nativeReduce(VM* vm, Value* args, int argCount) {
+    if (argCount < 2 || argCount > 3) return nativeError(vm, "reduce() takes 2 or 3 arguments, got %d.", argCount);
+    if (!IS_ARRAY(args[0])) return nativeError(vm, "reduce() expects an array, got %s.", valueTypeName(args[0]));
+    Function* fn = callbackArg(args[1]);
+    if (!fn) return nativeError(vm, "reduce() callback must be a function, got %s.", valueTypeName(args[1]));
+
+    Value arrVal = args[0];
+    Array* arr = (Array*)AS_OBJ(arrVal);
+    int start = 0;
+    Value acc;
+    if (argCount == 3) {
+        acc = args[2];
+    } else if (arr->count == 0) {
+        return nativeError(vm, "reduce() of an empty array needs an initial value.");
+    } else {
+        acc = arr->items[0];
+        start = 1;
+    }
+
+    vm->stack[vm->stackTop++] = arrVal;
+    vm->stack[vm->stackTop++] = OBJ_VAL(fn);
+    int accSlot = vm->stackTop++;
+    vm->stack[accSlot] = acc; // Rooted between calls
+    for (int i = start; i < arr->count; i++) {
+        Value pair[2] = {vm->stack[accSlot], arr->items[i]};
+        Value next = invokeFunction(vm, fn, pair, 2);
+        if (vm->throwPending) break;
+        vm->stack[accSlot] = next;
+    }
+    acc = vm->stack[accSlot];
+    vm->stackTop -= 3;
+    return vm->throwPending ? NIL_VAL : acc;
+}
+
+// wadd/wsub/wmul: integer arithmetic that wraps around instead of raising
+// an overflow. Unsigned math is modulo 2^64, which read back as two's
+// complement is the wrapped int.
+static bool wrapArgs(VM* vm, const char* name, Value* args, int argCount, uint64_t* a, uint64_t* b) {
+    if (argCount != 2) {
+        nativeError(vm, "%s() takes 2 arguments, got %d.", name, argCount);
+        return false;
+    }
+    if (!IS_INT(args[0]) || !IS_INT(args[1])) {
+        nativeError(vm, "%s() expects two ints, got %s and %s.", name,
+                    valueTypeName(args[0]), valueTypeName(args[1]));
+        return false;
+    }
+    *a = (uint64_t)AS_INT(args[0]);
+    *b = (uint64_t)AS_INT(args[1]);
+    return true;
+}
+
+static Value nativeWadd(VM* vm, Value* args, int argCount) {
+    uint64_t a, b;
+    if (!wrapArgs(vm, "wadd", args, argCount, &a, &b)) return NIL_VAL;
+    return intValue(vm, (int64_t)(a + b));
+}
+
+static Value nativeWsub(VM* vm, Value* args, int argCount) {
+    uint64_t a, b;
+    if (!wrapArgs(vm, "wsub", args, argCount, &a, &b)) return NIL_VAL;
+    return intValue(vm, (int64_t)(a - b));
+}
+
+static Value nativeWmul(VM* vm, Value* args, int argCount) {
+    uint64_t a, b;
+    if (!wrapArgs(vm, "wmul", args, argCount, &a, &b)) return NIL_VAL;
+    return intValue(vm, (int64_t)(a * b));
+}
+
+// popcount/clz/rotl see an int as its 64 bits, the same bits the bitwise
+// operators work on, so a negative number has its high bits set.
+static bool bitsArg(VM* vm, const char* name, Value v, uint64_t* bits) {
+    if (!IS_INT(v)) {
+        nativeError(vm, "%s() expects an int, got %s.", name, valueTypeName(v));
+        return false;
+    }
+    *bits = (uint64_t)AS_INT(v);
+    return true;
+}
+
+static Value nativePopcount(VM* vm, Value* args, int argCount) {
+    uint64_t bits;
+    if (argCount != 1) return nativeError(vm, "popcount() takes 1 argument, got %d.", argCount);
+    if (!bitsArg(vm, "popcount", args[0], &bits)) return NIL_VAL;
+    return INT_VAL(__builtin_popcountll(bits));
+}
+
+// Leading zero bits of the 64, so 64 for zero and 0 for a negative number
+static Value nativeClz(VM* vm, Value* args, int argCount) {
+    uint64_t bits;
+    if (argCount != 1) return nativeError(vm, "clz() takes 1 argument, got %d.", argCount);
+    if (!bitsArg(vm, "clz", args[0], &bits)) return NIL_VAL;
+    if (bits == 0) return INT_VAL(INT_BITS);
+    return INT_VAL(__builtin_clzll(bits));
+}
+
+// Rotates left by n modulo 64; a negative n rotates right
+static Value nativeRotl(VM* vm, Value* args, int argCount) {
+    uint64_t bits;
+    if (argCount != 2) return nativeError(vm, "rotl() takes 2 arguments, got %d.", argCount);
+    if (!bitsArg(vm, "rotl", args[0], &bits)) return NIL_VAL;
+    if (!IS_INT(args[1])) {
+        return nativeError(vm, "rotl() expects an int count, got %s.", valueTypeName(args[1]));
+    }
+    int64_t n = AS_INT(args[1]) % INT_BITS;
+    if (n < 0) n += INT_BITS;
+    if (n == 0) return args[0];
+    return intValue(vm, (int64_t)((bits << n) | (bits >> (INT_BITS - n))));
+}
+
+// Name of a value's runtime type, as returned by typeof()
+const char* valueTypeName(Value v) {
+    switch (getValueType(v)) {
+        case VAL_INT:   return "int";
+        case VAL_FLOAT: return "double";
+        case VAL_BOOL:  return "bool";
+        case VAL_NIL:   return "nil";
+        case VAL_OBJ:
+            switch (AS_OBJ(v)->type) {
+                case OBJ_STRING:          return "string";
+                case OBJ_ARRAY:           return "array";
+                case OBJ_MAP:             return "map";
+                case OBJ_FUNCTION:        return "function";
+                case OBJ_STRUCT_DEF:      return "struct";
+                case OBJ_STRUCT_INSTANCE: return "object";
+                case OBJ_MODULE:          return "module";
+                case OBJ_FUTURE:          return "future";
+                case OBJ_RESOURCE:        return "resource";
+                case OBJ_RANGE:           return "range";
+                case OBJ_BOUND_METHOD:    return "function";
+                case OBJ_CHANNEL:         return "channel";
+                case OBJ_SET:             return "set";
+                case OBJ_STRING_BUILDER:  return "string_builder";
+                default: break;
+            }
+            break;
+    }
+    return "unknown";
+}
+
+// typeof(x): name of the value's runtime type
+static Value nativeTypeof(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return NIL_VAL;
+    const char* name = valueTypeName(args[0]);
+    return OBJ_VAL(internString(vm, name, (int)strlen(name)));
+}
+
+// Worked out in 128 bits, as a range may run from one end of the ints to
+// the other; one longer than INT64_MAX counts as that
+int64_t rangeLength(Range* r) {
+    __int128 span = r->step > 0 ? (__int128)r->stop - r->start : (__int128)r->start - r->stop;
+    __int128 stride = r->step > 0 ? (__int128)r->step : -(__int128)r->step;
+    __int128 length = span > 0 ? (span + stride - 1) / stride : 0;
+    return length > INT64_MAX ? INT64_MAX : (int64_t)length;
+}
+
+// range(stop), range(start, stop), range(start, stop, step): a lazy
+// sequence of integers; nothing is materialized until it is iterated
+static Value nativeRange(VM* vm, Value* args, int argCount) {
+    if (argCount < 1 || argCount > 3) {
+        return nativeError(vm, "range expects 1 to 3 arguments but got %d.", argCount);
+    }
+    for (int i = 0; i < argCount; i++) {
+        if (!IS_INT(args[i])) {
+            return nativeError(vm, "range expects integer arguments but got %s.", valueTypeName(args[i]));
+        }
+    }
+    int64_t start = 0, stop, step = 1;
+    if (argCount == 1) {
+        stop = AS_INT(args[0]);
+    } else {
+        start = AS_INT(args[0]);
+        stop = AS_INT(args[1]);
+        if (argCount == 3) step = AS_INT(args[2]);
+    }
+    if (step == 0) return nativeError(vm, "range step cannot be zero.");
+
+    Range* r = ALLOCATE_OBJ(vm, Range, OBJ_RANGE);
+    r->start = start;
+    r->stop = stop;
+    r->step = step;
+    return OBJ_VAL(r);
+}
+
+// channel(), channel(capacity): unbuffered unless a capacity is given
+static Value nativeChannel(VM* vm, Value* args, int argCount) {
+    if (argCount > 1) return nativeError(vm, "channel() takes 0 or 1 arguments, got %d.", argCount);
+    int64_t capacity = 0;
+    if (argCount == 1) {
+        if (!IS_INT(args[0])) {
+            return nativeError(vm, "channel() expects an int capacity, got %s.", valueTypeName(args[0]));
+        }
+        capacity = AS_INT(args[0]);
+        if (capacity < 0 || capacity > INT32_MAX) {
+            return nativeError(vm, "channel() capacity must be between 0 and %d.", INT32_MAX);
+        }
+    }
+    return OBJ_VAL(newChannel(vm, (int)capacity));
+}
+
+static Channel* channelArg(VM* vm, const char* name, Value v) {
+    if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_CHANNEL) return (Channel*)AS_OBJ(v);
+    nativeError(vm, "%s() expects a channel, got %s.", name, valueTypeName(v));
+    return NULL;
+}
+
+static Value nativeSend(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "send() takes 2 arguments, got %d.", argCount);
+    Channel* ch = channelArg(vm, "send", args[0]);
+    if (ch) channelSend(vm, ch, args[1]);
+    return NIL_VAL;
+}
+
+static Value nativeRecv(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "recv() takes 1 argument, got %d.", argCount);
+    Channel* ch = channelArg(vm, "recv", args[0]);
+    Value value = NIL_VAL;
+    if (ch && !channelReceive(vm, ch, &value)) return NIL_VAL;
+    return value;
+}
+
+static Value nativeYield(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (argCount != 0) return nativeError(vm, "yield() takes no arguments, got %d.", argCount);
+    yieldCoroutine(vm);
+    return NIL_VAL;
+}
+
+Function* findMethod(StructDef* def, const char* name, int length) {
+    for (int i = 0; i < def->methodCount; i++) {
+        Token n = def->methods[i]->name;
+        if (n.length == length && memcmp(n.start, name, length) == 0) return def->methods[i];
+    }
+    return NULL;
+}
+
+Function* resourceCloser(Value resource) {
+    if (!IS_OBJ(resource) || AS_OBJ(resource)->type != OBJ_STRUCT_INSTANCE) return NULL;
+    return findMethod(((StructInstance*)AS_OBJ(resource))->def, "__close__", 9);
+}
+
+bool setMaxFrames(VM* vm, int frames) {
+    if (frames < 1 || frames > MAX_FRAMES_LIMIT || vm->callStackTop > frames) return false;
+    CallFrame* resized = realloc(vm->callStack, sizeof(CallFrame) * frames);
+    if (!resized) return false;
+    vm->callStack = resized;
+    vm->maxFrames = frames;
+    return true;
+}
+
+Function* specialMethod(Value v, const char* name) {
+    if (!IS_OBJ(v) || AS_OBJ(v)->type != OBJ_STRUCT_INSTANCE) return NULL;
+    return findMethod(((StructInstance*)AS_OBJ(v))->def, name, (int)strlen(name));
+}
+
+bool callOperator(VM* vm, const char* name, Value left, Value right, Value* result) {
+    Function* method = specialMethod(left, name);
+    if (!method) return false;
+    int base = vm->stackTop;
+    vm->stack[vm->stackTop++] = left;
+    vm->stack[vm->stackTop++] = right;
+    *result = invokeFunction(vm, method, &vm->stack[base], 2);
+    vm->stackTop = base;
+    return true;
+}
+
+// left == right inside a derived comparison: __eq__ when the left operand
+// defines it, else whether both are the same instance
+static bool operatorEqual(VM* vm, Value left, Value right) {
+    Value r;
+    if (callOperator(vm, "__eq__", left, right, &r)) return !vm->throwPending && isTruthy(r);
+    return IS_OBJ(right) && AS_OBJ(left) == AS_OBJ(right);
+}
+
+bool compareOperator(VM* vm, TokenType op, Value left, Value right, bool* result) {
+    Value r;
+    if (op == TOKEN_EQUAL_EQUAL || op == TOKEN_BANG_EQUAL) {
+        if (!callOperator(vm, "__eq__", left, right, &r)) return false;
+        *result = isTruthy(r) == (op == TOKEN_EQUAL_EQUAL);
+        return true;
+    }
+    if (!callOperator(vm, "__lt__", left, right, &r)) return false;
+    if (vm->throwPending) return true;
+    bool less = isTruthy(r);
+    switch (op) {
+        case TOKEN_LESS:          *result = less; break;
+        case TOKEN_GREATER_EQUAL: *result = !less; break;
+        case TOKEN_LESS_EQUAL:    *result = less || operatorEqual(vm, left, right); break;
+        default:                  *result = !less && !operatorEqual(vm, left, right); break;
+    }
+    return true;
+}
+
+ObjString* structString(VM* vm, Value v) {
+    Function* method = specialMethod(v, "__str__");
+    if (!method) return NULL;
+    vm->stack[vm->stackTop++] = v;
+    Value s = invokeFunction(vm, method, &vm->stack[vm->stackTop - 1], 1);
+    vm->stackTop--;
+    if (vm->throwPending) return NULL;
+    if (!IS_STRING(s)) {
+        nativeError(vm, "__str__ must return a string, got %s.", valueTypeName(s));
+        return NULL;
+    }
+    return AS_STRING(s);
+}
+
+// The caller keeps the receiver rooted
+BoundMethod* newBoundMethod(VM* vm, Value receiver, Function* method) {
+    BoundMethod* bound = ALLOCATE_OBJ(vm, BoundMethod, OBJ_BOUND_METHOD);
+    bound->receiver = receiver;
+    bound->method = method;
+    return bound;
+}
+
+// --- printf / sprintf ---
+
+// Growable text for the formatting natives
+typedef struct {
+    char* chars;
+    int length;
+    int capacity;
+} TextBuffer;
+
+static void textAppend(TextBuffer* b, const char* s, int n) {
+    if (b->length + n + 1 > b->capacity) {
+        int cap = b->capacity < 64 ? 64 : b->capacity;
+        while (b->length + n + 1 > cap) cap *= 2;
+        b->chars = realloc(b->chars, cap);
+        b->capacity = cap;
+    }
+    memcpy(b->chars + b->length, s, n);
+    b->length += n;
+    b->chars[b->length] = '\0';
+}
+
+static void textAppendRepeat(TextBuffer* b, char c, int n) {
+    for (int i = 0; i < n; i++) textAppend(b, &c, 1);
+}
+
+// The same text print() shows for a value. A __str__ that throws leaves
+// throwPending set.
+static void textAppendValue(VM* vm, TextBuffer* b, Value v) {
+    char tmp[64];
+    if (IS_OBJ(v) && !IS_STRING(v) && !IS_INT(v)) {
+        Obj* o = AS_OBJ(v);
+        if (o->type == OBJ_ARRAY) {
+            Array* arr = (Array*)o;
+            textAppend(b, "[", 1);
+            for (int i = 0; i < arr->count && !vm->throwPending; i++) {
+                if (i > 0) textAppend(b, ", ", 2);
+                textAppendValue(vm, b, arr->items[i]);
+            }
+            textAppend(b, "]", 1);
+        } else if (o->type == OBJ_MAP) {
+            textAppend(b, "<map>", 5);
+        } else if (o->type == OBJ_SET) {
+            Map* set = (Map*)o;
+            textAppend(b, "#{", 2);
+            for (MapEntry* e = set->first; e; e = e->after) {
+                textAppendValue(vm, b, e->value);
+                if (e->after) textAppend(b, ", ", 2);
+            }
+            textAppend(b, "}", 1);
+        } else if (o->type == OBJ_FUNCTION && ((Function*)o)->name.start) {
+            Function* f = (Function*)o;
+            int n = snprintf(tmp, sizeof(tmp), "<fn %.*s>", f->name.length, f->name.start);
+            textAppend(b, tmp, n < (int)sizeof(tmp) ? n : (int)sizeof(tmp) - 1);
+        } else if (o->type == OBJ_BOUND_METHOD) {
+            Function* f = ((BoundMethod*)o)->method;
+            int n = snprintf(tmp, sizeof(tmp), "<method %.*s>", f->name.length, f->name.start);
+            textAppend(b, tmp, n < (int)sizeof(tmp) ? n : (int)sizeof(tmp) - 1);
+        } else if (o->type == OBJ_CHANNEL) {
+            textAppend(b, "<channel>", 9);
+        } else if (o->type == OBJ_STRING_BUILDER) {
+            StringBuilder* sb = (StringBuilder*)o;
+            textAppend(b, sb->chars, sb->length);
+        } else if (specialMethod(v, "__str__")) {
+            ObjString* text = structString(vm, v);
+            if (text) textAppend(b, text->chars, text->length);
+        } else {
+            textAppend(b, "<obj>", 5);
+        }
+        return;
+    }
+    const char* text = valueToChars(v, tmp, sizeof(tmp));
+    textAppend(b, text, IS_STRING(v) ? AS_STRING(v)->length : (int)strlen(text));
+}
+
+#define FORMAT_WIDTH_MAX 1024
+
+// One %[flags][width][.precision]verb directive
+typedef struct {
+    bool left, zero, plus, space;
+    int width;      // 0 when absent
+    int precision;  // -1 when absent
+    char verb;
+} FormatSpec;
+
+// Parse the directive after the '%' at fmt[*pos]; false with a message on error
+static bool parseFormatSpec(const char* fmt, int len, int* pos, FormatSpec* spec, char* err, size_t errSize) {
+    int i = *pos;
+    memset(spec, 0, sizeof(*spec));
+    spec->precision = -1;
+    for (; i < len; i++) {
+        if (fmt[i] == '-') spec->left = true;
+        else if (fmt[i] == '0') spec->zero = true;
+        else if (fmt[i] == '+') spec->plus = true;
+        else if (fmt[i] == ' ') spec->space = true;
+        else break;
+    }
+    for (; i < len && fmt[i] >= '0' && fmt[i] <= '9'; i++) {
+        spec->width = spec->width * 10 + (fmt[i] - '0');
+        if (spec->width > FORMAT_WIDTH_MAX) {
+            snprintf(err, errSize, "width is larger than %d", FORMAT_WIDTH_MAX);
+            return false;
         }
-        
-        case NODE_STMT_RETURN: {
-            if (vm->callStackTop == 0) {
-                 error("Return outside function.", 0);
-                 break;
-            }
-            CallFrame* frame = &vm->callStack[vm->callStackTop - 1];
-            frame->hasReturned = true;
-            if (node->returnStmt.value) {
-                frame->returnValue = evaluate(vm, node->returnStmt.value);
-            } else {
-                frame->returnValue = NIL_VAL;
+    }
+    if (i < len && fmt[i] == '.') {
+        spec->precision = 0;
+        for (i++; i < len && fmt[i] >= '0' && fmt[i] <= '9'; i++) {
+            spec->precision = spec->precision * 10 + (fmt[i] - '0');
+            if (spec->precision > FORMAT_WIDTH_MAX) {
+                snprintf(err, errSize, "precision is larger than %d", FORMAT_WIDTH_MAX);
+                return false;
             }
-            break;
         }
-        
-        default:
-             evaluate(vm, node);
-             break;
     }
+    if (i >= len) {
+        snprintf(err, errSize, "ends in the middle of a directive");
+        return false;
+    }
+    spec->verb = fmt[i];
+    if (!strchr("dfsxX%", spec->verb)) {
+        snprintf(err, errSize, "has unknown verb '%%%c'", spec->verb);
+        return false;
+    }
+    *pos = i + 1;
+    return true;
 }
 
-// Evaluate expression
-static Value evaluate(VM* vm, Node* node) {
-    if (!node) {
-        error("Null expression.", 0);
-        return NIL_VAL;
+// Append sign + body padded to the spec's width. Zeros go after the sign.
+static void textAppendPadded(TextBuffer* b, const FormatSpec* spec, const char* sign, const char* body, int bodyLen, bool zeroOk) {
+    int signLen = (int)strlen(sign);
+    int pad = spec->width - signLen - bodyLen;
+    if (pad < 0) pad = 0;
+    if (spec->left) {
+        textAppend(b, sign, signLen);
+        textAppend(b, body, bodyLen);
+        textAppendRepeat(b, ' ', pad);
+    } else if (spec->zero && zeroOk) {
+        textAppend(b, sign, signLen);
+        textAppendRepeat(b, '0', pad);
+        textAppend(b, body, bodyLen);
+    } else {
+        textAppendRepeat(b, ' ', pad);
+        textAppend(b, sign, signLen);
+        textAppend(b, body, bodyLen);
     }
+}
 
-    switch (node->type) {
-        case NODE_EXPR_LITERAL: {
-            if (node->literal.token.type == TOKEN_NUMBER) {
-                // Heuristic: if contains dot, float
-                bool isFloat = false;
-                for (int i = 0; i < node->literal.token.length; i++) {
-                    if (node->literal.token.start[i] == '.') { isFloat = true; break; }
-                }
-                char buf[64];
-                int len = node->literal.token.length;
-                if (len < 0) len = 0;
-                if (len >= 64) len = 63;
-                memcpy(buf, node->literal.token.start, (size_t)len);
-                buf[len] = '\0';
-                
-                if (isFloat) {
-                    return FLOAT_VAL(strtod(buf, NULL));
-                } else {
-                    return INT_VAL(atoi(buf));
-                }
-            } else if (node->literal.token.type == TOKEN_STRING) {
-                // Strip quotes
-                const char* start = node->literal.token.start + 1;
-                int len = node->literal.token.length - 2;
-                ObjString* s = internString(vm, start, len);
-                Value v = OBJ_VAL(s);
-                return v;
-            } else if (node->literal.token.type == TOKEN_TRUE) {
-                return BOOL_VAL(true);
-            } else if (node->literal.token.type == TOKEN_FALSE) {
-                return BOOL_VAL(false);
-            } else if (node->literal.token.type == TOKEN_NIL) {
-                return NIL_VAL;
+static const char* formatSign(const FormatSpec* spec, bool negative) {
+    if (negative) return "-";
+    if (spec->plus) return "+";
+    return spec->space ? " " : "";
+}
+
+// Format one argument; false with a message when its type doesn't fit the verb
+static bool formatOne(VM* vm, TextBuffer* b, const FormatSpec* spec, Value v, char* err, size_t errSize) {
+    char tmp[FORMAT_WIDTH_MAX + 400];
+    switch (spec->verb) {
+        case 'd': case 'x': case 'X': {
+            if (!IS_INT(v)) {
+                snprintf(err, errSize, "verb '%%%c' expects an int, got %s", spec->verb, valueTypeName(v));
+                return false;
             }
-            return NIL_VAL;
+            int64_t n = AS_INT(v);
+            unsigned long long mag = n < 0 ? -(unsigned long long)n : (unsigned long long)n;
+            const char* conv = spec->verb == 'd' ? "%llu" : spec->verb == 'x' ? "%llx" : "%llX";
+            char digits[32];
+            int len = snprintf(digits, sizeof(digits), conv, mag);
+            // A precision is the minimum number of digits, as in C and Go
+            int zeros = spec->precision > len ? spec->precision - len : 0;
+            memset(tmp, '0', zeros);
+            memcpy(tmp + zeros, digits, len + 1);
+            textAppendPadded(b, spec, formatSign(spec, n < 0), tmp, zeros + len, spec->precision < 0);
+            return true;
         }
-
-        case NODE_EXPR_VAR: {
-            if (node->var.slot != -1) {
-                return vm->stack[vm->fp + node->var.slot];
+        case 'f': {
+            if (!IS_INT(v) && !IS_FLOAT(v)) {
+                snprintf(err, errSize, "verb '%%f' expects a number, got %s", valueTypeName(v));
+                return false;
             }
-            VarEntry* entry = findEntry(vm, node->var.name, false);
-            if (entry) return entry->value;
-            errorAtToken(node->var.name, "Undefined variable.");
-            return NIL_VAL;
+            double d = IS_INT(v) ? (double)AS_INT(v) : AS_FLOAT(v);
+            int len = snprintf(tmp, sizeof(tmp), "%.*f", spec->precision < 0 ? 6 : spec->precision, d);
+            if (len >= (int)sizeof(tmp)) len = (int)sizeof(tmp) - 1;
+            bool negative = tmp[0] == '-';
+            textAppendPadded(b, spec, formatSign(spec, negative), tmp + negative, len - negative, isfinite(d));
+            return true;
         }
-
-        case NODE_EXPR_UNARY: {
-            Value expr = evaluate(vm, node->unary.expr);
-            if (node->unary.op.type == TOKEN_MINUS) {
-                if (IS_INT(expr)) expr = INT_VAL(-AS_INT(expr));
-                else if (IS_FLOAT(expr)) expr = FLOAT_VAL(-AS_FLOAT(expr));
-                else errorAtToken(node->unary.op, "Cannot negate non-numeric value.");
-            } else if (node->unary.op.type == TOKEN_PLUS) {
-                if (!IS_INT(expr) && !IS_FLOAT(expr)) errorAtToken(node->unary.op, "Unary '+' requires numeric value.");
-            } else if (node->unary.op.type == TOKEN_BANG) {
-                return BOOL_VAL(!isTruthy(expr));
+        default: { // 's'
+            TextBuffer text = {NULL, 0, 0};
+            textAppendValue(vm, &text, v);
+            if (vm->throwPending) {
+                free(text.chars);
+                return false;
             }
-            return expr;
+            int len = text.length;
+            if (spec->precision >= 0 && spec->precision < len) len = spec->precision;
+            textAppendPadded(b, spec, "", text.chars ? text.chars : "", len, false);
+            free(text.chars);
+            return true;
         }
+    }
+}
 
-        case NODE_EXPR_BINARY: {
-             // Logical AND
-             if (node->binary.op.type == TOKEN_AND) {
-                 Value left = evaluate(vm, node->binary.left);
-                 if (!isTruthy(left)) return BOOL_VAL(false);
-                 Value right = evaluate(vm, node->binary.right);
-                 return BOOL_VAL(isTruthy(right));
-             }
-             // Logical OR
-             if (node->binary.op.type == TOKEN_OR) {
-                 Value left = evaluate(vm, node->binary.left);
-                 if (isTruthy(left)) return BOOL_VAL(true);
-                 Value right = evaluate(vm, node->binary.right);
-                 return BOOL_VAL(isTruthy(right));
-             }
+// Expand args[0] with args[1..] for printf()/sprintf(). Returns malloc'd
+// text, or NULL after raising an error with nativeError().
+static char* formatArgs(VM* vm, const char* fn, Value* args, int argCount, int* outLength) {
+    if (argCount < 1 || !IS_STRING(args[0])) {
+        nativeError(vm, "%s() format must be a string, got %s.", fn,
+                    argCount < 1 ? "nothing" : valueTypeName(args[0]));
+        return NULL;
+    }
+    ObjString* format = AS_STRING(args[0]);
+    const char* fmt = format->chars;
+    int len = format->length;
+    char err[128];
+    FormatSpec spec;
 
-             Value left = evaluate(vm, node->binary.left);
-             Value right = evaluate(vm, node->binary.right);
+    // Check the whole format and the argument count before writing anything
+    int verbs = 0;
+    for (int i = 0; i < len; i++) {
+        if (fmt[i] != '%') continue;
+        i++;
+        if (!parseFormatSpec(fmt, len, &i, &spec, err, sizeof(err))) {
+            nativeError(vm, "%s() format %s.", fn, err);
+            return NULL;
+        }
+        i--;
+        if (spec.verb != '%') verbs++;
+    }
+    if (verbs != argCount - 1) {
+        nativeError(vm, "%s() format has %d verb%s but got %d argument%s.", fn,
+                    verbs, verbs == 1 ? "" : "s", argCount - 1, argCount - 1 == 1 ? "" : "s");
+        return NULL;
+    }
 
-             // Concatenation
-             if (node->binary.op.type == TOKEN_PLUS && (IS_STRING(left) || IS_STRING(right))) {
-                 char* lStr = NULL; char* rStr = NULL;
-                 char lBuf[64], rBuf[64];
-
-                 if (IS_STRING(left)) lStr = AS_CSTRING(left);
-                 else {
-                     if (IS_INT(left)) { snprintf(lBuf, 64, "%ld", (long)AS_INT(left)); lStr = lBuf; }
-                     else if (IS_FLOAT(left)) { snprintf(lBuf, 64, "%.6g", AS_FLOAT(left)); lStr = lBuf; }
-                     else if (IS_BOOL(left)) lStr = AS_BOOL(left) ? "true" : "false"; 
-                     else if (IS_NIL(left)) lStr = "nil";
-                     else lStr = "[object]"; 
-                 }
+    TextBuffer out = {NULL, 0, 0};
+    textAppend(&out, "", 0);
+    int next = 1;
+    int i = 0;
+    while (i < len) {
+        if (fmt[i] != '%') {
+            int start = i;
+            while (i < len && fmt[i] != '%') i++;
+            textAppend(&out, fmt + start, i - start);
+            continue;
+        }
+        i++;
+        parseFormatSpec(fmt, len, &i, &spec, err, sizeof(err));
+        if (spec.verb == '%') {
+            textAppend(&out, "%", 1);
+        } else if (!formatOne(vm, &out, &spec, args[next], err, sizeof(err))) {
+            free(out.chars);
+            if (!vm->throwPending) nativeError(vm, "%s() argument %d: %s.", fn, next, err);
+            return NULL;
+        } else {
+            next++;
+        }
+    }
+    *outLength = out.length;
+    return out.chars;
+}
 
-                 if (IS_STRING(right)) rStr = AS_CSTRING(right);
-                 else {
-                     if (IS_INT(right)) { snprintf(rBuf, 64, "%ld", (long)AS_INT(right)); rStr = rBuf; }
-                     else if (IS_FLOAT(right)) { snprintf(rBuf, 64, "%.6g", AS_FLOAT(right)); rStr = rBuf; }
-                     else if (IS_BOOL(right)) rStr = AS_BOOL(right) ? "true" : "false";
-                     else if (IS_NIL(right)) rStr = "nil";
-                     else rStr = "[object]";
-                 }
-                 
-                 int len = strlen(lStr) + strlen(rStr);
-                 char* combined = malloc(len + 1);
-                 strcpy(combined, lStr); strcat(combined, rStr);
-                 ObjString* s = internString(vm, combined, len);
-                 free(combined);
-                 Value v = OBJ_VAL(s); return v;
-             }
+// printf(format, args...): write formatted text as print does, no newline added
+static Value nativePrintf(VM* vm, Value* args, int argCount) {
+    int length;
+    char* text = formatArgs(vm, "printf", args, argCount, &length);
+    if (!text) return NIL_VAL;
+    writeOutput(vm, text, (size_t)length);
+    if (vm->output.flushEachLine && memchr(text, '\n', (size_t)length)) flushOutput(vm);
+    free(text);
+    return NIL_VAL;
+}
 
-             // Equality
-             if (node->binary.op.type == TOKEN_EQUAL_EQUAL || node->binary.op.type == TOKEN_BANG_EQUAL) {
-                 bool eq = false;
-                 if (getValueType(left) != getValueType(right)) {
-                     // Numeric mixed
-                     if ((IS_INT(left) || IS_FLOAT(left)) && (IS_INT(right) || IS_FLOAT(right))) {
-                         double a = (IS_INT(left)) ? (double)AS_INT(left) : AS_FLOAT(left);
-                         double b = (IS_INT(right)) ? (double)AS_INT(right) : AS_FLOAT(right);
-                         eq = (a == b);
-                     } else eq = false;
-                 } else {
-                     switch (getValueType(left)) {
-                         case VAL_BOOL: eq = (AS_BOOL(left) == AS_BOOL(right)); break;
-                         case VAL_INT: eq = (AS_INT(left) == AS_INT(right)); break;
-                         case VAL_FLOAT: eq = (AS_FLOAT(left) == AS_FLOAT(right)); break;
-                         case VAL_NIL: eq = true; break;
-                         case VAL_OBJ: eq = (AS_OBJ(left) == AS_OBJ(right)); break;
-                         default: eq = false; break;
-                     }
-                 }
-                 if (node->binary.op.type == TOKEN_BANG_EQUAL) eq = !eq;
-                 return BOOL_VAL(eq);
-             }
+// sprintf(format, args...): the text printf() would write
+static Value nativeSprintf(VM* vm, Value* args, int argCount) {
+    int length;
+    char* text = formatArgs(vm, "sprintf", args, argCount, &length);
+    if (!text) return NIL_VAL;
+    ObjString* result = internString(vm, text, length);
+    free(text);
+    return OBJ_VAL(result);
+}
 
-             // Numeric
-             if ((IS_INT(left) || IS_FLOAT(left)) && (IS_INT(right) || IS_FLOAT(right))) {
-                 if (IS_INT(left) && IS_INT(right)) {
-                     int a = AS_INT(left); int b = AS_INT(right);
-                     switch (node->binary.op.type) {
-                         case TOKEN_PLUS: return INT_VAL(a + b);
-                         case TOKEN_MINUS: return INT_VAL(a - b);
-                         case TOKEN_STAR: return INT_VAL(a * b);
-                         case TOKEN_SLASH: if(b==0) error("Div by zero",0); return INT_VAL(a / b);
-                         case TOKEN_GREATER: return BOOL_VAL(a > b);
-                         case TOKEN_GREATER_EQUAL: return BOOL_VAL(a >= b);
-                         case TOKEN_LESS: return BOOL_VAL(a < b);
-                         case TOKEN_LESS_EQUAL: return BOOL_VAL(a <= b);
-                         default: break;
-                     }
-                 }
-                 double a = (IS_INT(left)) ? (double)AS_INT(left) : AS_FLOAT(left);
-                 double b = (IS_INT(right)) ? (double)AS_INT(right) : AS_FLOAT(right);
-                 
-                 switch(node->binary.op.type) {
-                     case TOKEN_PLUS: return FLOAT_VAL(a + b);
-                     case TOKEN_MINUS: return FLOAT_VAL(a - b);
-                     case TOKEN_STAR: return FLOAT_VAL(a * b);
-                     case TOKEN_SLASH: return FLOAT_VAL(a / b);
-                     case TOKEN_GREATER: return BOOL_VAL(a > b);
-                     case TOKEN_GREATER_EQUAL: return BOOL_VAL(a >= b);
-                     case TOKEN_LESS: return BOOL_VAL(a < b);
-                     case TOKEN_LESS_EQUAL: return BOOL_VAL(a <= b);
-                     default: break;
-                 }
-             }
-             error("Invalid binary op or type.", node->binary.op.line);
-             return NIL_VAL;
+// --- format_table ---
+
+typedef struct {
+    int first;
+    int last;
+} CodepointRange;
+
+// Combining marks, zero-width spaces and joiners, and variation selectors:
+// drawn over the character before them
+static const CodepointRange zeroWidthRanges[] = {
+    {0x0300, 0x036F}, {0x0483, 0x0489}, {0x0591, 0x05BD}, {0x0610, 0x061A},
+    {0x064B, 0x065F}, {0x1AB0, 0x1AFF}, {0x1DC0, 0x1DFF}, {0x200B, 0x200F},
+    {0x20D0, 0x20FF}, {0xFE00, 0xFE0F}, {0xFE20, 0xFE2F}, {0xE0100, 0xE01EF},
+};
+
+// East Asian wide and fullwidth characters, and the emoji blocks, which a
+// terminal draws two columns wide
+static const CodepointRange wideRanges[] = {
+    {0x1100, 0x115F},   {0x2E80, 0x303E},   {0x3041, 0x33FF},   {0x3400, 0x4DBF},
+    {0x4E00, 0x9FFF},   {0xA000, 0xA4CF},   {0xAC00, 0xD7A3},   {0xF900, 0xFAFF},
+    {0xFE30, 0xFE4F},   {0xFF00, 0xFF60},   {0xFFE0, 0xFFE6},   {0x1F300, 0x1F64F},
+    {0x1F680, 0x1F6FF}, {0x1F900, 0x1F9FF}, {0x1FA70, 0x1FAFF}, {0x20000, 0x3FFFD},
+};
+
+static bool inRanges(int cp, const CodepointRange* ranges, int count) {
+    for (int i = 0; i < count; i++) {
+        if (cp >= ranges[i].first && cp <= ranges[i].last) return true;
+    }
+    return false;
+}
+
+// Columns a cell takes in a terminal: two for a wide character, none for a
+// combining mark and one for anything else, a byte that is not well-formed
+// UTF-8 included. A sequence joined by U+200D counts each of its parts.
+static int textColumns(const char* s, int n) {
+    const unsigned char* u = (const unsigned char*)s;
+    int columns = 0;
+    int i = 0;
+    while (i < n) {
+        int length = u[i] >= 0xF0 ? 4 : u[i] >= 0xE0 ? 3 : u[i] >= 0xC0 ? 2 : 1;
+        int cp = u[i] & (0x7F >> length);
+        for (int k = 1; k < length; k++) {
+            if (i + k >= n || (u[i + k] & 0xC0) != 0x80) {
+                length = 1;
+                break;
+            }
+            cp = (cp << 6) | (u[i + k] & 0x3F);
         }
+        if (length == 1) columns++;
+        else if (inRanges(cp, wideRanges, sizeof(wideRanges) / sizeof(wideRanges[0]))) columns += 2;
+        else if (!inRanges(cp, zeroWidthRanges, sizeof(zeroWidthRanges) / sizeof(zeroWidthRanges[0]))) columns++;
+        i += length;
+    }
+    return columns;
+}
 
-        case NODE_EXPR_CALL: {
-            Function* func = NULL;
-            // Struct instantiation check
-            if (node->call.callee->type == NODE_EXPR_VAR) {
-                 VarEntry* ve = findEntry(vm, node->call.callee->var.name, false);
-                 if (ve && IS_OBJ(ve->value) && AS_OBJ(ve->value)->type == OBJ_STRUCT_DEF) {
-                     StructDef* def = (StructDef*)AS_OBJ(ve->value);
-                     // Instantiation logic
-                     Value argVals[16]; int ac=0; Node* arg = node->call.arguments;
-                     while(arg && ac < 16) { argVals[ac++] = evaluate(vm, arg); arg = arg->next; }
-                     if (ac != def->fieldCount) error("Struct inst arg count mismatch", 0);
-                     StructInstance* inst = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
-                     inst->def = def;
-                     inst->fields = malloc(sizeof(Value) * def->fieldCount);
-                     for(int i=0; i<def->fieldCount; i++) inst->fields[i] = argVals[i];
-                     
-                     Value v = OBJ_VAL(inst); return v;
-                 } else if (ve && IS_OBJ(ve->value) && AS_OBJ(ve->value)->type == OBJ_FUNCTION) {
-                     func = (Function*)AS_OBJ(ve->value);
-                 }
-                 
-                 if (!func) func = findFunction(vm, node->call.callee->var.name);
-                 if (!func && vm->defEnv) func = findFunctionInEnv(vm->defEnv, node->call.callee->var.name);
-                 
-                 if (!func) {
-                     // Native builtins manually handled
-                     // Native builtins manually handled
-                     char fname[64]; int flen = node->call.callee->var.name.length;
-                     if(flen>63) flen=63; 
-                     memcpy(fname, node->call.callee->var.name.start, flen); 
-                     fname[flen]=0;
-                     
-                     Value args[16]; int ac=0; Node* arg = node->call.arguments;
-                     while(arg && ac < 16) { args[ac++] = evaluate(vm, arg); arg = arg->next; }
-                     
-                     if (strcmp(fname, "array")==0) { Value v = OBJ_VAL(newArray(vm)); return v; }
-                     if (strcmp(fname, "map")==0) { Value v = OBJ_VAL(newMap(vm)); return v; }
-                     if (strcmp(fname, "length")==0 && ac==1) {
-                         Value v; 
-                         int res = 0;
-                         if (IS_STRING(args[0])) res = ((ObjString*)AS_OBJ(args[0]))->length;
-                         else if (IS_ARRAY(args[0])) res = ((Array*)AS_OBJ(args[0]))->count;
-                         v = INT_VAL(res);
-                         return v;
-                     }
-                     if (strcmp(fname, "push")==0 && ac==2 && IS_ARRAY(args[0])) {
-                         arrayPush(vm, (Array*)AS_OBJ(args[0]), args[1]);
-                         Value v = INT_VAL(((Array*)AS_OBJ(args[0]))->count); return v;
-                     }
-                     if (strcmp(fname, "pop")==0 && ac==1 && IS_ARRAY(args[0])) {
-                         Value v;
-                         if (arrayPop((Array*)AS_OBJ(args[0]), &v)) return v;
-                         return NIL_VAL;
-                     }
-                     if (strcmp(fname, "has")==0 && ac==2 && IS_MAP(args[0])) {
-                         Map* m = (Map*)AS_OBJ(args[0]);
-                         bool found = false;
-                         if (IS_INT(args[1])) found = (mapFindEntryInt(m, AS_INT(args[1]), NULL) != NULL);
-                         else if (IS_STRING(args[1])) found = (mapFindEntry(m, AS_CSTRING(args[1]), ((ObjString*)AS_OBJ(args[1]))->length, NULL) != NULL);
-                         return BOOL_VAL(found);
-                     }
-                     if (strcmp(fname, "keys")==0 && ac==1 && IS_MAP(args[0])) {
-                         Map* m = (Map*)AS_OBJ(args[0]);
-                         Array* a = newArray(vm);
-                         for(int i=0; i<TABLE_SIZE; i++) {
-                             MapEntry* e = m->buckets[i];
-                             while(e) {
-                                 Value k; 
-                                 if(e->isIntKey) { k = INT_VAL(e->intKey); }
-                                 else { 
-                                     ObjString* s = internString(vm, e->key, (int)strlen(e->key));
-                                     k = OBJ_VAL(s); 
-                                 }
-                                 arrayPush(vm, a, k);
-                                 e = e->next;
-                             }
-                         }
-                         Value v = OBJ_VAL(a); return v;
-                     }
-                 }
-            } else if (node->call.callee->type == NODE_EXPR_GET) {
-               // Method call (modules only for now)
-               Value obj = evaluate(vm, node->call.callee->get.object);
-               if (IS_OBJ(obj) && AS_OBJ(obj)->type == OBJ_MODULE) {
-                   func = findFunctionInEnv(((Module*)AS_OBJ(obj))->env, node->call.callee->get.name);
-               }
+// The format_table() options, checked against the number of columns
+typedef struct {
+    bool* rightAlign;   // Per column, false (left) unless opts says "right"
+    int* minWidth;      // Per column, 0 unless opts gives "widths"
+    const char* separator;
+    int separatorLength;
+} TableOptions;
+
+// Read opts into 'table'; false after raising an error with nativeError()
+static bool readTableOptions(VM* vm, Value opts, int columns, TableOptions* table) {
+    table->separator = "  ";
+    table->separatorLength = 2;
+    if (IS_NIL(opts)) return true;
+    if (!IS_MAP(opts)) {
+        nativeError(vm, "format_table() options must be a map, got %s.", valueTypeName(opts));
+        return false;
+    }
+    Map* m = (Map*)AS_OBJ(opts);
+    for (MapEntry* e = mapFirstEntry(m); e; e = mapNextEntry(m, e)) {
+        if (e->isIntKey) {
+            nativeError(vm, "format_table() has no option %lld.", (long long)e->intKey);
+            return false;
+        }
+        Value v = e->value;
+        if (e->keyLength == 9 && memcmp(e->key, "separator", 9) == 0) {
+            if (!IS_STRING(v)) {
+                nativeError(vm, "format_table() separator must be a string, got %s.", valueTypeName(v));
+                return false;
+            }
+            table->separator = AS_CSTRING(v);
+            table->separatorLength = AS_STRING(v)->length;
+        } else if (e->keyLength == 5 && memcmp(e->key, "align", 5) == 0) {
+            if (!IS_ARRAY(v)) {
+                nativeError(vm, "format_table() align must be an array, got %s.", valueTypeName(v));
+                return false;
+            }
+            Array* align = (Array*)AS_OBJ(v);
+            for (int i = 0; i < align->count; i++) {
+                Value a = align->items[i];
+                bool left = IS_STRING(a) && strcmp(AS_CSTRING(a), "left") == 0;
+                bool right = IS_STRING(a) && strcmp(AS_CSTRING(a), "right") == 0;
+                if (!left && !right) {
+                    nativeError(vm, "format_table() align[%d] must be \"left\" or \"right\".", i);
+                    return false;
+                }
+                if (i < columns) table->rightAlign[i] = right;
+            }
+        } else if (e->keyLength == 6 && memcmp(e->key, "widths", 6) == 0) {
+            if (!IS_ARRAY(v)) {
+                nativeError(vm, "format_table() widths must be an array, got %s.", valueTypeName(v));
+                return false;
             }
+            Array* widths = (Array*)AS_OBJ(v);
+            for (int i = 0; i < widths->count; i++) {
+                Value w = widths->items[i];
+                if (!IS_INT(w) || AS_INT(w) < 0 || AS_INT(w) > FORMAT_WIDTH_MAX) {
+                    nativeError(vm, "format_table() widths[%d] must be an int from 0 to %d.", i, FORMAT_WIDTH_MAX);
+                    return false;
+                }
+                if (i < columns) table->minWidth[i] = (int)AS_INT(w);
+            }
+        } else {
+            nativeError(vm, "format_table() has no option '%.*s'.", e->keyLength, e->key);
+            return false;
+        }
+    }
+    return true;
+}
 
-            if (!func) { error("Undefined function or method.", 0); return NIL_VAL; }
-            
-            Value args[16]; int ac=0; Node* arg = node->call.arguments;
-            while(arg && ac < 16) { args[ac++] = evaluate(vm, arg); arg = arg->next; }
-            return callFunction(vm, func, args, ac);
+// format_table(rows, opts?): the arrays in 'rows' laid out as aligned
+// columns, one line per row joined by "\n". A cell is the text print()
+// shows for it, and a column is as wide as its widest cell, counted in
+// terminal columns (textColumns). opts may set "align" (per column, "left" or "right"),
+// "widths" (per column minimums) and "separator" (two spaces). A short row
+// ends after its last cell, and a left-aligned cell ending a line is not
+// padded, so no line has trailing spaces.
+static Value nativeFormatTable(VM* vm, Value* args, int argCount) {
+    if (argCount < 1 || argCount > 2) return nativeError(vm, "format_table() takes 1 or 2 arguments, got %d.", argCount);
+    if (!IS_ARRAY(args[0])) return nativeError(vm, "format_table() expects an array of rows, got %s.", valueTypeName(args[0]));
+    Array* rows = (Array*)AS_OBJ(args[0]);
+    int columns = 0;
+    int cellCount = 0;
+    for (int r = 0; r < rows->count; r++) {
+        if (!IS_ARRAY(rows->items[r])) {
+            return nativeError(vm, "format_table() row %d must be an array, got %s.", r, valueTypeName(rows->items[r]));
         }
+        int count = ((Array*)AS_OBJ(rows->items[r]))->count;
+        if (count > columns) columns = count;
+        cellCount += count;
+    }
 
-        case NODE_EXPR_AWAIT: {
-            Value v = evaluate(vm, node->unary.expr);
-            if (IS_OBJ(v) && AS_OBJ(v)->type == OBJ_FUTURE) return futureAwait((Future*)AS_OBJ(v));
-            return v;
+    TableOptions table;
+    table.rightAlign = calloc(columns + 1, sizeof(bool));
+    table.minWidth = calloc(columns + 1, sizeof(int));
+    if (!readTableOptions(vm, argCount == 2 ? args[1] : NIL_VAL, columns, &table)) {
+        free(table.rightAlign);
+        free(table.minWidth);
+        return NIL_VAL;
+    }
+
+    // Every cell's text, row by row, and each column's width
+    TextBuffer* cells = calloc(cellCount + 1, sizeof(TextBuffer));
+    int* widths = calloc(columns + 1, sizeof(int));
+    for (int c = 0; c < columns; c++) widths[c] = table.minWidth[c];
+    int next = 0;
+    for (int r = 0; r < rows->count && !vm->throwPending; r++) {
+        Array* row = (Array*)AS_OBJ(rows->items[r]);
+        for (int c = 0; c < row->count && !vm->throwPending; c++, next++) {
+            textAppend(&cells[next], "", 0);
+            textAppendValue(vm, &cells[next], row->items[c]);
+            int w = textColumns(cells[next].chars, cells[next].length);
+            if (w > widths[c]) widths[c] = w;
         }
+    }
+    if (vm->throwPending) { // A __str__ threw
+        for (int i = 0; i < next; i++) free(cells[i].chars);
+        free(cells);
+        free(widths);
+        free(table.rightAlign);
+        free(table.minWidth);
+        return NIL_VAL;
+    }
 
-        case NODE_EXPR_GET: {
-            Value obj = evaluate(vm, node->get.object);
-            if (IS_OBJ(obj)) {
-                Obj* o = AS_OBJ(obj);
-                if (o->type == OBJ_MODULE) {
-                     VarEntry* ve = findVarInEnv(((Module*)o)->env, node->get.name);
-                     if (ve) return ve->value;
-                } else if (o->type == OBJ_STRUCT_INSTANCE) {
-                     StructInstance* inst = (StructInstance*)o;
-                     for(int i=0; i<inst->def->fieldCount; i++) {
-                         if (inst->def->fields[i] == node->get.name.start) return inst->fields[i]; // Pointer comp if interned
-                         // If not strictly interned in struct def (it is):
-                         if (strncmp(inst->def->fields[i], node->get.name.start, node->get.name.length)==0) return inst->fields[i];
-                     }
-                } else if (o->type == OBJ_STRING) {
-                     if (node->get.name.length == 6 && strncmp(node->get.name.start, "length", 6) == 0) {
-                         return INT_VAL(((ObjString*)o)->length);
-                     }
-                } else if (o->type == OBJ_ARRAY) {
-                     if (node->get.name.length == 6 && strncmp(node->get.name.start, "length", 6) == 0) {
-                         return INT_VAL(((Array*)o)->count);
-                     }
-                }
-            }
-            error("Invalid property access.", 0);
-            return NIL_VAL;
+    TextBuffer out = {NULL, 0, 0};
+    textAppend(&out, "", 0);
+    next = 0;
+    for (int r = 0; r < rows->count; r++) {
+        if (r > 0) textAppend(&out, "\n", 1);
+        Array* row = (Array*)AS_OBJ(rows->items[r]);
+        for (int c = 0; c < row->count; c++, next++) {
+            TextBuffer* cell = &cells[next];
+            int pad = widths[c] - textColumns(cell->chars, cell->length);
+            bool last = c == row->count - 1;
+            if (c > 0) textAppend(&out, table.separator, table.separatorLength);
+            if (table.rightAlign[c]) textAppendRepeat(&out, ' ', pad);
+            textAppend(&out, cell->chars, cell->length);
+            if (!table.rightAlign[c] && !last) textAppendRepeat(&out, ' ', pad);
+            free(cell->chars);
         }
+    }
+    free(cells);
+    free(widths);
+    free(table.rightAlign);
+    free(table.minWidth);
+    return OBJ_VAL(takeString(vm, out.chars, out.length));
+}
 
-        case NODE_EXPR_INDEX: {
-             Value t = evaluate(vm, node->index.target);
-             Value i = evaluate(vm, node->index.index);
-             if (IS_ARRAY(t) && IS_INT(i)) {
-                 Array* a = (Array*)AS_OBJ(t);
-                 int idx = (int)AS_INT(i);
-                 if (idx >= 0 && idx < a->count) return a->items[idx];
-                 error("Index out of bounds",0);
-             }
-             if (IS_MAP(t)) {
-                 Map* m = (Map*)AS_OBJ(t);
-                 MapEntry* e = NULL;
-                 if (IS_INT(i)) e = mapFindEntryInt(m, AS_INT(i), NULL);
-                 else if (IS_STRING(i)) e = mapFindEntry(m, AS_CSTRING(i), ((ObjString*)AS_OBJ(i))->length, NULL);
-                 if (e) return e->value;
-                 error("Key not found",0);
-             }
-             error("Invalid index opr",0);
-             return NIL_VAL;
+// --- to_int / to_double / to_string / to_bool ---
+
+// The number spelled by 'text', as an int when it is whole digits that fit
+// and a double otherwise. Surrounding whitespace is allowed; anything else
+// (hex, underscores, trailing characters) is not a number.
+static bool parseNumberText(VM* vm, const char* text, Value* out) {
+    const char* start = text;
+    while (isspace((unsigned char)*start)) start++;
+    const char* end = start + strlen(start);
+    while (end > start && isspace((unsigned char)end[-1])) end--;
+    int len = (int)(end - start);
+    if (len == 0 || len > 400) return false;
+    char buf[401];
+    memcpy(buf, start, len);
+    buf[len] = '\0';
+
+    const char* digits = buf + (buf[0] == '+' || buf[0] == '-');
+    if (strcmp(digits, "nan") == 0 || strcmp(digits, "inf") == 0) {
+        *out = FLOAT_VAL(strtod(buf, NULL)); // The words print() writes
+        return true;
+    }
+    bool whole = *digits != '\0';
+    for (const char* p = digits; *p; p++) {
+        if (isdigit((unsigned char)*p)) continue;
+        if (!strchr(".eE+-", *p)) return false;
+        whole = false;
+    }
+    char* stop;
+    if (whole) {
+        errno = 0;
+        long long n = strtoll(buf, &stop, 10);
+        if (errno == 0) {
+            *out = intValue(vm, n);
+            return true;
         }
+    }
+    double d = strtod(buf, &stop);
+    if (*stop != '\0' || stop == buf) return false;
+    *out = FLOAT_VAL(d);
+    return true;
+}
 
-        case NODE_EXPR_ARRAY_LITERAL: {
-            Array* a = newArray(vm);
-            Node* el = node->arrayLiteral.elements;
-            while(el) {
-                arrayPush(vm, a, evaluate(vm, el));
-                el = el->next;
+// to_int(x): an int as is, a double truncated toward zero, a numeric string
+// parsed and then truncated. Errors for anything else, bools included.
+static Value nativeToInt(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "to_int() expects 1 argument but got %d.", argCount);
+    Value v = args[0];
+    if (IS_STRING(v) && !parseNumberText(vm, AS_CSTRING(v), &v)) {
+        return nativeError(vm, "to_int(): \"%.64s\" is not a number.", AS_CSTRING(args[0]));
+    }
+    if (IS_INT(v)) return v;
+    if (IS_FLOAT(v)) {
+        double d = trunc(AS_FLOAT(v));
+        // 2^63 is the first double past INT64_MAX
+        if (!isfinite(d) || d < -0x1p63 || d >= 0x1p63) {
+            // The argument as given: the string quoted, a double with its
+            // '.0' so a whole one doesn't read as an int
+            if (IS_STRING(args[0])) {
+                return nativeError(vm, "to_int(): \"%.64s\" is outside the int range.", AS_CSTRING(args[0]));
             }
-            Value v = OBJ_VAL(a); return v;
+            char buf[48];
+            const char* shown = formatDouble(AS_FLOAT(v), buf, sizeof(buf));
+            bool whole = isfinite(AS_FLOAT(v)) && !strpbrk(shown, ".e");
+            return nativeError(vm, "to_int(): %s%s is outside the int range.", shown, whole ? ".0" : "");
         }
+        return intValue(vm, (int64_t)d);
+    }
+    if (IS_BOOL(v)) return nativeError(vm, "to_int() can't convert a bool; use 'b ? 1 : 0'.");
+    return nativeError(vm, "to_int() can't convert a %s.", valueTypeName(v));
+}
+
+// to_double(x): a number or numeric string as a double
+static Value nativeToDouble(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "to_double() expects 1 argument but got %d.", argCount);
+    Value v = args[0];
+    if (IS_STRING(v) && !parseNumberText(vm, AS_CSTRING(v), &v)) {
+        return nativeError(vm, "to_double(): \"%.64s\" is not a number.", AS_CSTRING(args[0]));
+    }
+    if (IS_INT(v)) return FLOAT_VAL((double)AS_INT(v));
+    if (IS_FLOAT(v)) return v;
+    if (IS_BOOL(v)) return nativeError(vm, "to_double() can't convert a bool; use 'b ? 1.0 : 0.0'.");
+    return nativeError(vm, "to_double() can't convert a %s.", valueTypeName(v));
+}
+
+// to_string(x): the text print() shows
+static Value nativeToString(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "to_string() expects 1 argument but got %d.", argCount);
+    if (IS_STRING(args[0])) return args[0];
+    if (IS_STRING_BUILDER(args[0])) {
+        StringBuilder* sb = (StringBuilder*)AS_OBJ(args[0]);
+        return OBJ_VAL(internString(vm, sb->length ? sb->chars : "", sb->length));
+    }
+    TextBuffer text = {NULL, 0, 0};
+    textAppendValue(vm, &text, args[0]);
+    if (vm->throwPending) {
+        free(text.chars);
+        return NIL_VAL;
+    }
+    if (!text.chars) return OBJ_VAL(internString(vm, "", 0));
+    return OBJ_VAL(takeString(vm, text.chars, text.length));
+}
+
+// --- string_builder ---
+
+// string_builder(): an empty builder
+static Value nativeStringBuilder(VM* vm, Value* args, int argCount) {
+    (void)args;
+    if (argCount != 0) return nativeError(vm, "string_builder() expects 0 arguments but got %d.", argCount);
+    StringBuilder* sb = ALLOCATE_OBJ(vm, StringBuilder, OBJ_STRING_BUILDER);
+    sb->chars = NULL;
+    sb->length = 0;
+    sb->capacity = 0;
+    return OBJ_VAL(sb);
+}
+
+static StringBuilder* builderArg(VM* vm, const char* name, Value v) {
+    if (IS_STRING_BUILDER(v)) return (StringBuilder*)AS_OBJ(v);
+    nativeError(vm, "%s() expects a string_builder, got %s.", name, valueTypeName(v));
+    return NULL;
+}
+
+// Growing may collect; the builder is rooted as the native's argument
+static bool builderAppend(VM* vm, StringBuilder* sb, const char* chars, int length) {
+    if (length > INT32_MAX - sb->length) {
+        nativeError(vm, "string_builder can't grow past %d bytes.", INT32_MAX);
+        return false;
+    }
+    if (sb->length + length > sb->capacity) {
+        int64_t cap = sb->capacity < 64 ? 64 : sb->capacity;
+        while (cap < sb->length + length) cap *= 2;
+        if (cap > INT32_MAX) cap = INT32_MAX;
+        sb->chars = reallocate(vm, sb->chars, (size_t)sb->capacity, (size_t)cap);
+        sb->capacity = (int)cap;
+    }
+    memcpy(sb->chars + sb->length, chars, length);
+    sb->length += length;
+    return true;
+}
+
+// append(sb, s): add the string s; returns sb
+static Value nativeAppend(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "append() expects 2 arguments but got %d.", argCount);
+    StringBuilder* sb = builderArg(vm, "append", args[0]);
+    if (!sb) return NIL_VAL;
+    if (!IS_STRING(args[1])) {
+        return nativeError(vm, "append() expects a string, got %s; use append_int, append_double or to_string.", valueTypeName(args[1]));
+    }
+    ObjString* s = AS_STRING(args[1]);
+    if (!builderAppend(vm, sb, s->chars, s->length)) return NIL_VAL;
+    return args[0];
+}
+
+// append_int(sb, n): add n in decimal; returns sb
+static Value nativeAppendInt(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "append_int() expects 2 arguments but got %d.", argCount);
+    StringBuilder* sb = builderArg(vm, "append_int", args[0]);
+    if (!sb) return NIL_VAL;
+    if (!IS_INT(args[1])) return nativeError(vm, "append_int() expects an int, got %s.", valueTypeName(args[1]));
+    char tmp[32];
+    int n = snprintf(tmp, sizeof(tmp), "%lld", (long long)AS_INT(args[1]));
+    if (!builderAppend(vm, sb, tmp, n)) return NIL_VAL;
+    return args[0];
+}
+
+// append_double(sb, x): add x as print() shows a double; returns sb
+static Value nativeAppendDouble(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "append_double() expects 2 arguments but got %d.", argCount);
+    StringBuilder* sb = builderArg(vm, "append_double", args[0]);
+    if (!sb) return NIL_VAL;
+    Value x = args[1];
+    if (IS_INT(x)) x = FLOAT_VAL((double)AS_INT(x));
+    if (!IS_FLOAT(x)) return nativeError(vm, "append_double() expects a number, got %s.", valueTypeName(x));
+    char tmp[64];
+    const char* text = valueToChars(x, tmp, sizeof(tmp));
+    if (!builderAppend(vm, sb, text, (int)strlen(text))) return NIL_VAL;
+    return args[0];
+}
+
+// to_bool(x): false for nil and false, true for everything else, as in 'if'
+static Value nativeToBool(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "to_bool() expects 1 argument but got %d.", argCount);
+    return BOOL_VAL(isTruthy(args[0]));
+}
+
+// freeze(collection): mark an array, map or set read-only and return it.
+// Only the collection itself: arrays and maps inside it stay writable.
+static Value nativeFreeze(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "freeze() expects 1 argument but got %d.", argCount);
+    if (IS_ARRAY(args[0])) ((Array*)AS_OBJ(args[0]))->frozen = true;
+    else if (IS_MAP(args[0]) || IS_SET(args[0])) ((Map*)AS_OBJ(args[0]))->frozen = true;
+    else return nativeError(vm, "freeze() expects an array, map or set, got %s.", valueTypeName(args[0]));
+    return args[0];
+}
+
+// is_frozen(x): whether x is an array, map or set passed to freeze()
+static Value nativeIsFrozen(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "is_frozen() expects 1 argument but got %d.", argCount);
+    if (IS_ARRAY(args[0])) return BOOL_VAL(((Array*)AS_OBJ(args[0]))->frozen);
+    if (IS_MAP(args[0]) || IS_SET(args[0])) return BOOL_VAL(((Map*)AS_OBJ(args[0]))->frozen);
+    return BOOL_VAL(false);
+}
 
+// ---- equals() and clone() ----
+
+#define DEEP_DEPTH_MAX 10000 // Nesting equals() and clone() follow before giving up
+
+// A pair of collections equals() is comparing further out. Meeting it
+// again means the structures loop back: the pair counts as equal, since no
+// difference was found on the way round, so equal cyclic shapes are equal.
+typedef struct EqualsPair {
+    Obj* a;
+    Obj* b;
+    struct EqualsPair* outer;
+} EqualsPair;
+
+// Like ==, but arrays, maps and struct instances compare by contents. False
+// with an error pending when the nesting is too deep.
+static bool deepEquals(VM* vm, Value a, Value b, EqualsPair* outer, int depth) {
+    if (IS_INT(a) && IS_INT(b)) return AS_INT(a) == AS_INT(b);
+    if (IS_NUMERIC(a) && IS_NUMERIC(b)) return AS_NUMERIC(a) == AS_NUMERIC(b);
+    if (!IS_OBJ(a) || !IS_OBJ(b)) return a == b; // nil, bools, or a mix of types
+    Obj* x = AS_OBJ(a);
+    Obj* y = AS_OBJ(b);
+    if (x == y) return true;
+    if (x->type != y->type) return false;
+    switch (x->type) {
+        case OBJ_STRING:
+            return stringsEqual((ObjString*)x, (ObjString*)y);
+        case OBJ_RANGE: {
+            Range* r = (Range*)x;
+            Range* q = (Range*)y;
+            return r->start == q->start && r->stop == q->stop && r->step == q->step;
+        }
+        case OBJ_SET: {
+            // Same elements, in any order
+            Map* p = (Map*)x;
+            Map* q = (Map*)y;
+            if (p->count != q->count) return false;
+            for (MapEntry* e = p->first; e; e = e->after) {
+                if (!setHas(q, e->value)) return false;
+            }
+            return true;
+        }
+        case OBJ_ARRAY:
+        case OBJ_MAP:
+        case OBJ_STRUCT_INSTANCE:
+            break;
         default:
-            return NIL_VAL;
+            return false; // Functions, channels and the rest: identity only
+    }
+
+    for (EqualsPair* p = outer; p; p = p->outer) {
+        if (p->a == x && p->b == y) return true;
+    }
+    if (depth >= DEEP_DEPTH_MAX) {
+        nativeError(vm, "equals() can't compare values nested more than %d deep.", DEEP_DEPTH_MAX);
+        return false;
+    }
+    EqualsPair pair = {x, y, outer};
+
+    if (x->type == OBJ_ARRAY) {
+        Array* p = (Array*)x;
+        Array* q = (Array*)y;
+        if (p->count != q->count) return false;
+        for (int i = 0; i < p->count; i++) {
+            if (!deepEquals(vm, p->items[i], q->items[i], &pair, depth + 1)) return false;
+        }
+        return true;
+    }
+    if (x->type == OBJ_MAP) {
+        // Same keys with equal values, in any order
+        Map* p = (Map*)x;
+        Map* q = (Map*)y;
+        if (p->count != q->count) return false;
+        for (MapEntry* e = mapFirstEntry(p); e; e = mapNextEntry(p, e)) {
+            MapEntry* other = e->isIntKey ? mapFindEntryInt(q, e->intKey, NULL)
+                                          : mapFindEntry(q, e->key, e->keyLength, NULL);
+            if (!other || !deepEquals(vm, e->value, other->value, &pair, depth + 1)) return false;
+        }
+        return true;
+    }
+    StructInstance* p = (StructInstance*)x;
+    StructInstance* q = (StructInstance*)y;
+    if (p->def != q->def) return false;
+    for (int i = 0; i < p->def->fieldCount; i++) {
+        if (!deepEquals(vm, p->fields[i], q->fields[i], &pair, depth + 1)) return false;
     }
+    return true;
 }
 
-// Initialize VM
-void initVM(VM* vm) {
-    // Initialize GC State FIRST
-    vm->objects = NULL;
-    vm->nursery = NULL;
-    vm->nurseryCount = 0;
-    vm->grayStack = NULL;
-    vm->grayCount = 0;
-    vm->grayCapacity = 0;
-    vm->bytesAllocated = 0;
-    vm->nextGC = 1024 * 1024; // Start GC at 1MB
+// equals(a, b): structural equality. == stays identity for collections.
+static Value nativeEquals(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "equals() expects 2 arguments but got %d.", argCount);
+    bool equal = deepEquals(vm, args[0], args[1], NULL, 0);
+    return vm->throwPending ? NIL_VAL : BOOL_VAL(equal);
+}
 
+// Copies made so far by original, so a collection reached twice is copied
+// once: the copy keeps the cycles and sharing of the original. The copies
+// are also pushed on 'keep', a rooted array, until clone() returns.
+typedef struct {
+    Obj** from;
+    Obj** to;
+    int capacity;        // Power of two, at least twice count
+    int count;
+    Array* keep;
+} CloneTable;
 
-    vm->stackTop = 0;
-    vm->callStackTop = 0;
-    vm->fp = 0;
-    vm->regBase = 0;
-    vm->regTop = 0;
+static int cloneSlot(CloneTable* t, Obj* from) {
+    uintptr_t h = (uintptr_t)from >> 4;
+    h ^= h >> 16;
+    int mask = t->capacity - 1;
+    int i = (int)(h & (uintptr_t)mask);
+    while (t->from[i] && t->from[i] != from) i = (i + 1) & mask;
+    return i;
+}
 
-    // Initialize entire register file to NIL_VAL to prevent GC from scanning garbage
-    for (int i = 0; i < STACK_MAX; i++) {
-        vm->registers[i] = NIL_VAL;
+static void cloneRemember(VM* vm, CloneTable* t, Obj* from, Obj* to) {
+    arrayPush(vm, t->keep, OBJ_VAL(to));
+    WRITE_BARRIER(vm, t->keep);
+    if ((t->count + 1) * 2 > t->capacity) {
+        Obj** oldFrom = t->from;
+        Obj** oldTo = t->to;
+        int oldCapacity = t->capacity;
+        t->capacity *= 2;
+        t->from = calloc(t->capacity, sizeof(Obj*));
+        t->to = calloc(t->capacity, sizeof(Obj*));
+        for (int i = 0; i < oldCapacity; i++) {
+            if (!oldFrom[i]) continue;
+            int slot = cloneSlot(t, oldFrom[i]);
+            t->from[slot] = oldFrom[i];
+            t->to[slot] = oldTo[i];
+        }
+        free(oldFrom);
+        free(oldTo);
     }
+    int slot = cloneSlot(t, from);
+    t->from[slot] = from;
+    t->to[slot] = to;
+    t->count++;
+}
 
-    vm->argc = 0;
-    vm->argv = NULL;
-    
-    // Create global environment (Starts GC allocation!)
-    vm->globalEnv = ALLOCATE_OBJ(vm, Environment, OBJ_ENVIRONMENT);
-    vm->globalEnv->enclosing = NULL;
-    memset(vm->globalEnv->buckets, 0, sizeof(vm->globalEnv->buckets));
-    memset(vm->globalEnv->funcBuckets, 0, sizeof(vm->globalEnv->funcBuckets));
-    memset(vm->moduleBuckets, 0, sizeof(vm->moduleBuckets));
-    
-    // Set current environment to global initially
-    vm->env = vm->globalEnv;
-    vm->defEnv = vm->globalEnv;
-    
-    // Set project root from current working directory
-    if (!getcwd(vm->projectRoot, sizeof(vm->projectRoot))) {
-        strcpy(vm->projectRoot, ".");
+// Arrays, maps, sets and struct instances are copied, all the way down;
+// strings can't change and functions, channels and the rest are shared
+static Value deepClone(VM* vm, Value v, CloneTable* t, int depth) {
+    if (!IS_OBJ(v)) return v;
+    Obj* o = AS_OBJ(v);
+    if (o->type != OBJ_ARRAY && o->type != OBJ_MAP && o->type != OBJ_SET && o->type != OBJ_STRUCT_INSTANCE) return v;
+    int slot = cloneSlot(t, o);
+    if (t->from[slot]) return OBJ_VAL(t->to[slot]);
+    if (depth >= DEEP_DEPTH_MAX) {
+        return nativeError(vm, "clone() can't copy values nested more than %d deep.", DEEP_DEPTH_MAX);
     }
-    // Initialize extern handles
-    vm->externHandleCount = 0;
-    for (int i = 0; i < TABLE_SIZE; i++) vm->externHandles[i] = NULL;
-    
-    // Initialize string pool for performance optimization
-    vm->stringPool.strings = malloc(64 * sizeof(char*));
-    vm->stringPool.hashes = malloc(64 * sizeof(unsigned int));
-    vm->stringPool.count = 0;
-    vm->stringPool.capacity = 64;
-    if (!vm->stringPool.strings || !vm->stringPool.hashes) {
-        error("Memory allocation failed for string pool.", 0);
+
+    if (o->type == OBJ_ARRAY) {
+        Array* src = (Array*)o;
+        Array* copy = newArray(vm);
+        cloneRemember(vm, t, o, (Obj*)copy);
+        for (int i = 0; i < src->count; i++) {
+            Value item = deepClone(vm, src->items[i], t, depth + 1);
+            if (vm->throwPending) return NIL_VAL;
+            arrayPush(vm, copy, item);
+            WRITE_BARRIER(vm, copy);
+        }
+        return OBJ_VAL(copy);
     }
-    pthread_mutex_init(&vm->stringPool.lock, NULL);
-    
-    // Initialize value pool for basic types
-    vm->valuePool.capacity = 128;
-    vm->valuePool.values = malloc(vm->valuePool.capacity * sizeof(Value));
-    vm->valuePool.free_list = malloc(vm->valuePool.capacity * sizeof(int));
-    vm->valuePool.next_free = 0;
-    if (!vm->valuePool.values || !vm->valuePool.free_list) {
-        error("Memory allocation failed for value pool.", 0);
+    if (o->type == OBJ_SET) {
+        // The elements are ints and strings, which are not copied
+        Map* src = (Map*)o;
+        Map* copy = newSet(vm);
+        cloneRemember(vm, t, o, (Obj*)copy);
+        for (MapEntry* e = src->first; e; e = e->after) setAdd(vm, copy, e->value);
+        return OBJ_VAL(copy);
     }
-    // Initialize free list
-    for (int i = 0; i < vm->valuePool.capacity - 1; i++) {
-        vm->valuePool.free_list[i] = i + 1;
+    if (o->type == OBJ_MAP) {
+        Map* src = (Map*)o;
+        Map* copy = newMap(vm);
+        copy->ordered = src->ordered;
+        cloneRemember(vm, t, o, (Obj*)copy);
+        for (MapEntry* e = mapFirstEntry(src); e; e = mapNextEntry(src, e)) {
+            Value value = deepClone(vm, e->value, t, depth + 1);
+            if (vm->throwPending) return NIL_VAL;
+            if (e->isIntKey) mapSetInt(vm, copy, e->intKey, value);
+            else mapSetStr(vm, copy, e->key, e->keyLength, value);
+            WRITE_BARRIER(vm, copy);
+        }
+        return OBJ_VAL(copy);
     }
-    vm->valuePool.free_list[vm->valuePool.capacity - 1] = -1;
-    
-    // Initialize async task queue
-    vm->taskQueue = NULL;
-    vm->taskCount = 0;
-    vm->taskCapacity = 0;
-    
-    // Initialize GC statistics
-    vm->gcPhase = 0;  // GC_IDLE
-    vm->gcCollectCount = 0;
-    vm->gcTotalPauseUs = 0;
-    vm->gcLastPauseUs = 0;
-    vm->gcTotalFreed = 0;
-    vm->gcPeakMemory = 0;
-    vm->gcLastCollectTime = 0;
-    vm->gcBytesAllocSinceGC = 0;
-    
-    // Generational GC
-    vm->nurseryThreshold = 1000;  // Minor GC after 1000 young objects
+    StructInstance* src = (StructInstance*)o;
+    StructInstance* copy = ALLOCATE_OBJ(vm, StructInstance, OBJ_STRUCT_INSTANCE);
+    copy->def = src->def;
+    copy->fields = malloc(sizeof(Value) * (src->def->fieldCount > 0 ? src->def->fieldCount : 1));
+    for (int i = 0; i < src->def->fieldCount; i++) copy->fields[i] = NIL_VAL;
+    cloneRemember(vm, t, o, (Obj*)copy);
+    for (int i = 0; i < src->def->fieldCount; i++) {
+        Value field = deepClone(vm, src->fields[i], t, depth + 1);
+        if (vm->throwPending) return NIL_VAL;
+        copy->fields[i] = field;
+        WRITE_BARRIER(vm, copy);
+        GEN_BARRIER_VALUE(vm, copy, field);
+    }
+    return OBJ_VAL(copy);
+}
 
+// clone(x): a deep copy of x. The copies are never frozen.
+static Value nativeClone(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "clone() expects 1 argument but got %d.", argCount);
+    CloneTable table = {NULL, NULL, 16, 0, newArray(vm)};
+    vm->stack[vm->stackTop++] = OBJ_VAL(table.keep);
+    table.from = calloc(table.capacity, sizeof(Obj*));
+    table.to = calloc(table.capacity, sizeof(Obj*));
+    Value copy = deepClone(vm, args[0], &table, 0);
+    free(table.from);
+    free(table.to);
+    vm->stackTop--;
+    return vm->throwPending ? NIL_VAL : copy;
 }
 
-// Free VM memory
-// Old freeVM implementation removed (consolidated above)
+// assert(cond) or assert(cond, message): throws an Error naming the line
+// of the call when cond is falsy
+static Value nativeAssert(VM* vm, Value* args, int argCount) {
+    if (argCount < 1 || argCount > 2) {
+        return nativeError(vm, "assert expects 1 or 2 arguments but got %d.", argCount);
+    }
+    if (isTruthy(args[0])) {
+        vm->assertsPassed++;
+        return NIL_VAL;
+    }
+    vm->assertsFailed++;
 
-// Interpret AST
-void interpret(VM* vm, Node* ast) {
-    if (!ast) return;
-    
-    // Phase 0: Intern Strings (Critical for hashPointer)
-    internAST(vm, ast);
-    
-    // Phase 1: Resolve Locals (Calculate stack slots)
-    if (!resolveAST(vm, ast)) {
-        printf("Resolution failed.\n"); // Or handle error
-        return;
+    char reason[256] = "";
+    if (argCount == 2) {
+        char tmp[64];
+        snprintf(reason, sizeof(reason), ": %s", valueToChars(args[1], tmp, sizeof(tmp)));
     }
-    
-    execute(vm, ast);
-}// Define a global variable with interning
-void defineGlobal(VM* vm, const char* name, Value value) {
-    ObjString* keyObj = internString(vm, name, (int)strlen(name));
-    char* key = keyObj->chars;
-    unsigned int h = keyObj->hash % TABLE_SIZE;
-    
-    // Check if exists
-    VarEntry* entry = vm->globalEnv->buckets[h];
-    while (entry) {
-        if (entry->key == key) {
-            entry->value = value;
-            return;
-        }
-        entry = entry->next;
+
+    // The calling instruction, when called from bytecode
+    BytecodeChunk* chunk = vm->nativeChunk;
+    int offset = chunk && vm->nativeIp ? (int)(vm->nativeIp - chunk->code) : -1;
+    if (offset >= 0 && offset < chunk->codeSize) {
+        return nativeError(vm, "Assertion failed at line %d%s", chunkLine(chunk, offset), reason);
     }
-    
-    // Create new
-    entry = malloc(sizeof(VarEntry));
-    if (!entry) error("Memory allocation failed.", 0);
-    entry->key = key;
-    entry->keyString = keyObj; // Store for GC marking
-    entry->keyLength = (int)strlen(key);
-    entry->ownsKey = false;
-    entry->value = value;
-    entry->next = vm->globalEnv->buckets[h];
-    vm->globalEnv->buckets[h] = entry;
+    if (!chunk && vm->nativeLine > 0) {
+        return nativeError(vm, "Assertion failed at line %d%s", vm->nativeLine, reason);
+    }
+    return nativeError(vm, "Assertion failed%s", reason);
 }
 
-// Helper to define variable in current environment (for hybrid stack/env)
-static void defineInEnv(VM* vm, Environment* env, Token name, Value value) {
-    if (!env) return;
-    (void)vm;
-    // name.start is interned
-    unsigned int h = hashPointer(name.start) % TABLE_SIZE;
-    
-    // Check/Update existing in this env
-    VarEntry* entry = env->buckets[h];
-    while (entry) {
-        if (entry->key == name.start) {
-            entry->value = value;
-            return;
-        }
-        entry = entry->next;
-    }
-    
-    // Create new
-    entry = malloc(sizeof(VarEntry));
-    if (!entry) error("Memory allocation failed.", name.line);
-    entry->key = (char*)name.start;
-    entry->keyString = NULL; // Cannot get ObjString from Token here
-    entry->keyLength = name.length;
-    entry->ownsKey = false;
-    entry->value = value;
-    entry->next = env->buckets[h];
-    env->buckets[h] = entry;
+// panic(value): throw 'value' as a panic, for errors in the program itself.
+// A panic goes through every catch block (with blocks still close and
+// deferred calls still run) and stops only at recover().
+static Value nativePanic(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "panic() takes 1 argument, got %d.", argCount);
+    vm->thrownValue = args[0];
+    vm->throwPending = true;
+    vm->panicking = true;
+    return NIL_VAL;
 }
 
-// Define a native function in a specific environment with interning
-void defineNative(VM* vm, Environment* env, const char* name, NativeFn fn, int arity) {
-    ObjString* keyObj = internString(vm, name, (int)strlen(name));
-    char* key = keyObj->chars;
-    unsigned int h = keyObj->hash % TABLE_SIZE;
-    
-    FuncEntry* fe = malloc(sizeof(FuncEntry));
-    fe->key = key;
-    fe->keyString = keyObj; // Store for GC marking
-    fe->next = env->funcBuckets[h];
-    env->funcBuckets[h] = fe;
-    
-    Function* func = ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
-    func->isNative = true;
-    func->native = fn;
-    func->paramCount = arity;
-    func->name = (Token){TOKEN_IDENTIFIER, key, (int)strlen(key), 0};
-    func->body = NULL;
-    func->closure = NULL;
-    func->obj.isMarked = true; // PERMANENT ROOT
-    func->obj.isPermanent = true; // Never sweep
-    
-    fe->function = func;
+// recover(body, handler): the result of body(), or, when a panic leaves it,
+// of handler(value) with the value given to panic(). An ordinary throw
+// goes on through, for a catch further out.
+static Value nativeRecover(VM* vm, Value* args, int argCount) {
+    if (argCount != 2) return nativeError(vm, "recover() takes 2 arguments, got %d.", argCount);
+    Function* body = callbackArg(args[0]);
+    Function* handler = callbackArg(args[1]);
+    if (!body) return nativeError(vm, "recover() body must be a function, got %s.", valueTypeName(args[0]));
+    if (!handler) return nativeError(vm, "recover() handler must be a function, got %s.", valueTypeName(args[1]));
 
-    // ALSO register as a variable for Bytecode VM (OP_LOAD_GLOBAL checks variable buckets)
-    // We treat the function as a first-class object value
-    Value funcVal = OBJ_VAL(func);
-    
-    // Check/Update existing in this env
-    VarEntry* ve = env->buckets[h];
-    while (ve) {
-        if (ve->key == key) {
-            ve->value = funcVal;
-            return;
+    int root = vm->stackTop;
+    vm->stack[vm->stackTop++] = OBJ_VAL(handler);
+    Value result = NIL_VAL;
+    Value thrown = NIL_VAL;
+    bool returned = body->bytecodeChunk ? callGuarded(vm, body, NULL, 0, &result, &thrown)
+                                        : callCaught(vm, body, NULL, 0, &result, &thrown);
+    if (returned || !vm->panicking) {
+        vm->stackTop = root;
+        if (!returned) {
+            // Rethrown from here, keeping where it was thrown
+            vm->thrownValue = thrown;
+            vm->throwPending = true;
         }
-        ve = ve->next;
+        return result;
     }
-    
-    // Create new variable entry
-    ve = malloc(sizeof(VarEntry));
-    ve->key = key;
-    ve->keyString = keyObj; // Store for GC marking
-    ve->keyLength = (int)strlen(key);
-    ve->ownsKey = false;
-    ve->value = funcVal;
-    ve->next = env->buckets[h];
-    env->buckets[h] = ve;
+
+    vm->panicking = false;
+    vm->errorTraceCount = 0;
+    vm->stack[vm->stackTop++] = thrown;
+    result = invokeFunction(vm, handler, &vm->stack[root + 1], 1);
+    vm->stackTop = root;
+    return vm->throwPending ? NIL_VAL : result;
 }
 
-// --- Built-in Natives Implementation ---
+#define EVAL_NAME "<eval>"
 
-static Value nativeHas(VM* vm, Value* args, int argCount) {
-    (void)vm;
-    if (argCount < 2) return NIL_VAL;
-    if (!IS_MAP(args[0])) return BOOL_VAL(false);
-    
-    Map* map = (Map*)AS_OBJ(args[0]);
-    
-    if (IS_STRING(args[1])) {
-        ObjString* key = AS_STRING(args[1]);
-        int bucket;
-        MapEntry* e = mapFindEntry(map, key->chars, key->length, &bucket);
-        return BOOL_VAL(e != NULL);
-    } 
-    return BOOL_VAL(false);
+// A syntax or compile error of eval()'s source, thrown like a runtime one
+static Value evalError(VM* vm, int line, const char* message) {
+    if (line > 0) return nativeError(vm, "Error in eval() at line %d: %s", line, message);
+    return nativeError(vm, "Error in eval(): %s", message);
 }
 
-static Value nativeKeys(VM* vm, Value* args, int argCount) {
-    if (argCount < 1) return NIL_VAL;
-    if (!IS_MAP(args[0])) return NIL_VAL;
-    
-    Map* map = (Map*)AS_OBJ(args[0]);
-    Array* keys = newArray(vm);
-    
-    for (int i = 0; i < TABLE_SIZE; i++) {
-        MapEntry* e = map->buckets[i];
-        while (e) {
-            if (e->key) {
-                 ObjString* s = internString(vm, e->key, (int)strlen(e->key));
-                 arrayPush(vm, keys, OBJ_VAL(s));
-            } else if (e->isIntKey) {
-                 arrayPush(vm, keys, INT_VAL(e->intKey));
-            }
-            e = e->next;
+// The first error the compiler wrote, as an eval() error
+static Value evalCompileError(VM* vm, char* text) {
+    if (!text || !text[0]) return evalError(vm, 0, "compilation failed.");
+    char* message;
+    int line = firstReportedError(text, &message);
+    return evalError(vm, line, message);
+}
+
+// eval(source): run source in the current globals, where what it defines
+// stays, and return the value of its last statement when that is an
+// expression, else nil. Syntax and compile errors throw as runtime errors
+// do. A bytecode caller runs it as bytecode, the tree walker walks it.
+static Value nativeEval(VM* vm, Value* args, int argCount) {
+    if (argCount != 1) return nativeError(vm, "eval() expects 1 argument but got %d.", argCount);
+    if (vm->evalDisabled) return nativeError(vm, "eval() is disabled in this interpreter.");
+    if (!IS_STRING(args[0])) return nativeError(vm, "eval() expects a string, got %s.", valueTypeName(args[0]));
+    bool walker = !vm->nativeChunk;
+
+    ObjString* text = AS_STRING(args[0]);
+    EvalSource* src = malloc(sizeof(EvalSource));
+    src->source = malloc(text->length + 1);
+    memcpy(src->source, text->chars, text->length + 1);
+    src->ast = NULL;
+    initParser(&src->parser);
+    // As at the REPL, the last statement needs no semicolon
+    src->parser.implicitSemicolon = true;
+    src->next = vm->evalSources;
+    vm->evalSources = src;
+
+    // The parser reports through error(), which comes back here
+    const char* savedSource = g_source;
+    const char* savedFilename = g_filename;
+    jmp_buf* savedCatch = g_catchJump;
+    jmp_buf parseJump;
+    g_source = src->source;
+    g_filename = EVAL_NAME;
+    g_catchJump = &parseJump;
+    bool parsed = setjmp(parseJump) == 0;
+    if (parsed) {
+        Lexer lexer;
+        initLexer(&lexer, src->source);
+        while (true) {
+            Token token = scanToken(&lexer);
+            addToken(&src->parser, token);
+            if (token.type == TOKEN_EOF) break;
         }
+        src->ast = parse(&src->parser);
     }
-    return OBJ_VAL(keys);
-}
+    g_catchJump = savedCatch;
+    g_source = savedSource;
+    g_filename = savedFilename;
+    if (!parsed) return evalError(vm, g_catchLine, g_catchMessage);
 
-static Value nativeLength(VM* vm, Value* args, int argCount) {
-    (void)vm; // Unused parameter
-    if (argCount != 1) return NIL_VAL;
-    if (IS_STRING(args[0])) return INT_VAL(((ObjString*)AS_OBJ(args[0]))->length);
-    if (IS_ARRAY(args[0])) return INT_VAL(((Array*)AS_OBJ(args[0]))->count);
-    return INT_VAL(0);
-}
+    Node* ast = src->ast;
+    int last = ast->block.count - 1;
+    bool valued = last >= 0 && isExpressionNode(ast->block.statements[last]);
+    if (valued && !walker) {
+        // Compiled as 'return <expression>;', which a script may end with
+        Node* ret = calloc(1, sizeof(Node));
+        ret->type = NODE_STMT_RETURN;
+        ret->line = ast->block.statements[last]->line;
+        ret->returnStmt.value = ast->block.statements[last];
+        ret->returnStmt.count = 1;
+        ast->block.statements[last] = ret;
+    }
 
-static Value nativePush(VM* vm, Value* args, int argCount) {
-    if (argCount != 2) return NIL_VAL;
-    if (!IS_ARRAY(args[0])) return NIL_VAL;
-    Array* arr = (Array*)AS_OBJ(args[0]);
-    arrayPush(vm, arr, args[1]);
-    return INT_VAL(arr->count);
-}
+    // Compiled in both modes, as the script was, for its errors
+    BytecodeChunk* chunk = malloc(sizeof(BytecodeChunk));
+    initChunk(chunk);
+    Function* script = newBytecodeScript(vm, chunk, EVAL_NAME);
+    script->name.start = EVAL_NAME;
+    script->name.length = (int)strlen(EVAL_NAME);
+    vm->stack[vm->stackTop++] = OBJ_VAL(script);
+    char* errors = NULL;
+    size_t errorsSize = 0;
+    FILE* errorOut = open_memstream(&errors, &errorsSize);
+    FILE* savedErrorOut = vm->errorOut;
+    if (errorOut) vm->errorOut = errorOut;
+    g_source = src->source;
+    g_filename = EVAL_NAME;
+    bool compiled = compileToBytecode(vm, ast, chunk, EVAL_NAME);
+    g_source = savedSource;
+    g_filename = savedFilename;
+    vm->errorOut = savedErrorOut;
+    if (errorOut) fclose(errorOut);
+    if (!compiled) {
+        vm->stackTop--;
+        Value failure = evalCompileError(vm, errors);
+        free(errors);
+        return failure;
+    }
+    free(errors);
 
-static Value nativePop(VM* vm, Value* args, int argCount) {
-    (void)vm; // Unused parameter
-    if (argCount != 1) return NIL_VAL;
-    if (!IS_ARRAY(args[0])) return NIL_VAL;
-    Value v;
-    if (arrayPop((Array*)AS_OBJ(args[0]), &v)) return v;
-    return NIL_VAL;
+    if (!walker) {
+        Value result = callBytecodeFunction(vm, script, NULL, 0);
+        vm->stackTop--;
+        return result;
+    }
+    vm->stackTop--;
+
+    internAST(vm, ast);
+    if (!resolveAST(vm, ast)) return evalError(vm, 0, "resolution failed.");
+    // At the top level of its own frame: its declarations are globals
+    int savedFp = vm->fp, savedTop = vm->stackTop;
+    Environment* savedEnv = vm->env;
+    vm->fp = vm->stackTop;
+    vm->env = vm->globalEnv;
+    Value result = NIL_VAL;
+    for (int i = 0; i <= last; i++) {
+        if (i == last && valued) result = evaluate(vm, ast->block.statements[i]);
+        else execute(vm, ast->block.statements[i]);
+    }
+    vm->fp = savedFp;
+    vm->stackTop = savedTop;
+    vm->env = savedEnv;
+    return result;
 }
 
 void registerBuiltins(VM* vm) {
     defineNative(vm, vm->globalEnv, "has", nativeHas, 2);
     defineNative(vm, vm->globalEnv, "keys", nativeKeys, 1);
+    defineNative(vm, vm->globalEnv, "values", nativeValues, 1);
+    defineNative(vm, vm->globalEnv, "ordered_map", nativeOrderedMap, 0);
+    defineNative(vm, vm->globalEnv, "delete", nativeDelete, 2);
+    defineNative(vm, vm->globalEnv, "set", nativeSet, 0);
+    defineNative(vm, vm->globalEnv, "to_set", nativeToSet, 1);
+    defineNative(vm, vm->globalEnv, "add", nativeAdd, 2);
+    defineNative(vm, vm->globalEnv, "remove", nativeRemove, 2);
     defineNative(vm, vm->globalEnv, "length", nativeLength, 1);
+    defineNative(vm, vm->globalEnv, "len", nativeLength, 1);
     defineNative(vm, vm->globalEnv, "push", nativePush, 2);
     defineNative(vm, vm->globalEnv, "pop", nativePop, 1);
+    defineNative(vm, vm->globalEnv, "sort", nativeSort, 2);
+    defineNative(vm, vm->globalEnv, "freeze", nativeFreeze, 1);
+    defineNative(vm, vm->globalEnv, "is_frozen", nativeIsFrozen, 1);
+    defineNative(vm, vm->globalEnv, "equals", nativeEquals, 2);
+    defineNative(vm, vm->globalEnv, "clone", nativeClone, 1);
+    defineNative(vm, vm->globalEnv, "map", nativeMap, 2);
+    defineNative(vm, vm->globalEnv, "filter", nativeFilter, 2);
+    defineNative(vm, vm->globalEnv, "reduce", nativeReduce, 3);
+    defineNative(vm, vm->globalEnv, "wadd", nativeWadd, 2);
+    defineNative(vm, vm->globalEnv, "wsub", nativeWsub, 2);
+    defineNative(vm, vm->globalEnv, "wmul", nativeWmul, 2);
+    defineNative(vm, vm->globalEnv, "popcount", nativePopcount, 1);
+    defineNative(vm, vm->globalEnv, "clz", nativeClz, 1);
+    defineNative(vm, vm->globalEnv, "rotl", nativeRotl, 2);
+    defineNative(vm, vm->globalEnv, "flush", nativeFlush, 0);
+    defineNative(vm, vm->globalEnv, "typeof", nativeTypeof, 1);
+    defineNative(vm, vm->globalEnv, "to_int", nativeToInt, 1);
+    defineNative(vm, vm->globalEnv, "to_double", nativeToDouble, 1);
+    defineNative(vm, vm->globalEnv, "to_string", nativeToString, 1);
+    defineNative(vm, vm->globalEnv, "string_builder", nativeStringBuilder, 0);
+    defineNative(vm, vm->globalEnv, "append", nativeAppend, 2);
+    defineNative(vm, vm->globalEnv, "append_int", nativeAppendInt, 2);
+    defineNative(vm, vm->globalEnv, "append_double", nativeAppendDouble, 2);
+    defineNative(vm, vm->globalEnv, "to_bool", nativeToBool, 1);
+    defineNative(vm, vm->globalEnv, "range", nativeRange, 3);
+    defineNative(vm, vm->globalEnv, "channel", nativeChannel, 1);
+    defineNative(vm, vm->globalEnv, "send", nativeSend, 2);
+    defineNative(vm, vm->globalEnv, "recv", nativeRecv, 1);
+    defineNative(vm, vm->globalEnv, "yield", nativeYield, 0);
+    defineNative(vm, vm->globalEnv, "printf", nativePrintf, 1);
+    defineNative(vm, vm->globalEnv, "sprintf", nativeSprintf, 1);
+    defineNative(vm, vm->globalEnv, "format_table", nativeFormatTable, 2);
+    defineNative(vm, vm->globalEnv, "assert", nativeAssert, 2);
+    defineNative(vm, vm->globalEnv, "panic", nativePanic, 1);
+    defineNative(vm, vm->globalEnv, "recover", nativeRecover, 2);
+    defineNative(vm, vm->globalEnv, "eval", nativeEval, 1);
+}
+
+void registerLibraries(VM* vm) {
+    registerUCoreUON(vm); // Register built-in core libraries
+    registerUCoreHttp(vm);
+    registerUCoreTimer(vm); // Register Timer
+    registerUCoreJson(vm);  // Register Json
+    registerUCoreScraper(vm); // Register Scraper
+    registerUCoreString(vm);  // Register String Utils
+    registerUCoreRegex(vm);   // Register Regex
+    registerUCoreTui(vm);      // Register TUI
+    registerUCoreMath(vm);     // Register Math
+    registerUCoreTime(vm);     // Register Time
+    registerUCoreFile(vm);     // Register File I/O
+    registerUCoreRandom(vm);   // Register Random
+
+    registerUCoreSystem(vm); // Register System
+    registerBuiltins(vm);    // Register built-in natives (has, keys)
+
+    // After registration: stress mode is meant for script code
+    configureGC(vm);
+}
+
+// Function object for a script's top-level code in 'chunk'
+Function* newBytecodeScript(VM* vm, BytecodeChunk* chunk, const char* path) {
+    Function* script = (Function*)ALLOCATE_OBJ(vm, Function, OBJ_FUNCTION);
+    script->paramCount = 0;
+    script->requiredCount = 0;
+    script->isVariadic = false;
+    script->isMethod = false;
+    script->defaults = NULL;
+    script->params = NULL;
+    script->isAsync = false;
+    script->native = NULL;
+    script->nativeData = NULL;
+    script->moduleEnv = vm->globalEnv;
+    script->upvalueCount = 0;
+    script->upvalues = NULL;
+    script->proto = NULL;
+    script->name.start = "<script>";
+    script->name.length = 8;
+    script->name.line = 0;
+    script->body = NULL;
+    script->closure = NULL;
+    script->isNative = false;
+    script->bytecodeChunk = chunk;
+    script->modulePath = path ? strdup(path) : NULL;
+    return script;
 }
 
 // String concatenation helper (exposed for VM)
@@ -1865,8 +5921,7 @@ Value vm_concatenate(VM* vm, Value a, Value b) {
         snprintf(bufferA, sizeof(bufferA), "%ld", (long)AS_INT(a));
         strA = bufferA;
     } else if (IS_FLOAT(a)) {
-        snprintf(bufferA, sizeof(bufferA), "%.14g", AS_FLOAT(a));
-        strA = bufferA;
+        strA = formatDouble(AS_FLOAT(a), bufferA, sizeof(bufferA));
     } else if (IS_BOOL(a)) {
         strA = AS_BOOL(a) ? "true" : "false";
     } else if (IS_NIL(a)) {
@@ -1882,8 +5937,7 @@ Value vm_concatenate(VM* vm, Value a, Value b) {
         snprintf(bufferB, sizeof(bufferB), "%ld", (long)AS_INT(b));
         strB = bufferB;
     } else if (IS_FLOAT(b)) {
-        snprintf(bufferB, sizeof(bufferB), "%.14g", AS_FLOAT(b));
-        strB = bufferB;
+        strB = formatDouble(AS_FLOAT(b), bufferB, sizeof(bufferB));
     } else if (IS_BOOL(b)) {
         strB = AS_BOOL(b) ? "true" : "false";
     } else if (IS_NIL(b)) {
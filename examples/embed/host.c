@@ -0,0 +1,265 @@
+// A host program using the embedding API (core/include/unnarize.h).
+// Built and checked by examples/runEmbed.sh.
+
+#include <pthread.h>
+#include <stdio.h>
+#include <string.h>
+#include "unnarize.h"
+
+// tally(amount): adds to a counter the host owns, returns the new total
+static UnnValue tally(UnnInterp* interp, const UnnValue* args, int argCount, void* userData) {
+    int64_t* total = userData;
+    if (argCount != 1) return unnThrow(interp, "tally expects 1 argument but got %d.", argCount);
+    if (args[0].type != UNN_INT) return unnThrow(interp, "tally expects an int but got %s.", unnTypeName(args[0]));
+    *total += args[0].as.integer;
+    return unnInt(*total);
+}
+
+// greet(name): builds a string in a buffer the host owns, which the VM
+// copies once greet returns
+static UnnValue greet(UnnInterp* interp, const UnnValue* args, int argCount, void* userData) {
+    (void)interp;
+    char* buffer = userData;
+    snprintf(buffer, 128, "hello, %s", argCount > 0 && args[0].type == UNN_STRING ? args[0].as.string : "stranger");
+    return unnString(buffer);
+}
+
+// units.toKm(miles) and units.toMiles(km), counting calls in userData
+static UnnValue convert(UnnInterp* interp, const UnnValue* args, int argCount, double factor, int* calls) {
+    (*calls)++;
+    if (argCount != 1 || !unnIsNumber(args[0])) return unnThrow(interp, "units expects a number.");
+    return unnDouble(unnAsNumber(args[0]) * factor);
+}
+
+static UnnValue toKm(UnnInterp* interp, const UnnValue* args, int argCount, void* userData) {
+    return convert(interp, args, argCount, 1.609344, userData);
+}
+
+static UnnValue toMiles(UnnInterp* interp, const UnnValue* args, int argCount, void* userData) {
+    return convert(interp, args, argCount, 1 / 1.609344, userData);
+}
+
+static const UnnModuleFn unitFns[] = {
+    { "toKm", toKm },
+    { "toMiles", toMiles },
+    { NULL, NULL }
+};
+
+static void show(UnnValue result) {
+    switch (result.type) {
+        case UNN_NIL:    printf("=> nil\n"); break;
+        case UNN_BOOL:   printf("=> %s\n", result.as.boolean ? "true" : "false"); break;
+        case UNN_INT:    printf("=> %lld\n", (long long)result.as.integer); break;
+        case UNN_DOUBLE: printf("=> %g\n", result.as.number); break;
+        case UNN_STRING: printf("=> \"%s\"\n", result.as.string); break;
+        case UNN_OBJECT: printf("=> <%s>\n", result.as.typeName); break;
+    }
+}
+
+static void run(UnnInterp* interp, const char* source) {
+    UnnValue result;
+    if (!unnRun(interp, source, &result)) {
+        printf("error: %s\n", unnLastError(interp));
+        return;
+    }
+    show(result);
+    unnFreeValue(&result);
+}
+
+// Runs a script 'perStep' instructions at a time, as run() shows it
+static void stepped(UnnInterp* interp, const char* source, int64_t perStep) {
+    if (!unnStart(interp, source)) {
+        printf("error: %s\n", unnLastError(interp));
+        return;
+    }
+    UnnValue result;
+    UnnStepStatus status;
+    int steps = 1;
+    while ((status = unnStep(interp, perStep, &result)) == UNN_STEP_PAUSED) steps++;
+    printf("%s step(s): ", steps > 1 ? "several" : "one");
+    if (status == UNN_STEP_FAILED) {
+        printf("error: %s\n", unnLastError(interp));
+        return;
+    }
+    show(result);
+    unnFreeValue(&result);
+}
+
+// Collects what scripts print, counting the pieces the interpreter hands over
+typedef struct {
+    char text[256];
+    size_t length;
+    int pieces;
+} Captured;
+
+static void capture(const char* data, size_t length, void* userData) {
+    Captured* out = userData;
+    if (out->length + length < sizeof(out->text)) {
+        memcpy(out->text + out->length, data, length);
+        out->length += length;
+        out->text[out->length] = '\0';
+    }
+    out->pieces++;
+}
+
+static void showCaptured(Captured* out) {
+    printf("captured %d piece(s): ", out->pieces);
+    for (size_t i = 0; i < out->length; i++) {
+        if (out->text[i] == '\n') printf("\\n");
+        else putchar(out->text[i]);
+    }
+    printf("\n");
+    out->length = 0;
+    out->text[0] = '\0';
+    out->pieces = 0;
+}
+
+// Each thread owns an interpreter and sums 1..n in it
+static void* worker(void* arg) {
+    int64_t n = *(int64_t*)arg;
+    UnnInterp* interp = unnNew();
+    unnSetGlobal(interp, "n", unnInt(n));
+    UnnValue sum;
+    bool ok = unnRun(interp,
+                     "var sum = 0;\n"
+                     "for (var i : range(1, n + 1)) { sum = sum + i; }\n"
+                     "return sum;\n", &sum);
+    *(int64_t*)arg = ok ? sum.as.integer : -1;
+    unnFree(interp);
+    return NULL;
+}
+
+int main(void) {
+    // Before the first interpreter, so the map order below is reproducible
+    bool seeded = unnSetHashSeed(7);
+    UnnInterp* interp = unnNew();
+    int64_t total = 0;
+    char greeting[128];
+    unnRegisterFn(interp, "tally", tally, &total);
+    unnRegisterFn(interp, "greet", greet, greeting);
+
+    printf("--- results ---\n");
+    run(interp, "return 6 * 7;");
+    run(interp, "return 1.5 + 1;");
+    run(interp, "return \"un\" + \"narize\";");
+    run(interp, "return [1, 2, 3];");
+    run(interp, "print(\"printed by the script\");");
+
+    printf("--- host functions ---\n");
+    run(interp, "tally(5); tally(10); return tally(27);");
+    printf("host total: %lld\n", (long long)total);
+    run(interp, "return greet(\"embedder\");");
+    run(interp, "try { tally(\"ten\"); } catch (e) { return \"caught: \" + e.message; }");
+
+    printf("--- modules ---\n");
+    int unitCalls = 0;
+    unnRegisterModule(interp, "units", unitFns, &unitCalls);
+    run(interp, "return units.toKm(10);");
+    run(interp, "return ucoreMath.sqrt(16) + units.toMiles(1.609344);");
+    run(interp, "return typeof(units);");
+    run(interp, "var convert = units.toKm; return convert(1);");
+    run(interp, "try { units.toFeet(1); } catch (e) { return \"caught: \" + e.message; }");
+    run(interp, "try { return ucoreMath.cube(2); } catch (e) { return \"caught: \" + e.message; }");
+    printf("unit calls: %d\n", unitCalls);
+    // One at a time, each with data of its own
+    unnRegisterModuleFn(interp, "units", "greet", greet, greeting);
+    unnRegisterModuleFn(interp, "people", "greet", greet, greeting);
+    run(interp, "return units.greet(\"km\") + \" / \" + people.greet(\"ada\") + \" / \" + units.toKm(1);");
+
+    printf("--- globals ---\n");
+    unnSetGlobal(interp, "limit", unnInt(3));
+    unnSetGlobal(interp, "label", unnString("items"));
+    run(interp, "var shown = label + \" up to \" + limit; return shown;");
+    UnnValue shown;
+    if (unnGetGlobal(interp, "shown", &shown)) printf("shown = %s\n", unnAsString(shown));
+    unnFreeValue(&shown);
+    run(interp, "var kept = 100;");
+    run(interp, "return kept + 1;");
+    printf("missing global found: %s\n", unnGetGlobal(interp, "nope", NULL) ? "yes" : "no");
+    // Script ints are 64-bit, so a wide one keeps every digit
+    unnSetGlobal(interp, "id", unnInt(INT64_C(9007199254740993)));
+    run(interp, "return id;");
+
+    printf("--- errors ---\n");
+    run(interp, "var = 1;");
+    run(interp, "const k = 1;\nk = 2;");
+    run(interp, "var x = 1;\nthrow \"thrown from line 2\";");
+    run(interp, "tally(1, 2);");
+    run(interp, "return \"still usable\";");
+
+    printf("--- output ---\n");
+    Captured captured = { "", 0, 0 };
+    unnSetOutput(interp, capture, &captured);
+    run(interp, "print(\"one\"); print([1, 2]); printf(\"%d\", 3);");
+    showCaptured(&captured);
+    run(interp, "print(\"before flush\"); flush(); print(\"after flush\");");
+    showCaptured(&captured);
+    run(interp, "print(\"printed, then\");\nthrow \"failed\";");
+    showCaptured(&captured);
+    unnSetOutput(interp, NULL, NULL);
+    run(interp, "print(\"back on stdout\");");
+    printf("captured %d piece(s) after reset\n", captured.pieces);
+
+    printf("--- limits ---\n");
+    printf("max stack 0 accepted: %s\n", unnSetMaxStack(interp, 0) ? "yes" : "no");
+    unnSetMaxStack(interp, 64);
+    run(interp, "function down(n) { return down(n + 1) + 1; }\n"
+                "try { down(0); } catch (e) { return \"caught: \" + e.message; }");
+    unnSetTimeout(interp, 50);
+    run(interp, "try { while (true) {} } catch (e) { return \"caught\"; }");
+    unnSetTimeout(interp, 0);
+    unnSetMaxHeap(interp, 2 * 1024 * 1024);
+    run(interp, "var hog = [];\ntry { while (true) { push(hog, \"x\" + length(hog) * 1000); } } catch (e) { return \"caught\"; }");
+    unnSetMaxHeap(interp, 0);
+    run(interp, "hog = nil; return \"still usable\";");
+    run(interp, "return eval(\"6 * 7\");");
+    unnSetEval(interp, false);
+    run(interp, "try { eval(\"1\"); } catch (e) { return \"caught: \" + e.message; }");
+    run(interp, "return eval(\"1\");");
+    unnSetEval(interp, true);
+    run(interp, "eval(\"function triple(n) { return n * 3; }\"); return triple(21);");
+    run(interp, "return eval(\"1 +\");");
+
+    printf("--- steps ---\n");
+    const char* loop = "var total = 0;\nfor (var i = 0; i < 200000; i++) { total += i % 7; }\nreturn total;";
+    run(interp, loop);
+    stepped(interp, loop, 10000);
+    stepped(interp, loop, 100000000);
+    stepped(interp, "function sq(x) { var y = 0; for (var j = 0; j < x; j++) { y += x; } return y; }\n"
+                    "return json_encode(map([10, 20, 30], sq));", 7);
+    stepped(interp, "var n = 0;\nwhile (n < 5000) { n++; }\nthrow \"gave up at \" + n;", 100);
+    unnStart(interp, "var progress = 0;\nwhile (progress < 1000) { progress++; }\nreturn progress;");
+    unnStep(interp, 500, NULL);
+    UnnValue progress;
+    if (unnGetGlobal(interp, "progress", &progress)) {
+        printf("progress while paused: %s\n", progress.as.integer > 0 && progress.as.integer < 1000 ? "partway" : "wrong");
+    }
+    run(interp, "return 1;");
+    UnnValue result;
+    while (unnStep(interp, 500, &result) == UNN_STEP_PAUSED) {}
+    show(result);
+    printf("step with no run: %s\n", unnStep(interp, 10, NULL) == UNN_STEP_FAILED ? unnLastError(interp) : "ran");
+    unnSetTimeout(interp, 50);
+    stepped(interp, "while (true) {}", 1000000);
+    unnSetTimeout(interp, 0);
+    unnStart(interp, "while (true) {}");
+    unnStep(interp, 100, NULL);
+    unnFree(interp);
+
+    printf("--- hash seed ---\n");
+    printf("fixed before unnNew: %s\n", seeded ? "yes" : "no");
+    printf("fixed after unnNew: %s\n", unnSetHashSeed(8) ? "yes" : "no");
+    interp = unnNew();
+    run(interp, "var m = map();\nfor (var i = 0; i < 6; i++) { m[\"key\" + i] = i; }\nreturn json_encode(m);");
+    run(interp, "var m = map();\nfor (var i = 0; i < 500; i++) { m[\"k\" + i] = i; }\n"
+                "var sum = 0;\nfor (var k : keys(m)) { sum += m[k]; }\nreturn len(m) + \" keys, sum \" + sum;");
+    unnFree(interp);
+
+    printf("--- threads ---\n");
+    pthread_t threads[2];
+    int64_t counts[2] = {1000, 2000};
+    for (int i = 0; i < 2; i++) pthread_create(&threads[i], NULL, worker, &counts[i]);
+    for (int i = 0; i < 2; i++) pthread_join(threads[i], NULL);
+    printf("sums: %lld %lld\n", (long long)counts[0], (long long)counts[1]);
+    return 0;
+}
@@ -0,0 +1,47 @@
+#!/bin/bash
+
+# Unnarize Tree Walker Check
+# Runs every script in examples/basics/ and examples/errors/, the import
+# tests in examples/modules/ and the multi-file app in examples/testcase/
+# on the bytecode VM and again with --ast-interp, which walks the syntax
+# tree instead, and expects the same output and exit status from both. The
+# walker is the reference: a difference points at the compiler, the
+# optimizer or the interpreter loop. Error reports on stderr are not
+# compared, as the walker prints no stack traces.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+# The modules' lib/ files are what the import tests load, not tests
+FILES=$( (find examples/basics examples/errors -name "*.unna"
+          find examples/modules -maxdepth 1 -name "*.unna"
+          echo examples/testcase/main.unna) | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+for f in $FILES; do
+    # One after the other: some scripts share scratch files
+    timeout 10s "$BIN" "$f" > "$TMP_DIR/bytecode.txt" 2> /dev/null
+    echo "exit status $?" >> "$TMP_DIR/bytecode.txt"
+    timeout 10s "$BIN" --ast-interp "$f" > "$TMP_DIR/walker.txt" 2> /dev/null
+    echo "exit status $?" >> "$TMP_DIR/walker.txt"
+    if diff -q "$TMP_DIR/bytecode.txt" "$TMP_DIR/walker.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (output differs)"
+        diff "$TMP_DIR/bytecode.txt" "$TMP_DIR/walker.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
@@ -0,0 +1,42 @@
+#!/bin/bash
+
+# Benchmark Comparison Parser Check
+# Feeds the saved outputs in languagebench/compare/testdata to the Go
+# comparison runner and checks its table against expected.txt. The
+# Unnarize sample has the older "ops/sec" layout and a diagnostic line
+# before the banner, which the parser has to skip. Runs the unit tests in
+# main_test.go first.
+
+DIR="languagebench/compare"
+
+if ! command -v go &> /dev/null; then
+    echo -e "\033[0;33m SKIP \033[0m benchmark comparison (go not found)"
+    exit 0
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+if ! (cd "$DIR" && timeout 120s go vet ./... && timeout 120s go test ./...) > "$TMP_DIR/test.txt" 2>&1; then
+    echo -e "\033[0;31m FAIL \033[0m benchmark comparison unit tests"
+    sed 's/^/      /' "$TMP_DIR/test.txt"
+    exit 1
+fi
+
+timeout 60s go run "$DIR/main.go" \
+    -unnarize-output "$DIR/testdata/unnarize.txt" \
+    -go-output "$DIR/testdata/go.txt" > "$TMP_DIR/table.txt" 2>&1
+STATUS=$?
+if [ "$STATUS" -ne 0 ]; then
+    echo -e "\033[0;31m FAIL \033[0m (exit status $STATUS)"
+    sed 's/^/      /' "$TMP_DIR/table.txt"
+    exit 1
+fi
+
+if ! diff -u "$DIR/testdata/expected.txt" "$TMP_DIR/table.txt" > "$TMP_DIR/diff.txt"; then
+    echo -e "\033[0;31m FAIL \033[0m benchmark comparison table"
+    sed 's/^/      /' "$TMP_DIR/diff.txt"
+    exit 1
+fi
+
+echo -e "\033[0;32m PASS \033[0m benchmark comparison ($(grep -c 'x$' "$TMP_DIR/table.txt") benchmarks)"
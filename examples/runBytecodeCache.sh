@@ -0,0 +1,99 @@
+#!/bin/bash
+
+# Unnarize Bytecode Cache Check
+# Runs a copy of examples/cache/greet.unna with a cache directory of its
+# own and reads "Bytecode cache:" from --stats: the first run compiles and
+# writes the cache, the second loads it, and an edit to the source, a
+# cache file from another interpreter version, a damaged one or other
+# options compile again. The output never depends on where the bytecode came from.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/cache/greet.unna"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+export UNNARIZE_CACHE_DIR="$TMP_DIR/cache"
+COPY="$TMP_DIR/greet.unna"
+cp "$SCRIPT" "$COPY"
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    sed 's/^/      /' "$TMP_DIR/stats.txt"
+    exit 1
+}
+
+# Runs the copy with --stats, leaving the state of the cache in $STATE
+run() {
+    timeout 10s "$BIN" --stats "$@" "$COPY" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/stats.txt"
+    STATE=$(sed -n 's/^Bytecode cache:  \([a-z ]*\) (.*/\1/p' "$TMP_DIR/stats.txt")
+}
+
+"$BIN" --no-cache "$COPY" > "$TMP_DIR/expected.txt" 2>&1
+[ -e "$UNNARIZE_CACHE_DIR" ] && fail "--no-cache made the cache directory"
+
+run
+[ "$STATE" = "written" ] || fail "first run: '$STATE', expected written"
+CACHED=$(ls "$UNNARIZE_CACHE_DIR"/greet-*.unc 2> /dev/null)
+[ -n "$CACHED" ] || fail "no cache file"
+cmp -s "$TMP_DIR/out.txt" "$TMP_DIR/expected.txt" || fail "output of the compiling run differs"
+
+run
+[ "$STATE" = "hit" ] || fail "second run: '$STATE', expected hit"
+cmp -s "$TMP_DIR/out.txt" "$TMP_DIR/expected.txt" || fail "output of the cached run differs"
+
+# An edit is seen at once, and the new bytecode is cached in its place
+echo 'print("edited");' >> "$COPY"
+run
+[ "$STATE" = "written" ] || fail "edited source: '$STATE', expected written"
+[ "$(tail -1 "$TMP_DIR/out.txt")" = "edited" ] || fail "the edit did not run"
+run
+[ "$STATE" = "hit" ] || fail "edited source, second run: '$STATE', expected hit"
+[ "$(ls "$UNNARIZE_CACHE_DIR" | wc -l)" -eq 1 ] || fail "more than one cache file for the script"
+
+# The version is stored after the magic and its length: change a byte of
+# it, as another release would have written
+printf 'X' | dd of="$CACHED" bs=1 seek=8 conv=notrunc 2> /dev/null
+run
+[ "$STATE" = "written" ] || fail "other version: '$STATE', expected written"
+
+# A damaged image no longer matches the hash in the key: a flipped bit
+# near the end, then a file cut short, are both compiled again with the
+# same output
+size=$(stat -c %s "$CACHED")
+byte=$(od -An -tu1 -j $((size - 8)) -N1 "$CACHED" | tr -d ' ')
+printf "\\x$(printf %02x $((byte ^ 16)))" | dd of="$CACHED" bs=1 seek=$((size - 8)) conv=notrunc 2> /dev/null
+run
+[ "$STATE" = "written" ] || fail "flipped bit: '$STATE', expected written"
+grep -q "Error" "$TMP_DIR/stats.txt" && fail "the damaged image reached the loader"
+cmp -s <(tail -1 "$TMP_DIR/out.txt") <(echo "edited") || fail "output after a flipped bit differs"
+truncate -s -16 "$CACHED"
+run
+[ "$STATE" = "written" ] || fail "truncated cache file: '$STATE', expected written"
+run
+[ "$STATE" = "hit" ] || fail "after the damaged files: '$STATE', expected hit"
+
+# Optimized and unoptimized bytecode are not mixed up
+run --no-optimize
+[ "$STATE" = "written" ] || fail "--no-optimize: '$STATE', expected written"
+run
+[ "$STATE" = "written" ] || fail "back to optimized: '$STATE', expected written"
+
+# An error reported from cached bytecode is reported as from the source
+echo 'var broken = nil; print(broken.field);' >> "$COPY"
+"$BIN" --no-cache "$COPY" > "$TMP_DIR/expected.txt" 2>&1
+"$BIN" "$COPY" > /dev/null 2>&1
+"$BIN" "$COPY" > "$TMP_DIR/out.txt" 2>&1
+cmp -s "$TMP_DIR/out.txt" "$TMP_DIR/expected.txt" || fail "runtime error from the cache differs"
+
+# An empty UNNARIZE_CACHE_DIR turns the cache off
+rm -rf "$UNNARIZE_CACHE_DIR"
+UNNARIZE_CACHE_DIR= run
+[ -z "$STATE" ] || fail "empty UNNARIZE_CACHE_DIR: '$STATE'"
+
+echo -e "\033[0;32m PASS \033[0m bytecode cache (written, hit, edited, versioned, damaged)"
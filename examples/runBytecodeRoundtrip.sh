@@ -0,0 +1,48 @@
+#!/bin/bash
+
+# Unnarize Bytecode Round-Trip Check
+# Compiles each basic example to .unc, runs both the source and the
+# bytecode, and verifies that their output is identical.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FILES=$(find examples/basics -name "*.unna" | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+COUNT=0
+PASSED=0
+
+for f in $FILES; do
+    COUNT=$((COUNT + 1))
+    echo -n "[$COUNT/$TOTAL] $f..."
+
+    unc="$TMP_DIR/$(basename "$f" .unna).unc"
+    if ! "$BIN" compile "$f" -o "$unc" > "$TMP_DIR/compile.txt" 2>&1; then
+        echo -e "\033[0;31m FAIL \033[0m (compile)"
+        sed 's/^/      /' "$TMP_DIR/compile.txt"
+        continue
+    fi
+
+    timeout 10s "$BIN" "$f" > "$TMP_DIR/source.txt" 2>&1
+    timeout 10s "$BIN" "$unc" > "$TMP_DIR/bytecode.txt" 2>&1
+
+    if diff -q "$TMP_DIR/source.txt" "$TMP_DIR/bytecode.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m (output differs)"
+        diff "$TMP_DIR/source.txt" "$TMP_DIR/bytecode.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
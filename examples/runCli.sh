@@ -0,0 +1,38 @@
+#!/bin/bash
+
+# Unnarize Command-Line Check
+# Runs examples/cli/args_env.unna with a flag before the script and extra
+# arguments after it, and an environment variable set, then compares the
+# output with args_env.expected: args() holds only the arguments after the
+# script, in order, and getenv() gives the value or nil.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/cli/args_env.unna"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    sed 's/^/      /' "$TMP_DIR/out.txt"
+    exit 1
+}
+
+unset UNNARIZE_CLI_UNSET UNNARIZE_CLI_NEW
+UNNARIZE_CLI_SET=present timeout 10s "$BIN" --stats "$SCRIPT" one "two words" --three \
+    > "$TMP_DIR/out.txt" 2> /dev/null
+STATUS=$?
+[ "$STATUS" -eq 0 ] || fail "exit status $STATUS"
+diff -q "${SCRIPT%.unna}.expected" "$TMP_DIR/out.txt" > /dev/null || fail "output differs"
+
+# Without extra arguments args() is empty
+echo 'print(len(args()));' > "$TMP_DIR/none.unna"
+[ "$("$BIN" "$TMP_DIR/none.unna")" = "0" ] || fail "args() not empty without arguments"
+
+echo -e "\033[0;32m PASS \033[0m cli ($(wc -l < "$TMP_DIR/out.txt") lines)"
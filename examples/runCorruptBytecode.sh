@@ -0,0 +1,100 @@
+#!/bin/bash
+
+# Unnarize Damaged Bytecode Check
+# A .unc file that was cut short, edited or hit by a flipped bit must be
+# turned away with an error, or run into one, never crash the interpreter.
+# Patches a small compiled script in known places and checks the loader's
+# report, then flips bits all through the images of a few basic examples
+# and checks that each run ends with status 0 or 1.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+PASSED=0
+TOTAL=0
+
+# Sets byte 'offset' of file $1 to the value $3
+poke() {
+    printf "\\x$(printf %02x "$3")" | dd of="$1" bs=1 seek="$2" conv=notrunc 2> /dev/null
+}
+
+byteAt() {
+    od -An -tu1 -j "$2" -N1 "$1" | tr -d ' '
+}
+
+# Runs the patched image and expects the loader to refuse it with 'message'
+expectRejected() {
+    local name="$1" message="$2"
+    TOTAL=$((TOTAL + 1))
+    timeout 10s "$BIN" "$TMP_DIR/patched.unc" > /dev/null 2> "$TMP_DIR/err.txt"
+    local status=$?
+    if [ "$status" -eq 1 ] && grep -qF "$message" "$TMP_DIR/err.txt"; then
+        echo -e "\033[0;32m PASS \033[0m $name"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $name (exit status $status)"
+        sed 's/^/      /' "$TMP_DIR/err.txt" | head -n 5
+    fi
+}
+
+# The first instruction of the script is LOADK R1 K0. Its word follows
+# the header, the recorded source path, maxRegs and codeSize, low byte
+# first: Bx, then A, then the opcode.
+printf 'var greeting = "hello";\nprint(greeting);\n' > "$TMP_DIR/small.unna"
+"$BIN" compile "$TMP_DIR/small.unna" -o "$TMP_DIR/small.unc" > /dev/null
+SOURCE_LEN=$(byteAt "$TMP_DIR/small.unc" 6)
+CODE=$((10 + SOURCE_LEN + 8))
+
+cp "$TMP_DIR/small.unc" "$TMP_DIR/patched.unc"
+poke "$TMP_DIR/patched.unc" "$((CODE + 1))" 200
+expectRejected "constant index past the pool" "Instruction 0 (LOADK) has an operand outside its chunk."
+
+cp "$TMP_DIR/small.unc" "$TMP_DIR/patched.unc"
+poke "$TMP_DIR/patched.unc" "$((CODE + 2))" 250
+expectRejected "register past the frame" "Instruction 0 (LOADK) has an operand outside its chunk."
+
+# codeSize one short drops the closing RETURNNIL
+cp "$TMP_DIR/small.unc" "$TMP_DIR/patched.unc"
+poke "$TMP_DIR/patched.unc" "$((CODE - 4))" "$(( $(byteAt "$TMP_DIR/small.unc" $((CODE - 4))) - 1 ))"
+expectRejected "code that runs off its end" "Bytecode file is truncated or corrupt."
+
+cp "$TMP_DIR/small.unc" "$TMP_DIR/patched.unc"
+truncate -s -3 "$TMP_DIR/patched.unc"
+expectRejected "truncated file" "Bytecode file is truncated or corrupt."
+
+# One bit of every seventh byte, past the magic and version, in turn
+for f in examples/basics/13_closures.unna examples/basics/23_tail_calls.unna \
+         examples/basics/36_spread.unna examples/basics/40_map_filter_reduce.unna; do
+    TOTAL=$((TOTAL + 1))
+    image="$TMP_DIR/$(basename "$f" .unna).unc"
+    "$BIN" compile "$f" -o "$image" > /dev/null
+    size=$(stat -c %s "$image")
+    crashed=""
+    for ((i = 6; i < size; i += 7)); do
+        cp "$image" "$TMP_DIR/patched.unc"
+        poke "$TMP_DIR/patched.unc" "$i" "$(( $(byteAt "$image" "$i") ^ (1 << (i % 8)) ))"
+        (cd "$TMP_DIR" && timeout 5s "$OLDPWD/$BIN" patched.unc > /dev/null 2>&1 < /dev/null)
+        status=$?
+        if [ "$status" -gt 1 ] && [ "$status" -ne 124 ]; then
+            crashed="byte $i, exit status $status"
+            break
+        fi
+    done
+    if [ -z "$crashed" ]; then
+        echo -e "\033[0;32m PASS \033[0m $f (bit flips)"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f ($crashed)"
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
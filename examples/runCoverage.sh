@@ -0,0 +1,60 @@
+#!/bin/bash
+
+# Unnarize Coverage Check
+# Runs examples/coverage/branches.unna with --coverage and compares the
+# report on stderr with branches.expected: the branch that is never taken
+# and the function nobody calls are listed as not run, and the program's
+# own output is unchanged. Then 'unnarize test --coverage' must report every
+# test file while keeping the runner's exit status.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/coverage/branches.unna"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    sed 's/^/      /' "$TMP_DIR/coverage.txt"
+    exit 1
+}
+
+timeout 10s "$BIN" --coverage "$SCRIPT" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/coverage.txt"
+STATUS=$?
+[ "$STATUS" -eq 0 ] || fail "exit status $STATUS"
+
+"$BIN" "$SCRIPT" > "$TMP_DIR/plain.txt" 2>&1
+cmp -s "$TMP_DIR/out.txt" "$TMP_DIR/plain.txt" || fail "program output changed"
+
+diff -q "examples/coverage/branches.expected" "$TMP_DIR/coverage.txt" > /dev/null ||
+    fail "report differs from branches.expected"
+
+# Line 8 is the negative branch, 16-17 the body of unused()
+grep -q "not run: 8, 16-17$" "$TMP_DIR/coverage.txt" || fail "uncovered lines missing"
+
+# The same lines from the compiled form, which records its source
+"$BIN" compile "$SCRIPT" -o "$TMP_DIR/branches.unc" > /dev/null || fail "compile failed"
+"$BIN" --coverage "$TMP_DIR/branches.unc" > /dev/null 2> "$TMP_DIR/unc.txt"
+cmp -s "$TMP_DIR/unc.txt" "$TMP_DIR/coverage.txt" || fail "report from .unc differs"
+
+# Without --coverage nothing is written to stderr
+"$BIN" "$SCRIPT" > /dev/null 2> "$TMP_DIR/stderr.txt"
+[ -s "$TMP_DIR/stderr.txt" ] && fail "stderr output without --coverage"
+
+# The test runner adds up every file it ran; failing tests still fail
+timeout 10s "$BIN" test --coverage examples/testrunner/failing > "$TMP_DIR/tests.txt" 2> "$TMP_DIR/coverage.txt"
+STATUS=$?
+[ "$STATUS" -eq 1 ] || fail "test runner exit status $STATUS, expected 1"
+diff -q "examples/testrunner/failing.expected" "$TMP_DIR/tests.txt" > /dev/null || fail "test report changed"
+for file in failing/nested/caught_test.unna failing/sample_test.unna; do
+    grep -q "^  examples/testrunner/$file " "$TMP_DIR/coverage.txt" || fail "$file not covered"
+done
+grep -q "^  total " "$TMP_DIR/coverage.txt" || fail "no total over the test files"
+
+echo -e "\033[0;32m PASS \033[0m coverage ($(grep -c '%$' "$TMP_DIR/coverage.txt") files)"
@@ -0,0 +1,35 @@
+#!/bin/bash
+
+# Unnarize Debugger Session Check
+# Runs examples/debugger/orders.unna under 'unnarize debug', feeding the
+# commands in session.txt on stdin, and compares everything printed with
+# session.expected. The session stops at breakpoints, steps into and over
+# calls and inspects locals and globals.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+timeout 10s "$BIN" debug examples/debugger/orders.unna < examples/debugger/session.txt > "$TMP_DIR/session.txt" 2> "$TMP_DIR/err.txt"
+STATUS=$?
+
+if [ "$STATUS" -ne 0 ]; then
+    echo -e "\033[0;31m FAIL \033[0m (exit status $STATUS)"
+    sed 's/^/      /' "$TMP_DIR/err.txt"
+    exit 1
+fi
+
+if diff -q examples/debugger/session.expected "$TMP_DIR/session.txt" > /dev/null; then
+    echo -e "\033[0;32m PASS \033[0m debugger session"
+else
+    echo -e "\033[0;31m FAIL \033[0m (output differs)"
+    diff examples/debugger/session.expected "$TMP_DIR/session.txt" | head -n 10 | sed 's/^/      /'
+    exit 1
+fi
@@ -0,0 +1,40 @@
+#!/bin/bash
+
+# Unnarize Disassembly Check
+# Disassembles every script in examples/disasm/ and compares the listing
+# with the matching .expected file. A difference means the instruction set
+# or the code the compiler generates has changed; if that was intended,
+# regenerate the file with: ./bin/unnarize disasm <file.unna> > <file.expected>
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FILES=$(find examples/disasm -name "*.unna" | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+for f in $FILES; do
+    expected="${f%.unna}.expected"
+    if ! timeout 10s "$BIN" disasm "$f" > "$TMP_DIR/out.txt" 2>&1; then
+        echo -e "\033[0;31m FAIL \033[0m $f (disassembly failed)"
+        sed 's/^/      /' "$TMP_DIR/out.txt" | head -n 10
+    elif diff -q "$expected" "$TMP_DIR/out.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (listing differs)"
+        diff "$expected" "$TMP_DIR/out.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
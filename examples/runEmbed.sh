@@ -0,0 +1,71 @@
+#!/bin/bash
+
+# Unnarize Embedding API Check
+# Builds bin/libunnarize.a, links examples/embed/host.c against it and
+# compares the host's output with examples/embed/host.expected, also with
+# UNNARIZE_GC_STRESS=1, then runs the tests of the Go package in
+# bindings/go where Go is installed.
+
+LIB="./bin/libunnarize.a"
+HOST_SRC="examples/embed/host.c"
+EXPECTED="examples/embed/host.expected"
+
+if ! make lib > /dev/null; then
+    echo -e "\033[0;31m FAIL \033[0m (make lib failed)"
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+if ! gcc -Wall -Wextra -std=c11 -D_POSIX_C_SOURCE=200809L -Icore/include "$HOST_SRC" "$LIB" \
+        -o "$TMP_DIR/host" -lm -ldl -lpthread 2> "$TMP_DIR/build.txt" || [ -s "$TMP_DIR/build.txt" ]; then
+    echo -e "\033[0;31m FAIL \033[0m (host did not build cleanly)"
+    sed 's/^/      /' "$TMP_DIR/build.txt"
+    exit 1
+fi
+
+timeout 10s "$TMP_DIR/host" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/err.txt"
+STATUS=$?
+if [ "$STATUS" -ne 0 ]; then
+    echo -e "\033[0;31m FAIL \033[0m (exit status $STATUS)"
+    tail -n 5 "$TMP_DIR/err.txt" | sed 's/^/      /'
+    exit 1
+fi
+
+# Errors are reported to the host, never printed by the library
+if [ -s "$TMP_DIR/err.txt" ]; then
+    echo -e "\033[0;31m FAIL \033[0m (library wrote to stderr)"
+    sed 's/^/      /' "$TMP_DIR/err.txt"
+    exit 1
+fi
+
+if ! diff -u "$EXPECTED" "$TMP_DIR/out.txt" > "$TMP_DIR/diff.txt"; then
+    echo -e "\033[0;31m FAIL \033[0m (output differs from $EXPECTED)"
+    sed 's/^/      /' "$TMP_DIR/diff.txt"
+    exit 1
+fi
+
+echo -e "\033[0;32m PASS \033[0m embedding API ($(wc -l < "$EXPECTED") lines)"
+
+# Again with a collection at every allocation, where registering a host
+# function must keep its name alive while the function is allocated
+UNNARIZE_GC_STRESS=1 timeout 60s "$TMP_DIR/host" > "$TMP_DIR/stress.txt" 2> "$TMP_DIR/err.txt"
+STATUS=$?
+if [ "$STATUS" -ne 0 ] || ! diff -q "$EXPECTED" "$TMP_DIR/stress.txt" > /dev/null; then
+    echo -e "\033[0;31m FAIL \033[0m embedding API under GC stress (exit status $STATUS)"
+    tail -n 5 "$TMP_DIR/err.txt" | sed 's/^/      /'
+    exit 1
+fi
+echo -e "\033[0;32m PASS \033[0m embedding API under GC stress"
+
+if ! command -v go &> /dev/null; then
+    echo -e "\033[0;33m SKIP \033[0m Go package (go not found)"
+    exit 0
+fi
+if ! (cd bindings/go && timeout 300s go vet ./... && timeout 300s go test ./...) > "$TMP_DIR/go.txt" 2>&1; then
+    echo -e "\033[0;31m FAIL \033[0m Go package"
+    sed 's/^/      /' "$TMP_DIR/go.txt"
+    exit 1
+fi
+echo -e "\033[0;32m PASS \033[0m Go package"
@@ -0,0 +1,72 @@
+#!/bin/bash
+
+# Unnarize Error Report Check
+# Runs every script in examples/errors/, each of which ends in an uncaught
+# runtime error or fails to compile, and compares what it prints on stderr
+# (the message, source line and stack trace) with the matching .expected file.
+# Each script that compiles is also compiled to a .unc and run from there,
+# which must report the same source locations. A script with a .ast.expected
+# file beside it is run with --ast-interp as well, whose report (the
+# message and source line, with no stack trace) must match that file.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FILES=$(find examples/errors -name "*.unna" | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+for f in $FILES; do
+    expected="${f%.unna}.expected"
+    timeout 10s "$BIN" "$f" > /dev/null 2> "$TMP_DIR/err.txt"
+    status=$?
+
+    if [ "$status" -ne 1 ]; then
+        echo -e "\033[0;31m FAIL \033[0m $f (exit status $status, expected 1)"
+    elif diff -q "$expected" "$TMP_DIR/err.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (report differs)"
+        diff "$expected" "$TMP_DIR/err.txt" | head -n 10 | sed 's/^/      /'
+        continue
+    fi
+
+    astExpected="${f%.unna}.ast.expected"
+    if [ -f "$astExpected" ]; then
+        TOTAL=$((TOTAL + 1))
+        timeout 10s "$BIN" --ast-interp "$f" > /dev/null 2> "$TMP_DIR/err.txt"
+        if diff -q "$astExpected" "$TMP_DIR/err.txt" > /dev/null; then
+            echo -e "\033[0;32m PASS \033[0m $f (--ast-interp)"
+            PASSED=$((PASSED + 1))
+        else
+            echo -e "\033[0;31m FAIL \033[0m $f (report from --ast-interp differs)"
+            diff "$astExpected" "$TMP_DIR/err.txt" | head -n 10 | sed 's/^/      /'
+        fi
+    fi
+
+    # A script that fails to compile has no bytecode to run
+    unc="$TMP_DIR/$(basename "${f%.unna}").unc"
+    "$BIN" compile "$f" -o "$unc" > /dev/null 2>&1 || continue
+    TOTAL=$((TOTAL + 1))
+    timeout 10s "$BIN" "$unc" > /dev/null 2> "$TMP_DIR/err.txt"
+    if diff -q "$expected" "$TMP_DIR/err.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f (from .unc)"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (report from .unc differs)"
+        diff "$expected" "$TMP_DIR/err.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
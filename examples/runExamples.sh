@@ -112,6 +112,14 @@ for f in $FILES; do
             echo " ] $f: FAIL (Timeout) (CPU: ${cpu_usage}%, RAM: ${ram_usage}KB)" >> "$REPORT_FILE"
             echo "    Error Details: Execution timed out after 10s" >> "$REPORT_FILE"
         fi
+    elif [ $exit_code -eq 1 ] && [[ "$f" == examples/errors/* || "$f" == examples/modules/lib/broken_* ]]; then
+        # These scripts end in an uncaught error on purpose (see runErrorTraces.sh,
+        # and modules/failures.unna for the modules)
+        echo -e "\033[0;32m PASS (Error Expected) \033[0m (CPU: ${cpu_usage}%, RAM: ${ram_usage}KB)"
+        PASSED=$((PASSED + 1))
+        echo "x] $f: PASS (Error Expected) (CPU: ${cpu_usage}%, RAM: ${ram_usage}KB)" >> "$REPORT_FILE"
+        echo "    Output Details:" >> "$REPORT_FILE"
+        clean_output "$temp_out" | sed 's/^/      /' >> "$REPORT_FILE"
     else
         echo -e "\033[0;31m FAIL \033[0m (CPU: ${cpu_usage}%, RAM: ${ram_usage}KB)"
         echo " ] $f: FAIL (Exit Code: $exit_code) (CPU: ${cpu_usage}%, RAM: ${ram_usage}KB)" >> "$REPORT_FILE"
@@ -0,0 +1,95 @@
+#!/bin/bash
+
+# Unnarize Formatter Check
+# 'unnarize fmt' on examples/fmt/messy.unna must print messy.expected, which
+# must already be formatted and print the same as the original. Also checks
+# that -w rewrites a file in place, that a syntax error exits with status 1,
+# and that formatting any script in examples/basics twice changes nothing
+# the second time.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+PASSED=0
+FAILED=0
+
+pass() {
+    echo -e "\033[0;32m PASS \033[0m $1"
+    PASSED=$((PASSED + 1))
+}
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m $1"
+    FAILED=$((FAILED + 1))
+}
+
+MESSY="examples/fmt/messy.unna"
+EXPECTED="examples/fmt/messy.expected"
+
+"$BIN" fmt "$MESSY" > "$TMP_DIR/out.unna" 2>&1
+if diff -q "$EXPECTED" "$TMP_DIR/out.unna" > /dev/null; then
+    pass "golden output"
+else
+    fail "golden output"
+    diff "$EXPECTED" "$TMP_DIR/out.unna" | head -n 10 | sed 's/^/      /'
+fi
+
+"$BIN" fmt "$EXPECTED" > "$TMP_DIR/again.unna" 2>&1
+if diff -q "$EXPECTED" "$TMP_DIR/again.unna" > /dev/null; then
+    pass "formatted output is a fixpoint"
+else
+    fail "formatted output is a fixpoint"
+fi
+
+"$BIN" "$MESSY" > "$TMP_DIR/messy.txt" 2>&1
+"$BIN" "$EXPECTED" > "$TMP_DIR/expected.txt" 2>&1
+if diff -q "$TMP_DIR/messy.txt" "$TMP_DIR/expected.txt" > /dev/null; then
+    pass "same program output"
+else
+    fail "same program output"
+    diff "$TMP_DIR/messy.txt" "$TMP_DIR/expected.txt" | head -n 10 | sed 's/^/      /'
+fi
+
+cp "$MESSY" "$TMP_DIR/inplace.unna"
+if "$BIN" fmt -w "$TMP_DIR/inplace.unna" > "$TMP_DIR/w.txt" 2>&1 &&
+   [ ! -s "$TMP_DIR/w.txt" ] && diff -q "$EXPECTED" "$TMP_DIR/inplace.unna" > /dev/null; then
+    pass "-w rewrites in place"
+else
+    fail "-w rewrites in place"
+fi
+
+printf 'var x = ;\n' > "$TMP_DIR/broken.unna"
+cp "$TMP_DIR/broken.unna" "$TMP_DIR/broken.orig"
+"$BIN" fmt -w "$TMP_DIR/broken.unna" > /dev/null 2>&1
+status=$?
+if [ "$status" -eq 1 ] && cmp -s "$TMP_DIR/broken.unna" "$TMP_DIR/broken.orig"; then
+    pass "syntax error leaves the file alone"
+else
+    fail "syntax error leaves the file alone (exit status $status)"
+fi
+
+UNSTABLE=0
+for f in examples/basics/*.unna; do
+    "$BIN" fmt "$f" > "$TMP_DIR/once.unna" 2> /dev/null
+    "$BIN" fmt "$TMP_DIR/once.unna" > "$TMP_DIR/twice.unna" 2> /dev/null
+    if ! diff -q "$TMP_DIR/once.unna" "$TMP_DIR/twice.unna" > /dev/null; then
+        echo "      not stable: $f"
+        UNSTABLE=$((UNSTABLE + 1))
+    fi
+done
+if [ "$UNSTABLE" -eq 0 ]; then
+    pass "examples/basics format stably"
+else
+    fail "examples/basics format stably"
+fi
+
+echo "Formatter: $PASSED passed, $FAILED failed"
+[ "$FAILED" -eq 0 ]
@@ -0,0 +1,61 @@
+#!/bin/bash
+
+# Unnarize Example Output Check
+# Runs every script in examples/basics/ and the corelib examples that have
+# a .expected file beside them, and compares what each prints on stdout,
+# and its exit status, with that file. Every script in examples/basics/
+# must have one. Output with a "FAILED" line fails even when it matches,
+# so an expected file cannot record a failing check.
+#
+# After a change that is meant to alter the output, refresh the expected
+# files with:  examples/runGoldens.sh --update
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+UPDATE=0
+[ "$1" = "--update" ] && UPDATE=1
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+export UNNARIZE_CACHE_DIR="$TMP_DIR/cache"
+
+FILES=$( (find examples/basics -name "*.unna"
+          find examples/corelib -name "*.unna" | while read -r f; do
+              [ -f "${f%.unna}.expected" ] && echo "$f"
+          done) | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+for f in $FILES; do
+    expected="${f%.unna}.expected"
+    # One after the other: some scripts share scratch files. Plain maps
+    # list their keys in hash order, so the seed is fixed
+    timeout 20s "$BIN" --hash-seed 0 "$f" > "$TMP_DIR/out.txt" 2> /dev/null
+    echo "exit status $?" >> "$TMP_DIR/out.txt"
+
+    if [ "$UPDATE" -eq 1 ]; then
+        cp "$TMP_DIR/out.txt" "$expected"
+    fi
+    if grep -q "FAILED" "$TMP_DIR/out.txt"; then
+        echo -e "\033[0;31m FAIL \033[0m $f (a check failed)"
+        grep "FAILED" "$TMP_DIR/out.txt" | head -n 10 | sed 's/^/      /'
+    elif [ ! -f "$expected" ]; then
+        echo -e "\033[0;31m FAIL \033[0m $f (no $expected)"
+    elif diff -q "$expected" "$TMP_DIR/out.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (output differs)"
+        diff "$expected" "$TMP_DIR/out.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
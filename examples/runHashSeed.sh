@@ -0,0 +1,75 @@
+#!/bin/bash
+
+# Unnarize Hash Seed Check
+# Runs examples/hashing/map_order.unna under different string hash seeds.
+# A fixed seed, from --hash-seed or UNNARIZE_HASH_SEED, repeats the run
+# exactly; other seeds, and runs without one, list a plain map's keys in
+# other orders. Whatever the seed, the "check" lines, which look keys up,
+# delete them and compare strings, match map_order.expected.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/hashing/map_order.unna"
+EXPECTED="${SCRIPT%.unna}.expected"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+export UNNARIZE_CACHE_DIR="$TMP_DIR/cache"
+unset UNNARIZE_HASH_SEED
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    [ -n "$2" ] && sed 's/^/      /' "$2"
+    exit 1
+}
+
+# run <name> [env...] -- [flags...]: the script's output in $TMP_DIR/<name>.txt
+run() {
+    local name=$1; shift
+    local env=()
+    while [ "$1" != "--" ]; do env+=("$1"); shift; done
+    shift
+    env "${env[@]}" timeout 20s "$BIN" "$@" "$SCRIPT" > "$TMP_DIR/$name.txt" 2> "$TMP_DIR/$name.err" ||
+        fail "$name: exit status $?" "$TMP_DIR/$name.err"
+    grep '^check' "$TMP_DIR/$name.txt" | diff -q "$EXPECTED" - > /dev/null ||
+        fail "$name: map results differ from $EXPECTED" "$TMP_DIR/$name.txt"
+}
+
+same() { cmp -s "$TMP_DIR/$1.txt" "$TMP_DIR/$2.txt"; }
+
+# The same seed gives the same order, the first run compiled and the
+# second from the bytecode cache, and the variable acts as the flag does
+run fixed1 -- --hash-seed 12345
+run fixed2 -- --hash-seed 12345
+run fixedEnv UNNARIZE_HASH_SEED=12345 --
+run walker -- --ast-interp --hash-seed 12345
+same fixed1 fixed2 || fail "--hash-seed 12345 twice gave different output"
+same fixed1 fixedEnv || fail "UNNARIZE_HASH_SEED=12345 differs from --hash-seed 12345"
+same fixed1 walker || fail "the tree walker's order differs under the same seed"
+
+# Another seed, another order
+run other -- --hash-seed 54321
+same fixed1 other && fail "seeds 12345 and 54321 gave the same order"
+
+# Without a seed each run picks its own: of three runs, at least two differ
+run random1 --
+run random2 --
+run random3 --
+if same random1 random2 && same random2 random3; then
+    fail "three unseeded runs listed the keys in one order"
+fi
+
+# --stats names the seed, so a run can be repeated
+timeout 20s "$BIN" --stats --hash-seed 777 "$SCRIPT" 2>&1 > /dev/null | grep -q "^Hash seed: *777$" ||
+    fail "--stats does not report the seed"
+echo 'print(1);' > "$TMP_DIR/one.unna"
+"$BIN" --hash-seed -1 "$TMP_DIR/one.unna" > /dev/null 2>&1 && fail "--hash-seed -1 was accepted"
+[ "$(UNNARIZE_HASH_SEED=junk "$BIN" "$TMP_DIR/one.unna" 2>&1)" = "$(printf 'Warning: ignoring invalid UNNARIZE_HASH_SEED "junk"\n1')" ] ||
+    fail "an invalid UNNARIZE_HASH_SEED is not reported"
+
+echo -e "\033[0;32m PASS \033[0m hash seed (fixed seeds repeat, unseeded runs differ, $(wc -l < "$EXPECTED") checks hold)"
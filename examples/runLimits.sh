@@ -0,0 +1,47 @@
+#!/bin/bash
+
+# Unnarize Resource Limit Check
+# Runs every script in examples/limits/ with the flags on its "// Flags:"
+# line (--max-stack, --max-heap, --timeout, --watchdog) and compares
+# everything it prints with the matching .expected file. A script whose expected output
+# holds a runtime error must exit with status 1, any other with 0.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FILES=$(find examples/limits -name "*.unna" | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+for f in $FILES; do
+    expected="${f%.unna}.expected"
+    flags=$(sed -n 's|^// Flags: ||p' "$f")
+    want=0
+    grep -q "^Runtime Error" "$expected" && want=1
+
+    # shellcheck disable=SC2086
+    timeout 10s "$BIN" $flags "$f" > "$TMP_DIR/out.txt" 2>&1
+    status=$?
+
+    if [ "$status" -ne "$want" ]; then
+        echo -e "\033[0;31m FAIL \033[0m $f (exit status $status, expected $want)"
+    elif diff -q "$expected" "$TMP_DIR/out.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $f"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $f (output differs)"
+        diff "$expected" "$TMP_DIR/out.txt" | head -n 10 | sed 's/^/      /'
+    fi
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
@@ -0,0 +1,135 @@
+#!/bin/bash
+
+# Unnarize Memory Statistics Check
+# Runs examples/stats/push_elements.unna with --stats and checks the report
+# on stderr: the 10000 pushed arrays (plus the outer one and any created at
+# startup) must show up in the array allocation count, and the byte counters
+# must be consistent with that many arrays. Program output must be unchanged.
+# Then runs examples/stats/push_churn.unna, which keeps dropping batches of
+# small arrays and strings, with the block pool on and with it turned off
+# (UNNARIZE_GC_POOL=0): the pool must serve most of its blocks from freed
+# ones while the program output and byte counters stay the same. Last, the
+# churn runs again with young collections turned off (UNNARIZE_GC_YOUNG=0),
+# which must leave its output alone, and
+# examples/garbagecollection/generational.unna checks its own counters.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/stats/push_elements.unna"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FAILED=0
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m $1"
+    FAILED=$((FAILED + 1))
+}
+
+timeout 20s "$BIN" --stats "$SCRIPT" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/stats.txt"
+STATUS=$?
+if [ "$STATUS" -ne 0 ]; then
+    fail "exit status $STATUS"
+    sed 's/^/      /' "$TMP_DIR/stats.txt"
+    exit 1
+fi
+
+# stdout is the program's alone, and identical to a run without --stats
+"$BIN" "$SCRIPT" > "$TMP_DIR/plain.txt" 2>&1
+diff -q "$TMP_DIR/plain.txt" "$TMP_DIR/out.txt" > /dev/null || fail "program output changed"
+grep -q "Memory Statistics" "$TMP_DIR/out.txt" && fail "report written to stdout"
+
+field() {
+    grep "^$1" "$TMP_DIR/stats.txt" | awk '{print $NF}'
+}
+ARRAYS=$(grep "^  array " "$TMP_DIR/stats.txt" | awk '{print $2}')
+LIVE_ARRAYS=$(field "  array ")
+TOTAL=$(field "Bytes allocated:")
+PEAK=$(field "Peak heap bytes:")
+LIVE=$(field "Live heap bytes:")
+
+if [ -z "$ARRAYS" ] || [ -z "$TOTAL" ] || [ -z "$PEAK" ] || [ -z "$LIVE" ]; then
+    fail "report is missing counters"
+    sed 's/^/      /' "$TMP_DIR/stats.txt"
+    exit 1
+fi
+
+# 10000 pushed arrays and the outer one, with a little slack for startup
+if [ "$ARRAYS" -lt 10001 ] || [ "$ARRAYS" -gt 10050 ]; then
+    fail "arrays allocated: $ARRAYS, expected 10001..10050"
+fi
+if [ "$LIVE_ARRAYS" -lt 10001 ]; then
+    fail "live arrays: $LIVE_ARRAYS, expected at least 10001"
+fi
+# Every array holds at least one Value slot: 8 bytes each, at least
+if [ "$TOTAL" -lt 80000 ] || [ "$TOTAL" -gt 20000000 ]; then
+    fail "bytes allocated: $TOTAL, expected 80000..20000000"
+fi
+if [ "$PEAK" -gt "$TOTAL" ] || [ "$LIVE" -gt "$PEAK" ]; then
+    fail "counters out of order: live $LIVE, peak $PEAK, total $TOTAL"
+fi
+
+if [ "$FAILED" -ne 0 ]; then
+    sed 's/^/      /' "$TMP_DIR/stats.txt"
+    exit 1
+fi
+
+CHURN="examples/stats/push_churn.unna"
+timeout 20s "$BIN" --stats "$CHURN" > "$TMP_DIR/pooled.txt" 2> "$TMP_DIR/pooled_stats.txt"
+UNNARIZE_GC_POOL=0 timeout 20s "$BIN" --stats "$CHURN" > "$TMP_DIR/unpooled.txt" 2> "$TMP_DIR/unpooled_stats.txt"
+diff -q "$TMP_DIR/pooled.txt" "$TMP_DIR/unpooled.txt" > /dev/null || fail "block pool changed program output"
+
+pooled() {
+    grep "^Pooled blocks:" "$1" | awk '{print $'"$2"'}'
+}
+REUSED=$(pooled "$TMP_DIR/pooled_stats.txt" 3)
+NEW=$(pooled "$TMP_DIR/pooled_stats.txt" 5)
+UNPOOLED_REUSED=$(pooled "$TMP_DIR/unpooled_stats.txt" 3)
+UNPOOLED_NEW=$(pooled "$TMP_DIR/unpooled_stats.txt" 5)
+POOLED_TOTAL=$(grep "^Bytes allocated:" "$TMP_DIR/pooled_stats.txt" | awk '{print $NF}')
+UNPOOLED_TOTAL=$(grep "^Bytes allocated:" "$TMP_DIR/unpooled_stats.txt" | awk '{print $NF}')
+
+if [ -z "$REUSED" ] || [ -z "$NEW" ] || [ -z "$UNPOOLED_NEW" ]; then
+    fail "report is missing the block pool counters"
+elif [ "$UNPOOLED_REUSED" -ne 0 ]; then
+    fail "UNNARIZE_GC_POOL=0 still reused $UNPOOLED_REUSED blocks"
+elif [ $((REUSED + NEW)) -ne "$UNPOOLED_NEW" ]; then
+    fail "pool handed out $((REUSED + NEW)) blocks, $UNPOOLED_NEW without it"
+elif [ $((NEW * 4)) -gt "$UNPOOLED_NEW" ]; then
+    fail "pool took $NEW of $UNPOOLED_NEW blocks from malloc, expected under a quarter"
+fi
+[ "$POOLED_TOTAL" = "$UNPOOLED_TOTAL" ] || fail "bytes allocated: $POOLED_TOTAL with the pool, $UNPOOLED_TOTAL without"
+
+UNNARIZE_GC_YOUNG=0 timeout 20s "$BIN" --stats "$CHURN" > "$TMP_DIR/full.txt" 2> "$TMP_DIR/full_stats.txt"
+diff -q "$TMP_DIR/pooled.txt" "$TMP_DIR/full.txt" > /dev/null || fail "young collections changed program output"
+young() {
+    grep "^Young GC:" "$1" | awk '{print $3}'
+}
+YOUNG=$(young "$TMP_DIR/pooled_stats.txt")
+YOUNG_OFF=$(young "$TMP_DIR/full_stats.txt")
+if [ -z "$YOUNG" ] || [ "$YOUNG" -eq 0 ]; then
+    fail "no young collections in the churn"
+fi
+[ "$YOUNG_OFF" = "0" ] || fail "UNNARIZE_GC_YOUNG=0 still ran $YOUNG_OFF young collections"
+
+GENERATIONS="examples/garbagecollection/generational.unna"
+timeout 20s "$BIN" "$GENERATIONS" > "$TMP_DIR/generations.txt" 2>&1
+if [ $? -ne 0 ] || grep -q "FAILED" "$TMP_DIR/generations.txt"; then
+    fail "$GENERATIONS"
+    sed 's/^/      /' "$TMP_DIR/generations.txt"
+fi
+
+if [ "$FAILED" -eq 0 ]; then
+    echo -e "\033[0;32m PASS \033[0m memory statistics ($ARRAYS arrays, $TOTAL bytes)"
+    echo -e "\033[0;32m PASS \033[0m block pool ($NEW of $UNPOOLED_NEW blocks from malloc)"
+    echo -e "\033[0;32m PASS \033[0m generations ($YOUNG young collections in the churn)"
+    exit 0
+fi
+sed 's/^/      /' "$TMP_DIR/pooled_stats.txt"
+exit 1
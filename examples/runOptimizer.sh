@@ -0,0 +1,57 @@
+#!/bin/bash
+
+# Unnarize Optimizer Check
+# Runs every script in examples/optimizer/ and examples/basics/ twice, with
+# and without --no-optimize, and expects the same output both times. The
+# peephole optimizer must also remove instructions from every script in
+# examples/optimizer/. examples/disasm/peephole.unna (checked by
+# runDisassembly.sh) pins down the individual rewrites.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+FILES=$(find examples/optimizer examples/basics -name "*.unna" | sort)
+TOTAL=$(echo "$FILES" | wc -l)
+PASSED=0
+
+# Instructions in a disassembly listing
+count() {
+    "$BIN" disasm "$@" 2> /dev/null | grep -c '^[0-9]'
+}
+
+for f in $FILES; do
+    timeout 10s "$BIN" --no-optimize "$f" > "$TMP_DIR/plain.txt" 2>&1
+    timeout 10s "$BIN" "$f" > "$TMP_DIR/optimized.txt" 2>&1
+    if ! diff -q "$TMP_DIR/plain.txt" "$TMP_DIR/optimized.txt" > /dev/null; then
+        echo -e "\033[0;31m FAIL \033[0m $f (output differs)"
+        diff "$TMP_DIR/plain.txt" "$TMP_DIR/optimized.txt" | head -n 10 | sed 's/^/      /'
+        continue
+    fi
+    case "$f" in
+        examples/optimizer/*)
+            before=$(count --no-optimize "$f")
+            after=$(count "$f")
+            if [ "$after" -ge "$before" ]; then
+                echo -e "\033[0;31m FAIL \033[0m $f (nothing removed: $before instructions)"
+                continue
+            fi
+            echo -e "\033[0;32m PASS \033[0m $f ($before -> $after instructions)"
+            ;;
+        *)
+            echo -e "\033[0;32m PASS \033[0m $f"
+            ;;
+    esac
+    PASSED=$((PASSED + 1))
+done
+
+echo ""
+echo "Passed: $PASSED / $TOTAL"
+[ "$PASSED" -eq "$TOTAL" ]
@@ -0,0 +1,65 @@
+#!/bin/bash
+
+# Unnarize Buffered Output Check
+# print collects its output in a buffer (see OutputBuffer in vm.h). This
+# prints examples/output/many_lines.unna buffered and with --unbuffered,
+# which writes each line on its own, and requires the same bytes from both;
+# the two times are shown for comparison. The other scripts check that the
+# buffer is written out before an uncaught error is reported, on exit(),
+# before a shell command runs and when the script calls flush().
+
+BIN="./bin/unnarize"
+DIR="examples/output"
+LINES=200000
+
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    exit 1
+}
+
+# Seconds the command takes, with its output in the named file
+timed() {
+    local out="$1"
+    shift
+    local start end
+    start=$(date +%s%N)
+    timeout 60s "$@" > "$out" 2> /dev/null || fail "$* exited with status $?"
+    end=$(date +%s%N)
+    awk -v ns=$((end - start)) 'BEGIN { printf "%.3f", ns / 1e9 }'
+}
+
+BUFFERED=$(timed "$TMP_DIR/buffered.txt" "$BIN" "$DIR/many_lines.unna" "$LINES")
+UNBUFFERED=$(timed "$TMP_DIR/unbuffered.txt" "$BIN" --unbuffered "$DIR/many_lines.unna" "$LINES")
+cmp -s "$TMP_DIR/buffered.txt" "$TMP_DIR/unbuffered.txt" || fail "buffered and unbuffered output differ"
+[ "$(wc -l < "$TMP_DIR/buffered.txt")" -eq $((LINES + 1)) ] || fail "expected $((LINES + 1)) lines"
+[ "$(tail -n 1 "$TMP_DIR/buffered.txt")" = "$LINES lines" ] || fail "last line missing"
+
+# An uncaught error: every line is written, then the report
+timeout 10s "$BIN" "$DIR/error_after_print.unna" > "$TMP_DIR/error.txt" 2>&1
+[ $? -eq 1 ] || fail "uncaught error did not exit with status 1"
+[ "$(grep -c '^line ' "$TMP_DIR/error.txt")" -eq 3000 ] || fail "lines before the error were lost"
+[ "$(grep -A1 '^last line$' "$TMP_DIR/error.txt" | tail -n 1 | cut -c1-13)" = "Runtime Error" ] ||
+    fail "error report not after the printed lines"
+
+# exit() keeps its status and what was printed, newline or not
+timeout 10s "$BIN" "$DIR/exit_after_print.unna" > "$TMP_DIR/exit.txt" 2>&1
+[ $? -eq 3 ] || fail "exit() status not kept"
+[ "$(cat "$TMP_DIR/exit.txt")" = "$(printf 'before exit\nno newline')" ] || fail "output lost on exit()"
+
+# A shell command's output lands between the prints around it
+[ "$(timeout 10s "$BIN" "$DIR/exec_order.unna" | tr '\n' '|')" = "before|from the shell|after|" ] ||
+    fail "exec() output out of order"
+
+# flush() hands over "ready" while the script still sleeps
+FIRST=$(timeout 10s "$BIN" "$DIR/flush.unna" | { read -r -t 1 line; echo "$line"; cat > /dev/null; })
+[ "$FIRST" = "ready" ] || fail "flush() did not write the buffer out"
+
+echo -e "\033[0;32m PASS \033[0m buffered output ($LINES lines: ${BUFFERED}s buffered, ${UNBUFFERED}s unbuffered)"
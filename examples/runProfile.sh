@@ -0,0 +1,58 @@
+#!/bin/bash
+
+# Unnarize Profiler Check
+# Runs examples/profile/two_costs.unna with --profile and checks the report
+# on stderr: costly() ranks above cheap(), the call counts are exact, a
+# recursive function's total is not counted once per level, and the
+# program's own output is unchanged.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/profile/two_costs.unna"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+fail() {
+    echo -e "\033[0;31m FAIL \033[0m ($1)"
+    sed 's/^/      /' "$TMP_DIR/profile.txt"
+    exit 1
+}
+
+timeout 10s "$BIN" --profile "$SCRIPT" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/profile.txt"
+STATUS=$?
+[ "$STATUS" -eq 0 ] || fail "exit status $STATUS"
+
+"$BIN" "$SCRIPT" > "$TMP_DIR/plain.txt" 2>&1
+cmp -s "$TMP_DIR/out.txt" "$TMP_DIR/plain.txt" || fail "program output changed"
+
+grep -q "^=== Profile ===$" "$TMP_DIR/profile.txt" || fail "no profile header"
+
+# Rows are "  name calls total self", the most self time first
+rank() { awk -v f="$1" '$1 == f { print NR; exit }' "$TMP_DIR/profile.txt"; }
+field() { awk -v f="$1" -v n="$2" '$1 == f { print $n; exit }' "$TMP_DIR/profile.txt"; }
+
+COSTLY=$(rank costly)
+CHEAP=$(rank cheap)
+[ -n "$COSTLY" ] && [ -n "$CHEAP" ] || fail "missing a function"
+[ "$COSTLY" -lt "$CHEAP" ] || fail "cheap ranks above costly"
+
+for expected in "<script> 1" "cheap 2000" "costly 200" "fib 1973" "countdown 101"; do
+    set -- $expected
+    [ "$(field "$1" 2)" = "$2" ] || fail "$1 should have $2 calls"
+done
+
+# fib's total runs from the outermost call to its return, inside the script's
+awk -v a="$(field fib 3)" -v b="$(field '<script>' 3)" 'BEGIN { exit !(a <= b) }' ||
+    fail "fib total exceeds the script total"
+
+# Without --profile nothing is written to stderr
+"$BIN" "$SCRIPT" > /dev/null 2> "$TMP_DIR/stderr.txt"
+[ -s "$TMP_DIR/stderr.txt" ] && fail "stderr output without --profile"
+
+echo -e "\033[0;32m PASS \033[0m profile ($(grep -c '^  ' "$TMP_DIR/profile.txt") functions)"
@@ -0,0 +1,44 @@
+#!/bin/bash
+
+# Unnarize REPL Session Check
+# Feeds examples/repl/session.txt to the REPL on stdin and compares what
+# it prints (minus the version banner) with session.expected. The session
+# contains errors on purpose: they must be reported at the entry's line,
+# and later entries must still run. Writes to a const or an enum member
+# from a later entry are among them.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+timeout 10s "$BIN" < examples/repl/session.txt > "$TMP_DIR/out.txt" 2> "$TMP_DIR/err.txt"
+STATUS=$?
+tail -n +2 "$TMP_DIR/out.txt" > "$TMP_DIR/session.txt"
+
+if [ "$STATUS" -ne 0 ]; then
+    echo -e "\033[0;31m FAIL \033[0m (exit status $STATUS)"
+    sed 's/^/      /' "$TMP_DIR/err.txt"
+    exit 1
+fi
+
+if ! grep -q "Undefined variable" "$TMP_DIR/err.txt" || ! grep -qF "<repl> at line 1:" "$TMP_DIR/err.txt" ||
+   ! grep -qF "Cannot assign to constant 'K'" "$TMP_DIR/err.txt" ||
+   ! grep -qF "Cannot assign to constant 'GREEN'" "$TMP_DIR/err.txt"; then
+    echo -e "\033[0;31m FAIL \033[0m (expected error was not reported)"
+    exit 1
+fi
+
+if diff -q examples/repl/session.expected "$TMP_DIR/session.txt" > /dev/null; then
+    echo -e "\033[0;32m PASS \033[0m REPL session"
+else
+    echo -e "\033[0;31m FAIL \033[0m (output differs)"
+    diff examples/repl/session.expected "$TMP_DIR/session.txt" | head -n 10 | sed 's/^/      /'
+    exit 1
+fi
@@ -0,0 +1,49 @@
+#!/bin/bash
+
+# Unnarize Test Runner Check
+# Runs 'unnarize test' on each fixture directory in examples/testrunner and
+# compares the report with <dir>.expected and the exit status with the one
+# listed below: 'passing' holds only passing tests, 'failing' mixes passing
+# and failing asserts with a test that throws.
+
+BIN="./bin/unnarize"
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+PASSED=0
+FAILED=0
+
+check() {
+    local name="$1"
+    local want="$2"
+    local dir="examples/testrunner/$name"
+
+    timeout 10s "$BIN" test "$dir" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/err.txt"
+    local status=$?
+
+    if [ "$status" -ne "$want" ]; then
+        echo -e "\033[0;31m FAIL \033[0m $name (exit status $status, expected $want)"
+        sed 's/^/      /' "$TMP_DIR/err.txt"
+        FAILED=$((FAILED + 1))
+    elif diff -q "$dir.expected" "$TMP_DIR/out.txt" > /dev/null; then
+        echo -e "\033[0;32m PASS \033[0m $name"
+        PASSED=$((PASSED + 1))
+    else
+        echo -e "\033[0;31m FAIL \033[0m $name (output differs)"
+        diff "$dir.expected" "$TMP_DIR/out.txt" | head -n 10 | sed 's/^/      /'
+        FAILED=$((FAILED + 1))
+    fi
+}
+
+check passing 0
+check failing 1
+
+echo "Test runner: $PASSED passed, $FAILED failed"
+[ "$FAILED" -eq 0 ]
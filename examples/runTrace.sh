@@ -0,0 +1,77 @@
+#!/bin/bash
+
+# Unnarize Execution Trace Check
+# Runs examples/trace/tiny.unna with --trace and checks that the trace on
+# stderr contains the key instructions below in this order, each in the
+# expected frame, and that the program's own output is unchanged. Other
+# instructions may appear in between.
+
+BIN="./bin/unnarize"
+SCRIPT="examples/trace/tiny.unna"
+
+EXPECTED=(
+    "[1 <script>] DEFGLOBAL"     # function add
+    "[1 <script>] NEWARRAY"      # [1, 2]
+    "[1 <script>] PUSH"
+    "[1 <script>] FOREACH_PREP"  # for (var x : xs)
+    "[1 <script>] FOREACH_NEXT"
+    "[1 <script>] CALL"          # add(total, x)
+    "[2 add] ADD"
+    "[2 add] RETURN"
+    "[1 <script>] SETGLOBAL"     # total = ...
+    "[1 <script>] LOOP"
+    "[1 <script>] CALL"          # second iteration
+    "[2 add] ADD"
+    "[1 <script>] FOREACH_NEXT"  # loop exit
+    "[1 <script>] PRINT"         # print(total)
+    "[1 <script>] RETURNNIL"
+)
+
+# Ensure binary exists
+if [ ! -f "$BIN" ]; then
+    echo "Error: Binary not found at $BIN. Please run 'make' first."
+    exit 1
+fi
+
+TMP_DIR=$(mktemp -d)
+trap 'rm -rf "$TMP_DIR"' EXIT
+
+timeout 10s "$BIN" --trace "$SCRIPT" > "$TMP_DIR/out.txt" 2> "$TMP_DIR/trace.txt"
+STATUS=$?
+if [ "$STATUS" -ne 0 ]; then
+    echo -e "\033[0;31m FAIL \033[0m (exit status $STATUS)"
+    tail -n 5 "$TMP_DIR/trace.txt" | sed 's/^/      /'
+    exit 1
+fi
+
+if [ "$(cat "$TMP_DIR/out.txt")" != "3" ]; then
+    echo -e "\033[0;31m FAIL \033[0m (program output changed)"
+    sed 's/^/      /' "$TMP_DIR/out.txt"
+    exit 1
+fi
+
+# Frame and opcode of each traced instruction: "[depth name] OPCODE"
+sed -E 's/^(\[[^]]*\]) +[0-9]+ +[0-9]+ +([A-Z_]+).*/\1 \2/' "$TMP_DIR/trace.txt" > "$TMP_DIR/ops.txt"
+
+# Walk the trace once, matching the expected entries in order
+next=0
+while IFS= read -r line && [ "$next" -lt "${#EXPECTED[@]}" ]; do
+    if [ "$line" = "${EXPECTED[$next]}" ]; then
+        next=$((next + 1))
+    fi
+done < "$TMP_DIR/ops.txt"
+
+if [ "$next" -ne "${#EXPECTED[@]}" ]; then
+    echo -e "\033[0;31m FAIL \033[0m (missing \"${EXPECTED[$next]}\" after ${next} matches)"
+    head -n 20 "$TMP_DIR/trace.txt" | sed 's/^/      /'
+    exit 1
+fi
+
+# Without --trace nothing is written to stderr
+"$BIN" "$SCRIPT" > /dev/null 2> "$TMP_DIR/plain.txt"
+if [ -s "$TMP_DIR/plain.txt" ]; then
+    echo -e "\033[0;31m FAIL \033[0m (stderr output without --trace)"
+    exit 1
+fi
+
+echo -e "\033[0;32m PASS \033[0m execution trace ($(wc -l < "$TMP_DIR/ops.txt") instructions)"
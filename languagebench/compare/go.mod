@@ -0,0 +1,3 @@
+module github.com/gtkrshnaaa/unnarize/languagebench/compare
+
+go 1.21
@@ -0,0 +1,161 @@
+// Unnarize vs Go Benchmark Comparison
+//
+// Runs bench_unnarize.unna and bench_go.go, which share benchmarks and
+// iteration counts, parses the printResult lines of both and prints them
+// side by side with how many times slower Unnarize is on each.
+//
+// From languagebench/:
+//
+//	go run compare/main.go
+//	go run compare/main.go -unnarize-output a.txt -go-output b.txt
+//
+// The second form parses saved outputs instead of running the programs.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Result is one printResult line: "  Name | 123.45 OPS/sec | 0.1234s"
+type Result struct {
+	Name string
+	Ops  float64
+	Sec  float64
+}
+
+// Comparison pairs the two results of one benchmark. Slowdown is Go's
+// OPS/sec over Unnarize's, or 0 when either side is missing.
+type Comparison struct {
+	Name     string
+	Unnarize *Result
+	Go       *Result
+	Slowdown float64
+}
+
+var resultLine = regexp.MustCompile(`^\s*(.*?)\s*\|\s*([0-9.eE+]+)\s+(?i:OPS/sec)\s*\|\s*([0-9.eE+]+)\s*s\s*$`)
+
+// ParseResults reads the printResult lines of a benchmark program's output
+// and ignores everything else (banners, table rules, diagnostics). The
+// OPS/sec marker is matched in any case.
+func ParseResults(r io.Reader) ([]Result, error) {
+	var results []Result
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := resultLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ops, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad OPS/sec in %q: %v", line, err)
+		}
+		sec, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad time in %q: %v", line, err)
+		}
+		results = append(results, Result{Name: m[1], Ops: ops, Sec: sec})
+	}
+	return results, scanner.Err()
+}
+
+// Compare matches benchmarks by name, in Unnarize's order followed by any
+// only Go ran
+func Compare(unnarize, golang []Result) []Comparison {
+	var rows []Comparison
+	index := map[string]int{}
+	for i := range unnarize {
+		index[unnarize[i].Name] = len(rows)
+		rows = append(rows, Comparison{Name: unnarize[i].Name, Unnarize: &unnarize[i]})
+	}
+	for i := range golang {
+		row, ok := index[golang[i].Name]
+		if !ok {
+			row = len(rows)
+			rows = append(rows, Comparison{Name: golang[i].Name})
+		}
+		rows[row].Go = &golang[i]
+	}
+	for i := range rows {
+		u, g := rows[i].Unnarize, rows[i].Go
+		if u != nil && g != nil && u.Ops > 0 {
+			rows[i].Slowdown = g.Ops / u.Ops
+		}
+	}
+	return rows
+}
+
+func formatOps(r *Result) string {
+	if r == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(r.Ops, 'f', 2, 64)
+}
+
+// PrintTable writes the comparison in the column layout of printResult
+func PrintTable(w io.Writer, rows []Comparison) {
+	rule := "  ---------------------------------------------------------------------"
+	fmt.Fprintln(w, rule)
+	fmt.Fprintf(w, "  %-15s | %18s | %18s | %s\n", "Benchmark", "Unnarize OPS/sec", "Go OPS/sec", "Slowdown")
+	fmt.Fprintln(w, rule)
+	for _, row := range rows {
+		slowdown := "-"
+		if row.Slowdown > 0 {
+			slowdown = fmt.Sprintf("%.2fx", row.Slowdown)
+		}
+		fmt.Fprintf(w, "  %-15s | %18s | %18s | %8s\n", row.Name, formatOps(row.Unnarize), formatOps(row.Go), slowdown)
+	}
+	fmt.Fprintln(w, rule)
+}
+
+// Results of a saved output file, or of running the command when there is none
+func collect(name, savedOutput string, command ...string) ([]Result, error) {
+	if savedOutput != "" {
+		f, err := os.Open(savedOutput)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ParseResults(f)
+	}
+	fmt.Fprintf(os.Stderr, "Running %s benchmarks...\n", name)
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", strings.Join(command, " "), err)
+	}
+	return ParseResults(bytes.NewReader(out))
+}
+
+func main() {
+	binary := flag.String("unnarize", "../bin/unnarize", "Unnarize interpreter to run")
+	unnarizeOutput := flag.String("unnarize-output", "", "parse this saved output of bench_unnarize.unna instead of running it")
+	goOutput := flag.String("go-output", "", "parse this saved output of bench_go.go instead of running it")
+	flag.Parse()
+
+	unnarize, err := collect("Unnarize", *unnarizeOutput, *binary, "bench_unnarize.unna")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	golang, err := collect("Go", *goOutput, "go", "run", "bench_go.go")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	if len(unnarize) == 0 || len(golang) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no benchmark results found")
+		os.Exit(1)
+	}
+	PrintTable(os.Stdout, Compare(unnarize, golang))
+}
@@ -0,0 +1,213 @@
+// Tests for the comparison runner. From languagebench/compare:
+//
+//	go test ./...
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Result
+		wantErr string
+	}{
+		{
+			name:  "printResult line",
+			input: "  Integer Add     |   3328827831.44 OPS/sec | 0.3004s\n",
+			want:  []Result{{Name: "Integer Add", Ops: 3328827831.44, Sec: 0.3004}},
+		},
+		{
+			name:  "older lower-case marker",
+			input: "  Fibonacci | 1250.5 ops/sec | 2s\n",
+			want:  []Result{{Name: "Fibonacci", Ops: 1250.5, Sec: 2}},
+		},
+		{
+			name:  "exponent in the numbers",
+			input: "  Loop | 1.5e+09 OPS/sec | 2.5E+1s\n",
+			want:  []Result{{Name: "Loop", Ops: 1.5e9, Sec: 25}},
+		},
+		{
+			name: "banners, rules and diagnostics skipped",
+			input: "Tokenized 593 tokens successfully.\n" +
+				">>> Unnarize Benchmark Suite <<<\n" +
+				"  -------------------------------------------------------------\n" +
+				"  Benchmark       |     Performance     | Time\n" +
+				"  String Concat   |   200000.00 OPS/sec | 0.0625s\n" +
+				"\n",
+			want: []Result{{Name: "String Concat", Ops: 200000, Sec: 0.0625}},
+		},
+		{
+			name: "malformed lines skipped",
+			input: "  No Time | 100 OPS/sec\n" +
+				"  No Rate | 100 | 1s\n" +
+				"  Words | fast OPS/sec | 1s\n" +
+				"  Trailing | 100 OPS/sec | 1s extra\n",
+			want: nil,
+		},
+		{
+			name:    "bad OPS/sec",
+			input:   "  Broken | 1.2.3 OPS/sec | 1s\n",
+			wantErr: "bad OPS/sec",
+		},
+		{
+			name:    "bad time",
+			input:   "  Broken | 100 OPS/sec | 1e+s\n",
+			wantErr: "bad time",
+		},
+		{
+			name:  "empty output",
+			input: "",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResults(strings.NewReader(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseResults() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseResults() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseResults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	type row struct {
+		name     string
+		unnarize bool
+		golang   bool
+		slowdown float64
+	}
+	tests := []struct {
+		name     string
+		unnarize []Result
+		golang   []Result
+		want     []row
+	}{
+		{
+			name:     "matched by name",
+			unnarize: []Result{{Name: "Add", Ops: 100}, {Name: "Loop", Ops: 50}},
+			golang:   []Result{{Name: "Loop", Ops: 500}, {Name: "Add", Ops: 250}},
+			want:     []row{{"Add", true, true, 2.5}, {"Loop", true, true, 10}},
+		},
+		{
+			name:     "missing from Go",
+			unnarize: []Result{{Name: "Add", Ops: 100}, {Name: "Strings", Ops: 10}},
+			golang:   []Result{{Name: "Add", Ops: 100}},
+			want:     []row{{"Add", true, true, 1}, {"Strings", true, false, 0}},
+		},
+		{
+			name:     "only Go ran it, listed last",
+			unnarize: []Result{{Name: "Add", Ops: 100}},
+			golang:   []Result{{Name: "Channels", Ops: 10}, {Name: "Add", Ops: 300}},
+			want:     []row{{"Add", true, true, 3}, {"Channels", false, true, 0}},
+		},
+		{
+			name:     "zero Unnarize rate has no slowdown",
+			unnarize: []Result{{Name: "Add", Ops: 0}},
+			golang:   []Result{{Name: "Add", Ops: 100}},
+			want:     []row{{"Add", true, true, 0}},
+		},
+		{
+			name: "no results",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []row
+			for _, c := range Compare(tt.unnarize, tt.golang) {
+				got = append(got, row{c.Name, c.Unnarize != nil, c.Go != nil, c.Slowdown})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Compare() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintTable(t *testing.T) {
+	tests := []struct {
+		name string
+		rows []Comparison
+		want string
+	}{
+		{
+			name: "ratio to two places",
+			rows: Compare([]Result{{Name: "Add", Ops: 3}}, []Result{{Name: "Add", Ops: 10}}),
+			want: "  Add             |               3.00 |              10.00 |    3.33x",
+		},
+		{
+			name: "ratio rounded up",
+			rows: Compare([]Result{{Name: "Add", Ops: 1000}}, []Result{{Name: "Add", Ops: 28456}}),
+			want: "  Add             |            1000.00 |           28456.00 |   28.46x",
+		},
+		{
+			name: "Go faster than one",
+			rows: Compare([]Result{{Name: "Add", Ops: 400}}, []Result{{Name: "Add", Ops: 100}}),
+			want: "  Add             |             400.00 |             100.00 |    0.25x",
+		},
+		{
+			name: "missing side",
+			rows: Compare([]Result{{Name: "Strings", Ops: 12.345}}, nil),
+			want: "  Strings         |              12.35 |                  - |        -",
+		},
+	}
+	rule := "  ---------------------------------------------------------------------"
+	header := "  Benchmark       |   Unnarize OPS/sec |         Go OPS/sec | Slowdown"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			PrintTable(&out, tt.rows)
+			want := strings.Join([]string{rule, header, rule, tt.want, rule, ""}, "\n")
+			if out.String() != want {
+				t.Errorf("PrintTable() =\n%s\nwant\n%s", out.String(), want)
+			}
+		})
+	}
+}
+
+// The saved outputs in testdata give the table in expected.txt, as
+// examples/runBenchComparison.sh checks through main()
+func TestSavedOutputs(t *testing.T) {
+	dir := "testdata/"
+	parse := func(name string) []Result {
+		f, err := os.Open(dir + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		results, err := ParseResults(f)
+		if err != nil {
+			t.Fatalf("ParseResults(%s) error = %v", name, err)
+		}
+		if len(results) == 0 {
+			t.Fatalf("ParseResults(%s) found no results", name)
+		}
+		return results
+	}
+	want, err := os.ReadFile(dir + "expected.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	PrintTable(&out, Compare(parse("unnarize.txt"), parse("go.txt")))
+	if out.String() != string(want) {
+		t.Errorf("table differs from expected.txt:\n%s", out.String())
+	}
+}
@@ -0,0 +1,29 @@
+#!/bin/bash
+
+# Dispatch Comparison
+# Builds the interpreter twice, with computed-goto (threaded) dispatch and
+# with the portable switch loop (make DISPATCH=switch), and runs the
+# dispatch-bound loops of bench_dispatch.unna on each.
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+ROOT_DIR="$(cd "$SCRIPT_DIR/.." && pwd)"
+BUILD_DIR=$(mktemp -d)
+trap 'rm -rf "$BUILD_DIR"' EXIT
+
+cd "$ROOT_DIR" || exit 1
+for mode in switch threaded; do
+    dispatch=""
+    if [ "$mode" = "switch" ]; then dispatch="switch"; fi
+    if ! make -s OBJ_DIR="$BUILD_DIR/$mode/obj" BIN_DIR="$BUILD_DIR/$mode/bin" DISPATCH="$dispatch" > /dev/null; then
+        echo "Build failed ($mode)"
+        exit 1
+    fi
+done
+
+CPU_INFO=$(grep "model name" /proc/cpuinfo | head -n 1 | cut -d ':' -f 2 | xargs)
+echo "Dispatch comparison on: $CPU_INFO"
+for mode in switch threaded; do
+    echo ""
+    echo "--- $mode dispatch ---"
+    "$BUILD_DIR/$mode/bin/unnarize" "$SCRIPT_DIR/bench_dispatch.unna"
+done
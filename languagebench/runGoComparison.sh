@@ -0,0 +1,18 @@
+#!/bin/bash
+
+# Unnarize vs Go Comparison
+# Builds Unnarize, then runs bench_unnarize.unna and bench_go.go through
+# compare/main.go, which prints their OPS/sec side by side with the
+# slowdown factor of each benchmark.
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+ROOT_DIR="$(cd "$SCRIPT_DIR/.." && pwd)"
+
+if ! command -v go &> /dev/null; then
+    echo "Go not found. Please install: sudo apt install golang-go"
+    exit 1
+fi
+
+cd "$ROOT_DIR" && make -s || exit 1
+cd "$SCRIPT_DIR" || exit 1
+go run compare/main.go -unnarize "$ROOT_DIR/bin/unnarize"